@@ -6,23 +6,95 @@ import (
 	"github.com/sergev/floppy/hfe"
 )
 
-// FloppyAdapter defines the interface for floppy disk adapters
+// Terminology of the adapter API: a cylinder is a position of the heads,
+// numbered from 0 at the outer edge of the disk, and a head (side) selects
+// one surface. A track is one side of a cylinder, always addressed by
+// cylinder and head. HFE images call cylinders tracks (Header.NumberOfTrack,
+// Disk.Tracks), and some devices number tracks as cylinder*2+head: such
+// numbers are converted only where they are sent to the device.
+
+// FloppyAdapter defines the interface for floppy disk adapters.
+// Its methods may be called from several goroutines: while one operation
+// is talking to the device, others fail with ErrBusy (PrintStatus prints
+// a notice instead). Lower-level methods of adapter clients are not guarded.
 type FloppyAdapter interface {
 	// PrintStatus prints adapter status information to stdout
 	PrintStatus()
 
-	// Read reads the entire floppy disk and returns it as a disk object
-	Read(numberOfTracks int) (*hfe.Disk, error)
+	// Read reads cylinders 0 to numberOfCylinders-1 of the floppy disk,
+	// limited by ReadOpts, and returns it as a disk object.
+	// When w is not nil, every track is also saved to it as soon as it is read.
+	Read(numberOfCylinders int, w *hfe.Writer) (*hfe.Disk, error)
+
+	// ReadTrack reads one track into memory, and decodes it with
+	// rates measured on the track itself, unless forced by ReadOpts
+	ReadTrack(cyl, head int) (*TrackCapture, error)
+
+	// Write writes the first numberOfCylinders cylinders of the disk object
+	// to the floppy disk. Image marked as write protected is refused
+	// with ErrImageReadOnly unless WriteOpts.Force is set,
+	// see hfe.Disk.IsWriteProtected.
+	Write(disk *hfe.Disk, numberOfCylinders int) error
 
-	// Write writes data from the disk object to the floppy disk
-	Write(disk *hfe.Disk, numberOfTracks int) error
+	// WriteTrackFlux writes raw flux to one track, for example to preserve
+	// copy protection. Transitions are intervals between flux reversals,
+	// in nanoseconds. When cueToIndex is set, writing starts at the index pulse.
+	WriteTrackFlux(cyl, head int, transitions []uint64, cueToIndex bool) error
 
 	// Format formats the floppy disk
 	Format() error
 
-	// Erase erases the floppy disk
-	Erase(numberOfTracks int) error
+	// Erase erases cylinders 0 to numberOfCylinders-1 of the floppy disk,
+	// on every head of the drive
+	Erase(numberOfCylinders int) error
+
+	// Calibrate verifies the track 0 sensor and times a full-stroke seek
+	Calibrate() error
+
+	// MeasureRPM measures rotation speed over the given number of revolutions.
+	// Returns mean speed and its standard deviation, in RPM.
+	MeasureRPM(revolutions int) (mean float64, stddev float64, err error)
+
+	// DiskPresent reports whether a disk is inserted in the drive.
+	// Adapters which sense the disk change line may step the head
+	// to clear the line, and return it to its cylinder. Other adapters
+	// spin the disk and look for index pulses, and KryoFlux moves
+	// the head to cylinder 0 for that. See Capability.
+	// Returns ErrNotSupported when the adapter cannot detect it.
+	DiskPresent() (bool, error)
+
+	// IsWriteProtected reports whether the disk in the drive is write protected.
+	// Returns ErrNotSupported when the adapter cannot sense the write protect
+	// line: then protection shows only as a failed write. See Capability.
+	IsWriteProtected() (bool, error)
+
+	// Capabilities reports what the adapter can do, with its firmware.
+	// Operations it cannot do return ErrNotSupported.
+	Capabilities() Capability
+}
+
+// Capability describes what an adapter can do, so that callers
+// offer only the actions which are supported
+type Capability struct {
+	CanRead               bool // Read and ReadTrack
+	CanWrite              bool // Write
+	CanWriteFlux          bool // WriteTrackFlux
+	CanErase              bool // Erase
+	CanFormat             bool // Format
+	MaxRevolutions        int  // Most revolutions captured by one track read, 0 = no fixed limit
+	SupportsDensitySelect bool // Drives the density select line
+	SupportsDoubleStep    bool // Steps twice per cylinder, for 40-track disks in 80-track drives
+	SensesDiskChange      bool // DiskPresent reads the disk change line, instead of spinning the disk
+	SensesWriteProtect    bool // IsWriteProtected reads the write protect line, instead of ErrNotSupported
+	MaxCylinders          int  // Number of cylinders the head may step to
 }
 
 // NewClientFunc is a function type that creates a new adapter client
 type NewClientFunc func(portDetails *enumerator.PortDetails) (FloppyAdapter, error)
+
+// Describer is implemented by adapters which can identify themselves
+// in the manifest of a disk image
+type Describer interface {
+	// Describe returns type, serial number and versions of the adapter
+	Describe() hfe.ManifestDevice
+}
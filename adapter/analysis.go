@@ -0,0 +1,42 @@
+package adapter
+
+import "github.com/sergev/floppy/mfm"
+
+// FluxFunc receives flux transitions of one track before PLL decoding.
+// Transition times are in nanoseconds, relative to the index pulse.
+type FluxFunc func(cyl, head int, transitions []uint64)
+
+// FluxHook, when set, is invoked by adapters for every track read.
+// It is used for analysis of bad reads, and is nil by default.
+var FluxHook FluxFunc
+
+// LayoutFunc receives alignment of sectors to the index on one track
+type LayoutFunc func(cyl, head int, layout *mfm.TrackLayout)
+
+// LayoutHook, when set, is invoked by adapters for every track read,
+// which has IBM PC sectors. It is nil by default.
+var LayoutHook LayoutFunc
+
+// AnalysisEnabled reports whether adapters must pass flux data to FluxHook
+func AnalysisEnabled() bool {
+	return FluxHook != nil
+}
+
+// ReportFlux passes flux transitions of the track to FluxHook, when set
+func ReportFlux(cyl, head int, transitions []uint64) {
+	if FluxHook != nil {
+		FluxHook(cyl, head, transitions)
+	}
+}
+
+// ReportLayout finds sectors and gaps of the track, and passes them
+// to LayoutHook, when set. MFM bitcells must start at the index pulse,
+// so the track is analyzed before RevolutionMFM.
+func ReportLayout(cyl, head int, bits []byte, bitRate uint16) {
+	if LayoutHook == nil {
+		return
+	}
+	if layout := mfm.AnalyzeLayoutIBMPC(bits, bitRate); layout != nil {
+		LayoutHook(cyl, head, layout)
+	}
+}
@@ -0,0 +1,54 @@
+package adapter
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Busy serializes operations of an adapter client.
+// Every operation exchanges a sequence of commands with the device,
+// and two of them running at once would interleave protocol bytes.
+// Instead of waiting, a second operation fails with ErrBusy,
+// so that a status poller does not stall until a long read completes.
+type Busy struct {
+	Motor *Motor // Drive motor to stop when idle, or nil
+
+	mu       sync.Mutex
+	stopping atomic.Bool // Idle timer is stopping the motor
+}
+
+// Begin starts an operation, or returns ErrBusy when another one is in progress
+func (b *Busy) Begin() error {
+	if !b.mu.TryLock() {
+		if !b.stopping.Load() {
+			return ErrBusy
+		}
+		// Stopping the idle motor takes a moment: wait for it
+		b.mu.Lock()
+	}
+	if b.Motor != nil {
+		b.Motor.cancel()
+	}
+	return nil
+}
+
+// End finishes the operation started by Begin.
+// Motor left running is stopped after idle time.
+func (b *Busy) End() {
+	if b.Motor != nil && b.Motor.running {
+		b.Motor.arm(b)
+	}
+	b.mu.Unlock()
+}
+
+// Called by the idle timer. When another operation has begun
+// in the meantime, the motor is left running for it.
+func (b *Busy) stopIdle() {
+	b.stopping.Store(true)
+	defer b.stopping.Store(false)
+	if !b.mu.TryLock() {
+		return
+	}
+	defer b.mu.Unlock()
+	b.Motor.Off()
+}
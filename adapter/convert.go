@@ -1,7 +1,9 @@
 package adapter
 
 import (
+	"errors"
 	"fmt"
+	"os"
 
 	"github.com/sergev/floppy/hfe"
 	"github.com/spf13/cobra"
@@ -12,30 +14,77 @@ var convertCmd = &cobra.Command{
 	Short: "Convert between image formats",
 	Long: `Convert between image formats.
 Reads contents of the SRC.EXT file and writes it to DEST.EXT file.
-Format of floppy image is defined by extension.
+Format of source image is detected from its contents when possible;
+format of destination image is defined by extension.
+Existing DEST.EXT file is not replaced unless --force is given.
 USB adapter is not used.
 ` + supportedImageFormatsText,
 	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 		srcFilename := args[0]
 		destFilename := args[1]
+		convertOpts.Trim = trimOptions()
+		convertOpts.Identify = true
 
-		// Read source file
-		disk, err := hfe.Read(srcFilename)
-		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to read file %s: %w", srcFilename, err))
+		report, err := hfe.Convert(srcFilename, destFilename, convertOpts)
+		if errors.Is(err, os.ErrExist) {
+			cobra.CheckErr(fmt.Errorf("file %s already exists, use --force to overwrite", destFilename))
 		}
+		cobra.CheckErr(err)
 
-		// Write destination file
-		err = hfe.Write(destFilename, disk)
-		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to write file %s: %w", destFilename, err))
+		if report.Identification != nil {
+			fmt.Printf("Disk: %s\n", report.Identification)
+		}
+		for _, warning := range report.Warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+		printTrimReport(report.Trim)
+		if report.ReadOnly {
+			fmt.Printf("Note: source image is write protected, which %s format cannot record.\n", report.DestFormat)
+		}
+		if report.Sectors > 0 {
+			fmt.Printf("Converted %d sectors, %d missing.\n", report.Sectors, report.Missing)
 		}
-
 		fmt.Printf("Successfully converted %s to %s\n", srcFilename, destFilename)
 	},
 }
 
+// Options of the convert command
+var convertOpts hfe.ConvertOptions
+
+// Trimming of trailing cylinders, requested by --trim or --tracks
+var (
+	trimDisk   bool
+	trimTracks int
+)
+
+// Return trimming options given by user, or nil when trimming is not requested
+func trimOptions() *hfe.TrimOptions {
+	if !trimDisk && trimTracks == 0 {
+		return nil
+	}
+	return &hfe.TrimOptions{Tracks: trimTracks}
+}
+
+// Print cylinders removed by trimming
+func printTrimReport(report *hfe.TrimReport) {
+	if report == nil {
+		return
+	}
+	for _, msg := range report.Messages() {
+		fmt.Printf("Trim: %s\n", msg)
+	}
+}
+
 func init() {
+	convertCmd.Flags().BoolVarP(&convertOpts.Overwrite, "force", "f", false, "overwrite existing destination file")
+	convertCmd.Flags().IntVar(&convertOpts.Cylinders, "cylinders", 0, "number of `cylinders` to convert, 0 for all")
+	convertCmd.Flags().IntVar(&convertOpts.Sides, "sides", 0, "number of sides to convert, 0 for all")
+	convertCmd.Flags().BoolVar(&convertOpts.Manifest, "manifest", false, "save description of the image to DEST.EXT.json")
+	convertCmd.Flags().IntVar((*int)(&convertOpts.HFEVersion), "hfe-version", 0, "version of HFE file: 1 or 3, 0 for automatic")
+	convertCmd.Flags().StringVar(&convertOpts.Template, "template", "", "take header fields of HFE file from `FILE.hfe`, like interface mode and write protection")
+	convertCmd.Flags().BoolVar(&convertOpts.StrictDuplicates, "strict-duplicates", false, "fail when a track has several sectors with the same ID")
+	convertCmd.Flags().BoolVar(&trimDisk, "trim", false, "remove empty and duplicate cylinders at the end of disk")
+	convertCmd.Flags().IntVar(&trimTracks, "tracks", 0, "trim or pad the disk to `N` cylinders: 40, 80, 82 or 83")
 	rootCmd.AddCommand(convertCmd)
 }
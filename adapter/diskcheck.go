@@ -0,0 +1,32 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CheckWritable verifies that a disk is inserted and not write protected,
+// before an operation which destroys its contents. Functions present
+// and protected query the drive; a check the adapter does not support
+// is skipped. Users may turn off all checks with WriteOpts.NoDiskCheck,
+// for drives which report these signals incorrectly.
+func CheckWritable(present, protected func() (bool, error)) error {
+	if WriteOpts.NoDiskCheck {
+		return nil
+	}
+	ok, err := present()
+	if err != nil && !errors.Is(err, ErrNotSupported) {
+		return fmt.Errorf("failed to check for disk: %w", err)
+	}
+	if err == nil && !ok {
+		return ErrNoDisk
+	}
+	ok, err = protected()
+	if err != nil && !errors.Is(err, ErrNotSupported) {
+		return fmt.Errorf("failed to check write protection: %w", err)
+	}
+	if err == nil && ok {
+		return ErrWriteProtected
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package adapter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sergev/floppy/hfe"
+)
+
+func TestCheckWritable(t *testing.T) {
+	yes := func() (bool, error) { return true, nil }
+	no := func() (bool, error) { return false, nil }
+	unknown := func() (bool, error) { return false, ErrNotSupported }
+	broken := func() (bool, error) { return false, ErrDeviceGone }
+
+	testCases := []struct {
+		name      string
+		present   func() (bool, error)
+		protected func() (bool, error)
+		expected  error
+	}{
+		{"writable", yes, no, nil},
+		{"no disk", no, no, ErrNoDisk},
+		{"protected", yes, yes, ErrWriteProtected},
+		{"not supported", unknown, unknown, nil},
+		{"no disk detection", unknown, yes, ErrWriteProtected},
+		{"failed", broken, no, ErrDeviceGone},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckWritable(tc.present, tc.protected)
+			if tc.expected == nil && err != nil {
+				t.Errorf("CheckWritable() error: %v", err)
+			}
+			if tc.expected != nil && !errors.Is(err, tc.expected) {
+				t.Errorf("CheckWritable() error = %v, expected %v", err, tc.expected)
+			}
+		})
+	}
+
+	// All checks are skipped on request
+	defer func(skip bool) { WriteOpts.NoDiskCheck = skip }(WriteOpts.NoDiskCheck)
+	WriteOpts.NoDiskCheck = true
+	if err := CheckWritable(no, yes); err != nil {
+		t.Errorf("CheckWritable() with NoDiskCheck error: %v", err)
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	disk := &hfe.Disk{}
+	disk.SetWriteProtect(false)
+	if err := WriteOpts.CheckImage(disk); err != nil {
+		t.Errorf("CheckImage() error: %v", err)
+	}
+
+	disk.SetWriteProtect(true)
+	if err := WriteOpts.CheckImage(disk); !errors.Is(err, ErrImageReadOnly) {
+		t.Errorf("CheckImage() error = %v, expected %v", err, ErrImageReadOnly)
+	}
+
+	// Written anyway on request
+	defer func(force bool) { WriteOpts.Force = force }(WriteOpts.Force)
+	WriteOpts.Force = true
+	if err := WriteOpts.CheckImage(disk); err != nil {
+		t.Errorf("CheckImage() with Force error: %v", err)
+	}
+}
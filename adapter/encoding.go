@@ -0,0 +1,47 @@
+package adapter
+
+import (
+	"github.com/sergev/floppy/hfe"
+)
+
+// EncodingDetector finds encoding of the disk being read, and keeps
+// header of the disk up to date. Encoding is detected on the first
+// track read with IBM PC or Amiga sectors.
+type EncodingDetector struct {
+	detected bool // Encoding is known
+	warned   bool // Unknown encoding was reported
+}
+
+// Update sets encoding and interface mode of the disk, after the track
+// of the capture is stored, and bit rate of the disk is known
+func (d *EncodingDetector) Update(disk *hfe.Disk, capture *TrackCapture) {
+	h := &disk.Header
+	if d.detected {
+		h.SetEncoding(h.TrackEncoding)
+		return
+	}
+	h.SetEncoding(hfe.DetectEncoding(capture.MFM, capture.Cyl, capture.Head))
+	switch {
+	case h.TrackEncoding == hfe.ENC_ISOIBM_MFM:
+		d.detected = true
+	case h.TrackEncoding != hfe.ENC_Unknown:
+		d.detected = true
+		Progressf("\nDetected %s encoding on track %d, side %d\n", h.EncodingName(), capture.Cyl, capture.Head)
+	case !d.warned:
+		d.warned = true
+		Progressf("\nWarning: no IBM PC or Amiga sectors on track %d, side %d, encoding unknown\n",
+			capture.Cyl, capture.Head)
+	}
+}
+
+// Report returns encoding of the disk for the user, when it is not IBM PC,
+// or empty string
+func (d *EncodingDetector) Report(disk *hfe.Disk) string {
+	switch {
+	case !d.detected && d.warned:
+		return "Warning: no IBM PC or Amiga sectors found, track encoding unknown."
+	case d.detected && disk.Header.TrackEncoding != hfe.ENC_ISOIBM_MFM:
+		return "Track encoding: " + disk.Header.EncodingName() + "."
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package adapter
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+)
+
+// Sectors of 512 bytes, filled with their numbers
+func makeSectors(n int) [][]byte {
+	sectors := make([][]byte, n)
+	for i := range sectors {
+		sectors[i] = bytes.Repeat([]byte{byte(i)}, 512)
+	}
+	return sectors
+}
+
+func TestEncodingDetector(t *testing.T) {
+	ibm := mfm.NewWriter(100000).EncodeTrackIBMPC(makeSectors(9), 0, 1, 9, 250)
+	amiga := mfm.NewWriter(100000).EncodeTrackAmiga(makeSectors(11), 1)
+	noise := make([]byte, 12500)
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	tests := []struct {
+		name     string
+		tracks   [][]byte // Tracks read, all at cylinder 0, side 1
+		bitRate  uint16
+		encoding uint8
+		mode     uint8
+		messages int
+		report   string
+	}{
+		{"ibm", [][]byte{ibm}, 250, hfe.ENC_ISOIBM_MFM, hfe.IFM_IBMPC_DD, 0, ""},
+		{"ibm hd", [][]byte{ibm}, 500, hfe.ENC_ISOIBM_MFM, hfe.IFM_IBMPC_HD, 0, ""},
+		{"amiga", [][]byte{amiga, ibm}, 250, hfe.ENC_Amiga_MFM, hfe.IFM_Amiga_DD, 1, "Track encoding: Amiga MFM."},
+		{"amiga hd", [][]byte{amiga}, 500, hfe.ENC_Amiga_MFM, hfe.IFM_Amiga_HD, 1, "Track encoding: Amiga MFM."},
+		{"unknown", [][]byte{noise, noise}, 250, hfe.ENC_Unknown, hfe.IFM_IBMPC_DD, 1, "Warning: no IBM PC or Amiga sectors found"},
+		{"unformatted first", [][]byte{noise, amiga}, 250, hfe.ENC_Amiga_MFM, hfe.IFM_Amiga_DD, 2, "Track encoding: Amiga MFM."},
+	}
+	defer func(p ProgressFunc) { Progress = p }(Progress)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var messages []string
+			Progress = func(message string) { messages = append(messages, message) }
+
+			disk := &hfe.Disk{
+				Header: hfe.Header{NumberOfTrack: 1, NumberOfSide: 2, BitRate: tt.bitRate},
+				Tracks: make([]hfe.TrackData, 1),
+			}
+			var d EncodingDetector
+			for _, track := range tt.tracks {
+				capture := &TrackCapture{Cyl: 0, Head: 1, MFM: track}
+				capture.Store(disk)
+				d.Update(disk, capture)
+			}
+			h := disk.Header
+			if h.TrackEncoding != tt.encoding || h.Track0S0Encoding != tt.encoding || h.Track0S1Encoding != tt.encoding {
+				t.Errorf("encoding %s, expected 0x%02x", h.EncodingName(), tt.encoding)
+			}
+			if h.FloppyInterfaceMode != tt.mode {
+				t.Errorf("interface mode %s, expected 0x%02x", h.InterfaceModeName(), tt.mode)
+			}
+			if len(messages) != tt.messages {
+				t.Errorf("progress messages %q, expected %d", messages, tt.messages)
+			}
+			if report := d.Report(disk); !strings.HasPrefix(report, tt.report) || (tt.report == "") != (report == "") {
+				t.Errorf("report %q, expected %q", report, tt.report)
+			}
+		})
+	}
+}
@@ -15,9 +15,12 @@ var eraseCmd = &cobra.Command{
 	Long:  "Erase the floppy disk connected via USB adapter.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if floppyAdapter == nil {
-			cobra.CheckErr(fmt.Errorf("adapter not available"))
+			checkErr(fmt.Errorf("adapter not available"))
 		}
-		fmt.Printf("Erasing %d tracks, %d side(s)\n", config.Cyls+2, config.Heads)
+		if !floppyAdapter.Capabilities().CanErase {
+			checkErr(fmt.Errorf("erase %w", ErrNotSupported))
+		}
+		fmt.Printf("Erasing %d tracks, %d side(s)\n", config.OuterCyls(), config.Heads)
 		fmt.Printf("\n")
 
 		// Prompt user to insert diskette
@@ -28,13 +31,14 @@ var eraseCmd = &cobra.Command{
 
 		// Erase floppy disk using adapter interface.
 		// Erase two extra cylinders.
-		err := floppyAdapter.Erase(config.Cyls + 2)
+		err := floppyAdapter.Erase(config.OuterCyls())
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to erase floppy disk: %w", err))
+			checkErr(fmt.Errorf("failed to erase floppy disk: %w", err))
 		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(eraseCmd)
+	eraseCmd.Flags().BoolVar(&WriteOpts.NoDiskCheck, "no-disk-check", false, "do not check for disk and write protection before erasing")
 }
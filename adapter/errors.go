@@ -0,0 +1,49 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sergev/floppy/flux"
+)
+
+// Error conditions reported by floppy adapters.
+// Adapter packages wrap these, so callers can check them with errors.Is.
+var (
+	ErrNoIndex        = errors.New("no index")
+	ErrNoTrack0       = errors.New("no track 0")
+	ErrWriteProtected = errors.New("write protected")
+	ErrOverflow       = errors.New("overflow")
+	ErrUnderflow      = errors.New("underflow")
+	ErrDeviceGone     = errors.New("device disconnected")
+	ErrBusy           = errors.New("adapter is busy")
+	ErrNoDisk         = errors.New("no disk in drive")
+	ErrNotSupported   = errors.New("not supported by adapter")
+	ErrImageReadOnly  = errors.New("image is write protected")
+	ErrBadCylinder    = errors.New("cylinder beyond drive limit")
+	ErrHardSectored   = flux.ErrHardSectored
+)
+
+// TrackError describes a failure to read or write a particular track
+type TrackError struct {
+	Cyl  int
+	Head int
+	Err  error
+}
+
+func (e *TrackError) Error() string {
+	return fmt.Sprintf("track %d, side %d: %v", e.Cyl, e.Head, e.Err)
+}
+
+func (e *TrackError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether the operation may succeed when repeated,
+// for example after inserting a disk or on a less loaded USB bus.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrNoIndex) ||
+		errors.Is(err, ErrNoDisk) ||
+		errors.Is(err, ErrOverflow) ||
+		errors.Is(err, ErrUnderflow)
+}
@@ -0,0 +1,100 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TrackFailures keeps reading of a disk going when some tracks cannot be read.
+// A failed track is read again up to ReadOpts.Retries times, then left empty
+// and recorded, unless ReadOpts.FailFast is set. Errors of the adapter itself,
+// like disconnected device, always stop reading, unless Reconnect is given:
+// then the device is opened again, and the track in progress is read anew.
+type TrackFailures struct {
+	Tracks     []*TrackError // Tracks left empty, in order of reading
+	Good       int           // Tracks read successfully
+	Retried    int           // Tracks read more than once
+	Retries    int           // Extra reads of all tracks
+	Reconnect  func() error  // Reopen disconnected device and restore its state, or nil
+	Reconnects int           // Times the device was reopened
+}
+
+// Read calls read for the track, and repeats it after failure.
+// Returns nil when the track is read, or when it is given up and recorded.
+func (f *TrackFailures) Read(cyl, head int, read func() error) error {
+	var trackErr *TrackError
+	for retry := 0; ; retry++ {
+		err := read()
+		if err == nil {
+			f.Good++
+			return nil
+		}
+		if !errors.As(err, &trackErr) {
+			trackErr = &TrackError{Cyl: cyl, Head: head, Err: err}
+		}
+		if errors.Is(err, ErrDeviceGone) && f.reconnect(trackErr) {
+			// Reopened device does not count as a retry
+			retry--
+			continue
+		}
+		if ReadOpts.FailFast || isFatal(err) || retry >= ReadOpts.Retries {
+			break
+		}
+		if retry == 0 {
+			f.Retried++
+		}
+		f.Retries++
+		fmt.Printf("\nWarning: %v, reading again\n", trackErr)
+	}
+	if ReadOpts.FailFast || isFatal(trackErr) {
+		return trackErr
+	}
+	fmt.Printf("\nWarning: %v, track left empty\n", trackErr)
+	f.Tracks = append(f.Tracks, trackErr)
+	return nil
+}
+
+// Open the device again after it is lost at the given track.
+// Returns false when not possible, or when attempts are used up.
+func (f *TrackFailures) reconnect(trackErr *TrackError) bool {
+	if f.Reconnect == nil || f.Reconnects >= ReadOpts.MaxReconnects {
+		return false
+	}
+	f.Reconnects++
+	Progressf("\nWarning: %v, reconnecting (attempt %d of %d)...\n",
+		trackErr, f.Reconnects, ReadOpts.MaxReconnects)
+	if err := f.Reconnect(); err != nil {
+		Progressf("Failed to reconnect: %v\n", err)
+		return false
+	}
+	Progressf("Reconnected, reading track %d, side %d again\n", trackErr.Cyl, trackErr.Head)
+	return true
+}
+
+// Err returns error when more than ReadOpts.MaxFailedTracks tracks failed,
+// or no track could be read at all.
+func (f *TrackFailures) Err() error {
+	n := len(f.Tracks)
+	if n == 0 || (n <= ReadOpts.MaxFailedTracks && f.Good > 0) {
+		return nil
+	}
+	return fmt.Errorf("%d of %d tracks failed, first at %w", n, n+f.Good, f.Tracks[0])
+}
+
+// Report returns list of failed tracks for the user, or empty string.
+func (f *TrackFailures) Report() string {
+	if len(f.Tracks) == 0 {
+		return ""
+	}
+	report := fmt.Sprintf("Failed to read %d tracks, left empty in the image:", len(f.Tracks))
+	for _, e := range f.Tracks {
+		report += fmt.Sprintf("\n    %v", e)
+	}
+	return report
+}
+
+// Errors after which reading of other tracks makes no sense
+func isFatal(err error) bool {
+	return errors.Is(err, ErrDeviceGone) || errors.Is(err, ErrBusy) ||
+		errors.Is(err, ErrHardSectored) || errors.Is(err, ErrBadCylinder)
+}
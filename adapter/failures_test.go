@@ -0,0 +1,164 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/sergev/floppy/flux"
+	"go.bug.st/serial"
+)
+
+func TestTrackFailures(t *testing.T) {
+	defer func(opts ReadOptions) { ReadOpts = opts }(ReadOpts)
+	ReadOpts.FailFast = false
+	ReadOpts.Retries = 2
+	ReadOpts.MaxFailedTracks = 1
+
+	// Track is read on the second attempt
+	f := &TrackFailures{}
+	calls := 0
+	err := f.Read(0, 0, func() error {
+		calls++
+		if calls == 1 {
+			return ErrOverflow
+		}
+		return nil
+	})
+	if err != nil || calls != 2 || f.Good != 1 || f.Err() != nil || f.Report() != "" {
+		t.Errorf("Read() error = %v after %d calls", err, calls)
+	}
+
+	// Track fails in every attempt: recorded, and reading goes on
+	calls = 0
+	err = f.Read(3, 1, func() error {
+		calls++
+		return ErrNoIndex
+	})
+	if err != nil || calls != 3 || len(f.Tracks) != 1 {
+		t.Fatalf("Read() error = %v after %d calls", err, calls)
+	}
+	if e := f.Tracks[0]; e.Cyl != 3 || e.Head != 1 || !errors.Is(e, ErrNoIndex) {
+		t.Errorf("failed track recorded as %v", e)
+	}
+	if f.Err() != nil || f.Report() == "" {
+		t.Errorf("one failed track: Err() = %v, report %q", f.Err(), f.Report())
+	}
+	if f.Retried != 2 || f.Retries != 3 {
+		t.Errorf("%d tracks retried, %d retries", f.Retried, f.Retries)
+	}
+
+	// Second failure is over the threshold
+	_ = f.Read(4, 0, func() error { return &TrackError{Cyl: 4, Head: 0, Err: ErrUnderflow} })
+	var trackErr *TrackError
+	if err := f.Err(); !errors.As(err, &trackErr) || trackErr.Cyl != 3 {
+		t.Errorf("Err() = %v, expected first failed track", err)
+	}
+
+	// Disconnected device stops reading at once
+	calls = 0
+	err = (&TrackFailures{}).Read(5, 0, func() error {
+		calls++
+		return ErrDeviceGone
+	})
+	if !errors.Is(err, ErrDeviceGone) || calls != 1 {
+		t.Errorf("Read() error = %v after %d calls, expected device gone", err, calls)
+	}
+
+	// Hard-sectored disk stops reading at once
+	calls = 0
+	err = (&TrackFailures{}).Read(0, 0, func() error {
+		calls++
+		return &flux.HardSectorError{Holes: 10}
+	})
+	if !errors.Is(err, ErrHardSectored) || calls != 1 {
+		t.Errorf("Read() error = %v after %d calls, expected hard-sectored", err, calls)
+	}
+
+	// Fail fast: no retries
+	ReadOpts.FailFast = true
+	calls = 0
+	err = (&TrackFailures{}).Read(6, 1, func() error {
+		calls++
+		return ErrNoIndex
+	})
+	if !errors.As(err, &trackErr) || trackErr.Cyl != 6 || calls != 1 {
+		t.Errorf("Read() error = %v after %d calls, expected failure of track 6.1", err, calls)
+	}
+
+	// No track read at all
+	ReadOpts.FailFast = false
+	f = &TrackFailures{}
+	_ = f.Read(0, 0, func() error { return ErrNoIndex })
+	if f.Err() == nil {
+		t.Errorf("Err() = nil without good tracks")
+	}
+}
+
+func TestTrackFailures_Reconnect(t *testing.T) {
+	defer func(opts ReadOptions) { ReadOpts = opts }(ReadOpts)
+	ReadOpts.FailFast = false
+	ReadOpts.Retries = 0
+	ReadOpts.MaxReconnects = 2
+	defer func(p ProgressFunc) { Progress = p }(Progress)
+	var messages []string
+	Progress = func(message string) { messages = append(messages, message) }
+
+	// Device is lost once, and the track is read after reconnect
+	reconnects := 0
+	f := &TrackFailures{Reconnect: func() error {
+		reconnects++
+		return nil
+	}}
+	calls := 0
+	err := f.Read(7, 1, func() error {
+		calls++
+		if calls == 1 {
+			return &TrackError{Cyl: 7, Head: 1, Err: ErrDeviceGone}
+		}
+		return nil
+	})
+	if err != nil || calls != 2 || reconnects != 1 || f.Good != 1 {
+		t.Errorf("Read() error = %v after %d calls and %d reconnects", err, calls, reconnects)
+	}
+	if len(messages) == 0 || !strings.Contains(messages[0], "track 7, side 1") {
+		t.Errorf("reconnection not reported: %q", messages)
+	}
+
+	// Attempts are limited per operation
+	calls = 0
+	err = f.Read(8, 0, func() error {
+		calls++
+		return ErrDeviceGone
+	})
+	if !errors.Is(err, ErrDeviceGone) || calls != 2 || f.Reconnects != 2 {
+		t.Errorf("Read() error = %v after %d calls and %d reconnects", err, calls, f.Reconnects)
+	}
+
+	// Device which cannot be reopened stops reading
+	f = &TrackFailures{Reconnect: func() error { return errors.New("not found") }}
+	err = f.Read(0, 0, func() error { return ErrDeviceGone })
+	if !errors.Is(err, ErrDeviceGone) || f.Reconnects != 1 {
+		t.Errorf("Read() error = %v, expected device gone", err)
+	}
+}
+
+func TestSerialError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		gone bool
+	}{
+		{io.EOF, true},
+		{fmt.Errorf("read: %w", syscall.EIO), true},
+		{&serial.PortError{}, false},
+		{errors.New("timeout"), false},
+	}
+	for _, tc := range testCases {
+		if gone := errors.Is(SerialError(tc.err), ErrDeviceGone); gone != tc.gone {
+			t.Errorf("SerialError(%v) device gone = %v, expected %v", tc.err, gone, tc.gone)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/sergev/floppy/config"
+)
+
+// Allowed excess of raw flux over one revolution, in percent.
+// Covers speed variation of the drive and slightly long tracks.
+const fluxRevolutionTolerance = 3
+
+// CheckFluxIntervals validates raw flux before it is written to a track.
+// Intervals between flux reversals are in nanoseconds; none may be shorter
+// than minIntervalNs, and together they must fit within one revolution
+// of the configured drive, plus a small tolerance.
+func CheckFluxIntervals(intervals []uint64, minIntervalNs uint64) error {
+	if len(intervals) == 0 {
+		return fmt.Errorf("no flux transitions to write")
+	}
+	total := uint64(0)
+	for i, interval := range intervals {
+		if interval < minIntervalNs {
+			return fmt.Errorf("flux interval %d of %d ns is shorter than %d ns", i, interval, minIntervalNs)
+		}
+		total += interval
+	}
+
+	rpm := config.RPM
+	if rpm <= 0 {
+		rpm = 300
+	}
+	revolutionNs := uint64(60e9) / uint64(rpm)
+	limitNs := revolutionNs * (100 + fluxRevolutionTolerance) / 100
+	if total > limitNs {
+		return fmt.Errorf("flux of %.3f ms does not fit in one revolution of %.3f ms at %d RPM",
+			float64(total)/1e6, float64(revolutionNs)/1e6, rpm)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package adapter
+
+import (
+	"testing"
+
+	"github.com/sergev/floppy/config"
+)
+
+func TestCheckFluxIntervals(t *testing.T) {
+	defer func(rpm int) { config.RPM = rpm }(config.RPM)
+	config.RPM = 300
+
+	// 200 msec per revolution, up to 206 msec allowed
+	tests := []struct {
+		intervals []uint64
+		ok        bool
+	}{
+		{[]uint64{2000, 3000, 4000}, true},
+		{[]uint64{100e6, 105e6}, true},
+		{[]uint64{100e6, 107e6}, false},
+		{[]uint64{2000, 499, 4000}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		err := CheckFluxIntervals(test.intervals, 500)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: error = %v", test.intervals, err)
+		}
+	}
+}
@@ -18,13 +18,18 @@ var formatCmd = &cobra.Command{
 	Long:  "Format the floppy disk connected via USB adapter by selecting from pre-defined images.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if floppyAdapter == nil {
-			cobra.CheckErr(fmt.Errorf("adapter not available"))
+			checkErr(fmt.Errorf("adapter not available"))
 		}
+		if !floppyAdapter.Capabilities().CanWrite {
+			checkErr(fmt.Errorf("write %w", ErrNotSupported))
+		}
+		checkErr(WriteOpts.Validate())
+		WriteOpts.ApplyLayout()
 
 		// Get list of image names from config
 		imageNames := config.Images
 		if len(imageNames) == 0 {
-			cobra.CheckErr(fmt.Errorf("no images available for current drive"))
+			checkErr(fmt.Errorf("no images available for current drive"))
 		}
 
 		// Display menu with tags
@@ -39,7 +44,7 @@ var formatCmd = &cobra.Command{
 		reader := bufio.NewReader(os.Stdin)
 		selection, err := reader.ReadString('\n')
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to read selection: %w", err))
+			checkErr(fmt.Errorf("failed to read selection: %w", err))
 		}
 		selection = strings.TrimSpace(selection)
 
@@ -49,12 +54,12 @@ var formatCmd = &cobra.Command{
 			var err error
 			selectedIndex, err = tagToIndex(selection, len(imageNames))
 			if err != nil {
-				cobra.CheckErr(fmt.Errorf("invalid selection: %w", err))
+				checkErr(fmt.Errorf("invalid selection: %w", err))
 			}
 		}
 
 		if selectedIndex < 0 || selectedIndex >= len(imageNames) {
-			cobra.CheckErr(fmt.Errorf("invalid selection index: %d", selectedIndex))
+			checkErr(fmt.Errorf("invalid selection index: %d", selectedIndex))
 		}
 
 		selectedImageName := imageNames[selectedIndex]
@@ -63,19 +68,19 @@ var formatCmd = &cobra.Command{
 		// Get filename from config
 		filename, err := config.GetImageFilename(selectedImageName)
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to get filename for image %q: %w", selectedImageName, err))
+			checkErr(fmt.Errorf("failed to get filename for image %q: %w", selectedImageName, err))
 		}
 
 		// Get image data from embedded images
 		imageData, err := images.GetImage(filename)
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to get embedded image %q: %w", filename, err))
+			checkErr(fmt.Errorf("failed to get embedded image %q: %w", filename, err))
 		}
 
 		// Write decompressed data to temporary file
 		tmpFile, err := os.CreateTemp("", "floppy-format-*.img")
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to create temporary file: %w", err))
+			checkErr(fmt.Errorf("failed to create temporary file: %w", err))
 		}
 		tmpFilename := tmpFile.Name()
 		defer os.Remove(tmpFilename) // Clean up temp file
@@ -88,36 +93,36 @@ var formatCmd = &cobra.Command{
 			tmpFileWithExt = tmpFilename + ext
 			err = os.Rename(tmpFilename, tmpFileWithExt)
 			if err != nil {
-				cobra.CheckErr(fmt.Errorf("failed to rename temp file: %w", err))
+				checkErr(fmt.Errorf("failed to rename temp file: %w", err))
 			}
 			defer os.Remove(tmpFileWithExt)
 		}
 
 		err = os.WriteFile(tmpFileWithExt, imageData, 0644)
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to write temporary file: %w", err))
+			checkErr(fmt.Errorf("failed to write temporary file: %w", err))
 		}
 
 		// Read file using hfe.Read (same as write command)
 		disk, err := hfe.Read(tmpFileWithExt)
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to read image file: %w", err))
+			checkErr(fmt.Errorf("failed to read image file: %w", err))
 		}
 
 		// Match image versus drive (same as write command)
 		if int(disk.Header.BitRate) > config.MaxKBps {
-			cobra.CheckErr(fmt.Errorf("Image with bit rate %d kbps is incompatible with drive %s",
+			checkErr(fmt.Errorf("Image with bit rate %d kbps is incompatible with drive %s",
 				disk.Header.BitRate, config.DriveName))
 		}
 		if int(disk.Header.NumberOfSide) > config.Heads {
-			cobra.CheckErr(fmt.Errorf("Image with %d sides is incompatible with drive %s",
+			checkErr(fmt.Errorf("Image with %d sides is incompatible with drive %s",
 				disk.Header.NumberOfSide, config.DriveName))
 		}
 
 		// Get number of tracks to write (but no more than extra 2 tracks)
 		numCylinders := int(disk.Header.NumberOfTrack)
-		if numCylinders > config.Cyls+2 {
-			numCylinders = config.Cyls + 2
+		if numCylinders > config.OuterCyls() {
+			numCylinders = config.OuterCyls()
 		}
 		if hfe.DetectImageFormat(tmpFileWithExt) != hfe.ImageFormatHFE {
 			if numCylinders >= 80 {
@@ -128,7 +133,7 @@ var formatCmd = &cobra.Command{
 			}
 		}
 		disk.InitVerifyOptions()
-		fmt.Printf("Writing %d tracks, %d side(s)\n", numCylinders, disk.Header.NumberOfSide)
+		fmt.Printf("Writing %d cylinders, %d side(s)\n", numCylinders, disk.Header.NumberOfSide)
 		fmt.Printf("Bit Rate: %d kbps\n", disk.Header.BitRate)
 		fmt.Printf("Rotation Speed: %d RPM\n", disk.Header.FloppyRPM)
 		fmt.Printf("\n")
@@ -141,7 +146,7 @@ var formatCmd = &cobra.Command{
 		// Write floppy disk using adapter interface (same as write command)
 		err = floppyAdapter.Write(disk, numCylinders)
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to write floppy disk: %w", err))
+			checkErr(fmt.Errorf("failed to write floppy disk: %w", err))
 		}
 		fmt.Printf("\n")
 		fmt.Printf("Diskette formatted as '%s'.\n", selectedImageName)
@@ -150,6 +155,9 @@ var formatCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(formatCmd)
+	formatCmd.Flags().IntVar(&WriteOpts.Interleave, "interleave", WriteOpts.Interleave, "sector interleave: 1 for 1:1, 2 for 2:1, etc.")
+	formatCmd.Flags().IntVar(&WriteOpts.Skew, "skew", WriteOpts.Skew, "shift of sector 1 from one cylinder to the next, in `sectors`")
+	formatCmd.Flags().BoolVar(&WriteOpts.NoDiskCheck, "no-disk-check", false, "do not check for disk and write protection before writing")
 }
 
 // indexToTag converts an index (0-based) to a tag string (1-9, a-z)
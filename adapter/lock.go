@@ -0,0 +1,54 @@
+package adapter
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/sergev/floppy/flux"
+)
+
+// LockLog collects lock of PLL on every track read, for the read report
+type LockLog struct {
+	Tracks []TrackLock // Tracks with decoded flux, in order of reading
+}
+
+// TrackLock is lock of PLL on one track
+type TrackLock struct {
+	Cyl  int
+	Head int
+	flux.PLLLock
+}
+
+// Add remembers lock of PLL on the capture. Tracks without flux
+// transitions have no lock, and are skipped.
+func (l *LockLog) Add(capture *TrackCapture) {
+	if capture.Lock.PeriodNs == 0 {
+		return
+	}
+	l.Tracks = append(l.Tracks, TrackLock{Cyl: capture.Cyl, Head: capture.Head, PLLLock: capture.Lock})
+}
+
+// Report returns bitcell period and phase error of every track,
+// one line per cylinder, or empty string when nothing was decoded.
+func (l *LockLog) Report() string {
+	if len(l.Tracks) == 0 {
+		return ""
+	}
+	tracks := slices.Clone(l.Tracks)
+	slices.SortStableFunc(tracks, func(a, b TrackLock) int {
+		if a.Cyl != b.Cyl {
+			return a.Cyl - b.Cyl
+		}
+		return a.Head - b.Head
+	})
+	report := "PLL lock per track, bitcell period and RMS phase error:"
+	for i, t := range tracks {
+		if i == 0 || t.Cyl != tracks[i-1].Cyl {
+			report += fmt.Sprintf("\n    track %d:", t.Cyl)
+		} else {
+			report += ","
+		}
+		report += fmt.Sprintf(" side %d %.0f ns %.1f%%", t.Head, t.PeriodNs, t.LockQuality*100)
+	}
+	return report
+}
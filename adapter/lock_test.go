@@ -0,0 +1,29 @@
+package adapter
+
+import (
+	"testing"
+
+	"github.com/sergev/floppy/flux"
+)
+
+func TestLockLog(t *testing.T) {
+	l := &LockLog{}
+	if l.Report() != "" {
+		t.Errorf("report of no tracks: %q", l.Report())
+	}
+
+	// Side 1 is read after all of side 0, like on a flippy drive
+	l.Add(&TrackCapture{Cyl: 0, Head: 0, Lock: flux.PLLLock{PeriodNs: 1000, LockQuality: 0.031}})
+	l.Add(&TrackCapture{Cyl: 1, Head: 0, Lock: flux.PLLLock{PeriodNs: 1002, LockQuality: 0.05}})
+	l.Add(&TrackCapture{Cyl: 1, Head: 1})
+	l.Add(&TrackCapture{Cyl: 0, Head: 1, Lock: flux.PLLLock{PeriodNs: 998, LockQuality: 0.2}})
+	if len(l.Tracks) != 3 {
+		t.Errorf("%d tracks, expected 3 with flux", len(l.Tracks))
+	}
+	want := "PLL lock per track, bitcell period and RMS phase error:" +
+		"\n    track 0: side 0 1000 ns 3.1%, side 1 998 ns 20.0%" +
+		"\n    track 1: side 0 1002 ns 5.0%"
+	if got := l.Report(); got != want {
+		t.Errorf("report:\n%s\nexpected:\n%s", got, want)
+	}
+}
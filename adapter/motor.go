@@ -0,0 +1,85 @@
+package adapter
+
+import (
+	"time"
+
+	"github.com/sergev/floppy/config"
+)
+
+// DefaultMotorIdle is how long the motor keeps running after an operation,
+// unless the drive profile sets motor_idle
+const DefaultMotorIdle = 5 * time.Second
+
+// Motor tracks the drive motor of an adapter client. The motor is turned on
+// once per operation, and keeps running between operations, so that the next
+// one starts without spin-up delay. After a period without device activity,
+// the motor is turned off and the drive is deselected.
+//
+// Motor is driven by Busy: the idle timer is stopped when an operation
+// begins, and started again when it ends with the motor running.
+type Motor struct {
+	Stop    func() error  // Turn the motor off and deselect the drive
+	MaxIdle time.Duration // Limit of idle time set by the device firmware, 0 = none
+
+	running bool        // Motor is on
+	timer   *time.Timer // Stops the motor when idle
+}
+
+// MotorStopper is implemented by adapters which keep the motor running
+// between operations
+type MotorStopper interface {
+	// StopMotor turns off the motor left running after the last operation
+	StopMotor() error
+}
+
+// Running reports whether the motor has been turned on and is not stopped yet
+func (m *Motor) Running() bool {
+	return m.running
+}
+
+// SetRunning records that the motor has been turned on by the client,
+// or found stopped, for example after the device was reset
+func (m *Motor) SetRunning(on bool) {
+	m.running = on
+}
+
+// Off turns the motor off now, when it is running
+func (m *Motor) Off() error {
+	m.cancel()
+	if !m.running {
+		return nil
+	}
+	m.running = false
+	if m.Stop == nil {
+		return nil
+	}
+	return m.Stop()
+}
+
+// Time without operations after which the motor is stopped
+func (m *Motor) idleTime() time.Duration {
+	idle := DefaultMotorIdle
+	if config.MotorIdle > 0 {
+		idle = time.Duration(config.MotorIdle) * time.Millisecond
+	}
+	if m.MaxIdle > 0 && idle > m.MaxIdle {
+		idle = m.MaxIdle
+	}
+	return idle
+}
+
+// Start the idle timer, which stops the motor unless another operation begins
+func (m *Motor) arm(b *Busy) {
+	if m.timer == nil {
+		m.timer = time.AfterFunc(m.idleTime(), b.stopIdle)
+	} else {
+		m.timer.Reset(m.idleTime())
+	}
+}
+
+// Stop the idle timer
+func (m *Motor) cancel() {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+}
@@ -0,0 +1,27 @@
+package adapter
+
+import "fmt"
+
+// ProgressFunc receives progress and informational messages from adapters
+type ProgressFunc func(message string)
+
+// Progress is invoked by adapters to report progress.
+// By default messages are printed to stdout.
+var Progress ProgressFunc = func(message string) {
+	fmt.Print(message)
+}
+
+// Progressf formats a message and reports it through the Progress callback
+func Progressf(format string, args ...interface{}) {
+	if Progress != nil {
+		Progress(fmt.Sprintf(format, args...))
+	}
+}
+
+// FlipFunc asks user to flip the disk over, to read the other side
+// in a single-head drive. Returns false when user declines.
+type FlipFunc func() bool
+
+// FlipDisk is invoked by adapters of single-head drives after the first side is read.
+// By default it is nil, and the other side is not read.
+var FlipDisk FlipFunc
@@ -0,0 +1,188 @@
+package adapter
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/sergev/floppy/flux"
+)
+
+// Tracks which differ from the disk by more than this fraction of rotation
+// speed or bit rate are reported, and decoded at their own rates
+const rateTolerance = 0.05
+
+// RateMeasurement is rotation speed and bit rate measured on one track
+type RateMeasurement struct {
+	Cyl     int
+	Head    int
+	RPM     float64 // Rotation speed, 0 when unknown
+	BitRate float64 // Bit rate in kbps, 0 when unknown
+}
+
+// RateEstimator finds rotation speed and bit rate of the disk being read.
+// Rates of the disk are medians of measurements on the first
+// ReadOpts.RateTracks decoded tracks, unless forced by options; until then
+// every track is decoded at its own rates. Later tracks are measured too:
+// a track which differs from the disk by more than 5% is reported as
+// mixed-format or zoned media, and decoded at its own rates, while
+// the header of the disk keeps a single value.
+type RateEstimator struct {
+	Measurements []RateMeasurement // Tracks decoded, in order of reading
+	Mismatches   int               // Tracks which differ from the disk
+
+	rpm     float64   // Median rotation speed of the first tracks
+	bitRate float64   // Median bit rate of the first tracks
+	shown   [2]uint16 // Rates of the disk printed last
+}
+
+// RatesFunc receives rotation speed and bit rate of the disk,
+// as measured so far. Bit rate is in kbps.
+type RatesFunc func(rpm, bitRate float64)
+
+// RatesHook, when set, is invoked by RateEstimator every time rates
+// of the disk are measured. It is nil by default.
+var RatesHook RatesFunc
+
+// Number of tracks to measure rates of the disk
+func rateTracks() int {
+	return max(ReadOpts.RateTracks, 1)
+}
+
+// Rates of the disk are known
+func (e *RateEstimator) settled() bool {
+	return len(e.Measurements) >= rateTracks()
+}
+
+// Rates returns rotation speed and bit rate to decode the given track with:
+// rates of the disk, or rates of the track while the disk is being measured,
+// or when the track differs from the disk
+func (e *RateEstimator) Rates(track *flux.FluxTrack) (rpm, bitRate uint16) {
+	if e.settled() && !e.differs(track.RPM(), track.MeasureBitRateKbps()) {
+		return e.Disk()
+	}
+	return ReadOpts.TrackRates(track)
+}
+
+// Disk returns rotation speed and bit rate of the disk, for the header
+func (e *RateEstimator) Disk() (rpm, bitRate uint16) {
+	return ReadOpts.nominalRates(e.rpm, e.bitRate)
+}
+
+// Add records rates of the given track, after it is successfully decoded.
+// Rates of the disk are printed when measured on the first track,
+// and again when they change.
+func (e *RateEstimator) Add(cyl, head int, track *flux.FluxTrack) {
+	m := RateMeasurement{Cyl: cyl, Head: head, RPM: track.RPM(), BitRate: track.MeasureBitRateKbps()}
+	settled := e.settled()
+	e.Measurements = append(e.Measurements, m)
+	if settled {
+		e.check(m)
+		return
+	}
+	e.rpm = medianRate(e.Measurements, func(m RateMeasurement) float64 { return m.RPM })
+	e.bitRate = medianRate(e.Measurements, func(m RateMeasurement) float64 { return m.BitRate })
+	if RatesHook != nil {
+		RatesHook(e.rpm, e.bitRate)
+	}
+
+	rpm, bitRate := e.Disk()
+	if len(e.Measurements) == 1 {
+		ReadOpts.printRates(rpm, bitRate)
+	} else if e.shown != [2]uint16{rpm, bitRate} {
+		Progressf("\nRates of the disk: %d RPM, %d kbps, median of %d tracks\n", rpm, bitRate, len(e.Measurements))
+	}
+	e.shown = [2]uint16{rpm, bitRate}
+
+	// Check the first tracks against their median
+	if e.settled() {
+		for _, m := range e.Measurements {
+			e.check(m)
+		}
+	}
+}
+
+// Report a track which differs from the disk
+func (e *RateEstimator) check(m RateMeasurement) {
+	if !e.differs(m.RPM, m.BitRate) {
+		return
+	}
+	e.Mismatches++
+	Progressf("\nWarning: track %d, side %d: measured %.1f RPM, %.0f kbps, disk has %.1f RPM, %.0f kbps: mixed-format or zoned media?\n",
+		m.Cyl, m.Head, m.RPM, m.BitRate, e.rpm, e.bitRate)
+}
+
+// Measured rates differ from the disk by more than rateTolerance.
+// Unknown rates do not count.
+func (e *RateEstimator) differs(rpm, bitRate float64) bool {
+	return rateDiffers(rpm, e.rpm) || rateDiffers(bitRate, e.bitRate)
+}
+
+func rateDiffers(measured, nominal float64) bool {
+	return measured != 0 && nominal != 0 && math.Abs(measured/nominal-1) > rateTolerance
+}
+
+// Median of nonzero rates, or 0 when none are known
+func medianRate(measurements []RateMeasurement, rate func(RateMeasurement) float64) float64 {
+	var rates []float64
+	for _, m := range measurements {
+		if r := rate(m); r != 0 {
+			rates = append(rates, r)
+		}
+	}
+	if len(rates) == 0 {
+		return 0
+	}
+	slices.Sort(rates)
+	n := len(rates)
+	if n%2 == 0 {
+		return (rates[n/2-1] + rates[n/2]) / 2
+	}
+	return rates[n/2]
+}
+
+// Confidence tells how well the rates of the disk are measured:
+// "high" when all tracks agree, "medium" when some tracks differ,
+// "low" when fewer tracks than needed were measured, or more
+// than a quarter of tracks differ.
+func (e *RateEstimator) Confidence() string {
+	switch {
+	case !e.settled() || e.Mismatches*4 > len(e.Measurements):
+		return "low"
+	case e.Mismatches > 0:
+		return "medium"
+	}
+	return "high"
+}
+
+// Report returns rates of the disk with range of measurements
+// and confidence for the user, or empty string.
+func (e *RateEstimator) Report() string {
+	if len(e.Measurements) == 0 {
+		return ""
+	}
+	rpm, bitRate := e.Disk()
+	minRPM, maxRPM := rateRange(e.Measurements, func(m RateMeasurement) float64 { return m.RPM })
+	minRate, maxRate := rateRange(e.Measurements, func(m RateMeasurement) float64 { return m.BitRate })
+	report := fmt.Sprintf("Rates: %d RPM, %d kbps; measured %.1f-%.1f RPM, %.0f-%.0f kbps on %d tracks",
+		rpm, bitRate, minRPM, maxRPM, minRate, maxRate, len(e.Measurements))
+	if e.Mismatches > 0 {
+		report += fmt.Sprintf(", %d tracks differ", e.Mismatches)
+	}
+	return report + "; confidence " + e.Confidence() + "."
+}
+
+// Smallest and largest nonzero rates
+func rateRange(measurements []RateMeasurement, rate func(RateMeasurement) float64) (lo, hi float64) {
+	for _, m := range measurements {
+		r := rate(m)
+		if r == 0 {
+			continue
+		}
+		if lo == 0 || r < lo {
+			lo = r
+		}
+		hi = max(hi, r)
+	}
+	return lo, hi
+}
@@ -0,0 +1,117 @@
+package adapter
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/sergev/floppy/flux"
+)
+
+// One revolution with transitions at every data bit, for the given
+// rotation speed and bit rate, slowed down by the given factor
+func makeRateTrack(rpm, kbps, slow float64) *flux.FluxTrack {
+	revolution := uint64(60e9 / rpm * slow)
+	bit := 1e6 / kbps * slow
+	track := &flux.FluxTrack{IndexPulses: []uint64{0, revolution}}
+	for pos := bit; pos < float64(revolution); pos += bit {
+		track.Transitions = append(track.Transitions, uint64(pos))
+	}
+	return track
+}
+
+func TestRateEstimator(t *testing.T) {
+	defer func(o ReadOptions) { ReadOpts = o }(ReadOpts)
+	defer func(p ProgressFunc) { Progress = p }(Progress)
+	var messages []string
+	Progress = func(message string) { messages = append(messages, message) }
+	ReadOpts = ReadOptions{RateTracks: 3}
+
+	// DD disk in a 360 RPM drive, where track 0 measures 10% slow
+	slow := makeRateTrack(360, 300, 1.1)
+	good := makeRateTrack(360, 300, 1)
+	var e RateEstimator
+
+	// Tracks are decoded at their own rates, until three are measured
+	if rpm, bitRate := e.Rates(slow); rpm != 300 || bitRate != 250 {
+		t.Errorf("track 0 decoded at %d RPM, %d kbps, expected 300 and 250", rpm, bitRate)
+	}
+	e.Add(0, 0, slow)
+	if rpm, bitRate := e.Rates(good); rpm != 360 || bitRate != 300 {
+		t.Errorf("track 1 decoded at %d RPM, %d kbps, expected 360 and 300", rpm, bitRate)
+	}
+	e.Add(0, 1, good)
+	e.Add(1, 0, good)
+	if rpm, bitRate := e.Disk(); rpm != 360 || bitRate != 300 {
+		t.Errorf("disk has %d RPM, %d kbps, expected 360 and 300", rpm, bitRate)
+	}
+	if e.Mismatches != 1 || !strings.Contains(strings.Join(messages, ""), "track 0, side 0: measured") {
+		t.Errorf("%d mismatches, messages %q: expected track 0 reported", e.Mismatches, messages)
+	}
+	if c := e.Confidence(); c != "low" {
+		t.Errorf("confidence %q with a third of tracks slow, expected low", c)
+	}
+
+	// Good tracks are decoded at rates of the disk, and raise confidence
+	e.Add(1, 1, good)
+	e.Add(2, 0, good)
+	if rpm, bitRate := e.Rates(good); rpm != 360 || bitRate != 300 {
+		t.Errorf("track 2 decoded at %d RPM, %d kbps, expected 360 and 300", rpm, bitRate)
+	}
+	if c := e.Confidence(); c != "medium" {
+		t.Errorf("confidence %q with one of five tracks slow, expected medium", c)
+	}
+
+	// Slow track later on the disk is decoded at its own rates
+	if rpm, bitRate := e.Rates(slow); rpm != 300 || bitRate != 250 {
+		t.Errorf("slow track decoded at %d RPM, %d kbps, expected 300 and 250", rpm, bitRate)
+	}
+	e.Add(2, 1, slow)
+	if e.Mismatches != 2 || len(e.Measurements) != 6 {
+		t.Errorf("%d mismatches in %d measurements, expected 2 in 6", e.Mismatches, len(e.Measurements))
+	}
+	report := e.Report()
+	for _, want := range []string{"360 RPM, 300 kbps", "327.3-360.0 RPM", "273-300 kbps", "6 tracks", "2 tracks differ", "confidence low"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report %q does not mention %q", report, want)
+		}
+	}
+
+	// Forced rates are used for all tracks
+	ReadOpts = ReadOptions{RateTracks: 3, BitRate: 300, RPM: 360}
+	if rpm, bitRate := e.Rates(slow); rpm != 360 || bitRate != 300 {
+		t.Errorf("forced %d RPM, %d kbps, expected 360 and 300", rpm, bitRate)
+	}
+}
+
+func TestRateEstimator_Median(t *testing.T) {
+	defer func(o ReadOptions) { ReadOpts = o }(ReadOpts)
+	defer func(p ProgressFunc) { Progress = p }(Progress)
+	Progress = nil
+	ReadOpts = ReadOptions{RateTracks: 3}
+
+	// Rates of the first track are replaced by the median of three
+	var e RateEstimator
+	e.Add(0, 0, makeRateTrack(300, 250, 0.85))
+	if rpm, bitRate := e.Disk(); rpm != 360 || bitRate != 300 {
+		t.Errorf("disk has %d RPM, %d kbps after the fast track, expected 360 and 300", rpm, bitRate)
+	}
+	e.Add(0, 1, makeRateTrack(300, 250, 1))
+	e.Add(1, 0, makeRateTrack(300, 250, 1.01))
+	if rpm, bitRate := e.Disk(); rpm != 300 || bitRate != 250 {
+		t.Errorf("disk has %d RPM, %d kbps, expected 300 and 250", rpm, bitRate)
+	}
+	if e.Mismatches != 1 {
+		t.Errorf("%d mismatches, expected 1", e.Mismatches)
+	}
+
+	// Measured rates are passed on, not rounded to nominal ones
+	var rpm, bitRate float64
+	defer func() { RatesHook = nil }()
+	RatesHook = func(r, b float64) { rpm, bitRate = r, b }
+	e = RateEstimator{}
+	e.Add(0, 0, makeRateTrack(300, 250, 1.01))
+	if math.Abs(rpm-300/1.01) > 0.1 || math.Abs(bitRate-250/1.01) > 1 {
+		t.Errorf("measured %.1f RPM, %.0f kbps, expected %.1f and %.0f", rpm, bitRate, 300/1.01, 250/1.01)
+	}
+}
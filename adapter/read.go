@@ -3,10 +3,16 @@ package adapter
 import (
 	"bufio"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
+	"github.com/sergev/floppy/analysis"
 	"github.com/sergev/floppy/config"
 	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
 	"github.com/spf13/cobra"
 )
 
@@ -20,7 +26,7 @@ By default the floppy image is saved in HDE format as 'image.hde'.
 	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		if floppyAdapter == nil {
-			cobra.CheckErr(fmt.Errorf("adapter not available"))
+			checkErr(fmt.Errorf("adapter not available"))
 		}
 
 		// Determine output filename
@@ -29,16 +35,36 @@ By default the floppy image is saved in HDE format as 'image.hde'.
 			filename = args[0]
 		}
 
+		ReadOpts.Trim = trimOptions()
+		checkErr(ReadOpts.Validate())
+		if max := floppyAdapter.Capabilities().MaxRevolutions; max != 0 && ReadOpts.Revolutions > max {
+			checkErr(fmt.Errorf("adapter reads at most %d revolutions per track", max))
+		}
+		if ReadOpts.Sides == "1" && config.Heads < 2 {
+			checkErr(fmt.Errorf("drive %s has no side 1", config.DriveName))
+		}
+
 		// Compute number of cylinders to read
 		cylinders := config.Cyls
 		switch hfe.DetectImageFormat(filename) {
 		case hfe.ImageFormatUnknown:
-			cobra.CheckErr(fmt.Errorf("unknown image format: %s", filename))
+			checkErr(fmt.Errorf("unknown image format: %s", filename))
 		case hfe.ImageFormatHFE:
 			// For HFE, read two extra cylinders
-			cylinders += 2
+			cylinders = config.OuterCyls()
+		}
+		if ReadOpts.EndTrack >= 0 && ReadOpts.EndTrack < cylinders {
+			// Image ends at the last requested track
+			cylinders = ReadOpts.EndTrack + 1
+		}
+		if ReadOpts.StartTrack >= cylinders {
+			checkErr(fmt.Errorf("start track %d is beyond the end of disk", ReadOpts.StartTrack))
+		}
+		if ReadOpts.StartTrack != 0 || ReadOpts.Sides != "both" {
+			fmt.Printf("Reading tracks %d-%d, side(s) %s\n", ReadOpts.StartTrack, cylinders-1, ReadOpts.Sides)
+		} else {
+			fmt.Printf("Reading %d tracks, %d side(s)\n", cylinders, config.Heads)
 		}
-		fmt.Printf("Reading %d tracks, %d side(s)\n", cylinders, config.Heads)
 		fmt.Printf("\n")
 
 		// Prompt user to insert diskette
@@ -47,22 +73,273 @@ By default the floppy image is saved in HDE format as 'image.hde'.
 		_, _ = reader.ReadString('\n')
 		fmt.Printf("\n")
 
-		// Read floppy disk using adapter interface
-		disk, err := floppyAdapter.Read(cylinders)
-		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to read floppy disk: %w", err))
+		// Check head positioning before spending minutes on imaging
+		if config.Calibrate {
+			err := floppyAdapter.Calibrate()
+			if err != nil {
+				checkErr(fmt.Errorf("drive calibration failed: %w", err))
+			}
 		}
 
-		// Write file
-		err = hfe.Write(filename, disk)
-		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to write file: %w", err))
+		// Save flux histograms of every track
+		if analyzeDir != "" {
+			err := startAnalysis(analyzeDir)
+			if err != nil {
+				checkErr(err)
+			}
+			defer func() { FluxHook, LayoutHook = nil, nil }()
+		}
+
+		// Keep rates of the disk measured while reading, for the manifest
+		var measured [2]float64
+		if writeManifest {
+			RatesHook = func(rpm, bitRate float64) { measured = [2]float64{rpm, bitRate} }
+			defer func() { RatesHook = nil }()
+		}
+
+		// Ask user to flip the disk, when side 1 must be read separately
+		FlipDisk = func() bool {
+			fmt.Print("\n\nFlip the diskette over and press Enter when ready,\nor type 'n' to skip side 1...")
+			answer, _ := reader.ReadString('\n')
+			fmt.Printf("\n")
+			return !strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "n")
+		}
+		defer func() { FlipDisk = nil }()
+
+		var disk *hfe.Disk
+		if hfe.DetectImageFormat(filename) == hfe.ImageFormatHFE {
+			// Save tracks to HFE file as they are read,
+			// so that a failed read still leaves a valid partial image
+			w, err := hfe.NewWriter(filename, hfe.Header{}, ReadOpts.HFEVersion)
+			if err != nil {
+				checkErr(fmt.Errorf("failed to create file: %w", err))
+			}
+			disk, err = floppyAdapter.Read(cylinders, w)
+			closeErr := w.Close()
+			if err != nil {
+				if closeErr == nil && w.TrackCount() > 0 {
+					fmt.Printf("\nPartial image with %d tracks saved to file '%s'.\n", w.TrackCount(), filename)
+				}
+				checkErr(fmt.Errorf("failed to read floppy disk: %w", err))
+			}
+			if closeErr != nil {
+				checkErr(fmt.Errorf("failed to write file: %w", closeErr))
+			}
+
+			// Tracks are already saved: write the file again without trimmed ones
+			if ReadOpts.Trim != nil && trimRead(disk) {
+				err = hfe.WriteHFE(filename, disk, ReadOpts.HFEVersion)
+				if err != nil {
+					checkErr(fmt.Errorf("failed to write file: %w", err))
+				}
+			}
+		} else {
+			// Read floppy disk using adapter interface
+			var err error
+			disk, err = floppyAdapter.Read(cylinders, nil)
+			if err != nil {
+				checkErr(fmt.Errorf("failed to read floppy disk: %w", err))
+			}
+			if ReadOpts.Trim != nil {
+				trimRead(disk)
+			}
+
+			// Write file
+			err = writeImage(filename, disk)
+			if err != nil {
+				checkErr(fmt.Errorf("failed to write file: %w", err))
+			}
 		}
 		fmt.Printf("\n")
 		fmt.Printf("Image from diskette saved to file '%s'.\n", filename)
+		if id, err := hfe.Identify(disk); err == nil {
+			fmt.Printf("Disk: %s\n", id)
+			if warning := id.FormatWarning(hfe.DetectImageFormat(filename)); warning != "" {
+				fmt.Printf("Warning: %s\n", warning)
+			}
+		}
+		if report := analysis.LayoutReport(trackLayouts); report != "" {
+			fmt.Println(report)
+		}
+
+		if writeManifest {
+			err := saveManifest(filename, disk, measured[0], measured[1])
+			if err != nil {
+				checkErr(err)
+			}
+			fmt.Printf("Manifest saved to file '%s'.\n", hfe.ManifestName(filename))
+		}
+
+		if analyzeDir != "" {
+			err := saveSectorMap(analyzeDir, disk)
+			if err != nil {
+				checkErr(err)
+			}
+			fmt.Printf("Analysis saved to directory '%s'.\n", analyzeDir)
+		}
 	},
 }
 
+// Write image of the disk read. Sectors missing from IMG image,
+// like of tracks left empty or not read, are filled with zeros,
+// unless reading must stop at the first failure.
+func writeImage(filename string, disk *hfe.Disk) error {
+	if hfe.DetectImageFormat(filename) != hfe.ImageFormatIMG {
+		return hfe.Write(filename, disk)
+	}
+	report, err := hfe.WriteIMGOptions(filename, disk, hfe.IMGOptions{Strict: ReadOpts.FailFast})
+	if err != nil {
+		return err
+	}
+	if len(report.Missing) > 0 {
+		fmt.Printf("\nWarning: %d sectors could not be read, filled with zeros in the image.\n", len(report.Missing))
+	}
+	return nil
+}
+
+// Trim the disk as requested by ReadOpts.Trim, and print the report.
+// Returns true when any cylinder was removed or added.
+func trimRead(disk *hfe.Disk) bool {
+	fmt.Printf("\n")
+	report := disk.Trim(*ReadOpts.Trim)
+	printTrimReport(report)
+	return report.Changed()
+}
+
+// Directory for analysis files, empty when analysis is disabled
+var analyzeDir string
+
+// Save JSON manifest next to the image
+var writeManifest bool
+
+// Alignment of sectors on tracks read, when analysis is enabled
+var trackLayouts []analysis.TrackLayout
+
+// Bin size of flux histograms, in nanoseconds
+const histogramBinNs = 50
+
+// Create analysis directory, and save flux histogram of every track read
+func startAnalysis(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create analysis directory: %w", err)
+	}
+	FluxHook = func(cyl, head int, transitions []uint64) {
+		name := filepath.Join(dir, fmt.Sprintf("flux-%02d.%d", cyl, head))
+		err := writeFile(name+".csv", func(f *os.File) error {
+			return analysis.HistogramCSV(f, transitions, histogramBinNs)
+		})
+		if err == nil {
+			err = writeFile(name+".png", func(f *os.File) error {
+				return analysis.HistogramPNG(f, transitions, histogramBinNs)
+			})
+		}
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	// Keep layout of the last read of every track
+	trackLayouts = nil
+	LayoutHook = func(cyl, head int, layout *mfm.TrackLayout) {
+		trackLayouts = slices.DeleteFunc(trackLayouts, func(t analysis.TrackLayout) bool {
+			return t.Cyl == cyl && t.Head == head
+		})
+		trackLayouts = append(trackLayouts, analysis.TrackLayout{Cyl: cyl, Head: head, Layout: layout})
+		analysis.SortLayouts(trackLayouts)
+	}
+	return nil
+}
+
+// Save map of good and bad sectors of the disk
+func saveSectorMap(dir string, disk *hfe.Disk) error {
+	report := analysis.ScanSectors(disk)
+	err := writeFile(filepath.Join(dir, "sectors.csv"), func(f *os.File) error {
+		return analysis.SectorMapCSV(f, report)
+	})
+	if err != nil {
+		return err
+	}
+	if len(trackLayouts) > 0 {
+		err = writeFile(filepath.Join(dir, "layout.csv"), func(f *os.File) error {
+			return analysis.LayoutCSV(f, trackLayouts)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if report.MaxSectors == 0 {
+		// Nothing to draw
+		return nil
+	}
+	return writeFile(filepath.Join(dir, "sectors.png"), func(f *os.File) error {
+		return analysis.SectorMapPNG(f, report)
+	})
+}
+
+// Save manifest of the image, with identification of the adapter and drive,
+// and with rates measured while reading, when known
+func saveManifest(filename string, disk *hfe.Disk, rpm, bitRate float64) error {
+	m, err := hfe.NewManifest(filename, disk)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if rpm != 0 {
+		m.RPM = math.Round(rpm*10) / 10
+	}
+	if bitRate != 0 {
+		m.BitRate = math.Round(bitRate)
+	}
+	if d, ok := floppyAdapter.(Describer); ok {
+		device := d.Describe()
+		m.Device = &device
+	}
+	m.Drive = config.DriveName
+	for _, t := range trackLayouts {
+		m.SetLayout(t.Cyl, t.Head, t.Layout)
+	}
+	return m.Save(filename)
+}
+
+// Create file and fill it using the given function
+func writeFile(filename string, write func(f *os.File) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	err = write(f)
+	closeErr := f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to write %s: %w", filename, closeErr)
+	}
+	return nil
+}
+
 func init() {
+	readCmd.Flags().BoolVar(&config.Calibrate, "calibrate", false, "verify track 0 sensor and head seek before reading")
+	readCmd.Flags().IntVar(&ReadOpts.StartTrack, "start-track", ReadOpts.StartTrack, "first `cylinder` to read")
+	readCmd.Flags().IntVar(&ReadOpts.EndTrack, "end-track", ReadOpts.EndTrack, "last `cylinder` to read, -1 for the end of disk")
+	readCmd.Flags().StringVar(&ReadOpts.Sides, "sides", ReadOpts.Sides, "sides to read: both, 0 or 1")
+	readCmd.Flags().BoolVar(&ReadOpts.Indexless, "no-index", false, "drive has no index sensor: find revolutions from flux data (KryoFlux only)")
+	readCmd.Flags().DurationVar(&ReadOpts.CaptureTime, "capture-time", ReadOpts.CaptureTime, "duration of capture without index sensor")
+	readCmd.Flags().IntVar(&ReadOpts.Revolutions, "revolutions", 0, "revolutions to capture per track, 0 for the adapter default")
+	readCmd.Flags().BoolVar(&writeManifest, "manifest", false, "save description of the image to DEST.EXT.json")
+	readCmd.Flags().BoolVar(&ReadOpts.Verify, "verify", false, "read every track again and require two matching decodes of every sector")
+	readCmd.Flags().IntVar(&ReadOpts.VerifyRetries, "verify-retries", ReadOpts.VerifyRetries, "extra reads of a track when sectors do not match")
+	readCmd.Flags().BoolVar(&ReadOpts.FailFast, "fail-fast", false, "stop at the first track which cannot be read")
+	readCmd.Flags().IntVar(&ReadOpts.Retries, "retries", ReadOpts.Retries, "extra reads of a track which fails to read")
+	readCmd.Flags().IntVar(&ReadOpts.MaxFailedTracks, "max-failed-tracks", ReadOpts.MaxFailedTracks, "fail when more tracks cannot be read")
+	readCmd.Flags().IntVar(&ReadOpts.MaxReconnects, "max-reconnects", ReadOpts.MaxReconnects, "attempts to reopen the adapter after it drops off the bus")
+	readCmd.Flags().IntVar((*int)(&ReadOpts.HFEVersion), "hfe-version", int(ReadOpts.HFEVersion), "version of HFE image: 1 or 3")
+	readCmd.Flags().IntVar(&ReadOpts.BitRate, "bit-rate", 0, "bit rate of the disk in `kbps`, 0 to measure")
+	readCmd.Flags().IntVar(&ReadOpts.RPM, "rpm", 0, "rotation speed of the disk, 0 to measure")
+	readCmd.Flags().IntVar(&ReadOpts.RateTracks, "rate-tracks", ReadOpts.RateTracks, "measure rotation speed and bit rate of the disk on `N` tracks")
+	readCmd.Flags().IntVar(&ReadOpts.WeakThreshold, "weak-threshold", ReadOpts.WeakThreshold, "mark bitcells as weak when more than `N` revolutions disagree with the majority")
+	readCmd.Flags().BoolVar(&trimDisk, "trim", false, "remove empty and duplicate cylinders at the end of disk")
+	readCmd.Flags().IntVar(&trimTracks, "tracks", 0, "trim or pad the image to `N` cylinders: 40, 80, 82 or 83")
+	readCmd.Flags().StringVar(&analyzeDir, "analyze", "", "save flux histograms, sector map and track layout to `directory`")
 	rootCmd.AddCommand(readCmd)
 }
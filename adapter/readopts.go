@@ -0,0 +1,215 @@
+package adapter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/flux"
+	"github.com/sergev/floppy/hfe"
+)
+
+// ReadOptions select part of the disk for adapters to read
+type ReadOptions struct {
+	StartTrack int    // First cylinder to read
+	EndTrack   int    // Last cylinder to read, -1 = up to the end of disk
+	Sides      string // Sides to read: "both", "0" or "1"
+
+	// Index-less capture mode, for drives without index sensor:
+	// stream for a fixed time, and find revolutions from flux data
+	Indexless   bool
+	CaptureTime time.Duration // Duration of index-less capture
+
+	// Revolutions captured per track, 0 = default of the adapter
+	Revolutions int
+
+	// Verification mode: every track is read again, until all sectors
+	// are decoded identically twice, or VerifyRetries extra reads are made
+	Verify        bool
+	VerifyRetries int
+
+	// Tracks which cannot be read are read again up to Retries times,
+	// then left empty, and reading goes on. Read fails at the end when more
+	// than MaxFailedTracks tracks are lost. With FailFast, the first failed
+	// track stops reading.
+	FailFast        bool
+	Retries         int
+	MaxFailedTracks int
+
+	// Adapter which drops off the bus is opened again, and reading resumes
+	// from the track in progress, at most MaxReconnects times per read
+	MaxReconnects int
+
+	// Version of HFE image written while reading
+	HFEVersion hfe.HFEVersion
+
+	// Remove trailing cylinders captured past the end of disk,
+	// see hfe.Disk.Trim, or nil to keep all cylinders
+	Trim *hfe.TrimOptions
+
+	// Values to use instead of measuring them, 0 = measure
+	BitRate int // Bit rate in kbps
+	RPM     int // Rotation speed
+
+	// Rates of the disk are medians of measurements on the first
+	// RateTracks decoded tracks, see RateEstimator
+	RateTracks int
+
+	// Regions where more than WeakThreshold revolutions of a capture
+	// disagree with the majority are weak, see WeakDetector
+	WeakThreshold int
+}
+
+// Options of the read command
+var ReadOpts = ReadOptions{
+	StartTrack: 0,
+	EndTrack:   -1,
+	Sides:      "both",
+
+	// About 1.25 revolutions at 300 RPM
+	CaptureTime: 250 * time.Millisecond,
+
+	VerifyRetries: 3,
+	HFEVersion:    hfe.HFEVersion3,
+
+	// Give up a track after three reads, and the disk after ten tracks
+	Retries:         2,
+	MaxFailedTracks: 10,
+	MaxReconnects:   3,
+
+	RateTracks: 3,
+
+	// One revolution which reads differently is noise
+	WeakThreshold: 1,
+}
+
+// Validate checks the options given by user
+func (o *ReadOptions) Validate() error {
+	switch o.Sides {
+	case "both", "0", "1":
+	default:
+		return fmt.Errorf("invalid sides: %s (must be both, 0 or 1)", o.Sides)
+	}
+	if o.StartTrack < 0 || (o.EndTrack >= 0 && o.EndTrack < o.StartTrack) {
+		return fmt.Errorf("invalid track range: %d-%d", o.StartTrack, o.EndTrack)
+	}
+	if o.StartTrack >= config.MaxCyls || o.EndTrack >= config.MaxCyls {
+		return fmt.Errorf("invalid track range: %d-%d (last cylinder is %d): %w",
+			o.StartTrack, o.EndTrack, config.MaxCyls-1, ErrBadCylinder)
+	}
+	if o.Indexless && o.CaptureTime <= 0 {
+		return fmt.Errorf("invalid capture time: %v", o.CaptureTime)
+	}
+	if o.Revolutions < 0 || o.Revolutions > 20 {
+		return fmt.Errorf("invalid number of revolutions: %d (must be 0-20)", o.Revolutions)
+	}
+	if o.VerifyRetries < 0 || o.VerifyRetries > 100 {
+		return fmt.Errorf("invalid number of verify retries: %d (must be 0-100)", o.VerifyRetries)
+	}
+	if o.Retries < 0 || o.Retries > 100 {
+		return fmt.Errorf("invalid number of retries: %d (must be 0-100)", o.Retries)
+	}
+	if o.MaxFailedTracks < 0 {
+		return fmt.Errorf("invalid number of failed tracks: %d", o.MaxFailedTracks)
+	}
+	if o.MaxReconnects < 0 || o.MaxReconnects > 100 {
+		return fmt.Errorf("invalid number of reconnects: %d (must be 0-100)", o.MaxReconnects)
+	}
+	if o.HFEVersion != hfe.HFEVersion1 && o.HFEVersion != hfe.HFEVersion3 {
+		return fmt.Errorf("invalid HFE version: %d (must be 1 or 3)", o.HFEVersion)
+	}
+	if o.Trim != nil {
+		if err := o.Trim.Validate(); err != nil {
+			return err
+		}
+	}
+	if o.BitRate != 0 && (o.BitRate < 100 || o.BitRate > 1000) {
+		return fmt.Errorf("invalid bit rate: %d kbps (must be 100-1000)", o.BitRate)
+	}
+	if o.RPM != 0 && (o.RPM < 250 || o.RPM > 400) {
+		return fmt.Errorf("invalid rotation speed: %d RPM (must be 250-400)", o.RPM)
+	}
+	if o.RateTracks < 1 || o.RateTracks > 20 {
+		return fmt.Errorf("invalid number of tracks to measure rates: %d (must be 1-20)", o.RateTracks)
+	}
+	if o.WeakThreshold < 0 || o.WeakThreshold > 20 {
+		return fmt.Errorf("invalid weak bits threshold: %d revolutions (must be 0-20)", o.WeakThreshold)
+	}
+	return nil
+}
+
+// Print rotation speed and bit rate of the disk
+func (o *ReadOptions) printRates(rpm, bitRate uint16) {
+	if o.RPM != 0 {
+		Progressf("Rotation Speed: %d RPM (forced)\n", rpm)
+	} else {
+		Progressf("Rotation Speed: %d RPM\n", rpm)
+	}
+	if o.BitRate != 0 {
+		Progressf("Bit Rate: %d kbps (forced)\n", bitRate)
+	} else {
+		Progressf("Bit Rate: %d kbps\n", bitRate)
+	}
+}
+
+// TrackRates returns rotation speed and bit rate measured on the given track,
+// unless forced by options
+func (o *ReadOptions) TrackRates(track *flux.FluxTrack) (rpm, bitRate uint16) {
+	return o.nominalRates(track.RPM(), track.MeasureBitRateKbps())
+}
+
+// Round measured rotation speed and bit rate to standard values,
+// unless forced by options
+func (o *ReadOptions) nominalRates(measuredRPM, measuredBitRate float64) (rpm, bitRate uint16) {
+	if o.RPM != 0 {
+		rpm = uint16(o.RPM)
+	} else {
+		rpm = flux.NominalSpeed(measuredRPM)
+	}
+	if o.BitRate != 0 {
+		bitRate = uint16(o.BitRate)
+	} else {
+		bitRate = flux.NominalBitRate(measuredBitRate)
+	}
+	return rpm, bitRate
+}
+
+// TrackRevolutions returns number of revolutions to capture per track:
+// as given by options, or the default of the adapter
+func (o *ReadOptions) TrackRevolutions(adapterDefault int) int {
+	if o.Revolutions != 0 {
+		return o.Revolutions
+	}
+	return adapterDefault
+}
+
+// Cylinders returns range of cylinders to read, first to last inclusive,
+// on a disk with the given number of cylinders
+func (o *ReadOptions) Cylinders(numberOfCylinders int) (first, last int) {
+	first, last = o.StartTrack, numberOfCylinders-1
+	if o.EndTrack >= 0 && o.EndTrack < last {
+		last = o.EndTrack
+	}
+	return first, last
+}
+
+// Heads returns range of heads to read, first to last inclusive,
+// on a drive with the given number of heads
+func (o *ReadOptions) Heads(numHeads int) (first, last int) {
+	switch o.Sides {
+	case "0":
+		return 0, 0
+	case "1":
+		return 1, 1
+	}
+	return 0, numHeads - 1
+}
+
+// NumberOfSides returns number of sides in the image:
+// when only side 0 is read, the image is single-sided
+func (o *ReadOptions) NumberOfSides(numHeads int) int {
+	if o.Sides == "0" {
+		return 1
+	}
+	return numHeads
+}
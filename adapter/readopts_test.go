@@ -0,0 +1,53 @@
+package adapter
+
+import (
+	"testing"
+
+	"github.com/sergev/floppy/flux"
+	"github.com/sergev/floppy/hfe"
+)
+
+func TestReadOptionsValidate(t *testing.T) {
+	for _, o := range []ReadOptions{
+		{Sides: "both", EndTrack: -1, HFEVersion: 2},
+		{Sides: "both", EndTrack: -1, HFEVersion: hfe.HFEVersion3, BitRate: 50},
+		{Sides: "both", EndTrack: -1, HFEVersion: hfe.HFEVersion3, RPM: 1000},
+		{Sides: "both", EndTrack: 84, HFEVersion: hfe.HFEVersion3},
+		{Sides: "both", StartTrack: 90, EndTrack: -1, HFEVersion: hfe.HFEVersion3},
+		{Sides: "both", EndTrack: -1, HFEVersion: hfe.HFEVersion3, Revolutions: 21},
+	} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Validate(%+v) accepted invalid options", o)
+		}
+	}
+	o := ReadOpts
+	o.WeakThreshold = -1
+	if err := o.Validate(); err == nil {
+		t.Errorf("Validate() accepted negative weak bits threshold")
+	}
+	o = ReadOpts
+	o.HFEVersion, o.BitRate, o.RPM = hfe.HFEVersion1, 300, 360
+	o.EndTrack = 83
+	if err := o.Validate(); err != nil {
+		t.Errorf("Validate() error: %v", err)
+	}
+}
+
+func TestTrackRates(t *testing.T) {
+	// One revolution of 200 msec with DD density of transitions
+	track := &flux.FluxTrack{IndexPulses: []uint64{0, 200000000}}
+	for pos := uint64(6000); pos < 200000000; pos += 6000 {
+		track.Transitions = append(track.Transitions, pos)
+	}
+
+	o := ReadOptions{}
+	if rpm, bitRate := o.TrackRates(track); rpm != 300 || bitRate != 250 {
+		t.Errorf("measured %d RPM, %d kbps, expected 300 and 250", rpm, bitRate)
+	}
+
+	// 300 kbps media in a 360 RPM drive
+	o = ReadOptions{BitRate: 300, RPM: 360}
+	if rpm, bitRate := o.TrackRates(track); rpm != 360 || bitRate != 300 {
+		t.Errorf("forced %d RPM, %d kbps, expected 360 and 300", rpm, bitRate)
+	}
+}
@@ -0,0 +1,72 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// Time allowed for the device to appear on the bus again, after it is lost
+const ReconnectTimeout = 10 * time.Second
+
+// First pause before opening the device again; it doubles up to a second
+var ReconnectDelay = 100 * time.Millisecond
+
+// SerialError maps errors of a serial port which mean that the device
+// is gone from the bus to ErrDeviceGone. Other errors are returned as is.
+func SerialError(err error) error {
+	var portErr *serial.PortError
+	if errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.EIO) ||
+		errors.Is(err, syscall.ENXIO) ||
+		errors.Is(err, syscall.ENODEV) ||
+		(errors.As(err, &portErr) && portErr.Code() == serial.PortClosed) {
+		return fmt.Errorf("%w: %v", ErrDeviceGone, err)
+	}
+	return err
+}
+
+// FindSerialPort returns name of the serial port of the device with
+// the given serial number. After the device is enumerated again, it can
+// appear under another name. Returns name when the device is not found.
+func FindSerialPort(serialNumber, name string) string {
+	if serialNumber == "" {
+		return name
+	}
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return name
+	}
+	for _, port := range ports {
+		if port.IsUSB && port.SerialNumber == serialNumber {
+			return port.Name
+		}
+	}
+	return name
+}
+
+// Reopen calls open until it succeeds, with growing pauses before every
+// attempt, and gives up after ReconnectTimeout.
+func Reopen(open func() error) error {
+	deadline := time.Now().Add(ReconnectTimeout)
+	delay := ReconnectDelay
+	attempts := 0
+	for {
+		time.Sleep(delay)
+		attempts++
+		err := open()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("failed to reopen device (tried %d times): %w", attempts, err)
+		}
+		delay = min(delay*2, time.Second)
+	}
+}
@@ -31,3 +31,15 @@ func RegisterUSBAdapter(factory AdapterFactory) {
 		Factory:   factory,
 	})
 }
+
+// SimulatorFactory is a function that creates a simulated adapter
+// with the disk from the given image file
+type SimulatorFactory func(filename string) (FloppyAdapter, error)
+
+var registeredSimulator SimulatorFactory
+
+// RegisterSimulator registers the simulated adapter, which is used
+// instead of hardware when the --simulate option is given
+func RegisterSimulator(factory SimulatorFactory) {
+	registeredSimulator = factory
+}
@@ -2,6 +2,7 @@ package adapter
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 
 	"github.com/sergev/floppy/config"
@@ -11,12 +12,27 @@ import (
 
 var floppyAdapter FloppyAdapter
 
+// Image file of the simulated disk, when set by --simulate option
+var simulateImage string
+
+// Log file of exchanges with the device, when set by --trace option
+var traceFile string
+
+// Transcript file of exchanges with the device, when set by --record option
+var recordFile string
+
 const supportedImageFormatsText = `Supported image formats:
+  *.86f          - 86Box flux-accurate image
+  *.a2r          - Applesauce flux image (read only)
   *.adf          - Amiga Disk File
   *.bkd          - BK-0010/0011M Disk image
+  *.d64          - Commodore 1541 disk image
   *.hfe          - HxC Floppy Emulator
   *.imd          - Dave Dunfield's ImageDisk utility
-  *.img or *.ima - raw binary contents of the entire disk`
+  *.img or *.ima - raw binary contents of the entire disk
+  *.msa          - Magic Shadow Archiver image of Atari ST disk
+  *.st           - raw binary contents of Atari ST disk
+Any of these may be compressed with gzip, like disk.hfe.gz`
 	// TODO: cp2        - Central Point Software's Copy-II-PC
 	// TODO: dcf        - Disk Copy Fast utility
 	// TODO: epl        - EPLCopy utility
@@ -46,6 +62,25 @@ var rootCmd = &cobra.Command{
 		}
 
 		var err error
+		var traceFuncs []TraceFunc
+		if traceFile != "" {
+			f, err := os.Create(traceFile)
+			if err != nil {
+				cobra.CheckErr(fmt.Errorf("failed to create trace file: %w", err))
+			}
+			traceFuncs = append(traceFuncs, TraceWriter(f))
+		}
+		if recordFile != "" {
+			f, err := os.Create(recordFile)
+			if err != nil {
+				cobra.CheckErr(fmt.Errorf("failed to create transcript file: %w", err))
+			}
+			SetTraceFullData(true)
+			traceFuncs = append(traceFuncs, TranscriptWriter(f))
+		}
+		if len(traceFuncs) > 0 {
+			SetTraceFunc(TeeTrace(traceFuncs...))
+		}
 		floppyAdapter, err = findAdapter()
 		if err != nil {
 			cobra.CheckErr(fmt.Errorf("%w", err))
@@ -57,11 +92,21 @@ var rootCmd = &cobra.Command{
 			cobra.CheckErr(fmt.Errorf("failed to initialize config: %w", err))
 		}
 	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		stopMotor()
+	},
 }
 
 // findAdapter attempts to find and initialize a registered adapter
 // Returns the initialized adapter or an error if none is found
 func findAdapter() (FloppyAdapter, error) {
+	if simulateImage != "" {
+		if registeredSimulator == nil {
+			return nil, fmt.Errorf("simulated adapter is not available")
+		}
+		return registeredSimulator(simulateImage)
+	}
+
 	ports, err := enumerator.GetDetailedPortsList()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list serial ports: %w", err)
@@ -106,6 +151,28 @@ func findAdapter() (FloppyAdapter, error) {
 	return nil, fmt.Errorf("no supported USB floppy adapter found")
 }
 
+func init() {
+	rootCmd.PersistentFlags().StringVar(&simulateImage, "simulate", "", "use simulated drive with disk image `FILE` instead of USB adapter")
+	rootCmd.PersistentFlags().StringVar(&traceFile, "trace", "", "log all exchanges with the device to `FILE`")
+	rootCmd.PersistentFlags().StringVar(&recordFile, "record", "", "record transcript of exchanges with the device to `FILE`, for tests")
+}
+
+// Turn off the motor left running by the adapter after the last operation
+func stopMotor() {
+	if stopper, ok := floppyAdapter.(MotorStopper); ok {
+		stopper.StopMotor()
+	}
+}
+
+// checkErr is like cobra.CheckErr, and also turns off the drive motor
+// before exiting on error
+func checkErr(err error) {
+	if err != nil {
+		stopMotor()
+	}
+	cobra.CheckErr(err)
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 func Execute() {
 	cobra.CheckErr(rootCmd.Execute())
@@ -0,0 +1,49 @@
+package adapter
+
+import (
+	"fmt"
+	"math"
+)
+
+// RPMStats computes mean rotation speed and its standard deviation
+// from a list of revolution periods in nanoseconds.
+func RPMStats(periodsNs []float64) (mean float64, stddev float64, err error) {
+	if len(periodsNs) == 0 {
+		return 0, 0, fmt.Errorf("no revolutions measured")
+	}
+
+	// Convert every period to RPM
+	sum := 0.0
+	rpms := make([]float64, len(periodsNs))
+	for i, period := range periodsNs {
+		if period <= 0 {
+			return 0, 0, fmt.Errorf("invalid revolution period %.0f nsec", period)
+		}
+		rpms[i] = 60e9 / period
+		sum += rpms[i]
+	}
+	mean = sum / float64(len(rpms))
+
+	// Population standard deviation
+	variance := 0.0
+	for _, rpm := range rpms {
+		variance += (rpm - mean) * (rpm - mean)
+	}
+	stddev = math.Sqrt(variance / float64(len(rpms)))
+	return mean, stddev, nil
+}
+
+// NominalRPM returns the standard spindle speed closest to the measured one: 300 or 360.
+// Use 330 RPM as the threshold (midpoint between 300 and 360).
+func NominalRPM(rpm float64) float64 {
+	if rpm < 330 {
+		return 300
+	}
+	return 360
+}
+
+// RPMDeviation returns the deviation of measured speed from nominal, in percent.
+func RPMDeviation(rpm float64) float64 {
+	nominal := NominalRPM(rpm)
+	return (rpm - nominal) * 100 / nominal
+}
@@ -13,7 +13,7 @@ var statusCmd = &cobra.Command{
 	Long:  "Check the status of the USB floppy disk controller.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if floppyAdapter == nil {
-			cobra.CheckErr(fmt.Errorf("adapter not available"))
+			checkErr(fmt.Errorf("adapter not available"))
 		}
 
 		// Print status information
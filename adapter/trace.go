@@ -0,0 +1,157 @@
+package adapter
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceDirection tells which way the traced bytes went
+type TraceDirection int
+
+const (
+	TraceToDevice   TraceDirection = iota // Host to device
+	TraceFromDevice                       // Device to host
+	TraceNote                             // Decoded information, no bytes transferred
+)
+
+func (d TraceDirection) String() string {
+	switch d {
+	case TraceToDevice:
+		return ">>"
+	case TraceFromDevice:
+		return "<<"
+	default:
+		return "--"
+	}
+}
+
+// Longest data kept in a trace event. Bulk flux data is truncated,
+// and its full size is given by Length, unless full data is enabled
+// by SetTraceFullData.
+const MaxTraceData = 64
+
+// TraceEvent describes one exchange with the device
+type TraceEvent struct {
+	Adapter   string         // Adapter name, like "greaseweazle"
+	Direction TraceDirection // Which way the bytes went
+	Command   string         // Decoded command name, or text of a note
+	Data      []byte         // Bytes transferred, up to MaxTraceData unless full data is enabled
+	Length    int            // Number of bytes transferred
+	Time      time.Time      // When the transfer started
+	Duration  time.Duration  // How long the transfer took
+	Err       error          // Error of the transfer, or nil
+}
+
+// TraceFunc receives trace events from adapters
+type TraceFunc func(event TraceEvent)
+
+var (
+	traceMu   sync.Mutex
+	traceFunc TraceFunc
+	traceFull bool // Keep all data of events, see SetTraceFullData
+)
+
+// SetTraceFunc installs a function which receives every exchange of adapters
+// with the device. Nil disables tracing, which is the default.
+func SetTraceFunc(fn TraceFunc) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	traceFunc = fn
+}
+
+// SetTraceFullData makes trace events carry all bytes transferred,
+// not only first MaxTraceData bytes. Needed to record transcripts.
+func SetTraceFullData(full bool) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	traceFull = full
+}
+
+// TeeTrace returns a trace function which passes events to all given ones
+func TeeTrace(fns ...TraceFunc) TraceFunc {
+	return func(event TraceEvent) {
+		for _, fn := range fns {
+			fn(event)
+		}
+	}
+}
+
+// Tracing reports whether trace events are wanted.
+// Adapters check it to avoid building events nobody receives.
+func Tracing() bool {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	return traceFunc != nil
+}
+
+// Trace reports bytes transferred by the adapter, starting at the given time.
+// Data is copied, so the caller may reuse its buffer.
+func Trace(adapter string, dir TraceDirection, command string, data []byte, start time.Time, err error) {
+	traceMu.Lock()
+	fn := traceFunc
+	limit := MaxTraceData
+	if traceFull {
+		limit = len(data)
+	}
+	traceMu.Unlock()
+	if fn == nil {
+		return
+	}
+	fn(TraceEvent{
+		Adapter:   adapter,
+		Direction: dir,
+		Command:   command,
+		Data:      append([]byte(nil), data[:min(len(data), limit)]...),
+		Length:    len(data),
+		Time:      start,
+		Duration:  time.Since(start),
+		Err:       err,
+	})
+}
+
+// Tracef reports decoded information as a note in the trace
+func Tracef(adapter string, format string, args ...interface{}) {
+	if !Tracing() {
+		return
+	}
+	Trace(adapter, TraceNote, fmt.Sprintf(format, args...), nil, time.Now(), nil)
+}
+
+// TraceWriter returns a trace function which writes events to w
+// as a log with hexdump of data, like:
+//
+//	15:04:05.000000 greaseweazle >> GET_INFO (3 bytes, 12µs)
+//	  0000  00 03 00                                          |...|
+func TraceWriter(w io.Writer) TraceFunc {
+	var mu sync.Mutex
+	return func(event TraceEvent) {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %s %s %s", event.Time.Format("15:04:05.000000"),
+			event.Adapter, event.Direction, event.Command)
+		if event.Direction != TraceNote {
+			fmt.Fprintf(&b, " (%d bytes, %v)", event.Length, event.Duration)
+		}
+		if event.Err != nil {
+			fmt.Fprintf(&b, ": %v", event.Err)
+		}
+		b.WriteByte('\n')
+		if data := event.Data[:min(len(event.Data), MaxTraceData)]; len(data) > 0 {
+			dump := hex.Dump(data)
+			for _, line := range strings.SplitAfter(strings.TrimSuffix(dump, "\n"), "\n") {
+				b.WriteString("  " + strings.TrimPrefix(line, "0000"))
+			}
+			b.WriteByte('\n')
+			if event.Length > len(data) {
+				fmt.Fprintf(&b, "  ... %d more bytes\n", event.Length-len(data))
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, b.String())
+	}
+}
@@ -0,0 +1,66 @@
+package adapter
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	var events []TraceEvent
+	SetTraceFunc(func(event TraceEvent) { events = append(events, event) })
+	defer SetTraceFunc(nil)
+
+	// Data is copied and truncated, full length is kept
+	data := bytes.Repeat([]byte{0xaa}, MaxTraceData+10)
+	Trace("test", TraceFromDevice, "flux data", data, time.Now(), nil)
+	data[0] = 0
+	Tracef("test", "%d transitions", 42)
+
+	if len(events) != 2 {
+		t.Fatalf("got %d events, expected 2", len(events))
+	}
+	e := events[0]
+	if e.Adapter != "test" || e.Direction != TraceFromDevice || e.Command != "flux data" ||
+		e.Length != MaxTraceData+10 || len(e.Data) != MaxTraceData || e.Data[0] != 0xaa {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if e := events[1]; e.Direction != TraceNote || e.Command != "42 transitions" || e.Length != 0 {
+		t.Errorf("unexpected note %+v", e)
+	}
+
+	// Nothing is reported when tracing is off
+	SetTraceFunc(nil)
+	if Tracing() {
+		t.Errorf("Tracing() = true after SetTraceFunc(nil)")
+	}
+	Tracef("test", "lost")
+	if len(events) != 2 {
+		t.Errorf("event reported with tracing off")
+	}
+}
+
+func TestTraceWriter(t *testing.T) {
+	var out bytes.Buffer
+	trace := TraceWriter(&out)
+	start := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	trace(TraceEvent{Adapter: "gw", Direction: TraceToDevice, Command: "GET_INFO",
+		Data: []byte{0, 3, 0}, Length: 3, Time: start, Duration: time.Millisecond})
+	trace(TraceEvent{Adapter: "gw", Direction: TraceFromDevice, Command: "flux data",
+		Data: []byte("0123456789abcdefXY"), Length: 1000, Time: start, Err: errors.New("timeout")})
+	trace(TraceEvent{Adapter: "gw", Direction: TraceNote, Command: "retry 1", Time: start})
+
+	want := `15:04:05.000000 gw >> GET_INFO (3 bytes, 1ms)
+  0000  00 03 00                                          |...|
+15:04:05.000000 gw << flux data (1000 bytes, 0s): timeout
+  0000  30 31 32 33 34 35 36 37  38 39 61 62 63 64 65 66  |0123456789abcdef|
+  0010  58 59                                             |XY|
+  ... 982 more bytes
+15:04:05.000000 gw -- retry 1
+`
+	if got := out.String(); got != want {
+		t.Errorf("trace log:\n%s\nexpected:\n%s", got, want)
+	}
+}
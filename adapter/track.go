@@ -0,0 +1,77 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/flux"
+	"github.com/sergev/floppy/hfe"
+)
+
+// TrackCapture is one track of the disk, read into memory by ReadTrack
+type TrackCapture struct {
+	Cyl     int    // Cylinder number
+	Head    int    // Side of the disk
+	BitRate uint16 // Bit rate used for decoding, in kbps
+	RPM     uint16 // Nominal rotation speed
+
+	// MFM bitcells of one revolution, starting before sector 1,
+	// in the same layout as tracks of hfe.Disk
+	MFM []byte
+
+	// Bit position of the index pulse in MFM
+	Index int
+
+	// Raw flux transitions and index pulses of the capture,
+	// in nanoseconds relative to the first index pulse
+	Flux *flux.FluxTrack
+
+	// Lock of PLL when decoding the first capture
+	Lock flux.PLLLock
+
+	// Weak bitcells of MFM, see WeakDetector, or nil
+	Weak []byte
+}
+
+// Store puts MFM bitcells of the capture into the disk, as the track
+// at its cylinder and side, with their weak mask
+func (t *TrackCapture) Store(disk *hfe.Disk) {
+	if t.Head == 0 {
+		disk.Tracks[t.Cyl].Side0 = t.MFM
+	} else {
+		disk.Tracks[t.Cyl].Side1 = t.MFM
+	}
+	disk.Tracks[t.Cyl].IndexBitOffset[t.Head] = t.Index
+	disk.Tracks[t.Cyl].WeakBits[t.Head] = t.Weak
+}
+
+// CheckTrack returns an error when the drive has no such cylinder or head
+func CheckTrack(cyl, head int) error {
+	if cyl < 0 || cyl >= config.Cyls {
+		return fmt.Errorf("invalid cylinder %d (must be 0-%d): %w", cyl, config.Cyls-1, ErrBadCylinder)
+	}
+	if head < 0 || head >= config.Heads {
+		return fmt.Errorf("invalid head %d (must be 0-%d)", head, config.Heads-1)
+	}
+	return nil
+}
+
+// CheckIndex returns ErrHardSectored when the track has index pulses
+// of sector holes, more than one per revolution of the configured drive
+func CheckIndex(track *flux.FluxTrack) error {
+	return track.CheckIndex(config.RPM)
+}
+
+// RevolutionMFM starts decoded MFM bitcells of a track before sector 1,
+// and cuts them to exactly one revolution at the given rates.
+// Bitcells must start at the index. Returns bit position of the index
+// in the result, which is 0 when the track is not rotated.
+func RevolutionMFM(bits []byte, bitRate, rpm uint16) ([]byte, int) {
+	index := 0
+	if start, err := hfe.SectorStart(bits, 1); err == nil {
+		index = (len(bits)*8 - start) % (len(bits) * 8)
+		bits = hfe.RotateTrack(bits, start)
+	}
+	revBits := hfe.RevolutionBits(bitRate, rpm)
+	return hfe.TrimTrackToRevolution(bits, revBits), index % revBits
+}
@@ -0,0 +1,276 @@
+package adapter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Transcript is a recorded exchange of bytes with the device. It is captured
+// from real hardware with the --record option, and replayed in tests instead
+// of the device.
+//
+// File format: magic "FDXT" and version byte 1, followed by records.
+// Every record is a direction byte ('>' to device, '<' from device),
+// length of data as 32-bit little-endian, and data.
+const transcriptMagic = "FDXT\x01"
+
+// Direction markers of transcript records
+const (
+	transcriptToDevice   = '>'
+	transcriptFromDevice = '<'
+)
+
+// Longest record accepted when reading a transcript
+const maxTranscriptRecord = 16 << 20
+
+// TranscriptRecord is one transfer to or from the device
+type TranscriptRecord struct {
+	Direction TraceDirection // TraceToDevice or TraceFromDevice
+	Data      []byte
+}
+
+// TranscriptWriter returns a trace function which writes exchanges
+// with the device to w in transcript format. Notes are skipped.
+// Trace events must carry full data, see SetTraceFullData.
+func TranscriptWriter(w io.Writer) TraceFunc {
+	var mu sync.Mutex
+	started := false
+	return func(event TraceEvent) {
+		if event.Direction == TraceNote || len(event.Data) == 0 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !started {
+			io.WriteString(w, transcriptMagic)
+			started = true
+		}
+		writeTranscriptRecord(w, TranscriptRecord{event.Direction, event.Data})
+	}
+}
+
+// RecordTranscript makes all exchanges of adapters with the device
+// recorded to w in transcript format, until the returned function is called.
+// Tracing to other functions is replaced meanwhile.
+func RecordTranscript(w io.Writer) (stop func()) {
+	SetTraceFullData(true)
+	SetTraceFunc(TranscriptWriter(w))
+	return func() {
+		SetTraceFunc(nil)
+		SetTraceFullData(false)
+	}
+}
+
+// Write one record in transcript format
+func writeTranscriptRecord(w io.Writer, record TranscriptRecord) error {
+	header := make([]byte, 5)
+	header[0] = transcriptToDevice
+	if record.Direction == TraceFromDevice {
+		header[0] = transcriptFromDevice
+	}
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(record.Data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(record.Data)
+	return err
+}
+
+// WriteTranscript writes records to w in transcript format
+func WriteTranscript(w io.Writer, records []TranscriptRecord) error {
+	if _, err := io.WriteString(w, transcriptMagic); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := writeTranscriptRecord(w, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadTranscript reads all records of a transcript
+func ReadTranscript(r io.Reader) ([]TranscriptRecord, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(transcriptMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != transcriptMagic {
+		return nil, fmt.Errorf("not a transcript file")
+	}
+
+	var records []TranscriptRecord
+	header := make([]byte, 5)
+	for {
+		_, err := io.ReadFull(br, header)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("truncated transcript record %d", len(records))
+		}
+		var dir TraceDirection
+		switch header[0] {
+		case transcriptToDevice:
+			dir = TraceToDevice
+		case transcriptFromDevice:
+			dir = TraceFromDevice
+		default:
+			return nil, fmt.Errorf("bad direction 0x%02x of transcript record %d", header[0], len(records))
+		}
+		length := binary.LittleEndian.Uint32(header[1:])
+		if length > maxTranscriptRecord {
+			return nil, fmt.Errorf("transcript record %d too long: %d bytes", len(records), length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("truncated transcript record %d", len(records))
+		}
+		records = append(records, TranscriptRecord{dir, data})
+	}
+}
+
+// LoadTranscript reads a transcript file
+func LoadTranscript(filename string) ([]TranscriptRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := ReadTranscript(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return records, nil
+}
+
+// USBSetupPacket returns setup packet of a control transfer,
+// as recorded in transcripts
+func USBSetupPacket(rType, request uint8, val, idx uint16, length int) []byte {
+	setup := make([]byte, 8)
+	setup[0] = rType
+	setup[1] = request
+	binary.LittleEndian.PutUint16(setup[2:4], val)
+	binary.LittleEndian.PutUint16(setup[4:6], idx)
+	binary.LittleEndian.PutUint16(setup[6:8], uint16(length))
+	return setup
+}
+
+// ErrTranscriptMismatch is reported when the adapter departs from the transcript
+var ErrTranscriptMismatch = errors.New("transcript mismatch")
+
+// Replay plays back a transcript in place of the device. Bytes written
+// must match the recorded commands, and reads return the recorded responses,
+// at most one record per read. It serves as a serial port, and as USB
+// control and bulk endpoints.
+type Replay struct {
+	records []TranscriptRecord
+	pos     int   // Index of current record
+	offset  int   // Bytes of current record consumed
+	err     error // First mismatch
+}
+
+// NewReplay creates a replay of the given records
+func NewReplay(records []TranscriptRecord) *Replay {
+	return &Replay{records: records}
+}
+
+// Current record when it goes in the given direction, or nil
+func (r *Replay) next(dir TraceDirection) []byte {
+	for r.pos < len(r.records) && r.offset == len(r.records[r.pos].Data) {
+		r.pos++
+		r.offset = 0
+	}
+	if r.pos == len(r.records) || r.records[r.pos].Direction != dir {
+		return nil
+	}
+	return r.records[r.pos].Data[r.offset:]
+}
+
+// Remember the first mismatch, and report it from now on
+func (r *Replay) fail(format string, args ...interface{}) error {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w at record %d: %s", ErrTranscriptMismatch, r.pos, fmt.Sprintf(format, args...))
+	}
+	return r.err
+}
+
+func (r *Replay) Write(buf []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	done := 0
+	for done < len(buf) {
+		want := r.next(TraceToDevice)
+		if want == nil {
+			return done, r.fail("unexpected write of % x", buf[done:min(len(buf), done+16)])
+		}
+		n := min(len(want), len(buf)-done)
+		if !bytes.Equal(buf[done:done+n], want[:n]) {
+			return done, r.fail("wrote % x, expected % x", buf[done:done+min(n, 16)], want[:min(n, 16)])
+		}
+		r.offset += n
+		done += n
+	}
+	return done, nil
+}
+
+func (r *Replay) Read(buf []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	data := r.next(TraceFromDevice)
+	if data == nil {
+		if r.pos == len(r.records) {
+			return 0, io.EOF
+		}
+		return 0, r.fail("read while the device waits for a command")
+	}
+	n := copy(buf, data)
+	r.offset += n
+	return n, nil
+}
+
+// Control performs a control transfer: the setup packet must match
+// the recorded one, and data of the next record is returned
+func (r *Replay) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if _, err := r.Write(USBSetupPacket(rType, request, val, idx, len(data))); err != nil {
+		return 0, err
+	}
+	if r.next(TraceFromDevice) == nil {
+		// Transfer without data stage
+		return 0, nil
+	}
+	return r.Read(data)
+}
+
+func (r *Replay) Close() error {
+	return nil
+}
+
+func (r *Replay) SetMode(mode *serial.Mode) error {
+	return nil
+}
+
+func (r *Replay) SetReadTimeout(t time.Duration) error {
+	return nil
+}
+
+// Done reports a mismatch, or records left unplayed
+func (r *Replay) Done() error {
+	if r.err != nil {
+		return r.err
+	}
+	r.next(TraceToDevice)
+	if r.pos < len(r.records) {
+		return fmt.Errorf("%w: %d records left unplayed", ErrTranscriptMismatch, len(r.records)-r.pos)
+	}
+	return nil
+}
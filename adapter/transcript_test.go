@@ -0,0 +1,104 @@
+package adapter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTranscriptFormat(t *testing.T) {
+	var buf bytes.Buffer
+	stop := RecordTranscript(&buf)
+	Trace("test", TraceToDevice, "GET_INFO", []byte{0, 3, 0}, time.Now(), nil)
+	Tracef("test", "notes are not recorded")
+	Trace("test", TraceFromDevice, "flux data", bytes.Repeat([]byte{0x55}, MaxTraceData+10), time.Now(), nil)
+	stop()
+	if Tracing() {
+		t.Errorf("tracing left enabled after recording")
+	}
+
+	records, err := ReadTranscript(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadTranscript() error: %v", err)
+	}
+	if len(records) != 2 || records[0].Direction != TraceToDevice || !bytes.Equal(records[0].Data, []byte{0, 3, 0}) ||
+		records[1].Direction != TraceFromDevice || len(records[1].Data) != MaxTraceData+10 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	// Written again, the transcript is the same
+	var again bytes.Buffer
+	if err := WriteTranscript(&again, records); err != nil {
+		t.Fatalf("WriteTranscript() error: %v", err)
+	}
+	if !bytes.Equal(again.Bytes(), buf.Bytes()) {
+		t.Errorf("transcript differs after writing again")
+	}
+
+	// Damaged transcripts
+	for _, data := range [][]byte{
+		[]byte("FDXT\x02"),
+		buf.Bytes()[:len(buf.Bytes())-1],
+		append([]byte(transcriptMagic), '?', 0, 0, 0, 0),
+	} {
+		if _, err := ReadTranscript(bytes.NewReader(data)); err == nil {
+			t.Errorf("ReadTranscript(% x) succeeded, expected error", data)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	records := []TranscriptRecord{
+		{TraceToDevice, []byte{1, 2, 3}},
+		{TraceFromDevice, []byte{1, 0}},
+		{TraceFromDevice, []byte("flux")},
+		{TraceToDevice, USBSetupPacket(0xc3, 5, 0, 40, 16)},
+		{TraceFromDevice, []byte("request=40")},
+	}
+
+	// Command may be written in pieces, replies come one record per read
+	r := NewReplay(records)
+	if _, err := r.Write([]byte{1}); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if _, err := r.Write([]byte{2, 3}); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	buf := make([]byte, 16)
+	if n, err := r.Read(buf); err != nil || !bytes.Equal(buf[:n], []byte{1, 0}) {
+		t.Errorf("Read() = % x, %v", buf[:n], err)
+	}
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "flux" {
+		t.Errorf("Read() = %q, %v", buf[:n], err)
+	}
+	if err := r.Done(); !errors.Is(err, ErrTranscriptMismatch) {
+		t.Errorf("Done() = %v with records left", err)
+	}
+	n, err := r.Control(0xc3, 5, 0, 40, buf)
+	if err != nil || string(buf[:n]) != "request=40" {
+		t.Errorf("Control() = %q, %v", buf[:n], err)
+	}
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Errorf("Read() after the end = %v, expected EOF", err)
+	}
+	if err := r.Done(); err != nil {
+		t.Errorf("Done() error: %v", err)
+	}
+
+	// Wrong command
+	r = NewReplay(records)
+	if _, err := r.Write([]byte{1, 2, 4}); !errors.Is(err, ErrTranscriptMismatch) {
+		t.Errorf("Write() of wrong command = %v", err)
+	}
+	if _, err := r.Read(buf); !errors.Is(err, ErrTranscriptMismatch) {
+		t.Errorf("Read() after mismatch = %v", err)
+	}
+
+	// Reply read before the command is sent
+	r = NewReplay(records)
+	if _, err := r.Read(buf); !errors.Is(err, ErrTranscriptMismatch) {
+		t.Errorf("Read() before command = %v", err)
+	}
+}
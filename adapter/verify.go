@@ -0,0 +1,141 @@
+package adapter
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+)
+
+// Verifier checks that repeated reads of every track decode to the same
+// sectors, when ReadOpts.Verify is set. Sectors are compared by contents,
+// so differences in gaps and bit positions between reads are ignored.
+type Verifier struct {
+	Tracks    int // Tracks verified
+	Rereads   int // Additional reads made
+	Confirmed int // Sectors decoded identically in two reads
+	Flagged   int // Sectors without two matching decodes
+
+	Mismatches []VerifyMismatch // Tracks with flagged sectors
+}
+
+// VerifyMismatch lists sectors of a track without two matching decodes
+type VerifyMismatch struct {
+	Cyl, Head int
+	Sectors   []int // Sorted numbers of flagged sectors
+	Reads     int   // Number of reads compared
+}
+
+func (m VerifyMismatch) String() string {
+	return fmt.Sprintf("track %d, side %d: sectors %v do not match in %d reads", m.Cyl, m.Head, m.Sectors, m.Reads)
+}
+
+// Track compares sectors decoded from bits with further reads of the track,
+// obtained by calling reread, until every sector is decoded identically twice,
+// or ReadOpts.VerifyRetries reads beyond the second one are made.
+// Returns bitstream of the read with most of the confirmed sectors.
+func (v *Verifier) Track(cyl, head int, bits []byte, reread func() ([]byte, error)) ([]byte, error) {
+	reads := [][]byte{bits}
+	decoded := []map[int][]byte{decodeSectors(bits, cyl, head)}
+	confirmed := make(map[int][]byte)
+	for len(reads) < 2+ReadOpts.VerifyRetries {
+		more, err := reread()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read track again: %w", err)
+		}
+		v.Rereads++
+		sectors := decodeSectors(more, cyl, head)
+		for num, data := range sectors {
+			if _, ok := confirmed[num]; ok || data == nil {
+				continue
+			}
+			for _, prev := range decoded {
+				if bytes.Equal(prev[num], data) {
+					confirmed[num] = data
+					break
+				}
+			}
+		}
+		reads = append(reads, more)
+		decoded = append(decoded, sectors)
+		if len(unconfirmed(decoded, confirmed)) == 0 {
+			break
+		}
+	}
+
+	v.Tracks++
+	v.Confirmed += len(confirmed)
+	if flagged := unconfirmed(decoded, confirmed); len(flagged) > 0 {
+		v.Flagged += len(flagged)
+		mismatch := VerifyMismatch{Cyl: cyl, Head: head, Sectors: flagged, Reads: len(reads)}
+		v.Mismatches = append(v.Mismatches, mismatch)
+		fmt.Printf("\nWarning: %v\n", mismatch)
+	}
+
+	// Keep the read which has most sectors with confirmed contents
+	best, bestCount := 0, -1
+	for i, sectors := range decoded {
+		count := 0
+		for num, data := range confirmed {
+			if bytes.Equal(sectors[num], data) {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = i, count
+		}
+	}
+	return reads[best], nil
+}
+
+// Report returns summary of verification for the user, with list
+// of tracks which have flagged sectors, or empty string.
+func (v *Verifier) Report() string {
+	if v.Tracks == 0 {
+		return ""
+	}
+	report := fmt.Sprintf("Verified %d tracks with %d extra reads: %d sectors confirmed, %d sectors do not match.",
+		v.Tracks, v.Rereads, v.Confirmed, v.Flagged)
+	for _, m := range v.Mismatches {
+		report += fmt.Sprintf("\n    %v", m)
+	}
+	return report
+}
+
+// Decode IBM PC sectors of the track. Returns contents of every sector
+// found, by sector number, or nil for sectors with bad checksum.
+func decodeSectors(bits []byte, cyl, head int) map[int][]byte {
+	sectors := make(map[int][]byte)
+	reader := mfm.NewReader(bits)
+	reader.Tolerance = hfe.IDTolerance
+	for {
+		sector, err := reader.ReadSectorInfoIBMPC(cyl, head)
+		if err != nil {
+			break
+		}
+		if sector.Bad {
+			if _, ok := sectors[sector.Sector]; !ok {
+				sectors[sector.Sector] = nil
+			}
+		} else if sectors[sector.Sector] == nil {
+			sectors[sector.Sector] = sector.Data
+		}
+	}
+	return sectors
+}
+
+// Sorted numbers of sectors found in any read, but not confirmed
+func unconfirmed(decoded []map[int][]byte, confirmed map[int][]byte) []int {
+	var result []int
+	for _, sectors := range decoded {
+		for num := range sectors {
+			if _, ok := confirmed[num]; !ok && !slices.Contains(result, num) {
+				result = append(result, num)
+			}
+		}
+	}
+	slices.Sort(result)
+	return result
+}
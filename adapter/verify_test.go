@@ -0,0 +1,94 @@
+package adapter
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Encode DD track of 9 sectors, with the given first byte of sector 3
+func makeVerifyTrack(sector3 byte) []byte {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = bytes.Repeat([]byte{byte(i)}, 512)
+	}
+	sectors[2][0] = sector3
+	return mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 5, 1, 9, 250)
+}
+
+// Return reads of the track from the list, one per call
+func rereads(t *testing.T, tracks ...[]byte) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if len(tracks) == 0 {
+			t.Fatalf("too many reads")
+		}
+		next := tracks[0]
+		tracks = tracks[1:]
+		return next, nil
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	defer func(retries int) { ReadOpts.VerifyRetries = retries }(ReadOpts.VerifyRetries)
+	ReadOpts.VerifyRetries = 3
+
+	t.Run("match", func(t *testing.T) {
+		v := &Verifier{}
+		first := makeVerifyTrack(0)
+		got, err := v.Track(5, 1, first, rereads(t, makeVerifyTrack(0)))
+		if err != nil {
+			t.Fatalf("Track() error: %v", err)
+		}
+		if !bytes.Equal(got, first) || v.Rereads != 1 || v.Confirmed != 9 || v.Flagged != 0 {
+			t.Errorf("unexpected result: %+v", v)
+		}
+	})
+
+	t.Run("mismatch resolved", func(t *testing.T) {
+		v := &Verifier{}
+		second := makeVerifyTrack(0x55)
+		got, err := v.Track(5, 1, makeVerifyTrack(0xAA), rereads(t, second, makeVerifyTrack(0x55)))
+		if err != nil {
+			t.Fatalf("Track() error: %v", err)
+		}
+		if v.Rereads != 2 || v.Confirmed != 9 || v.Flagged != 0 {
+			t.Errorf("unexpected result: %+v", v)
+		}
+		if !bytes.Equal(got, second) {
+			t.Errorf("expected the second read with all sectors confirmed")
+		}
+	})
+
+	t.Run("mismatch flagged", func(t *testing.T) {
+		v := &Verifier{}
+		_, err := v.Track(5, 1, makeVerifyTrack(1), rereads(t,
+			makeVerifyTrack(2), makeVerifyTrack(3), makeVerifyTrack(4), makeVerifyTrack(5)))
+		if err != nil {
+			t.Fatalf("Track() error: %v", err)
+		}
+		if v.Rereads != 4 || v.Confirmed != 8 || v.Flagged != 1 {
+			t.Errorf("unexpected result: %+v", v)
+		}
+		want := VerifyMismatch{Cyl: 5, Head: 1, Sectors: []int{3}, Reads: 5}
+		if len(v.Mismatches) != 1 || !reflect.DeepEqual(v.Mismatches[0], want) {
+			t.Errorf("mismatches %+v, expected %+v", v.Mismatches, want)
+		}
+		if report := v.Report(); !strings.Contains(report, want.String()) {
+			t.Errorf("report %q does not list the mismatch", report)
+		}
+	})
+
+	t.Run("blank track", func(t *testing.T) {
+		v := &Verifier{}
+		blank := make([]byte, 12500)
+		if _, err := v.Track(5, 1, blank, rereads(t, blank)); err != nil {
+			t.Fatalf("Track() error: %v", err)
+		}
+		if v.Rereads != 1 || v.Confirmed != 0 || v.Flagged != 0 {
+			t.Errorf("unexpected result: %+v", v)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Runs of weak bitcells closer than this are merged into one region
+const weakGapCells = 64
+
+// Regions with fewer weak bitcells are dropped: isolated
+// differences between revolutions are noise of the read
+const minWeakCells = 16
+
+// WeakDetector finds weak bits of tracks: bitcells which read differently
+// on every revolution, like on copy protected disks. Revolutions of a capture
+// are aligned at their first sector header, and regions where more than
+// ReadOpts.WeakThreshold revolutions disagree with the majority are weak.
+// Sectors with good CRC are never marked weak: they read the same every time.
+type WeakDetector struct {
+	Tracks []WeakTrack // Tracks with weak bits, in order of reading
+}
+
+// WeakTrack lists weak regions of one track, as bit positions in its MFM
+type WeakTrack struct {
+	Cyl     int
+	Head    int
+	Regions []hfe.WeakRegion
+}
+
+// Detect compares revolutions of the capture, and sets its weak mask
+// when weak bits are found. Captures of one revolution, and tracks
+// without IBM PC sectors are left as is.
+func (d *WeakDetector) Detect(capture *TrackCapture) {
+	if capture.Flux == nil || len(capture.MFM) == 0 {
+		return
+	}
+
+	// Bitcells of every revolution, from the header of the same sector.
+	// Revolutions where the header is lost are skipped.
+	var revs [][]byte
+	sector := -1
+	for rev := range capture.Flux.Revolutions() {
+		bits, err := capture.Flux.DecodeRevolutionMFM(rev, capture.BitRate, pll.Config{})
+		if err != nil {
+			continue
+		}
+		reader := mfm.NewReader(bits)
+		var pos int
+		if sector < 0 {
+			pos, sector, err = reader.FindHeaderIBMPC()
+		} else {
+			pos, err = reader.FindSectorIBMPC(sector)
+		}
+		if err != nil {
+			continue
+		}
+		revs = append(revs, hfe.RotateTrack(bits, pos)[:len(bits)-(pos+7)/8])
+	}
+	if len(revs) < 2 {
+		return
+	}
+	start, err := mfm.NewReader(capture.MFM).FindSectorIBMPC(sector)
+	if err != nil {
+		return
+	}
+
+	regions := weakRegions(revs, ReadOpts.WeakThreshold)
+	if len(regions) == 0 {
+		return
+	}
+
+	// Move regions to positions in MFM of the capture, which
+	// may wrap around the end of the track
+	n := len(capture.MFM) * 8
+	var moved []hfe.WeakRegion
+	for _, r := range regions {
+		s := (r.Start + start) % n
+		e := s + min(r.End-r.Start, n)
+		moved = append(moved, hfe.WeakRegion{Start: s, End: min(e, n)})
+		if e > n {
+			moved = append(moved, hfe.WeakRegion{Start: 0, End: e - n})
+		}
+	}
+	capture.Weak = hfe.NewWeakMask(len(capture.MFM), moved)
+	keepGoodSectors(capture)
+	if capture.Weak == nil {
+		return
+	}
+	d.Tracks = append(d.Tracks, WeakTrack{
+		Cyl:     capture.Cyl,
+		Head:    capture.Head,
+		Regions: hfe.WeakRegions(capture.Weak),
+	})
+}
+
+// Find regions of bitcells where more than threshold revolutions
+// disagree with the majority. Revolutions are aligned at bit 0,
+// and compared up to the end of the shortest one.
+func weakRegions(revs [][]byte, threshold int) []hfe.WeakRegion {
+	n := len(revs[0]) * 8
+	for _, bits := range revs[1:] {
+		n = min(n, len(bits)*8)
+	}
+
+	var regions []hfe.WeakRegion
+	var cur hfe.WeakRegion
+	count, total := 0, 0
+	odd := make([]bool, len(revs)) // Revolutions which disagree in the current region
+	flush := func() {
+		disagree := 0
+		for _, o := range odd {
+			if o {
+				disagree++
+			}
+		}
+		// Disagreement up to the end of revolution is a slip of PLL
+		if count >= minWeakCells && disagree > threshold && cur.End < n-weakGapCells {
+			regions = append(regions, cur)
+		}
+		count = 0
+		clear(odd)
+	}
+	for pos := 0; pos < n; pos++ {
+		ones := 0
+		for _, bits := range revs {
+			if bits[pos/8]&(0x80>>(pos%8)) != 0 {
+				ones++
+			}
+		}
+		if ones == 0 || ones == len(revs) {
+			continue
+		}
+		total++
+		if count == 0 || pos-cur.End >= weakGapCells {
+			flush()
+			cur.Start = pos
+		}
+		cur.End = pos + 1
+		count++
+
+		// Majority value of the bitcell, or value of the first revolution on a tie
+		majority := ones*2 > len(revs) || (ones*2 == len(revs) && revs[0][pos/8]&(0x80>>(pos%8)) != 0)
+		for i, bits := range revs {
+			if (bits[pos/8]&(0x80>>(pos%8)) != 0) != majority {
+				odd[i] = true
+			}
+		}
+	}
+	flush()
+
+	// Revolutions which differ everywhere have slipped, rather than weak
+	if total > n/2 {
+		return nil
+	}
+	return regions
+}
+
+// Clear weak mask of the capture over sectors with good data CRC,
+// from data address mark to CRC. Mask without weak bits left is dropped.
+func keepGoodSectors(capture *TrackCapture) {
+	reader := mfm.NewReader(capture.MFM)
+	for {
+		sector, err := reader.ReadSectorInfoIBMPC(capture.Cyl, capture.Head)
+		if err != nil {
+			break
+		}
+		if sector.Bad {
+			continue
+		}
+		end := min(sector.DataBitPos+(len(sector.Data)+2)*16, len(capture.Weak)*8)
+		for pos := max(sector.DataBitPos-4*16, 0); pos < end; pos++ {
+			capture.Weak[pos/8] &^= 0x80 >> (pos % 8)
+		}
+	}
+	if len(hfe.WeakRegions(capture.Weak)) == 0 {
+		capture.Weak = nil
+	}
+}
+
+// Report returns list of tracks with weak bits for the user, or empty string.
+func (d *WeakDetector) Report() string {
+	if len(d.Tracks) == 0 {
+		return ""
+	}
+	report := fmt.Sprintf("Weak bits found on %d tracks, possibly copy protection:", len(d.Tracks))
+	for _, t := range d.Tracks {
+		report += fmt.Sprintf("\n    track %d, side %d:", t.Cyl, t.Head)
+		for i, r := range t.Regions {
+			if i > 0 {
+				report += ","
+			}
+			report += " " + r.String()
+		}
+	}
+	return report
+}
@@ -0,0 +1,114 @@
+package adapter
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+)
+
+func TestWeakRegions(t *testing.T) {
+	// Three revolutions of the same bits, with random bytes 100-119
+	// and 125-139 on every revolution, and noise at byte 400
+	rng := rand.New(rand.NewSource(1))
+	base := bytes.Repeat([]byte{0x92, 0x49, 0x24}, 200)
+	var revs [][]byte
+	for i := 0; i < 3; i++ {
+		rev := bytes.Clone(base)
+		rng.Read(rev[100:120])
+		rng.Read(rev[125:140])
+		revs = append(revs, rev)
+	}
+	revs[1][400] ^= 0x10
+	revs[2] = revs[2][:550]
+
+	regions := weakRegions(revs, 0)
+	if len(regions) != 1 || regions[0].Start < 800 || regions[0].Start > 808 ||
+		regions[0].End > 1120 || regions[0].End < 1112 {
+		t.Errorf("weakRegions() = %v, expected one region at bits 800-1120", regions)
+	}
+
+	// Two revolutions agree: the third one alone is not enough
+	if regions := weakRegions([][]byte{base, base, revs[0]}, 1); regions != nil {
+		t.Errorf("weakRegions() with threshold 1 = %v, expected none", regions)
+	}
+	if regions := weakRegions(revs, 1); len(regions) != 1 {
+		t.Errorf("weakRegions() of random revolutions with threshold 1 = %v, expected one region", regions)
+	}
+
+	// Revolutions which differ from some point to the end have
+	// slipped: phase of the PLL was lost, bitcells are not weak
+	slipped := bytes.Clone(base)
+	copy(slipped[500:], base[501:])
+	if regions := weakRegions([][]byte{base, base, slipped, slipped}, 1); regions != nil {
+		t.Errorf("weakRegions() of revolutions slipped at the end = %v, expected none", regions)
+	}
+
+	// Revolutions which differ everywhere
+	if regions := weakRegions([][]byte{base, revs[0][1:]}, 0); regions != nil {
+		t.Errorf("weakRegions() of slipped revolutions = %v, expected none", regions)
+	}
+}
+
+func TestWeakDetector_Report(t *testing.T) {
+	var d WeakDetector
+	if report := d.Report(); report != "" {
+		t.Errorf("Report() without weak bits = %q", report)
+	}
+	d.Tracks = []WeakTrack{
+		{Cyl: 3, Head: 0, Regions: []hfe.WeakRegion{{Start: 1600, End: 3200}}},
+		{Cyl: 5, Head: 1, Regions: []hfe.WeakRegion{{Start: 0, End: 160}, {Start: 4000, End: 4016}}},
+	}
+	expected := "Weak bits found on 2 tracks, possibly copy protection:" +
+		"\n    track 3, side 0: bytes 100-199" +
+		"\n    track 5, side 1: bytes 0-9, bytes 250-250"
+	if report := d.Report(); report != expected {
+		t.Errorf("Report() = %q, expected %q", report, expected)
+	}
+}
+
+func TestKeepGoodSectors(t *testing.T) {
+	// Every bitcell of the track is marked weak, but only
+	// the sector with bad CRC stays weak
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+	}
+	track := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+	bad, err := mfm.NewReader(track).FindSectorIBMPC(5)
+	if err != nil {
+		t.Fatalf("FindSectorIBMPC() error: %v", err)
+	}
+	track[bad/8+200] ^= 0x44
+
+	capture := &TrackCapture{MFM: track, Weak: bytes.Repeat([]byte{0xff}, len(track))}
+	keepGoodSectors(capture)
+	regions := hfe.WeakRegions(capture.Weak)
+	if len(regions) == 0 {
+		t.Fatalf("no weak regions left")
+	}
+	reader := mfm.NewReader(track)
+	for {
+		sector, err := reader.ReadSectorInfoIBMPC(0, 0)
+		if err != nil {
+			break
+		}
+		weak := false
+		for _, r := range regions {
+			weak = weak || (r.Start < sector.DataBitPos+514*16 && r.End > sector.DataBitPos)
+		}
+		if weak != sector.Bad {
+			t.Errorf("sector %d with bad CRC %v: weak %v", sector.Sector, sector.Bad, weak)
+		}
+	}
+
+	// Mask inside a good sector is dropped
+	good := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+	capture = &TrackCapture{MFM: good, Weak: hfe.NewWeakMask(len(good), []hfe.WeakRegion{{Start: bad + 1600, End: bad + 3200}})}
+	keepGoodSectors(capture)
+	if capture.Weak != nil {
+		t.Errorf("weak regions %v left in good sector", hfe.WeakRegions(capture.Weak))
+	}
+}
@@ -19,32 +19,40 @@ Format of floppy image is defined by extension.
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		if floppyAdapter == nil {
-			cobra.CheckErr(fmt.Errorf("adapter not available"))
+			checkErr(fmt.Errorf("adapter not available"))
+		}
+		if !floppyAdapter.Capabilities().CanWrite {
+			checkErr(fmt.Errorf("write %w", ErrNotSupported))
 		}
 
 		// Determine input filename
 		filename := args[0]
+		checkErr(WriteOpts.Validate())
+		WriteOpts.ApplyLayout()
 
 		// Read file
 		disk, err := hfe.Read(filename)
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to read file: %w", err))
+			checkErr(fmt.Errorf("failed to read file: %w", err))
+		}
+		if err := WriteOpts.CheckImage(disk); err != nil {
+			checkErr(fmt.Errorf("%s: %w, use --force to write it anyway", filename, err))
 		}
 
 		// Match image versus drive.
 		if int(disk.Header.BitRate) > config.MaxKBps {
-			cobra.CheckErr(fmt.Errorf("Image with bit rate %d kbps is incompatible with drive %s",
+			checkErr(fmt.Errorf("Image with bit rate %d kbps is incompatible with drive %s",
 				disk.Header.BitRate, config.DriveName))
 		}
 		if int(disk.Header.NumberOfSide) > config.Heads {
-			cobra.CheckErr(fmt.Errorf("Image with %d sides is incompatible with drive %s",
+			checkErr(fmt.Errorf("Image with %d sides is incompatible with drive %s",
 				disk.Header.NumberOfSide, config.DriveName))
 		}
 
 		// Get number of tracks to write (but no more than extra 2 tracks)
 		numCylinders := int(disk.Header.NumberOfTrack)
-		if numCylinders > config.Cyls+2 {
-			cobra.CheckErr(fmt.Errorf("Image with %d cylinders is incompatible with drive %s",
+		if numCylinders > config.OuterCyls() {
+			checkErr(fmt.Errorf("Image with %d cylinders is incompatible with drive %s",
 				numCylinders, config.DriveName))
 		}
 		if hfe.DetectImageFormat(filename) != hfe.ImageFormatHFE {
@@ -56,7 +64,7 @@ Format of floppy image is defined by extension.
 			}
 		}
 		disk.InitVerifyOptions()
-		fmt.Printf("Writing %d tracks, %d side(s)\n", numCylinders, disk.Header.NumberOfSide)
+		fmt.Printf("Writing %d cylinders, %d side(s)\n", numCylinders, disk.Header.NumberOfSide)
 		fmt.Printf("Bit Rate: %d kbps\n", disk.Header.BitRate)
 		fmt.Printf("Rotation Speed: %d RPM\n", disk.Header.FloppyRPM)
 		fmt.Printf("\n")
@@ -70,7 +78,7 @@ Format of floppy image is defined by extension.
 		// Write floppy disk using adapter interface
 		err = floppyAdapter.Write(disk, numCylinders)
 		if err != nil {
-			cobra.CheckErr(fmt.Errorf("failed to write floppy disk: %w", err))
+			checkErr(fmt.Errorf("failed to write floppy disk: %w", err))
 		}
 		fmt.Printf("\n")
 		fmt.Printf("Image from file '%s' written to diskette.\n", filename)
@@ -79,4 +87,11 @@ Format of floppy image is defined by extension.
 
 func init() {
 	rootCmd.AddCommand(writeCmd)
+	writeCmd.Flags().StringVar(&WriteOpts.Precomp, "precomp", WriteOpts.Precomp, "write precompensation: auto (HD disks only), on or off")
+	writeCmd.Flags().Uint64Var(&WriteOpts.PrecompNs, "precomp-ns", WriteOpts.PrecompNs, "amount of write precompensation in `nsec`")
+	writeCmd.Flags().IntVar(&WriteOpts.PrecompFromCyl, "precomp-cyl", WriteOpts.PrecompFromCyl, "first `cylinder` with write precompensation")
+	writeCmd.Flags().IntVar(&WriteOpts.Interleave, "interleave", WriteOpts.Interleave, "sector interleave of IMG images: 1 for 1:1, 2 for 2:1, etc.")
+	writeCmd.Flags().IntVar(&WriteOpts.Skew, "skew", WriteOpts.Skew, "shift of sector 1 from one cylinder to the next, in `sectors`")
+	writeCmd.Flags().BoolVar(&WriteOpts.NoDiskCheck, "no-disk-check", false, "do not check for disk and write protection before writing")
+	writeCmd.Flags().BoolVar(&WriteOpts.Force, "force", false, "write image even when it is marked as write protected")
 }
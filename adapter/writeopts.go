@@ -0,0 +1,71 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+)
+
+// WriteOptions control how adapters write tracks
+type WriteOptions struct {
+	Precomp        string // Write precompensation: "auto" (HD disks only), "on" or "off"
+	PrecompNs      uint64 // Amount of precompensation, nsec
+	PrecompFromCyl int    // First cylinder with precompensation
+	Interleave     int    // Sector interleave of tracks generated from IMG images
+	Skew           int    // Track-to-track skew of generated tracks, in sectors
+	NoDiskCheck    bool   // Skip checks of disk presence and write protection
+	Force          bool   // Write images marked as write protected in their header
+}
+
+// Options of the write and format commands
+var WriteOpts = WriteOptions{
+	Precomp:        "auto",
+	PrecompNs:      125,
+	PrecompFromCyl: 40,
+	Interleave:     1,
+}
+
+// Validate checks the options given by user
+func (o *WriteOptions) Validate() error {
+	switch o.Precomp {
+	case "auto", "on", "off":
+	default:
+		return fmt.Errorf("invalid precompensation mode: %s (must be auto, on or off)", o.Precomp)
+	}
+	if o.PrecompFromCyl < 0 {
+		return fmt.Errorf("invalid precompensation cylinder: %d", o.PrecompFromCyl)
+	}
+	if o.Interleave < 1 {
+		return fmt.Errorf("invalid interleave: %d (must be 1 or more)", o.Interleave)
+	}
+	if o.Skew < 0 {
+		return fmt.Errorf("invalid track skew: %d", o.Skew)
+	}
+	return nil
+}
+
+// CheckImage refuses to write an image marked as write protected,
+// unless Force is set. Such images are often preservation masters,
+// not meant to be written back to a diskette.
+func (o *WriteOptions) CheckImage(disk *hfe.Disk) error {
+	if disk.IsWriteProtected() && !o.Force {
+		return ErrImageReadOnly
+	}
+	return nil
+}
+
+// ApplyLayout passes sector interleave and track skew to the image reader.
+func (o *WriteOptions) ApplyLayout() {
+	hfe.Interleave = o.Interleave
+	hfe.TrackSkew = o.Skew
+}
+
+// PrecompTable returns write precompensation for tracks of the given bit rate.
+// In auto mode only HD tracks are precompensated.
+func (o *WriteOptions) PrecompTable(bitRateKhz uint16) mfm.PrecompTable {
+	if o.Precomp == "off" || o.PrecompNs == 0 || (o.Precomp == "auto" && bitRateKhz < 500) {
+		return nil
+	}
+	return mfm.PrecompTable{{FirstCyl: o.PrecompFromCyl, LastCyl: -1, ShiftNs: o.PrecompNs}}
+}
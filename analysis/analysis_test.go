@@ -0,0 +1,120 @@
+package analysis
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+)
+
+func TestHistogram(t *testing.T) {
+	// Intervals 4000, 6000, 4000, 8000 nsec
+	transitions := []uint64{4000, 10000, 14000, 22000}
+	bins := Histogram(transitions, 1000)
+	if len(bins) != 9 || bins[4] != 2 || bins[6] != 1 || bins[8] != 1 {
+		t.Errorf("Histogram() = %v", bins)
+	}
+
+	var csv bytes.Buffer
+	if err := HistogramCSV(&csv, transitions, 2000); err != nil {
+		t.Fatalf("HistogramCSV() error: %v", err)
+	}
+	expected := "interval_ns,count\n0,0\n2000,0\n4000,2\n6000,1\n8000,1\n"
+	if csv.String() != expected {
+		t.Errorf("HistogramCSV() = %q, expected %q", csv.String(), expected)
+	}
+	if err := HistogramCSV(&csv, transitions, 0); err == nil {
+		t.Errorf("expected error for zero bin size")
+	}
+
+	var pic bytes.Buffer
+	if err := HistogramPNG(&pic, transitions, 50); err != nil {
+		t.Fatalf("HistogramPNG() error: %v", err)
+	}
+	img, err := png.Decode(&pic)
+	if err != nil {
+		t.Fatalf("png.Decode() error: %v", err)
+	}
+	if img.Bounds().Dx() != HistogramMaxNs/50*histogramBarPx {
+		t.Errorf("picture width %d", img.Bounds().Dx())
+	}
+}
+
+func TestSectorMap(t *testing.T) {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+	}
+	disk := &hfe.Disk{
+		Header: hfe.Header{NumberOfTrack: 2, NumberOfSide: 1, BitRate: 250},
+		Tracks: []hfe.TrackData{
+			{Side0: mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)},
+			{Side0: mfm.NewWriter(100000).EncodeTrackIBMPC(sectors[:5], 1, 0, 5, 250)},
+		},
+	}
+
+	report := ScanSectors(disk)
+	if len(report.Tracks) != 2 || report.MaxSectors != 9 {
+		t.Fatalf("ScanSectors() = %d tracks, %d sectors", len(report.Tracks), report.MaxSectors)
+	}
+
+	var csv bytes.Buffer
+	if err := SectorMapCSV(&csv, report); err != nil {
+		t.Fatalf("SectorMapCSV() error: %v", err)
+	}
+	for _, line := range []string{"0,0,9,good", "1,0,5,good", "1,0,6,missing"} {
+		if !strings.Contains(csv.String(), line+"\n") {
+			t.Errorf("SectorMapCSV() has no line %q", line)
+		}
+	}
+
+	var pic bytes.Buffer
+	if err := SectorMapPNG(&pic, report); err != nil {
+		t.Fatalf("SectorMapPNG() error: %v", err)
+	}
+	img, err := png.Decode(&pic)
+	if err != nil {
+		t.Fatalf("png.Decode() error: %v", err)
+	}
+	if img.Bounds().Dx() != 9*sectorCellPx || img.Bounds().Dy() != 2*sectorCellPx {
+		t.Errorf("picture size %v", img.Bounds())
+	}
+}
+
+func TestLayout(t *testing.T) {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+	}
+	track := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+	layout := mfm.AnalyzeLayoutIBMPC(track, 250)
+	tracks := []TrackLayout{
+		{Cyl: 1, Head: 0, Layout: layout},
+		{Cyl: 0, Head: 1, Layout: &mfm.TrackLayout{Sectors: 9, FirstID: 300, Gap4a: -1, Splices: []int{12, 4000}}},
+	}
+	SortLayouts(tracks)
+	if tracks[0].Cyl != 0 || tracks[1].Cyl != 1 {
+		t.Errorf("tracks not sorted: %+v", tracks)
+	}
+
+	var csv bytes.Buffer
+	if err := LayoutCSV(&csv, tracks); err != nil {
+		t.Fatalf("LayoutCSV() error: %v", err)
+	}
+	for _, line := range []string{"0,1,9,300,-1,0,0,0,0,12 4000,false", "1,0,9,158,80,50,80,80,"} {
+		if !strings.Contains(csv.String(), line) {
+			t.Errorf("LayoutCSV() has no line %q:\n%s", line, csv.String())
+		}
+	}
+
+	want := "Track layout: 1 of 2 tracks nominal, 1 with index mark, 1 with write splices; first sector ID at 158-300 bytes from index"
+	if got := LayoutReport(tracks); got != want {
+		t.Errorf("LayoutReport() = %q", got)
+	}
+	if got := LayoutReport(nil); got != "" {
+		t.Errorf("LayoutReport(nil) = %q", got)
+	}
+}
@@ -0,0 +1,93 @@
+// Package analysis helps to diagnose bad reads: it builds histograms
+// of flux intervals and maps of good and bad sectors on the disk,
+// and exports them as CSV tables or PNG pictures.
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// Parameters of histogram picture
+const (
+	HistogramMaxNs  = 12000 // Longest interval shown, enough for 250 kbps MFM
+	histogramHeight = 200   // Picture height in pixels
+	histogramBarPx  = 2     // Width of one bin in pixels
+)
+
+// Histogram counts intervals between flux transitions, in bins of binNs nanoseconds.
+// Transition times are absolute, in nanoseconds from the index pulse.
+// Bin i holds intervals from i*binNs up to (i+1)*binNs.
+func Histogram(transitions []uint64, binNs int) []int {
+	if binNs <= 0 {
+		return nil
+	}
+	var bins []int
+	last := uint64(0)
+	for _, t := range transitions {
+		if t < last {
+			// Not sorted: skip
+			continue
+		}
+		bin := int(t-last) / binNs
+		last = t
+		for len(bins) <= bin {
+			bins = append(bins, 0)
+		}
+		bins[bin]++
+	}
+	return bins
+}
+
+// HistogramCSV writes histogram of flux intervals as CSV table
+// with interval in nanoseconds and number of transitions.
+func HistogramCSV(w io.Writer, transitions []uint64, binNs int) error {
+	if binNs <= 0 {
+		return fmt.Errorf("invalid bin size: %d nsec", binNs)
+	}
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "interval_ns,count\n")
+	for i, count := range Histogram(transitions, binNs) {
+		fmt.Fprintf(out, "%d,%d\n", i*binNs, count)
+	}
+	return out.Flush()
+}
+
+// HistogramPNG renders histogram of flux intervals up to HistogramMaxNs.
+// For a good MFM track three distinct peaks are visible.
+func HistogramPNG(w io.Writer, transitions []uint64, binNs int) error {
+	if binNs <= 0 {
+		return fmt.Errorf("invalid bin size: %d nsec", binNs)
+	}
+	bins := Histogram(transitions, binNs)
+	numBins := HistogramMaxNs / binNs
+	if len(bins) > numBins {
+		bins = bins[:numBins]
+	}
+	maxCount := 1
+	for _, count := range bins {
+		maxCount = max(maxCount, count)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, numBins*histogramBarPx, histogramHeight))
+	fill(img, img.Bounds(), color.White)
+	for i, count := range bins {
+		h := count * histogramHeight / maxCount
+		bar := image.Rect(i*histogramBarPx, histogramHeight-h, (i+1)*histogramBarPx, histogramHeight)
+		fill(img, bar, color.Black)
+	}
+	return png.Encode(w, img)
+}
+
+// Fill rectangle with solid color
+func fill(img *image.RGBA, r image.Rectangle, c color.Color) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.Set(x, y, c)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// TrackLayout holds alignment of sectors on one side of a cylinder
+type TrackLayout struct {
+	Cyl    int
+	Head   int
+	Layout *mfm.TrackLayout
+}
+
+// SortLayouts orders tracks by cylinder and side
+func SortLayouts(tracks []TrackLayout) {
+	slices.SortFunc(tracks, func(a, b TrackLayout) int {
+		if a.Cyl != b.Cyl {
+			return a.Cyl - b.Cyl
+		}
+		return a.Head - b.Head
+	})
+}
+
+// LayoutCSV writes alignment of sectors on every track as CSV table.
+// Positions and gaps are in bytes; gap3 is given as its range.
+// Splices are separated by spaces.
+func LayoutCSV(w io.Writer, tracks []TrackLayout) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "cylinder,head,sectors,first_id,gap4a,gap1,gap3_min,gap3_max,gap4b,splices,nominal\n")
+	for _, track := range tracks {
+		l := track.Layout
+		gap3Min, gap3Max := 0, 0
+		if len(l.Gap3) > 0 {
+			gap3Min, gap3Max = slices.Min(l.Gap3), slices.Max(l.Gap3)
+		}
+		splices := make([]string, len(l.Splices))
+		for i, s := range l.Splices {
+			splices[i] = fmt.Sprint(s)
+		}
+		fmt.Fprintf(out, "%d,%d,%d,%d,%d,%d,%d,%d,%d,%s,%v\n", track.Cyl, track.Head,
+			l.Sectors, l.FirstID, l.Gap4a, l.Gap1, gap3Min, gap3Max, l.Gap4b,
+			strings.Join(splices, " "), l.Nominal)
+	}
+	return out.Flush()
+}
+
+// LayoutReport summarizes alignment of tracks: how many have the standard
+// layout, and where the first sector starts. Empty when there are no tracks.
+func LayoutReport(tracks []TrackLayout) string {
+	if len(tracks) == 0 {
+		return ""
+	}
+	nominal, spliced, indexMark := 0, 0, 0
+	minID, maxID := tracks[0].Layout.FirstID, tracks[0].Layout.FirstID
+	for _, track := range tracks {
+		l := track.Layout
+		if l.Nominal {
+			nominal++
+		}
+		if len(l.Splices) > 0 {
+			spliced++
+		}
+		if l.Gap4a >= 0 {
+			indexMark++
+		}
+		minID, maxID = min(minID, l.FirstID), max(maxID, l.FirstID)
+	}
+	return fmt.Sprintf("Track layout: %d of %d tracks nominal, %d with index mark, %d with write splices; first sector ID at %d-%d bytes from index",
+		nominal, len(tracks), indexMark, spliced, minID, maxID)
+}
@@ -0,0 +1,134 @@
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+)
+
+// SectorStatus describes result of reading one sector
+type SectorStatus int
+
+const (
+	SectorMissing SectorStatus = iota // Sector header not found
+	SectorGood                        // Data read with correct CRC
+	SectorBad                         // Data CRC mismatch
+)
+
+func (s SectorStatus) String() string {
+	switch s {
+	case SectorGood:
+		return "good"
+	case SectorBad:
+		return "bad"
+	default:
+		return "missing"
+	}
+}
+
+// TrackSectors holds status of every sector on one side of a cylinder
+type TrackSectors struct {
+	Cyl    int
+	Head   int
+	Status []SectorStatus // Indexed by sector number minus 1
+}
+
+// SectorReport holds sector status of the whole disk
+type SectorReport struct {
+	Tracks     []TrackSectors
+	MaxSectors int // Largest number of sectors per track
+}
+
+// Size of one sector cell in the picture, in pixels
+const sectorCellPx = 8
+
+// Colors of sector map
+var sectorColors = map[SectorStatus]color.Color{
+	SectorMissing: color.RGBA{0xa0, 0xa0, 0xa0, 0xff},
+	SectorGood:    color.RGBA{0x20, 0xc0, 0x20, 0xff},
+	SectorBad:     color.RGBA{0xe0, 0x20, 0x20, 0xff},
+}
+
+// ScanSectors finds IBM PC sectors on every track of the disk.
+// Sectors missing on a track, but present on other tracks, are reported as missing.
+func ScanSectors(disk *hfe.Disk) *SectorReport {
+	report := &SectorReport{}
+	numSides := max(int(disk.Header.NumberOfSide), 1)
+	for cyl := range disk.Tracks {
+		for head := 0; head < numSides; head++ {
+			bits := disk.Tracks[cyl].Side0
+			if head == 1 {
+				bits = disk.Tracks[cyl].Side1
+			}
+			track := TrackSectors{Cyl: cyl, Head: head}
+			reader := mfm.NewReader(bits)
+			for {
+				sector, err := reader.ReadSectorInfoIBMPC(cyl, head)
+				if err != nil {
+					break
+				}
+				if sector.Sector < 1 {
+					continue
+				}
+				for len(track.Status) < sector.Sector {
+					track.Status = append(track.Status, SectorMissing)
+				}
+				status := SectorGood
+				if sector.Bad {
+					status = SectorBad
+				}
+				// Keep good copy of a duplicated sector
+				if track.Status[sector.Sector-1] != SectorGood {
+					track.Status[sector.Sector-1] = status
+				}
+			}
+			report.MaxSectors = max(report.MaxSectors, len(track.Status))
+			report.Tracks = append(report.Tracks, track)
+		}
+	}
+	return report
+}
+
+// Status of the given sector (0-based index) of the track
+func (t *TrackSectors) status(s int) SectorStatus {
+	if s < len(t.Status) {
+		return t.Status[s]
+	}
+	return SectorMissing
+}
+
+// SectorMapCSV writes status of every sector as CSV table
+func SectorMapCSV(w io.Writer, report *SectorReport) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "cylinder,head,sector,status\n")
+	for _, track := range report.Tracks {
+		for s := 0; s < report.MaxSectors; s++ {
+			fmt.Fprintf(out, "%d,%d,%d,%s\n", track.Cyl, track.Head, s+1, track.status(s))
+		}
+	}
+	return out.Flush()
+}
+
+// SectorMapPNG renders sector map of the disk:
+// one row per track, one cell per sector.
+func SectorMapPNG(w io.Writer, report *SectorReport) error {
+	if len(report.Tracks) == 0 || report.MaxSectors == 0 {
+		return fmt.Errorf("no sectors found")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, report.MaxSectors*sectorCellPx, len(report.Tracks)*sectorCellPx))
+	fill(img, img.Bounds(), color.White)
+	for row, track := range report.Tracks {
+		for s := 0; s < report.MaxSectors; s++ {
+			// Leave one pixel gap between cells
+			cell := image.Rect(s*sectorCellPx, row*sectorCellPx, (s+1)*sectorCellPx-1, (row+1)*sectorCellPx-1)
+			fill(img, cell, sectorColors[track.status(s)])
+		}
+	}
+	return png.Encode(w, img)
+}
@@ -16,15 +16,33 @@ var defaultConfigData []byte
 
 // Global state variables for the selected drive
 var (
-	DriveName string
-	Cyls      int
-	Heads     int
-	RPM       int
-	MaxKBps   int
-	Images    []string
-	ImageMap  map[string]string // image name -> filename mapping
+	DriveName  string
+	Cyls       int
+	Heads      int
+	RPM        int
+	MaxKBps    int
+	Images     []string
+	ImageMap   map[string]string // image name -> filename mapping
+	StepDelay  int               // step delay in usec, 0 = adapter default
+	Settle     int               // head settle time in msec, 0 = adapter default
+	MotorDelay int               // motor spin-up time in msec, 0 = adapter default
+	SpinUp     int               // timeout for stable rotation in msec, 0 = adapter default
+	MotorIdle  int               // motor idle time before it is turned off in msec, 0 = adapter default
+	Calibrate  bool              // calibrate head seek before reading
+	Unit       int               // drive unit on the adapter: 0 = drive A, 1 = drive B
+	Densel     bool              // drive density select on pin 2 by media type
 )
 
+// Most cylinders of a drive. Adapters step the head up to cylinder 83,
+// which covers 80-track drives with a few cylinders past the end of disk.
+const MaxCyls = 84
+
+// OuterCyls returns number of cylinders including two extra ones
+// past the end of disk, which may hold data, within MaxCyls
+func OuterCyls() int {
+	return min(Cyls+2, MaxCyls)
+}
+
 // Config represents the entire TOML configuration structure
 type Config struct {
 	Default string  `toml:"default"`
@@ -40,6 +58,15 @@ type Drive struct {
 	RPM     int      `toml:"rpm"`
 	MaxKBps int      `toml:"maxkbps"`
 	Images  []string `toml:"images"`
+	Unit    int      `toml:"unit"`   // Drive unit on the adapter, 0 by default
+	Densel  bool     `toml:"densel"` // Host selects density on pin 2
+
+	// Optional seek profile of the drive
+	StepDelay  int `toml:"step_delay"`  // usec
+	Settle     int `toml:"settle"`      // msec
+	MotorDelay int `toml:"motor_delay"` // msec
+	SpinUp     int `toml:"spinup"`      // msec
+	MotorIdle  int `toml:"motor_idle"`  // msec
 }
 
 // Image represents a built-in image configuration
@@ -121,8 +148,8 @@ func Initialize() error {
 	}
 
 	// 7. Validate drive fields (positive integers, non-empty images list)
-	if foundDrive.Cyls <= 0 {
-		return fmt.Errorf("drive %q has invalid cyls: %d (must be positive)", conf.Default, foundDrive.Cyls)
+	if foundDrive.Cyls <= 0 || foundDrive.Cyls > MaxCyls {
+		return fmt.Errorf("drive %q has invalid cyls: %d (must be 1-%d)", conf.Default, foundDrive.Cyls, MaxCyls)
 	}
 	if foundDrive.Heads <= 0 {
 		return fmt.Errorf("drive %q has invalid heads: %d (must be positive)", conf.Default, foundDrive.Heads)
@@ -133,16 +160,41 @@ func Initialize() error {
 	if foundDrive.MaxKBps <= 0 {
 		return fmt.Errorf("drive %q has invalid maxkbps: %d (must be positive)", conf.Default, foundDrive.MaxKBps)
 	}
+	if foundDrive.StepDelay < 0 || foundDrive.StepDelay > 0xffff {
+		return fmt.Errorf("drive %q has invalid step_delay: %d", conf.Default, foundDrive.StepDelay)
+	}
+	if foundDrive.Settle < 0 || foundDrive.Settle > 0xffff {
+		return fmt.Errorf("drive %q has invalid settle: %d", conf.Default, foundDrive.Settle)
+	}
+	if foundDrive.MotorDelay < 0 || foundDrive.MotorDelay > 0xffff {
+		return fmt.Errorf("drive %q has invalid motor_delay: %d", conf.Default, foundDrive.MotorDelay)
+	}
+	if foundDrive.SpinUp < 0 {
+		return fmt.Errorf("drive %q has invalid spinup: %d", conf.Default, foundDrive.SpinUp)
+	}
+	if foundDrive.MotorIdle < 0 {
+		return fmt.Errorf("drive %q has invalid motor_idle: %d", conf.Default, foundDrive.MotorIdle)
+	}
+	if foundDrive.Unit < 0 || foundDrive.Unit > 3 {
+		return fmt.Errorf("drive %q has invalid unit: %d", conf.Default, foundDrive.Unit)
+	}
 	if len(foundDrive.Images) == 0 {
 		return fmt.Errorf("drive %q has no images listed", conf.Default)
 	}
 
 	// 8. Store drive properties in global variables
-        DriveName = conf.Default
+	DriveName = conf.Default
 	Cyls = foundDrive.Cyls
 	Heads = foundDrive.Heads
 	RPM = foundDrive.RPM
 	MaxKBps = foundDrive.MaxKBps
+	StepDelay = foundDrive.StepDelay
+	Settle = foundDrive.Settle
+	MotorDelay = foundDrive.MotorDelay
+	SpinUp = foundDrive.SpinUp
+	MotorIdle = foundDrive.MotorIdle
+	Unit = foundDrive.Unit
+	Densel = foundDrive.Densel
 	Images = make([]string, len(foundDrive.Images))
 	copy(Images, foundDrive.Images)
 
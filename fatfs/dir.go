@@ -0,0 +1,287 @@
+package fatfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Size of directory entry in bytes
+const dirEntrySize = 32
+
+// File attributes
+const (
+	AttrReadOnly  = 0x01
+	AttrHidden    = 0x02
+	AttrSystem    = 0x04
+	AttrVolumeID  = 0x08
+	AttrDirectory = 0x10
+	AttrArchive   = 0x20
+	attrLongName  = 0x0F // Entry is a part of VFAT long name
+)
+
+// Flags of lowercase short names, set by Windows NT
+const (
+	lowerBase = 0x08
+	lowerExt  = 0x10
+)
+
+// DirEntry describes a file or subdirectory
+type DirEntry struct {
+	Name      string    // Long name, or short name when there is no long one
+	ShortName string    // Name in 8.3 format
+	Attr      byte      // Combination of Attr* flags
+	Size      int       // Size of file in bytes, 0 for directories
+	ModTime   time.Time // Time of last modification
+	Cluster   int       // First cluster of contents
+}
+
+// IsDir reports whether the entry is a subdirectory
+func (e *DirEntry) IsDir() bool {
+	return e.Attr&AttrDirectory != 0
+}
+
+// ListDir returns entries of the directory with the given path,
+// like "/" or "/GAMES/DOOM". Names are matched regardless of case,
+// either long or short. When some sectors of the directory are
+// unreadable, entries found in the rest are returned along with ReadError.
+func (fs *FS) ListDir(path string) ([]DirEntry, error) {
+	data, readErr := fs.readDir(path)
+	if data == nil && readErr != nil {
+		return nil, readErr
+	}
+	entries := parseDir(data)
+	if readErr != nil {
+		return entries, readErr
+	}
+	return entries, nil
+}
+
+// ReadFile returns contents of the file with the given path.
+// When some sectors or clusters of the file are unreadable,
+// data is returned along with ReadError listing the affected byte ranges.
+func (fs *FS) ReadFile(path string) ([]byte, error) {
+	entry, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if entry.IsDir() {
+		return nil, fmt.Errorf("%s: is a directory", path)
+	}
+	readErr := &ReadError{Path: path}
+	data := fs.readChain(entry.Cluster, entry.Size, readErr)
+	if readErr.Err != nil {
+		return data, readErr
+	}
+	return data, nil
+}
+
+// Read raw contents of directory with the given path.
+// Returns nil data when the directory cannot be found.
+func (fs *FS) readDir(path string) ([]byte, error) {
+	readErr := &ReadError{Path: path}
+	var data []byte
+	if isRoot(path) {
+		data = make([]byte, fs.BPB.RootEntries*dirEntrySize)
+		fs.readSectors(data, fs.rootStart, 0, readErr)
+	} else {
+		entry, err := fs.lookup(path)
+		if err != nil {
+			return nil, err
+		}
+		if !entry.IsDir() {
+			return nil, fmt.Errorf("%s: not a directory", path)
+		}
+		if entry.Cluster < 2 {
+			return nil, fmt.Errorf("%s: invalid first cluster %d", path, entry.Cluster)
+		}
+		data = fs.readChain(entry.Cluster, -1, readErr)
+	}
+	if readErr.Err != nil {
+		return data, readErr
+	}
+	return data, nil
+}
+
+// Find entry with the given path
+func (fs *FS) lookup(path string) (*DirEntry, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	dir := "/"
+	for i, name := range parts {
+		data, err := fs.readDir(dir)
+		if data == nil {
+			return nil, err
+		}
+		entry := findEntry(parseDir(data), name)
+		if entry == nil {
+			if err != nil {
+				return nil, fmt.Errorf("%s: not found in damaged directory: %w", path, err)
+			}
+			return nil, fmt.Errorf("%s: not found", path)
+		}
+		if i == len(parts)-1 {
+			return entry, nil
+		}
+		if !entry.IsDir() {
+			return nil, fmt.Errorf("%s: %s is not a directory", path, entry.Name)
+		}
+		dir += name + "/"
+	}
+	return nil, fmt.Errorf("%s: not found", path)
+}
+
+// Path of root directory is empty or consists of slashes only
+func isRoot(path string) bool {
+	return strings.Trim(path, "/") == ""
+}
+
+// Find entry by long or short name, regardless of case
+func findEntry(entries []DirEntry, name string) *DirEntry {
+	for i := range entries {
+		if strings.EqualFold(entries[i].Name, name) || strings.EqualFold(entries[i].ShortName, name) {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// Decode directory entries, skipping deleted ones, volume label,
+// and links to current and parent directories.
+func parseDir(data []byte) []DirEntry {
+	var entries []DirEntry
+	var longName []uint16 // Characters of long name collected so far
+	var longSum byte      // Checksum of short name, from long name entries
+	nextSeq := 0          // Sequence number of next long name entry, 0 when none is expected
+
+	for offset := 0; offset+dirEntrySize <= len(data); offset += dirEntrySize {
+		e := data[offset : offset+dirEntrySize]
+		if e[0] == 0x00 {
+			// End of directory
+			break
+		}
+		if e[0] == 0xE5 {
+			// Deleted entry
+			longName = nil
+			nextSeq = 0
+			continue
+		}
+
+		attr := e[11]
+		if attr == attrLongName {
+			seq := int(e[0] & 0x1F)
+			if e[0]&0x40 != 0 {
+				// Last part of the name comes first
+				longName = make([]uint16, 13*seq)
+				longSum = e[13]
+				nextSeq = seq
+			}
+			if seq == 0 || seq != nextSeq || e[13] != longSum {
+				// Broken sequence
+				longName = nil
+				nextSeq = 0
+				continue
+			}
+			chars := longName[(seq-1)*13 : seq*13]
+			for i, pos := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				chars[i] = binary.LittleEndian.Uint16(e[pos:])
+			}
+			nextSeq--
+			continue
+		}
+
+		hasLongName := nextSeq == 0 && longName != nil && shortNameChecksum(e[0:11]) == longSum
+		name := longName
+		longName = nil
+		nextSeq = 0
+		if attr&AttrVolumeID != 0 || e[0] == '.' {
+			continue
+		}
+
+		entry := DirEntry{
+			ShortName: shortName(e[0:11], 0),
+			Attr:      attr,
+			Size:      int(binary.LittleEndian.Uint32(e[28:32])),
+			ModTime:   dosTime(binary.LittleEndian.Uint16(e[24:26]), binary.LittleEndian.Uint16(e[22:24])),
+			Cluster:   int(binary.LittleEndian.Uint16(e[26:28])),
+		}
+		if hasLongName {
+			entry.Name = decodeLongName(name)
+		} else {
+			entry.Name = shortName(e[0:11], e[12])
+		}
+		if entry.IsDir() {
+			entry.Size = 0
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Format name in 8.3 format, like "README.TXT".
+// Flags in case byte request lowercase name or extension.
+// Bytes above 0x7F are taken as Latin-1 characters.
+func shortName(raw []byte, caseFlags byte) string {
+	base := []byte(strings.TrimRight(string(raw[0:8]), " "))
+	ext := []byte(strings.TrimRight(string(raw[8:11]), " "))
+	if len(base) > 0 && base[0] == 0x05 {
+		// First byte 0xE5 is stored as 0x05
+		base[0] = 0xE5
+	}
+	name := latin1(base)
+	if caseFlags&lowerBase != 0 {
+		name = strings.ToLower(name)
+	}
+	if len(ext) > 0 {
+		extName := latin1(ext)
+		if caseFlags&lowerExt != 0 {
+			extName = strings.ToLower(extName)
+		}
+		name += "." + extName
+	}
+	return name
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// Decode long name from UTF-16, up to terminating zero
+func decodeLongName(chars []uint16) string {
+	for i, c := range chars {
+		if c == 0 {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+// Checksum of short name, stored in entries of the long name
+func shortNameChecksum(raw []byte) byte {
+	var sum byte
+	for _, c := range raw {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// Convert date and time in MS-DOS format
+func dosTime(date, tm uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(
+		int(date>>9)+1980,
+		time.Month(date>>5&0xF),
+		int(date&0x1F),
+		int(tm>>11),
+		int(tm>>5&0x3F),
+		int(tm&0x1F)*2,
+		0, time.UTC)
+}
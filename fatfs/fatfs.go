@@ -0,0 +1,330 @@
+// Package fatfs provides read-only access to FAT12 and FAT16 file systems
+// of floppy disks, either decoded from MFM tracks or stored as raw IMG data.
+package fatfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/sergev/floppy/hfe"
+)
+
+// BPB holds fields of BIOS Parameter Block from the boot sector
+type BPB struct {
+	BytesPerSector    int
+	SectorsPerCluster int
+	ReservedSectors   int
+	NumFATs           int
+	RootEntries       int
+	TotalSectors      int
+	MediaDescriptor   byte
+	SectorsPerFAT     int
+	SectorsPerTrack   int
+	NumHeads          int
+}
+
+// FS is a read-only view of FAT12 or FAT16 file system
+type FS struct {
+	BPB         BPB
+	FAT16       bool // FAT16 when true, FAT12 otherwise
+	NumClusters int  // Number of data clusters
+
+	readSector func(lba int) ([]byte, error) // Read logical sector, numbered from 0
+	fat        []byte                        // Contents of file allocation table
+	fatBad     []bool                        // FAT sectors not readable in any copy
+	rootStart  int                           // First sector of root directory
+	dataStart  int                           // First sector of cluster 2
+}
+
+// Range is a span of bytes of a file or directory, from Start up to End
+type Range struct {
+	Start int
+	End   int
+}
+
+// ReadError reports parts of a file or directory which could not be read.
+// Data returned along with it has these parts filled with zeros,
+// or with contents of sectors with bad checksum.
+type ReadError struct {
+	Path   string
+	Ranges []Range
+	Err    error // First error found
+}
+
+func (e *ReadError) Error() string {
+	if len(e.Ranges) == 0 {
+		return fmt.Sprintf("%s: %v", e.Path, e.Err)
+	}
+	var ranges []string
+	for _, r := range e.Ranges {
+		ranges = append(ranges, fmt.Sprintf("%d-%d", r.Start, r.End-1))
+	}
+	return fmt.Sprintf("%s: unreadable bytes %s: %v", e.Path, strings.Join(ranges, ", "), e.Err)
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// Add range of bytes to the error, merging it with the previous one when adjacent
+func (e *ReadError) add(start, end int, err error) {
+	if e.Err == nil {
+		e.Err = err
+	}
+	if start == end {
+		return
+	}
+	if n := len(e.Ranges); n > 0 && e.Ranges[n-1].End == start {
+		e.Ranges[n-1].End = end
+		return
+	}
+	e.Ranges = append(e.Ranges, Range{start, end})
+}
+
+// Open returns file system of the disk in IBM PC format.
+// Sectors are located by geometry from the boot sector.
+func Open(disk *hfe.Disk) (*FS, error) {
+	boot, err := disk.ReadSector(0, 0, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read boot sector: %w", err)
+	}
+	bpb, err := parseBPB(boot)
+	if err != nil {
+		return nil, err
+	}
+	if bpb.SectorsPerTrack == 0 || bpb.NumHeads == 0 {
+		return nil, fmt.Errorf("unknown disk geometry: %d sectors per track, %d heads",
+			bpb.SectorsPerTrack, bpb.NumHeads)
+	}
+	return newFS(bpb, func(lba int) ([]byte, error) {
+		cyl := lba / (bpb.SectorsPerTrack * bpb.NumHeads)
+		head := lba / bpb.SectorsPerTrack % bpb.NumHeads
+		sector := lba%bpb.SectorsPerTrack + 1
+		return disk.ReadSector(cyl, head, sector)
+	})
+}
+
+// OpenImage returns file system of the raw disk image,
+// which is a sequence of sectors, like in IMG file.
+func OpenImage(data []byte) (*FS, error) {
+	if len(data) < 512 {
+		return nil, fmt.Errorf("image too small: %d bytes", len(data))
+	}
+	bpb, err := parseBPB(data[:512])
+	if err != nil {
+		return nil, err
+	}
+	return newFS(bpb, func(lba int) ([]byte, error) {
+		offset := lba * bpb.BytesPerSector
+		if offset+bpb.BytesPerSector > len(data) {
+			return nil, fmt.Errorf("sector %d is beyond end of image", lba)
+		}
+		return data[offset : offset+bpb.BytesPerSector], nil
+	})
+}
+
+// Decode BIOS Parameter Block from the boot sector
+func parseBPB(boot []byte) (BPB, error) {
+	if len(boot) < 512 {
+		return BPB{}, fmt.Errorf("boot sector too small: %d bytes", len(boot))
+	}
+	bpb := BPB{
+		BytesPerSector:    int(binary.LittleEndian.Uint16(boot[11:13])),
+		SectorsPerCluster: int(boot[13]),
+		ReservedSectors:   int(binary.LittleEndian.Uint16(boot[14:16])),
+		NumFATs:           int(boot[16]),
+		RootEntries:       int(binary.LittleEndian.Uint16(boot[17:19])),
+		TotalSectors:      int(binary.LittleEndian.Uint16(boot[19:21])),
+		MediaDescriptor:   boot[21],
+		SectorsPerFAT:     int(binary.LittleEndian.Uint16(boot[22:24])),
+		SectorsPerTrack:   int(binary.LittleEndian.Uint16(boot[24:26])),
+		NumHeads:          int(binary.LittleEndian.Uint16(boot[26:28])),
+	}
+	if bpb.TotalSectors == 0 {
+		bpb.TotalSectors = int(binary.LittleEndian.Uint32(boot[32:36]))
+	}
+
+	switch bpb.BytesPerSector {
+	case 128, 256, 512, 1024, 2048, 4096:
+	default:
+		return BPB{}, fmt.Errorf("no BIOS parameter block: invalid sector size %d", bpb.BytesPerSector)
+	}
+	spc := bpb.SectorsPerCluster
+	if spc == 0 || spc&(spc-1) != 0 {
+		return BPB{}, fmt.Errorf("invalid number of sectors per cluster: %d", spc)
+	}
+	if bpb.ReservedSectors == 0 || bpb.NumFATs == 0 || bpb.SectorsPerFAT == 0 {
+		return BPB{}, fmt.Errorf("invalid FAT layout: %d reserved sectors, %d FATs of %d sectors",
+			bpb.ReservedSectors, bpb.NumFATs, bpb.SectorsPerFAT)
+	}
+	if bpb.RootEntries == 0 {
+		return BPB{}, fmt.Errorf("no root directory entries, FAT32 is not supported")
+	}
+	return bpb, nil
+}
+
+// Create file system with the given layout, and read its FAT
+func newFS(bpb BPB, readSector func(lba int) ([]byte, error)) (*FS, error) {
+	fs := &FS{
+		BPB:        bpb,
+		readSector: readSector,
+	}
+	fs.rootStart = bpb.ReservedSectors + bpb.NumFATs*bpb.SectorsPerFAT
+	rootSectors := (bpb.RootEntries*dirEntrySize + bpb.BytesPerSector - 1) / bpb.BytesPerSector
+	fs.dataStart = fs.rootStart + rootSectors
+	if bpb.TotalSectors <= fs.dataStart {
+		return nil, fmt.Errorf("no space for data: %d sectors total, data starts at sector %d",
+			bpb.TotalSectors, fs.dataStart)
+	}
+	fs.NumClusters = (bpb.TotalSectors - fs.dataStart) / bpb.SectorsPerCluster
+	fs.FAT16 = fs.NumClusters >= 4085
+
+	// Clusters beyond the end of FAT cannot be used
+	fatBytes := bpb.SectorsPerFAT * bpb.BytesPerSector
+	for fs.NumClusters > 0 && fs.entryOffset(fs.NumClusters+1)+2 > fatBytes {
+		fs.NumClusters--
+	}
+	fs.readFAT()
+	return fs, nil
+}
+
+// Read all sectors of the file allocation table.
+// Every sector is taken from the first copy of FAT where it is readable.
+func (fs *FS) readFAT() {
+	bps := fs.BPB.BytesPerSector
+	fs.fat = make([]byte, fs.BPB.SectorsPerFAT*bps)
+	fs.fatBad = make([]bool, fs.BPB.SectorsPerFAT)
+	for i := range fs.fatBad {
+		fs.fatBad[i] = true
+		for n := 0; n < fs.BPB.NumFATs; n++ {
+			lba := fs.BPB.ReservedSectors + n*fs.BPB.SectorsPerFAT + i
+			data, err := fs.readSector(lba)
+			if err == nil {
+				copy(fs.fat[i*bps:(i+1)*bps], data)
+				fs.fatBad[i] = false
+				break
+			}
+		}
+	}
+}
+
+// Byte offset of FAT entry for the given cluster
+func (fs *FS) entryOffset(cluster int) int {
+	if fs.FAT16 {
+		return cluster * 2
+	}
+	return cluster * 3 / 2
+}
+
+// Values of FAT entries
+const (
+	clusterFree = 0
+	clusterBad  = 0xFFF7 // Bad cluster in FAT16, 0xFF7 in FAT12
+	clusterEnd  = 0xFFF8 // End of chain in FAT16, 0xFF8 and above in FAT12
+)
+
+// Returns FAT entry of the cluster, extended to 16 bits for FAT12
+func (fs *FS) next(cluster int) (int, error) {
+	offset := fs.entryOffset(cluster)
+	bps := fs.BPB.BytesPerSector
+	if fs.fatBad[offset/bps] || fs.fatBad[(offset+1)/bps] {
+		return 0, fmt.Errorf("FAT entry of cluster %d is unreadable", cluster)
+	}
+	value := int(binary.LittleEndian.Uint16(fs.fat[offset:]))
+	if fs.FAT16 {
+		return value, nil
+	}
+	if cluster&1 != 0 {
+		value >>= 4
+	} else {
+		value &= 0xFFF
+	}
+	if value >= 0xFF7 {
+		value |= 0xF000
+	}
+	return value, nil
+}
+
+// Follow cluster chain starting from the given cluster.
+// Returns clusters found before the error, when the chain is broken.
+func (fs *FS) chain(first int) ([]int, error) {
+	var clusters []int
+	cluster := first
+	for {
+		if cluster < 2 || cluster >= fs.NumClusters+2 {
+			return clusters, fmt.Errorf("invalid cluster %d in chain", cluster)
+		}
+		if len(clusters) >= fs.NumClusters {
+			return clusters, fmt.Errorf("loop in cluster chain at cluster %d", cluster)
+		}
+		clusters = append(clusters, cluster)
+		next, err := fs.next(cluster)
+		if err != nil {
+			return clusters, err
+		}
+		switch {
+		case next >= clusterEnd:
+			return clusters, nil
+		case next == clusterBad:
+			return clusters, fmt.Errorf("cluster %d is linked to bad cluster", cluster)
+		case next == clusterFree:
+			return clusters, fmt.Errorf("cluster %d is linked to free cluster", cluster)
+		}
+		cluster = next
+	}
+}
+
+// Read sectors starting from lba into buf, which is a part of data
+// at the given offset. Unreadable sectors are recorded in readErr.
+func (fs *FS) readSectors(buf []byte, lba, offset int, readErr *ReadError) {
+	bps := fs.BPB.BytesPerSector
+	for i := 0; i < len(buf); i += bps {
+		data, err := fs.readSector(lba + i/bps)
+		copy(buf[i:min(i+bps, len(buf))], data)
+		if err != nil {
+			readErr.add(offset+i, offset+min(i+bps, len(buf)), err)
+		}
+	}
+}
+
+// Read contents of cluster chain, up to size bytes,
+// or the whole chain when size is negative, for directories.
+// When the chain is broken, the rest of data is reported as unreadable.
+func (fs *FS) readChain(first, size int, readErr *ReadError) []byte {
+	clusterSize := fs.BPB.SectorsPerCluster * fs.BPB.BytesPerSector
+	if size == 0 {
+		// Empty file has no clusters
+		return []byte{}
+	}
+	clusters, err := fs.chain(first)
+	isDir := size < 0
+	if isDir {
+		// Size of directory is given by the chain
+		size = len(clusters) * clusterSize
+	} else if limit := fs.NumClusters * clusterSize; size > limit {
+		// Size from directory entry cannot be trusted:
+		// no file is larger than the data area
+		readErr.add(0, 0, fmt.Errorf("file size %d exceeds data area of %d bytes", size, limit))
+		size = limit
+	}
+	data := make([]byte, size)
+	offset := 0
+	for _, cluster := range clusters {
+		if offset >= size {
+			break
+		}
+		lba := fs.dataStart + (cluster-2)*fs.BPB.SectorsPerCluster
+		end := min(offset+clusterSize, size)
+		fs.readSectors(data[offset:end], lba, offset, readErr)
+		offset = end
+	}
+	if offset < size && err == nil {
+		err = fmt.Errorf("cluster chain is shorter than %d bytes", size)
+	}
+	if err != nil && (offset < size || isDir) {
+		// Rest of directory past the break is lost
+		readErr.add(offset, size, err)
+	}
+	return data
+}
@@ -0,0 +1,386 @@
+package fatfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/images"
+)
+
+// Layout of 1.44M floppy: root directory at sector 19, cluster 2 at sector 33
+const (
+	testRootLBA = 19
+	testDataLBA = 33
+)
+
+var testModTime = time.Date(2024, 3, 15, 10, 30, 20, 0, time.UTC)
+
+// Contents of test file, of given size
+func testContents(size, seed int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + seed)
+	}
+	return data
+}
+
+// Build directory entry with short name in 8.3 format, space padded
+func dirEntry(name string, attr, caseFlags byte, cluster, size int) []byte {
+	e := make([]byte, dirEntrySize)
+	copy(e, fmt.Sprintf("%-11s", name))
+	e[11] = attr
+	e[12] = caseFlags
+	t := testModTime
+	binary.LittleEndian.PutUint16(e[22:], uint16(t.Hour()<<11|t.Minute()<<5|t.Second()/2))
+	binary.LittleEndian.PutUint16(e[24:], uint16((t.Year()-1980)<<9|int(t.Month())<<5|t.Day()))
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], uint32(size))
+	return e
+}
+
+// Build VFAT entries of long name, which precede the short entry
+func longNameEntries(name string, short []byte) []byte {
+	chars := utf16.Encode([]rune(name))
+	chars = append(chars, 0)
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xFFFF)
+	}
+	count := len(chars) / 13
+	sum := shortNameChecksum(short[0:11])
+	var out []byte
+	for seq := count; seq >= 1; seq-- {
+		e := make([]byte, dirEntrySize)
+		e[0] = byte(seq)
+		if seq == count {
+			e[0] |= 0x40
+		}
+		e[11] = attrLongName
+		e[13] = sum
+		for i, pos := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+			binary.LittleEndian.PutUint16(e[pos:], chars[(seq-1)*13+i])
+		}
+		out = append(out, e...)
+	}
+	return out
+}
+
+// Set FAT12 entry in both copies of FAT
+func setFAT12(img []byte, cluster, value int) {
+	for _, start := range []int{1, 10} {
+		fat := img[start*512:]
+		offset := cluster * 3 / 2
+		if cluster&1 != 0 {
+			fat[offset] = fat[offset]&0x0F | byte(value<<4)
+			fat[offset+1] = byte(value >> 4)
+		} else {
+			fat[offset] = byte(value)
+			fat[offset+1] = fat[offset+1]&0xF0 | byte(value>>8)
+		}
+	}
+}
+
+// Store file in consecutive clusters, starting from the given one
+func storeFile(img, data []byte, first int) {
+	clusters := (len(data) + 511) / 512
+	for i := 0; i < clusters; i++ {
+		next := first + i + 1
+		if i == clusters-1 {
+			next = 0xFFF
+		}
+		setFAT12(img, first+i, next)
+	}
+	copy(img[(testDataLBA+first-2)*512:], data)
+}
+
+// Build image of 1.44M floppy with a few files:
+//
+//	/Hello World.txt  - 1300 bytes in clusters 2-4, with long name
+//	/EMPTY.DAT        - no data, preceded by orphaned long name entry
+//	/DOCS/readme.txt  - 600 bytes in clusters 6-7, with lowercase short name
+func makeTestImage(t *testing.T) []byte {
+	img, err := images.GetImage("fat1.44.img")
+	if err != nil {
+		t.Fatalf("GetImage() error: %v", err)
+	}
+
+	var root []byte
+	root = append(root, dirEntry("TESTDISK", AttrVolumeID, 0, 0, 0)...)
+	hello := dirEntry("HELLOW~1TXT", AttrArchive, 0, 2, 1300)
+	root = append(root, longNameEntries("Hello World.txt", hello)...)
+	root = append(root, hello...)
+	deleted := dirEntry("OLD     TXT", AttrArchive, 0, 9, 100)
+	deleted[0] = 0xE5
+	root = append(root, deleted...)
+	empty := dirEntry("EMPTY   DAT", AttrArchive, 0, 0, 0)
+	root = append(root, longNameEntries("Orphan", dirEntry("OTHER", 0, 0, 0, 0))...)
+	root = append(root, empty...)
+	root = append(root, dirEntry("DOCS", AttrDirectory, 0, 5, 0)...)
+	copy(img[testRootLBA*512:], root)
+
+	var docs []byte
+	docs = append(docs, dirEntry(".", AttrDirectory, 0, 5, 0)...)
+	docs = append(docs, dirEntry("..", AttrDirectory, 0, 0, 0)...)
+	docs = append(docs, dirEntry("README  TXT", AttrArchive, lowerBase|lowerExt, 6, 600)...)
+	docs = append(docs, make([]byte, 512-len(docs))...) // New directory is zeroed
+	storeFile(img, docs, 5)
+
+	storeFile(img, testContents(1300, 1), 2)
+	storeFile(img, testContents(600, 2), 6)
+	return img
+}
+
+// Check files of the test image
+func checkTestFiles(t *testing.T, fs *FS) {
+	entries, err := fs.ListDir("/")
+	if err != nil {
+		t.Fatalf("ListDir(/) error: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if fmt.Sprint(names) != "[Hello World.txt EMPTY.DAT DOCS]" {
+		t.Errorf("ListDir(/) = %v", names)
+	}
+	if len(entries) == 3 {
+		e := entries[0]
+		if e.ShortName != "HELLOW~1.TXT" || e.Size != 1300 || e.Cluster != 2 || e.IsDir() {
+			t.Errorf("entry %+v", e)
+		}
+		if !e.ModTime.Equal(testModTime) {
+			t.Errorf("ModTime = %v, expected %v", e.ModTime, testModTime)
+		}
+		if !entries[2].IsDir() {
+			t.Errorf("DOCS is not a directory")
+		}
+	}
+
+	for _, path := range []string{"/Hello World.txt", "hello world.TXT", "/HELLOW~1.TXT"} {
+		data, err := fs.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error: %v", path, err)
+		}
+		if !bytes.Equal(data, testContents(1300, 1)) {
+			t.Errorf("ReadFile(%s): contents differ", path)
+		}
+	}
+	data, err := fs.ReadFile("/EMPTY.DAT")
+	if err != nil || len(data) != 0 {
+		t.Errorf("ReadFile(/EMPTY.DAT) = %d bytes, error %v", len(data), err)
+	}
+
+	entries, err = fs.ListDir("/docs")
+	if err != nil {
+		t.Fatalf("ListDir(/docs) error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "readme.txt" || entries[0].ShortName != "README.TXT" {
+		t.Errorf("ListDir(/docs) = %+v", entries)
+	}
+	data, err = fs.ReadFile("/DOCS/README.TXT")
+	if err != nil {
+		t.Fatalf("ReadFile(/DOCS/README.TXT) error: %v", err)
+	}
+	if !bytes.Equal(data, testContents(600, 2)) {
+		t.Errorf("ReadFile(/DOCS/README.TXT): contents differ")
+	}
+
+	if _, err := fs.ReadFile("/DOCS"); err == nil {
+		t.Errorf("ReadFile() of directory succeeded")
+	}
+	if _, err := fs.ReadFile("/OLD.TXT"); err == nil {
+		t.Errorf("ReadFile() of deleted file succeeded")
+	}
+	if _, err := fs.ListDir("/EMPTY.DAT"); err == nil {
+		t.Errorf("ListDir() of file succeeded")
+	}
+	if _, err := fs.ReadFile("/EMPTY.DAT/X"); err == nil {
+		t.Errorf("ReadFile() below file succeeded")
+	}
+}
+
+func TestOpenImage(t *testing.T) {
+	fs, err := OpenImage(makeTestImage(t))
+	if err != nil {
+		t.Fatalf("OpenImage() error: %v", err)
+	}
+	if fs.FAT16 || fs.NumClusters != 2847 || fs.BPB.RootEntries != 224 || fs.BPB.SectorsPerTrack != 18 {
+		t.Errorf("FAT16 %v, %d clusters, BPB %+v", fs.FAT16, fs.NumClusters, fs.BPB)
+	}
+	checkTestFiles(t, fs)
+}
+
+func TestOpen_SampleFile(t *testing.T) {
+	for _, name := range []string{"fat12v1.hfe", "fat12v3.hfe"} {
+		t.Run(name, func(t *testing.T) {
+			disk, err := hfe.Read("../images/" + name)
+			if err != nil {
+				t.Fatalf("Read() error: %v", err)
+			}
+
+			// Formatted disk has empty root directory
+			fs, err := Open(disk)
+			if err != nil {
+				t.Fatalf("Open() error: %v", err)
+			}
+			entries, err := fs.ListDir("/")
+			if err != nil || len(entries) != 0 {
+				t.Errorf("ListDir(/) = %v, error %v", entries, err)
+			}
+
+			// Sample has two cylinders: put files there
+			img := makeTestImage(t)
+			for lba := 0; lba < 2*2*18; lba++ {
+				cyl, head, sector := lba/36, lba/18%2, lba%18+1
+				if err := disk.WriteSector(cyl, head, sector, img[lba*512:(lba+1)*512]); err != nil {
+					t.Fatalf("WriteSector(%d, %d, %d) error: %v", cyl, head, sector, err)
+				}
+			}
+			fs, err = Open(disk)
+			if err != nil {
+				t.Fatalf("Open() error: %v", err)
+			}
+			checkTestFiles(t, fs)
+		})
+	}
+}
+
+// Open test image, with some sectors unreadable
+func openDamaged(t *testing.T, img []byte, bad ...int) *FS {
+	bpb, err := parseBPB(img)
+	if err != nil {
+		t.Fatalf("parseBPB() error: %v", err)
+	}
+	fs, err := newFS(bpb, func(lba int) ([]byte, error) {
+		for _, b := range bad {
+			if lba == b {
+				return nil, fmt.Errorf("sector %d not found", lba)
+			}
+		}
+		return img[lba*512 : (lba+1)*512], nil
+	})
+	if err != nil {
+		t.Fatalf("newFS() error: %v", err)
+	}
+	return fs
+}
+
+func TestReadFile_Damaged(t *testing.T) {
+	tests := []struct {
+		name   string
+		bad    []int            // Unreadable sectors
+		modify func(img []byte) // Changes of the image
+		path   string           // File to read
+		ranges []Range          // Expected unreadable ranges
+	}{
+		{"bad sector", []int{testDataLBA + 1}, nil, "/Hello World.txt", []Range{{512, 1024}}},
+		{"last sectors", []int{testDataLBA + 1, testDataLBA + 2}, nil, "/Hello World.txt", []Range{{512, 1300}}},
+		{"two sectors", []int{testDataLBA, testDataLBA + 2}, nil, "/Hello World.txt", []Range{{0, 512}, {1024, 1300}}},
+		{"bad cluster", nil, func(img []byte) { setFAT12(img, 3, 0xFF7) }, "/Hello World.txt", []Range{{1024, 1300}}},
+		{"free cluster", nil, func(img []byte) { setFAT12(img, 2, 0) }, "/Hello World.txt", []Range{{512, 1300}}},
+		{"short chain", nil, func(img []byte) { setFAT12(img, 6, 0xFFF) }, "/DOCS/README.TXT", []Range{{512, 600}}},
+		{"FAT lost", []int{1, 10}, nil, "/Hello World.txt", []Range{{512, 1300}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img := makeTestImage(t)
+			if tc.modify != nil {
+				tc.modify(img)
+			}
+			fs := openDamaged(t, img, tc.bad...)
+			data, err := fs.ReadFile(tc.path)
+			var readErr *ReadError
+			if !errors.As(err, &readErr) {
+				t.Fatalf("ReadFile() error %v, expected ReadError", err)
+			}
+			if fmt.Sprint(readErr.Ranges) != fmt.Sprint(tc.ranges) {
+				t.Errorf("ranges %v, expected %v", readErr.Ranges, tc.ranges)
+			}
+
+			// Readable parts are returned, the rest is zeros
+			want := testContents(len(data), 1)
+			if tc.path != "/Hello World.txt" {
+				want = testContents(len(data), 2)
+			}
+			for _, r := range tc.ranges {
+				clear(want[r.Start:r.End])
+			}
+			if !bytes.Equal(data, want) {
+				t.Errorf("partial data differs")
+			}
+		})
+	}
+
+	// Second copy of FAT is used when the first is unreadable
+	fs := openDamaged(t, makeTestImage(t), 1)
+	checkTestFiles(t, fs)
+}
+
+func TestReadFile_HugeSize(t *testing.T) {
+	// Size of /Hello World.txt is corrupted to 4 Gbytes
+	img := makeTestImage(t)
+	binary.LittleEndian.PutUint32(img[testRootLBA*512+3*dirEntrySize+28:], 0xFFFFFFFF)
+	fs := openDamaged(t, img)
+	data, err := fs.ReadFile("/Hello World.txt")
+	var readErr *ReadError
+	if !errors.As(err, &readErr) {
+		t.Fatalf("ReadFile() error %v, expected ReadError", err)
+	}
+	if len(data) != fs.NumClusters*512 {
+		t.Errorf("read %d bytes, expected size of data area %d", len(data), fs.NumClusters*512)
+	}
+	if !bytes.Equal(data[:1300], testContents(1300, 1)) {
+		t.Errorf("contents of the chain differ")
+	}
+}
+
+func TestListDir_Damaged(t *testing.T) {
+	// Second sector of root directory is lost
+	fs := openDamaged(t, makeTestImage(t), testRootLBA+1)
+	entries, err := fs.ListDir("/")
+	var readErr *ReadError
+	if !errors.As(err, &readErr) || fmt.Sprint(readErr.Ranges) != "[{512 1024}]" {
+		t.Errorf("ListDir() error %v, expected ReadError for bytes 512-1023", err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("ListDir() found %d entries, expected 3", len(entries))
+	}
+
+	// Subdirectory is lost
+	fs = openDamaged(t, makeTestImage(t), testDataLBA+3)
+	if _, err := fs.ReadFile("/DOCS/README.TXT"); err == nil {
+		t.Errorf("ReadFile() in lost directory succeeded")
+	}
+}
+
+func TestOpenImage_Invalid(t *testing.T) {
+	img := makeTestImage(t)
+	tests := []struct {
+		name   string
+		offset int
+		value  byte
+	}{
+		{"sector size", 11, 0x33},
+		{"cluster size", 13, 3},
+		{"no FATs", 16, 0},
+		{"no root", 17, 0},
+	}
+	for _, tc := range tests {
+		bad := bytes.Clone(img)
+		bad[tc.offset] = tc.value
+		if tc.name == "no root" {
+			bad[18] = 0
+		}
+		if _, err := OpenImage(bad); err == nil {
+			t.Errorf("%s: OpenImage() succeeded, expected error", tc.name)
+		}
+	}
+	if _, err := OpenImage(img[:100]); err == nil {
+		t.Errorf("OpenImage() of short data succeeded")
+	}
+}
@@ -0,0 +1,259 @@
+// Package flux holds flux transitions of one track, as read by any adapter,
+// and recovers MFM bitcells from them. Every adapter converts its own device
+// stream into FluxTrack, and the rest of decoding is shared.
+package flux
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// FluxTrack contains flux transitions and index pulses of one track.
+// Transitions of all revolutions are kept in one sequence;
+// see Revolutions to split them.
+type FluxTrack struct {
+	Transitions   []uint64 // Transition times in nanoseconds, relative to the first index pulse
+	IndexPulses   []uint64 // Index pulse times in nanoseconds, the first one is 0
+	SampleClockHz float64  // Sample clock of the adapter
+}
+
+// Revolution is flux of one turn of the disk, between two index pulses
+type Revolution struct {
+	Transitions []uint64 // Transition times in nanoseconds, relative to Start
+	Start       uint64   // Time of the starting index pulse, relative to the first one
+	End         uint64   // Time of the ending index pulse
+}
+
+// Duration returns time of the revolution in nanoseconds
+func (r *Revolution) Duration() uint64 {
+	return r.End - r.Start
+}
+
+// Duration of the first revolution in nanoseconds, or 0 when unknown
+func (t *FluxTrack) revolutionNs() uint64 {
+	if len(t.IndexPulses) < 2 {
+		return 0
+	}
+	return t.IndexPulses[1] - t.IndexPulses[0]
+}
+
+// RPM returns measured rotation speed, or 0 when less than two index pulses are present
+func (t *FluxTrack) RPM() float64 {
+	durationNs := t.revolutionNs()
+	if durationNs == 0 {
+		return 0
+	}
+	return 60e9 / float64(durationNs)
+}
+
+// NominalRPM rounds rotation speed to either 300 or 360 RPM
+// (standard floppy drive speeds). Default is 300.
+func (t *FluxTrack) NominalRPM() uint16 {
+	return NominalSpeed(t.RPM())
+}
+
+// NominalSpeed rounds measured rotation speed to either 300 or 360 RPM.
+// Default is 300, for speed 0.
+func NominalSpeed(rpm float64) uint16 {
+	// Use 330 RPM as the threshold (midpoint between 300 and 360)
+	if rpm < 330 {
+		return 300
+	}
+	return 360
+}
+
+// EstimateBitRateKbps estimates bit rate from flux intervals of the first
+// revolution, rounded to standard rates: 250, 300, 500 or 1000 kbps.
+// Default is 250. Rate of 300 kbps is seen when DD disk is read
+// in a 360 RPM drive.
+func (t *FluxTrack) EstimateBitRateKbps() uint16 {
+	return NominalBitRate(t.MeasureBitRateKbps())
+}
+
+// MeasureBitRateKbps measures bit rate from flux intervals of the first
+// revolution, without rounding. Returns 0 when it cannot be measured.
+//
+// The shortest MFM interval spans two bitcells, or one data bit.
+// Counting transitions per revolution is not enough: a track filled
+// with 0xAA bytes at 1000 kbps has as many transitions as a track
+// filled with zeros at 500 kbps. But gaps and sync fields of every
+// track have plenty of shortest intervals, so a low percentile of
+// intervals gives the period of one data bit.
+func (t *FluxTrack) MeasureBitRateKbps() float64 {
+	if t.revolutionNs() == 0 {
+		return 0
+	}
+	bitNs := t.shortIntervalNs()
+	if bitNs == 0 {
+		return 0
+	}
+	return 1e6 / bitNs
+}
+
+// NominalBitRate rounds measured bit rate to standard rates:
+// 250, 300, 500 or 1000 kbps. Default is 250, for rate 0.
+func NominalBitRate(kbps float64) uint16 {
+	// Use thresholds: < 275 -> 250, < 375 -> 300, < 750 -> 500, >= 750 -> 1000
+	switch {
+	case kbps < 275:
+		return 250
+	case kbps < 375:
+		return 300
+	case kbps < 750:
+		return 500
+	default:
+		return 1000
+	}
+}
+
+// Typical length of the shortest flux interval in the first revolution,
+// in nanoseconds: 5th percentile of all intervals, which is robust
+// to rare glitches. Returns 0 when there are no intervals.
+func (t *FluxTrack) shortIntervalNs() float64 {
+	transitions := t.firstRevolution()
+	intervals := make([]uint64, 0, len(transitions))
+	prev := uint64(0)
+	for _, tr := range transitions {
+		if tr > prev {
+			intervals = append(intervals, tr-prev)
+		}
+		prev = tr
+	}
+	if len(intervals) == 0 {
+		return 0
+	}
+	slices.Sort(intervals)
+	return float64(intervals[len(intervals)/20])
+}
+
+// Revolutions splits transitions into complete revolutions between index pulses.
+// Times in every revolution are relative to its starting index pulse.
+func (t *FluxTrack) Revolutions() []Revolution {
+	var revs []Revolution
+	i := 0
+	for r := 0; r+1 < len(t.IndexPulses); r++ {
+		rev := Revolution{Start: t.IndexPulses[r], End: t.IndexPulses[r+1]}
+		for i < len(t.Transitions) && t.Transitions[i] <= rev.Start {
+			i++
+		}
+		for ; i < len(t.Transitions) && t.Transitions[i] <= rev.End; i++ {
+			rev.Transitions = append(rev.Transitions, t.Transitions[i]-rev.Start)
+		}
+		revs = append(revs, rev)
+	}
+	return revs
+}
+
+// Transitions of the first revolution, or all of them without index pulses
+func (t *FluxTrack) firstRevolution() []uint64 {
+	if revs := t.Revolutions(); len(revs) > 0 {
+		return revs[0].Transitions
+	}
+	return t.Transitions
+}
+
+// DecodeMFM recovers raw MFM bitcells of the first revolution using PLL
+// with the given config, and returns them packed MSB-first (bitcells,
+// not decoded data bits). When the track has less than two index pulses,
+// all transitions are decoded.
+func (t *FluxTrack) DecodeMFM(bitRateKbps uint16, cfg pll.Config) ([]byte, error) {
+	bits, _, err := t.decodeFirstRevolution(bitRateKbps, cfg)
+	return bits, err
+}
+
+// Decode the first revolution like DecodeMFM, and return lock of PLL
+func (t *FluxTrack) decodeFirstRevolution(bitRateKbps uint16, cfg pll.Config) ([]byte, PLLLock, error) {
+	transitions := t.firstRevolution()
+	if len(transitions) == 0 {
+		return nil, PLLLock{}, fmt.Errorf("no flux transitions found")
+	}
+	if bitRateKbps == 0 {
+		return nil, PLLLock{}, fmt.Errorf("invalid bit rate: %d kbps", bitRateKbps)
+	}
+	bits, lock := decodeMFM(transitions, float64(bitRateKbps), cfg)
+	return bits, lock, nil
+}
+
+// DecodeRevolutionMFM recovers raw MFM bitcells of the given revolution,
+// counting from 0, like DecodeMFM does for the first one.
+func (t *FluxTrack) DecodeRevolutionMFM(rev int, bitRateKbps uint16, cfg pll.Config) ([]byte, error) {
+	return t.decodeRevolution(rev, float64(bitRateKbps), cfg)
+}
+
+// Decode the given revolution like DecodeRevolutionMFM, at any bit rate
+func (t *FluxTrack) decodeRevolution(rev int, bitRateKbps float64, cfg pll.Config) ([]byte, error) {
+	revs := t.Revolutions()
+	if rev < 0 || rev >= len(revs) {
+		return nil, fmt.Errorf("no revolution %d in flux data", rev)
+	}
+	if len(revs[rev].Transitions) == 0 {
+		return nil, fmt.Errorf("no flux transitions found")
+	}
+	if bitRateKbps <= 0 {
+		return nil, fmt.Errorf("invalid bit rate: %.0f kbps", bitRateKbps)
+	}
+	bits, _ := decodeMFM(revs[rev].Transitions, bitRateKbps, cfg)
+	return bits, nil
+}
+
+// PLLLock describes how well PLL followed flux of a decoded track
+type PLLLock struct {
+	PeriodNs    float64 // Bitcell period at the end of the track, in nanoseconds
+	LockQuality float64 // RMS phase error of transitions, relative to the period
+}
+
+// Scratch buffers for MFM bitcells, reused between decodes
+var bitcellPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// Decode transitions into MFM bitcells at the given bit rate in kbps
+func decodeMFM(transitions []uint64, bitRateKbps float64, cfg pll.Config) ([]byte, PLLLock) {
+	decoder := mfm.NewDecoderConfig(transitions, 1e6/bitRateKbps/2, cfg)
+
+	// Ignore first half-bit (as done in reference implementation)
+	_ = decoder.NextBit()
+
+	// Two bitcells per data bit, plus some slack for PLL drift.
+	// Bitcells are packed into the scratch buffer, and copied out.
+	estimate := int(float64(transitions[len(transitions)-1])*bitRateKbps/4e6) + 64
+	buf := bitcellPool.Get().(*[]byte)
+	defer bitcellPool.Put(buf)
+	if cap(*buf) < estimate {
+		*buf = make([]byte, 0, estimate)
+	}
+	mfmBytes := (*buf)[:0]
+	currentByte := byte(0)
+	bitCount := 0
+	for {
+		if decoder.NextBit() {
+			currentByte |= 0x80 >> bitCount
+		}
+		if decoder.NextBit() {
+			currentByte |= 0x40 >> bitCount
+		}
+		bitCount += 2
+
+		// When we have 8 bits, save the byte and start a new one
+		if bitCount == 8 {
+			mfmBytes = append(mfmBytes, currentByte)
+			currentByte = 0
+			bitCount = 0
+		}
+
+		if decoder.IsDone() {
+			// No more transitions available
+			break
+		}
+	}
+
+	// Add any remaining partial byte
+	if bitCount > 0 {
+		mfmBytes = append(mfmBytes, currentByte)
+	}
+	*buf = mfmBytes
+	return bytes.Clone(mfmBytes), PLLLock{PeriodNs: decoder.PeriodNs(), LockQuality: decoder.LockQuality()}
+}
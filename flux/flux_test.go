@@ -0,0 +1,551 @@
+package flux
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+func TestRevolutions(t *testing.T) {
+	track := &FluxTrack{
+		Transitions: []uint64{100, 200, 1000, 1100, 1500, 2100},
+		IndexPulses: []uint64{0, 1000, 2000},
+	}
+	revs := track.Revolutions()
+	if len(revs) != 2 {
+		t.Fatalf("Revolutions() = %v, expected 2 revolutions", revs)
+	}
+	if rev := revs[0].Transitions; len(rev) != 3 || rev[2] != 1000 {
+		t.Errorf("revolution 0 = %v", rev)
+	}
+	if rev := revs[1].Transitions; len(rev) != 2 || rev[0] != 100 || rev[1] != 500 {
+		t.Errorf("revolution 1 = %v", rev)
+	}
+	if revs[1].Start != 1000 || revs[1].End != 2000 || revs[1].Duration() != 1000 {
+		t.Errorf("revolution 1 spans %d-%d", revs[1].Start, revs[1].End)
+	}
+
+	// No complete revolution without second index pulse
+	track.IndexPulses = track.IndexPulses[:1]
+	if revs := track.Revolutions(); len(revs) != 0 {
+		t.Errorf("Revolutions() = %v, expected none", revs)
+	}
+}
+
+// Index pulses of a hard-sectored disk: evenly spaced sector holes,
+// and the index hole midway between two of them.
+func hardSectorPulses(holes, revolutions int, revolutionNs uint64, offset int) []uint64 {
+	spacing := revolutionNs / uint64(holes)
+	var pulses []uint64
+	for r := 0; r < revolutions; r++ {
+		for h := 0; h < holes; h++ {
+			pos := uint64(r)*revolutionNs + uint64(h)*spacing
+			pulses = append(pulses, pos)
+			if h == offset {
+				pulses = append(pulses, pos+spacing/2)
+			}
+		}
+	}
+	return pulses
+}
+
+func TestCheckIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		pulses []uint64
+		rpm    int
+		holes  int // 0 = soft-sectored
+	}{
+		{"soft-sectored", []uint64{0, 200000000, 400000000}, 300, 0},
+		{"soft-sectored at 360 RPM", []uint64{0, 166666667}, 360, 0},
+		{"single pulse", []uint64{0}, 300, 0},
+		{"10 holes, 2 revolutions", hardSectorPulses(10, 2, 200000000, 3), 300, 10},
+		{"16 holes, 3 revolutions", hardSectorPulses(16, 3, 200000000, 0), 300, 16},
+		{"32 holes at 360 RPM", hardSectorPulses(32, 2, 166666667, 20), 360, 32},
+		{"two sector holes only", []uint64{0, 20000000}, 300, 10},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			track := &FluxTrack{IndexPulses: tc.pulses}
+			err := track.CheckIndex(tc.rpm)
+			if tc.holes == 0 {
+				if err != nil {
+					t.Errorf("CheckIndex() error = %v, expected nil", err)
+				}
+				return
+			}
+			var hsErr *HardSectorError
+			if !errors.Is(err, ErrHardSectored) || !errors.As(err, &hsErr) {
+				t.Fatalf("CheckIndex() error = %v, expected hard-sectored", err)
+			}
+			if hsErr.Holes != tc.holes {
+				t.Errorf("found %d sector holes, expected %d", hsErr.Holes, tc.holes)
+			}
+		})
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		revolutionNs uint64
+		transitions  int
+		rpm          uint16
+		bitRate      uint16
+	}{
+		{200000000, 50000, 300, 250},   // DD at 300 RPM
+		{166666667, 50000, 360, 300},   // DD at 360 RPM
+		{200000000, 60000, 300, 300},   // 300 kbps at 300 RPM
+		{200000000, 100000, 300, 500},  // HD
+		{200000000, 200000, 300, 1000}, // ED
+		{0, 0, 300, 250},               // No index pulses
+	}
+	for _, tc := range tests {
+		track := &FluxTrack{}
+		if tc.revolutionNs != 0 {
+			track.IndexPulses = []uint64{0, tc.revolutionNs}
+			for i := 1; i <= tc.transitions; i++ {
+				track.Transitions = append(track.Transitions, tc.revolutionNs*uint64(i)/uint64(tc.transitions))
+			}
+		}
+		if rpm := track.NominalRPM(); rpm != tc.rpm {
+			t.Errorf("%d nsec: NominalRPM() = %d, expected %d", tc.revolutionNs, rpm, tc.rpm)
+		}
+		if rate := track.EstimateBitRateKbps(); rate != tc.bitRate {
+			t.Errorf("%d nsec: EstimateBitRateKbps() = %d, expected %d", tc.revolutionNs, rate, tc.bitRate)
+		}
+	}
+}
+
+func TestDecodeMFM(t *testing.T) {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+	}
+	bits := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+	transitions, err := mfm.GenerateFluxTransitions(bits, 250)
+	if err != nil {
+		t.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+
+	// Second revolution is ignored
+	last := transitions[len(transitions)-1]
+	track := &FluxTrack{IndexPulses: []uint64{0, last, 2 * last}}
+	track.Transitions = append(track.Transitions, transitions...)
+	for _, tr := range transitions {
+		track.Transitions = append(track.Transitions, last+tr)
+	}
+
+	decoded, err := track.DecodeMFM(250, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(decoded).CountSectorsIBMPC(); n != 9 {
+		t.Errorf("decoded %d sectors, expected 9", n)
+	}
+	if len(decoded) > len(bits)+1 {
+		t.Errorf("decoded %d bytes, expected %d", len(decoded), len(bits))
+	}
+
+	if _, err := (&FluxTrack{}).DecodeMFM(250, pll.Config{}); err == nil {
+		t.Errorf("expected error for empty track")
+	}
+
+	// Second revolution decodes the same way
+	second, err := track.DecodeRevolutionMFM(1, 250, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeRevolutionMFM failed: %v", err)
+	}
+	if !bytes.Equal(second, decoded) {
+		t.Errorf("second revolution differs from the first one")
+	}
+	if _, err := track.DecodeRevolutionMFM(2, 250, pll.Config{}); err == nil {
+		t.Errorf("expected error for missing revolution")
+	}
+}
+
+// Config of PLL limits how far the period follows the speed of the drive
+func TestDecodeMFM_Config(t *testing.T) {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+	}
+	bits := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+	track := &FluxTrack{Transitions: mfm.IntervalsToTransitions(SynthesizeFlux(bits, 250, 0, 0.25))}
+
+	// Drive 25% fast is beyond default range of period
+	decoded, err := track.DecodeMFM(250, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(decoded).CountSectorsIBMPC(); n != 0 {
+		t.Errorf("decoded %d sectors with default config, expected none", n)
+	}
+	decoded, err = track.DecodeMFM(250, pll.Config{MaxAdjust: 30})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(decoded).CountSectorsIBMPC(); n != 9 {
+		t.Errorf("decoded %d sectors with period range of 30%%, expected 9", n)
+	}
+
+	// Bitcells are packed into a buffer reused between decodes:
+	// only the result and the PLL are allocated
+	allocs := testing.AllocsPerRun(10, func() {
+		track.DecodeMFM(250, pll.Config{})
+	})
+	if allocs > 2 {
+		t.Errorf("%v allocations per decode, expected 2", allocs)
+	}
+}
+
+// Flux of a track at 300 RPM with the given bit rate, number of sectors
+// and contents: random when fill is negative. Transitions get random jitter.
+func syntheticFluxTrack(t *testing.T, bitRate uint16, sectorsPerTrack, fill, jitterNs int) *FluxTrack {
+	t.Helper()
+	rng := rand.New(rand.NewSource(int64(bitRate)))
+	sectors := make([][]byte, sectorsPerTrack)
+	for i := range sectors {
+		sectors[i] = bytes.Repeat([]byte{byte(fill)}, 512)
+		if fill < 0 {
+			rng.Read(sectors[i])
+		}
+	}
+	maxHalfBits := int(bitRate) * 1000 * 60 / 300 * 2
+	bits := mfm.NewWriter(maxHalfBits).EncodeTrackIBMPC(sectors, 0, 0, sectorsPerTrack, bitRate)
+	transitions, err := mfm.GenerateFluxTransitions(bits, bitRate)
+	if err != nil {
+		t.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+	track := &FluxTrack{IndexPulses: []uint64{0, 200000000}}
+	for _, tr := range transitions {
+		track.Transitions = append(track.Transitions, tr+uint64(rng.Intn(jitterNs+1)))
+	}
+	return track
+}
+
+// ED tracks have 500 nsec bitcells. Tracks filled with 0xAA have as many
+// transitions as HD tracks, but still must be recognized as ED.
+func TestDecodeMFM_ExtendedDensity(t *testing.T) {
+	for _, tc := range []struct {
+		bitRate uint16
+		sectors int
+		fill    int
+	}{
+		{1000, 36, -1},
+		{1000, 36, 0xAA},
+		{1000, 36, 0x00},
+		{1000, 39, -1},
+		{500, 18, 0xAA},
+		{500, 18, 0x00},
+		{250, 9, 0xAA},
+	} {
+		for _, jitter := range []int{0, 100} {
+			track := syntheticFluxTrack(t, tc.bitRate, tc.sectors, tc.fill, jitter)
+			if rate := track.EstimateBitRateKbps(); rate != tc.bitRate {
+				t.Errorf("%d kbps, fill %#x, jitter %d: EstimateBitRateKbps() = %d", tc.bitRate, tc.fill, jitter, rate)
+			}
+			bits, err := track.DecodeMFM(tc.bitRate, pll.Config{})
+			if err != nil {
+				t.Fatalf("DecodeMFM failed: %v", err)
+			}
+			if good := countGoodSectors(bits); good != tc.sectors {
+				t.Errorf("%d kbps, fill %#x, jitter %d: %d good sectors, expected %d",
+					tc.bitRate, tc.fill, jitter, good, tc.sectors)
+			}
+		}
+	}
+}
+
+// DD disk in a 360 RPM drive is read at 300 kbps
+func TestDecodeMFM_360RPM(t *testing.T) {
+	rng := rand.New(rand.NewSource(300))
+	for _, fill := range []int{-1, 0xAA, 0x00} {
+		sectors := make([][]byte, 9)
+		for i := range sectors {
+			sectors[i] = bytes.Repeat([]byte{byte(fill)}, 512)
+			if fill < 0 {
+				rng.Read(sectors[i])
+			}
+		}
+		bits := mfm.NewWriter(300*1000*60/360*2).EncodeTrackIBMPC(sectors, 0, 0, 9, 300)
+		transitions, err := mfm.GenerateFluxTransitions(bits, 300)
+		if err != nil {
+			t.Fatalf("GenerateFluxTransitions failed: %v", err)
+		}
+		for _, jitter := range []int{0, 100} {
+			track := &FluxTrack{IndexPulses: []uint64{0, 166666667}}
+			for _, tr := range transitions {
+				track.Transitions = append(track.Transitions, tr+uint64(rng.Intn(jitter+1)))
+			}
+			if rpm, rate := track.NominalRPM(), track.EstimateBitRateKbps(); rpm != 360 || rate != 300 {
+				t.Errorf("fill %#x, jitter %d: estimated %d RPM, %d kbps", fill, jitter, rpm, rate)
+			}
+			decoded, err := track.DecodeMFM(300, pll.Config{})
+			if err != nil {
+				t.Fatalf("DecodeMFM failed: %v", err)
+			}
+			if good := countGoodSectors(decoded); good != 9 {
+				t.Errorf("fill %#x, jitter %d: %d good sectors, expected 9", fill, jitter, good)
+			}
+		}
+	}
+}
+
+func TestSynthesizeIndex(t *testing.T) {
+	// DD track with random contents, at 300 RPM
+	rng := rand.New(rand.NewSource(1))
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		rng.Read(sectors[i])
+	}
+	bits := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+	transitions, err := mfm.GenerateFluxTransitions(bits, 250)
+	if err != nil {
+		t.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+	const period = 200000000
+
+	// Capture of 250 msec starting in the middle of revolution, with jitter
+	track := &FluxTrack{}
+	start := uint64(period / 3)
+	for rev := uint64(0); rev < 2; rev++ {
+		for _, tr := range transitions {
+			pos := rev*period + tr
+			if pos <= start || pos > start+250000000 {
+				continue
+			}
+			track.Transitions = append(track.Transitions, pos-start+uint64(rng.Intn(200)))
+		}
+	}
+
+	if err := track.SynthesizeIndex(); err != nil {
+		t.Fatalf("SynthesizeIndex failed: %v", err)
+	}
+	if len(track.IndexPulses) != 2 || track.IndexPulses[0] != 0 {
+		t.Fatalf("index pulses %v", track.IndexPulses)
+	}
+	if got := track.IndexPulses[1]; got < period-10000 || got > period+10000 {
+		t.Errorf("revolution %d nsec, expected %d", got, period)
+	}
+	if rpm := track.NominalRPM(); rpm != 300 {
+		t.Errorf("NominalRPM() = %d, expected 300", rpm)
+	}
+	decoded, err := track.DecodeMFM(250, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(decoded).CountSectorsIBMPC(); n < 8 {
+		t.Errorf("decoded %d sectors, expected at least 8", n)
+	}
+
+	// Noise does not repeat
+	noise := &FluxTrack{}
+	pos := uint64(0)
+	for pos < 250000000 {
+		pos += 4000 + uint64(rng.Intn(4000))
+		noise.Transitions = append(noise.Transitions, pos)
+	}
+	if err := noise.SynthesizeIndex(); err == nil {
+		t.Errorf("expected error for noise, got index pulses %v", noise.IndexPulses)
+	}
+}
+
+// Flux of a DD track with random contents, with time scaled
+// by the given factor: drive spinning slow when above 1.
+func scaledFluxTrack(t *testing.T, scale float64) *FluxTrack {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		rng.Read(sectors[i])
+	}
+	bits := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+	transitions, err := mfm.GenerateFluxTransitions(bits, 250)
+	if err != nil {
+		t.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+	track := &FluxTrack{}
+	for _, tr := range transitions {
+		track.Transitions = append(track.Transitions, uint64(float64(tr)*scale)+uint64(rng.Intn(300)))
+	}
+	return track
+}
+
+func TestSpeedRecovery(t *testing.T) {
+	for _, tc := range []struct {
+		scale   float64 // Time scale of flux
+		nominal int     // Good sectors at nominal rate
+	}{
+		{1.0, 9},
+		{1.025, 9},
+		{0.975, 9},
+		{1.25, 0}, // 240 RPM
+		{0.8, 0},  // 375 RPM
+	} {
+		track := scaledFluxTrack(t, tc.scale)
+		bits, err := track.DecodeMFM(250, pll.Config{})
+		if err != nil {
+			t.Fatalf("DecodeMFM failed: %v", err)
+		}
+		if good := countGoodSectors(bits); good != tc.nominal {
+			t.Errorf("scale %.3f: %d good sectors at nominal rate, expected %d", tc.scale, good, tc.nominal)
+		}
+
+		r := &SpeedRecovery{}
+		bits, adjust, err := r.DecodeMFM(track, 250)
+		if err != nil {
+			t.Fatalf("SpeedRecovery.DecodeMFM failed: %v", err)
+		}
+		if good := countGoodSectors(bits); good != 9 {
+			t.Errorf("scale %.3f: %d good sectors after recovery, expected 9", tc.scale, good)
+		}
+
+		// PLL is locked to the actual speed of the drive
+		if p := r.Lock.PeriodNs; math.Abs(p/tc.scale-2000) > 40 || r.Weak || r.LockReport() == "" {
+			t.Errorf("scale %.3f: lock %+v, weak %v", tc.scale, r.Lock, r.Weak)
+		}
+		// Rereads of the track are decoded at the adjusted rate
+		bits, err = r.DecodeRevolutionMFM(track, 0, 250, adjust)
+		if err != nil {
+			t.Fatalf("SpeedRecovery.DecodeRevolutionMFM failed: %v", err)
+		}
+		if good := countGoodSectors(bits); good != 9 {
+			t.Errorf("scale %.3f: %d good sectors on reread, expected 9", tc.scale, good)
+		}
+		if tc.nominal == 9 {
+			if adjust != 0 || r.Tracks != 0 || r.Report() != "" {
+				t.Errorf("scale %.3f: unexpected adjustment %.3f", tc.scale, adjust)
+			}
+			continue
+		}
+		if r.Tracks != 1 || math.Abs((1+adjust)*tc.scale-1) > 0.02 {
+			t.Errorf("scale %.3f: adjustment %.3f, %d tracks recovered", tc.scale, adjust, r.Tracks)
+		}
+		if r.Report() == "" {
+			t.Errorf("scale %.3f: no report", tc.scale)
+		}
+	}
+
+	// Unformatted track: attempts are bounded, nothing recovered
+	noise := &FluxTrack{}
+	rng := rand.New(rand.NewSource(2))
+	for pos := uint64(0); pos < 200000000; pos += 4000 + uint64(rng.Intn(4000)) {
+		noise.Transitions = append(noise.Transitions, pos)
+	}
+	r := &SpeedRecovery{}
+	if _, adjust, err := r.DecodeMFM(noise, 250); err != nil || adjust != 0 || r.Tracks != 0 {
+		t.Errorf("noise: adjustment %.3f, error %v", adjust, err)
+	}
+	if r.Weak || r.LockReport() != "" {
+		t.Errorf("noise: lock %+v counted", r.Lock)
+	}
+}
+
+// Drive off by 2.5% with PLL which cannot follow it:
+// nothing at nominal rate, all sectors at the right steps
+func TestSpeedRecovery_Steps(t *testing.T) {
+	cfg := pll.Config{MaxAdjust: 1, PhaseAdjust: 10}
+	for _, tc := range []struct {
+		scale float64 // Time scale of flux
+		good  []int   // Good sectors at steps of recoveryAdjustments
+	}{
+		{1.025, []int{9, 0, 9, 0}}, // Slow drive
+		{0.975, []int{0, 9, 0, 9}}, // Fast drive
+	} {
+		track := scaledFluxTrack(t, tc.scale)
+		bits, err := track.DecodeMFM(250, cfg)
+		if err != nil {
+			t.Fatalf("DecodeMFM failed: %v", err)
+		}
+		if good := countGoodSectors(bits); good != 0 {
+			t.Fatalf("scale %.3f: %d good sectors at nominal rate, test is not representative", tc.scale, good)
+		}
+
+		// Measured rate goes first, then all the steps
+		rates := track.recoveryRates(250)
+		if len(rates) != 1+len(recoveryAdjustments) || math.Abs(rates[0]*tc.scale/250-1) > 0.01 {
+			t.Fatalf("scale %.3f: rates %.1f", tc.scale, rates)
+		}
+		for i, rate := range rates[1:] {
+			if want := 250 * (1 + recoveryAdjustments[i]); rate != want {
+				t.Errorf("scale %.3f: step %d at %.1f kbps, expected %.1f", tc.scale, i, rate, want)
+			}
+			bits, _ := decodeMFM(track.firstRevolution(), rate, cfg)
+			if good := countGoodSectors(bits); good != tc.good[i] {
+				t.Errorf("scale %.3f: %d good sectors at %+.0f%%, expected %d",
+					tc.scale, good, recoveryAdjustments[i]*100, tc.good[i])
+			}
+		}
+
+		r := &SpeedRecovery{PLL: cfg}
+		bits, adjust, err := r.DecodeMFM(track, 250)
+		if err != nil {
+			t.Fatalf("SpeedRecovery.DecodeMFM failed: %v", err)
+		}
+		if good := countGoodSectors(bits); good != 9 || r.Tracks != 1 {
+			t.Errorf("scale %.3f: %d good sectors after recovery, %d tracks recovered", tc.scale, good, r.Tracks)
+		}
+		if math.Abs((1+adjust)*tc.scale-1) > 0.01 {
+			t.Errorf("scale %.3f: adjustment %.3f", tc.scale, adjust)
+		}
+	}
+}
+
+func TestSynthesizeFlux(t *testing.T) {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+	}
+	bits := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+
+	// Without noise: same transitions as the encoder gives
+	for _, bitRate := range []uint16{250, 500, 1000} {
+		want, err := mfm.GenerateFluxTransitions(bits, bitRate)
+		if err != nil {
+			t.Fatalf("GenerateFluxTransitions failed: %v", err)
+		}
+		got := mfm.IntervalsToTransitions(SynthesizeFlux(bits, bitRate, 0, 0))
+		if !slices.Equal(got, want) {
+			t.Errorf("%d kbps: synthesized flux differs from encoder", bitRate)
+		}
+	}
+
+	// Drive 2% fast: revolution is 2% shorter
+	exact := SynthesizeFlux(bits, 250, 0, 0)
+	fast := SynthesizeFlux(bits, 250, 0, 0.02)
+	total := func(intervals []uint64) (sum uint64) {
+		for _, iv := range intervals {
+			sum += iv
+		}
+		return sum
+	}
+	if ratio := float64(total(fast)) / float64(total(exact)); math.Abs(ratio*1.02-1) > 0.0001 {
+		t.Errorf("fast drive: duration ratio %.4f", ratio)
+	}
+
+	// Jitter: deviation of transitions from exact positions
+	noisy := SynthesizeFlux(bits, 250, 100, 0)
+	if len(noisy) != len(exact) {
+		t.Fatalf("%d transitions with jitter, expected %d", len(noisy), len(exact))
+	}
+	a, b := mfm.IntervalsToTransitions(exact), mfm.IntervalsToTransitions(noisy)
+	sum := 0.0
+	for i := range a {
+		d := float64(b[i]) - float64(a[i])
+		sum += d * d
+	}
+	if sigma := math.Sqrt(sum / float64(len(a))); sigma < 90 || sigma > 110 {
+		t.Errorf("jitter %.1f nsec, expected 100", sigma)
+	}
+	if !slices.Equal(noisy, SynthesizeFlux(bits, 250, 100, 0)) {
+		t.Errorf("synthesized flux is not repeatable")
+	}
+}
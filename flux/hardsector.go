@@ -0,0 +1,73 @@
+package flux
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// ErrHardSectored is reported for disks with a hole per sector,
+// which give many index pulses per revolution
+var ErrHardSectored = errors.New("hard-sectored disk")
+
+// More index pulses per nominal revolution mean sector holes
+const maxIndexPerRevolution = 1.5
+
+// HardSectorError tells how many sector holes were found on the disk
+type HardSectorError struct {
+	Holes int // Sector holes per revolution, not counting the index hole
+}
+
+func (e *HardSectorError) Error() string {
+	return fmt.Sprintf("%v with %d sector holes, not supported", ErrHardSectored, e.Holes)
+}
+
+func (e *HardSectorError) Unwrap() error {
+	return ErrHardSectored
+}
+
+// CheckIndex returns HardSectorError when index pulses come more often
+// than once per revolution at the given nominal RPM (300 when 0).
+// Revolutions of such a track are not real, and cannot be decoded.
+func (t *FluxTrack) CheckIndex(nominalRPM int) error {
+	n := len(t.IndexPulses)
+	if n < 2 {
+		return nil
+	}
+	if nominalRPM <= 0 {
+		nominalRPM = 300
+	}
+	revolutionNs := 60e9 / float64(nominalRPM)
+	span := float64(t.IndexPulses[n-1] - t.IndexPulses[0])
+	if float64(n-1)*revolutionNs <= maxIndexPerRevolution*span {
+		return nil
+	}
+	return &HardSectorError{Holes: t.sectorHoles(revolutionNs)}
+}
+
+// Count sector holes per revolution. The index hole sits midway between
+// two sector holes, and splits their interval into two short ones:
+// intervals from one such pair to the next make a revolution. With less
+// than a revolution captured, holes are counted at the nominal speed.
+func (t *FluxTrack) sectorHoles(revolutionNs float64) int {
+	intervals := make([]uint64, len(t.IndexPulses)-1)
+	for i := range intervals {
+		intervals[i] = t.IndexPulses[i+1] - t.IndexPulses[i]
+	}
+	sorted := slices.Clone(intervals)
+	slices.Sort(sorted)
+	median := sorted[len(sorted)/2]
+
+	var pairs []int
+	for i := 0; i+1 < len(intervals); i++ {
+		if intervals[i] < median*3/4 && intervals[i+1] < median*3/4 {
+			pairs = append(pairs, i)
+			i++
+		}
+	}
+	if len(pairs) >= 2 {
+		return pairs[1] - pairs[0] - 1
+	}
+	return int(math.Round(revolutionNs / float64(median)))
+}
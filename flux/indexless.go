@@ -0,0 +1,83 @@
+package flux
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Range of rotation speeds considered when looking for revolution period
+const (
+	minIndexlessRPM = 270
+	maxIndexlessRPM = 400
+)
+
+// Number of flux intervals compared when looking for repetition
+const indexlessWindow = 4000
+
+// SynthesizeIndex estimates duration of a revolution on a track captured
+// without index pulses, and places index pulses at its multiples,
+// starting from time 0. The period is found as the lag at which
+// the sequence of flux intervals repeats itself (autocorrelation).
+// Capture must be longer than one revolution.
+func (t *FluxTrack) SynthesizeIndex() error {
+	n := len(t.Transitions)
+	if n < 2*indexlessWindow {
+		return fmt.Errorf("not enough flux transitions: %d", n)
+	}
+
+	// Quantize intervals to bitcells: the shortest common interval is two cells
+	intervals := make([]uint64, n)
+	prev := uint64(0)
+	for i, tr := range t.Transitions {
+		intervals[i] = tr - prev
+		prev = tr
+	}
+	sorted := slices.Clone(intervals)
+	slices.Sort(sorted)
+	cell := max(sorted[n/10]/2, 1)
+	cells := make([]uint64, n)
+	for i, iv := range intervals {
+		cells[i] = (iv + cell/2) / cell
+	}
+
+	// Compare the first window with windows starting at every transition
+	// within the range of plausible revolution periods
+	minPeriod := uint64(60e9) / maxIndexlessRPM
+	maxPeriod := uint64(60e9) / minIndexlessRPM
+	window := indexlessWindow
+	best, bestMismatches := -1, window/10+1
+	for j := 1; j+window <= n; j++ {
+		lag := t.Transitions[j] - t.Transitions[0]
+		if lag < minPeriod {
+			continue
+		}
+		if lag > maxPeriod {
+			break
+		}
+		mismatches := 0
+		for i := 1; i < window && mismatches < bestMismatches; i++ {
+			if cells[i] != cells[j+i] {
+				mismatches++
+			}
+		}
+		if mismatches < bestMismatches {
+			best, bestMismatches = j, mismatches
+		}
+	}
+	if best < 0 {
+		return fmt.Errorf("flux data does not repeat: cannot find revolution period")
+	}
+
+	// Average distance between matching transitions
+	sum := uint64(0)
+	for i := 0; i < window; i++ {
+		sum += t.Transitions[best+i] - t.Transitions[i]
+	}
+	period := sum / uint64(window)
+
+	t.IndexPulses = nil
+	for pos := uint64(0); pos <= t.Transitions[n-1]; pos += period {
+		t.IndexPulses = append(t.IndexPulses, pos)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package flux
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Maximum number of decodes at adjusted bit rates, per track
+const maxRecoveryAttempts = 5
+
+// Phase error of PLL, relative to bitcell period, above which
+// the lock on a track is weak
+const weakLockQuality = 0.15
+
+// Bit rate adjustments tried after the rate measured from flux intervals
+var recoveryAdjustments = []float64{-0.02, +0.02, -0.04, +0.04}
+
+// SpeedRecovery decodes tracks of one disk, and compensates for drives
+// which spin too fast or too slow. When a track has no CRC-valid IBM PC
+// sectors, or less of them than the best track so far, it is decoded again
+// at alternative bit rates, and the decode with most good sectors is kept.
+//
+// Lock of PLL on every decoded track with sectors is collected
+// for the read report. Unformatted tracks have no lock to speak of.
+type SpeedRecovery struct {
+	PLL pll.Config // Config of PLL for all decodes
+
+	Tracks int     // Number of tracks improved by adjusted bit rate
+	Lock   PLLLock // Lock of PLL on the last decoded track
+	Weak   bool    // Last decoded track has sectors, but PLL hardly followed its flux
+
+	expected  int     // Largest number of good sectors on a track so far
+	adjustSum float64 // Sum of adjustments used for improved tracks
+
+	lockTracks  int        // Number of decoded tracks
+	qualitySum  float64    // Sum of lock quality of all tracks
+	worstLock   float64    // Largest phase error of a track
+	periodRange [2]float64 // Smallest and largest period of a track
+}
+
+// DecodeMFM recovers MFM bitcells of the first revolution, like FluxTrack.DecodeMFM.
+// Returns relative adjustment of bit rate used for the result, or 0 for nominal rate.
+func (r *SpeedRecovery) DecodeMFM(t *FluxTrack, bitRateKbps uint16) ([]byte, float64, error) {
+	best, bestLock, err := t.decodeFirstRevolution(bitRateKbps, r.PLL)
+	if err != nil {
+		return nil, 0, err
+	}
+	bestGood := countGoodSectors(best)
+	bestAdjust := 0.0
+	if bestGood > 0 && bestGood >= r.expected {
+		r.expected = bestGood
+		r.addLock(bestLock, bestGood)
+		return best, 0, nil
+	}
+
+	nominal := float64(bitRateKbps)
+	transitions := t.firstRevolution()
+	for _, rate := range t.recoveryRates(nominal) {
+		bits, lock := decodeMFM(transitions, rate, r.PLL)
+		if good := countGoodSectors(bits); good > bestGood {
+			best, bestGood, bestAdjust, bestLock = bits, good, rate/nominal-1, lock
+		}
+	}
+
+	if bestAdjust != 0 {
+		r.Tracks++
+		r.adjustSum += bestAdjust
+	}
+	r.expected = max(r.expected, bestGood)
+	r.addLock(bestLock, bestGood)
+	return best, bestAdjust, nil
+}
+
+// DecodeRevolutionMFM recovers MFM bitcells of the given revolution,
+// like FluxTrack.DecodeRevolutionMFM, at the bit rate adjusted by the amount
+// which DecodeMFM returned for the track. Rereads of a track are decoded
+// this way, as the drive keeps its speed between them. Revolution 0
+// is decoded like DecodeMFM does, even without index pulses.
+func (r *SpeedRecovery) DecodeRevolutionMFM(t *FluxTrack, rev int, bitRateKbps uint16, adjust float64) ([]byte, error) {
+	rate := float64(bitRateKbps) * (1 + adjust)
+	if rev > 0 {
+		return t.decodeRevolution(rev, rate, r.PLL)
+	}
+	transitions := t.firstRevolution()
+	if len(transitions) == 0 {
+		return nil, fmt.Errorf("no flux transitions found")
+	}
+	if rate <= 0 {
+		return nil, fmt.Errorf("invalid bit rate: %.0f kbps", rate)
+	}
+	bits, _ := decodeMFM(transitions, rate, r.PLL)
+	return bits, nil
+}
+
+// Bit rates to decode the track at, when the nominal rate fails:
+// the rate measured from flux data, then fixed steps around nominal
+func (t *FluxTrack) recoveryRates(nominal float64) []float64 {
+	var rates []float64
+	if measured := t.measureBitRate(nominal); measured > 0 && math.Abs(measured/nominal-1) > 0.01 {
+		rates = append(rates, measured)
+	}
+	for _, adjust := range recoveryAdjustments {
+		rates = append(rates, nominal*(1+adjust))
+	}
+	return rates[:min(len(rates), maxRecoveryAttempts)]
+}
+
+// Remember lock of PLL on the decoded track with the given number of good sectors
+func (r *SpeedRecovery) addLock(lock PLLLock, good int) {
+	r.Lock = lock
+	r.Weak = good > 0 && lock.LockQuality > weakLockQuality
+	if good == 0 {
+		return
+	}
+	if r.lockTracks == 0 {
+		r.periodRange = [2]float64{lock.PeriodNs, lock.PeriodNs}
+	}
+	r.lockTracks++
+	r.qualitySum += lock.LockQuality
+	r.worstLock = max(r.worstLock, lock.LockQuality)
+	r.periodRange[0] = min(r.periodRange[0], lock.PeriodNs)
+	r.periodRange[1] = max(r.periodRange[1], lock.PeriodNs)
+}
+
+// LockReport returns summary of PLL lock on decoded tracks,
+// or empty string when no sectors were found.
+func (r *SpeedRecovery) LockReport() string {
+	if r.lockTracks == 0 {
+		return ""
+	}
+	return fmt.Sprintf("PLL lock: bitcell period %.0f-%.0f ns, phase error %.1f%% RMS on average, %.1f%% at worst.",
+		r.periodRange[0], r.periodRange[1], r.qualitySum/float64(r.lockTracks)*100, r.worstLock*100)
+}
+
+// Adjustment returns average relative adjustment of bit rate
+// on improved tracks, or 0 when no tracks were improved.
+func (r *SpeedRecovery) Adjustment() float64 {
+	if r.Tracks == 0 {
+		return 0
+	}
+	return r.adjustSum / float64(r.Tracks)
+}
+
+// Report returns summary of recovery for the user, or empty string.
+func (r *SpeedRecovery) Report() string {
+	if r.Tracks == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Recovered %d tracks at adjusted bit rate: drive speed is off by about %+.1f%%.",
+		r.Tracks, r.Adjustment()*100)
+}
+
+// Estimate bit rate in kbps from the most frequent flux interval, which
+// for MFM is the shortest one: two bitcells, or one data bit.
+// Only intervals within 30% of the nominal rate are considered.
+// Returns 0 when the histogram has no clear peak.
+func (t *FluxTrack) measureBitRate(nominalKbps float64) float64 {
+	const binNs = 25
+	bitNs := 1e6 / nominalKbps
+	lo, hi := uint64(bitNs*0.7), uint64(bitNs*1.3)
+	histogram := make([]int, (hi-lo)/binNs+1)
+	prev := uint64(0)
+	for _, tr := range t.firstRevolution() {
+		if iv := tr - prev; iv >= lo && iv <= hi {
+			histogram[(iv-lo)/binNs]++
+		}
+		prev = tr
+	}
+	peak := 0
+	for i, n := range histogram {
+		if n > histogram[peak] {
+			peak = i
+		}
+	}
+	if histogram[peak] == 0 {
+		return 0
+	}
+
+	// Center of the peak, weighted over neighbouring bins
+	sum, count := 0.0, 0
+	for i := max(peak-2, 0); i <= min(peak+2, len(histogram)-1); i++ {
+		sum += (float64(lo) + (float64(i)+0.5)*binNs) * float64(histogram[i])
+		count += histogram[i]
+	}
+	return 1e6 / (sum / float64(count))
+}
+
+// Count distinct IBM PC sectors with good checksum, regardless of their IDs
+func countGoodSectors(bits []byte) int {
+	reader := mfm.NewReader(bits)
+	reader.Tolerance = mfm.IDIgnoreCylHead
+	found := make(map[int]bool)
+	for {
+		sector, err := reader.ReadSectorInfoIBMPC(0, 0)
+		if err != nil {
+			break
+		}
+		if !sector.Bad {
+			found[sector.Sector] = true
+		}
+	}
+	return len(found)
+}
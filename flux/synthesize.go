@@ -0,0 +1,49 @@
+package flux
+
+import (
+	"math"
+	"math/rand"
+)
+
+// SynthesizeFlux converts MFM bitcells, packed MSB-first, to intervals between
+// flux transitions in nanoseconds, like a drive would write them and read back.
+// Every transition is displaced by Gaussian noise with standard deviation
+// jitterNs, and the drive spins rpmError faster than nominal: for example
+// 0.02 means 2% fast, and all intervals are 2% shorter. Noise is generated
+// from a fixed seed, so the same input gives the same flux.
+// Use IntervalsToTransitions of package mfm to get transition times.
+func SynthesizeFlux(mfmBitcells []byte, bitRateKhz uint16, jitterNs float64, rpmError float64) []uint64 {
+	return SynthesizeFluxSeed(mfmBitcells, bitRateKhz, jitterNs, rpmError, 1)
+}
+
+// SynthesizeFluxSeed is SynthesizeFlux with noise from the given seed:
+// revolutions of one track synthesized with different seeds have
+// independent jitter, like on a real drive.
+func SynthesizeFluxSeed(mfmBitcells []byte, bitRateKhz uint16, jitterNs float64, rpmError float64, seed int64) []uint64 {
+	if bitRateKhz == 0 || rpmError <= -1 {
+		return nil
+	}
+	rng := rand.New(rand.NewSource(seed))
+	cellNs := 1e6 / (2 * float64(bitRateKhz)) / (1 + rpmError)
+
+	var intervals []uint64
+	last := uint64(0)
+	for i := 0; i < len(mfmBitcells)*8; i++ {
+		if mfmBitcells[i/8]&(0x80>>(i%8)) == 0 {
+			continue
+		}
+		t := float64(i+1) * cellNs
+		if jitterNs > 0 {
+			t += rng.NormFloat64() * jitterNs
+		}
+
+		// Noise never reorders transitions
+		pos := uint64(math.Max(math.Round(t), 0))
+		if pos <= last {
+			pos = last + 1
+		}
+		intervals = append(intervals, pos-last)
+		last = pos
+	}
+	return intervals
+}
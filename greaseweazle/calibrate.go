@@ -0,0 +1,48 @@
+package greaseweazle
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sergev/floppy/config"
+)
+
+// Calibrate applies the seek profile of the drive, verifies the track 0 sensor,
+// and times a full-stroke seek to the last track and back.
+func (c *Client) Calibrate() error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	err := c.SelectDrive(c.drive)
+	if err != nil {
+		return fmt.Errorf("failed to select drive: %w", err)
+	}
+
+	// Apply step delay and settle time from the drive profile
+	err = c.applyDriveProfile()
+	if err != nil {
+		return fmt.Errorf("failed to set drive parameters: %w", err)
+	}
+
+	// Seek to track 0: the device reports an error when TRK0 is not detected
+	err = c.Seek(0)
+	if err != nil {
+		return fmt.Errorf("failed to seek to track 0: %w", err)
+	}
+
+	// Long seek to the last track and back
+	maxCyl := config.Cyls - 1
+	start := time.Now()
+	err = c.Seek(byte(maxCyl))
+	if err != nil {
+		return fmt.Errorf("failed to seek to track %d: %w", maxCyl, err)
+	}
+	err = c.Seek(0)
+	if err != nil {
+		return fmt.Errorf("failed to return to track 0: %w", err)
+	}
+	fmt.Printf("Seek Time: %d msec for %d tracks and back\n", time.Since(start).Milliseconds(), maxCyl)
+	return nil
+}
@@ -0,0 +1,99 @@
+package greaseweazle
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DriveInfo contains drive state from GETINFO_DRIVE response
+type DriveInfo struct {
+	Flags    uint32 // GW_DF_* flags
+	Cylinder int32  // Current cylinder, valid when GW_DF_CYL_VALID is set
+}
+
+// CylValid returns true when the drive knows position of the head
+func (d DriveInfo) CylValid() bool {
+	return d.Flags&GW_DF_CYL_VALID != 0
+}
+
+// MotorOn returns true when the motor of the drive is running
+func (d DriveInfo) MotorOn() bool {
+	return d.Flags&GW_DF_MOTOR_ON != 0
+}
+
+// IsFlippy returns true for a single-head drive, where the disk
+// must be flipped over to read the other side
+func (d DriveInfo) IsFlippy() bool {
+	return d.Flags&GW_DF_IS_FLIPPY != 0
+}
+
+// FetchDriveInfo retrieves state of the given drive: 0 or 1.
+// Older firmware does not support this request, and returns an error.
+func (c *Client) FetchDriveInfo(drive byte) (DriveInfo, error) {
+	var info DriveInfo
+	if drive > 1 {
+		return info, fmt.Errorf("invalid drive number: %d", drive)
+	}
+
+	// Send CMD_GET_INFO command: [CMD_GET_INFO, length=3, GETINFO_DRIVE(drive)]
+	cmd := []byte{CMD_GET_INFO, 3, GETINFO_DRIVE_0 + drive}
+	err := c.doCommand(cmd)
+	if err != nil {
+		return info, fmt.Errorf("failed to send GET_INFO DRIVE command: %w", err)
+	}
+
+	// Read 32-byte response
+	response := make([]byte, 32)
+	err = c.receive("GET_INFO DRIVE", response)
+	if err != nil {
+		return info, fmt.Errorf("failed to read DRIVE response: %w", err)
+	}
+
+	// Parse fields according to packed struct layout:
+	// bytes 0-3: flags (uint32, little-endian)
+	// bytes 4-7: cyl (int32, little-endian)
+	info.Flags = binary.LittleEndian.Uint32(response[0:4])
+	info.Cylinder = int32(binary.LittleEndian.Uint32(response[4:8]))
+	return info, nil
+}
+
+// Check whether the selected drive is flippy. Unknown drive info means no.
+func (c *Client) isFlippy() bool {
+	info, err := c.FetchDriveInfo(c.drive)
+	return err == nil && info.IsFlippy()
+}
+
+// Compare cylinder reported by the selected drive with the one we have seeked to
+func (c *Client) checkCylinder(cyl int) {
+	info, err := c.FetchDriveInfo(c.drive)
+	if err != nil || !info.CylValid() {
+		return
+	}
+	if int(info.Cylinder) != cyl {
+		fmt.Printf("\nWarning: drive reports cylinder %d, expected %d\n", info.Cylinder, cyl)
+	}
+}
+
+// PrintDriveInfo prints state of both drives
+func (c *Client) PrintDriveInfo() {
+	for drive := byte(0); drive <= 1; drive++ {
+		info, err := c.FetchDriveInfo(drive)
+		if err != nil {
+			// Not supported by firmware
+			return
+		}
+		cyl := "unknown"
+		if info.CylValid() {
+			cyl = fmt.Sprintf("%d", info.Cylinder)
+		}
+		motor := "off"
+		if info.MotorOn() {
+			motor = "on"
+		}
+		fmt.Printf("Drive %d: cylinder %s, motor %s", drive, cyl, motor)
+		if info.IsFlippy() {
+			fmt.Printf(", flippy")
+		}
+		fmt.Printf("\n")
+	}
+}
@@ -3,25 +3,36 @@ package greaseweazle
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
 
+	"github.com/sergev/floppy/adapter"
 	"github.com/sergev/floppy/config"
 )
 
 // Erase erases all tracks on the floppy disk
 // The erase operation writes a DC erase pattern for 200 seconds per track to ensure complete erasure
 // This method iterates over all cylinders (82 tracks) and heads (2 sides), following the same pattern as Read()
-func (c *Client) Erase(numberOfTracks int) error {
-	// Select drive 0 and turn on motor
-	err := c.SelectDrive(0)
+func (c *Client) Erase(numberOfCylinders int) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+	if !c.Capabilities().CanErase {
+		return fmt.Errorf("erase %w by firmware %d.%d", adapter.ErrNotSupported, c.firmwareInfo.FwMajor, c.firmwareInfo.FwMinor)
+	}
+
+	// Select the drive and turn on motor
+	err := c.SelectDrive(c.drive)
 	if err != nil {
 		return fmt.Errorf("failed to select drive: %w", err)
 	}
-	err = c.SetMotor(0, true)
+	err = c.checkWritable()
+	if err != nil {
+		return err
+	}
+	err = c.startMotor()
 	if err != nil {
-		return fmt.Errorf("failed to turn on motor: %w", err)
+		return err
 	}
-	defer c.SetMotor(0, false) // Turn off motor when done
 
 	// Calculate clock period in nanoseconds from sample frequency
 	// clock_period_ns = 1e9 / sample_freq_hz
@@ -38,7 +49,7 @@ func (c *Client) Erase(numberOfTracks int) error {
 	binary.LittleEndian.PutUint32(cmd[2:6], ticks)
 
 	// Iterate through all cylinders and heads (same as Read())
-	for cyl := 0; cyl < numberOfTracks; cyl++ {
+	for cyl := 0; cyl < numberOfCylinders; cyl++ {
 		for head := 0; head < config.Heads; head++ {
 			// Print progress message
 			if cyl != 0 || head != 0 {
@@ -68,7 +79,7 @@ func (c *Client) Erase(numberOfTracks int) error {
 			// Read synchronization byte (returned when erase operation completes)
 			// Value 0 indicates success
 			syncByte := make([]byte, 1)
-			_, err = io.ReadFull(c.port, syncByte)
+			err = c.receive("ERASE_FLUX done", syncByte)
 			if err != nil {
 				return fmt.Errorf("failed to read erase synchronization byte for cylinder %d, head %d: %w", cyl, head, err)
 			}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"time"
 
 	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
 
 	"go.bug.st/serial"
 	"go.bug.st/serial/enumerator"
@@ -51,6 +53,11 @@ const (
 	GETINFO_DRIVE_1       = 9 // GETINFO_DRIVE(1)
 )
 
+// SET_PARAMS/GET_PARAMS indices
+const (
+	PARAMS_DELAYS = 0
+)
+
 // Drive info flags
 const (
 	GW_DF_CYL_VALID = 1 << 0 // _GW_DF_cyl_valid
@@ -90,11 +97,24 @@ const (
 	BUS_SHUGART = 2
 )
 
+// Port is the serial transport used to talk to the device.
+// It is implemented by serial.Port, and can be replaced by a fake in tests.
+type Port interface {
+	io.ReadWriteCloser
+	SetMode(mode *serial.Mode) error
+	SetReadTimeout(t time.Duration) error
+}
+
 // Client wraps a serial port connection to a Greaseweazle device
 type Client struct {
-	port         serial.Port
+	port         Port
 	firmwareInfo FirmwareInfo
 	serialNumber string
+	drive        byte                 // Drive unit on the bus, see SetDrive
+	openPort     func() (Port, error) // Reopen the port after device reset
+	busy         adapter.Busy         // One operation at a time
+	motor        adapter.Motor        // Left running between operations, see startMotor
+	fluxBuf      []byte               // Flux data of the last ReadFlux, reused between tracks
 }
 
 func init() {
@@ -114,44 +134,64 @@ func NewClient(portDetails *enumerator.PortDetails) (adapter.FloppyAdapter, erro
 		return nil, fmt.Errorf("failed to open serial port %s: %w", portDetails.Name, err)
 	}
 
+	client, err := newClient(port, portDetails.SerialNumber)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	client.openPort = func() (Port, error) {
+		// Port name may change when the device is enumerated again
+		return serial.Open(adapter.FindSerialPort(portDetails.SerialNumber, portDetails.Name), mode)
+	}
+	return client, nil
+}
+
+// newClient initializes the device connected via the given port.
+// The port is not closed on failure.
+func newClient(port Port, serialNumber string) (*Client, error) {
 	client := &Client{
 		port:         port,
-		serialNumber: portDetails.SerialNumber,
+		serialNumber: serialNumber,
 	}
+	client.keepMotor()
 
 	// Fetch firmware version during initialization
 	fwInfo, err := client.fetchFirmwareVersion()
 	if err != nil {
-		port.Close()
 		return nil, fmt.Errorf("failed to fetch firmware version: %w", err)
 	}
 	client.firmwareInfo = fwInfo
+	if err := fwInfo.checkCompatible(); err != nil {
+		return nil, err
+	}
 
 	/* Twiddle the baud rate, which indicates to the Greaseweazle that the
 	 * data stream has been reset. */
 	err = port.SetMode(&serial.Mode{BaudRate: 10000})
 	if err != nil {
-		port.Close()
 		return nil, fmt.Errorf("failed to set baud rate to 10000: %w", err)
 	}
 	time.Sleep(100 * time.Millisecond)
 	err = port.SetMode(&serial.Mode{BaudRate: 9600})
 	if err != nil {
-		port.Close()
 		return nil, fmt.Errorf("failed to set baud rate to 9600: %w", err)
 	}
 
 	/* Configure the hardware. */
 	err = client.SetBusType()
 	if err != nil {
-		port.Close()
 		return nil, fmt.Errorf("failed to set bus type: %w", err)
 	}
+	err = client.SetDrive(config.Unit)
+	if err != nil {
+		return nil, err
+	}
 
 	return client, nil
 }
 
-// ackError converts an ACK error code to a readable error message
+// ackError converts an ACK error code to a readable error message.
+// Codes with a generic meaning wrap the corresponding adapter error.
 func ackError(code byte) error {
 	msg := "unknown error"
 	switch code {
@@ -160,15 +200,15 @@ func ackError(code byte) error {
 	case ACK_BAD_COMMAND:
 		msg = "bad command"
 	case ACK_NO_INDEX:
-		msg = "no index"
+		return fmt.Errorf("Greaseweazle error: %w", adapter.ErrNoIndex)
 	case ACK_NO_TRK0:
-		msg = "no track 0"
+		return fmt.Errorf("Greaseweazle error: %w", adapter.ErrNoTrack0)
 	case ACK_FLUX_OVERFLOW:
-		msg = "overflow"
+		return fmt.Errorf("Greaseweazle error: %w", adapter.ErrOverflow)
 	case ACK_FLUX_UNDERFLOW:
-		msg = "underflow"
+		return fmt.Errorf("Greaseweazle error: %w", adapter.ErrUnderflow)
 	case ACK_WRPROT:
-		msg = "write protected"
+		return fmt.Errorf("Greaseweazle error: %w", adapter.ErrWriteProtected)
 	case ACK_NO_UNIT:
 		msg = "no unit"
 	case ACK_NO_BUS:
@@ -176,9 +216,9 @@ func ackError(code byte) error {
 	case ACK_BAD_UNIT:
 		msg = "invalid unit"
 	case ACK_BAD_PIN:
-		msg = "invalid pin"
+		return fmt.Errorf("Greaseweazle error: %w", ErrBadPin)
 	case ACK_BAD_CYLINDER:
-		msg = "invalid track"
+		return fmt.Errorf("Greaseweazle error: %w", adapter.ErrBadCylinder)
 	}
 	return fmt.Errorf("Greaseweazle error: %s", msg)
 }
@@ -186,16 +226,17 @@ func ackError(code byte) error {
 // doCommand sends a command and reads the ACK response
 func (c *Client) doCommand(cmd []byte) error {
 	// Send command
-	_, err := c.port.Write(cmd)
+	name := commandName(cmd[0])
+	err := c.send(name, cmd)
 	if err != nil {
-		return fmt.Errorf("failed to write command: %w", err)
+		return fmt.Errorf("failed to write command: %w", adapter.SerialError(err))
 	}
 
 	// Read ACK response (2 bytes: command echo, status)
 	ack := make([]byte, 2)
-	_, err = io.ReadFull(c.port, ack)
+	err = c.receive(name+" ACK", ack)
 	if err != nil {
-		return fmt.Errorf("failed to read ACK: %w", err)
+		return fmt.Errorf("failed to read ACK: %w", adapter.SerialError(err))
 	}
 
 	// Validate command echo matches
@@ -250,11 +291,16 @@ func (c *Client) fetchFirmwareVersion() (FirmwareInfo, error) {
 
 	// Read 32-byte response
 	response := make([]byte, 32)
-	_, err = io.ReadFull(c.port, response)
+	err = c.receive("GET_INFO FIRMWARE", response)
 	if err != nil {
 		return info, fmt.Errorf("failed to read response: %w", err)
 	}
+	return parseFirmwareInfo(response), nil
+}
 
+// parseFirmwareInfo decodes GET_INFO firmware response.
+// Fields added by newer firmware are zero in responses of older one.
+func parseFirmwareInfo(response []byte) FirmwareInfo {
 	// Parse all fields according to packed struct layout:
 	// byte 0: fw_major (uint8)
 	// byte 1: fw_minor (uint8)
@@ -268,6 +314,8 @@ func (c *Client) fetchFirmwareVersion() (FirmwareInfo, error) {
 	// bytes 12-13: mcu_mhz (uint16, little-endian)
 	// bytes 14-15: mcu_sram_kb (uint16, little-endian)
 	// bytes 16-17: usb_buf_kb (uint16, little-endian)
+	// bytes 18-31: reserved, no firmware release defines them
+	var info FirmwareInfo
 	info.FwMajor = response[0]
 	info.FwMinor = response[1]
 	info.IsMainFirmware = response[2] != 0
@@ -280,8 +328,7 @@ func (c *Client) fetchFirmwareVersion() (FirmwareInfo, error) {
 	info.MCUMhz = binary.LittleEndian.Uint16(response[12:14])
 	info.MCUSRAMKB = binary.LittleEndian.Uint16(response[14:16])
 	info.USBBufKB = binary.LittleEndian.Uint16(response[16:18])
-
-	return info, nil
+	return info
 }
 
 // Seek moves the read/write head to the specified cylinder
@@ -302,6 +349,37 @@ func (c *Client) SelectDrive(drive byte) error {
 	return c.doCommand(cmd)
 }
 
+// DeselectDrive deselects the current unit
+func (c *Client) DeselectDrive() error {
+	cmd := []byte{CMD_DESELECT, 2}
+	return c.doCommand(cmd)
+}
+
+// SetDrive sets drive unit for subsequent operations.
+// IBM PC bus has two units: 0 for drive A and 1 for drive B.
+// Motor of the previous unit is turned off.
+func (c *Client) SetDrive(unit int) error {
+	if unit < 0 || unit >= busUnits(BUS_IBMPC) {
+		return fmt.Errorf("invalid drive unit: %d (IBM PC bus has units 0 and 1)", unit)
+	}
+	if byte(unit) != c.drive {
+		c.motor.Off()
+	}
+	c.drive = byte(unit)
+	return nil
+}
+
+// Number of drive units on the bus of the given type
+func busUnits(bus byte) int {
+	switch bus {
+	case BUS_IBMPC:
+		return 2
+	case BUS_SHUGART:
+		return 4
+	}
+	return 0
+}
+
 // SetMotor turns the drive motor on or off
 func (c *Client) SetMotor(drive byte, on bool) error {
 	var motorState byte = 0
@@ -318,8 +396,9 @@ func (c *Client) GetFluxStatus() error {
 	return c.doCommand(cmd)
 }
 
-// Reset to initial state
+// Reset to initial state, with drives deselected and motors off
 func (c *Client) Reset() error {
+	c.motor.SetRunning(false)
 	cmd := []byte{CMD_RESET, 2}
 	return c.doCommand(cmd)
 }
@@ -330,7 +409,24 @@ func (c *Client) SetBusType() error {
 	return c.doCommand(cmd)
 }
 
-// Format formats the floppy disk
+// Format is not supported: disks are formatted by writing an image
 func (c *Client) Format() error {
-	return fmt.Errorf("Format() not yet implemented for Greaseweazle adapter")
+	return fmt.Errorf("format %w", adapter.ErrNotSupported)
+}
+
+// Capabilities reports what the adapter can do. Older firmware
+// lacks newer commands, as told by the highest command it knows.
+func (c *Client) Capabilities() adapter.Capability {
+	fw := &c.firmwareInfo
+	return adapter.Capability{
+		CanRead:               fw.MaxCmd >= CMD_READ_FLUX,
+		CanWrite:              fw.MaxCmd >= CMD_WRITE_FLUX,
+		CanWriteFlux:          fw.MaxCmd >= CMD_WRITE_FLUX,
+		CanErase:              fw.MaxCmd >= CMD_ERASE_FLUX,
+		MaxRevolutions:        math.MaxUint16, // Index pulses counted by READ_FLUX
+		SupportsDensitySelect: fw.MaxCmd >= CMD_SET_PIN,
+		SensesDiskChange:      fw.MaxCmd >= CMD_GET_PIN,
+		SensesWriteProtect:    fw.MaxCmd >= CMD_GET_PIN,
+		MaxCylinders:          config.MaxCyls,
+	}
 }
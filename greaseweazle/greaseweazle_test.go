@@ -0,0 +1,1038 @@
+package greaseweazle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/hfe"
+	"go.bug.st/serial"
+)
+
+// fakePort is an in-memory serial port replaying canned device responses.
+type fakePort struct {
+	rx    bytes.Buffer // Data to be returned by the device
+	tx    bytes.Buffer // Data sent by the host
+	modes []int        // Baud rates set by the host
+}
+
+func (p *fakePort) Read(buf []byte) (int, error) {
+	if p.rx.Len() == 0 {
+		return 0, io.EOF
+	}
+	// Like the device, pause after end of flux stream:
+	// the next reply is only sent after the next command
+	if end := bytes.IndexByte(p.rx.Bytes(), 0); end >= 0 && end < len(buf) {
+		buf = buf[:end+1]
+	}
+	return p.rx.Read(buf)
+}
+
+func (p *fakePort) Write(buf []byte) (int, error) {
+	return p.tx.Write(buf)
+}
+
+func (p *fakePort) Close() error {
+	return nil
+}
+
+func (p *fakePort) SetMode(mode *serial.Mode) error {
+	p.modes = append(p.modes, mode.BaudRate)
+	return nil
+}
+
+func (p *fakePort) SetReadTimeout(t time.Duration) error {
+	return nil
+}
+
+// Build a GET_INFO firmware response.
+func makeFirmwareInfo(major, minor, model uint8, sampleFreq uint32) []byte {
+	info := make([]byte, 32)
+	info[0] = major
+	info[1] = minor
+	info[2] = 1 // main firmware
+	info[3] = CMD_GET_PIN
+	binary.LittleEndian.PutUint32(info[4:8], sampleFreq)
+	info[8] = model
+	info[10] = 1 // high speed USB
+	binary.LittleEndian.PutUint16(info[16:18], 32)
+	return info
+}
+
+func TestNewClient_GetInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		rx      [][]byte
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			rx: [][]byte{
+				{CMD_GET_INFO, ACK_OKAY},
+				makeFirmwareInfo(1, 5, 4, 72000000),
+				{CMD_SET_BUS_TYPE, ACK_OKAY},
+			},
+		},
+		{
+			name:    "bad command",
+			rx:      [][]byte{{CMD_GET_INFO, ACK_BAD_COMMAND}},
+			wantErr: true,
+		},
+		{
+			name:    "garbage echo",
+			rx:      [][]byte{{0x55, ACK_OKAY}},
+			wantErr: true,
+		},
+		{
+			name:    "truncated response",
+			rx:      [][]byte{{CMD_GET_INFO, ACK_OKAY}, {1, 5, 1}},
+			wantErr: true,
+		},
+		{
+			name: "no bus",
+			rx: [][]byte{
+				{CMD_GET_INFO, ACK_OKAY},
+				makeFirmwareInfo(1, 5, 4, 72000000),
+				{CMD_SET_BUS_TYPE, ACK_NO_BUS},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			port := &fakePort{}
+			for _, r := range tc.rx {
+				port.rx.Write(r)
+			}
+
+			client, err := newClient(port, "TEST")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("newClient() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newClient() error: %v", err)
+			}
+
+			// Verify command bytes sent to the device
+			want := []byte{CMD_GET_INFO, 3, GETINFO_FIRMWARE, CMD_SET_BUS_TYPE, 3, BUS_IBMPC}
+			if !bytes.Equal(port.tx.Bytes(), want) {
+				t.Errorf("sent % x, expected % x", port.tx.Bytes(), want)
+			}
+			if len(port.modes) != 2 || port.modes[0] != 10000 || port.modes[1] != 9600 {
+				t.Errorf("baud rate sequence %v, expected [10000 9600]", port.modes)
+			}
+
+			info := client.firmwareInfo
+			if info.FwMajor != 1 || info.FwMinor != 5 || !info.IsMainFirmware {
+				t.Errorf("firmware version %d.%d main=%v", info.FwMajor, info.FwMinor, info.IsMainFirmware)
+			}
+			if info.SampleFreqHz != 72000000 || info.HwModel != 4 || info.USBBufKB != 32 {
+				t.Errorf("unexpected firmware info %+v", info)
+			}
+		})
+	}
+}
+
+// Queue READ_FLUX and GET_FLUX_STATUS responses with revolutions
+// of given duration in msec, and no transitions.
+func writeRevolutions(port *fakePort, sampleFreq uint32, msecs ...uint32) {
+	port.rx.Write([]byte{CMD_READ_FLUX, ACK_OKAY})
+	port.rx.Write([]byte{0xFF, FLUXOP_INDEX})
+	port.rx.Write(encodeN28(0))
+	for _, msec := range msecs {
+		port.rx.Write([]byte{0xFF, FLUXOP_SPACE})
+		port.rx.Write(encodeN28(msec * (sampleFreq / 1000)))
+		port.rx.Write([]byte{0xFF, FLUXOP_INDEX})
+		port.rx.Write(encodeN28(0))
+	}
+	port.rx.WriteByte(0)
+	port.rx.Write([]byte{CMD_GET_FLUX_STATUS, ACK_OKAY})
+}
+
+// Queue responses to spin-up check: two polls with stable rotation
+func writeSpinUp(port *fakePort, sampleFreq uint32) {
+	writeRevolutions(port, sampleFreq, 200)
+	writeRevolutions(port, sampleFreq, 200)
+}
+
+func TestMeasureRPM(t *testing.T) {
+	const sampleFreq = 72000000
+	port := &fakePort{}
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_HEAD, ACK_OKAY, CMD_MOTOR, ACK_OKAY})
+	writeSpinUp(port, sampleFreq)
+
+	// Three revolutions of 200, 201 and 199 msec, with no transitions
+	port.rx.Write([]byte{CMD_READ_FLUX, ACK_OKAY})
+	port.rx.Write([]byte{0xFF, FLUXOP_INDEX})
+	port.rx.Write(encodeN28(0))
+	for _, msec := range []uint32{200, 201, 199} {
+		port.rx.Write([]byte{0xFF, FLUXOP_SPACE})
+		port.rx.Write(encodeN28(msec * (sampleFreq / 1000)))
+		port.rx.Write([]byte{0xFF, FLUXOP_INDEX})
+		port.rx.Write(encodeN28(0))
+	}
+	port.rx.WriteByte(0)
+	port.rx.Write([]byte{CMD_GET_FLUX_STATUS, ACK_OKAY})
+
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+	mean, stddev, err := c.MeasureRPM(3)
+	if err != nil {
+		t.Fatalf("MeasureRPM() error: %v", err)
+	}
+	wantMean := (60e3/200 + 60e3/201 + 60e3/199) / 3
+	if mean < wantMean-0.01 || mean > wantMean+0.01 {
+		t.Errorf("mean = %.3f RPM, expected %.3f", mean, wantMean)
+	}
+	if stddev < 1.2 || stddev > 1.3 {
+		t.Errorf("stddev = %.3f RPM, expected about 1.23", stddev)
+	}
+
+	// READ_FLUX must ask for one more index pulse than revolutions,
+	// after two polls of spin-up check
+	cmd := port.tx.Bytes()[30:38]
+	if cmd[0] != CMD_READ_FLUX || binary.LittleEndian.Uint16(cmd[6:8]) != 4 {
+		t.Errorf("READ_FLUX command % x, expected maxIndex 4", cmd)
+	}
+}
+
+func TestDriveUnit(t *testing.T) {
+	const sampleFreq = 72000000
+	port := &fakePort{}
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+	if err := c.SetDrive(2); err == nil {
+		t.Errorf("SetDrive(2) accepted unit not present on IBM PC bus")
+	}
+	if err := c.SetDrive(1); err != nil {
+		t.Fatalf("SetDrive(1) error: %v", err)
+	}
+
+	c.keepMotor()
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_HEAD, ACK_OKAY, CMD_MOTOR, ACK_OKAY})
+	writeSpinUp(port, sampleFreq)
+	writeRevolutions(port, sampleFreq, 200)
+	port.rx.Write([]byte{CMD_MOTOR, ACK_OKAY, CMD_DESELECT, ACK_OKAY})
+	if _, _, err := c.MeasureRPM(1); err != nil {
+		t.Fatalf("MeasureRPM() error: %v", err)
+	}
+	if err := c.StopMotor(); err != nil {
+		t.Fatalf("StopMotor() error: %v", err)
+	}
+
+	// Unit 1 is selected, and its motor is turned on and off
+	sent := port.tx.Bytes()
+	if !bytes.HasPrefix(sent, []byte{CMD_SELECT, 3, 1, CMD_HEAD, 3, 0, CMD_MOTOR, 4, 1, 1}) {
+		t.Errorf("sent % x, expected select and motor on of unit 1", sent)
+	}
+	if !bytes.HasSuffix(sent, []byte{CMD_MOTOR, 4, 1, 0, CMD_DESELECT, 2}) {
+		t.Errorf("sent % x, expected motor off of unit 1", sent)
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	defer func(cyls, stepDelay, settle int) {
+		config.Cyls, config.StepDelay, config.Settle = cyls, stepDelay, settle
+	}(config.Cyls, config.StepDelay, config.Settle)
+	config.Cyls, config.StepDelay, config.Settle = 80, 6000, 25
+
+	t.Run("ok", func(t *testing.T) {
+		port := &fakePort{}
+		port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_GET_PARAMS, ACK_OKAY})
+		port.rx.Write(DriveParams{10, 3000, 15, 750, 10000}.marshal())
+		port.rx.Write([]byte{CMD_SET_PARAMS, ACK_OKAY, CMD_GET_PARAMS, ACK_OKAY})
+		port.rx.Write(DriveParams{10, 6000, 25, 750, 10000}.marshal())
+		port.rx.Write([]byte{CMD_SEEK, ACK_OKAY, CMD_SEEK, ACK_OKAY, CMD_SEEK, ACK_OKAY})
+
+		c := &Client{port: port}
+		if err := c.Calibrate(); err != nil {
+			t.Fatalf("Calibrate() error: %v", err)
+		}
+
+		// SET_PARAMS must keep motor delay and update step delay and settle time
+		want := []byte{CMD_SET_PARAMS, 13, PARAMS_DELAYS,
+			0x0a, 0x00, 0x70, 0x17, 0x19, 0x00, 0xee, 0x02, 0x10, 0x27}
+		sent := port.tx.Bytes()
+		if !bytes.Contains(sent, want) {
+			t.Errorf("sent % x, expected SET_PARAMS % x", sent, want)
+		}
+		if !bytes.HasSuffix(sent, []byte{CMD_SEEK, 3, 0, CMD_SEEK, 3, 79, CMD_SEEK, 3, 0}) {
+			t.Errorf("sent % x, expected seeks to 0, 79 and 0", sent)
+		}
+	})
+
+	t.Run("no track 0", func(t *testing.T) {
+		config.StepDelay, config.Settle = 0, 0
+		port := &fakePort{}
+		port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_SEEK, ACK_NO_TRK0})
+
+		c := &Client{port: port}
+		err := c.Calibrate()
+		if !errors.Is(err, adapter.ErrNoTrack0) {
+			t.Errorf("Calibrate() error = %v, expected no track 0", err)
+		}
+	})
+}
+
+func TestAckError(t *testing.T) {
+	tests := []struct {
+		code byte
+		want error
+	}{
+		{ACK_NO_INDEX, adapter.ErrNoIndex},
+		{ACK_NO_TRK0, adapter.ErrNoTrack0},
+		{ACK_FLUX_OVERFLOW, adapter.ErrOverflow},
+		{ACK_FLUX_UNDERFLOW, adapter.ErrUnderflow},
+		{ACK_WRPROT, adapter.ErrWriteProtected},
+		{ACK_BAD_PIN, ErrBadPin},
+		{ACK_BAD_CYLINDER, adapter.ErrBadCylinder},
+	}
+	for _, tc := range tests {
+		port := &fakePort{}
+		port.rx.Write([]byte{CMD_SEEK, tc.code})
+		c := &Client{port: port}
+
+		err := c.Seek(0)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("ACK code %d: error = %v, expected %v", tc.code, err, tc.want)
+		}
+	}
+
+	if err := ackError(ACK_BAD_COMMAND); err == nil || adapter.IsRetryable(err) {
+		t.Errorf("ackError(ACK_BAD_COMMAND) = %v, expected fatal error", err)
+	}
+}
+
+func TestWriteProtected(t *testing.T) {
+	defer func(stepDelay, settle, motorDelay int) {
+		config.StepDelay, config.Settle, config.MotorDelay = stepDelay, settle, motorDelay
+	}(config.StepDelay, config.Settle, config.MotorDelay)
+	config.StepDelay, config.Settle, config.MotorDelay = 0, 0, 0
+
+	port := &fakePort{}
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_MOTOR, ACK_OKAY})
+	writeRevolutions(port, 72000000, 200)
+	writeRevolutions(port, 72000000, 200)
+	port.rx.Write([]byte{CMD_SEEK, ACK_OKAY, CMD_HEAD, ACK_OKAY})
+	port.rx.Write([]byte{CMD_WRITE_FLUX, ACK_WRPROT})
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: 72000000}}
+
+	disk := &hfe.Disk{
+		Header: hfe.Header{NumberOfTrack: 1, NumberOfSide: 1, BitRate: 500, FloppyRPM: 300, WriteAllowed: 0xFF},
+		Tracks: []hfe.TrackData{{Side0: bytes.Repeat([]byte{0x92, 0x54}, 100)}},
+	}
+	err := c.Write(disk, 1)
+	var trackErr *adapter.TrackError
+	if !errors.As(err, &trackErr) || trackErr.Cyl != 0 || trackErr.Head != 0 {
+		t.Fatalf("Write() error = %v, expected TrackError at 0.0", err)
+	}
+	if !errors.Is(err, adapter.ErrWriteProtected) {
+		t.Errorf("Write() error = %v, expected write protected", err)
+	}
+}
+
+func TestWaitSpinUp(t *testing.T) {
+	const sampleFreq = 72000000
+	defer func(spinUp int) { config.SpinUp = spinUp }(config.SpinUp)
+
+	t.Run("stable", func(t *testing.T) {
+		config.SpinUp = 0
+		port := &fakePort{}
+		writeRevolutions(port, sampleFreq, 230)
+		writeRevolutions(port, sampleFreq, 202)
+		writeRevolutions(port, sampleFreq, 201)
+
+		c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+		if err := c.waitSpinUp(); err != nil {
+			t.Fatalf("waitSpinUp() error: %v", err)
+		}
+		if port.rx.Len() != 0 {
+			t.Errorf("%d bytes left unread", port.rx.Len())
+		}
+
+		// Every poll is limited to 500 msec
+		cmd := port.tx.Bytes()[:8]
+		if cmd[0] != CMD_READ_FLUX || binary.LittleEndian.Uint32(cmd[2:6]) != sampleFreq/2 ||
+			binary.LittleEndian.Uint16(cmd[6:8]) != 2 {
+			t.Errorf("READ_FLUX command % x", cmd)
+		}
+	})
+
+	t.Run("no index", func(t *testing.T) {
+		config.SpinUp = 50
+		port := &fakePort{}
+		port.rx.Write([]byte{CMD_READ_FLUX, ACK_NO_INDEX})
+
+		c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+		err := c.waitSpinUp()
+		if !errors.Is(err, adapter.ErrNoIndex) {
+			t.Errorf("waitSpinUp() error = %v, expected ErrNoIndex", err)
+		}
+	})
+}
+
+// Queue response to GET_INFO DRIVE request with the given flags
+func writeDriveInfo(port *fakePort, flags uint32) {
+	response := make([]byte, 32)
+	binary.LittleEndian.PutUint32(response[0:4], flags)
+	port.rx.Write([]byte{CMD_GET_INFO, ACK_OKAY})
+	port.rx.Write(response)
+}
+
+// Wait until the idle timer stops the motor.
+// Every poll restarts the timer: poll less often than it expires.
+func waitMotorOff(t *testing.T, c *Client) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if err := c.busy.Begin(); err == nil {
+			running := c.motor.Running()
+			c.busy.End()
+			if !running {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("motor is still running")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestMotorIdle(t *testing.T) {
+	const sampleFreq = 72000000
+	defer func(idle int) { config.MotorIdle = idle }(config.MotorIdle)
+	config.MotorIdle = 60000
+
+	port := &fakePort{}
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+	c.keepMotor()
+
+	// First operation turns the motor on and waits for spin-up
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_HEAD, ACK_OKAY, CMD_MOTOR, ACK_OKAY})
+	writeSpinUp(port, sampleFreq)
+	writeRevolutions(port, sampleFreq, 200)
+	if _, _, err := c.MeasureRPM(1); err != nil {
+		t.Fatalf("MeasureRPM() error: %v", err)
+	}
+	if !c.motor.Running() {
+		t.Fatalf("motor stopped after operation")
+	}
+
+	// Next operation finds the motor running: no motor request, no spin-up
+	port.tx.Reset()
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_HEAD, ACK_OKAY})
+	writeDriveInfo(port, GW_DF_MOTOR_ON)
+	writeRevolutions(port, sampleFreq, 200)
+	if _, _, err := c.MeasureRPM(1); err != nil {
+		t.Fatalf("MeasureRPM() error: %v", err)
+	}
+	want := []byte{CMD_SELECT, 3, 0, CMD_HEAD, 3, 0, CMD_GET_INFO, 3, GETINFO_DRIVE_0, CMD_READ_FLUX}
+	if !bytes.HasPrefix(port.tx.Bytes(), want) {
+		t.Errorf("sent % x, expected % x...", port.tx.Bytes(), want)
+	}
+
+	// Idle timer turns the motor off and deselects the drive
+	config.MotorIdle = 20
+	port.tx.Reset()
+	port.rx.Write([]byte{CMD_MOTOR, ACK_OKAY, CMD_DESELECT, ACK_OKAY})
+	waitMotorOff(t, c)
+	if !bytes.Equal(port.tx.Bytes(), []byte{CMD_MOTOR, 4, 0, 0, CMD_DESELECT, 2}) {
+		t.Errorf("sent % x when idle, expected motor off and deselect", port.tx.Bytes())
+	}
+
+	// Next operation spins the motor up again
+	config.MotorIdle = 60000
+	port.tx.Reset()
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_HEAD, ACK_OKAY, CMD_MOTOR, ACK_OKAY})
+	writeSpinUp(port, sampleFreq)
+	writeRevolutions(port, sampleFreq, 200)
+	port.rx.Write([]byte{CMD_MOTOR, ACK_OKAY, CMD_DESELECT, ACK_OKAY})
+	if _, _, err := c.MeasureRPM(1); err != nil {
+		t.Fatalf("MeasureRPM() error: %v", err)
+	}
+	if !bytes.HasPrefix(port.tx.Bytes(), []byte{CMD_SELECT, 3, 0, CMD_HEAD, 3, 0, CMD_MOTOR, 4, 0, 1, CMD_READ_FLUX}) {
+		t.Errorf("sent % x, expected motor on", port.tx.Bytes())
+	}
+	if err := c.StopMotor(); err != nil {
+		t.Fatalf("StopMotor() error: %v", err)
+	}
+	if c.motor.Running() || !bytes.HasSuffix(port.tx.Bytes(), []byte{CMD_MOTOR, 4, 0, 0, CMD_DESELECT, 2}) {
+		t.Errorf("sent % x, expected motor off", port.tx.Bytes())
+	}
+}
+
+func TestMotorStoppedByFirmware(t *testing.T) {
+	const sampleFreq = 72000000
+	port := &fakePort{}
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+	c.motor.SetRunning(true)
+
+	// Watchdog of the firmware has turned the motor off
+	writeDriveInfo(port, 0)
+	port.rx.Write([]byte{CMD_MOTOR, ACK_OKAY})
+	writeSpinUp(port, sampleFreq)
+	if err := c.startMotor(); err != nil {
+		t.Fatalf("startMotor() error: %v", err)
+	}
+	want := []byte{CMD_GET_INFO, 3, GETINFO_DRIVE_0, CMD_MOTOR, 4, 0, 1, CMD_READ_FLUX}
+	if !bytes.HasPrefix(port.tx.Bytes(), want) {
+		t.Errorf("sent % x, expected % x...", port.tx.Bytes(), want)
+	}
+	if port.rx.Len() != 0 {
+		t.Errorf("%d bytes left unread", port.rx.Len())
+	}
+
+	// Disk does not spin up: motor is turned off at once
+	port.tx.Reset()
+	port.rx.Write([]byte{CMD_MOTOR, ACK_OKAY, CMD_READ_FLUX, ACK_NO_INDEX})
+	port.rx.Write([]byte{CMD_MOTOR, ACK_OKAY, CMD_DESELECT, ACK_OKAY})
+	c.keepMotor()
+	c.motor.SetRunning(false)
+	defer func(spinUp int) { config.SpinUp = spinUp }(config.SpinUp)
+	config.SpinUp = 1
+	if err := c.startMotor(); !errors.Is(err, adapter.ErrNoIndex) {
+		t.Fatalf("startMotor() error = %v, expected ErrNoIndex", err)
+	}
+	if c.motor.Running() || !bytes.HasSuffix(port.tx.Bytes(), []byte{CMD_MOTOR, 4, 0, 0, CMD_DESELECT, 2}) {
+		t.Errorf("sent % x, expected motor off", port.tx.Bytes())
+	}
+}
+
+func TestDriveParams(t *testing.T) {
+	// Firmware defaults, as sent by the reference host tool ("gw delays")
+	defaults := DriveParams{
+		SelectDelayUS: 10,
+		StepDelayUS:   10000,
+		SeekSettleMS:  15,
+		MotorDelayMS:  750,
+		WatchdogMS:    10000,
+	}
+	wire := []byte{0x0a, 0x00, 0x10, 0x27, 0x0f, 0x00, 0xee, 0x02, 0x10, 0x27}
+
+	if got := defaults.marshal(); !bytes.Equal(got, wire) {
+		t.Errorf("marshal() = % x, expected % x", got, wire)
+	}
+	if got := unmarshalDriveParams(wire); got != defaults {
+		t.Errorf("unmarshalDriveParams() = %+v, expected %+v", got, defaults)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		port := &fakePort{}
+		port.rx.Write([]byte{CMD_GET_PARAMS, ACK_OKAY})
+		port.rx.Write(wire)
+
+		c := &Client{port: port}
+		params, err := c.GetDriveParams()
+		if err != nil {
+			t.Fatalf("GetDriveParams() error: %v", err)
+		}
+		if params != defaults {
+			t.Errorf("GetDriveParams() = %+v, expected %+v", params, defaults)
+		}
+		if want := []byte{0x05, 0x04, 0x00, 0x0a}; !bytes.Equal(port.tx.Bytes(), want) {
+			t.Errorf("sent % x, expected % x", port.tx.Bytes(), want)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		port := &fakePort{}
+		port.rx.Write([]byte{CMD_SET_PARAMS, ACK_OKAY, CMD_GET_PARAMS, ACK_OKAY})
+		port.rx.Write(wire)
+
+		c := &Client{port: port}
+		if err := c.SetDriveParams(defaults); err != nil {
+			t.Fatalf("SetDriveParams() error: %v", err)
+		}
+		want := []byte{0x04, 0x0d, 0x00, 0x0a, 0x00, 0x10, 0x27, 0x0f, 0x00, 0xee, 0x02, 0x10, 0x27,
+			0x05, 0x04, 0x00, 0x0a}
+		if !bytes.Equal(port.tx.Bytes(), want) {
+			t.Errorf("sent % x, expected % x", port.tx.Bytes(), want)
+		}
+	})
+
+	t.Run("read back mismatch", func(t *testing.T) {
+		port := &fakePort{}
+		port.rx.Write([]byte{CMD_SET_PARAMS, ACK_OKAY, CMD_GET_PARAMS, ACK_OKAY})
+		port.rx.Write(wire)
+
+		c := &Client{port: port}
+		params := defaults
+		params.StepDelayUS = 6000
+		err := c.SetDriveParams(params)
+		if err == nil || !strings.Contains(err.Error(), "did not read back") {
+			t.Errorf("SetDriveParams() error = %v, expected read back mismatch", err)
+		}
+	})
+}
+
+// Build a firmware image with valid footer and checksum.
+func makeFirmwareImage(major, minor uint8, model uint16, size int) []byte {
+	image := make([]byte, size-2)
+	for i := range image {
+		image[i] = byte(i * 7)
+	}
+	footer := image[len(image)-6:]
+	copy(footer, "GW")
+	footer[2] = major
+	footer[3] = minor
+	binary.LittleEndian.PutUint16(footer[4:6], model)
+	return binary.BigEndian.AppendUint16(image, crc16CCITT(image))
+}
+
+func TestParseFirmwareImage(t *testing.T) {
+	image := makeFirmwareImage(1, 6, 4, 10000)
+	info, err := ParseFirmwareImage(image)
+	if err != nil {
+		t.Fatalf("ParseFirmwareImage() error: %v", err)
+	}
+	if info != (FirmwareImage{FwMajor: 1, FwMinor: 6, HwModel: 4}) {
+		t.Errorf("ParseFirmwareImage() = %+v", info)
+	}
+
+	corrupt := append([]byte(nil), image...)
+	corrupt[100] ^= 1
+	if _, err := ParseFirmwareImage(corrupt); err == nil {
+		t.Errorf("ParseFirmwareImage() accepted image with bad checksum")
+	}
+	if _, err := ParseFirmwareImage(image[:len(image)-4]); err == nil {
+		t.Errorf("ParseFirmwareImage() accepted truncated image")
+	}
+}
+
+func TestUpdateFirmware(t *testing.T) {
+	image := makeFirmwareImage(1, 6, 4, 10000)
+
+	// Device in main firmware 1.5 before update
+	newTestClient := func(ports ...*fakePort) (*Client, *fakePort) {
+		port := &fakePort{}
+		c := &Client{
+			port:         port,
+			firmwareInfo: FirmwareInfo{FwMajor: 1, FwMinor: 5, IsMainFirmware: true, HwModel: 4},
+		}
+		c.openPort = func() (Port, error) {
+			if len(ports) == 0 {
+				return nil, io.EOF
+			}
+			p := ports[0]
+			ports = ports[1:]
+			return p, nil
+		}
+		return c, port
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		// Bootloader: GET_INFO, UPDATE, status, SWITCH_FW_MODE
+		boot := &fakePort{}
+		bootInfo := makeFirmwareInfo(1, 5, 4, 72000000)
+		bootInfo[2] = 0 // bootloader
+		boot.rx.Write([]byte{CMD_GET_INFO, ACK_OKAY})
+		boot.rx.Write(bootInfo)
+		boot.rx.Write([]byte{CMD_UPDATE, ACK_OKAY, ACK_OKAY, CMD_SWITCH_FW_MODE, ACK_OKAY})
+
+		// New main firmware: GET_INFO, SET_BUS_TYPE
+		app := &fakePort{}
+		app.rx.Write([]byte{CMD_GET_INFO, ACK_OKAY})
+		app.rx.Write(makeFirmwareInfo(1, 6, 4, 72000000))
+		app.rx.Write([]byte{CMD_SET_BUS_TYPE, ACK_OKAY})
+
+		c, port := newTestClient(boot, app)
+		port.rx.Write([]byte{CMD_SWITCH_FW_MODE, ACK_OKAY})
+
+		if err := c.UpdateFirmware(image); err != nil {
+			t.Fatalf("UpdateFirmware() error: %v", err)
+		}
+		if want := []byte{CMD_SWITCH_FW_MODE, 3, FW_MODE_BOOTLOADER}; !bytes.Equal(port.tx.Bytes(), want) {
+			t.Errorf("sent % x to main firmware, expected % x", port.tx.Bytes(), want)
+		}
+
+		// Bootloader receives GET_INFO, UPDATE with length, image and mode switch
+		var want []byte
+		want = append(want, CMD_GET_INFO, 3, GETINFO_FIRMWARE)
+		want = append(want, CMD_UPDATE, 6)
+		want = binary.LittleEndian.AppendUint32(want, uint32(len(image)))
+		want = append(want, image...)
+		want = append(want, CMD_SWITCH_FW_MODE, 3, FW_MODE_APPLICATION)
+		if !bytes.Equal(boot.tx.Bytes(), want) {
+			t.Errorf("sent %d bytes to bootloader, expected %d", boot.tx.Len(), len(want))
+		}
+		if c.firmwareInfo.FwMinor != 6 || !c.firmwareInfo.IsMainFirmware {
+			t.Errorf("firmware after update %+v", c.firmwareInfo)
+		}
+	})
+
+	t.Run("nak", func(t *testing.T) {
+		boot := &fakePort{}
+		bootInfo := makeFirmwareInfo(1, 5, 4, 72000000)
+		bootInfo[2] = 0 // bootloader
+		boot.rx.Write([]byte{CMD_GET_INFO, ACK_OKAY})
+		boot.rx.Write(bootInfo)
+		boot.rx.Write([]byte{CMD_UPDATE, ACK_OKAY, ACK_BAD_COMMAND})
+
+		c, port := newTestClient(boot)
+		port.rx.Write([]byte{CMD_SWITCH_FW_MODE, ACK_OKAY})
+
+		err := c.UpdateFirmware(image)
+		if err == nil || !strings.Contains(err.Error(), "update failed") {
+			t.Fatalf("UpdateFirmware() error = %v, expected update failure", err)
+		}
+		if c.firmwareInfo.IsMainFirmware {
+			t.Errorf("device should stay in bootloader after failed update")
+		}
+	})
+
+	t.Run("wrong model", func(t *testing.T) {
+		c, port := newTestClient()
+		err := c.UpdateFirmware(makeFirmwareImage(1, 6, 7, 10000))
+		if err == nil || !strings.Contains(err.Error(), "hardware model") {
+			t.Fatalf("UpdateFirmware() error = %v, expected model mismatch", err)
+		}
+		if port.tx.Len() != 0 {
+			t.Errorf("sent % x to device, expected nothing", port.tx.Bytes())
+		}
+	})
+}
+
+func TestFetchDriveInfo(t *testing.T) {
+	port := &fakePort{}
+	response := make([]byte, 32)
+	binary.LittleEndian.PutUint32(response[0:4], GW_DF_CYL_VALID|GW_DF_IS_FLIPPY)
+	binary.LittleEndian.PutUint32(response[4:8], 42)
+	port.rx.Write([]byte{CMD_GET_INFO, ACK_OKAY})
+	port.rx.Write(response)
+
+	c := &Client{port: port}
+	info, err := c.FetchDriveInfo(1)
+	if err != nil {
+		t.Fatalf("FetchDriveInfo() error: %v", err)
+	}
+	if !info.CylValid() || info.MotorOn() || !info.IsFlippy() || info.Cylinder != 42 {
+		t.Errorf("FetchDriveInfo() = %+v", info)
+	}
+	if !bytes.Equal(port.tx.Bytes(), []byte{CMD_GET_INFO, 3, GETINFO_DRIVE_1}) {
+		t.Errorf("command % x", port.tx.Bytes())
+	}
+
+	// Older firmware does not know drive info.
+	// Info is requested for the selected drive.
+	port.tx.Reset()
+	port.rx.Write([]byte{CMD_GET_INFO, ACK_BAD_COMMAND})
+	c.drive = 1
+	if c.isFlippy() {
+		t.Errorf("isFlippy() = true for unsupported request")
+	}
+	if !bytes.Equal(port.tx.Bytes(), []byte{CMD_GET_INFO, 3, GETINFO_DRIVE_1}) {
+		t.Errorf("isFlippy() command % x, expected drive 1", port.tx.Bytes())
+	}
+
+	// Head position is checked on the selected drive as well
+	port.tx.Reset()
+	port.rx.Write([]byte{CMD_GET_INFO, ACK_OKAY})
+	port.rx.Write(response)
+	c.checkCylinder(42)
+	if !bytes.Equal(port.tx.Bytes(), []byte{CMD_GET_INFO, 3, GETINFO_DRIVE_1}) {
+		t.Errorf("checkCylinder() command % x, expected drive 1", port.tx.Bytes())
+	}
+	if port.rx.Len() != 0 {
+		t.Errorf("%d bytes of replies not consumed", port.rx.Len())
+	}
+	if _, err := c.FetchDriveInfo(2); err == nil {
+		t.Errorf("expected error for drive 2")
+	}
+}
+
+// blockingPort stalls the first read until released,
+// keeping an operation in the middle of its protocol exchange.
+type blockingPort struct {
+	fakePort
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingPort) Read(buf []byte) (int, error) {
+	if p.started != nil {
+		close(p.started)
+		p.started = nil
+		<-p.release
+	}
+	return p.fakePort.Read(buf)
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	const sampleFreq = 72000000
+	port := &blockingPort{started: make(chan struct{}), release: make(chan struct{})}
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_HEAD, ACK_OKAY, CMD_MOTOR, ACK_OKAY})
+	writeSpinUp(&port.fakePort, sampleFreq)
+	writeRevolutions(&port.fakePort, sampleFreq, 200)
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+
+	// Long operation, stalled after sending its first command
+	type result struct {
+		mean float64
+		err  error
+	}
+	done := make(chan result)
+	started := port.started
+	go func() {
+		mean, _, err := c.MeasureRPM(1)
+		done <- result{mean, err}
+	}()
+	<-started
+	sent := bytes.Clone(port.tx.Bytes())
+
+	// Status poller and other operations must not touch the device meanwhile
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				c.PrintStatus()
+				if _, _, err := c.MeasureRPM(1); !errors.Is(err, adapter.ErrBusy) {
+					t.Errorf("MeasureRPM() error = %v, expected busy", err)
+				}
+				if err := c.Calibrate(); !errors.Is(err, adapter.ErrBusy) {
+					t.Errorf("Calibrate() error = %v, expected busy", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if !bytes.Equal(port.tx.Bytes(), sent) {
+		t.Fatalf("sent % x while busy, expected only % x", port.tx.Bytes(), sent)
+	}
+
+	// The stalled operation completes with intact protocol exchange
+	close(port.release)
+	r := <-done
+	if r.err != nil || r.mean < 299.9 || r.mean > 300.1 {
+		t.Fatalf("MeasureRPM() = %.3f, %v", r.mean, r.err)
+	}
+	if !bytes.HasPrefix(port.tx.Bytes(), []byte{CMD_SELECT, 3, 0, CMD_HEAD, 3, 0, CMD_MOTOR, 4, 0, 1, CMD_READ_FLUX}) ||
+		!bytes.HasSuffix(port.tx.Bytes(), []byte{CMD_GET_FLUX_STATUS, 2}) {
+		t.Errorf("sent % x", port.tx.Bytes())
+	}
+
+	// Next operation may start
+	if err := c.busy.Begin(); err != nil {
+		t.Errorf("Begin() error = %v after operation completed", err)
+	}
+}
+
+func TestSetPin(t *testing.T) {
+	port := &fakePort{}
+	port.rx.Write([]byte{CMD_SET_PIN, ACK_OKAY, CMD_SET_PIN, ACK_BAD_PIN})
+	c := &Client{port: port}
+
+	if err := c.SetPin(PinDensity, true); err != nil {
+		t.Fatalf("SetPin() error: %v", err)
+	}
+	if !bytes.Equal(port.tx.Bytes(), []byte{CMD_SET_PIN, 4, 2, 1}) {
+		t.Errorf("command % x", port.tx.Bytes())
+	}
+	port.tx.Reset()
+	if err := c.SetPin(33, false); !errors.Is(err, ErrBadPin) {
+		t.Errorf("SetPin() error = %v, expected ErrBadPin", err)
+	}
+	if !bytes.Equal(port.tx.Bytes(), []byte{CMD_SET_PIN, 4, 33, 0}) {
+		t.Errorf("command % x", port.tx.Bytes())
+	}
+}
+
+func TestDiskPresent(t *testing.T) {
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	seek := func(cyl byte) []byte { return []byte{CMD_SEEK, 3, cyl} }
+	getPin := []byte{CMD_GET_PIN, 3, PinDiskChange}
+	getInfo := []byte{CMD_GET_INFO, 3, GETINFO_DRIVE_0}
+
+	// Replies: disk change line, and drive at the given cylinder
+	pin := func(level byte) []byte { return []byte{CMD_GET_PIN, ACK_OKAY, level} }
+	driveAt := func(flags uint32, cyl int32) []byte {
+		response := make([]byte, 32)
+		binary.LittleEndian.PutUint32(response[0:4], flags)
+		binary.LittleEndian.PutUint32(response[4:8], uint32(cyl))
+		return join([]byte{CMD_GET_INFO, ACK_OKAY}, response)
+	}
+	seeks := []byte{CMD_SEEK, ACK_OKAY, CMD_SEEK, ACK_OKAY}
+
+	testCases := []struct {
+		name     string
+		rx       []byte
+		expected bool
+		tx       []byte
+	}{
+		{"ready", pin(1), true, getPin},
+
+		// Head returns to its cylinder, or to 0 when unknown
+		{"changed", join(pin(0), driveAt(GW_DF_CYL_VALID, 5), seeks, pin(1)),
+			true, join(getPin, getInfo, seek(4), seek(5), getPin)},
+		{"changed at track 0", join(pin(0), driveAt(GW_DF_CYL_VALID, 0), seeks, pin(1)),
+			true, join(getPin, getInfo, seek(1), seek(0), getPin)},
+		{"no disk", join(pin(0), driveAt(0, 0), seeks, pin(0)),
+			false, join(getPin, getInfo, seek(1), seek(0), getPin)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			port := &fakePort{}
+			port.rx.Write(tc.rx)
+			c := &Client{port: port, firmwareInfo: FirmwareInfo{MaxCmd: CMD_GET_PIN}}
+			present, err := c.diskPresent()
+			if err != nil {
+				t.Fatalf("diskPresent() error: %v", err)
+			}
+			if present != tc.expected {
+				t.Errorf("diskPresent() = %v, expected %v", present, tc.expected)
+			}
+			if !bytes.Equal(port.tx.Bytes(), tc.tx) {
+				t.Errorf("commands % x, expected % x", port.tx.Bytes(), tc.tx)
+			}
+		})
+	}
+
+	// Old firmware cannot read pins
+	c := &Client{port: &fakePort{}, firmwareInfo: FirmwareInfo{MaxCmd: CMD_GET_PIN - 1}}
+	if _, err := c.diskPresent(); !errors.Is(err, adapter.ErrNotSupported) {
+		t.Errorf("diskPresent() error = %v, expected not supported", err)
+	}
+}
+
+func TestWriteNoDisk(t *testing.T) {
+	defer func(stepDelay, settle, motorDelay int, densel bool) {
+		config.StepDelay, config.Settle, config.MotorDelay, config.Densel = stepDelay, settle, motorDelay, densel
+	}(config.StepDelay, config.Settle, config.MotorDelay, config.Densel)
+	config.StepDelay, config.Settle, config.MotorDelay, config.Densel = 0, 0, 0, true
+
+	disk := &hfe.Disk{
+		Header: hfe.Header{NumberOfTrack: 1, NumberOfSide: 1, BitRate: 250, FloppyRPM: 300, WriteAllowed: 0xFF},
+		Tracks: []hfe.TrackData{{Side0: bytes.Repeat([]byte{0x92, 0x54}, 100)}},
+	}
+	fw := FirmwareInfo{SampleFreqHz: 72000000, MaxCmd: CMD_GET_PIN}
+
+	// No disk: fail before the motor is turned on
+	port := &fakePort{}
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_GET_PIN, ACK_OKAY, 0})
+	writeDriveInfo(port, 0)
+	port.rx.Write([]byte{CMD_SEEK, ACK_OKAY, CMD_SEEK, ACK_OKAY, CMD_GET_PIN, ACK_OKAY, 0})
+	c := &Client{port: port, firmwareInfo: fw}
+	err := c.Write(disk, 1)
+	if !errors.Is(err, adapter.ErrNoDisk) || !adapter.IsRetryable(err) {
+		t.Fatalf("Write() error = %v, expected no disk", err)
+	}
+	if bytes.Contains(port.tx.Bytes(), []byte{CMD_MOTOR}) {
+		t.Errorf("motor turned on without disk: % x", port.tx.Bytes())
+	}
+
+	// Write protected disk: fail before the motor is turned on
+	port = &fakePort{}
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_GET_PIN, ACK_OKAY, 1, CMD_GET_PIN, ACK_OKAY, 0})
+	c = &Client{port: port, firmwareInfo: fw}
+	err = c.Write(disk, 1)
+	if !errors.Is(err, adapter.ErrWriteProtected) {
+		t.Fatalf("Write() error = %v, expected write protected", err)
+	}
+	if bytes.Contains(port.tx.Bytes(), []byte{CMD_MOTOR}) {
+		t.Errorf("motor turned on for protected disk: % x", port.tx.Bytes())
+	}
+
+	// Disk present: density is set low for DD media before spin-up
+	port = &fakePort{}
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_GET_PIN, ACK_OKAY, 1, CMD_GET_PIN, ACK_OKAY, 1, CMD_SET_PIN, ACK_OKAY})
+	port.rx.Write([]byte{CMD_MOTOR, ACK_OKAY})
+	writeRevolutions(port, 72000000, 200)
+	writeRevolutions(port, 72000000, 200)
+	port.rx.Write([]byte{CMD_SEEK, ACK_OKAY, CMD_HEAD, ACK_OKAY})
+	port.rx.Write([]byte{CMD_WRITE_FLUX, ACK_WRPROT})
+	c = &Client{port: port, firmwareInfo: fw}
+	err = c.Write(disk, 1)
+	if !errors.Is(err, adapter.ErrWriteProtected) {
+		t.Fatalf("Write() error = %v, expected write protected", err)
+	}
+	expected := []byte{CMD_SELECT, 3, 0, CMD_GET_PIN, 3, PinDiskChange, CMD_GET_PIN, 3, PinWriteProtect, CMD_SET_PIN, 4, PinDensity, 0, CMD_MOTOR}
+	if !bytes.HasPrefix(port.tx.Bytes(), expected) {
+		t.Errorf("commands % x, expected prefix % x", port.tx.Bytes()[:len(expected)], expected)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var events []adapter.TraceEvent
+	adapter.SetTraceFunc(func(event adapter.TraceEvent) { events = append(events, event) })
+	defer adapter.SetTraceFunc(nil)
+
+	port := &fakePort{}
+	port.rx.Write([]byte{CMD_GET_INFO, ACK_OKAY})
+	port.rx.Write(makeFirmwareInfo(1, 5, 4, 72000000))
+	port.rx.Write([]byte{CMD_READ_FLUX, ACK_OKAY, 100, 100, 100, 0})
+	c := &Client{port: port}
+
+	_, err := c.fetchFirmwareVersion()
+	if err != nil {
+		t.Fatalf("fetchFirmwareVersion() error = %v", err)
+	}
+	_, err = c.ReadFlux(0, 2)
+	if err != nil {
+		t.Fatalf("ReadFlux() error = %v", err)
+	}
+
+	want := []struct {
+		dir     adapter.TraceDirection
+		command string
+		length  int
+	}{
+		{adapter.TraceToDevice, "GET_INFO", 3},
+		{adapter.TraceFromDevice, "GET_INFO ACK", 2},
+		{adapter.TraceFromDevice, "GET_INFO FIRMWARE", 32},
+		{adapter.TraceToDevice, "READ_FLUX", 8},
+		{adapter.TraceFromDevice, "READ_FLUX ACK", 2},
+		{adapter.TraceFromDevice, "flux data", 4},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, expected %d: %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Adapter != "greaseweazle" || e.Direction != w.dir || e.Command != w.command || e.Length != w.length {
+			t.Errorf("event %d: %s %s %q %d bytes, expected %s %q %d bytes",
+				i, e.Adapter, e.Direction, e.Command, e.Length, w.dir, w.command, w.length)
+		}
+	}
+	if !bytes.Equal(events[0].Data, []byte{CMD_GET_INFO, 3, GETINFO_FIRMWARE}) {
+		t.Errorf("GET_INFO traced as % x", events[0].Data)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	var _ adapter.FloppyAdapter = (*Client)(nil)
+
+	c := &Client{port: &fakePort{}, firmwareInfo: FirmwareInfo{MaxCmd: CMD_GET_PIN}}
+	caps := c.Capabilities()
+	if !caps.CanRead || !caps.CanWrite || !caps.CanWriteFlux || !caps.CanErase || caps.CanFormat || !caps.SupportsDensitySelect ||
+		!caps.SensesDiskChange || !caps.SensesWriteProtect {
+		t.Errorf("Capabilities() = %+v for current firmware", caps)
+	}
+	if err := c.Format(); !errors.Is(err, adapter.ErrNotSupported) {
+		t.Errorf("Format() error = %v, expected not supported", err)
+	}
+
+	// Old firmware has no ERASE_FLUX command: nothing may be sent
+	port := &fakePort{}
+	c = &Client{port: port, firmwareInfo: FirmwareInfo{MaxCmd: CMD_ERASE_FLUX - 1}}
+	caps = c.Capabilities()
+	if !caps.CanWrite || caps.CanErase {
+		t.Errorf("Capabilities() = %+v for old firmware", caps)
+	}
+	if err := c.Erase(1); !errors.Is(err, adapter.ErrNotSupported) {
+		t.Errorf("Erase() error = %v, expected not supported", err)
+	}
+	if port.tx.Len() != 0 {
+		t.Errorf("sent % x, expected nothing", port.tx.Bytes())
+	}
+}
@@ -0,0 +1,97 @@
+package greaseweazle
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel error for firmware which lacks commands needed to use the device
+var ErrFirmwareTooOld = errors.New("firmware too old, please update")
+
+// Highest command used unconditionally: the bus type is set
+// when the device is opened. Newer commands are optional,
+// see Capabilities.
+const minMaxCmd = CMD_SET_BUS_TYPE
+
+// Commands used when available, which older firmware lacks
+var optionalCommands = []byte{CMD_SET_PIN, CMD_ERASE_FLUX, CMD_GET_PIN}
+
+// Names of products by hardware model and submodel,
+// as reported by GET_INFO
+var modelNames = map[uint8]map[uint8]string{
+	HW_MODEL_F1: {
+		0: "Greaseweazle F1",
+		1: "Greaseweazle F1 Plus",
+		2: "Greaseweazle F1 Plus (Unbuffered)",
+	},
+	HW_MODEL_AT32: {
+		0: "Greaseweazle V4",
+		1: "Greaseweazle V4 Slim",
+		2: "Greaseweazle V4.1",
+	},
+	HW_MODEL_F7: {
+		0: "Greaseweazle F7 v1",
+		1: "Greaseweazle F7 Plus (Ant Goffart, v1)",
+		2: "Greaseweazle F7 Lightning",
+		3: "Greaseweazle F7 v2",
+		4: "Greaseweazle F7 Plus (Ant Goffart, v2)",
+		5: "Greaseweazle F7 Lightning Plus",
+		6: "Greaseweazle F7 Slim",
+		7: "Greaseweazle F7 v3 \"Thunderbolt\"",
+	},
+	HW_MODEL_ADAFRUIT: {
+		0: "Adafruit Floppy Generic",
+	},
+}
+
+// ModelName returns name of the product, like "Greaseweazle V4.1".
+// Unknown submodels are named by their model, and unknown models by numbers.
+func (fw *FirmwareInfo) ModelName() string {
+	submodels, ok := modelNames[fw.HwModel]
+	if !ok {
+		return fmt.Sprintf("Unknown (model %d.%d)", fw.HwModel, fw.HwSubmodel)
+	}
+	if name, ok := submodels[fw.HwSubmodel]; ok {
+		return name
+	}
+	return fmt.Sprintf("%s (submodel %d)", submodels[0], fw.HwSubmodel)
+}
+
+// MCUName returns family of the microcontroller, by hardware model
+func (fw *FirmwareInfo) MCUName() string {
+	switch fw.HwModel {
+	case HW_MODEL_F1:
+		return "STM32F1"
+	case HW_MODEL_F7:
+		return "STM32F7"
+	case HW_MODEL_AT32:
+		return "AT32F4"
+	case HW_MODEL_ADAFRUIT:
+		return "RP2040 or SAMD51"
+	default:
+		return fmt.Sprintf("Unknown (model %d)", fw.HwModel)
+	}
+}
+
+// Check that main firmware knows all commands used unconditionally.
+// Bootloader passes: it is only used to update firmware.
+func (fw *FirmwareInfo) checkCompatible() error {
+	if !fw.IsMainFirmware || fw.MaxCmd >= minMaxCmd {
+		return nil
+	}
+	return fmt.Errorf("Greaseweazle firmware %d.%d lacks %s command: %w",
+		fw.FwMajor, fw.FwMinor, commandName(minMaxCmd), ErrFirmwareTooOld)
+}
+
+// Optional commands which the firmware lacks, like "ERASE_FLUX, GET_PIN",
+// or empty string
+func (fw *FirmwareInfo) missingCommands() string {
+	var names []string
+	for _, cmd := range optionalCommands {
+		if fw.MaxCmd < cmd {
+			names = append(names, commandName(cmd))
+		}
+	}
+	return strings.Join(names, ", ")
+}
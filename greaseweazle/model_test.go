@@ -0,0 +1,135 @@
+package greaseweazle
+
+import (
+	"errors"
+	"testing"
+)
+
+// GET_INFO firmware response with the given leading bytes, padded to 32 bytes
+func firmwareResponse(fields ...byte) []byte {
+	response := make([]byte, 32)
+	copy(response, fields)
+	return response
+}
+
+func TestParseFirmwareInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		info     FirmwareInfo
+		model    string
+		mcu      string
+		missing  string
+		tooOld   bool
+	}{
+		{
+			name: "F1 v0.27, no MCU details",
+			response: firmwareResponse(0, 27, 1, CMD_ERASE_FLUX,
+				0x00, 0x12, 0x7a, 0x00, HW_MODEL_F1, 0, USB_FULL_SPEED),
+			info: FirmwareInfo{FwMajor: 0, FwMinor: 27, IsMainFirmware: true, MaxCmd: CMD_ERASE_FLUX,
+				SampleFreqHz: 8000000, HwModel: HW_MODEL_F1},
+			model:   "Greaseweazle F1",
+			mcu:     "STM32F1",
+			missing: "GET_PIN",
+		},
+		{
+			name: "F7 Lightning Plus v1.5",
+			response: firmwareResponse(1, 5, 1, 22,
+				0x00, 0x51, 0x25, 0x02, HW_MODEL_F7, 5, USB_HIGH_SPEED, 0,
+				216, 0, 64, 0, 64, 0),
+			info: FirmwareInfo{FwMajor: 1, FwMinor: 5, IsMainFirmware: true, MaxCmd: 22,
+				SampleFreqHz: 36000000, HwModel: HW_MODEL_F7, HwSubmodel: 5, USBSpeed: USB_HIGH_SPEED,
+				MCUMhz: 216, MCUSRAMKB: 64, USBBufKB: 64},
+			model: "Greaseweazle F7 Lightning Plus",
+			mcu:   "STM32F7",
+		},
+		{
+			name: "V4.1 v1.6, reserved bytes ignored",
+			response: append(firmwareResponse(1, 6, 1, 22,
+				0x00, 0x1b, 0xb7, 0x00, HW_MODEL_AT32, 2, USB_FULL_SPEED, 5,
+				32, 1, 224, 0, 32, 0)[:18], 0xAA, 0x55, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0),
+			info: FirmwareInfo{FwMajor: 1, FwMinor: 6, IsMainFirmware: true, MaxCmd: 22,
+				SampleFreqHz: 12000000, HwModel: HW_MODEL_AT32, HwSubmodel: 2, MCUID: 5,
+				MCUMhz: 288, MCUSRAMKB: 224, USBBufKB: 32},
+			model: "Greaseweazle V4.1",
+			mcu:   "AT32F4",
+		},
+		{
+			name: "Adafruit Floppy v1.0",
+			response: firmwareResponse(1, 0, 1, CMD_GET_PIN,
+				0x00, 0x1b, 0xb7, 0x00, HW_MODEL_ADAFRUIT, 0, USB_FULL_SPEED),
+			info: FirmwareInfo{FwMajor: 1, FwMinor: 0, IsMainFirmware: true, MaxCmd: CMD_GET_PIN,
+				SampleFreqHz: 12000000, HwModel: HW_MODEL_ADAFRUIT},
+			model: "Adafruit Floppy Generic",
+			mcu:   "RP2040 or SAMD51",
+		},
+		{
+			name: "V4 bootloader",
+			response: firmwareResponse(1, 2, 0, CMD_SWITCH_FW_MODE,
+				0, 0, 0, 0, HW_MODEL_AT32, 0),
+			info:  FirmwareInfo{FwMajor: 1, FwMinor: 2, MaxCmd: CMD_SWITCH_FW_MODE, HwModel: HW_MODEL_AT32},
+			model: "Greaseweazle V4",
+			mcu:   "AT32F4",
+			// Bootloader is good for update, whatever commands it knows
+			missing: "SET_PIN, ERASE_FLUX, GET_PIN",
+		},
+		{
+			name: "F1 v0.11, unknown submodel",
+			response: firmwareResponse(0, 11, 1, CMD_DESELECT,
+				0x00, 0x12, 0x7a, 0x00, HW_MODEL_F1, 9),
+			info: FirmwareInfo{FwMajor: 0, FwMinor: 11, IsMainFirmware: true, MaxCmd: CMD_DESELECT,
+				SampleFreqHz: 8000000, HwModel: HW_MODEL_F1, HwSubmodel: 9},
+			model:   "Greaseweazle F1 (submodel 9)",
+			mcu:     "STM32F1",
+			missing: "SET_PIN, ERASE_FLUX, GET_PIN",
+			tooOld:  true,
+		},
+		{
+			name:     "unknown model",
+			response: firmwareResponse(1, 5, 1, 22, 0, 0, 0, 0, 42, 3),
+			info:     FirmwareInfo{FwMajor: 1, FwMinor: 5, IsMainFirmware: true, MaxCmd: 22, HwModel: 42, HwSubmodel: 3},
+			model:    "Unknown (model 42.3)",
+			mcu:      "Unknown (model 42)",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			info := parseFirmwareInfo(tc.response)
+			if info != tc.info {
+				t.Errorf("parsed %+v, expected %+v", info, tc.info)
+			}
+			if name := info.ModelName(); name != tc.model {
+				t.Errorf("ModelName() = %q, expected %q", name, tc.model)
+			}
+			if mcu := info.MCUName(); mcu != tc.mcu {
+				t.Errorf("MCUName() = %q, expected %q", mcu, tc.mcu)
+			}
+			if missing := info.missingCommands(); missing != tc.missing {
+				t.Errorf("missingCommands() = %q, expected %q", missing, tc.missing)
+			}
+			err := info.checkCompatible()
+			if errors.Is(err, ErrFirmwareTooOld) != tc.tooOld {
+				t.Errorf("checkCompatible() = %v, expected too old %v", err, tc.tooOld)
+			}
+		})
+	}
+}
+
+func TestNewClient_FirmwareTooOld(t *testing.T) {
+	port := &fakePort{}
+	port.rx.Write([]byte{CMD_GET_INFO, ACK_OKAY})
+	port.rx.Write(firmwareResponse(0, 11, 1, CMD_DESELECT, 0x00, 0x12, 0x7a, 0x00, HW_MODEL_F1))
+
+	_, err := newClient(port, "TEST")
+	if !errors.Is(err, ErrFirmwareTooOld) {
+		t.Fatalf("newClient() error = %v, expected firmware too old", err)
+	}
+	if msg := err.Error(); msg != "Greaseweazle firmware 0.11 lacks SET_BUS_TYPE command: firmware too old, please update" {
+		t.Errorf("error message %q", msg)
+	}
+
+	// Nothing is configured on the device
+	if want := []byte{CMD_GET_INFO, 3, GETINFO_FIRMWARE}; string(port.tx.Bytes()) != string(want) {
+		t.Errorf("sent % x, expected % x", port.tx.Bytes(), want)
+	}
+}
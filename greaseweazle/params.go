@@ -0,0 +1,114 @@
+package greaseweazle
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sergev/floppy/config"
+)
+
+// Size of PARAMS_DELAYS structure on the wire: five uint16 values
+const driveParamsSize = 10
+
+// DriveParams contains drive timing parameters (PARAMS_DELAYS)
+type DriveParams struct {
+	SelectDelayUS uint16 // Delay after drive select, usec
+	StepDelayUS   uint16 // Delay between head steps, usec
+	SeekSettleMS  uint16 // Head settle time after seek, msec
+	MotorDelayMS  uint16 // Motor spin-up time, msec
+	WatchdogMS    uint16 // Motor and select timeout on host inactivity, msec
+}
+
+// Encode drive parameters as packed little-endian structure
+func (p DriveParams) marshal() []byte {
+	buf := make([]byte, driveParamsSize)
+	binary.LittleEndian.PutUint16(buf[0:2], p.SelectDelayUS)
+	binary.LittleEndian.PutUint16(buf[2:4], p.StepDelayUS)
+	binary.LittleEndian.PutUint16(buf[4:6], p.SeekSettleMS)
+	binary.LittleEndian.PutUint16(buf[6:8], p.MotorDelayMS)
+	binary.LittleEndian.PutUint16(buf[8:10], p.WatchdogMS)
+	return buf
+}
+
+// Decode drive parameters from packed little-endian structure
+func unmarshalDriveParams(buf []byte) DriveParams {
+	return DriveParams{
+		SelectDelayUS: binary.LittleEndian.Uint16(buf[0:2]),
+		StepDelayUS:   binary.LittleEndian.Uint16(buf[2:4]),
+		SeekSettleMS:  binary.LittleEndian.Uint16(buf[4:6]),
+		MotorDelayMS:  binary.LittleEndian.Uint16(buf[6:8]),
+		WatchdogMS:    binary.LittleEndian.Uint16(buf[8:10]),
+	}
+}
+
+// GetDriveParams retrieves drive timing parameters
+func (c *Client) GetDriveParams() (DriveParams, error) {
+	// Send CMD_GET_PARAMS command: [CMD_GET_PARAMS, length=4, PARAMS_DELAYS, nr_bytes]
+	cmd := []byte{CMD_GET_PARAMS, 4, PARAMS_DELAYS, driveParamsSize}
+	err := c.doCommand(cmd)
+	if err != nil {
+		return DriveParams{}, fmt.Errorf("failed to send GET_PARAMS command: %w", err)
+	}
+
+	response := make([]byte, driveParamsSize)
+	err = c.receive("GET_PARAMS", response)
+	if err != nil {
+		return DriveParams{}, fmt.Errorf("failed to read response: %w", err)
+	}
+	return unmarshalDriveParams(response), nil
+}
+
+// SetDriveParams sets drive timing parameters,
+// and verifies that they read back unchanged
+func (c *Client) SetDriveParams(params DriveParams) error {
+	// Send CMD_SET_PARAMS command: [CMD_SET_PARAMS, length, PARAMS_DELAYS, params...]
+	cmd := append([]byte{CMD_SET_PARAMS, 3 + driveParamsSize, PARAMS_DELAYS}, params.marshal()...)
+	err := c.doCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to send SET_PARAMS command: %w", err)
+	}
+
+	readBack, err := c.GetDriveParams()
+	if err != nil {
+		return err
+	}
+	if readBack != params {
+		return fmt.Errorf("drive parameters did not read back: set %+v, got %+v", params, readBack)
+	}
+	return nil
+}
+
+// Apply user-supplied drive parameters from the drive profile, if any
+func (c *Client) applyDriveProfile() error {
+	if config.StepDelay == 0 && config.Settle == 0 && config.MotorDelay == 0 {
+		return nil
+	}
+
+	params, err := c.GetDriveParams()
+	if err != nil {
+		return err
+	}
+	if config.StepDelay != 0 {
+		params.StepDelayUS = uint16(config.StepDelay)
+	}
+	if config.Settle != 0 {
+		params.SeekSettleMS = uint16(config.Settle)
+	}
+	if config.MotorDelay != 0 {
+		params.MotorDelayMS = uint16(config.MotorDelay)
+	}
+	return c.SetDriveParams(params)
+}
+
+// PrintDriveParams prints drive timing parameters
+func (c *Client) PrintDriveParams() {
+	params, err := c.GetDriveParams()
+	if err != nil {
+		return
+	}
+	fmt.Printf("Select Delay: %d usec\n", params.SelectDelayUS)
+	fmt.Printf("Step Delay: %d usec\n", params.StepDelayUS)
+	fmt.Printf("Settle Time: %d msec\n", params.SeekSettleMS)
+	fmt.Printf("Motor Delay: %d msec\n", params.MotorDelayMS)
+	fmt.Printf("Watchdog: %d msec\n", params.WatchdogMS)
+}
@@ -0,0 +1,149 @@
+package greaseweazle
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+)
+
+// Pins of IBM PC floppy interface
+const (
+	PinDensity      = 2  // Density select, driven by host
+	PinWriteProtect = 28 // Write protect, low when disk is protected
+	PinDiskChange   = 34 // Disk change, low when no disk or disk was swapped
+)
+
+// SetPin sets level of the specified pin: true for High, false for Low.
+// Returns ErrBadPin if the pin cannot be driven by the adapter.
+func (c *Client) SetPin(pin byte, level bool) error {
+	// Send CMD_SET_PIN command: [CMD_SET_PIN, length=4, pin#, level]
+	value := byte(0)
+	if level {
+		value = 1
+	}
+	cmd := []byte{CMD_SET_PIN, 4, pin, value}
+	return c.doCommand(cmd)
+}
+
+// DiskPresent checks the disk change line of the drive.
+// Returns adapter.ErrNotSupported when the adapter cannot read the line.
+func (c *Client) DiskPresent() (bool, error) {
+	if err := c.busy.Begin(); err != nil {
+		return false, err
+	}
+	defer c.busy.End()
+
+	err := c.SelectDrive(c.drive)
+	if err != nil {
+		return false, fmt.Errorf("failed to select drive: %w", err)
+	}
+	return c.diskPresent()
+}
+
+// IsWriteProtected checks the write protect line of the drive.
+// Returns adapter.ErrNotSupported when the adapter cannot read the line.
+func (c *Client) IsWriteProtected() (bool, error) {
+	if err := c.busy.Begin(); err != nil {
+		return false, err
+	}
+	defer c.busy.End()
+
+	err := c.SelectDrive(c.drive)
+	if err != nil {
+		return false, fmt.Errorf("failed to select drive: %w", err)
+	}
+	return c.isWriteProtected()
+}
+
+// Read level of an input pin of the selected drive.
+// Older firmware cannot read pins at all.
+func (c *Client) readPin(pin byte) (bool, error) {
+	if c.firmwareInfo.MaxCmd < CMD_GET_PIN {
+		return false, adapter.ErrNotSupported
+	}
+	level, err := c.getPinValue(pin)
+	if errors.Is(err, ErrBadPin) {
+		return false, fmt.Errorf("pin %d: %w", pin, adapter.ErrNotSupported)
+	}
+	return level, err
+}
+
+// Check the disk change line of the selected drive.
+// The line is latched low when the disk is removed, and is cleared
+// by a step pulse when a disk is inserted. So when the line is low,
+// the heads are stepped and the line is checked again. The head
+// returns to the cylinder reported by the drive; when the drive
+// does not know its position, the head is left at cylinder 0.
+func (c *Client) diskPresent() (bool, error) {
+	level, err := c.readPin(PinDiskChange)
+	if err != nil || level {
+		return level, err
+	}
+
+	// Step to clear the change latch, and back
+	cyl := 0
+	if info, err := c.FetchDriveInfo(c.drive); err == nil && info.CylValid() {
+		cyl = int(info.Cylinder)
+	}
+	away := cyl + 1
+	if cyl > 0 {
+		away = cyl - 1
+	}
+	err = c.Seek(byte(away))
+	if err != nil {
+		return false, fmt.Errorf("failed to seek: %w", err)
+	}
+	err = c.Seek(byte(cyl))
+	if err != nil {
+		return false, fmt.Errorf("failed to seek: %w", err)
+	}
+	return c.readPin(PinDiskChange)
+}
+
+// Check the write protect line of the selected drive: low when protected
+func (c *Client) isWriteProtected() (bool, error) {
+	level, err := c.readPin(PinWriteProtect)
+	return !level, err
+}
+
+// Fail fast when no disk is inserted, instead of waiting for index pulses.
+// Adapters without the disk change line proceed as before.
+func (c *Client) checkDisk() error {
+	present, err := c.diskPresent()
+	if errors.Is(err, adapter.ErrNotSupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check disk: %w", err)
+	}
+	if !present {
+		return fmt.Errorf("Greaseweazle error: %w", adapter.ErrNoDisk)
+	}
+	return nil
+}
+
+// Before writing: fail when no disk is inserted, or it is write protected
+func (c *Client) checkWritable() error {
+	err := adapter.CheckWritable(c.diskPresent, c.isWriteProtected)
+	if err != nil {
+		return fmt.Errorf("Greaseweazle error: %w", err)
+	}
+	return nil
+}
+
+// Select density of the drive for media of the given bit rate:
+// pin 2 is high for HD media and low for DD media.
+// Nothing is done unless the drive profile asks for it,
+// or when the bit rate is not known.
+func (c *Client) setDensity(bitRateKhz int) error {
+	if !config.Densel || bitRateKhz <= 0 {
+		return nil
+	}
+	err := c.SetPin(PinDensity, bitRateKhz >= 500)
+	if err != nil {
+		return fmt.Errorf("failed to set density select: %w", err)
+	}
+	return nil
+}
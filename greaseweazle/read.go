@@ -1,15 +1,20 @@
 package greaseweazle
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io"
+	"time"
 
+	"github.com/sergev/floppy/adapter"
 	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/flux"
 	"github.com/sergev/floppy/hfe"
-	"github.com/sergev/floppy/mfm"
 )
 
+// Pause before a track is read again after flux overflow or lost index
+const ReadRetryDelay = 100 * time.Millisecond
+
 // readN28 decodes a 28-bit value from Greaseweazle N28 encoding
 // Returns the decoded value and the number of bytes consumed
 func readN28(data []byte, offset int) (uint32, int, error) {
@@ -33,6 +38,7 @@ func readN28(data []byte, offset int) (uint32, int, error) {
 // ReadFlux reads raw flux data from the current track
 // ticks: maximum ticks to read (0 = no limit)
 // maxIndex: maximum index pulses to read (0 = no limit, typically 2 for 2 revolutions)
+// The returned data is valid until the next call.
 func (c *Client) ReadFlux(ticks uint32, maxIndex uint16) ([]byte, error) {
 	// Build CMD_READ_FLUX command: [CMD_READ_FLUX, 8, ticks (le32), maxIndex (le16)]
 	cmd := make([]byte, 8)
@@ -47,171 +53,115 @@ func (c *Client) ReadFlux(ticks uint32, maxIndex uint16) ([]byte, error) {
 	}
 
 	// Read flux data until we encounter a 0 byte (end of stream marker)
-	var data []byte
-	buf := make([]byte, 1)
+	data := c.fluxBuf[:0]
+	defer func() {
+		c.fluxBuf = data[:0]
+	}()
+	sizing := c.firmwareInfo.readSizing()
+	buf := make([]byte, sizing.chunk)
 	for {
-		_, err := io.ReadFull(c.port, buf)
+		start := time.Now()
+		n, err := c.port.Read(buf)
+		trace(adapter.TraceFromDevice, "flux data", buf[:n], start, err)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read flux data: %w", err)
+			if len(data) > 0 || n > 0 {
+				// Skip the rest of the stream, so that the next command
+				// does not take stale flux bytes for its ACK
+				c.drainFlux(buf)
+			}
+			return nil, fmt.Errorf("failed to read flux data: %w", adapter.SerialError(err))
 		}
-		if buf[0] == 0 {
+		if end := bytes.IndexByte(buf[:n], 0); end >= 0 {
+			data = append(data, buf[:end]...)
 			break
 		}
-		data = append(data, buf[0])
+		data = append(data, buf[:n]...)
+		if n < len(buf) && sizing.pause > 0 {
+			// Device is drained: let it fill the buffer
+			time.Sleep(sizing.pause)
+		}
 	}
 
 	if len(data) == 0 {
-		return nil, fmt.Errorf("no flux data")
+		// Tick limit reached with no transitions and no index pulses
+		return nil, fmt.Errorf("no flux data: %w", adapter.ErrNoIndex)
 	}
 	return data, nil
 }
 
-// Extract index pulse timings from flux data.
-// Calculate RPM and bit rate.
-// Return the calculated RPM: 300 or 360.
-// Return the calculated bit rate: 250, 500 or 1000 bits/msec.
-func (c *Client) calculateRPMAndBitRate(fluxData []byte) (uint16, uint16) {
-	var indexPulses []uint64 // Index pulse times in nanoseconds
-
-	tickPeriodNs := 1e9 / float64(c.firmwareInfo.SampleFreqHz) // Nanoseconds per tick
-	ticksAccumulated := uint64(0)
-	countTransitions := uint64(0)
-
-	i := 0
-	for i < len(fluxData) {
-		b := fluxData[i]
-
-		if b == 0xFF {
-			// Special opcode
-			if i+1 >= len(fluxData) {
-				break
-			}
-
-			opcode := fluxData[i+1]
-			i += 2
-
-			switch opcode {
-			case FLUXOP_INDEX:
-				// Index pulse marker
-				n28, consumed, err := readN28(fluxData, i)
-				if err != nil {
-					break
-				}
-				i += consumed
-				indexTime := ticksAccumulated + uint64(n28)
-				indexPulses = append(indexPulses, uint64(float64(indexTime)*tickPeriodNs))
-
-			case FLUXOP_SPACE:
-				// Time gap with no transitions
-				n28, consumed, err := readN28(fluxData, i)
-				if err != nil {
-					break
-				}
-				i += consumed
-				if DebugFlag {
-					fmt.Printf(" %d", n28)
-				}
-				ticksAccumulated += uint64(n28)
-
-			default:
-				// Unknown opcode, skip
-			}
-		} else if b < 250 {
-			// Direct interval: 1-249 ticks
-			if DebugFlag {
-				fmt.Printf(" %d", b)
-			}
-			ticksAccumulated += uint64(b)
-			if len(indexPulses) == 1 {
-				// Ignore all before the first index pulse, and
-				// after the second index pulse
-				countTransitions++
-			}
-			i++
-		} else {
-			// Extended interval: 250-254
-			if i+1 >= len(fluxData) {
-				break
-			}
-			delta := 250 + uint64(b-250)*255 + uint64(fluxData[i+1]) - 1
-			if DebugFlag {
-				fmt.Printf(" %d", delta)
-			}
-			ticksAccumulated += delta
-			if len(indexPulses) == 1 {
-				// Ignore all before the first index pulse, and
-				// after the second index pulse
-				countTransitions++
-			}
-			i += 2
+// Read and discard flux data up to the terminating 0 byte
+func (c *Client) drainFlux(buf []byte) {
+	for {
+		start := time.Now()
+		n, err := c.port.Read(buf)
+		trace(adapter.TraceFromDevice, "flux data drained", buf[:n], start, err)
+		if err != nil || bytes.IndexByte(buf[:n], 0) >= 0 {
+			return
 		}
 	}
+}
 
-	// Need at least 2 index pulses to calculate rotation period
-	if len(indexPulses) < 2 {
-		return 300, 250 // Default RPM and bit rate
+// Read flux data of the current track, and check flux status
+func (c *Client) readTrackFlux() (*flux.FluxTrack, error) {
+	// Read flux data (0 ticks = no limit, 2 index pulses = 2 revolutions by default)
+	fluxData, err := c.ReadFlux(0, uint16(adapter.ReadOpts.TrackRevolutions(2)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flux data: %w", err)
 	}
 
-	//
-	// Calculate RPM: 60 seconds per minute / period in seconds
-	//
-	trackDurationNs := indexPulses[1] - indexPulses[0]
-	if DebugFlag {
-		fmt.Printf("--- trackDurationNs = %d\n", trackDurationNs)
+	// Check flux status
+	err = c.GetFluxStatus()
+	if err != nil {
+		return nil, fmt.Errorf("flux status error: %w", err)
 	}
 
-	rpm := 60e9 / trackDurationNs
-	if DebugFlag {
-		fmt.Printf("--- rpm = %d\n", rpm)
+	track, err := c.fluxTrack(fluxData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode flux data: %w", err)
 	}
+	return track, nil
+}
 
-	// Round to either 300 or 360 RPM (standard floppy drive speeds)
-	// Use 330 RPM as the threshold (midpoint between 300 and 360)
-	if rpm < 330 {
-		rpm = 300
-	} else {
-		rpm = 360
+// Read flux data of the current track. After flux overflow or lost index
+// the drive is given a pause and a fresh spin-up check, so that the track
+// can be read again. Retries are made by adapter.TrackFailures, within
+// the budget of ReadOpts.Retries.
+func (c *Client) readTrackRetry() (*flux.FluxTrack, error) {
+	track, err := c.readTrackFlux()
+	if err == nil || !adapter.IsRetryable(err) {
+		return track, err
 	}
-
-	//
-	// Calculate bit rate
-	//
-	bitsPerMsec := countTransitions * 1e6 / trackDurationNs
-	if DebugFlag {
-		fmt.Printf("--- countTransitions = %d\n", countTransitions)
-		fmt.Printf("--- bitsPerMsec = %d\n", bitsPerMsec)
+	adapter.Tracef(traceName, "%v, waiting for spin-up", err)
+	time.Sleep(ReadRetryDelay)
+	if spinErr := c.waitSpinUp(); spinErr != nil && !adapter.IsRetryable(spinErr) {
+		return nil, spinErr
 	}
-
-	// Round to standard floppy drive bitrates: 250, 500, or 1000 kbps
-	// Use thresholds: < 375 -> 250, < 750 -> 500, >= 750 -> 1000
-	if bitsPerMsec < 375 {
-		if rpm == 360 {
-			bitsPerMsec = 300
-		} else {
-			bitsPerMsec = 250
-		}
-	} else if bitsPerMsec < 750 {
-		bitsPerMsec = 500
-	} else {
-		bitsPerMsec = 1000
-	}
-
-	return uint16(rpm), uint16(bitsPerMsec)
+	return nil, err
 }
 
-// decodeFluxToMFM recovers raw MFM bitcells from Greaseweazle flux data using PLL,
-// and returns MFM bitcells as bytes (bitcells packed MSB-first, not decoded data bits)
-func (c *Client) decodeFluxToMFM(fluxData []byte, bitRateKhz uint16) ([]byte, error) {
+// fluxTrack decodes Greaseweazle flux data into transition and index pulse times
+// in nanoseconds, relative to the first index pulse. Transitions before
+// the first index pulse are dropped.
+func (c *Client) fluxTrack(fluxData []byte) (*flux.FluxTrack, error) {
 	if len(fluxData) == 0 {
 		return nil, fmt.Errorf("empty flux data")
 	}
 
-	// Step 1: Decode Greaseweazle flux stream to get transition times
-	var transitions []uint64 // Times in nanoseconds
-	var indexPulses []uint64 // Index pulse times
-
-	tickPeriodNs := 1e9 / float64(c.firmwareInfo.SampleFreqHz) // Nanoseconds per tick = 13.89
+	track := &flux.FluxTrack{
+		Transitions:   make([]uint64, 0, len(fluxData)),
+		SampleClockHz: float64(c.firmwareInfo.SampleFreqHz),
+	}
+	tickPeriodNs := 1e9 / track.SampleClockHz // Nanoseconds per tick
 	ticksAccumulated := uint64(0)
+	firstIndexNs := uint64(0)
+
+	// Append transition at current time, once the first index pulse is seen
+	addTransition := func() {
+		timeNs := uint64(float64(ticksAccumulated) * tickPeriodNs)
+		if len(track.IndexPulses) > 0 && timeNs >= firstIndexNs {
+			track.Transitions = append(track.Transitions, timeNs-firstIndexNs)
+		}
+	}
 
 	i := 0
 	for i < len(fluxData) {
@@ -228,15 +178,18 @@ func (c *Client) decodeFluxToMFM(fluxData []byte, bitRateKhz uint16) ([]byte, er
 
 			switch opcode {
 			case FLUXOP_INDEX:
-				// Index pulse marker
-				_, consumed, err := readN28(fluxData, i)
+				// Index pulse marker, N28 is the offset from the last transition.
+				// Index pulse doesn't advance the cursor.
+				n28, consumed, err := readN28(fluxData, i)
 				if err != nil {
 					return nil, fmt.Errorf("failed to read INDEX N28: %w", err)
 				}
 				i += consumed
-				indexTime := ticksAccumulated //+ uint64(n28)
-				indexPulses = append(indexPulses, uint64(float64(indexTime)*tickPeriodNs))
-				// Index pulse doesn't advance the cursor
+				indexNs := uint64(float64(ticksAccumulated+uint64(n28)) * tickPeriodNs)
+				if len(track.IndexPulses) == 0 {
+					firstIndexNs = indexNs
+				}
+				track.IndexPulses = append(track.IndexPulses, indexNs-firstIndexNs)
 
 			case FLUXOP_SPACE:
 				// Time gap with no transitions
@@ -253,110 +206,87 @@ func (c *Client) decodeFluxToMFM(fluxData []byte, bitRateKhz uint16) ([]byte, er
 		} else if b < 250 {
 			// Direct interval: 1-249 ticks
 			ticksAccumulated += uint64(b)
-			if len(indexPulses) == 1 {
-				// Ignore all before the first index pulse, and
-				// after the second index pulse
-				transitionTime := uint64(float64(ticksAccumulated)*tickPeriodNs) - indexPulses[0]
-				transitions = append(transitions, transitionTime)
-				//fmt.Printf(" %d", transitionTime)
-			}
+			addTransition()
 			i++
 		} else {
 			// Extended interval: 250-254
 			if i+1 >= len(fluxData) {
 				return nil, fmt.Errorf("incomplete extended interval at offset %d", i)
 			}
-			delta := 250 + uint64(b-250)*255 + uint64(fluxData[i+1]) - 1
-			ticksAccumulated += delta
-			if len(indexPulses) == 1 {
-				transitionTime := uint64(float64(ticksAccumulated)*tickPeriodNs) - indexPulses[0]
-				transitions = append(transitions, transitionTime)
-				//fmt.Printf(" %d", transitionTime)
-			}
+			ticksAccumulated += 250 + uint64(b-250)*255 + uint64(fluxData[i+1]) - 1
+			addTransition()
 			i += 2
 		}
 	}
 
-	if len(transitions) == 0 {
+	if len(track.Transitions) == 0 {
 		return nil, fmt.Errorf("no flux transitions found")
 	}
+	adapter.Tracef(traceName, "%d transitions, %d index pulses", len(track.Transitions), len(track.IndexPulses))
+	return track, nil
+}
 
-	// Step 2: Apply SCP-style PLL to recover clock and generate bitcell boundaries
-	// Create and initialize PLL decoder with transitions
-	decoder := mfm.NewDecoder(transitions, bitRateKhz)
-
-	// Ignore first half-bit (as done in reference implementation)
-	_ = decoder.NextBit()
-
-	// Generate MFM bitcells using PLL algorithm
-	var bitcells []bool
-	for {
-		first := decoder.NextBit()
-		second := decoder.NextBit()
-
-		bitcells = append(bitcells, first)
-		bitcells = append(bitcells, second)
-
-		if decoder.IsDone() {
-			// No more transitions available
-			break
-		}
+// Prepare the drive for reading: select it, set drive parameters and density,
+// and spin up the motor
+func (c *Client) prepareRead() error {
+	err := c.SelectDrive(c.drive)
+	if err != nil {
+		return fmt.Errorf("failed to select drive: %w", err)
 	}
-
-	if len(bitcells) == 0 {
-		return nil, fmt.Errorf("no bitcells generated")
+	err = c.applyDriveProfile()
+	if err != nil {
+		return fmt.Errorf("failed to set drive parameters: %w", err)
 	}
-
-	// Step 4: Pack bitcells as bytes (MSB-first)
-	// Each bitcell becomes one bit in the output
-	var mfmBytes []byte
-	currentByte := byte(0)
-	bitCount := 0
-
-	for _, bit := range bitcells {
-		if bit {
-			currentByte |= 1 << (7 - bitCount)
-		}
-		bitCount++
-
-		// When we have 8 bits, save the byte and start a new one
-		if bitCount == 8 {
-			mfmBytes = append(mfmBytes, currentByte)
-			currentByte = 0
-			bitCount = 0
-		}
+	err = c.checkDisk()
+	if err != nil {
+		return err
 	}
-
-	// Add any remaining partial byte
-	if bitCount > 0 {
-		mfmBytes = append(mfmBytes, currentByte)
+	err = c.setDensity(adapter.ReadOpts.BitRate)
+	if err != nil {
+		return err
 	}
+	c.warnLinkSpeed(adapter.ReadOpts.BitRate)
+	return c.startMotor()
+}
 
-	if len(mfmBytes) == 0 {
-		return nil, fmt.Errorf("no MFM bytes generated")
+// ReadTrack reads one track into memory, and decodes it with
+// rates measured on the track itself, unless forced by ReadOpts
+func (c *Client) ReadTrack(cyl, head int) (*adapter.TrackCapture, error) {
+	if err := c.busy.Begin(); err != nil {
+		return nil, err
 	}
+	defer c.busy.End()
 
-	return mfmBytes, nil
+	err := adapter.CheckTrack(cyl, head)
+	if err != nil {
+		return nil, err
+	}
+	err = c.prepareRead()
+	if err != nil {
+		return nil, err
+	}
+	return c.readTrack(&trackReader{single: true}, cyl, head, head)
 }
 
-// Read reads the entire floppy disk and returns it as a disk object
-func (c *Client) Read(numberOfTracks int) (*hfe.Disk, error) {
-	// Select drive 0 and turn on motor
-	err := c.SelectDrive(0)
-	if err != nil {
-		return nil, fmt.Errorf("failed to select drive: %w", err)
+// Read reads the entire floppy disk and returns it as a disk object.
+// When w is not nil, every track is also saved to it as soon as it is read.
+func (c *Client) Read(numberOfCylinders int, w *hfe.Writer) (*hfe.Disk, error) {
+	if err := c.busy.Begin(); err != nil {
+		return nil, err
 	}
-	err = c.SetMotor(0, true)
+	defer c.busy.End()
+
+	// Select the drive and turn on motor
+	err := c.prepareRead()
 	if err != nil {
-		return nil, fmt.Errorf("failed to turn on motor: %w", err)
+		return nil, err
 	}
-	defer c.SetMotor(0, false) // Turn off motor when done
 
 	// Initialize disk structure
 	disk := &hfe.Disk{
 		Header: hfe.Header{
-			NumberOfTrack:       uint8(numberOfTracks),
-			NumberOfSide:        uint8(config.Heads),
+			NumberOfTrack:       uint8(numberOfCylinders),
+			NumberOfSide:        uint8(adapter.ReadOpts.NumberOfSides(config.Heads)),
 			TrackEncoding:       hfe.ENC_ISOIBM_MFM,
 			BitRate:             500,              // Will be calculated from flux data
 			FloppyRPM:           300,              // Will be calculated from flux data
@@ -369,95 +299,268 @@ func (c *Client) Read(numberOfTracks int) (*hfe.Disk, error) {
 			Track0S1AltEncoding: 0xFF, // Use default encoding
 			Track0S1Encoding:    hfe.ENC_ISOIBM_MFM,
 		},
-		Tracks: make([]hfe.TrackData, numberOfTracks),
+		Tracks: make([]hfe.TrackData, numberOfCylinders),
 	}
 
-	// Iterate through cylinders and heads
-	for cyl := 0; cyl < numberOfTracks; cyl++ {
-		for head := 0; head < config.Heads; head++ {
-			// Print progress message
-			if cyl != 0 || head != 0 {
-				fmt.Printf("\rReading track %d, side %d...", cyl, head)
-			}
+	// Bit rate is unknown until the first track is read
+	disk.Header.BitRate = 0
+
+	// Range of cylinders and heads to read
+	firstCyl, lastCyl := adapter.ReadOpts.Cylinders(numberOfCylinders)
+	firstHead, lastHead := adapter.ReadOpts.Heads(config.Heads)
+
+	// Single-head drive: the disk must be flipped over to read side 1
+	flippy := lastHead > 0 && c.isFlippy()
+	passLastHead := lastHead
+	if flippy {
+		if firstHead == 0 {
+			fmt.Printf("Warning: drive is flippy, reading side 0 first\n")
+		}
+		passLastHead = 0
+	}
 
-			// Seek to cylinder
-			err = c.Seek(byte(cyl))
+	// Read one track with the given head, and store it as the given side of the disk
+	r := &trackReader{}
+	failures := &adapter.TrackFailures{Reconnect: c.resume}
+	readTrack := func(cyl, head, side int) error {
+		return failures.Read(cyl, side, func() error {
+			// Print progress message, after parameters of the disk are known
+			if r.bitRate != 0 {
+				fmt.Printf("\rReading track %d, side %d...", cyl, side)
+			}
+			capture, err := c.readTrack(r, cyl, head, side)
 			if err != nil {
-				return nil, fmt.Errorf("failed to seek to cylinder %d: %w", cyl, err)
+				return err
 			}
+			capture.Store(disk)
+			disk.Header.FloppyRPM, disk.Header.BitRate = r.rates.Disk()
+			r.encoding.Update(disk, capture)
+			return nil
+		})
+	}
 
-			// Set head
-			err = c.SetHead(byte(head))
+	// Iterate through cylinders and heads
+	for cyl := firstCyl; cyl <= lastCyl; cyl++ {
+		for head := firstHead; head <= passLastHead; head++ {
+			err = readTrack(cyl, head, head)
 			if err != nil {
-				return nil, fmt.Errorf("failed to set head %d: %w", head, err)
+				return nil, err
 			}
+		}
 
-			// Read flux data (0 ticks = no limit, 2 index pulses = 2 revolutions)
-			fluxData, err := c.ReadFlux(0, 2)
+		// Save completed track to the output file
+		if w != nil && !flippy {
+			w.Header = disk.Header
+			err = w.WriteTrackData(cyl, disk.Tracks[cyl])
 			if err != nil {
-				return nil, fmt.Errorf("failed to read flux data from cylinder %d, head %d: %w", cyl, head, err)
+				return nil, fmt.Errorf("failed to save cylinder %d: %w", cyl, err)
 			}
+		}
+	}
 
-			// Calculate RPM and BitRate from first track (cylinder 0, head 0)
-			if cyl == 0 && head == 0 {
-				calculatedRPM, calculatedBitRate := c.calculateRPMAndBitRate(fluxData)
-
-				// Round to either 300 or 360 RPM (standard floppy drive speeds)
-				// Use 330 RPM as the threshold (midpoint between 300 and 360)
-				if calculatedRPM < 330 {
-					calculatedRPM = 300
-				} else {
-					calculatedRPM = 360
+	if flippy {
+		// Read the other side in a separate pass, with head 0.
+		// Motor is stopped while the user flips the disk.
+		c.motor.Off()
+		if adapter.FlipDisk != nil && adapter.FlipDisk() {
+			err = c.startMotor()
+			if err != nil {
+				return nil, err
+			}
+			for cyl := firstCyl; cyl <= lastCyl; cyl++ {
+				err = readTrack(cyl, 0, 1)
+				if err != nil {
+					return nil, err
 				}
+			}
+		} else {
+			fmt.Printf("\nSide 1 skipped.")
+			disk.Header.NumberOfSide = 1
+		}
 
-				// Round to standard floppy drive bitrates: 250, 500, or 1000 kbps
-				// Use thresholds: < 375 -> 250, < 750 -> 500, >= 750 -> 1000
-				if calculatedBitRate < 375 {
-					if calculatedRPM == 360 {
-						calculatedBitRate = 300
-					} else {
-						calculatedBitRate = 250
-					}
-				} else if calculatedBitRate < 750 {
-					calculatedBitRate = 500
-				} else {
-					calculatedBitRate = 1000
-				}
-				fmt.Printf("Bit Rate: %d kbps\n", calculatedBitRate)
-				fmt.Printf("Rotation Speed: %d RPM\n", calculatedRPM)
-
-				disk.Header.FloppyRPM = calculatedRPM
-				disk.Header.BitRate = calculatedBitRate
-				if disk.Header.BitRate >= 750 {
-					// Extended density
-					disk.Header.FloppyInterfaceMode = hfe.IFM_IBMPC_ED
-				} else if disk.Header.BitRate >= 375 {
-					// High density
-					disk.Header.FloppyInterfaceMode = hfe.IFM_IBMPC_HD
+		// Save all tracks to the output file
+		if w != nil {
+			w.Header = disk.Header
+			for cyl := firstCyl; cyl <= lastCyl; cyl++ {
+				err = w.WriteTrackData(cyl, disk.Tracks[cyl])
+				if err != nil {
+					return nil, fmt.Errorf("failed to save cylinder %d: %w", cyl, err)
 				}
 			}
+		}
+	}
+	fmt.Printf("\nRead complete.\n")
+	if failures.Retried > 0 {
+		fmt.Printf("Retried %d tracks, %d retries total.\n", failures.Retried, failures.Retries)
+	}
+	if report := r.rates.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.recovery.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.recovery.LockReport(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.locks.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.verifier.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.encoding.Report(disk); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.weak.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := failures.Report(); report != "" {
+		fmt.Println(report)
+	}
 
-			// Decode flux data to MFM bitstream
-			mfmBitstream, err := c.decodeFluxToMFM(fluxData, disk.Header.BitRate)
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode flux data to MFM from cylinder %d, head %d: %w", cyl, head, err)
-			}
+	return disk, failures.Err()
+}
 
-			// Check flux status
-			err = c.GetFluxStatus()
-			if err != nil {
-				return nil, fmt.Errorf("flux status error after reading cylinder %d, head %d: %w", cyl, head, err)
-			}
+// Reconnect to the device after it dropped off the bus, and restore
+// state of the read session: bus type, selected drive, drive parameters,
+// density and spinning motor. Head position is restored by a fresh seek.
+func (c *Client) resume() error {
+	err := c.reconnect()
+	if err != nil {
+		return err
+	}
+	err = c.SetBusType()
+	if err != nil {
+		return fmt.Errorf("failed to set bus type: %w", err)
+	}
+	err = c.SelectDrive(c.drive)
+	if err != nil {
+		return fmt.Errorf("failed to select drive: %w", err)
+	}
+	err = c.applyDriveProfile()
+	if err != nil {
+		return fmt.Errorf("failed to set drive parameters: %w", err)
+	}
+	err = c.setDensity(adapter.ReadOpts.BitRate)
+	if err != nil {
+		return err
+	}
+	err = c.Seek(0)
+	if err != nil {
+		return fmt.Errorf("failed to seek: %w", err)
+	}
+
+	// Motor has stopped with the device
+	c.motor.SetRunning(false)
+	return c.startMotor()
+}
+
+// State of reading tracks, shared between tracks of one disk
+type trackReader struct {
+	single   bool   // Reading a single track: rates are measured on it quietly
+	bitRate  uint16 // Bit rate of the track being read, 0 until the first track
+	rpm      uint16 // Rotation speed of the track being read
+	rates    adapter.RateEstimator
+	recovery flux.SpeedRecovery
+	verifier adapter.Verifier
+	locks    adapter.LockLog
+	encoding adapter.EncodingDetector
+	weak     adapter.WeakDetector
+}
+
+// Read one track with the given head, and decode it as the given side of the disk.
+// Bit rate and RPM of the disk are measured on the first tracks decoded.
+func (c *Client) readTrack(r *trackReader, cyl, head, side int) (*adapter.TrackCapture, error) {
+	// Seek to cylinder
+	err := c.Seek(byte(cyl))
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: side, Err: fmt.Errorf("failed to seek: %w", err)}
+	}
+
+	// Make sure the drive agrees on head position, every 10 cylinders
+	if cyl%10 == 0 && head == 0 {
+		c.checkCylinder(cyl)
+	}
+
+	// Set head
+	err = c.SetHead(byte(head))
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: side, Err: fmt.Errorf("failed to set head: %w", err)}
+	}
+
+	// Read flux data, and prepare for a retry after overflow or lost index
+	track, err := c.readTrackRetry()
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: side, Err: err}
+	}
+	err = adapter.CheckIndex(track)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: side, Err: err}
+	}
+	if len(track.IndexPulses) < 2 {
+		fmt.Printf("\nWarning: track %d, side %d: less than two index pulses, decoding all flux data\n", cyl, side)
+	}
+
+	// Calculate RPM and BitRate of the track, unless given by user
+	if r.single {
+		r.rpm, r.bitRate = adapter.ReadOpts.TrackRates(track)
+	} else {
+		r.rpm, r.bitRate = r.rates.Rates(track)
+	}
+
+	// Pass flux transitions of the first revolution for analysis
+	if adapter.AnalysisEnabled() {
+		if revs := track.Revolutions(); len(revs) > 0 {
+			adapter.ReportFlux(cyl, side, revs[0].Transitions)
+		}
+	}
 
-			// Store MFM bitstream in appropriate side
-			if head == 0 {
-				disk.Tracks[cyl].Side0 = mfmBitstream
-			} else {
-				disk.Tracks[cyl].Side1 = mfmBitstream
+	// Decode flux data to MFM bitstream
+	mfmBitstream, adjust, err := r.recovery.DecodeMFM(track, r.bitRate)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: side, Err: fmt.Errorf("failed to decode flux data to MFM: %w", err)}
+	}
+	if !r.single {
+		r.rates.Add(cyl, side, track)
+		if len(r.rates.Measurements) == 1 && adapter.ReadOpts.BitRate == 0 {
+			c.warnLinkSpeed(int(r.bitRate))
+		}
+	}
+	if adjust != 0 {
+		fmt.Printf("\nWarning: track %d, side %d: decoded at %+.1f%% bit rate\n", cyl, side, adjust*100)
+	}
+	if r.recovery.Weak {
+		fmt.Printf("\nWarning: track %d, side %d: weak PLL lock, phase error %.1f%% RMS at %.0f ns period\n",
+			cyl, side, r.recovery.Lock.LockQuality*100, r.recovery.Lock.PeriodNs)
+	}
+
+	// Read the track again, until all sectors are decoded twice the same way
+	if adapter.ReadOpts.Verify {
+		mfmBitstream, err = r.verifier.Track(cyl, side, mfmBitstream, func() ([]byte, error) {
+			track, err := c.readTrackRetry()
+			if err != nil {
+				return nil, err
 			}
+			return r.recovery.DecodeRevolutionMFM(track, 0, r.bitRate, adjust)
+		})
+		if err != nil {
+			return nil, &adapter.TrackError{Cyl: cyl, Head: side, Err: err}
 		}
 	}
-	fmt.Printf("\nRead complete.\n")
 
-	return disk, nil
+	// Pass alignment of sectors to the index for analysis
+	adapter.ReportLayout(cyl, side, mfmBitstream, r.bitRate)
+
+	capture := &adapter.TrackCapture{
+		Cyl:     cyl,
+		Head:    side,
+		BitRate: r.bitRate,
+		RPM:     r.rpm,
+		Flux:    track,
+		Lock:    r.recovery.Lock,
+	}
+	capture.MFM, capture.Index = adapter.RevolutionMFM(mfmBitstream, r.bitRate, r.rpm)
+	r.weak.Detect(capture)
+	r.locks.Add(capture)
+	return capture, nil
 }
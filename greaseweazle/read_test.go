@@ -0,0 +1,444 @@
+package greaseweazle
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Build a Greaseweazle flux stream for one HD track, enclosed between two index pulses.
+func makeTestFluxHD(tb testing.TB, sampleFreqHz uint32) []byte {
+	sectors := make([][]byte, 18)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		for j := range sectors[i] {
+			sectors[i][j] = byte(i + j)
+		}
+	}
+	writer := mfm.NewWriter(200000)
+	track := writer.EncodeTrackIBMPC(sectors, 0, 0, 18, 500)
+	transitions, err := mfm.GenerateFluxTransitions(track, 500)
+	if err != nil {
+		tb.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+
+	stream := encodeFluxStream(transitions, sampleFreqHz)
+	stream = stream[:len(stream)-1] // Remove terminating null byte
+
+	var flux []byte
+	flux = append(flux, 0xFF, FLUXOP_INDEX)
+	flux = append(flux, encodeN28(0)...)
+	flux = append(flux, stream...)
+	flux = append(flux, 0xFF, FLUXOP_INDEX)
+	flux = append(flux, encodeN28(0)...)
+	return flux
+}
+
+func TestFluxTrack(t *testing.T) {
+	c := &Client{firmwareInfo: FirmwareInfo{SampleFreqHz: 72000000}}
+	flux := makeTestFluxHD(t, c.firmwareInfo.SampleFreqHz)
+
+	track, err := c.fluxTrack(flux)
+	if err != nil {
+		t.Fatalf("fluxTrack failed: %v", err)
+	}
+	if len(track.IndexPulses) != 2 || track.IndexPulses[0] != 0 {
+		t.Errorf("index pulses %v", track.IndexPulses)
+	}
+	if rpm, rate := track.NominalRPM(), track.EstimateBitRateKbps(); rpm != 300 || rate != 500 {
+		t.Errorf("estimated %d RPM, %d kbps, expected 300 RPM, 500 kbps", rpm, rate)
+	}
+
+	bitcells, err := track.DecodeMFM(500, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(bitcells).CountSectorsIBMPC(); n != 18 {
+		t.Errorf("decoded %d sectors, expected 18", n)
+	}
+}
+
+func BenchmarkDecodeFluxToMFM(b *testing.B) {
+	c := &Client{firmwareInfo: FirmwareInfo{SampleFreqHz: 72000000}}
+	flux := makeTestFluxHD(b, c.firmwareInfo.SampleFreqHz)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		track, err := c.fluxTrack(flux)
+		if err != nil {
+			b.Fatalf("fluxTrack failed: %v", err)
+		}
+		_, err = track.DecodeMFM(500, pll.Config{})
+		if err != nil {
+			b.Fatalf("DecodeMFM failed: %v", err)
+		}
+	}
+}
+
+func TestDecodeFluxToMFM_SampleFreq(t *testing.T) {
+	sectors := make([][]byte, 18)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+	}
+	track := mfm.NewWriter(200000).EncodeTrackIBMPC(sectors, 0, 0, 18, 500)
+	expected := len(track) * 8
+
+	for _, freq := range []uint32{24000000, 72000000, 84000000} {
+		c := &Client{firmwareInfo: FirmwareInfo{SampleFreqHz: freq}}
+		flux := makeTestFluxHD(t, freq)
+		track, err := c.fluxTrack(flux)
+		if err != nil {
+			t.Fatalf("%d Hz: fluxTrack failed: %v", freq, err)
+		}
+		bitcells, err := track.DecodeMFM(500, pll.Config{})
+		if err != nil {
+			t.Fatalf("%d Hz: DecodeMFM failed: %v", freq, err)
+		}
+
+		// Bitcell count within 0.1% of the encoded track
+		got := len(bitcells) * 8
+		if diff := got - expected; diff*1000 > expected || -diff*1000 > expected {
+			t.Errorf("%d Hz: recovered %d bitcells, expected %d", freq, got, expected)
+		}
+		if n := mfm.NewReader(bitcells).CountSectorsIBMPC(); n != 18 {
+			t.Errorf("%d Hz: decoded %d sectors, expected 18", freq, n)
+		}
+	}
+}
+
+// Flux captured before the first index and after the second one
+// must not make the decoded track longer than one revolution.
+func TestFluxTrack_OneRevolution(t *testing.T) {
+	c := &Client{firmwareInfo: FirmwareInfo{SampleFreqHz: 72000000}}
+	rev := makeTestFluxHD(t, c.firmwareInfo.SampleFreqHz)
+	rev = rev[:len(rev)-6] // Drop the trailing index
+
+	// Partial revolution as lead-in, then two full revolutions
+	var flux []byte
+	flux = append(flux, rev[len(rev)/2:]...)
+	flux = append(flux, rev...)
+	flux = append(flux, rev...)
+	flux = append(flux, 0xFF, FLUXOP_INDEX)
+	flux = append(flux, encodeN28(0)...)
+
+	track, err := c.fluxTrack(flux)
+	if err != nil {
+		t.Fatalf("fluxTrack failed: %v", err)
+	}
+	if len(track.IndexPulses) != 3 {
+		t.Fatalf("index pulses %v", track.IndexPulses)
+	}
+	bitcells, err := track.DecodeMFM(500, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+
+	// One revolution at 500 kbps, 300 RPM: bitRate*60/RPM data bits, two bitcells each
+	expected := 500000 * 60 / 300 * 2
+	got := len(bitcells) * 8
+	if diff := got - expected; diff*200 > expected || -diff*200 > expected {
+		t.Errorf("recovered %d bitcells, expected %d", got, expected)
+	}
+	if n := mfm.NewReader(bitcells).CountSectorsIBMPC(); n != 18 {
+		t.Errorf("decoded %d sectors, expected 18", n)
+	}
+}
+
+func TestEncodeFluxStream_NoDrift(t *testing.T) {
+	// 100000 transitions of 2.001 usec: rounding of every interval
+	// must not accumulate over the track
+	const freq = 72000000
+	transitions := make([]uint64, 100000)
+	for i := range transitions {
+		transitions[i] = uint64(i+1) * 2001
+	}
+	stream := encodeFluxStream(transitions, freq)
+
+	total := uint64(0)
+	for _, b := range stream {
+		if b == 0 {
+			break
+		}
+		total += uint64(b)
+	}
+	expected := uint64(100000 * 2001 * freq / 1e9)
+	if total+1 < expected || total > expected+1 {
+		t.Errorf("total %d ticks, expected %d", total, expected)
+	}
+}
+
+func TestReadTrackRetry(t *testing.T) {
+	const sampleFreq = 72000000
+	defer func(spinUp int) { config.SpinUp = spinUp }(config.SpinUp)
+	config.SpinUp = 0
+	flux := makeTestFluxHD(t, sampleFreq)
+
+	// Queue one track read, ending with given flux status
+	writeTrack := func(port *fakePort, status byte) {
+		port.rx.Write([]byte{CMD_READ_FLUX, ACK_OKAY})
+		port.rx.Write(flux)
+		port.rx.WriteByte(0)
+		port.rx.Write([]byte{CMD_GET_FLUX_STATUS, status})
+	}
+
+	// Read the track through the retry policy of all adapters
+	readTrack := func(c *Client) (*adapter.TrackFailures, int) {
+		failures := &adapter.TrackFailures{}
+		transitions := 0
+		failures.Read(0, 0, func() error {
+			track, err := c.readTrackRetry()
+			if err == nil {
+				transitions = len(track.Transitions)
+			}
+			return err
+		})
+		return failures, transitions
+	}
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts.Retries = 2
+
+	t.Run("recovered", func(t *testing.T) {
+		port := &fakePort{}
+		writeTrack(port, ACK_FLUX_OVERFLOW)
+		writeRevolutions(port, sampleFreq, 200)
+		writeRevolutions(port, sampleFreq, 200)
+		writeTrack(port, ACK_OKAY)
+
+		c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+		failures, transitions := readTrack(c)
+		if failures.Good != 1 || failures.Retries != 1 || transitions == 0 {
+			t.Errorf("%d tracks read with %d retries, %d transitions", failures.Good, failures.Retries, transitions)
+		}
+		if port.rx.Len() != 0 {
+			t.Errorf("%d bytes left unread", port.rx.Len())
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		// Track is read once, then ReadOpts.Retries times again,
+		// with a spin-up check after every failed read
+		port := &fakePort{}
+		for i := 0; i <= adapter.ReadOpts.Retries; i++ {
+			writeTrack(port, ACK_FLUX_OVERFLOW)
+			writeRevolutions(port, sampleFreq, 200)
+			writeRevolutions(port, sampleFreq, 200)
+		}
+
+		c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+		failures, _ := readTrack(c)
+		if len(failures.Tracks) != 1 || !errors.Is(failures.Tracks[0], adapter.ErrOverflow) ||
+			failures.Retries != adapter.ReadOpts.Retries {
+			t.Errorf("failed tracks %v, %d retries", failures.Tracks, failures.Retries)
+		}
+		if port.rx.Len() != 0 {
+			t.Errorf("%d bytes left unread", port.rx.Len())
+		}
+	})
+}
+
+func TestFluxTrack_Revolutions(t *testing.T) {
+	c := &Client{firmwareInfo: FirmwareInfo{SampleFreqHz: 72000000}}
+
+	// Three revolutions with different flux intervals, in ticks.
+	// Transitions are half an interval away from every index pulse.
+	intervals := []int{100, 150, 200}
+	const perRevolution = 1000
+	var flux []byte
+	prevHalf := 0
+	for _, interval := range intervals {
+		flux = append(flux, 0xFF, FLUXOP_INDEX)
+		flux = append(flux, encodeN28(uint32(prevHalf))...)
+		flux = append(flux, byte(prevHalf+interval/2))
+		for i := 1; i < perRevolution; i++ {
+			flux = append(flux, byte(interval))
+		}
+		prevHalf = interval / 2
+	}
+	flux = append(flux, 0xFF, FLUXOP_INDEX)
+	flux = append(flux, encodeN28(uint32(prevHalf))...)
+
+	track, err := c.fluxTrack(flux)
+	if err != nil {
+		t.Fatalf("fluxTrack failed: %v", err)
+	}
+	revs := track.Revolutions()
+	if len(revs) != 3 {
+		t.Fatalf("decoded %d revolutions, expected 3", len(revs))
+	}
+	tickNs := 1e9 / 72e6
+	for r, rev := range revs {
+		if len(rev.Transitions) != perRevolution {
+			t.Errorf("revolution %d: %d transitions, expected %d", r, len(rev.Transitions), perRevolution)
+		}
+		want := float64(perRevolution*intervals[r]) * tickNs
+		if diff := float64(rev.Duration()) - want; diff < -1 || diff > 1 {
+			t.Errorf("revolution %d: duration %d ns, expected %.0f ns", r, rev.Duration(), want)
+		}
+		if diff := float64(rev.Transitions[0]) - float64(intervals[r]/2)*tickNs; diff < -1 || diff > 1 {
+			t.Errorf("revolution %d: first transition at %d ns", r, rev.Transitions[0])
+		}
+	}
+}
+
+// drivePort answers every command like a drive with the same HD track
+// on every cylinder, and records cylinders and heads selected
+type drivePort struct {
+	fakePort
+	flux   []byte   // Reply to READ_FLUX
+	info   []byte   // Reply to GET_INFO, zeros when nil
+	tracks [][2]int // Cylinder and head of every head selection
+	maxCyl int      // Farthest cylinder stepped to
+	cyl    int      // Current position of the head
+}
+
+func (p *drivePort) Write(buf []byte) (int, error) {
+	p.tx.Write(buf)
+	p.rx.Write([]byte{buf[0], ACK_OKAY})
+	switch buf[0] {
+	case CMD_SEEK:
+		p.cyl = int(int8(buf[2]))
+		p.maxCyl = max(p.maxCyl, p.cyl)
+	case CMD_HEAD:
+		p.tracks = append(p.tracks, [2]int{p.cyl, int(buf[2])})
+	case CMD_GET_INFO:
+		if p.info == nil {
+			p.info = make([]byte, 32)
+		}
+		p.rx.Write(p.info)
+	case CMD_READ_FLUX:
+		p.rx.Write(p.flux)
+		p.rx.WriteByte(0)
+	}
+	return len(buf), nil
+}
+
+func TestRead_AllCylinders(t *testing.T) {
+	const sampleFreq = 72000000
+	defer func(cyls, heads, spinUp int) { config.Cyls, config.Heads, config.SpinUp = cyls, heads, spinUp }(
+		config.Cyls, config.Heads, config.SpinUp)
+	config.Cyls, config.Heads, config.SpinUp = 82, 2, 0
+
+	port := &drivePort{flux: makeTestFluxHD(t, sampleFreq)}
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+	disk, err := c.Read(82, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if len(disk.Tracks) != 82 || len(disk.Tracks[81].Side1) == 0 {
+		t.Errorf("read %d cylinders, expected 82 with both sides", len(disk.Tracks))
+	}
+
+	// Every track is read once, in order of cylinders and heads
+	var expected [][2]int
+	for cyl := 0; cyl < 82; cyl++ {
+		expected = append(expected, [2]int{cyl, 0}, [2]int{cyl, 1})
+	}
+	if !reflect.DeepEqual(port.tracks, expected) || port.maxCyl != 81 {
+		t.Errorf("read tracks %v up to cylinder %d, expected cylinders 0-81 with heads 0 and 1",
+			port.tracks, port.maxCyl)
+	}
+}
+
+func TestReadTrack(t *testing.T) {
+	const sampleFreq = 72000000
+	defer func(cyls, heads, spinUp int) { config.Cyls, config.Heads, config.SpinUp = cyls, heads, spinUp }(
+		config.Cyls, config.Heads, config.SpinUp)
+	config.Cyls, config.Heads, config.SpinUp = 80, 2, 0
+
+	port := &drivePort{flux: makeTestFluxHD(t, sampleFreq)}
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+	for i := 0; i < 2; i++ {
+		capture, err := c.ReadTrack(5, 1)
+		if err != nil {
+			t.Fatalf("ReadTrack() error: %v", err)
+		}
+		if capture.Cyl != 5 || capture.Head != 1 || capture.BitRate != 500 || capture.RPM != 300 {
+			t.Errorf("capture of cylinder %d, head %d at %d kbps, %d RPM",
+				capture.Cyl, capture.Head, capture.BitRate, capture.RPM)
+		}
+		if n := mfm.NewReader(capture.MFM).CountSectorsIBMPC(); n != 18 {
+			t.Errorf("decoded %d sectors, expected 18", n)
+		}
+		if capture.Flux == nil || len(capture.Flux.IndexPulses) != 2 {
+			t.Errorf("flux of the capture is missing")
+		}
+	}
+
+	// Only the requested track is read, without stepping elsewhere
+	expected := [][2]int{{5, 1}, {5, 1}}
+	if !reflect.DeepEqual(port.tracks, expected) || port.maxCyl != 5 {
+		t.Errorf("read tracks %v up to cylinder %d, expected %v", port.tracks, port.maxCyl, expected)
+	}
+
+	// No such track
+	if _, err := c.ReadTrack(80, 0); err == nil {
+		t.Errorf("ReadTrack() accepted cylinder 80")
+	}
+	if _, err := c.ReadTrack(0, 2); err == nil {
+		t.Errorf("ReadTrack() accepted head 2")
+	}
+}
+
+// lostPort drops off the bus when the given head selection is sent
+type lostPort struct {
+	drivePort
+	heads int // Head selections made before the device is lost
+}
+
+func (p *lostPort) Write(buf []byte) (int, error) {
+	if buf[0] == CMD_HEAD {
+		if p.heads == 0 {
+			return 0, io.EOF
+		}
+		p.heads--
+	}
+	return p.drivePort.Write(buf)
+}
+
+func TestReadReconnect(t *testing.T) {
+	const sampleFreq = 72000000
+	defer func(cyls, heads, spinUp int) { config.Cyls, config.Heads, config.SpinUp = cyls, heads, spinUp }(
+		config.Cyls, config.Heads, config.SpinUp)
+	config.Cyls, config.Heads, config.SpinUp = 3, 2, 0
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts = adapter.ReadOptions{Sides: "both", EndTrack: -1, MaxReconnects: 1}
+	defer func(delay time.Duration) { adapter.ReconnectDelay = delay }(adapter.ReconnectDelay)
+	adapter.ReconnectDelay = time.Millisecond
+
+	// Device drops off the bus when selecting head 0 of the second cylinder
+	flux := makeTestFluxHD(t, sampleFreq)
+	lost := &lostPort{drivePort: drivePort{flux: flux}, heads: 2}
+	found := &drivePort{flux: flux, info: makeFirmwareInfo(1, 5, 4, sampleFreq)}
+	opened := 0
+	c := &Client{port: lost, firmwareInfo: FirmwareInfo{SampleFreqHz: sampleFreq}}
+	c.openPort = func() (Port, error) {
+		opened++
+		return found, nil
+	}
+	disk, err := c.Read(3, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	for cyl := range disk.Tracks {
+		if len(disk.Tracks[cyl].Side0) == 0 || len(disk.Tracks[cyl].Side1) == 0 {
+			t.Errorf("cylinder %d is not read", cyl)
+		}
+	}
+
+	// Reading resumes from the lost track, on the reopened port
+	expected := [][2]int{{1, 0}, {1, 1}, {2, 0}, {2, 1}}
+	if opened != 1 || c.port != found || !reflect.DeepEqual(found.tracks, expected) {
+		t.Errorf("port opened %d times, read tracks %v after reconnect, expected %v", opened, found.tracks, expected)
+	}
+	if c.firmwareInfo.SampleFreqHz != sampleFreq {
+		t.Errorf("sample frequency %d after reconnect", c.firmwareInfo.SampleFreqHz)
+	}
+}
@@ -0,0 +1,128 @@
+package greaseweazle
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+)
+
+// Spin-up parameters
+const (
+	SpinUpTimeout   = 2 * time.Second        // Default time to wait for stable rotation
+	SpinUpTolerance = 0.01                   // Allowed difference between consecutive index periods
+	SpinUpPollDelay = 100 * time.Millisecond // Pause after a poll without index pulses
+)
+
+// Longest time the motor is left running between operations.
+// Firmware turns the motor off by itself when the host is silent
+// for watchdog time, 10 seconds by default.
+const MotorIdleLimit = 9 * time.Second
+
+// Leave the motor running between operations, until idle time expires
+func (c *Client) keepMotor() {
+	c.motor.Stop = c.stopMotor
+	c.motor.MaxIdle = MotorIdleLimit
+	c.busy.Motor = &c.motor
+}
+
+// Turn on the motor of the selected drive and wait until the disk spins up.
+// Motor left running by the previous operation is used as is.
+// When the disk does not spin up, the motor is turned off.
+func (c *Client) startMotor() error {
+	if c.motor.Running() && c.motorSpinning() {
+		return nil
+	}
+	err := c.SetMotor(c.drive, true)
+	if err != nil {
+		return fmt.Errorf("failed to turn on motor: %w", err)
+	}
+	c.motor.SetRunning(true)
+	err = c.waitSpinUp()
+	if err != nil {
+		c.motor.Off()
+	}
+	return err
+}
+
+// Check that firmware has not stopped the motor on watchdog timeout.
+// Older firmware cannot tell: assume the motor is running.
+func (c *Client) motorSpinning() bool {
+	info, err := c.FetchDriveInfo(c.drive)
+	return err != nil || info.MotorOn()
+}
+
+// Turn off the motor and deselect the drive, when idle
+func (c *Client) stopMotor() error {
+	err := c.SetMotor(c.drive, false)
+	if err != nil {
+		return fmt.Errorf("failed to turn off motor: %w", err)
+	}
+	err = c.DeselectDrive()
+	if err != nil {
+		return fmt.Errorf("failed to deselect drive: %w", err)
+	}
+	return nil
+}
+
+// StopMotor turns off the motor left running after the last operation
+func (c *Client) StopMotor() error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+	return c.motor.Off()
+}
+
+// Wait until rotation speed is stable.
+// Index period is measured repeatedly, until two consecutive periods
+// agree within 1%. Returns adapter.ErrNoIndex when the disk does not
+// spin up in time, for example when no disk is inserted.
+func (c *Client) waitSpinUp() error {
+	timeout := SpinUpTimeout
+	if config.SpinUp != 0 {
+		timeout = time.Duration(config.SpinUp) * time.Millisecond
+	}
+	deadline := time.Now().Add(timeout)
+
+	// Limit every poll to 500 msec: enough for two index pulses at 300 RPM
+	ticks := c.firmwareInfo.SampleFreqHz / 2
+
+	lastPeriod := 0.0
+	for {
+		period, err := c.indexPeriod(ticks)
+		if err != nil && !adapter.IsRetryable(err) {
+			return fmt.Errorf("failed to wait for spin-up: %w", err)
+		}
+		if period > 0 && lastPeriod > 0 && math.Abs(period-lastPeriod) <= lastPeriod*SpinUpTolerance {
+			return nil
+		}
+		lastPeriod = period
+		if period == 0 {
+			time.Sleep(SpinUpPollDelay)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("disk did not spin up within %v: %w", timeout, adapter.ErrNoIndex)
+		}
+	}
+}
+
+// Measure one index period in nanoseconds, limited by the given number of ticks.
+// Returns zero when less than two index pulses were seen.
+func (c *Client) indexPeriod(ticks uint32) (float64, error) {
+	fluxData, err := c.ReadFlux(ticks, 2)
+	if err != nil {
+		return 0, err
+	}
+	err = c.GetFluxStatus()
+	if err != nil {
+		return 0, err
+	}
+	indexPulses := c.indexPulseTimes(fluxData)
+	if len(indexPulses) < 2 {
+		return 0, nil
+	}
+	return indexPulses[1] - indexPulses[0], nil
+}
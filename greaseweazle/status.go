@@ -3,9 +3,10 @@ package greaseweazle
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
 
+	"github.com/sergev/floppy/adapter"
 	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/hfe"
 )
 
 // fetchBwStats retrieves bandwidth statistics from the Greaseweazle device
@@ -21,7 +22,7 @@ func (c *Client) fetchBwStats() (BwStats, error) {
 
 	// Read 16-byte response (4 uint32_t values in little-endian format)
 	response := make([]byte, 16)
-	_, err = io.ReadFull(c.port, response)
+	err = c.receive("GET_INFO BW_STATS", response)
 	if err != nil {
 		return stats, fmt.Errorf("failed to read BW_STATS response: %w", err)
 	}
@@ -44,14 +45,14 @@ func (c *Client) fetchBwStats() (BwStats, error) {
 func (c *Client) getPinValue(pin byte) (bool, error) {
 	// Send CMD_GET_PIN command: [CMD_GET_PIN, length=3, pin#]
 	cmd := []byte{CMD_GET_PIN, 3, pin}
-	_, err := c.port.Write(cmd)
+	err := c.send("GET_PIN", cmd)
 	if err != nil {
 		return false, fmt.Errorf("failed to write command: %w", err)
 	}
 
 	// Read ACK response (2 bytes: command echo, status)
 	ack := make([]byte, 2)
-	_, err = io.ReadFull(c.port, ack)
+	err = c.receive("GET_PIN ACK", ack)
 	if err != nil {
 		return false, fmt.Errorf("failed to read ACK: %w", err)
 	}
@@ -73,7 +74,7 @@ func (c *Client) getPinValue(pin byte) (bool, error) {
 
 	// Read pin level byte (1=High, 0=Low)
 	pinLevel := make([]byte, 1)
-	_, err = io.ReadFull(c.port, pinLevel)
+	err = c.receive("GET_PIN level", pinLevel)
 	if err != nil {
 		return false, fmt.Errorf("failed to read pin level: %w", err)
 	}
@@ -136,11 +137,11 @@ func (c *Client) PrintRotationSpeed() {
 		return
 	}
 
-	err = c.SetMotor(0, true)
+	err = c.SetMotor(c.drive, true)
 	if err != nil {
 		return
 	}
-	defer c.SetMotor(0, false) // Turn off motor when done
+	defer c.SetMotor(c.drive, false) // Turn off motor when done
 
 	// Read flux data (0 ticks = no limit, 2 index pulses = 2 revolutions)
 	fluxData, err := c.ReadFlux(0, 2)
@@ -151,49 +152,155 @@ func (c *Client) PrintRotationSpeed() {
 	fmt.Printf("Floppy Disk: Inserted\n")
 
 	// Calculate RPM from first track (cylinder 0, head 0)
-	rpm, _ := c.calculateRPMAndBitRate(fluxData)
-	if rpm > 0 {
-		fmt.Printf("Rotation Speed: %d RPM\n", rpm)
+	track, err := c.fluxTrack(fluxData)
+	if err == nil && track.RPM() > 0 {
+		fmt.Printf("Rotation Speed: %.0f RPM\n", track.RPM())
+	}
+}
+
+// Extract index pulse times from flux data, in nanoseconds
+func (c *Client) indexPulseTimes(fluxData []byte) []float64 {
+	var indexPulses []float64
+
+	tickPeriodNs := 1e9 / float64(c.firmwareInfo.SampleFreqHz) // Nanoseconds per tick
+	ticksAccumulated := uint64(0)
+
+	i := 0
+	for i < len(fluxData) {
+		b := fluxData[i]
+		if b == 0xFF {
+			// Special opcode
+			if i+1 >= len(fluxData) {
+				break
+			}
+			opcode := fluxData[i+1]
+			i += 2
+
+			n28, consumed, err := readN28(fluxData, i)
+			if err != nil {
+				break
+			}
+			i += consumed
+			switch opcode {
+			case FLUXOP_INDEX:
+				indexTime := ticksAccumulated + uint64(n28)
+				indexPulses = append(indexPulses, float64(indexTime)*tickPeriodNs)
+			case FLUXOP_SPACE:
+				ticksAccumulated += uint64(n28)
+			}
+		} else if b < 250 {
+			// Direct interval: 1-249 ticks
+			ticksAccumulated += uint64(b)
+			i++
+		} else {
+			// Extended interval: 250-254
+			if i+1 >= len(fluxData) {
+				break
+			}
+			ticksAccumulated += 250 + uint64(b-250)*255 + uint64(fluxData[i+1]) - 1
+			i += 2
+		}
+	}
+	return indexPulses
+}
+
+// MeasureRPM measures rotation speed over the given number of revolutions.
+// Returns mean speed and its standard deviation, in RPM.
+func (c *Client) MeasureRPM(revolutions int) (float64, float64, error) {
+	if err := c.busy.Begin(); err != nil {
+		return 0, 0, err
+	}
+	defer c.busy.End()
+
+	if revolutions < 1 || revolutions > 0xfffe {
+		return 0, 0, fmt.Errorf("invalid number of revolutions: %d", revolutions)
+	}
+
+	// Use head 0 of the selected drive
+	err := c.SelectDrive(c.drive)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to select drive: %w", err)
+	}
+	err = c.SetHead(0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to set head: %w", err)
+	}
+	err = c.startMotor()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Read flux data until one more index pulse than revolutions
+	fluxData, err := c.ReadFlux(0, uint16(revolutions+1))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read flux data: %w", err)
+	}
+	err = c.GetFluxStatus()
+	if err != nil {
+		return 0, 0, fmt.Errorf("flux status error: %w", err)
+	}
+
+	indexPulses := c.indexPulseTimes(fluxData)
+	if len(indexPulses) < revolutions+1 {
+		return 0, 0, fmt.Errorf("found only %d index pulses, expected %d", len(indexPulses), revolutions+1)
+	}
+	periods := make([]float64, revolutions)
+	for i := range periods {
+		periods[i] = indexPulses[i+1] - indexPulses[i]
+	}
+	return adapter.RPMStats(periods)
+}
+
+// Describe returns identification of the adapter for image manifest
+func (c *Client) Describe() hfe.ManifestDevice {
+	fw := c.firmwareInfo
+	return hfe.ManifestDevice{
+		Adapter:      "Greaseweazle",
+		SerialNumber: c.serialNumber,
+		Hardware:     fmt.Sprintf("%s (%d.%d)", fw.ModelName(), fw.HwModel, fw.HwSubmodel),
+		Firmware:     fmt.Sprintf("%d.%d", fw.FwMajor, fw.FwMinor),
 	}
 }
 
 // PrintStatus prints all firmware information to stdout
 func (c *Client) PrintStatus() {
+	if err := c.busy.Begin(); err != nil {
+		fmt.Printf("Status unavailable: %v\n", err)
+		return
+	}
+	defer c.busy.End()
+
 	fw := c.firmwareInfo
 
 	usbSpeedStr := "Unknown"
 	switch fw.USBSpeed {
-	case 0:
+	case USB_FULL_SPEED:
 		usbSpeedStr = "Full Speed"
-	case 1:
+	case USB_HIGH_SPEED:
 		usbSpeedStr = "High Speed"
 	default:
 		usbSpeedStr = fmt.Sprintf("Unknown (%d)", fw.USBSpeed)
 	}
 
-	// Map hardware model to MCU name
-	mcuName := "Unknown"
-	switch fw.HwModel {
-	case 1:
-		mcuName = "STM32F1"
-	case 7:
-		mcuName = "STM32F7"
-	case 4:
-		mcuName = "AT32F4"
-	default:
-		mcuName = fmt.Sprintf("Unknown (model %d)", fw.HwModel)
-	}
-
 	fmt.Printf("Greaseweazle Firmware Version: %d.%d\n", fw.FwMajor, fw.FwMinor)
 	fmt.Printf("Serial Number: %s\n", c.serialNumber)
 	fmt.Printf("Max Command: %d\n", fw.MaxCmd)
+	if missing := fw.missingCommands(); missing != "" {
+		fmt.Printf("Warning: firmware lacks %s, please update\n", missing)
+	}
 	fmt.Printf("Sample Frequency: %.1f MHz\n", float64(fw.SampleFreqHz)*1.0e-6)
-	fmt.Printf("Hardware Model: %d.%d\n", fw.HwModel, fw.HwSubmodel)
+	fmt.Printf("Hardware Model: %s (%d.%d)\n", fw.ModelName(), fw.HwModel, fw.HwSubmodel)
 	fmt.Printf("USB Speed: %s\n", usbSpeedStr)
-	fmt.Printf("MCU: %s\n", mcuName)
+	fmt.Printf("MCU: %s\n", fw.MCUName())
 	fmt.Printf("MCU Clock: %d MHz\n", fw.MCUMhz)
 	fmt.Printf("MCU SRAM: %d KB\n", fw.MCUSRAMKB)
-	fmt.Printf("USB Buffer: %d KB\n", fw.USBBufKB)
+	fmt.Printf("USB Buffer: %d KB (%s)\n", fw.usbBufferKB(), fw.linkSummary())
+
+	// Display drive timing parameters
+	c.PrintDriveParams()
+
+	// Display state of both drives
+	c.PrintDriveInfo()
 
 	// Display bandwidth statistics
 	//c.PrintBwStats()
@@ -201,11 +308,13 @@ func (c *Client) PrintStatus() {
 	// Display pin status
 	//c.PrintPins()
 
-	// Show whether drive 0 is connected.
+	fmt.Printf("Drive Unit: %d\n", c.drive)
+
+	// Show whether the drive is connected.
 	// Reset, then try to seek to track #0.
 	driveIsConnected := (c.Reset() == nil) &&
 		(c.SetBusType() == nil) &&
-		(c.SelectDrive(0) == nil) &&
+		(c.SelectDrive(c.drive) == nil) &&
 		(c.Seek(0) == nil)
 	if !driveIsConnected {
 		fmt.Printf("Floppy Drive: Not detected\n")
@@ -0,0 +1,65 @@
+package greaseweazle
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+)
+
+// Adapter name in trace events
+const traceName = "greaseweazle"
+
+// Names of commands in trace events
+var commandNames = map[byte]string{
+	CMD_GET_INFO:        "GET_INFO",
+	CMD_UPDATE:          "UPDATE",
+	CMD_SEEK:            "SEEK",
+	CMD_HEAD:            "HEAD",
+	CMD_SET_PARAMS:      "SET_PARAMS",
+	CMD_GET_PARAMS:      "GET_PARAMS",
+	CMD_MOTOR:           "MOTOR",
+	CMD_READ_FLUX:       "READ_FLUX",
+	CMD_WRITE_FLUX:      "WRITE_FLUX",
+	CMD_GET_FLUX_STATUS: "GET_FLUX_STATUS",
+	CMD_SWITCH_FW_MODE:  "SWITCH_FW_MODE",
+	CMD_SELECT:          "SELECT",
+	CMD_DESELECT:        "DESELECT",
+	CMD_SET_BUS_TYPE:    "SET_BUS_TYPE",
+	CMD_SET_PIN:         "SET_PIN",
+	CMD_RESET:           "RESET",
+	CMD_ERASE_FLUX:      "ERASE_FLUX",
+	CMD_SOURCE_BYTES:    "SOURCE_BYTES",
+	CMD_SINK_BYTES:      "SINK_BYTES",
+	CMD_GET_PIN:         "GET_PIN",
+}
+
+// Name of command code, like "GET_INFO"
+func commandName(code byte) string {
+	if name, ok := commandNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("CMD_%d", code)
+}
+
+// Report bytes transferred since start
+func trace(dir adapter.TraceDirection, command string, data []byte, start time.Time, err error) {
+	adapter.Trace(traceName, dir, command, data, start, err)
+}
+
+// Write bytes to the device, and trace them
+func (c *Client) send(command string, data []byte) error {
+	start := time.Now()
+	_, err := c.port.Write(data)
+	trace(adapter.TraceToDevice, command, data, start, err)
+	return err
+}
+
+// Read a reply of known size from the device, and trace it
+func (c *Client) receive(command string, buf []byte) error {
+	start := time.Now()
+	n, err := io.ReadFull(c.port, buf)
+	trace(adapter.TraceFromDevice, command, buf[:n], start, err)
+	return err
+}
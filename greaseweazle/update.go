@@ -0,0 +1,178 @@
+package greaseweazle
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sergev/floppy/adapter"
+)
+
+// Firmware modes for CMD_SWITCH_FW_MODE
+const (
+	FW_MODE_BOOTLOADER  = 0
+	FW_MODE_APPLICATION = 1
+)
+
+// Firmware update parameters
+const (
+	UpdateChunkSize = 4096        // Bytes per write when streaming firmware image
+	MaxImageSize    = 1024 * 1024 // Sanity limit for firmware image size
+)
+
+// FirmwareImage describes a firmware image for a particular hardware model.
+// Image ends with 8-byte footer: signature "GW", major and minor version,
+// hardware model (le16) and CRC16-CCITT (be16) over the whole image.
+type FirmwareImage struct {
+	FwMajor uint8
+	FwMinor uint8
+	HwModel uint16
+}
+
+// Calculate CRC16-CCITT (polynomial 0x1021, initial value 0xffff)
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// ParseFirmwareImage validates firmware image and returns its footer information
+func ParseFirmwareImage(image []byte) (FirmwareImage, error) {
+	var info FirmwareImage
+	if len(image) < 8 || len(image) > MaxImageSize {
+		return info, fmt.Errorf("invalid firmware image size %d", len(image))
+	}
+	if len(image)%4 != 0 {
+		return info, fmt.Errorf("firmware image size %d is not a multiple of 4", len(image))
+	}
+	footer := image[len(image)-8:]
+	if string(footer[0:2]) != "GW" {
+		return info, fmt.Errorf("bad firmware image signature")
+	}
+	if crc16CCITT(image) != 0 {
+		return info, fmt.Errorf("bad firmware image checksum")
+	}
+	info.FwMajor = footer[2]
+	info.FwMinor = footer[3]
+	info.HwModel = binary.LittleEndian.Uint16(footer[4:6])
+	return info, nil
+}
+
+// Switch between bootloader and main firmware, and reconnect to the device
+func (c *Client) switchFirmwareMode(mode byte) error {
+	cmd := []byte{CMD_SWITCH_FW_MODE, 3, mode}
+	err := c.doCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to switch firmware mode: %w", err)
+	}
+	return c.reconnect()
+}
+
+// Reopen the port after device reset.
+// Device re-enumeration may take a while, so retry with growing pauses
+// until the device responds to GET_INFO.
+func (c *Client) reconnect() error {
+	if c.openPort == nil {
+		return fmt.Errorf("port cannot be reopened")
+	}
+	c.port.Close()
+
+	return adapter.Reopen(func() error {
+		port, err := c.openPort()
+		if err != nil {
+			return err
+		}
+		c.port = port
+		fwInfo, err := c.fetchFirmwareVersion()
+		if err != nil {
+			port.Close()
+			return err
+		}
+		c.firmwareInfo = fwInfo
+		return nil
+	})
+}
+
+// UpdateFirmware writes new main firmware to the device.
+// The device is switched to bootloader if needed, and back to main firmware
+// when done. New firmware version is verified after update.
+func (c *Client) UpdateFirmware(firmwareImage []byte) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	// Validate image before sending anything
+	image, err := ParseFirmwareImage(firmwareImage)
+	if err != nil {
+		return err
+	}
+	if image.HwModel != uint16(c.firmwareInfo.HwModel) {
+		return fmt.Errorf("firmware image is for hardware model %d, device is model %d",
+			image.HwModel, c.firmwareInfo.HwModel)
+	}
+
+	// Enter bootloader
+	if c.firmwareInfo.IsMainFirmware {
+		err = c.switchFirmwareMode(FW_MODE_BOOTLOADER)
+		if err != nil {
+			return fmt.Errorf("failed to enter bootloader: %w", err)
+		}
+		if c.firmwareInfo.IsMainFirmware {
+			return fmt.Errorf("device did not enter bootloader")
+		}
+	}
+
+	// Send CMD_UPDATE command: [CMD_UPDATE, length=6, image length (le32)]
+	cmd := make([]byte, 6)
+	cmd[0] = CMD_UPDATE
+	cmd[1] = 6
+	binary.LittleEndian.PutUint32(cmd[2:6], uint32(len(firmwareImage)))
+	err = c.doCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to send UPDATE command: %w", err)
+	}
+
+	// Stream the image
+	for offset := 0; offset < len(firmwareImage); offset += UpdateChunkSize {
+		end := min(offset+UpdateChunkSize, len(firmwareImage))
+		err = c.send("firmware data", firmwareImage[offset:end])
+		if err != nil {
+			return fmt.Errorf("failed to write firmware at offset %d: %w", offset, err)
+		}
+	}
+
+	// Read final status byte
+	status := make([]byte, 1)
+	err = c.receive("UPDATE status", status)
+	if err != nil {
+		return fmt.Errorf("failed to read update status: %w", err)
+	}
+	if status[0] != ACK_OKAY {
+		return fmt.Errorf("firmware update failed with status %d", status[0])
+	}
+
+	// Return to main firmware and verify the version
+	err = c.switchFirmwareMode(FW_MODE_APPLICATION)
+	if err != nil {
+		return fmt.Errorf("failed to start main firmware: %w", err)
+	}
+	fw := c.firmwareInfo
+	if !fw.IsMainFirmware || fw.FwMajor != image.FwMajor || fw.FwMinor != image.FwMinor {
+		return fmt.Errorf("firmware version %d.%d after update, expected %d.%d",
+			fw.FwMajor, fw.FwMinor, image.FwMajor, image.FwMinor)
+	}
+	err = c.SetBusType()
+	if err != nil {
+		return fmt.Errorf("failed to set bus type: %w", err)
+	}
+	return nil
+}
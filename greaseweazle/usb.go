@@ -0,0 +1,161 @@
+package greaseweazle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+)
+
+// Hardware models
+const (
+	HW_MODEL_F1       = 1 // STM32F1, Greaseweazle F1
+	HW_MODEL_AT32     = 4 // AT32F4, Greaseweazle V4
+	HW_MODEL_F7       = 7 // STM32F7, Greaseweazle F7
+	HW_MODEL_ADAFRUIT = 8 // Adafruit Floppy, on RP2040 or SAMD51 boards
+)
+
+// USB speeds
+const (
+	USB_FULL_SPEED = 0 // 12 Mbit/s
+	USB_HIGH_SPEED = 1 // 480 Mbit/s
+)
+
+// Throughput of bulk transfers over USB in practice, bytes per second
+const (
+	fullSpeedThroughput = 1000 * 1024
+	highSpeedThroughput = 20 * 1024 * 1024
+)
+
+// Longest time the host may be late to read flux data,
+// which the buffer of the device must cover
+const hostLatency = 20 * time.Millisecond
+
+// Longest pause between reads of flux data
+const maxReadPause = 10 * time.Millisecond
+
+// Nominal bit rates of disk densities, in kbps
+var densities = []struct {
+	name    string
+	bitRate int
+}{
+	{"DD", 250},
+	{"HD", 500},
+	{"ED", 1000},
+}
+
+// How well the device keeps up with flux data of some density
+type linkStatus int
+
+const (
+	linkOK       linkStatus = iota // Enough throughput and buffer
+	linkMarginal                   // Overflow is likely when the host is busy
+	linkTooSlow                    // USB cannot carry flux data at this rate
+)
+
+func (s linkStatus) String() string {
+	switch s {
+	case linkOK:
+		return "OK"
+	case linkMarginal:
+		return "marginal"
+	default:
+		return "too slow"
+	}
+}
+
+// Flux data rate in bytes per second for the given bit rate in kbps.
+// One byte per transition, and MFM has a transition every 3 bit cells on average.
+func fluxByteRate(bitRate int) int {
+	return bitRate * 1000 * 2 / 3
+}
+
+// Older firmware does not report buffer size: assume it by hardware model
+func (fw *FirmwareInfo) usbBufferKB() int {
+	if fw.USBBufKB != 0 {
+		return int(fw.USBBufKB)
+	}
+	switch fw.HwModel {
+	case HW_MODEL_F1:
+		return 8
+	case HW_MODEL_F7:
+		return 64
+	default:
+		return 32
+	}
+}
+
+// F1 has no high speed USB, whatever is reported
+func (fw *FirmwareInfo) fullSpeed() bool {
+	return fw.USBSpeed != USB_HIGH_SPEED || fw.HwModel == HW_MODEL_F1
+}
+
+// Check whether USB link and buffer of the device keep up with the bit rate
+func (fw *FirmwareInfo) linkStatus(bitRate int) linkStatus {
+	throughput := highSpeedThroughput
+	if fw.fullSpeed() {
+		throughput = fullSpeedThroughput
+	}
+	rate := fluxByteRate(bitRate)
+	bufferTime := time.Duration(fw.usbBufferKB()*1024) * time.Second / time.Duration(rate)
+	switch {
+	case throughput < rate:
+		return linkTooSlow
+	case throughput < 2*rate || bufferTime < hostLatency:
+		return linkMarginal
+	default:
+		return linkOK
+	}
+}
+
+// Describe suitability for every density, like "OK for DD/HD, marginal for ED"
+func (fw *FirmwareInfo) linkSummary() string {
+	var parts []string
+	var names []string
+	status := linkOK
+	for i, d := range densities {
+		s := fw.linkStatus(d.bitRate)
+		if i > 0 && s != status {
+			parts = append(parts, fmt.Sprintf("%s for %s", status, strings.Join(names, "/")))
+			names = nil
+		}
+		status = s
+		names = append(names, d.name)
+	}
+	parts = append(parts, fmt.Sprintf("%s for %s", status, strings.Join(names, "/")))
+	return strings.Join(parts, ", ")
+}
+
+// readSizing describes how flux data is read from the device
+type readSizing struct {
+	chunk int           // Size of host read buffer in bytes
+	pause time.Duration // Pause after the device has been drained
+}
+
+// Size the host read buffer to hold the whole device buffer.
+// Full speed devices are drained without pauses. High speed devices
+// are given time to fill a quarter of their buffer at the ED rate.
+func (fw *FirmwareInfo) readSizing() readSizing {
+	bufBytes := fw.usbBufferKB() * 1024
+	sizing := readSizing{chunk: bufBytes}
+	if !fw.fullSpeed() {
+		fill := time.Duration(bufBytes/4) * time.Second / time.Duration(fluxByteRate(1000))
+		sizing.pause = min(fill, maxReadPause)
+	}
+	return sizing
+}
+
+// Warn when flux data at the given bit rate in kbps may overflow the device
+func (c *Client) warnLinkSpeed(bitRate int) {
+	fw := &c.firmwareInfo
+	if bitRate == 0 || fw.linkStatus(bitRate) == linkOK {
+		return
+	}
+	speed := "high"
+	if fw.fullSpeed() {
+		speed = "full"
+	}
+	adapter.Progressf("Warning: %s speed USB with %d KB buffer is %s for %d kbps, flux data may overflow\n",
+		speed, fw.usbBufferKB(), fw.linkStatus(bitRate), bitRate)
+}
@@ -0,0 +1,68 @@
+package greaseweazle
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+)
+
+func TestReadSizing(t *testing.T) {
+	tests := []struct {
+		name    string
+		fw      FirmwareInfo
+		chunk   int
+		pause   time.Duration
+		summary string
+	}{
+		{"F1", FirmwareInfo{HwModel: HW_MODEL_F1, USBSpeed: USB_FULL_SPEED, USBBufKB: 8},
+			8192, 0, "OK for DD/HD, marginal for ED"},
+		{"V4", FirmwareInfo{HwModel: HW_MODEL_AT32, USBSpeed: USB_FULL_SPEED, USBBufKB: 32},
+			32768, 0, "OK for DD/HD, marginal for ED"},
+		{"F7", FirmwareInfo{HwModel: HW_MODEL_F7, USBSpeed: USB_HIGH_SPEED, USBBufKB: 64},
+			65536, maxReadPause, "OK for DD/HD/ED"},
+		{"F7 small buffer", FirmwareInfo{HwModel: HW_MODEL_F7, USBSpeed: USB_HIGH_SPEED, USBBufKB: 4},
+			4096, 1536 * time.Microsecond, "OK for DD, marginal for HD/ED"},
+		{"F1 claims high speed", FirmwareInfo{HwModel: HW_MODEL_F1, USBSpeed: USB_HIGH_SPEED, USBBufKB: 8},
+			8192, 0, "OK for DD/HD, marginal for ED"},
+		{"F1 old firmware", FirmwareInfo{HwModel: HW_MODEL_F1},
+			8192, 0, "OK for DD/HD, marginal for ED"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sizing := tc.fw.readSizing()
+			if sizing.chunk != tc.chunk || sizing.pause.Round(time.Microsecond) != tc.pause {
+				t.Errorf("readSizing() = %d bytes, pause %v, expected %d bytes, pause %v",
+					sizing.chunk, sizing.pause, tc.chunk, tc.pause)
+			}
+			if s := tc.fw.linkSummary(); s != tc.summary {
+				t.Errorf("linkSummary() = %q, expected %q", s, tc.summary)
+			}
+		})
+	}
+}
+
+func TestWarnLinkSpeed(t *testing.T) {
+	var messages []string
+	saved := adapter.Progress
+	adapter.Progress = func(message string) { messages = append(messages, message) }
+	defer func() { adapter.Progress = saved }()
+
+	c := &Client{firmwareInfo: FirmwareInfo{HwModel: HW_MODEL_AT32, USBSpeed: USB_FULL_SPEED, USBBufKB: 32}}
+	c.warnLinkSpeed(0)
+	c.warnLinkSpeed(500)
+	if len(messages) != 0 {
+		t.Errorf("unexpected warnings: %q", messages)
+	}
+	c.warnLinkSpeed(1000)
+	if len(messages) != 1 || !strings.Contains(messages[0], "full speed USB with 32 KB buffer is marginal for 1000 kbps") {
+		t.Errorf("warnings %q", messages)
+	}
+
+	c.firmwareInfo = FirmwareInfo{HwModel: HW_MODEL_F7, USBSpeed: USB_HIGH_SPEED, USBBufKB: 64}
+	c.warnLinkSpeed(1000)
+	if len(messages) != 1 {
+		t.Errorf("unexpected warning for high speed device: %q", messages[1:])
+	}
+}
@@ -1,16 +1,22 @@
 package greaseweazle
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"math"
 
+	"github.com/sergev/floppy/adapter"
 	"github.com/sergev/floppy/hfe"
 	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
 )
 
 const (
-	// Enable for debug
-	DebugFlag = false
+	// Shortest flux interval accepted for raw flux writes, nsec
+	minWriteFluxNs = 500
+
+	// How many times a track is written again after flux underflow
+	underflowRetries = 3
 )
 
 // Encode a 28-bit value into N28 format (4 bytes).
@@ -30,24 +36,20 @@ func encodeN28(value uint32) []byte {
 func encodeFluxStream(transitions []uint64, sampleFreqHz uint32) []byte {
 	var result []byte
 	tickPeriodNs := 1e9 / float64(sampleFreqHz) // 13.889
-	lastTime := uint64(0)
+	lastTicks := uint64(0)
 
 	// Encode each transition as an interval
 	for _, transitionTime := range transitions {
-		// Calculate interval in nanoseconds
-		intervalNs := transitionTime - lastTime
-
-		// Convert to ticks
-		intervalTicks := uint32(float64(intervalNs) / tickPeriodNs)
+		// Convert absolute time to ticks, so that rounding errors
+		// don't accumulate over the track
+		ticks := uint64(math.Round(float64(transitionTime) / tickPeriodNs))
 
 		// Encode interval
 		// Minimum interval is 1 tick
-		if intervalTicks == 0 {
-			intervalTicks = 1
-		}
-		if DebugFlag {
-			fmt.Printf(" %d", intervalTicks)
+		if ticks <= lastTicks {
+			ticks = lastTicks + 1
 		}
+		intervalTicks := uint32(ticks - lastTicks)
 
 		if intervalTicks < 250 {
 			// Direct encoding: single byte (1-249)
@@ -78,11 +80,9 @@ func encodeFluxStream(transitions []uint64, sampleFreqHz uint32) []byte {
 			result = append(result, n28...)
 		}
 
-		lastTime = transitionTime
-	}
-	if DebugFlag {
-		fmt.Printf("--- %d transitions -> %d fluxes\n", len(transitions), len(result))
+		lastTicks = ticks
 	}
+	adapter.Tracef(traceName, "%d transitions -> %d flux bytes", len(transitions), len(result))
 
 	// Terminate stream with null byte
 	result = append(result, 0x00)
@@ -91,7 +91,14 @@ func encodeFluxStream(transitions []uint64, sampleFreqHz uint32) []byte {
 }
 
 // Send CMD_WRITE_FLUX command and flux stream data to the device.
+// Writing starts and stops at the index pulse.
 func (c *Client) WriteFlux(fluxData []byte) error {
+	return c.writeFlux(fluxData, true, true)
+}
+
+// Send flux stream data to the device, optionally starting at the index pulse
+// and stopping at the next one.
+func (c *Client) writeFlux(fluxData []byte, cueAtIndex, terminateAtIndex bool) error {
 	// Build CMD_WRITE_FLUX command
 	// Based on firmware source, the command format is:
 	// [CMD_WRITE_FLUX, len, cue_at_index, terminate_at_index, ...hard_sector_ticks (optional)]
@@ -103,7 +110,13 @@ func (c *Client) WriteFlux(fluxData []byte) error {
 
 	// Always use minimum format with both cue_at_index and terminate_at_index
 	// len = 4 means: command(1) + len(1) + cue_at_index(1) + terminate_at_index(1) = 4 bytes
-	cmd := []byte{CMD_WRITE_FLUX, 4, 1, 1}
+	cmd := []byte{CMD_WRITE_FLUX, 4, 0, 0}
+	if cueAtIndex {
+		cmd[2] = 1
+	}
+	if terminateAtIndex {
+		cmd[3] = 1
+	}
 
 	// Send command
 	err := c.doCommand(cmd)
@@ -112,14 +125,14 @@ func (c *Client) WriteFlux(fluxData []byte) error {
 	}
 
 	// Send flux stream data
-	_, err = c.port.Write(fluxData)
+	err = c.send("flux data", fluxData)
 	if err != nil {
 		return fmt.Errorf("failed to write flux data: %w", err)
 	}
 
 	// Read synchronization byte (device sends this when write completes)
 	syncByte := make([]byte, 1)
-	_, err = io.ReadFull(c.port, syncByte)
+	err = c.receive("WRITE_FLUX done", syncByte)
 	if err != nil {
 		return fmt.Errorf("failed to read write synchronization byte: %w", err)
 	}
@@ -137,41 +150,88 @@ func (c *Client) WriteFlux(fluxData []byte) error {
 	return nil
 }
 
+// Write flux stream to the track, again when the device runs out of data.
+// The whole stream is prepared in memory and sent in one go, so underflow
+// means the host was late to send it, and usually passes on retry.
+// Retries resend the same stream the same way: nothing is done to lower
+// USB latency, which the host cannot control. When underflow persists,
+// the error advises on the USB link instead.
+func (c *Client) writeFluxRetry(fluxData []byte, cueAtIndex, terminateAtIndex bool) error {
+	for retry := 0; ; retry++ {
+		err := c.writeFlux(fluxData, cueAtIndex, terminateAtIndex)
+		if !errors.Is(err, adapter.ErrUnderflow) {
+			return err
+		}
+		if retry >= underflowRetries {
+			return fmt.Errorf("%w, persists after %d retries: %s", err, retry, c.underflowAdvice())
+		}
+		adapter.Tracef(traceName, "flux underflow, retry %d of %d", retry+1, underflowRetries)
+	}
+}
+
+// Suggest how to avoid flux underflow on this device
+func (c *Client) underflowAdvice() string {
+	if c.firmwareInfo.fullSpeed() {
+		return "full speed USB cannot feed flux data in time, connect the device to a high speed USB port, without hubs"
+	}
+	return "host cannot feed flux data in time, reduce other USB and system load"
+}
+
 // Write a disk object to the floppy disk track by track.
-func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
-	// Select drive 0 and turn on motor
-	err := c.SelectDrive(0)
+func (c *Client) Write(disk *hfe.Disk, numberOfCylinders int) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	err := adapter.WriteOpts.CheckImage(disk)
+	if err != nil {
+		return err
+	}
+
+	// Select the drive and turn on motor
+	err = c.SelectDrive(c.drive)
 	if err != nil {
 		return fmt.Errorf("failed to select drive: %w", err)
 	}
-	err = c.SetMotor(0, true)
+	err = c.applyDriveProfile()
+	if err != nil {
+		return fmt.Errorf("failed to set drive parameters: %w", err)
+	}
+	err = c.checkWritable()
+	if err != nil {
+		return err
+	}
+	err = c.setDensity(int(disk.Header.BitRate))
 	if err != nil {
-		return fmt.Errorf("failed to turn on motor: %w", err)
+		return err
+	}
+	err = c.startMotor()
+	if err != nil {
+		return err
 	}
-	defer c.SetMotor(0, false) // Turn off motor when done
 
 	// Iterate through cylinders and heads
-	for cyl := 0; cyl < numberOfTracks; cyl++ {
+	for cyl := 0; cyl < numberOfCylinders; cyl++ {
 		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
 
 			// Seek to cylinder
 			err = c.Seek(byte(cyl))
 			if err != nil {
-				return fmt.Errorf("failed to seek to cylinder %d: %w", cyl, err)
+				return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to seek: %w", err)}
 			}
 
 			// Set head
 			err = c.SetHead(byte(head))
 			if err != nil {
-				return fmt.Errorf("failed to set head %d: %w", head, err)
+				return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to set head: %w", err)}
 			}
 
-			// Get MFM bitcells from track data
-			var mfmBits []byte
-			if head == 0 {
-				mfmBits = disk.Tracks[cyl].Side0
-			} else {
-				mfmBits = disk.Tracks[cyl].Side1
+			// Get MFM bitcells from track data, starting at the index
+			track := disk.Tracks[cyl].FromIndex()
+			mfmBits := track.Side0
+			if head == 1 {
+				mfmBits = track.Side1
 			}
 
 			if len(mfmBits) == 0 {
@@ -180,33 +240,38 @@ func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
 			}
 
 			// Convert MFM bitcells to flux transitions
-			transitions, err := mfm.GenerateFluxTransitions(mfmBits, disk.Header.BitRate)
+			// with write precompensation of inner tracks
+			bitRate := disk.TrackBitRate(cyl)
+			intervals, err := mfm.FluxIntervals(mfmBits, mfm.CellPeriodNs(bitRate), adapter.WriteOpts.PrecompTable(bitRate), cyl)
 			if err != nil {
-				return fmt.Errorf("failed to convert MFM to flux transitions for cylinder %d, head %d: %w", cyl, head, err)
+				return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to convert MFM to flux transitions: %w", err)}
 			}
+			transitions := mfm.IntervalsToTransitions(intervals)
 
 			// Extend transitions to cover full rotation
-			transitions = mfm.CoverFullRotation(transitions, disk.Header.BitRate, disk.Header.FloppyRPM)
+			transitions = mfm.CoverFullRotation(transitions, bitRate, disk.Header.FloppyRPM)
 
 			// Encode flux transitions to flux stream format
 			fluxData := encodeFluxStream(transitions, c.firmwareInfo.SampleFreqHz)
 
 			// Retry several times
+			var lastErr error
 			for retry := 0; ; retry++ {
 				if retry >= 5 {
-					return fmt.Errorf("failed to format track %d, side %d", cyl, head)
+					return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("too many retries: %w", lastErr)}
 				}
 				fmt.Printf("\r  Writing track %d, side %d...", cyl, head)
 
-				// Write flux stream to floppy
-				err = c.WriteFlux(fluxData)
+				// Write flux stream to floppy, starting and stopping at the index
+				err = c.writeFluxRetry(fluxData, true, true)
 				if err != nil {
-					// Check for write protection error
-					errMsg := err.Error()
-					if errMsg == "Greaseweazle error: write protected" || errMsg == "failed to send WRITE_FLUX command: Greaseweazle error: write protected" {
-						return fmt.Errorf("write protected: cannot write to disk")
+					// Write protection is not going to go away,
+					// and underflow has been retried already
+					if errors.Is(err, adapter.ErrWriteProtected) || errors.Is(err, adapter.ErrUnderflow) {
+						return &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
 					}
 					// Failed to write flux data
+					lastErr = err
 					fmt.Printf("Error\n")
 					continue
 				}
@@ -218,14 +283,23 @@ func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
 					fluxResult, err := c.ReadFlux(0, 2)
 					if err != nil {
 						// Failed to read flux data
+						lastErr = err
 						fmt.Printf("Error\n")
 						continue
 					}
 
 					// Decode flux data to MFM bitstream
-					bitsResult, err := c.decodeFluxToMFM(fluxResult, disk.Header.BitRate)
+					track, err := c.fluxTrack(fluxResult)
+					if err != nil {
+						// Failed to decode flux data
+						lastErr = err
+						fmt.Printf("Error\n")
+						continue
+					}
+					bitsResult, err := track.DecodeMFM(disk.TrackBitRate(cyl), pll.Config{})
 					if err != nil {
 						// Failed to decode flux data to MFM
+						lastErr = err
 						fmt.Printf("Error\n")
 						continue
 					}
@@ -234,6 +308,7 @@ func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
 					err = c.GetFluxStatus()
 					if err != nil {
 						// Flux status error after reading
+						lastErr = err
 						fmt.Printf("Error\n")
 						continue
 					}
@@ -242,6 +317,7 @@ func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
 					err = disk.VerifyTrack(cyl, head, bitsResult)
 					if err != nil {
 						// Data mismatch
+						lastErr = err
 						fmt.Printf("Error\n")
 						continue
 					}
@@ -256,3 +332,54 @@ func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
 
 	return nil
 }
+
+// Write raw flux to one track.
+// Transitions are intervals between flux reversals, in nanoseconds.
+func (c *Client) WriteTrackFlux(cyl, head int, transitions []uint64, cueToIndex bool) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	err := adapter.CheckFluxIntervals(transitions, minWriteFluxNs)
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+	}
+
+	// Encode intervals to flux stream format
+	fluxData := encodeFluxStream(mfm.IntervalsToTransitions(transitions), c.firmwareInfo.SampleFreqHz)
+
+	// Select the drive and turn on motor
+	err = c.SelectDrive(c.drive)
+	if err != nil {
+		return fmt.Errorf("failed to select drive: %w", err)
+	}
+	err = c.applyDriveProfile()
+	if err != nil {
+		return fmt.Errorf("failed to set drive parameters: %w", err)
+	}
+	err = c.checkWritable()
+	if err != nil {
+		return err
+	}
+	err = c.startMotor()
+	if err != nil {
+		return err
+	}
+
+	err = c.Seek(byte(cyl))
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to seek: %w", err)}
+	}
+	err = c.SetHead(byte(head))
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to set head: %w", err)}
+	}
+
+	// Write the whole stream, even when it runs past the index pulse
+	err = c.writeFluxRetry(fluxData, cueToIndex, false)
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package greaseweazle
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+)
+
+func TestEncodeFluxStream_Intervals(t *testing.T) {
+	// At 72 MHz: 2 usec = 144 ticks, 4 usec = 288 ticks,
+	// 20 usec = 1440 ticks, 25 msec = 1800000 ticks
+	transitions := []uint64{2000, 6000, 26000, 25026000}
+	expected := []byte{
+		144,      // direct
+		0xFA, 39, // 250 + 39 - 1 = 288
+		0xFE, 171, // 1270 + 171 - 1 = 1440
+		0xFF, FLUXOP_SPACE, 0x81, 0xDD, 0xDB, 0x01, // 1800000 in N28
+		0, // end of stream
+	}
+	if got := encodeFluxStream(transitions, 72000000); !bytes.Equal(got, expected) {
+		t.Errorf("stream % x, expected % x", got, expected)
+	}
+}
+
+func TestWriteTrackFlux(t *testing.T) {
+	defer func(stepDelay, settle, motorDelay, rpm int) {
+		config.StepDelay, config.Settle, config.MotorDelay, config.RPM = stepDelay, settle, motorDelay, rpm
+	}(config.StepDelay, config.Settle, config.MotorDelay, config.RPM)
+	config.StepDelay, config.Settle, config.MotorDelay, config.RPM = 0, 0, 0, 300
+
+	port := &fakePort{}
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_MOTOR, ACK_OKAY})
+	writeRevolutions(port, 72000000, 200)
+	writeRevolutions(port, 72000000, 200)
+	port.rx.Write([]byte{CMD_SEEK, ACK_OKAY, CMD_HEAD, ACK_OKAY})
+	port.rx.Write([]byte{CMD_WRITE_FLUX, ACK_OKAY, 0, CMD_GET_FLUX_STATUS, ACK_OKAY})
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: 72000000}}
+	c.keepMotor()
+
+	err := c.WriteTrackFlux(5, 1, []uint64{2000, 4000, 20000}, true)
+	if err != nil {
+		t.Fatalf("WriteTrackFlux() error: %v", err)
+	}
+
+	// Cued to index, but not terminated there
+	expected := []byte{CMD_WRITE_FLUX, 4, 1, 0, 144, 0xFA, 39, 0xFE, 171, 0}
+	if !bytes.Contains(port.tx.Bytes(), expected) {
+		t.Errorf("sent % x, expected to contain % x", port.tx.Bytes(), expected)
+	}
+	if !bytes.Contains(port.tx.Bytes(), []byte{CMD_SEEK, 3, 5, CMD_HEAD, 3, 1}) {
+		t.Errorf("sent % x, expected seek to 5.1", port.tx.Bytes())
+	}
+
+	// Next track is written with the motor still running:
+	// it is only checked, not turned on again
+	port.rx.Write([]byte{CMD_SELECT, ACK_OKAY})
+	writeDriveInfo(port, GW_DF_MOTOR_ON)
+	port.rx.Write([]byte{CMD_SEEK, ACK_OKAY, CMD_HEAD, ACK_OKAY})
+	port.rx.Write([]byte{CMD_WRITE_FLUX, ACK_OKAY, 0, CMD_GET_FLUX_STATUS, ACK_OKAY})
+	err = c.WriteTrackFlux(6, 0, []uint64{2000, 4000, 20000}, true)
+	if err != nil {
+		t.Fatalf("WriteTrackFlux() error: %v", err)
+	}
+	if n := bytes.Count(port.tx.Bytes(), []byte{CMD_MOTOR, 4}); n != 1 {
+		t.Errorf("motor switched %d times, expected once", n)
+	}
+
+	// Motor is stopped by the user, or after idle time
+	port.rx.Write([]byte{CMD_MOTOR, ACK_OKAY, CMD_DESELECT, ACK_OKAY})
+	if err := c.StopMotor(); err != nil {
+		t.Fatalf("StopMotor() error: %v", err)
+	}
+	if !bytes.HasSuffix(port.tx.Bytes(), []byte{CMD_MOTOR, 4, 0, 0, CMD_DESELECT, 2}) || port.rx.Len() != 0 {
+		t.Errorf("sent % x, expected motor off", port.tx.Bytes())
+	}
+}
+
+func TestWriteTrackFlux_Underflow(t *testing.T) {
+	defer func(stepDelay, settle, motorDelay, rpm int) {
+		config.StepDelay, config.Settle, config.MotorDelay, config.RPM = stepDelay, settle, motorDelay, rpm
+	}(config.StepDelay, config.Settle, config.MotorDelay, config.RPM)
+	config.StepDelay, config.Settle, config.MotorDelay, config.RPM = 0, 0, 0, 300
+
+	stream := []byte{CMD_WRITE_FLUX, 4, 1, 0, 144, 0xFA, 39, 0xFE, 171, 0}
+	for _, tc := range []struct {
+		name       string
+		underflows int
+		speed      uint8
+		wantErr    string
+	}{
+		{"one underflow", 1, USB_HIGH_SPEED, ""},
+		{"persistent on full speed", underflowRetries + 1, USB_FULL_SPEED, "high speed USB port"},
+		{"persistent on high speed", underflowRetries + 1, USB_HIGH_SPEED, "reduce other USB"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			port := &fakePort{}
+			port.rx.Write([]byte{CMD_SELECT, ACK_OKAY, CMD_MOTOR, ACK_OKAY})
+			writeRevolutions(port, 72000000, 200)
+			writeRevolutions(port, 72000000, 200)
+			port.rx.Write([]byte{CMD_SEEK, ACK_OKAY, CMD_HEAD, ACK_OKAY})
+			for i := 0; i < tc.underflows; i++ {
+				port.rx.Write([]byte{CMD_WRITE_FLUX, ACK_OKAY, 0, CMD_GET_FLUX_STATUS, ACK_FLUX_UNDERFLOW})
+			}
+			if tc.wantErr == "" {
+				port.rx.Write([]byte{CMD_WRITE_FLUX, ACK_OKAY, 0, CMD_GET_FLUX_STATUS, ACK_OKAY})
+			}
+			port.rx.Write([]byte{CMD_MOTOR, ACK_OKAY})
+			c := &Client{port: port, firmwareInfo: FirmwareInfo{
+				SampleFreqHz: 72000000, HwModel: HW_MODEL_F7, USBSpeed: tc.speed,
+			}}
+
+			err := c.WriteTrackFlux(5, 1, []uint64{2000, 4000, 20000}, true)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("WriteTrackFlux() error: %v", err)
+				}
+				if n := bytes.Count(port.tx.Bytes(), stream); n != 2 {
+					t.Errorf("flux stream sent %d times, expected twice", n)
+				}
+				return
+			}
+			if !errors.Is(err, adapter.ErrUnderflow) || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("WriteTrackFlux() error: %v, expected underflow with %q", err, tc.wantErr)
+			}
+			if n := bytes.Count(port.tx.Bytes(), stream); n != underflowRetries+1 {
+				t.Errorf("flux stream sent %d times, expected %d", n, underflowRetries+1)
+			}
+		})
+	}
+}
+
+func TestWriteTrackFlux_Invalid(t *testing.T) {
+	defer func(rpm int) { config.RPM = rpm }(config.RPM)
+	config.RPM = 300
+
+	// Nothing may be sent to the device
+	port := &fakePort{}
+	c := &Client{port: port, firmwareInfo: FirmwareInfo{SampleFreqHz: 72000000}}
+	for _, transitions := range [][]uint64{
+		nil,
+		{2000, 400, 2000},    // too short
+		{100e6, 100e6, 10e6}, // longer than one revolution
+	} {
+		err := c.WriteTrackFlux(0, 0, transitions, true)
+		var trackErr *adapter.TrackError
+		if !errors.As(err, &trackErr) {
+			t.Errorf("%v: error = %v, expected TrackError", transitions, err)
+		}
+	}
+	if port.tx.Len() != 0 {
+		t.Errorf("sent % x, expected nothing", port.tx.Bytes())
+	}
+}
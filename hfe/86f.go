@@ -0,0 +1,309 @@
+package hfe
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 86F file signature and the version we write
+const (
+	d86fSignature = "86BF"
+	d86fVersion   = 0x020C // 2.12
+)
+
+// 86F disk flags
+const (
+	d86fDiskSurface   = 0x0001 // Surface description data present (weak bits)
+	d86fDiskHoleMask  = 0x0006 // Hole: 0 = DD, 1 = HD, 2 = ED
+	d86fDiskHoleHD    = 0x0002
+	d86fDiskHoleED    = 0x0004
+	d86fDiskSides     = 0x0008 // Two sides
+	d86fDiskWriteProt = 0x0010 // Write protected
+	d86fDiskSlowMask  = 0x0060 // RPM slowdown: 0, 1, 1.5 or 2 percent
+	d86fDiskBitCells  = 0x0080 // Track header has count of extra bit cells
+	d86fDiskZoned     = 0x0100 // Zoned RPM
+	d86fDiskReverse   = 0x0800 // Words stored in reverse endianness
+	d86fDiskSpeedUp   = 0x1000 // Speed up RPM instead of slowing down
+)
+
+// 86F track flags
+const (
+	d86fTrackRateMask = 0x07 // Data rate: 0 = 500, 1 = 300, 2 = 250, 3 = 1000 kbps
+	d86fTrackEncMask  = 0x18 // Encoding: 0 = FM, 1 = MFM, 2 = M2FM, 3 = GCR
+	d86fTrackEncMFM   = 0x08
+	d86fTrackRPMMask  = 0xE0 // Rotation speed: 0 = 300, 1 = 360 RPM
+	d86fTrackRPM360   = 0x20
+)
+
+// Data rates of 86F track flags, in kbps
+var d86fRates = []uint16{500, 300, 250, 1000}
+
+// Size of 86F track offset table, in entries
+func d86fTableSize(sides int) int {
+	return 256 * sides
+}
+
+// Nominal number of MFM bit cells per revolution, as 86Box computes it.
+// Actual track length is given relative to it, by extra bit cells.
+func d86fRawSize(bitRate, rpm uint16, diskFlags uint16) int {
+	size := 100000.0 * float64(bitRate) / 250 * 300 / float64(rpm)
+	slowdown := []float64{0, 0.01, 0.015, 0.02}[(diskFlags&d86fDiskSlowMask)>>5]
+	if diskFlags&d86fDiskSpeedUp != 0 {
+		size *= 1 - slowdown
+	} else {
+		size *= 1 + slowdown
+	}
+	return int(size)
+}
+
+// Track flags of 86F format for the given bit rate and rotation speed
+func d86fTrackFlags(bitRate, rpm uint16) (uint16, error) {
+	flags := uint16(d86fTrackEncMFM)
+	rate := -1
+	for i, r := range d86fRates {
+		if r == bitRate {
+			rate = i
+		}
+	}
+	if rate < 0 {
+		return 0, fmt.Errorf("bit rate %d kbps is not supported by 86F format", bitRate)
+	}
+	flags |= uint16(rate)
+	switch rpm {
+	case 300:
+	case 360:
+		flags |= d86fTrackRPM360
+	default:
+		return 0, fmt.Errorf("rotation speed %d RPM is not supported by 86F format", rpm)
+	}
+	return flags, nil
+}
+
+// Read86F reads a file in 86F format (86Box flux-accurate image) and returns a Disk structure.
+// Only MFM tracks without surface data are supported.
+func Read86F(filename string) (*Disk, error) {
+	data, err := readImageData(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	if len(data) < 8 || string(data[:4]) != d86fSignature {
+		return nil, fmt.Errorf("invalid 86F signature")
+	}
+	version := binary.LittleEndian.Uint16(data[4:6])
+	if version>>8 != 2 {
+		return nil, fmt.Errorf("unsupported 86F version %d.%02d", version>>8, version&0xFF)
+	}
+	diskFlags := binary.LittleEndian.Uint16(data[6:8])
+	if diskFlags&d86fDiskSurface != 0 {
+		return nil, fmt.Errorf("86F surface data (weak bits) is not supported")
+	}
+	if diskFlags&d86fDiskZoned != 0 {
+		return nil, fmt.Errorf("86F zoned RPM is not supported")
+	}
+	sides := 1
+	if diskFlags&d86fDiskSides != 0 {
+		sides = 2
+	}
+
+	// Track offset table
+	tableSize := d86fTableSize(sides)
+	if len(data) < 8+4*tableSize {
+		return nil, fmt.Errorf("file too short for 86F track table")
+	}
+	offsets := make([]int, tableSize)
+	numTracks := 0
+	for i := range offsets {
+		offsets[i] = int(binary.LittleEndian.Uint32(data[8+4*i:]))
+		if offsets[i] != 0 {
+			numTracks = i/sides + 1
+		}
+	}
+	if numTracks == 0 {
+		return nil, fmt.Errorf("no tracks in 86F image")
+	}
+
+	disk := &Disk{
+		Header: Header{
+			NumberOfTrack:       uint8(numTracks),
+			NumberOfSide:        uint8(sides),
+			TrackEncoding:       ENC_ISOIBM_MFM,
+			FloppyInterfaceMode: IFM_IBMPC_DD,
+			WriteProtected:      0xFF,
+			WriteAllowed:        0xFF,
+			SingleStep:          0xFF,
+			Track0S0AltEncoding: 0xFF,
+			Track0S0Encoding:    ENC_ISOIBM_MFM,
+			Track0S1AltEncoding: 0xFF,
+			Track0S1Encoding:    ENC_ISOIBM_MFM,
+		},
+		Tracks: make([]TrackData, numTracks),
+	}
+	switch diskFlags & d86fDiskHoleMask {
+	case d86fDiskHoleHD:
+		disk.Header.FloppyInterfaceMode = IFM_IBMPC_HD
+	case d86fDiskHoleED:
+		disk.Header.FloppyInterfaceMode = IFM_IBMPC_ED
+	}
+	if diskFlags&d86fDiskWriteProt != 0 {
+		disk.SetWriteProtect(true)
+	}
+
+	for i, offset := range offsets {
+		if offset == 0 {
+			continue
+		}
+		cyl, head := i/sides, i%sides
+
+		// Track header: flags, extra bit cells, index hole position
+		headerLen := 6
+		if diskFlags&d86fDiskBitCells != 0 {
+			headerLen = 10
+		}
+		if offset+headerLen > len(data) {
+			return nil, fmt.Errorf("truncated track %d.%d", cyl, head)
+		}
+		trackFlags := binary.LittleEndian.Uint16(data[offset:])
+		extra := 0
+		pos := offset + 2
+		if diskFlags&d86fDiskBitCells != 0 {
+			extra = int(int32(binary.LittleEndian.Uint32(data[pos:])))
+			pos += 4
+		}
+		indexPos := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+
+		if trackFlags&d86fTrackEncMask != d86fTrackEncMFM {
+			return nil, fmt.Errorf("track %d.%d: only MFM encoding is supported", cyl, head)
+		}
+		rate := int(trackFlags & d86fTrackRateMask)
+		if rate >= len(d86fRates) {
+			return nil, fmt.Errorf("track %d.%d: unsupported data rate %d", cyl, head, rate)
+		}
+		bitRate := d86fRates[rate]
+		rpm := uint16(300)
+		switch trackFlags & d86fTrackRPMMask {
+		case 0:
+		case d86fTrackRPM360:
+			rpm = 360
+		default:
+			return nil, fmt.Errorf("track %d.%d: unsupported rotation speed", cyl, head)
+		}
+		if disk.Header.BitRate == 0 {
+			disk.Header.BitRate = bitRate
+			disk.Header.FloppyRPM = rpm
+		}
+		if bitRate != disk.Header.BitRate {
+			disk.Tracks[cyl].BitRate = bitRate
+		}
+
+		// Bit cells are stored in 16-bit words
+		numBits := d86fRawSize(bitRate, rpm, diskFlags) + extra
+		if numBits <= 0 || indexPos >= numBits {
+			return nil, fmt.Errorf("track %d.%d: invalid length of %d bits", cyl, head, numBits)
+		}
+		dataLen := (numBits + 15) / 16 * 2
+		if pos+dataLen > len(data) {
+			return nil, fmt.Errorf("truncated track %d.%d", cyl, head)
+		}
+		raw := make([]byte, dataLen)
+		copy(raw, data[pos:pos+dataLen])
+		if diskFlags&d86fDiskReverse != 0 {
+			for j := 0; j < dataLen; j += 2 {
+				raw[j], raw[j+1] = raw[j+1], raw[j]
+			}
+		}
+
+		// Start the track at index hole
+		bits := make([]byte, (numBits+7)/8)
+		n := bitCopy(bits, 0, raw, indexPos, numBits-indexPos)
+		bitCopy(bits, n, raw, 0, indexPos)
+
+		if head == 0 {
+			disk.Tracks[cyl].Side0 = bits
+		} else {
+			disk.Tracks[cyl].Side1 = bits
+		}
+	}
+	return disk, nil
+}
+
+// Write86F writes a Disk structure to a file in 86F format, version 2.12.
+// Tracks are stored as MFM bit cells starting at index hole, without surface data.
+func Write86F(filename string, disk *Disk) error {
+	switch disk.Header.TrackEncoding {
+	case ENC_ISOIBM_MFM, ENC_Amiga_MFM:
+	case ENC_C64_GCR:
+		return fmt.Errorf("zoned RPM of GCR disks is not supported by 86F format")
+	default:
+		return fmt.Errorf("track encoding 0x%02x is not supported by 86F format", disk.Header.TrackEncoding)
+	}
+	numCylinders := min(int(disk.Header.NumberOfTrack), len(disk.Tracks))
+	sides := int(disk.Header.NumberOfSide)
+	if sides < 1 || sides > 2 {
+		return fmt.Errorf("invalid number of sides: %d", sides)
+	}
+	tableSize := d86fTableSize(sides)
+	if numCylinders*sides > tableSize {
+		return fmt.Errorf("too many tracks for 86F format: %d", numCylinders)
+	}
+
+	diskFlags := uint16(d86fDiskBitCells)
+	switch {
+	case disk.Header.BitRate >= 1000:
+		diskFlags |= d86fDiskHoleED
+	case disk.Header.BitRate >= 500:
+		diskFlags |= d86fDiskHoleHD
+	}
+	if sides == 2 {
+		diskFlags |= d86fDiskSides
+	}
+	if disk.IsWriteProtected() {
+		diskFlags |= d86fDiskWriteProt
+	}
+
+	// Header and track offset table, followed by tracks
+	out := make([]byte, 8+4*tableSize)
+	copy(out, d86fSignature)
+	binary.LittleEndian.PutUint16(out[4:], d86fVersion)
+	binary.LittleEndian.PutUint16(out[6:], diskFlags)
+	for cyl := 0; cyl < numCylinders; cyl++ {
+		for head := 0; head < sides; head++ {
+			bits := disk.Tracks[cyl].Side0
+			if head == 1 {
+				bits = disk.Tracks[cyl].Side1
+			}
+			if len(bits) == 0 {
+				continue // Unformatted track
+			}
+			bitRate := disk.TrackBitRate(cyl)
+			trackFlags, err := d86fTrackFlags(bitRate, disk.Header.FloppyRPM)
+			if err != nil {
+				return fmt.Errorf("track %d.%d: %w", cyl, head, err)
+			}
+			numBits := len(bits) * 8
+			extra := numBits - d86fRawSize(bitRate, disk.Header.FloppyRPM, diskFlags)
+
+			binary.LittleEndian.PutUint32(out[8+4*(cyl*sides+head):], uint32(len(out)))
+			header := make([]byte, 10)
+			binary.LittleEndian.PutUint16(header[0:], trackFlags)
+			binary.LittleEndian.PutUint32(header[2:], uint32(int32(extra)))
+			binary.LittleEndian.PutUint32(header[6:], 0) // Index hole at start of data
+			out = append(out, header...)
+
+			// Bit cells padded to 16-bit words
+			data := make([]byte, (numBits+15)/16*2)
+			copy(data, bits)
+			out = append(out, data...)
+		}
+	}
+
+	file, err := createAtomic(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+	if _, err := file.Write(out); err != nil {
+		return fmt.Errorf("failed to write 86F file: %w", err)
+	}
+	return file.Commit()
+}
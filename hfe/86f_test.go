@@ -0,0 +1,136 @@
+package hfe
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWrite86F_RoundTrip(t *testing.T) {
+	tests := []struct {
+		sample    string
+		sectors   int
+		diskFlags uint16
+	}{
+		{"fat720.img.gz", 9, d86fDiskBitCells | d86fDiskSides},
+		{"fat1.44.img.gz", 18, d86fDiskBitCells | d86fDiskSides | d86fDiskHoleHD},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			disk, _, err := OpenImage(findSampleFile(t, tt.sample))
+			if err != nil {
+				t.Fatalf("OpenImage() error: %v", err)
+			}
+			filename := filepath.Join(t.TempDir(), "disk.86f")
+			if err := Write(filename, disk); err != nil {
+				t.Fatalf("Write() error: %v", err)
+			}
+
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data[:4]) != "86BF" || binary.LittleEndian.Uint16(data[4:]) != 0x020C {
+				t.Errorf("header % x", data[:6])
+			}
+			if flags := binary.LittleEndian.Uint16(data[6:]); flags != tt.diskFlags {
+				t.Errorf("disk flags 0x%04x, expected 0x%04x", flags, tt.diskFlags)
+			}
+
+			got, format, err := OpenImage(filename)
+			if err != nil {
+				t.Fatalf("OpenImage() error: %v", err)
+			}
+			if format != ImageFormat86F {
+				t.Errorf("detected format %v", format)
+			}
+			if got.Header.NumberOfTrack != disk.Header.NumberOfTrack || got.Header.NumberOfSide != 2 ||
+				got.Header.BitRate != disk.Header.BitRate || got.Header.FloppyRPM != disk.Header.FloppyRPM {
+				t.Errorf("header %+v", got.Header)
+			}
+
+			// Every sector decodes to the same data
+			for cyl := range disk.Tracks {
+				for head := 0; head < 2; head++ {
+					src, dst := disk.Tracks[cyl].Side0, got.Tracks[cyl].Side0
+					if head == 1 {
+						src, dst = disk.Tracks[cyl].Side1, got.Tracks[cyl].Side1
+					}
+					want, _ := extractSectorsFromTrack(src, cyl, head, tt.sectors)
+					sectors, _ := extractSectorsFromTrack(dst, cyl, head, tt.sectors)
+					if len(sectors) != tt.sectors || len(want) != tt.sectors {
+						t.Fatalf("track %d.%d: %d sectors, expected %d", cyl, head, len(sectors), len(want))
+					}
+					for s, data := range want {
+						if string(sectors[s]) != string(data) {
+							t.Errorf("track %d.%d: sector %d differs", cyl, head, s+1)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRead86F_IndexHole(t *testing.T) {
+	track := makeTestTrack144()
+	disk := &Disk{
+		Header: Header{NumberOfTrack: 1, NumberOfSide: 1, TrackEncoding: ENC_ISOIBM_MFM, BitRate: 500, FloppyRPM: 300},
+		Tracks: []TrackData{{Side0: track}},
+	}
+	filename := filepath.Join(t.TempDir(), "disk.86f")
+	if err := Write86F(filename, disk); err != nil {
+		t.Fatalf("Write86F() error: %v", err)
+	}
+
+	// Single-sided table, track data after 10-byte track header
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int(binary.LittleEndian.Uint32(data[8:]))
+	if offset != 8+4*256 {
+		t.Fatalf("track offset %d", offset)
+	}
+	extra := int32(binary.LittleEndian.Uint32(data[offset+2:]))
+	if int(extra) != len(track)*8-200000 {
+		t.Errorf("extra bit cells %d, expected %d", extra, len(track)*8-200000)
+	}
+
+	// Move the index hole into the middle of track data
+	const indexPos = 12345
+	copy(data[offset+10:], rotateBits(track, len(track)*8-indexPos))
+	binary.LittleEndian.PutUint32(data[offset+6:], indexPos)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read86F(filename)
+	if err != nil {
+		t.Fatalf("Read86F() error: %v", err)
+	}
+	if string(got.Tracks[0].Side0) != string(track) {
+		t.Errorf("track not aligned to index hole")
+	}
+}
+
+func TestWrite86F_Unsupported(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "disk.86f")
+	tests := []struct {
+		header Header
+		errMsg string
+	}{
+		{Header{NumberOfTrack: 1, NumberOfSide: 1, TrackEncoding: ENC_ISOIBM_MFM, BitRate: 500, FloppyRPM: 320}, "320 RPM"},
+		{Header{NumberOfTrack: 1, NumberOfSide: 1, TrackEncoding: ENC_ISOIBM_MFM, BitRate: 400, FloppyRPM: 300}, "400 kbps"},
+		{Header{NumberOfTrack: 1, NumberOfSide: 1, TrackEncoding: ENC_C64_GCR, BitRate: 250, FloppyRPM: 300}, "zoned"},
+		{Header{NumberOfTrack: 1, NumberOfSide: 1, TrackEncoding: ENC_ISOIBM_FM, BitRate: 250, FloppyRPM: 300}, "not supported"},
+	}
+	for _, tt := range tests {
+		disk := &Disk{Header: tt.header, Tracks: []TrackData{{Side0: makeTestTrack144()}}}
+		err := Write86F(filename, disk)
+		if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("%+v: error = %v, expected %q", tt.header, err, tt.errMsg)
+		}
+	}
+}
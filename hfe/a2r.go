@@ -0,0 +1,379 @@
+package hfe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sergev/floppy/flux"
+	"github.com/sergev/floppy/mfm"
+)
+
+// A2R file signatures
+const (
+	a2rV2Signature = "A2R2\xff\n\r\n"
+	a2rV3Signature = "A2R3\xff\n\r\n"
+)
+
+// A2R disk types from the INFO chunk
+const (
+	a2rDisk525SS   = 1 // 5.25" single sided, 40 tracks, quarter-track steps (Apple GCR)
+	a2rDisk35Apple = 2 // 3.5" double sided, 80 tracks, Apple CLV (GCR)
+	a2rDisk525DS80 = 3 // 5.25" double sided, 80 tracks
+	a2rDisk525DS40 = 4 // 5.25" double sided, 40 tracks
+	a2rDisk35DS    = 5 // 3.5" double sided, 80 tracks
+	a2rDisk8DS     = 6 // 8" double sided
+)
+
+// A2R capture types
+const (
+	a2rCaptureTiming  = 1 // Timing data, one revolution plus a loop point
+	a2rCaptureBits    = 2 // Bits data
+	a2rCaptureXTiming = 3 // Extended timing data, several revolutions
+)
+
+// Default tick resolution of A2R v2 timing data, in picoseconds
+const a2rDefaultResolution = 125000
+
+// a2rCapture represents one flux capture of a track from A2R file
+type a2rCapture struct {
+	location    int      // Track location: quarter-track or (track << 1) | side
+	captureType byte     // Timing, bits or xtiming
+	resolution  uint32   // Tick duration in picoseconds
+	indexTicks  []uint32 // Index signal times in ticks (v3)
+	loopPoint   uint32   // Estimated loop point in ticks (v2)
+	data        []byte   // Raw timing data
+}
+
+// ReadA2R reads a file in A2R format (Applesauce flux image, version 2 or 3)
+// and returns a Disk structure.
+// Flux captures are decoded through the PLL into MFM bitcells.
+func ReadA2R(filename string) (*Disk, error) {
+	data, err := readImageData(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("file too short for A2R header")
+	}
+
+	version := 0
+	switch string(data[:8]) {
+	case a2rV2Signature:
+		version = 2
+	case a2rV3Signature:
+		version = 3
+	default:
+		return nil, fmt.Errorf("invalid A2R signature")
+	}
+
+	// Parse chunks
+	diskType := 0
+	var captures []a2rCapture
+	offset := 8
+	for offset+8 <= len(data) {
+		chunkID := string(data[offset : offset+4])
+		chunkSize := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		offset += 8
+		if offset+chunkSize > len(data) {
+			return nil, fmt.Errorf("truncated %s chunk", chunkID)
+		}
+		chunk := data[offset : offset+chunkSize]
+		offset += chunkSize
+
+		switch chunkID {
+		case "INFO":
+			// version(1), creator(32), disk type(1), write protected(1), synchronized(1)
+			if len(chunk) < 36 {
+				return nil, fmt.Errorf("INFO chunk too short")
+			}
+			diskType = int(chunk[33])
+		case "STRM":
+			c, err := parseA2RStrm(chunk)
+			if err != nil {
+				return nil, err
+			}
+			captures = append(captures, c...)
+		case "RWCP":
+			c, err := parseA2RRwcp(chunk)
+			if err != nil {
+				return nil, err
+			}
+			captures = append(captures, c...)
+		default:
+			// Skip META, SLVD and unknown chunks
+		}
+	}
+
+	switch diskType {
+	case 0:
+		return nil, fmt.Errorf("missing INFO chunk in A2R v%d file", version)
+	case a2rDisk525SS, a2rDisk35Apple:
+		return nil, fmt.Errorf("unsupported encoding: A2R disk type %d is Apple GCR", diskType)
+	case a2rDisk525DS80, a2rDisk525DS40, a2rDisk35DS, a2rDisk8DS:
+		// MFM disks
+	default:
+		return nil, fmt.Errorf("unsupported A2R disk type %d", diskType)
+	}
+
+	// Select one capture per track, skipping quarter tracks
+	type trackKey struct{ cyl, head int }
+	selected := make(map[trackKey]*a2rCapture)
+	numCyls := 0
+	numSides := 1
+	for i := range captures {
+		c := &captures[i]
+		if c.captureType == a2rCaptureBits {
+			// Not a flux capture
+			continue
+		}
+		cyl := c.location >> 1
+		head := c.location & 1
+		if diskType == a2rDisk525DS80 || diskType == a2rDisk525DS40 {
+			// Location is in quarter tracks
+			if cyl%4 != 0 {
+				fmt.Printf("Warning: skipping quarter-track capture at location %d\n", c.location)
+				continue
+			}
+			cyl /= 4
+		}
+		key := trackKey{cyl, head}
+		if selected[key] == nil {
+			selected[key] = c
+		}
+		if cyl+1 > numCyls {
+			numCyls = cyl + 1
+		}
+		if head == 1 {
+			numSides = 2
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no flux captures found in A2R file")
+	}
+	if numCyls > 255 {
+		return nil, fmt.Errorf("too many tracks in A2R file: %d", numCyls)
+	}
+
+	disk := &Disk{
+		Header: Header{
+			NumberOfTrack:       uint8(numCyls),
+			NumberOfSide:        uint8(numSides),
+			TrackEncoding:       ENC_ISOIBM_MFM,
+			BitRate:             0, // Detected from first track
+			FloppyRPM:           300,
+			FloppyInterfaceMode: IFM_IBMPC_DD,
+			WriteProtected:      0xFF,
+			WriteAllowed:        0xFF,
+			SingleStep:          0xFF,
+			Track0S0AltEncoding: 0xFF,
+			Track0S0Encoding:    ENC_ISOIBM_MFM,
+			Track0S1AltEncoding: 0xFF,
+			Track0S1Encoding:    ENC_ISOIBM_MFM,
+		},
+		Tracks: make([]TrackData, numCyls),
+	}
+
+	for cyl := 0; cyl < numCyls; cyl++ {
+		for head := 0; head < numSides; head++ {
+			c := selected[trackKey{cyl, head}]
+			if c == nil {
+				// Track not captured
+				continue
+			}
+			transitions, durationNs := c.revolution()
+			if len(transitions) == 0 || durationNs == 0 {
+				continue
+			}
+
+			// Calculate RPM and BitRate from first track
+			if disk.Header.BitRate == 0 {
+				disk.Header.FloppyRPM, disk.Header.BitRate = a2rRPMAndBitRate(transitions, durationNs)
+				if disk.Header.BitRate >= 750 {
+					disk.Header.FloppyInterfaceMode = IFM_IBMPC_ED
+				} else if disk.Header.BitRate >= 375 {
+					disk.Header.FloppyInterfaceMode = IFM_IBMPC_HD
+				}
+			}
+
+			mfmData := fluxToBitcells(transitions, disk.Header.BitRate)
+			if head == 0 {
+				disk.Tracks[cyl].Side0 = mfmData
+			} else {
+				disk.Tracks[cyl].Side1 = mfmData
+			}
+		}
+	}
+	if disk.Header.BitRate == 0 {
+		return nil, fmt.Errorf("no usable flux captures found in A2R file")
+	}
+	return disk, nil
+}
+
+// WriteA2R writes a Disk structure to an A2R format file.
+func WriteA2R(filename string, disk *Disk) error {
+	return fmt.Errorf("A2R format not yet implemented")
+}
+
+// Parse STRM chunk of A2R v2 file.
+// Each capture: location(1), type(1), data length(4), loop point(4), data.
+// The list is terminated by location 0xFF.
+func parseA2RStrm(chunk []byte) ([]a2rCapture, error) {
+	var captures []a2rCapture
+	offset := 0
+	for offset < len(chunk) && chunk[offset] != 0xFF {
+		if offset+10 > len(chunk) {
+			return nil, fmt.Errorf("truncated STRM capture header")
+		}
+		c := a2rCapture{
+			location:    int(chunk[offset]),
+			captureType: chunk[offset+1],
+			resolution:  a2rDefaultResolution,
+			loopPoint:   binary.LittleEndian.Uint32(chunk[offset+6 : offset+10]),
+		}
+		size := int(binary.LittleEndian.Uint32(chunk[offset+2 : offset+6]))
+		offset += 10
+		if offset+size > len(chunk) {
+			return nil, fmt.Errorf("truncated STRM capture data")
+		}
+		c.data = chunk[offset : offset+size]
+		offset += size
+		captures = append(captures, c)
+	}
+	return captures, nil
+}
+
+// Parse RWCP chunk of A2R v3 file.
+// Header: version(1), resolution in picoseconds(4), reserved(11).
+// Each capture: 'C', type(1), location(2), index count(1), index times(4 each),
+// data length(4), data. The list is terminated by 'X'.
+func parseA2RRwcp(chunk []byte) ([]a2rCapture, error) {
+	if len(chunk) < 16 {
+		return nil, fmt.Errorf("RWCP chunk too short")
+	}
+	resolution := binary.LittleEndian.Uint32(chunk[1:5])
+	if resolution == 0 {
+		return nil, fmt.Errorf("invalid RWCP resolution")
+	}
+
+	var captures []a2rCapture
+	offset := 16
+	for offset < len(chunk) && chunk[offset] == 'C' {
+		if offset+5 > len(chunk) {
+			return nil, fmt.Errorf("truncated RWCP capture header")
+		}
+		c := a2rCapture{
+			captureType: chunk[offset+1],
+			location:    int(binary.LittleEndian.Uint16(chunk[offset+2 : offset+4])),
+			resolution:  resolution,
+		}
+		numIndex := int(chunk[offset+4])
+		offset += 5
+		if offset+4*numIndex+4 > len(chunk) {
+			return nil, fmt.Errorf("truncated RWCP index list")
+		}
+		for i := 0; i < numIndex; i++ {
+			c.indexTicks = append(c.indexTicks, binary.LittleEndian.Uint32(chunk[offset:offset+4]))
+			offset += 4
+		}
+		size := int(binary.LittleEndian.Uint32(chunk[offset : offset+4]))
+		offset += 4
+		if offset+size > len(chunk) {
+			return nil, fmt.Errorf("truncated RWCP capture data")
+		}
+		c.data = chunk[offset : offset+size]
+		offset += size
+		captures = append(captures, c)
+	}
+	return captures, nil
+}
+
+// Extract flux transitions of one revolution, in nanoseconds relative to its start.
+// Returns transitions and duration of the revolution.
+func (c *a2rCapture) revolution() ([]uint64, uint64) {
+	// Decode timing data: each byte is a delta in ticks,
+	// value 255 means add 255 and continue with the next byte
+	ticks := make([]uint64, 0, len(c.data))
+	acc := uint64(0)
+	delta := uint64(0)
+	for _, b := range c.data {
+		delta += uint64(b)
+		if b == 255 {
+			continue
+		}
+		acc += delta
+		ticks = append(ticks, acc)
+		delta = 0
+	}
+
+	// Determine revolution boundaries in ticks
+	start := uint64(0)
+	end := acc
+	if len(c.indexTicks) >= 2 {
+		start = uint64(c.indexTicks[0])
+		end = uint64(c.indexTicks[1])
+	} else if len(c.indexTicks) == 1 {
+		start = uint64(c.indexTicks[0])
+	} else if c.loopPoint > 0 && uint64(c.loopPoint) < end {
+		end = uint64(c.loopPoint)
+	}
+	if end <= start {
+		return nil, 0
+	}
+
+	psPerTick := float64(c.resolution)
+	transitions := make([]uint64, 0, len(ticks))
+	for _, t := range ticks {
+		if t <= start {
+			continue
+		}
+		if t > end {
+			break
+		}
+		transitions = append(transitions, uint64(float64(t-start)*psPerTick/1000))
+	}
+	return transitions, uint64(float64(end-start) * psPerTick / 1000)
+}
+
+// Calculate RPM and bit rate from transitions of one revolution.
+// Return the calculated RPM: 300 or 360.
+// Return the calculated bit rate: 250, 300, 500 or 1000 bits/msec.
+func a2rRPMAndBitRate(transitions []uint64, durationNs uint64) (uint16, uint16) {
+	track := &flux.FluxTrack{
+		Transitions: transitions,
+		IndexPulses: []uint64{0, durationNs},
+	}
+	return track.NominalRPM(), track.EstimateBitRateKbps()
+}
+
+// Recover raw MFM bitcells from flux transitions using PLL,
+// and return MFM bitcells packed MSB-first.
+func fluxToBitcells(transitions []uint64, bitRateKhz uint16) []byte {
+	decoder := mfm.NewDecoder(transitions, bitRateKhz)
+
+	// Ignore first half-bit (as done in reference implementation)
+	_ = decoder.NextBit()
+
+	var result bytes.Buffer
+	result.Grow(int(transitions[len(transitions)-1]*uint64(bitRateKhz)/4e6) + 64)
+	currentByte := byte(0)
+	bitCount := 0
+	for !decoder.IsDone() {
+		if decoder.NextBit() {
+			currentByte |= 0x80 >> bitCount
+		}
+		if decoder.NextBit() {
+			currentByte |= 0x40 >> bitCount
+		}
+		bitCount += 2
+		if bitCount == 8 {
+			result.WriteByte(currentByte)
+			currentByte = 0
+			bitCount = 0
+		}
+	}
+	if bitCount > 0 {
+		result.WriteByte(currentByte)
+	}
+	return result.Bytes()
+}
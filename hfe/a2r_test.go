@@ -0,0 +1,234 @@
+package hfe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Encode a 1.44M track as flux transitions in nanoseconds.
+func makeA2RTestTrack(t *testing.T, cyl, head int) []uint64 {
+	t.Helper()
+	const spt = 18
+	sectors := make([][]byte, spt)
+	for i := range sectors {
+		sectors[i] = bytes.Repeat([]byte{byte(cyl*spt + i)}, 512)
+	}
+	maxHalfBits := 500 * 1000 * 60 / 300 * 2
+	writer := mfm.NewWriter(maxHalfBits)
+	mfmData := writer.EncodeTrackIBMPC(sectors, cyl, head, spt, 500)
+	transitions, err := mfm.GenerateFluxTransitions(mfmData, 500)
+	if err != nil {
+		t.Fatalf("GenerateFluxTransitions() error: %v", err)
+	}
+	return transitions
+}
+
+// Convert transitions in nanoseconds into A2R timing bytes.
+func encodeA2RTiming(transitions []uint64, nsPerTick uint64) []byte {
+	var data []byte
+	prev := uint64(0)
+	for _, ns := range transitions {
+		ticks := ns/nsPerTick - prev/nsPerTick
+		prev = ns
+		for ticks >= 255 {
+			data = append(data, 255)
+			ticks -= 255
+		}
+		data = append(data, byte(ticks))
+	}
+	return data
+}
+
+// Build an A2R chunk with the given ID.
+func makeA2RChunk(id string, payload []byte) []byte {
+	chunk := make([]byte, 8, 8+len(payload))
+	copy(chunk, id)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	return append(chunk, payload...)
+}
+
+// Build an INFO chunk payload for the given disk type.
+func makeA2RInfo(version, diskType byte) []byte {
+	info := make([]byte, 37)
+	info[0] = version
+	copy(info[1:33], "floppy test"+strings.Repeat(" ", 21))
+	info[33] = diskType
+	return info
+}
+
+// Build an A2R v3 file with one RWCP capture per location.
+func makeA2RV3(diskType byte, tracks map[uint16][]uint64) []byte {
+	const nsPerTick = 25
+	rwcp := make([]byte, 16)
+	rwcp[0] = 1
+	binary.LittleEndian.PutUint32(rwcp[1:5], nsPerTick*1000)
+	for location := uint16(0); location < 256; location++ {
+		transitions, ok := tracks[location]
+		if !ok {
+			continue
+		}
+		timing := encodeA2RTiming(transitions, nsPerTick)
+
+		// One full revolution at 300 RPM, starting at time zero
+		revTicks := uint32(200e6 / nsPerTick)
+		capture := []byte{'C', a2rCaptureXTiming, 0, 0, 2}
+		binary.LittleEndian.PutUint16(capture[2:4], location)
+		capture = binary.LittleEndian.AppendUint32(capture, 0)
+		capture = binary.LittleEndian.AppendUint32(capture, revTicks)
+		capture = binary.LittleEndian.AppendUint32(capture, uint32(len(timing)))
+		capture = append(capture, timing...)
+		rwcp = append(rwcp, capture...)
+	}
+	rwcp = append(rwcp, 'X')
+
+	file := []byte(a2rV3Signature)
+	file = append(file, makeA2RChunk("INFO", makeA2RInfo(3, diskType))...)
+	file = append(file, makeA2RChunk("RWCP", rwcp)...)
+	return file
+}
+
+// Build an A2R v2 file with one STRM capture per location.
+func makeA2RV2(diskType byte, tracks map[byte][]uint64) []byte {
+	var strm []byte
+	for location := 0; location < 255; location++ {
+		transitions, ok := tracks[byte(location)]
+		if !ok {
+			continue
+		}
+		timing := encodeA2RTiming(transitions, 125)
+		capture := []byte{byte(location), a2rCaptureTiming}
+		capture = binary.LittleEndian.AppendUint32(capture, uint32(len(timing)))
+		capture = binary.LittleEndian.AppendUint32(capture, uint32(200e6/125))
+		capture = append(capture, timing...)
+		strm = append(strm, capture...)
+	}
+	strm = append(strm, 0xFF)
+
+	file := []byte(a2rV2Signature)
+	file = append(file, makeA2RChunk("INFO", makeA2RInfo(1, diskType)[:36])...)
+	file = append(file, makeA2RChunk("STRM", strm)...)
+	return file
+}
+
+func writeA2RTestFile(t *testing.T, data []byte) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "test.a2r")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+	return filename
+}
+
+func TestReadA2R_V3(t *testing.T) {
+	filename := writeA2RTestFile(t, makeA2RV3(a2rDisk35DS, map[uint16][]uint64{
+		0: makeA2RTestTrack(t, 0, 0),
+		1: makeA2RTestTrack(t, 0, 1),
+		2: makeA2RTestTrack(t, 1, 0),
+		3: makeA2RTestTrack(t, 1, 1),
+	}))
+
+	disk, err := Read(filename)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if disk.Header.NumberOfTrack != 2 || disk.Header.NumberOfSide != 2 {
+		t.Errorf("geometry = %d tracks, %d sides, expected 2, 2",
+			disk.Header.NumberOfTrack, disk.Header.NumberOfSide)
+	}
+	if disk.Header.BitRate != 500 {
+		t.Errorf("BitRate = %d, expected 500", disk.Header.BitRate)
+	}
+	if disk.Header.FloppyRPM != 300 {
+		t.Errorf("FloppyRPM = %d, expected 300", disk.Header.FloppyRPM)
+	}
+	if disk.Header.FloppyInterfaceMode != IFM_IBMPC_HD {
+		t.Errorf("FloppyInterfaceMode = %d, expected IFM_IBMPC_HD", disk.Header.FloppyInterfaceMode)
+	}
+
+	for cyl := 0; cyl < 2; cyl++ {
+		for head, side := range [][]byte{disk.Tracks[cyl].Side0, disk.Tracks[cyl].Side1} {
+			if n := mfm.NewReader(side).CountSectorsIBMPC(); n != 18 {
+				t.Errorf("track %d side %d: found %d sectors, expected 18", cyl, head, n)
+			}
+		}
+	}
+
+	// Check the contents of one sector
+	_, data, err := mfm.NewReader(disk.Tracks[1].Side0).ReadSectorIBMPC(1, 0)
+	if err != nil {
+		t.Fatalf("ReadSectorIBMPC() error: %v", err)
+	}
+	if len(data) != 512 || data[0] != 18 {
+		t.Errorf("unexpected sector contents: len %d, first byte %d", len(data), data[0])
+	}
+}
+
+func TestReadA2R_V2SkipsQuarterTracks(t *testing.T) {
+	// 5.25" disk: location is quarter track << 1 | side
+	track0 := makeA2RTestTrack(t, 0, 0)
+	filename := writeA2RTestFile(t, makeA2RV2(a2rDisk525DS80, map[byte][]uint64{
+		0: track0,
+		2: track0, // Quarter track 1
+		8: makeA2RTestTrack(t, 1, 0),
+	}))
+
+	disk, err := ReadA2R(filename)
+	if err != nil {
+		t.Fatalf("ReadA2R() error: %v", err)
+	}
+	if disk.Header.NumberOfTrack != 2 || disk.Header.NumberOfSide != 1 {
+		t.Errorf("geometry = %d tracks, %d sides, expected 2, 1",
+			disk.Header.NumberOfTrack, disk.Header.NumberOfSide)
+	}
+	if disk.Header.BitRate != 500 {
+		t.Errorf("BitRate = %d, expected 500", disk.Header.BitRate)
+	}
+	for cyl := 0; cyl < 2; cyl++ {
+		if n := mfm.NewReader(disk.Tracks[cyl].Side0).CountSectorsIBMPC(); n != 18 {
+			t.Errorf("track %d: found %d sectors, expected 18", cyl, n)
+		}
+	}
+}
+
+func TestReadA2R_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{
+			name:    "bad signature",
+			data:    []byte("WOZ2\xff\n\r\n"),
+			wantErr: "invalid A2R signature",
+		},
+		{
+			name:    "GCR disk",
+			data:    makeA2RV3(a2rDisk525SS, nil),
+			wantErr: "unsupported encoding",
+		},
+		{
+			name:    "no captures",
+			data:    makeA2RV3(a2rDisk35DS, nil),
+			wantErr: "no flux captures",
+		},
+		{
+			name:    "truncated chunk",
+			data:    makeA2RV3(a2rDisk35DS, nil)[:20],
+			wantErr: "truncated INFO chunk",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadA2R(writeA2RTestFile(t, tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ReadA2R() error = %v, expected %q", err, tt.wantErr)
+			}
+		})
+	}
+}
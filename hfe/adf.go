@@ -3,7 +3,6 @@ package hfe
 import (
 	"fmt"
 	"github.com/sergev/floppy/mfm"
-	"os"
 )
 
 const (
@@ -16,18 +15,17 @@ const (
 
 // ReadADF reads a file in ADF format and returns a Disk structure.
 func ReadADF(filename string) (*Disk, error) {
-	file, err := os.Open(filename)
+	file, err := openImageFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, err
 	}
 	defer file.Close()
 
 	// Get file size
-	fileInfo, err := file.Stat()
+	fileSize, err := file.Size()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get file info: %w", err)
+		return nil, err
 	}
-	fileSize := fileInfo.Size()
 
 	// Validate file size
 	if fileSize != adfTotalSize {
@@ -116,11 +114,11 @@ func WriteADF(filename string, disk *Disk) error {
 	}
 
 	// Create output file
-	file, err := os.Create(filename)
+	file, err := createAtomic(filename)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return err
 	}
-	defer file.Close()
+	defer file.Abort()
 
 	// Iterate through cylinders and heads
 	for cyl := 0; cyl < adfCylinders; cyl++ {
@@ -134,7 +132,11 @@ func WriteADF(filename string, disk *Disk) error {
 			}
 
 			if len(sideData) == 0 {
-				return fmt.Errorf("empty track %d.%d", cyl, head)
+				// No data captured: fill with zeros
+				if _, err := file.Write(make([]byte, adfSectorsPerTrack*adfSectorSize)); err != nil {
+					return fmt.Errorf("failed to write track %d.%d: %w", cyl, head, err)
+				}
+				continue
 			}
 
 			// Create MFM reader for this track
@@ -181,5 +183,5 @@ func WriteADF(filename string, disk *Disk) error {
 		}
 	}
 
-	return nil
+	return file.Commit()
 }
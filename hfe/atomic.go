@@ -0,0 +1,106 @@
+package hfe
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is a temporary file in the destination directory.
+// Commit renames it into place after successful sync and close,
+// so that a failed write never leaves a truncated image behind.
+// Destination file with .gz suffix is compressed on Commit.
+type atomicFile struct {
+	*os.File
+	filename string // Destination file name
+	done     bool   // Committed or aborted
+}
+
+// Create a temporary file for writing the given destination file
+func createAtomic(filename string) (*atomicFile, error) {
+	file, err := createTemp(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: file, filename: filename}, nil
+}
+
+// Create a temporary file in the directory of the given destination file
+func createTemp(filename string) (*os.File, error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	return file, nil
+}
+
+// Replace the temporary file by another one with compressed contents.
+// The uncompressed file is removed in any case.
+func (f *atomicFile) compress() error {
+	plain := f.File
+	defer func() {
+		plain.Close()
+		os.Remove(plain.Name())
+	}()
+
+	file, err := createTemp(f.filename)
+	if err != nil {
+		return err
+	}
+	if err := gzipFile(file, plain); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to compress file: %w", err)
+	}
+	f.File = file
+	return nil
+}
+
+// Commit flushes data to disk and renames temporary file into place.
+// On failure the temporary file is removed.
+func (f *atomicFile) Commit() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	if isGzipName(f.filename) {
+		if err := f.compress(); err != nil {
+			return err
+		}
+	}
+	tmpName := f.Name()
+	if err := f.Sync(); err != nil {
+		f.File.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	// Temporary files are created with mode 0600
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err := os.Rename(tmpName, f.filename); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return nil
+}
+
+// Abort closes and removes the temporary file, unless it is already committed.
+// It is safe to defer Abort right after createAtomic.
+func (f *atomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.File.Close()
+	os.Remove(f.Name())
+}
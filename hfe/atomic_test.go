@@ -0,0 +1,93 @@
+package hfe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Check that directory contains only the given files
+func checkDirFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error: %v", err)
+	}
+	var found []string
+	for _, e := range entries {
+		found = append(found, e.Name())
+	}
+	if len(found) != len(names) {
+		t.Fatalf("directory contains %v, expected %v", found, names)
+	}
+	for i := range names {
+		if found[i] != names[i] {
+			t.Errorf("directory contains %v, expected %v", found, names)
+		}
+	}
+}
+
+func TestWrite_Atomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "disk.hfe")
+	if err := os.WriteFile(filename, []byte("original"), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	// Too many tracks: write fails in the middle
+	disk := &Disk{
+		Header: Header{NumberOfTrack: 129, NumberOfSide: 1, BitRate: 250, FloppyRPM: 300},
+		Tracks: make([]TrackData, 129),
+	}
+	for i := range disk.Tracks {
+		disk.Tracks[i].Side0 = make([]byte, 100)
+	}
+	if err := Write(filename, disk); err == nil {
+		t.Fatalf("Write() succeeded for 129 tracks")
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil || string(data) != "original" {
+		t.Errorf("original file was modified: %q, %v", data, err)
+	}
+	checkDirFiles(t, dir, "disk.hfe")
+
+	// Successful write replaces the file
+	disk.Header.NumberOfTrack = 2
+	disk.Tracks = disk.Tracks[:2]
+	if err := Write(filename, disk); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if _, err := Read(filename); err != nil {
+		t.Errorf("Read() error: %v", err)
+	}
+	checkDirFiles(t, dir, "disk.hfe")
+
+	// Rename fails when destination is a directory
+	if err := os.Mkdir(filepath.Join(dir, "sub.hfe"), 0755); err != nil {
+		t.Fatalf("Mkdir() error: %v", err)
+	}
+	if err := Write(filepath.Join(dir, "sub.hfe"), disk); err == nil {
+		t.Errorf("Write() succeeded over a directory")
+	}
+	checkDirFiles(t, dir, "disk.hfe", "sub.hfe")
+}
+
+func TestWriter_AppearsOnClose(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "partial.hfe")
+
+	w, err := NewWriter(filename, Header{NumberOfSide: 1, BitRate: 250}, HFEVersion1)
+	if err != nil {
+		t.Fatalf("NewWriter() error: %v", err)
+	}
+	if err := w.WriteTrack(0, make([]byte, 100), nil); err != nil {
+		t.Fatalf("WriteTrack() error: %v", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("file exists before Close")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	checkDirFiles(t, dir, "partial.hfe")
+}
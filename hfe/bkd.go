@@ -3,7 +3,6 @@ package hfe
 import (
 	"fmt"
 	"github.com/sergev/floppy/mfm"
-	"os"
 )
 
 const (
@@ -17,18 +16,17 @@ const (
 // BKD format has fixed geometry: 80 cylinders, 2 heads, 10 sectors per track.
 // Tracks are encoded using IBMPC encoding but without index marks.
 func ReadBKD(filename string) (*Disk, error) {
-	file, err := os.Open(filename)
+	file, err := openImageFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, err
 	}
 	defer file.Close()
 
 	// Get file size
-	fileInfo, err := file.Stat()
+	fileSize, err := file.Size()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get file info: %w", err)
+		return nil, err
 	}
-	fileSize := fileInfo.Size()
 
 	// Validate file size - must be exactly 819,200 bytes
 	if fileSize != bkdExpectedSize {
@@ -120,11 +118,11 @@ func WriteBKD(filename string, disk *Disk) error {
 	}
 
 	// Create output file
-	file, err := os.Create(filename)
+	file, err := createAtomic(filename)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return err
 	}
-	defer file.Close()
+	defer file.Abort()
 
 	// Iterate through cylinders and heads
 	for cyl := 0; cyl < numCylinders; cyl++ {
@@ -139,7 +137,11 @@ func WriteBKD(filename string, disk *Disk) error {
 			}
 
 			if len(sideData) == 0 {
-				return fmt.Errorf("empty track %d.%d", cyl, head)
+				// No data captured: fill with zeros
+				if _, err := file.Write(make([]byte, numSectorsPerTrack*sectorSize)); err != nil {
+					return fmt.Errorf("failed to write track %d.%d: %w", cyl, head, err)
+				}
+				continue
 			}
 
 			// Create MFM reader for this track
@@ -182,5 +184,5 @@ func WriteBKD(filename string, disk *Disk) error {
 			}
 		}
 	}
-	return nil
+	return file.Commit()
 }
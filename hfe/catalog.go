@@ -0,0 +1,282 @@
+package hfe
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CatalogOptions control cataloging of a directory tree of disk images
+type CatalogOptions struct {
+	Workers int // Number of files processed in parallel, or 0 for number of CPUs
+
+	// Convert every image to this format, or ImageFormatUnknown
+	// to inspect images only
+	Format ImageFormat
+
+	// Directory to write converted images to, keeping their paths
+	// relative to the root, or empty to write them next to the sources.
+	// Converted images keep extension of the source before their own,
+	// like dos.img.imd, so that images of one disk in several formats
+	// do not collide.
+	OutputDir string
+
+	Overwrite bool   // Replace converted images when they exist
+	Output    string // File to save the report to, as CSV when the name ends with .csv, or JSON otherwise; empty for none
+
+	// Context to cancel cataloging, or nil
+	Context context.Context
+
+	// Called after each file is processed, or nil.
+	// Calls come from one goroutine at a time, in any order of files.
+	Progress func(done, total int)
+}
+
+// CatalogEntry describes one image file of the catalog
+type CatalogEntry struct {
+	Path        string   `json:"path"`                  // Relative to the root of the catalog
+	Format      string   `json:"format,omitempty"`      // Detected format of the image
+	Sectors     int      `json:"sectors"`               // Good IBM PC sectors
+	Errors      int      `json:"errors"`                // IBM PC sectors with bad checksum or missing
+	Fingerprint string   `json:"fingerprint,omitempty"` // Combined hash of sectors, see Fingerprint
+	Converted   string   `json:"converted,omitempty"`   // Converted image, relative to the output directory
+	Warnings    []string `json:"warnings,omitempty"`    // Problems found in the image or its conversion
+	Error       string   `json:"error,omitempty"`       // Why the image could not be read or converted
+
+	// What the disk probably is, see Identify, or nil
+	Identification *Identification `json:"identification,omitempty"`
+}
+
+// CatalogReport contains results of cataloging, one entry per image file,
+// in order of paths
+type CatalogReport struct {
+	Root    string         `json:"root"`
+	Entries []CatalogEntry `json:"entries"`
+	Failed  int            `json:"failed"` // Entries with error
+}
+
+// Catalog walks the directory tree at root and inspects every file
+// with a known image extension: detects its format, identifies the disk,
+// counts sector errors and computes fingerprint. Images are optionally
+// converted to opts.Format. Files are processed by a pool of workers.
+// A file which cannot be read or converted gets an error in its entry,
+// and does not stop the walk. Returns error when the root cannot be
+// walked, the report cannot be saved, or the context is done.
+func Catalog(root string, opts CatalogOptions) (*CatalogReport, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.Workers < 0 {
+		return nil, fmt.Errorf("invalid number of workers: %d", opts.Workers)
+	}
+
+	report := &CatalogReport{Root: root}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// Unreadable directory deeper in the tree
+			report.Entries = append(report.Entries, CatalogEntry{Path: catalogPath(root, path), Error: err.Error()})
+			return nil
+		}
+		if !d.IsDir() && DetectImageFormat(path) != ImageFormatUnknown {
+			report.Entries = append(report.Entries, CatalogEntry{Path: catalogPath(root, path)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	workers := opts.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(report.Entries))
+
+	// Every worker fills entries it takes from the queue
+	next := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				entry := &report.Entries[i]
+				if entry.Error == "" {
+					catalogFile(ctx, root, entry, opts)
+				}
+				if opts.Progress != nil {
+					mu.Lock()
+					done++
+					opts.Progress(done, len(report.Entries))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+feed:
+	for i := range report.Entries {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range report.Entries {
+		if entry.Error != "" {
+			report.Failed++
+		}
+	}
+	if opts.Output != "" {
+		if err := report.Save(opts.Output); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// Path of the file relative to the root, with forward slashes
+func catalogPath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Inspect one image file, and convert it when requested
+func catalogFile(ctx context.Context, root string, entry *CatalogEntry, opts CatalogOptions) {
+	srcPath := filepath.Join(root, filepath.FromSlash(entry.Path))
+	disk, format, err := openImage(srcPath)
+	if format != ImageFormatUnknown {
+		entry.Format = format.String()
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	if err := disk.Header.Validate(); err != nil {
+		entry.Warnings = append(entry.Warnings, strings.Split(err.Error(), "\n")...)
+	}
+	entry.Identification, _ = Identify(disk)
+	for _, track := range disk.manifestTracks() {
+		entry.Sectors += track.Good
+		entry.Errors += len(track.Bad) + len(track.Missing)
+	}
+	if f, err := Fingerprint(disk); err == nil {
+		entry.Fingerprint = f.SHA256
+	}
+
+	if opts.Format == ImageFormatUnknown {
+		return
+	}
+	if format == opts.Format && opts.OutputDir == "" {
+		entry.Warnings = append(entry.Warnings, fmt.Sprintf("already in %s format", format))
+		return
+	}
+	rel := trimGzipSuffix(entry.Path)
+	if ext := "." + strings.ToLower(opts.Format.String()); !strings.EqualFold(filepath.Ext(rel), ext) {
+		rel += ext
+	}
+	outDir := opts.OutputDir
+	if outDir == "" {
+		outDir = root
+	}
+	dstPath := filepath.Join(outDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	converted, err := Convert(srcPath, dstPath, ConvertOptions{
+		Format:    opts.Format,
+		Overwrite: opts.Overwrite,
+		Context:   ctx,
+	})
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	entry.Converted = rel
+	entry.Warnings = append(entry.Warnings, converted.Warnings...)
+}
+
+// Columns of the report in CSV format
+var catalogColumns = []string{
+	"path", "format", "platform", "filesystem", "description", "confidence",
+	"cylinders", "heads", "sectors_per_track", "sector_size", "bit_rate",
+	"sectors", "errors", "fingerprint", "converted", "warnings", "error",
+}
+
+// WriteJSON writes the report to w as indented JSON
+func (r *CatalogReport) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// WriteCSV writes the report to w as CSV table with a header line,
+// one row per entry. Warnings are joined by semicolons.
+func (r *CatalogReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(catalogColumns)
+	for _, e := range r.Entries {
+		id := e.Identification
+		if id == nil {
+			id = &Identification{}
+		}
+		cw.Write([]string{
+			e.Path, e.Format, string(id.Platform), id.Filesystem, id.Description, string(id.Confidence),
+			strconv.Itoa(id.Cylinders), strconv.Itoa(id.Heads), strconv.Itoa(id.Sectors),
+			strconv.Itoa(id.SectorSize), strconv.Itoa(int(id.BitRate)),
+			strconv.Itoa(e.Sectors), strconv.Itoa(e.Errors), e.Fingerprint, e.Converted,
+			strings.Join(e.Warnings, "; "), e.Error,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Save writes the report to the given file: as CSV when the name
+// ends with .csv, or as JSON otherwise.
+func (r *CatalogReport) Save(filename string) error {
+	file, err := createAtomic(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		err = r.WriteCSV(file)
+	} else {
+		err = r.WriteJSON(file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	return file.Commit()
+}
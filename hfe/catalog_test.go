@@ -0,0 +1,189 @@
+package hfe
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Directory tree of small images: the same DOS disk as IMG and HFE,
+// IMD of random sectors in a subdirectory, a corrupt HFE file,
+// and a file which is not an image
+func makeCatalogTree(t *testing.T) string {
+	root := t.TempDir()
+	disk := makeIdentifyDiskIBM(80, 2, 9, makeBootSector(0xEB, 0x3C, 0x90), nil)
+	if err := WriteIMG(filepath.Join(root, "dos.img"), disk); err != nil {
+		t.Fatalf("WriteIMG() error: %v", err)
+	}
+	if err := Write(filepath.Join(root, "dos.hfe"), disk); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"sub/random.imd": makeRandomIMD(t, 2),
+		"broken.hfe":     append([]byte(HFEv1Signature), 0xFF, 0xFF, 0xFF),
+		"readme.txt":     []byte("not an image\n"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestCatalog(t *testing.T) {
+	root := makeCatalogTree(t)
+	calls := 0
+	report, err := Catalog(root, CatalogOptions{
+		Workers:  2,
+		Progress: func(done, total int) { calls++ },
+	})
+	if err != nil {
+		t.Fatalf("Catalog() error: %v", err)
+	}
+
+	var paths []string
+	for _, e := range report.Entries {
+		paths = append(paths, e.Path)
+	}
+	expected := []string{"broken.hfe", "dos.hfe", "dos.img", "sub/random.imd"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("paths %q, expected %q", paths, expected)
+	}
+	if calls != len(expected) {
+		t.Errorf("progress called %d times, expected %d", calls, len(expected))
+	}
+	if report.Failed != 1 || report.Entries[0].Error == "" {
+		t.Errorf("%d entries failed, broken.hfe error %q: expected only broken.hfe to fail",
+			report.Failed, report.Entries[0].Error)
+	}
+
+	hfe, img, imd := report.Entries[1], report.Entries[2], report.Entries[3]
+	if hfe.Format != "HFE" || img.Format != "IMG" || imd.Format != "IMD" {
+		t.Errorf("formats %s %s %s, expected HFE IMG IMD", hfe.Format, img.Format, imd.Format)
+	}
+	if img.Identification == nil || img.Identification.Description != "DOS FAT12 720K" {
+		t.Errorf("dos.img identified as %+v, expected DOS FAT12 720K", img.Identification)
+	}
+	if img.Sectors != 1440 || img.Errors != 0 {
+		t.Errorf("dos.img has %d good sectors, %d errors, expected 1440 and 0", img.Sectors, img.Errors)
+	}
+	if img.Fingerprint == "" || img.Fingerprint != hfe.Fingerprint {
+		t.Errorf("fingerprints of IMG %q and HFE %q differ", img.Fingerprint, hfe.Fingerprint)
+	}
+	if imd.Sectors != 36 || imd.Fingerprint == "" || imd.Fingerprint == img.Fingerprint {
+		t.Errorf("random.imd has %d sectors, fingerprint %q", imd.Sectors, imd.Fingerprint)
+	}
+}
+
+func TestCatalog_Convert(t *testing.T) {
+	root := makeCatalogTree(t)
+	out := t.TempDir()
+	report, err := Catalog(root, CatalogOptions{Workers: 1, Format: ImageFormatIMD, OutputDir: out})
+	if err != nil {
+		t.Fatalf("Catalog() error: %v", err)
+	}
+
+	// Both DOS images are converted, under names with their extensions
+	if report.Failed != 1 || report.Entries[0].Error == "" {
+		t.Errorf("%d entries failed, expected only broken.hfe", report.Failed)
+	}
+	converted := map[string]string{}
+	for _, e := range report.Entries {
+		if e.Converted != "" {
+			converted[e.Path] = e.Converted
+		}
+	}
+	want := map[string]string{
+		"dos.hfe":        "dos.hfe.imd",
+		"dos.img":        "dos.img.imd",
+		"sub/random.imd": "sub/random.imd",
+	}
+	if !reflect.DeepEqual(converted, want) {
+		t.Errorf("converted %v, expected %v", converted, want)
+	}
+	for _, name := range []string{"dos.hfe.imd", "dos.img.imd", "sub/random.imd"} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Errorf("converted image: %v", err)
+		}
+	}
+
+	// Conversion next to the source skips images in the target format
+	report, err = Catalog(filepath.Join(root, "sub"), CatalogOptions{Format: ImageFormatIMD})
+	if err != nil {
+		t.Fatalf("Catalog() error: %v", err)
+	}
+	if e := report.Entries[0]; e.Converted != "" || len(e.Warnings) != 1 || e.Warnings[0] != "already in IMD format" {
+		t.Errorf("random.imd converted to %q, warnings %q", e.Converted, e.Warnings)
+	}
+}
+
+func TestCatalog_Errors(t *testing.T) {
+	root := makeCatalogTree(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Catalog(root, CatalogOptions{Context: ctx}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Catalog() error = %v, expected context.Canceled", err)
+	}
+	if _, err := Catalog(filepath.Join(root, "missing"), CatalogOptions{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Catalog() error = %v, expected missing root", err)
+	}
+	if _, err := Catalog(root, CatalogOptions{Workers: -1}); err == nil {
+		t.Errorf("Catalog() accepted negative number of workers")
+	}
+}
+
+func TestCatalogReport_Save(t *testing.T) {
+	root := makeCatalogTree(t)
+	out := t.TempDir()
+	jsonName := filepath.Join(out, "catalog.json")
+	report, err := Catalog(root, CatalogOptions{Output: jsonName})
+	if err != nil {
+		t.Fatalf("Catalog() error: %v", err)
+	}
+
+	data, err := os.ReadFile(jsonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded CatalogReport
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to parse JSON report: %v", err)
+	}
+	if !reflect.DeepEqual(&decoded, report) {
+		t.Errorf("JSON report differs:\n%+v\nexpected\n%+v", decoded, *report)
+	}
+
+	csvName := filepath.Join(out, "catalog.CSV")
+	if err := report.Save(csvName); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	file, err := os.Open(csvName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse CSV report: %v", err)
+	}
+	if len(rows) != 1+len(report.Entries) || !reflect.DeepEqual(rows[0], catalogColumns) {
+		t.Fatalf("CSV report has %d rows, header %q", len(rows), rows[0])
+	}
+	img := rows[3]
+	if img[0] != "dos.img" || img[1] != "IMG" || img[4] != "DOS FAT12 720K" || img[6] != "80" ||
+		img[11] != "1440" || img[12] != "0" || img[13] != report.Entries[2].Fingerprint {
+		t.Errorf("CSV row of dos.img: %q", img)
+	}
+	if rows[1][0] != "broken.hfe" || rows[1][16] == "" {
+		t.Errorf("CSV row of broken.hfe: %q", rows[1])
+	}
+}
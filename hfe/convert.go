@@ -0,0 +1,267 @@
+package hfe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConvertOptions control conversion of disk images
+type ConvertOptions struct {
+	Format     ImageFormat // Destination format, or ImageFormatUnknown to detect from extension
+	HFEVersion HFEVersion  // Version of destination HFE file, or 0 to choose automatically
+	Template   string      // HFE file to take header fields from, see CopyMetadataFrom, or empty
+	Cylinders  int         // Number of cylinders to convert, or 0 for all
+	Sides      int         // Number of sides to convert, or 0 for all
+	Overwrite  bool        // Replace destination file when it exists
+	Manifest   bool        // Save manifest of destination file, see ManifestName
+	Identify   bool        // Identify the disk for the report, see ConvertReport
+
+	// Fail when a track has several sectors with the same ID,
+	// instead of adding a warning to the report
+	StrictDuplicates bool
+
+	// Remove trailing cylinders captured past the end of disk, see Trim,
+	// or nil to keep all cylinders
+	Trim *TrimOptions
+
+	// Context to cancel conversion, or nil
+	Context context.Context
+
+	// Called after each cylinder is processed, or nil
+	Progress func(done, total int)
+}
+
+// ConvertReport contains results of conversion
+type ConvertReport struct {
+	SourceFormat ImageFormat // Detected format of source file
+	DestFormat   ImageFormat // Format of destination file
+	Sectors      int         // Number of good IBM PC sectors converted
+	Missing      int         // Number of sectors missing or damaged
+	Warnings     []string    // Problems found in source image
+	ReadOnly     bool        // Source image is write protected, and destination format cannot record it
+	Trim         *TrimReport // Cylinders removed by trimming, or nil
+
+	// What the disk probably is, see Identify. The disk is identified
+	// when asked by options, for the manifest, or when the destination
+	// format may not fit the disk. Nil otherwise, or when not identified.
+	Identification *Identification
+}
+
+// Convert reads a disk image of any supported format from srcPath and writes
+// it to dstPath. Destination format is given by opts.Format, or by extension.
+func Convert(srcPath, dstPath string, opts ConvertOptions) (*ConvertReport, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.Sides < 0 || opts.Sides > 2 || opts.Cylinders < 0 {
+		return nil, fmt.Errorf("invalid geometry: %d cylinders, %d sides", opts.Cylinders, opts.Sides)
+	}
+	if opts.HFEVersion != 0 && opts.HFEVersion != HFEVersion1 && opts.HFEVersion != HFEVersion3 {
+		return nil, fmt.Errorf("invalid HFE version: %d (must be 1 or 3)", opts.HFEVersion)
+	}
+	if opts.Trim != nil {
+		if err := opts.Trim.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ConvertReport{DestFormat: opts.Format}
+	if report.DestFormat == ImageFormatUnknown {
+		report.DestFormat = DetectImageFormat(dstPath)
+		if report.DestFormat == ImageFormatUnknown {
+			return nil, fmt.Errorf("unknown or unsupported image format for file: %s", dstPath)
+		}
+	}
+	if !opts.Overwrite {
+		if _, err := os.Stat(dstPath); err == nil {
+			return nil, fmt.Errorf("%s: %w", dstPath, os.ErrExist)
+		}
+	}
+
+	disk, format, err := openImage(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", srcPath, err)
+	}
+	report.SourceFormat = format
+	if opts.Template != "" {
+		template, err := ReadHFE(opts.Template)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template %s: %w", opts.Template, err)
+		}
+		disk.CopyMetadataFrom(template)
+	}
+	if err := disk.Header.Validate(); err != nil {
+		report.Warnings = append(report.Warnings, strings.Split(err.Error(), "\n")...)
+	}
+	if err := disk.setGeometry(opts.Cylinders, opts.Sides); err != nil {
+		return nil, err
+	}
+	if opts.Trim != nil {
+		report.Trim = disk.Trim(*opts.Trim)
+	}
+	report.ReadOnly = disk.IsWriteProtected() && !keepsWriteProtect(report.DestFormat)
+	if opts.Identify || opts.Manifest || formatMayNotFit(report.DestFormat) {
+		if id, err := Identify(disk); err == nil {
+			report.Identification = id
+			if warning := id.FormatWarning(report.DestFormat); warning != "" {
+				report.Warnings = append(report.Warnings, warning)
+			}
+		}
+	}
+
+	if report.DestFormat != ImageFormatHFE && disk.hasWeakBits() {
+		report.Warnings = append(report.Warnings,
+			fmt.Sprintf("weak bits cannot be stored in %s format", report.DestFormat))
+	}
+
+	// HFE files are written track by track, other formats at once
+	var w *Writer
+	if report.DestFormat == ImageFormatHFE {
+		version := opts.HFEVersion
+		if version == 0 {
+			// Per-track bit rates and weak bits can only be stored in v3 format
+			version = HFEVersion1
+			if disk.hasTrackBitRates() || disk.hasWeakBits() {
+				version = HFEVersion3
+			}
+		}
+		if version != HFEVersion3 && disk.hasWeakBits() {
+			report.Warnings = append(report.Warnings, "weak bits cannot be stored in HFE v1 format")
+		}
+		w, err = NewWriter(dstPath, disk.Header, version)
+		if err != nil {
+			return nil, err
+		}
+		defer w.abort()
+	}
+
+	numCyls := len(disk.Tracks)
+	expected := disk.sectorsPerTrack()
+	for cyl := 0; cyl < numCyls; cyl++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+			decoded := DecodeTrack(disk.Tracks[cyl].side(head), cyl, head)
+			for _, sector := range decoded.Duplicates() {
+				msg := decoded.duplicateMessage(cyl, head, sector)
+				if opts.StrictDuplicates {
+					return nil, errors.New(msg)
+				}
+				report.Warnings = append(report.Warnings, msg)
+			}
+			good := decoded.GoodSectors()
+			report.Sectors += good
+			if good < expected {
+				report.Missing += expected - good
+				report.Warnings = append(report.Warnings,
+					fmt.Sprintf("track %d, side %d: %d sectors missing", cyl, head, expected-good))
+			}
+		}
+		if w != nil {
+			if err := w.WriteTrackData(cyl, disk.Tracks[cyl]); err != nil {
+				return nil, err
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(cyl+1, numCyls)
+		}
+	}
+
+	switch {
+	case w != nil:
+		err = w.Close()
+	case report.DestFormat == ImageFormatIMG:
+		_, err = WriteIMGOptions(dstPath, disk, IMGOptions{Strict: true, Context: ctx})
+	case report.DestFormat == ImageFormatIMD:
+		err = WriteIMDOptions(dstPath, disk, IMDOptions{Context: ctx})
+	default:
+		err = writeFormat(dstPath, disk, report.DestFormat)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write file %s: %w", dstPath, err)
+	}
+
+	if opts.Manifest {
+		m, err := newManifest(dstPath, disk, report.Identification)
+		if err != nil {
+			return nil, err
+		}
+		m.Source = srcPath
+		if err := m.Save(dstPath); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// CopyMetadataFrom copies header fields of the src disk, which cannot be
+// derived from track data: track encoding, rotation speed, interface mode,
+// write protection, single step and track 0 encodings. Number of tracks,
+// number of sides and bit rate stay as given by the data. HFE version
+// and location of the track list are chosen when the file is written.
+// It is used to keep the header of HFE file converted to a format
+// without such fields, like IMG or IMD, and back.
+func (disk *Disk) CopyMetadataFrom(src *Disk) {
+	h := &disk.Header
+	h.TrackEncoding = src.Header.TrackEncoding
+	h.FloppyRPM = src.Header.FloppyRPM
+	h.FloppyInterfaceMode = src.Header.FloppyInterfaceMode
+	h.WriteProtected = src.Header.WriteProtected
+	h.WriteAllowed = src.Header.WriteAllowed
+	h.SingleStep = src.Header.SingleStep
+	h.Track0S0AltEncoding = src.Header.Track0S0AltEncoding
+	h.Track0S0Encoding = src.Header.Track0S0Encoding
+	h.Track0S1AltEncoding = src.Header.Track0S1AltEncoding
+	h.Track0S1Encoding = src.Header.Track0S1Encoding
+}
+
+// Limit number of cylinders and sides of the disk.
+// Zero value keeps the geometry unchanged.
+func (disk *Disk) setGeometry(cylinders, sides int) error {
+	if cylinders > 0 {
+		if cylinders > len(disk.Tracks) {
+			return fmt.Errorf("cannot convert %d cylinders: source has only %d", cylinders, len(disk.Tracks))
+		}
+		disk.Tracks = disk.Tracks[:cylinders]
+		disk.Header.NumberOfTrack = uint8(cylinders)
+	}
+	if sides > 0 {
+		if sides > int(disk.Header.NumberOfSide) {
+			return fmt.Errorf("cannot convert %d sides: source has only %d", sides, disk.Header.NumberOfSide)
+		}
+		if sides == 1 {
+			for i := range disk.Tracks {
+				disk.Tracks[i].Side1 = nil
+			}
+		}
+		disk.Header.NumberOfSide = uint8(sides)
+	}
+	return nil
+}
+
+// Return the largest number of good IBM PC sectors per track,
+// or 0 when the disk has another format.
+func (disk *Disk) sectorsPerTrack() int {
+	result := 0
+	for cyl := range disk.Tracks {
+		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+			result = max(result, countGoodSectors(disk.Tracks[cyl].side(head), cyl, head))
+		}
+	}
+	return result
+}
+
+// Count distinct IBM PC sectors with good checksum on the track
+func countGoodSectors(track []byte, cyl, head int) int {
+	return DecodeTrack(track, cyl, head).GoodSectors()
+}
+
+// Check whether the image format records write protection of the disk
+func keepsWriteProtect(format ImageFormat) bool {
+	return format == ImageFormatHFE || format == ImageFormat86F
+}
@@ -0,0 +1,260 @@
+package hfe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sergev/floppy/images"
+)
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	src := findSampleFile(t, "fat360.img.gz")
+	hfeFile := filepath.Join(dir, "disk.hfe")
+
+	var progress []int
+	report, err := Convert(src, hfeFile, ConvertOptions{
+		HFEVersion: HFEVersion3,
+		Progress:   func(done, total int) { progress = append(progress, done) },
+	})
+	if err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	if report.SourceFormat != ImageFormatIMG || report.DestFormat != ImageFormatHFE {
+		t.Errorf("formats %v -> %v, expected IMG -> HFE", report.SourceFormat, report.DestFormat)
+	}
+	if report.Sectors != 720 || report.Missing != 0 {
+		t.Errorf("converted %d sectors, %d missing, expected 720 and 0", report.Sectors, report.Missing)
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != len(progress) {
+		t.Errorf("progress reported as %v", progress)
+	}
+	data, err := os.ReadFile(hfeFile)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte(HFEv3Signature)) {
+		t.Errorf("destination is not HFE v3 file")
+	}
+
+	// Back to raw image: contents must match the source
+	imgFile := filepath.Join(dir, "disk.img")
+	if _, err := Convert(hfeFile, imgFile, ConvertOptions{}); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	original, _, err := OpenImage(src)
+	if err != nil {
+		t.Fatalf("OpenImage() error: %v", err)
+	}
+	expected := filepath.Join(dir, "expected.img")
+	if err := WriteIMG(expected, original); err != nil {
+		t.Fatalf("WriteIMG() error: %v", err)
+	}
+	got, _ := os.ReadFile(imgFile)
+	want, _ := os.ReadFile(expected)
+	if len(got) != 368640 || !bytes.Equal(got, want) {
+		t.Errorf("round-trip mismatch: %d bytes", len(got))
+	}
+}
+
+func TestConvert_Overwrite(t *testing.T) {
+	src := findSampleFile(t, "fat360.imd")
+	dst := filepath.Join(t.TempDir(), "disk.hfe")
+	if err := os.WriteFile(dst, []byte("keep"), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	_, err := Convert(src, dst, ConvertOptions{})
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Convert() error = %v, expected ErrExist", err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "keep" {
+		t.Errorf("destination was overwritten")
+	}
+
+	if _, err := Convert(src, dst, ConvertOptions{Overwrite: true}); err != nil {
+		t.Fatalf("Convert() with Overwrite error: %v", err)
+	}
+}
+
+func TestConvert_Geometry(t *testing.T) {
+	src := findSampleFile(t, "fat360.imd")
+	dst := filepath.Join(t.TempDir(), "disk.hfe")
+	report, err := Convert(src, dst, ConvertOptions{Cylinders: 10, Sides: 1})
+	if err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	if report.Sectors != 10*9 {
+		t.Errorf("converted %d sectors, expected 90", report.Sectors)
+	}
+	disk, err := Read(dst)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if disk.Header.NumberOfTrack != 10 || disk.Header.NumberOfSide != 1 {
+		t.Errorf("geometry %d/%d, expected 10/1", disk.Header.NumberOfTrack, disk.Header.NumberOfSide)
+	}
+
+	if _, err := Convert(src, dst, ConvertOptions{Cylinders: 100, Overwrite: true}); err == nil {
+		t.Errorf("expected error for too many cylinders")
+	}
+}
+
+func TestConvert_Cancel(t *testing.T) {
+	src := findSampleFile(t, "fat360.imd")
+	dst := filepath.Join(t.TempDir(), "disk.hfe")
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := Convert(src, dst, ConvertOptions{
+		Context: ctx,
+		Progress: func(done, total int) {
+			if done == 5 {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Convert() error = %v, expected context.Canceled", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("destination file left after cancel")
+	}
+}
+
+func TestConvert_Template(t *testing.T) {
+	dir := t.TempDir()
+	sample, err := ReadHFE(findSampleFile(t, "fat12v3.hfe"))
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+
+	// The sample has two cylinders, which raw image cannot describe:
+	// put its header on tracks of a complete 1.44M disk
+	image, err := images.GetImage("fat1.44.img")
+	if err != nil {
+		t.Fatalf("GetImage() error: %v", err)
+	}
+	fullFile := filepath.Join(dir, "fat1.44.img")
+	if err := os.WriteFile(fullFile, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := ReadIMG(fullFile)
+	if err != nil {
+		t.Fatalf("ReadIMG() error: %v", err)
+	}
+	tracks := disk.Header.NumberOfTrack
+	disk.Header = sample.Header
+	disk.Header.NumberOfTrack = tracks
+	src := filepath.Join(dir, "fat12v3.hfe")
+	if err := WriteHFE(src, disk, HFEVersion3); err != nil {
+		t.Fatalf("WriteHFE() error: %v", err)
+	}
+	original, err := ReadHFE(src)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+
+	// HFE to IMG loses header fields
+	imgFile := filepath.Join(dir, "disk.img")
+	if _, err := Convert(src, imgFile, ConvertOptions{}); err != nil {
+		t.Fatalf("Convert() to IMG error: %v", err)
+	}
+
+	// Without template, header fields get default values
+	plainFile := filepath.Join(dir, "plain.hfe")
+	if _, err := Convert(imgFile, plainFile, ConvertOptions{HFEVersion: HFEVersion3}); err != nil {
+		t.Fatalf("Convert() to HFE error: %v", err)
+	}
+	plain, err := ReadHFE(plainFile)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	// Location of track list is chosen by the writer
+	sameHeader := func(a, b Header) bool {
+		a.TrackListOffset = b.TrackListOffset
+		return a == b
+	}
+	if sameHeader(plain.Header, original.Header) {
+		t.Errorf("header is kept without template, test sample is not representative")
+	}
+
+	// IMG back to HFE with the original file as template
+	hfeFile := filepath.Join(dir, "disk.hfe")
+	if _, err := Convert(imgFile, hfeFile, ConvertOptions{HFEVersion: HFEVersion3, Template: src}); err != nil {
+		t.Fatalf("Convert() to HFE error: %v", err)
+	}
+	result, err := ReadHFE(hfeFile)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	if !sameHeader(result.Header, original.Header) {
+		t.Errorf("header %+v\nexpected %+v", result.Header, original.Header)
+	}
+
+	if _, err := Convert(imgFile, hfeFile, ConvertOptions{Template: imgFile, Overwrite: true}); err == nil {
+		t.Errorf("Convert() with non-HFE template succeeded")
+	}
+}
+
+func TestConvert_WriteProtect(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := ReadHFE(findSampleFile(t, "fat12v1.hfe"))
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	if disk.IsWriteProtected() {
+		t.Fatalf("sample is write protected, test is not representative")
+	}
+
+	// Zero header reads as 0x00 in WriteAllowed byte, like in a file
+	if !(&Disk{}).IsWriteProtected() {
+		t.Errorf("zero header is not write protected")
+	}
+	disk.SetWriteProtect(true)
+	if disk.Header.WriteProtected != 0x00 || disk.Header.WriteAllowed != 0x00 {
+		t.Errorf("flags %#x %#x after SetWriteProtect(true)", disk.Header.WriteProtected, disk.Header.WriteAllowed)
+	}
+
+	// Flags are kept through HFE v3 file, and conversion to HFE
+	src := filepath.Join(dir, "master.hfe")
+	if err := WriteHFE(src, disk, HFEVersion3); err != nil {
+		t.Fatalf("WriteHFE() error: %v", err)
+	}
+	hfeFile := filepath.Join(dir, "copy.hfe")
+	report, err := Convert(src, hfeFile, ConvertOptions{HFEVersion: HFEVersion3})
+	if err != nil {
+		t.Fatalf("Convert() to HFE error: %v", err)
+	}
+	if report.ReadOnly {
+		t.Errorf("read-only reported for HFE destination")
+	}
+	result, err := ReadHFE(hfeFile)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	if string(result.Header.HeaderSignature[:]) != HFEv3Signature {
+		t.Errorf("converted file is not HFE v3")
+	}
+	if !result.IsWriteProtected() || result.Header.WriteProtected != 0x00 {
+		t.Errorf("flags %#x %#x lost in round trip", result.Header.WriteProtected, result.Header.WriteAllowed)
+	}
+
+	// Formats without the flag report it
+	for _, name := range []string{"disk.img", "disk.imd"} {
+		report, err := Convert(src, filepath.Join(dir, name), ConvertOptions{})
+		if err != nil {
+			t.Fatalf("Convert() to %s error: %v", name, err)
+		}
+		if !report.ReadOnly {
+			t.Errorf("%s: read-only is not reported", name)
+		}
+	}
+
+	result.SetWriteProtect(false)
+	if result.IsWriteProtected() || result.Header.WriteProtected != 0xFF || result.Header.WriteAllowed != 0xFF {
+		t.Errorf("flags %#x %#x after SetWriteProtect(false)", result.Header.WriteProtected, result.Header.WriteAllowed)
+	}
+}
@@ -0,0 +1,314 @@
+package hfe
+
+import (
+	"fmt"
+)
+
+const (
+	d64SectorSize = 256
+	d64Tracks     = 35
+	d64Sectors    = 683                        // Total number of sectors on 35 tracks
+	d64ImageSize  = d64Sectors * d64SectorSize // 174,848 bytes
+	d64ErrorSize  = d64ImageSize + d64Sectors  // 175,531 bytes, with error info
+	d64DirTrack   = 18                         // Track with BAM and directory
+	d64HeaderGap  = 9                          // Gap between header and data block
+	d64HeaderID   = 0x08                       // Header block descriptor
+	d64DataID     = 0x07                       // Data block descriptor
+	d64WrapBytes  = 400                        // Enough for header and data block of one sector
+)
+
+// Error info codes, one byte per sector after the data
+const (
+	d64ErrOK             = 0x01
+	d64ErrHeaderNotFound = 0x02 // 20 READ ERROR
+	d64ErrNoSync         = 0x03 // 21 READ ERROR
+	d64ErrDataNotFound   = 0x04 // 22 READ ERROR
+	d64ErrDataChecksum   = 0x05 // 23 READ ERROR
+	d64ErrHeaderChecksum = 0x09 // 27 READ ERROR
+	d64ErrIDMismatch     = 0x0b // 29 DISK ID MISMATCH
+)
+
+// Speed zone of Commodore 1541 disk
+type d64Zone struct {
+	firstTrack int    // First track of the zone (1-based)
+	sectors    int    // Sectors per track
+	trackBytes int    // GCR bytes per revolution at 300 RPM
+	gap        int    // Gap after data block, in bytes
+	bitRate    uint16 // Bit rate in kbps, as stored in HFE
+}
+
+// Zones from outer to inner tracks
+var d64Zones = []d64Zone{
+	{1, 21, 7692, 8, 154},
+	{18, 19, 7142, 17, 143},
+	{25, 18, 6666, 12, 133},
+	{31, 17, 6250, 9, 125},
+}
+
+// Find speed zone of the track (1-based)
+func d64TrackZone(track int) d64Zone {
+	zone := d64Zones[0]
+	for _, z := range d64Zones {
+		if track >= z.firstTrack {
+			zone = z
+		}
+	}
+	return zone
+}
+
+// Index of first sector of the track (1-based) in D64 image
+func d64TrackOffset(track int) int {
+	offset := 0
+	for t := 1; t < track; t++ {
+		offset += d64TrackZone(t).sectors
+	}
+	return offset
+}
+
+// ReadD64 reads a file in D64 format and returns a Disk structure.
+// Sectors are encoded as Commodore 1541 GCR tracks, with the bit rate
+// of every track set according to its speed zone.
+func ReadD64(filename string) (*Disk, error) {
+	data, err := readImageData(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var errorInfo []byte
+	switch len(data) {
+	case d64ImageSize:
+	case d64ErrorSize:
+		errorInfo = data[d64ImageSize:]
+	default:
+		return nil, fmt.Errorf("invalid D64 file size: %d bytes (expected %d or %d bytes)",
+			len(data), d64ImageSize, d64ErrorSize)
+	}
+
+	// Disk ID is stored in BAM
+	bam := data[d64TrackOffset(d64DirTrack)*d64SectorSize:]
+	id1, id2 := bam[0xa2], bam[0xa3]
+
+	disk := &Disk{
+		Header: Header{
+			NumberOfTrack:       d64Tracks,
+			NumberOfSide:        1,
+			TrackEncoding:       ENC_C64_GCR,
+			BitRate:             d64Zones[0].bitRate,
+			FloppyRPM:           300,
+			FloppyInterfaceMode: IFM_C64_DD,
+			WriteProtected:      0xFF,
+			WriteAllowed:        0xFF,
+			SingleStep:          0xFF,
+			Track0S0AltEncoding: 0xFF,
+			Track0S0Encoding:    ENC_C64_GCR,
+			Track0S1AltEncoding: 0xFF,
+			Track0S1Encoding:    ENC_C64_GCR,
+		},
+		Tracks: make([]TrackData, d64Tracks),
+	}
+
+	for track := 1; track <= d64Tracks; track++ {
+		zone := d64TrackZone(track)
+		first := d64TrackOffset(track)
+		sectors := make([][]byte, zone.sectors)
+		for s := range sectors {
+			offset := (first + s) * d64SectorSize
+			sectors[s] = data[offset : offset+d64SectorSize]
+		}
+		var codes []byte
+		if errorInfo != nil {
+			codes = errorInfo[first : first+zone.sectors]
+		}
+		if d64Uncaptured(codes) {
+			disk.Tracks[track-1] = TrackData{BitRate: zone.bitRate}
+			continue
+		}
+		disk.Tracks[track-1] = TrackData{
+			Side0:   encodeD64Track(track, sectors, codes, id1, id2),
+			BitRate: zone.bitRate,
+		}
+	}
+	return disk, nil
+}
+
+// Check whether no sector of the track has sync mark:
+// such is the placeholder of a track without data
+func d64Uncaptured(codes []byte) bool {
+	if len(codes) == 0 {
+		return false
+	}
+	for _, code := range codes {
+		if code != d64ErrNoSync {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode sectors of one track as GCR bitstream of one revolution.
+// Error info codes, when present, are reproduced as damaged blocks.
+func encodeD64Track(track int, sectors [][]byte, codes []byte, id1, id2 byte) []byte {
+	zone := d64TrackZone(track)
+	w := &gcrTrackWriter{data: make([]byte, 0, zone.trackBytes)}
+
+	for s, data := range sectors {
+		code := byte(d64ErrOK)
+		if codes != nil {
+			code = codes[s]
+		}
+
+		// Header block: ID, checksum, sector, track, disk ID, padding
+		headerID, id := byte(d64HeaderID), id1
+		switch code {
+		case d64ErrHeaderNotFound:
+			headerID = 0
+		case d64ErrIDMismatch:
+			id ^= 0xff
+		}
+		header := []byte{headerID, 0, byte(s), byte(track), id2, id, 0x0f, 0x0f}
+		header[1] = header[2] ^ header[3] ^ header[4] ^ header[5]
+		if code == d64ErrHeaderChecksum {
+			header[1] ^= 0xff
+		}
+
+		// Data block: ID, data, checksum, padding
+		block := make([]byte, d64SectorSize+4)
+		block[0] = d64DataID
+		if code == d64ErrDataNotFound {
+			block[0] = 0
+		}
+		copy(block[1:], data)
+		for _, b := range data {
+			block[d64SectorSize+1] ^= b
+		}
+		if code == d64ErrDataChecksum {
+			block[d64SectorSize+1] ^= 0xff
+		}
+
+		// Without sync marks, the sector cannot be found
+		if code != d64ErrNoSync {
+			w.writeSync()
+		}
+		w.writeBlock(header)
+		w.writeGap(d64HeaderGap)
+		if code != d64ErrNoSync {
+			w.writeSync()
+		}
+		w.writeBlock(block)
+		w.writeGap(zone.gap)
+	}
+
+	// Fill the rest of the revolution
+	w.writeGap(zone.trackBytes - len(w.data))
+	return w.data
+}
+
+// Sectors of one track, from GCR bitstream. Track without data
+// gives sectors with no sync mark, which ReadD64 maps back to empty track.
+func d64TrackSectors(track int, bits []byte) ([][]byte, []byte) {
+	if len(bits) > 0 {
+		return decodeD64Track(track, bits)
+	}
+	zone := d64TrackZone(track)
+	sectors := make([][]byte, zone.sectors)
+	codes := make([]byte, zone.sectors)
+	for s := range sectors {
+		sectors[s] = make([]byte, d64SectorSize)
+		codes[s] = d64ErrNoSync
+	}
+	return sectors, codes
+}
+
+// Decode sectors of one track from GCR bitstream.
+// Returns sector data and error info code for every sector.
+// Missing sectors are filled with zeros.
+func decodeD64Track(track int, bits []byte) ([][]byte, []byte) {
+	zone := d64TrackZone(track)
+	sectors := make([][]byte, zone.sectors)
+	codes := make([]byte, zone.sectors)
+	for s := range sectors {
+		sectors[s] = make([]byte, d64SectorSize)
+		codes[s] = d64ErrHeaderNotFound
+	}
+
+	// Sector may wrap around the end of the track: scan a bit further
+	extra := min(len(bits), d64WrapBytes)
+	scan := make([]byte, 0, len(bits)+extra)
+	scan = append(scan, bits...)
+	scan = append(scan, bits[:extra]...)
+
+	r := &gcrTrackReader{data: scan}
+	for r.findSync() {
+		header, err := r.readBytes(8)
+		if err != nil || header[0] != d64HeaderID {
+			continue
+		}
+		s := int(header[2])
+		if int(header[3]) != track || s >= zone.sectors || codes[s] == d64ErrOK {
+			continue
+		}
+		code := byte(d64ErrOK)
+		if header[1] != header[2]^header[3]^header[4]^header[5] {
+			code = d64ErrHeaderChecksum
+		}
+
+		// Data block follows after the next sync
+		pos := r.pos
+		if !r.findSync() {
+			codes[s] = d64ErrDataNotFound
+			break
+		}
+		block, err := r.readBytes(d64SectorSize + 4)
+		if err != nil || block[0] != d64DataID {
+			// Might be the header of the next sector
+			codes[s] = d64ErrDataNotFound
+			r.pos = pos
+			continue
+		}
+		checksum := byte(0)
+		for _, b := range block[1 : d64SectorSize+1] {
+			checksum ^= b
+		}
+		if code == d64ErrOK && checksum != block[d64SectorSize+1] {
+			code = d64ErrDataChecksum
+		}
+		copy(sectors[s], block[1:d64SectorSize+1])
+		codes[s] = code
+	}
+	return sectors, codes
+}
+
+// WriteD64 writes a Disk structure to a D64 format file.
+// Error info is appended when some sectors could not be read.
+func WriteD64(filename string, disk *Disk) error {
+	if int(disk.Header.NumberOfTrack) < d64Tracks || len(disk.Tracks) < d64Tracks {
+		return fmt.Errorf("invalid number of tracks: %d (expected %d)", disk.Header.NumberOfTrack, d64Tracks)
+	}
+
+	data := make([]byte, 0, d64ErrorSize)
+	errorInfo := make([]byte, 0, d64Sectors)
+	hasErrors := false
+	for track := 1; track <= d64Tracks; track++ {
+		sectors, codes := d64TrackSectors(track, disk.Tracks[track-1].Side0)
+		for s := range sectors {
+			data = append(data, sectors[s]...)
+			if codes[s] != d64ErrOK {
+				hasErrors = true
+			}
+		}
+		errorInfo = append(errorInfo, codes...)
+	}
+	if hasErrors {
+		data = append(data, errorInfo...)
+	}
+
+	file, err := createAtomic(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return file.Commit()
+}
@@ -0,0 +1,200 @@
+package hfe
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Generate D64 image contents: every sector is filled with its track and sector
+// numbers, and BAM on track 18 sector 0 has a recognizable signature.
+func makeTestD64() []byte {
+	data := make([]byte, 0, d64ImageSize)
+	for track := 1; track <= d64Tracks; track++ {
+		for s := 0; s < d64TrackZone(track).sectors; s++ {
+			sector := make([]byte, d64SectorSize)
+			for i := range sector {
+				sector[i] = byte(track*7 + s*3 + i)
+			}
+			if track == d64DirTrack && s == 0 {
+				copy(sector, []byte{18, 1, 0x41, 0})
+				copy(sector[0x90:], "TEST DISK")
+				sector[0xa2], sector[0xa3] = 'A', 'B'
+			}
+			data = append(data, sector...)
+		}
+	}
+	return data
+}
+
+func TestGCREncode(t *testing.T) {
+	// Header block ID 08 is encoded as 01010 01001
+	encoded := gcrEncode([]byte{0x08, 0x00, 0x00, 0x00})
+	if len(encoded) != 5 || encoded[0] != 0x52 || encoded[1]&0xc0 != 0x40 {
+		t.Errorf("gcrEncode() = % x", encoded)
+	}
+
+	// Decode back with the track reader, after a sync mark
+	data := []byte{0x12, 0x34, 0xab, 0xcf, 0x07, 0x08, 0xff, 0x00}
+	w := &gcrTrackWriter{}
+	w.writeGap(3)
+	w.writeSync()
+	w.writeBlock(data)
+	r := &gcrTrackReader{data: w.data}
+	if !r.findSync() {
+		t.Fatalf("sync not found")
+	}
+	decoded, err := r.readBytes(len(data))
+	if err != nil {
+		t.Fatalf("readBytes() error: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Errorf("decoded % x, expected % x", decoded, data)
+	}
+}
+
+func TestD64RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	image := makeTestD64()
+	src := filepath.Join(dir, "test.d64")
+	if err := os.WriteFile(src, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err := ReadD64(src)
+	if err != nil {
+		t.Fatalf("ReadD64() error: %v", err)
+	}
+	h := disk.Header
+	if h.NumberOfTrack != 35 || h.NumberOfSide != 1 || h.TrackEncoding != ENC_C64_GCR ||
+		h.FloppyInterfaceMode != IFM_C64_DD || h.FloppyRPM != 300 {
+		t.Errorf("unexpected header %+v", h)
+	}
+
+	// Every speed zone has its own bit rate and track length
+	for _, tc := range []struct {
+		track   int
+		bitRate uint16
+		length  int
+	}{{1, 154, 7692}, {17, 154, 7692}, {18, 143, 7142}, {25, 133, 6666}, {35, 125, 6250}} {
+		td := disk.Tracks[tc.track-1]
+		if td.BitRate != tc.bitRate || len(td.Side0) != tc.length {
+			t.Errorf("track %d: %d kbps, %d bytes, expected %d kbps, %d bytes",
+				tc.track, td.BitRate, len(td.Side0), tc.bitRate, tc.length)
+		}
+	}
+
+	// BAM lands on track 18 sector 0
+	sectors, codes := decodeD64Track(18, disk.Tracks[17].Side0)
+	bam := image[d64TrackOffset(18)*d64SectorSize:][:d64SectorSize]
+	if codes[0] != d64ErrOK || !bytes.Equal(sectors[0], bam) {
+		t.Errorf("BAM not found at track 18 sector 0")
+	}
+
+	dst := filepath.Join(dir, "copy.d64")
+	if err := WriteD64(dst, disk); err != nil {
+		t.Fatalf("WriteD64() error: %v", err)
+	}
+	result, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, image) {
+		t.Errorf("D64 image differs after round trip (%d bytes, expected %d)", len(result), len(image))
+	}
+}
+
+func TestD64ErrorInfo(t *testing.T) {
+	dir := t.TempDir()
+	image := makeTestD64()
+	errorInfo := bytes.Repeat([]byte{d64ErrOK}, d64Sectors)
+	errorInfo[5] = d64ErrDataChecksum
+	errorInfo[100] = d64ErrHeaderChecksum
+	image = append(image, errorInfo...)
+
+	src := filepath.Join(dir, "errors.d64")
+	if err := os.WriteFile(src, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := ReadD64(src)
+	if err != nil {
+		t.Fatalf("ReadD64() error: %v", err)
+	}
+	dst := filepath.Join(dir, "copy.d64")
+	if err := WriteD64(dst, disk); err != nil {
+		t.Fatalf("WriteD64() error: %v", err)
+	}
+	result, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, image) {
+		t.Errorf("D64 image with error info differs after round trip (%d bytes, expected %d)", len(result), len(image))
+	}
+}
+
+func TestD64ThroughHFE(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "test.d64")
+	if err := os.WriteFile(src, makeTestD64(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := Read(src)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+
+	// Zone bit rates must survive in HFE v3 file
+	hfeFile := filepath.Join(dir, "test.hfe")
+	if err := Write(hfeFile, disk); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	loaded, err := ReadHFE(hfeFile)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	if string(loaded.Header.HeaderSignature[:]) != HFEv3Signature {
+		t.Errorf("signature %q, expected %q", loaded.Header.HeaderSignature[:], HFEv3Signature)
+	}
+	for i := range disk.Tracks {
+		if loaded.TrackBitRate(i) != disk.TrackBitRate(i) {
+			t.Errorf("track %d: bit rate %d, expected %d", i+1, loaded.TrackBitRate(i), disk.TrackBitRate(i))
+		}
+	}
+}
+
+// Track without data is stored as sectors without sync mark, and read back as empty
+func TestD64EmptyTrack(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "test.d64")
+	if err := os.WriteFile(src, makeTestD64(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := ReadD64(src)
+	if err != nil {
+		t.Fatalf("ReadD64() error: %v", err)
+	}
+	disk.Tracks[19].Side0 = nil
+
+	dst := filepath.Join(dir, "copy.d64")
+	if err := WriteD64(dst, disk); err != nil {
+		t.Fatalf("WriteD64() error: %v", err)
+	}
+	result, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != d64ImageSize+d64Sectors {
+		t.Fatalf("D64 image of %d bytes, expected error info", len(result))
+	}
+	loaded, err := ReadD64(dst)
+	if err != nil {
+		t.Fatalf("ReadD64() error: %v", err)
+	}
+	for i, td := range loaded.Tracks {
+		if td.Empty() != (i == 19) {
+			t.Errorf("track %d: %d bytes", i+1, len(td.Side0))
+		}
+	}
+}
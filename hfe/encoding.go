@@ -0,0 +1,40 @@
+package hfe
+
+import "github.com/sergev/floppy/mfm"
+
+// DetectEncoding finds encoding of MFM track at the given cylinder and side:
+// ENC_ISOIBM_MFM when the track has IBM PC sectors, ENC_Amiga_MFM when it
+// has Amiga sectors with correct header checksum, or ENC_Unknown.
+func DetectEncoding(track []byte, cyl, head int) uint8 {
+	if len(track) == 0 {
+		return ENC_Unknown
+	}
+	if mfm.NewReader(track).CountSectorsIBMPC() > 0 {
+		return ENC_ISOIBM_MFM
+	}
+	if mfm.NewReader(track).CountSectorsAmiga(cyl*2+head) > 0 {
+		return ENC_Amiga_MFM
+	}
+	return ENC_Unknown
+}
+
+// SetEncoding sets track encoding of the disk, also for track 0,
+// and interface mode which matches it at bit rate of the header.
+// Disks of unknown encoding get IBM PC interface mode.
+func (h *Header) SetEncoding(encoding uint8) {
+	h.TrackEncoding = encoding
+	h.Track0S0Encoding = encoding
+	h.Track0S1Encoding = encoding
+	switch {
+	case encoding == ENC_Amiga_MFM && h.BitRate >= 375:
+		h.FloppyInterfaceMode = IFM_Amiga_HD
+	case encoding == ENC_Amiga_MFM:
+		h.FloppyInterfaceMode = IFM_Amiga_DD
+	case h.BitRate >= 750:
+		h.FloppyInterfaceMode = IFM_IBMPC_ED
+	case h.BitRate >= 375:
+		h.FloppyInterfaceMode = IFM_IBMPC_HD
+	default:
+		h.FloppyInterfaceMode = IFM_IBMPC_DD
+	}
+}
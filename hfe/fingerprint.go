@@ -0,0 +1,156 @@
+package hfe
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// DiskFingerprint identifies logical contents of a disk: data of IBM PC sectors,
+// regardless of image format, gaps, or bit alignment of tracks.
+// Identical disks captured by different adapters have identical fingerprints.
+type DiskFingerprint struct {
+	SHA256 string             // Combined hash of all tracks, in hex
+	Tracks []TrackFingerprint // Hashes of every track, in order of cylinder and head
+}
+
+// TrackFingerprint identifies contents of one track
+type TrackFingerprint struct {
+	Cylinder int
+	Head     int
+	Sectors  int    // Number of sectors found, good or bad
+	SHA256   string // Hash of sector payloads, in hex
+}
+
+// Status of sector in the hashed stream
+const (
+	fingerprintGood    = 0
+	fingerprintDeleted = 1 // Deleted data address mark
+	fingerprintBad     = 2 // Bad checksum: data is not reliable and not hashed
+	fingerprintMissing = 3
+)
+
+// Fingerprint decodes IBM PC sectors of every track and computes
+// SHA-256 hashes of their contents. Sectors are hashed in order of their
+// numbers, from 1 up to the largest number found on the disk; sectors
+// missing from a track are hashed as such. Gaps and checksums are skipped.
+// Unformatted tracks at the end of the disk, as left by capture
+// of extra cylinders, do not change the combined hash.
+func Fingerprint(disk *Disk) (*DiskFingerprint, error) {
+	type trackSectors struct {
+		cyl, head int
+		sectors   map[int]*mfm.SectorIBMPC
+	}
+	var tracks []trackSectors
+	maxSector := 0
+	for cyl := range disk.Tracks {
+		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+			sectors := make(map[int]*mfm.SectorIBMPC)
+			reader := mfm.NewReader(disk.Tracks[cyl].side(head))
+			reader.Tolerance = IDTolerance
+			for {
+				s, err := reader.ReadSectorInfoIBMPC(cyl, head)
+				if err != nil {
+					break
+				}
+				if s.Sector < 1 {
+					continue
+				}
+				// Keep the first good copy
+				if old, found := sectors[s.Sector]; found && !old.Bad {
+					continue
+				}
+				sectors[s.Sector] = s
+				maxSector = max(maxSector, s.Sector)
+			}
+			tracks = append(tracks, trackSectors{cyl, head, sectors})
+		}
+	}
+	if maxSector == 0 {
+		return nil, fmt.Errorf("no sectors of IBM PC format found")
+	}
+
+	f := &DiskFingerprint{}
+	diskHash := sha256.New()
+	pending := sha256.New() // Hashes of tracks after the last formatted one
+	for _, t := range tracks {
+		trackHash := sha256.New()
+		for s := 1; s <= maxSector; s++ {
+			hashSector(trackHash, s, t.sectors[s])
+		}
+		sum := trackHash.Sum(nil)
+		f.Tracks = append(f.Tracks, TrackFingerprint{
+			Cylinder: t.cyl,
+			Head:     t.head,
+			Sectors:  len(t.sectors),
+			SHA256:   hex.EncodeToString(sum),
+		})
+
+		pending.Write(sum)
+		if len(t.sectors) > 0 {
+			diskHash.Write(pending.Sum(nil))
+			pending.Reset()
+		}
+	}
+	f.SHA256 = hex.EncodeToString(diskHash.Sum(nil))
+	return f, nil
+}
+
+// Add sector to the hash: its number and status, then size and data of good sectors
+func hashSector(h hash.Hash, num int, s *mfm.SectorIBMPC) {
+	status := byte(fingerprintGood)
+	switch {
+	case s == nil:
+		status = fingerprintMissing
+	case s.Bad:
+		status = fingerprintBad
+	case s.Deleted:
+		status = fingerprintDeleted
+	}
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(num))
+	header[4] = status
+	h.Write(header[:])
+	if status == fingerprintGood || status == fingerprintDeleted {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(s.Data)))
+		h.Write(size[:])
+		h.Write(s.Data)
+	}
+}
+
+// Diff compares the fingerprint track by track with the expected one.
+// Returns a description of every track which differs from the expected,
+// or nil when disks are identical.
+func (f *DiskFingerprint) Diff(expected *DiskFingerprint) []string {
+	var diffs []string
+	n := max(len(f.Tracks), len(expected.Tracks))
+	for i := 0; i < n; i++ {
+		switch {
+		case i >= len(f.Tracks):
+			t := expected.Tracks[i]
+			if t.Sectors > 0 {
+				diffs = append(diffs, fmt.Sprintf("track %d.%d: missing", t.Cylinder, t.Head))
+			}
+		case i >= len(expected.Tracks):
+			t := f.Tracks[i]
+			if t.Sectors > 0 {
+				diffs = append(diffs, fmt.Sprintf("track %d.%d: unexpected", t.Cylinder, t.Head))
+			}
+		case f.Tracks[i].SHA256 != expected.Tracks[i].SHA256:
+			a, b := f.Tracks[i], expected.Tracks[i]
+			if a.Cylinder != b.Cylinder || a.Head != b.Head {
+				diffs = append(diffs, fmt.Sprintf("track %d.%d: compared to track %d.%d", a.Cylinder, a.Head, b.Cylinder, b.Head))
+			} else if a.Sectors != b.Sectors {
+				diffs = append(diffs, fmt.Sprintf("track %d.%d: %d sectors, %d expected", a.Cylinder, a.Head, a.Sectors, b.Sectors))
+			} else {
+				diffs = append(diffs, fmt.Sprintf("track %d.%d: contents differ", a.Cylinder, a.Head))
+			}
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,124 @@
+package hfe_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/hfe/hfetest"
+)
+
+func fingerprint(t *testing.T, disk *hfe.Disk) *hfe.DiskFingerprint {
+	t.Helper()
+	f, err := hfe.Fingerprint(disk)
+	if err != nil {
+		t.Fatalf("Fingerprint() error: %v", err)
+	}
+	return f
+}
+
+func TestFingerprint(t *testing.T) {
+	g := hfetest.Geometry{Cylinders: 80, Sides: 2, SectorsPerTrack: 9}
+	disk := hfetest.RandomDisk(7, g, false)
+	dir := t.TempDir()
+
+	// HFE file with rotated tracks and IMG converted from it
+	// have different tracks, but the same sectors
+	hfeFile := filepath.Join(dir, "disk.hfe")
+	if err := hfe.Write(hfeFile, disk); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	hfeDisk, err := hfe.Read(hfeFile)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	for i := range hfeDisk.Tracks {
+		hfeDisk.Tracks[i].Side0 = hfe.RotateTrack(hfeDisk.Tracks[i].Side0, 8*100)
+		hfeDisk.Tracks[i].Side1 = hfe.RotateTrack(hfeDisk.Tracks[i].Side1, 8*100)
+	}
+	imgFile := filepath.Join(dir, "disk.img")
+	if err := hfe.WriteIMG(imgFile, hfeDisk); err != nil {
+		t.Fatalf("WriteIMG() error: %v", err)
+	}
+	imgDisk, err := hfe.ReadIMG(imgFile)
+	if err != nil {
+		t.Fatalf("ReadIMG() error: %v", err)
+	}
+	if bytes.Equal(imgDisk.Tracks[0].Side0, hfeDisk.Tracks[0].Side0) {
+		t.Fatalf("IMG re-encoded track is identical to HFE track")
+	}
+
+	want := fingerprint(t, hfeDisk)
+	got := fingerprint(t, imgDisk)
+	if got.SHA256 != want.SHA256 {
+		t.Errorf("IMG fingerprint %s, HFE fingerprint %s", got.SHA256, want.SHA256)
+	}
+	if diffs := got.Diff(want); len(diffs) != 0 {
+		t.Errorf("unexpected differences: %v", diffs)
+	}
+	if len(want.Tracks) != 160 || want.Tracks[159].Sectors != 9 {
+		t.Errorf("%d tracks fingerprinted", len(want.Tracks))
+	}
+
+	// Unformatted extra cylinder does not change the disk hash
+	extra := imgDisk.Clone()
+	extra.Tracks = append(extra.Tracks, hfe.TrackData{
+		Side0: make([]byte, len(imgDisk.Tracks[0].Side0)),
+		Side1: make([]byte, len(imgDisk.Tracks[0].Side1)),
+	})
+	extra.Header.NumberOfTrack++
+	if f := fingerprint(t, extra); f.SHA256 != want.SHA256 || len(f.Diff(want)) != 0 {
+		t.Errorf("extra empty cylinder changed fingerprint: %v", f.Diff(want))
+	}
+
+	// One byte change alters hash of the affected track and of the disk
+	data, err := imgDisk.ReadSector(12, 1, 5)
+	if err != nil {
+		t.Fatalf("ReadSector() error: %v", err)
+	}
+	data[100] ^= 1
+	if err := imgDisk.WriteSector(12, 1, 5, data); err != nil {
+		t.Fatalf("WriteSector() error: %v", err)
+	}
+	changed := fingerprint(t, imgDisk)
+	if changed.SHA256 == want.SHA256 {
+		t.Errorf("disk hash not changed")
+	}
+	for i, track := range changed.Tracks {
+		modified := track.Cylinder == 12 && track.Head == 1
+		if (track.SHA256 != want.Tracks[i].SHA256) != modified {
+			t.Errorf("track %d.%d: hash changed %v, expected %v", track.Cylinder, track.Head, !modified, modified)
+		}
+	}
+	diffs := changed.Diff(want)
+	if len(diffs) != 1 || diffs[0] != "track 12.1: contents differ" {
+		t.Errorf("Diff() = %q", diffs)
+	}
+
+	// Messages describe the fingerprint relative to the expected one
+	short := imgDisk.Clone()
+	short.Tracks = short.Tracks[:79]
+	short.Header.NumberOfTrack--
+	diffs = fingerprint(t, short).Diff(changed)
+	if len(diffs) != 2 || diffs[0] != "track 79.0: missing" || diffs[1] != "track 79.1: missing" {
+		t.Errorf("Diff() of short disk = %q", diffs)
+	}
+	diffs = changed.Diff(fingerprint(t, short))
+	if len(diffs) != 2 || diffs[0] != "track 79.0: unexpected" {
+		t.Errorf("Diff() of long disk = %q", diffs)
+	}
+	erased := imgDisk.Clone()
+	erased.Tracks[3].Side0 = make([]byte, len(erased.Tracks[3].Side0))
+	copy(erased.Tracks[3].Side0, imgDisk.Tracks[3].Side0[:len(imgDisk.Tracks[3].Side0)/2])
+	diffs = fingerprint(t, erased).Diff(changed)
+	if len(diffs) != 1 || diffs[0] != "track 3.0: 5 sectors, 9 expected" {
+		t.Errorf("Diff() of erased track = %q", diffs)
+	}
+
+	// Disk without sectors has no fingerprint
+	empty := &hfe.Disk{Header: hfe.Header{NumberOfSide: 1}, Tracks: make([]hfe.TrackData, 1)}
+	if _, err := hfe.Fingerprint(empty); err == nil {
+		t.Errorf("expected error for disk without sectors")
+	}
+}
@@ -0,0 +1,81 @@
+package hfe
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/sergev/floppy/flux"
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Largest jitter of flux transitions, as a fraction of bitcell, at which
+// the decoder still recovers every sector. At 500 kbps that is 60 nsec
+// of standard deviation, with drive speed off by up to 3%.
+const maxJitterFraction = 0.06
+
+// Replay tracks of the sample image through synthesized flux and PLL:
+// all sectors must decode with valid CRC and the same contents.
+func TestFluxRoundTrip(t *testing.T) {
+	disk, err := Read(findSampleFile(t, "fat12v1.hfe"))
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	bitRate := disk.Header.BitRate
+	cellNs := 1e6 / (2 * float64(bitRate))
+	jitters := []float64{0, maxJitterFraction / 2, maxJitterFraction}
+	if testing.Short() {
+		jitters = jitters[2:]
+	}
+	for _, jitter := range jitters {
+		for _, rpmError := range []float64{0, 0.03, -0.03} {
+			name := fmt.Sprintf("jitter %.0fns, speed %+.0f%%", jitter*cellNs, rpmError*100)
+			t.Run(name, func(t *testing.T) {
+				for cyl := range disk.Tracks {
+					for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+						bits := disk.Tracks[cyl].side(head)
+						intervals := flux.SynthesizeFlux(bits, bitRate, jitter*cellNs, rpmError)
+						track := &flux.FluxTrack{Transitions: mfm.IntervalsToTransitions(intervals)}
+						decoded, err := track.DecodeMFM(bitRate, pll.Config{})
+						if err != nil {
+							t.Fatalf("DecodeMFM() error: %v", err)
+						}
+						compareSectors(t, cyl, head, bits, decoded)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Check that all sectors of the original track are decoded identically
+func compareSectors(t *testing.T, cyl, head int, want, got []byte) {
+	t.Helper()
+	sectors := make(map[int][]byte)
+	reader := mfm.NewReader(got)
+	for {
+		s, err := reader.ReadSectorInfoIBMPC(cyl, head)
+		if err != nil {
+			break
+		}
+		if !s.Bad {
+			sectors[s.Sector] = s.Data
+		}
+	}
+	reader = mfm.NewReader(want)
+	count := 0
+	for {
+		s, err := reader.ReadSectorInfoIBMPC(cyl, head)
+		if err != nil {
+			break
+		}
+		count++
+		if !bytes.Equal(sectors[s.Sector], s.Data) {
+			t.Errorf("track %d.%d: sector %d lost or damaged", cyl, head, s.Sector)
+		}
+	}
+	if count == 0 {
+		t.Errorf("track %d.%d: no sectors in original", cyl, head)
+	}
+}
@@ -0,0 +1,134 @@
+package hfe
+
+import (
+	"fmt"
+)
+
+// Commodore GCR encoding: every 4-bit nibble is written as a 5-bit group,
+// so that there are never more than two zero bits in a row,
+// and never more than eight one bits in a row.
+var gcrEncodeTable = [16]byte{
+	0x0a, 0x0b, 0x12, 0x13, 0x0e, 0x0f, 0x16, 0x17,
+	0x09, 0x19, 0x1a, 0x1b, 0x0d, 0x1d, 0x1e, 0x15,
+}
+
+// Reverse table: 5-bit group to nibble, 0xff for invalid groups
+var gcrDecodeTable [32]byte
+
+func init() {
+	for i := range gcrDecodeTable {
+		gcrDecodeTable[i] = 0xff
+	}
+	for nibble, group := range gcrEncodeTable {
+		gcrDecodeTable[group] = byte(nibble)
+	}
+}
+
+const (
+	gcrSyncBytes   = 5    // Sync mark: 40 one bits
+	gcrMinSyncBits = 10   // Minimal run of one bits recognized as sync
+	gcrGapByte     = 0x55 // Filler written in gaps, not GCR encoded
+)
+
+// Encode data bytes to GCR. Length of data must be a multiple of 4:
+// every 4 bytes are encoded as 5 bytes.
+func gcrEncode(data []byte) []byte {
+	result := make([]byte, 0, len(data)/4*5)
+	for i := 0; i+4 <= len(data); i += 4 {
+		// Collect 40 bits of four groups
+		var bits uint64
+		for _, b := range data[i : i+4] {
+			bits = bits<<10 |
+				uint64(gcrEncodeTable[b>>4])<<5 |
+				uint64(gcrEncodeTable[b&0x0f])
+		}
+		for shift := 32; shift >= 0; shift -= 8 {
+			result = append(result, byte(bits>>shift))
+		}
+	}
+	return result
+}
+
+// gcrTrackWriter builds GCR bitstream of a track
+type gcrTrackWriter struct {
+	data []byte
+}
+
+// Append sync mark
+func (w *gcrTrackWriter) writeSync() {
+	for i := 0; i < gcrSyncBytes; i++ {
+		w.data = append(w.data, 0xff)
+	}
+}
+
+// Append GCR encoded block
+func (w *gcrTrackWriter) writeBlock(block []byte) {
+	w.data = append(w.data, gcrEncode(block)...)
+}
+
+// Append gap of given length in bytes
+func (w *gcrTrackWriter) writeGap(n int) {
+	for i := 0; i < n; i++ {
+		w.data = append(w.data, gcrGapByte)
+	}
+}
+
+// gcrTrackReader scans GCR bitstream of a track
+type gcrTrackReader struct {
+	data []byte
+	pos  int // Position in bits
+}
+
+// Return next bit, or -1 at end of data
+func (r *gcrTrackReader) nextBit() int {
+	if r.pos >= len(r.data)*8 {
+		return -1
+	}
+	bit := int(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return bit
+}
+
+// Find next sync mark, and position the reader at the first bit after it.
+// Returns false when no more sync marks found.
+func (r *gcrTrackReader) findSync() bool {
+	ones := 0
+	for {
+		switch r.nextBit() {
+		case -1:
+			return false
+		case 1:
+			ones++
+		default:
+			if ones >= gcrMinSyncBits {
+				// Block starts with this zero bit
+				r.pos--
+				return true
+			}
+			ones = 0
+		}
+	}
+}
+
+// Read and decode n bytes of GCR data
+func (r *gcrTrackReader) readBytes(n int) ([]byte, error) {
+	result := make([]byte, n)
+	for i := range result {
+		var group [2]byte
+		for j := range group {
+			for k := 0; k < 5; k++ {
+				bit := r.nextBit()
+				if bit < 0 {
+					return nil, fmt.Errorf("unexpected end of track")
+				}
+				group[j] = group[j]<<1 | byte(bit)
+			}
+		}
+		hi, lo := gcrDecodeTable[group[0]], gcrDecodeTable[group[1]]
+		if hi == 0xff || lo == 0xff {
+			return nil, fmt.Errorf("invalid GCR code")
+		}
+		result[i] = hi<<4 | lo
+	}
+	return result, nil
+}
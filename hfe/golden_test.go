@@ -0,0 +1,78 @@
+package hfe
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Golden corpus: tiny images with checksums of every conversion output.
+// Any change in the checksums means that the codecs now produce different
+// files; inspect the difference before updating expected values.
+// Header of IMD file contains the time of writing,
+// so the checksum covers only data after the comment.
+func TestGoldenCorpus(t *testing.T) {
+	tests := []struct {
+		sample string
+		hfe1   string // SHA-256 of HFE v1 output
+		hfe3   string // SHA-256 of HFE v3 output
+		img    string // SHA-256 of IMG output, empty when not representable
+		imd    string // SHA-256 of IMD output, after the comment
+	}{
+		{"golden160.img.gz",
+			"2f1e6ace476bd45f08c8a8a67ec66235d3b773e595df4e6de24f88188f0988fc",
+			"461f388df29faf7a5af67836d0bf80554b5441e875bad58c70e51a1bb8340a36",
+			"9560530d8f23bce7650a8b40ea6c4a7e35dac51c6535f54b8757be13c1631ebf",
+			"2e1bdd74b145b3cb293e3b2ee815c85cc50b0227108d33d322c49b5cad52dfcb"},
+		{"golden-deleted.imd.gz",
+			"98c42d2b67a152842722fb83a8b7e212d33d755c864d4a04472739c4b5feafce",
+			"7369e992572b315a0790b950fbecb71bed67688bbea8c0f7fcc319cbba67043b",
+			"",
+			"175ff553d7ff4e779a70fd8cf3802231d074da3727217dbc633a5a03737448c0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			disk, _, err := OpenImage(findSampleFile(t, tt.sample))
+			if err != nil {
+				t.Fatalf("OpenImage() error: %v", err)
+			}
+			dir := t.TempDir()
+
+			hfe1File := filepath.Join(dir, "disk1.hfe")
+			if err := WriteHFE(hfe1File, disk, HFEVersion1); err != nil {
+				t.Fatalf("WriteHFE(v1) error: %v", err)
+			}
+			if sum := fileChecksum(t, hfe1File, false); sum != tt.hfe1 {
+				t.Errorf("HFE v1 checksum %s, expected %s", sum, tt.hfe1)
+			}
+
+			hfe3File := filepath.Join(dir, "disk3.hfe")
+			if err := WriteHFE(hfe3File, disk, HFEVersion3); err != nil {
+				t.Fatalf("WriteHFE(v3) error: %v", err)
+			}
+			if sum := fileChecksum(t, hfe3File, false); sum != tt.hfe3 {
+				t.Errorf("HFE v3 checksum %s, expected %s", sum, tt.hfe3)
+			}
+
+			imgFile := filepath.Join(dir, "disk.img")
+			err = WriteIMG(imgFile, disk)
+			if tt.img == "" {
+				// Deleted sectors cannot be stored in IMG
+				if err == nil {
+					t.Errorf("WriteIMG() succeeded, expected error")
+				}
+			} else if err != nil {
+				t.Fatalf("WriteIMG() error: %v", err)
+			} else if sum := fileChecksum(t, imgFile, false); sum != tt.img {
+				t.Errorf("IMG checksum %s, expected %s", sum, tt.img)
+			}
+
+			imdFile := filepath.Join(dir, "disk.imd")
+			if err := WriteIMD(imdFile, disk); err != nil {
+				t.Fatalf("WriteIMD() error: %v", err)
+			}
+			if sum := fileChecksum(t, imdFile, true); sum != tt.imd {
+				t.Errorf("IMD checksum %s, expected %s", sum, tt.imd)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package hfe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Image files may be compressed with gzip. Compression is recognized
+// by .gz suffix of the file name, and when reading, also by gzip signature.
+// Zstandard is not supported: Go standard library has no codec for it.
+//
+// Readers of all formats decompress the whole file into memory, since
+// HFE tracks are read at random offsets. Size of decompressed data is bounded
+// by Limits.MaxImageBytes. Written files of any format are compressed
+// when the temporary file is committed, see atomicFile.
+
+// Level of gzip compression of written image files:
+// from gzip.BestSpeed to gzip.BestCompression, or gzip.DefaultCompression
+var GzipLevel = gzip.DefaultCompression
+
+// Suffix of names of compressed files
+const gzipSuffix = ".gz"
+
+// First bytes of gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Check whether the file name has .gz suffix
+func isGzipName(filename string) bool {
+	return strings.HasSuffix(strings.ToLower(filename), gzipSuffix)
+}
+
+// Remove .gz suffix from the file name, if present
+func trimGzipSuffix(filename string) string {
+	if isGzipName(filename) {
+		return filename[:len(filename)-len(gzipSuffix)]
+	}
+	return filename
+}
+
+// imageReader is an image file opened for reading:
+// a plain file, or contents of a compressed file in memory
+type imageReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Size() (int64, error)
+}
+
+// Plain image file
+type fileImage struct {
+	*os.File
+}
+
+func (f fileImage) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get file info: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// Decompressed contents of image file
+type memImage struct {
+	*bytes.Reader
+}
+
+func (m memImage) Close() error {
+	return nil
+}
+
+func (m memImage) Size() (int64, error) {
+	return m.Reader.Size(), nil
+}
+
+// Open image file for reading. Compressed file is decompressed into memory.
+func openImageFile(filename string) (imageReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	magic := make([]byte, len(gzipMagic))
+	n, _ := file.ReadAt(magic, 0)
+	if !isGzipName(filename) && !bytes.Equal(magic[:n], gzipMagic) {
+		return fileImage{file}, nil
+	}
+	defer file.Close()
+
+	data, err := gunzip(file, filename)
+	if err != nil {
+		return nil, err
+	}
+	return memImage{bytes.NewReader(data)}, nil
+}
+
+// Read the whole image file, decompressed when needed
+func readImageData(filename string) ([]byte, error) {
+	file, err := openImageFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// Decompress gzip stream into memory, within the limit of image size
+func gunzip(r io.Reader, filename string) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", filename, err)
+	}
+	defer gz.Close()
+
+	var buf bytes.Buffer
+	if err := copyLimited(&buf, gz, filename); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Copy decompressed data, and fail when it exceeds Limits.MaxImageBytes
+func copyLimited(dst io.Writer, gz *gzip.Reader, filename string) error {
+	n, err := io.Copy(dst, io.LimitReader(gz, Limits.MaxImageBytes+1))
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", filename, err)
+	}
+	if err := Limits.checkImageBytes(n); err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Compress contents of the file into dst
+func gzipFile(dst io.Writer, src *os.File) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	gz, err := gzip.NewWriterLevel(dst, GzipLevel)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(gz, src); err != nil {
+		return err
+	}
+	return gz.Close()
+}
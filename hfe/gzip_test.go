@@ -0,0 +1,141 @@
+package hfe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGzip_RoundTrip(t *testing.T) {
+	// Sample file is read through the compressed path
+	disk, err := Read(findSampleFile(t, "fat360.img.gz"))
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	want, err := Fingerprint(disk)
+	if err != nil {
+		t.Fatalf("Fingerprint() error: %v", err)
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"disk.hfe", "disk.hfe.gz", "disk.img", "disk.img.gz", "disk.imd", "disk.IMD.GZ", "disk.86f.gz"} {
+		filename := filepath.Join(dir, name)
+		if err := Write(filename, disk); err != nil {
+			t.Fatalf("Write(%s) error: %v", name, err)
+		}
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := bytes.HasPrefix(data, gzipMagic); compressed != isGzipName(name) {
+			t.Errorf("%s: compressed = %v", name, compressed)
+		}
+
+		result, err := Read(filename)
+		if err != nil {
+			t.Fatalf("Read(%s) error: %v", name, err)
+		}
+		got, err := Fingerprint(result)
+		if err != nil {
+			t.Fatalf("%s: Fingerprint() error: %v", name, err)
+		}
+		if got.SHA256 != want.SHA256 {
+			t.Errorf("%s: contents differ after round trip: %q", name, got.Diff(want))
+		}
+	}
+
+	// Temporary files are removed
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 {
+		t.Errorf("%d files in directory, expected 7", len(entries))
+	}
+}
+
+func TestGzip_Signature(t *testing.T) {
+	// Compressed HFE file without .gz suffix
+	data, err := os.ReadFile(findSampleFile(t, "fat12v1.hfe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+
+	filename := filepath.Join(t.TempDir(), "disk.hfe")
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := ReadHFE(filename)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	if len(disk.Tracks) == 0 {
+		t.Errorf("no tracks read")
+	}
+	if _, format, err := OpenImage(filename); err != nil || format != ImageFormatHFE {
+		t.Errorf("OpenImage() format %v, error %v", format, err)
+	}
+
+	// Name with .gz suffix, but contents not compressed
+	plain := filepath.Join(t.TempDir(), "disk.hfe.gz")
+	if err := os.WriteFile(plain, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadHFE(plain); err == nil {
+		t.Errorf("expected error for uncompressed .gz file")
+	}
+}
+
+func TestGzip_Limits(t *testing.T) {
+	defer func(limits ImageLimits) { Limits = limits }(Limits)
+	Limits.MaxImageBytes = 100 * 1024
+
+	sample := findSampleFile(t, "fat360.img.gz")
+	if _, err := ReadIMG(sample); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("ReadIMG() error %v, expected limit of image size", err)
+	}
+	if _, _, err := OpenImage(sample); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("OpenImage() error %v, expected limit of image size", err)
+	}
+}
+
+func TestGzip_Level(t *testing.T) {
+	disk, err := Read(findSampleFile(t, "fat360.img.gz"))
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	defer func(level int) { GzipLevel = level }(GzipLevel)
+
+	dir := t.TempDir()
+	sizes := make(map[int]int64)
+	for _, level := range []int{gzip.NoCompression, gzip.BestCompression} {
+		GzipLevel = level
+		filename := filepath.Join(dir, "disk.imd.gz")
+		if err := Write(filename, disk); err != nil {
+			t.Fatalf("Write() at level %d error: %v", level, err)
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[level] = info.Size()
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.NoCompression] {
+		t.Errorf("compressed sizes %v", sizes)
+	}
+
+	GzipLevel = 42
+	if err := Write(filepath.Join(dir, "bad.img.gz"), disk); err == nil {
+		t.Errorf("expected error for invalid compression level")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.img.gz")); err == nil {
+		t.Errorf("file written with invalid compression level")
+	}
+}
@@ -1,5 +1,7 @@
 package hfe
 
+import "encoding/binary"
+
 // HFEVersion represents the HFE file format version
 type HFEVersion int
 
@@ -37,6 +39,7 @@ const (
 	ENC_Amiga_MFM  = 0x01
 	ENC_ISOIBM_FM  = 0x02
 	ENC_Emu_FM     = 0x03
+	ENC_C64_GCR    = 0x12
 	ENC_Unknown    = 0xff
 )
 
@@ -87,10 +90,54 @@ type TrackHeader struct {
 	TrackLen uint16 // in bytes
 }
 
-// TrackData represents the MFM bitstream data for a track
+// TrackData represents the MFM bitstream data for a track.
+// Empty side means no data was captured, like for a track which could not
+// be read: writers store a placeholder for it, which readers map back to
+// an empty side. Sector images have no such notion, and get filler sectors.
 type TrackData struct {
-	Side0 []byte // MFM bitstream for side 0 (bits, MSB-first)
-	Side1 []byte // MFM bitstream for side 1 (bits, MSB-first)
+	Side0   []byte // MFM bitstream for side 0 (bits, MSB-first)
+	Side1   []byte // MFM bitstream for side 1 (bits, MSB-first)
+	BitRate uint16 // Bit rate of this track in kbps, 0 = same as in header
+
+	// Bit position of the index pulse on each side, 0 = start of data.
+	// Stored with SETINDEX opcode in HFE v3. Readers rotate tracks
+	// to start at the index, so tracks read from images have it 0.
+	IndexBitOffset [2]int
+
+	// Weak bitcells of each side, which read differently on every
+	// revolution: set bits of the mask, in the same layout as the side.
+	// Nil when there are none. Stored with RAND opcode in HFE v3,
+	// eight bitcells at a time.
+	WeakBits [2][]byte
+}
+
+// Empty reports whether no data was captured on either side of the track
+func (track *TrackData) Empty() bool {
+	return len(track.Side0) == 0 && len(track.Side1) == 0
+}
+
+// FromIndex returns the track with both sides rotated to start
+// at the index pulse, for formats and drives which start tracks there
+func (track TrackData) FromIndex() TrackData {
+	for side, mask := range track.WeakBits {
+		if len(mask) == len(track.side(side)) {
+			track.WeakBits[side] = RotateTrack(mask, track.indexBit(side))
+		}
+	}
+	track.Side0 = RotateTrack(track.Side0, track.indexBit(0))
+	track.Side1 = RotateTrack(track.Side1, track.indexBit(1))
+	track.IndexBitOffset = [2]int{}
+	return track
+}
+
+// Position of the index pulse on the given side,
+// or 0 when it does not fall within the data
+func (track *TrackData) indexBit(side int) int {
+	offset := track.IndexBitOffset[side]
+	if offset < 0 || offset >= len(track.side(side))*8 {
+		return 0
+	}
+	return offset
 }
 
 // Disk represents a complete HFE v3 disk image
@@ -101,6 +148,46 @@ type Disk struct {
 	VerifyAmiga bool
 }
 
+// TrackBitRate returns bit rate of the given track in kbps
+func (disk *Disk) TrackBitRate(cyl int) uint16 {
+	if cyl < len(disk.Tracks) && disk.Tracks[cyl].BitRate != 0 {
+		return disk.Tracks[cyl].BitRate
+	}
+	return disk.Header.BitRate
+}
+
+// IsWriteProtected reports whether the image is marked as not to be written
+// to a diskette or modified, by 0x00 in WriteAllowed byte of the header.
+// WriteProtected byte is not checked: before HFE v1.1 it was unused,
+// and old files may have any value in it.
+// Note that zero value of Header is write protected, as in the file:
+// a disk built in memory must set WriteAllowed to 0xFF, like image
+// readers do, or call SetWriteProtect(false) to be written to a diskette.
+func (disk *Disk) IsWriteProtected() bool {
+	return disk.Header.WriteAllowed == 0x00
+}
+
+// SetWriteProtect marks the image as write protected, or removes the mark.
+// Both WriteProtected and WriteAllowed bytes of the header are set.
+func (disk *Disk) SetWriteProtect(protect bool) {
+	if protect {
+		disk.Header.WriteProtected = 0x00
+		disk.Header.WriteAllowed = 0x00
+	} else {
+		disk.Header.WriteProtected = 0xFF
+		disk.Header.WriteAllowed = 0xFF
+	}
+}
+
+// Convert bit rate in kbps to argument of SETBITRATE opcode, and back
+func bitRateToOpcode(kbps uint16) byte {
+	return byte((FLOPPYEMUFREQ/2/1000 + int(kbps)/2) / int(kbps))
+}
+
+func opcodeToBitRate(value byte) uint16 {
+	return uint16((FLOPPYEMUFREQ/2/1000 + int(value)/2) / int(value))
+}
+
 // byteBitsInverter inverts bits in a byte (for PIC EUSART compatibility)
 // This is a lookup table that inverts each bit position
 var byteBitsInverter [256]byte
@@ -137,8 +224,55 @@ func bitReverseBlock(data []byte) {
 	}
 }
 
+// invertBits stores src with bits inverted in every byte into dst.
+// Eight bytes are inverted at once, by swapping bits, bit pairs and nibbles.
+func invertBits(dst, src []byte) {
+	dst = dst[:len(src)]
+	for len(src) >= 8 {
+		x := binary.LittleEndian.Uint64(src)
+		x = x>>1&0x5555555555555555 | x&0x5555555555555555<<1
+		x = x>>2&0x3333333333333333 | x&0x3333333333333333<<2
+		x = x>>4&0x0F0F0F0F0F0F0F0F | x&0x0F0F0F0F0F0F0F0F<<4
+		binary.LittleEndian.PutUint64(dst, x)
+		src = src[8:]
+		dst = dst[8:]
+	}
+	for i, b := range src {
+		dst[i] = byteBitsInverter[b]
+	}
+}
+
 // bitCopy copies bits from source to destination at arbitrary bit offsets
 func bitCopy(dst []byte, dstOff int, src []byte, srcOff int, size int) int {
+	// Whole bytes, when both offsets are byte-aligned
+	if srcOff&7 == 0 && dstOff&7 == 0 && srcOff >= 0 && dstOff >= 0 {
+		n := min(min(size/8, len(src)-srcOff/8), len(dst)-dstOff/8)
+		if n > 0 {
+			copy(dst[dstOff/8:], src[srcOff/8:srcOff/8+n])
+			srcOff += n * 8
+			dstOff += n * 8
+			size -= n * 8
+		}
+	}
+
+	// Eight bits at a time, as long as they fit
+	for size >= 8 && srcOff >= 0 && dstOff >= 0 && srcOff+8 <= len(src)*8 && dstOff+8 <= len(dst)*8 {
+		b := src[srcOff/8] << (srcOff & 7)
+		if srcOff&7 != 0 {
+			b |= src[srcOff/8+1] >> (8 - srcOff&7)
+		}
+		if shift := dstOff & 7; shift == 0 {
+			dst[dstOff/8] = b
+		} else {
+			dst[dstOff/8] = dst[dstOff/8]&^(0xFF>>shift) | b>>shift
+			dst[dstOff/8+1] = dst[dstOff/8+1]&(0xFF>>shift) | b<<(8-shift)
+		}
+		srcOff += 8
+		dstOff += 8
+		size -= 8
+	}
+
+	// Remaining bits one by one
 	for i := 0; i < size; i++ {
 		if srcOff >= len(src)*8 || dstOff >= len(dst)*8 {
 			return dstOff
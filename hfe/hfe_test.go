@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"github.com/sergev/floppy/mfm"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -245,6 +246,16 @@ func TestBitCopy(t *testing.T) {
 			expectedDst: []byte{0x0F}, // Copy 4 bits starting at src[2] to dst[4]
 			expectedOff: 8,
 		},
+		{
+			name:        "unaligned destination",
+			src:         []byte{0x0F, 0xF0, 0x00},
+			srcOff:      4,
+			dst:         []byte{0x80, 0x01},
+			dstOff:      3,
+			size:        8,
+			expectedDst: []byte{0x9F, 0xE1}, // Other bits of dst are kept
+			expectedOff: 11,
+		},
 		{
 			name:        "boundary condition",
 			src:         []byte{0xAA},
@@ -420,6 +431,134 @@ func TestProcessOpcodes_Empty(t *testing.T) {
 	}
 }
 
+func TestEncodeOpcodes_AllBytes(t *testing.T) {
+	// Every byte value, alone and followed by every other value,
+	// so that opcode-like bytes appear at all bit shifts
+	var tracks [][]byte
+	for b := 0; b < 256; b++ {
+		tracks = append(tracks, []byte{byte(b)})
+		track := []byte{byte(b)}
+		for c := 0; c < 256; c++ {
+			track = append(track, byte(c), byte(b))
+		}
+		tracks = append(tracks, track)
+	}
+	for _, track := range tracks {
+		result, err := processOpcodes(encodeOpcodes(track, nil, 250, 0))
+		if err != nil {
+			t.Fatalf("processOpcodes() error: %v", err)
+		}
+		if !bytes.Equal(result, track) {
+			t.Fatalf("round-trip of % x...: got % x...", track[:min(len(track), 8)], result[:min(len(result), 8)])
+		}
+	}
+}
+
+func TestEncodeOpcodes_NoEscapedOpcodes(t *testing.T) {
+	// Data bytes must never be taken for opcodes
+	data := bytes.Repeat([]byte{RAND_OPCODE, NOP_OPCODE, 0xFF, 0x6F}, 100)
+	result, err := processOpcodes(encodeOpcodes(data, nil, 0, 0))
+	if err != nil {
+		t.Fatalf("processOpcodes() error: %v", err)
+	}
+	if !bytes.Equal(result, data) {
+		t.Errorf("round-trip mismatch")
+	}
+}
+
+func TestRoundTrip_RandomTracksV3(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	disk := createTestDisk(4, 2, 0)
+	for i := range disk.Tracks {
+		disk.Tracks[i].Side0 = make([]byte, 6250+i*3)
+		disk.Tracks[i].Side1 = make([]byte, 6250+i*5)
+		rng.Read(disk.Tracks[i].Side0)
+		rng.Read(disk.Tracks[i].Side1)
+	}
+	testWriteReadDisk(t, disk, HFEVersion3, func(t *testing.T, original, read *Disk) {
+		for i := range original.Tracks {
+			if !bytes.Equal(read.Tracks[i].Side0, original.Tracks[i].Side0) {
+				t.Errorf("track %d side 0 mismatch", i)
+			}
+			if !bytes.Equal(read.Tracks[i].Side1, original.Tracks[i].Side1) {
+				t.Errorf("track %d side 1 mismatch", i)
+			}
+		}
+	})
+}
+
+// Tracks of any length must come back bit-exact, without padding
+// of the last block. Sides of v3 may differ in length; v1 stores
+// one length for both sides.
+func TestRoundTrip_TrackLengths(t *testing.T) {
+	const base = 6250 // Bytes per side of DD track at 300 rpm
+	rng := rand.New(rand.NewSource(3))
+	const tracks = MaxHFETracks // Consecutive lengths per disk
+	step := tracks
+	if testing.Short() {
+		step = BlockSize
+	}
+	for _, version := range []HFEVersion{HFEVersion1, HFEVersion3} {
+		for first := base - BlockSize; first <= base+BlockSize; first += step {
+			disk := createTestDisk(tracks, 2, 0)
+			for i := range disk.Tracks {
+				n := first + i
+				disk.Tracks[i].Side0 = make([]byte, n)
+				disk.Tracks[i].Side1 = make([]byte, n)
+				if version == HFEVersion3 {
+					disk.Tracks[i].Side1 = make([]byte, n-i%7*37)
+				}
+				rng.Read(disk.Tracks[i].Side0)
+				rng.Read(disk.Tracks[i].Side1)
+			}
+			testWriteReadDisk(t, disk, version, func(t *testing.T, original, read *Disk) {
+				for i := range original.Tracks {
+					if !bytes.Equal(read.Tracks[i].Side0, original.Tracks[i].Side0) ||
+						!bytes.Equal(read.Tracks[i].Side1, original.Tracks[i].Side1) {
+						t.Errorf("v%d: track of %d/%d bytes read as %d/%d bytes", version,
+							len(original.Tracks[i].Side0), len(original.Tracks[i].Side1),
+							len(read.Tracks[i].Side0), len(read.Tracks[i].Side1))
+					}
+				}
+			})
+		}
+	}
+}
+
+// Index position must survive HFE files: v3 marks it with SETINDEX,
+// v1 starts the track there. Reader rotates tracks to start at the index.
+func TestRoundTrip_IndexBitOffset(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	disk := createTestDisk(4, 2, 0)
+	for i := range disk.Tracks {
+		disk.Tracks[i].Side0 = make([]byte, 6250)
+		disk.Tracks[i].Side1 = make([]byte, 6250)
+		rng.Read(disk.Tracks[i].Side0)
+		rng.Read(disk.Tracks[i].Side1)
+	}
+	disk.Tracks[1].IndexBitOffset = [2]int{8 * 100, 1}
+	disk.Tracks[2].IndexBitOffset = [2]int{6250 * 4, 6250*8 - 3} // Middle and end of track
+	disk.Tracks[3].IndexBitOffset = [2]int{-1, 6250 * 8}         // Out of range: start of data
+
+	for _, version := range []HFEVersion{HFEVersion1, HFEVersion3} {
+		testWriteReadDisk(t, disk, version, func(t *testing.T, original, read *Disk) {
+			for i, track := range original.Tracks {
+				want := track.FromIndex()
+				got := read.Tracks[i]
+				if !bytes.Equal(got.Side0, want.Side0) || !bytes.Equal(got.Side1, want.Side1) {
+					t.Errorf("v%d: track %d with index at %v not rotated to index", version, i, track.IndexBitOffset)
+				}
+				if got.IndexBitOffset != [2]int{} {
+					t.Errorf("v%d: track %d read with index at %v", version, i, got.IndexBitOffset)
+				}
+			}
+		})
+	}
+	if !bytes.Equal(disk.Tracks[2].FromIndex().Side0, rotateBits(disk.Tracks[2].Side0, 6250*4)) {
+		t.Errorf("FromIndex() does not rotate to index")
+	}
+}
+
 // Test 3: Track Reading Tests (requires file operations)
 
 func TestReadTrack_SingleSide(t *testing.T) {
@@ -450,6 +589,98 @@ func TestWriteTrack_SingleSide(t *testing.T) {
 	}
 }
 
+func TestWriteTrack_SingleSidePadding(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   HFEVersion
+		duplicate bool
+		padding   byte
+	}{
+		{"v1", HFEVersion1, false, 0xFF},
+		{"v3", HFEVersion3, false, NOP_OPCODE},
+		{"v1 duplicate", HFEVersion1, true, 0},
+		{"v3 duplicate", HFEVersion3, true, 0},
+	}
+	defer func() { DuplicateSingleSide = false }()
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			DuplicateSingleSide = tc.duplicate
+			disk := createTestDisk(2, 1, 300)
+			tmpFile := filepath.Join(t.TempDir(), "test_single.hfe")
+			if err := WriteHFE(tmpFile, disk, tc.version); err != nil {
+				t.Fatalf("WriteHFE() error: %v", err)
+			}
+
+			// Check side 1 half of the first block of track 0
+			data, err := os.ReadFile(tmpFile)
+			if err != nil {
+				t.Fatalf("ReadFile() error: %v", err)
+			}
+			offset := int(binary.LittleEndian.Uint16(data[BlockSize:])) * BlockSize
+			block := data[offset : offset+BlockSize]
+			for j := 0; j < 256; j++ {
+				expected := byteBitsInverter[tc.padding]
+				if tc.duplicate {
+					expected = block[j]
+				}
+				if block[256+j] != expected {
+					t.Fatalf("side 1 byte %d = 0x%02x, expected 0x%02x", j, block[256+j], expected)
+				}
+			}
+
+			readDisk, err := Read(tmpFile)
+			if err != nil {
+				t.Fatalf("Read() error: %v", err)
+			}
+			for i, track := range readDisk.Tracks {
+				if len(track.Side1) != 0 {
+					t.Errorf("track %d side 1 has %d bytes, expected none", i, len(track.Side1))
+				}
+				if len(track.Side0) < 300 {
+					t.Errorf("track %d side 0 has %d bytes", i, len(track.Side0))
+				} else if !bytes.Equal(track.Side0[:300], disk.Tracks[i].Side0) {
+					t.Errorf("track %d side 0 mismatch", i)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteTrack_WrapPadding(t *testing.T) {
+	disk := createTestDisk(2, 2, 300)
+	tmpFile := filepath.Join(t.TempDir(), "test_wrap.hfe")
+	if err := WriteHFE(tmpFile, disk, HFEVersion1); err != nil {
+		t.Fatalf("WriteHFE() error: %v", err)
+	}
+	data, err := os.ReadFile(tmpFile)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+
+	// Track of 300 bytes per side occupies two blocks: 512 bytes per side
+	offset := int(binary.LittleEndian.Uint16(data[BlockSize:])) * BlockSize
+	for side := 0; side < 2; side++ {
+		var sideData []byte
+		for k := 0; k < 2; k++ {
+			start := offset + k*BlockSize + side*256
+			for _, b := range data[start : start+256] {
+				sideData = append(sideData, byteBitsInverter[b])
+			}
+		}
+		original := disk.Tracks[0].Side0
+		if side == 1 {
+			original = disk.Tracks[0].Side1
+		}
+		if !bytes.Equal(sideData[:300], original) {
+			t.Errorf("side %d: track data mismatch", side)
+		}
+		if !bytes.Equal(sideData[300:], original[:212]) {
+			t.Errorf("side %d: padding is not a copy of track beginning: % x", side, sideData[300:316])
+		}
+	}
+}
+
 func TestWriteTrack_DoubleSide(t *testing.T) {
 	disk := createTestDisk(1, 2, 256)
 	tmpFile := filepath.Join(t.TempDir(), "test_write_double.hfe")
@@ -587,7 +818,7 @@ func getTestDataPath(filename string) string {
 // findSampleFile searches for a sample file in multiple possible locations
 // and returns the found path, or skips the test if not found
 // Also checks for .gz versions of the file
-func findSampleFile(t *testing.T, filename string) string {
+func findSampleFile(t testing.TB, filename string) string {
 	t.Helper()
 	wd, err := os.Getwd()
 	if err != nil {
@@ -1021,6 +1252,166 @@ func TestRoundTrip_GeneratedData(t *testing.T) {
 	}
 }
 
+func TestRoundTrip_ExtendedDensity(t *testing.T) {
+	// 2.88M image: 36 sectors per track at 1000 kbps,
+	// tracks are longer than 64 kbytes
+	img := make([]byte, 80*2*36*512)
+	rand.New(rand.NewSource(1)).Read(img)
+	imgFile := filepath.Join(t.TempDir(), "ed.img")
+	if err := os.WriteFile(imgFile, img, 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	disk, err := ReadIMG(imgFile)
+	if err != nil {
+		t.Fatalf("ReadIMG() error: %v", err)
+	}
+	if disk.Header.BitRate != 1000 {
+		t.Fatalf("bit rate %d, expected 1000", disk.Header.BitRate)
+	}
+
+	for _, version := range []HFEVersion{HFEVersion1, HFEVersion3} {
+		hfeFile := filepath.Join(t.TempDir(), "ed.hfe")
+		if err := WriteHFE(hfeFile, disk, version); err != nil {
+			t.Fatalf("v%d: WriteHFE() error: %v", version, err)
+		}
+		readDisk, err := Read(hfeFile)
+		if err != nil {
+			t.Fatalf("v%d: Read() error: %v", version, err)
+		}
+		if n := countSectors(readDisk.Tracks[0].Side1); n != 36 {
+			t.Errorf("v%d: track 0 side 1 has %d sectors, expected 36", version, n)
+		}
+
+		outFile := filepath.Join(t.TempDir(), "ed_out.img")
+		if err := WriteIMG(outFile, readDisk); err != nil {
+			t.Fatalf("v%d: WriteIMG() error: %v", version, err)
+		}
+		out, err := os.ReadFile(outFile)
+		if err != nil {
+			t.Fatalf("v%d: ReadFile() error: %v", version, err)
+		}
+		if !bytes.Equal(out, img) {
+			t.Errorf("v%d: sector data mismatch after round-trip", version)
+		}
+	}
+}
+
+func TestWrite_TrimLongTracks(t *testing.T) {
+	defer func() { TrimLongTracks = true }()
+
+	// Three revolutions at 250 kbps, 300 RPM
+	const revLen = 12500
+	disk := createTestDisk(1, 2, revLen*3)
+	for _, trim := range []bool{true, false} {
+		TrimLongTracks = trim
+		testWriteReadDisk(t, disk, HFEVersion1, func(t *testing.T, original, read *Disk) {
+			expected := len(original.Tracks[0].Side0)
+			if trim {
+				expected = revLen
+			}
+			track := read.Tracks[0]
+			if len(track.Side0) != expected {
+				t.Errorf("trim %v: side 0 has %d bytes, expected %d", trim, len(track.Side0), expected)
+			}
+			if !bytes.Equal(track.Side0[:expected], original.Tracks[0].Side0[:expected]) {
+				t.Errorf("trim %v: side 0 mismatch", trim)
+			}
+			if !bytes.Equal(track.Side1[:expected], original.Tracks[0].Side1[:expected]) {
+				t.Errorf("trim %v: side 1 mismatch", trim)
+			}
+		})
+	}
+}
+
+func TestWriter_Incremental(t *testing.T) {
+	for _, version := range []HFEVersion{HFEVersion1, HFEVersion3} {
+		disk := createTestDisk(3, 2, 1024)
+		tmpFile := filepath.Join(t.TempDir(), "test_writer.hfe")
+
+		w, err := NewWriter(tmpFile, disk.Header, version)
+		if err != nil {
+			t.Fatalf("NewWriter() error: %v", err)
+		}
+		for i, track := range disk.Tracks {
+			if err := w.WriteTrack(i, track.Side0, track.Side1); err != nil {
+				t.Fatalf("WriteTrack(%d) error: %v", i, err)
+			}
+		}
+		if err := w.WriteTrack(1, nil, nil); err == nil {
+			t.Error("WriteTrack() of already written track: expected error, got nil")
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() error: %v", err)
+		}
+
+		// Output must be identical to WriteHFE()
+		refFile := filepath.Join(t.TempDir(), "test_writer_ref.hfe")
+		if err := WriteHFE(refFile, disk, version); err != nil {
+			t.Fatalf("WriteHFE() error: %v", err)
+		}
+		got, _ := os.ReadFile(tmpFile)
+		want, _ := os.ReadFile(refFile)
+		if !bytes.Equal(got, want) {
+			t.Errorf("v%d: Writer output differs from WriteHFE()", version)
+		}
+	}
+}
+
+func TestWriter_PartialDisk(t *testing.T) {
+	disk := createTestDisk(5, 2, 1024)
+	tmpFile := filepath.Join(t.TempDir(), "test_writer_partial.hfe")
+
+	// Write only first two tracks, as if the read failed on track 2
+	w, err := NewWriter(tmpFile, disk.Header, HFEVersion1)
+	if err != nil {
+		t.Fatalf("NewWriter() error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.WriteTrack(i, disk.Tracks[i].Side0, disk.Tracks[i].Side1); err != nil {
+			t.Fatalf("WriteTrack(%d) error: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	readDisk, err := Read(tmpFile)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if readDisk.Header.NumberOfTrack != 2 || len(readDisk.Tracks) != 2 {
+		t.Fatalf("Read() track count = %d/%d, expected 2", readDisk.Header.NumberOfTrack, len(readDisk.Tracks))
+	}
+	for i := 0; i < 2; i++ {
+		compareTracks(t, disk.Tracks[i], readDisk.Tracks[i])
+	}
+}
+
+func TestWriter_Geometry(t *testing.T) {
+	dir := t.TempDir()
+
+	// Track list holds 128 tracks
+	disk := createTestDisk(MaxHFETracks+1, 2, 256)
+	err := WriteHFE(filepath.Join(dir, "long.hfe"), disk, HFEVersion3)
+	if err == nil || !strings.Contains(err.Error(), "limit 128") {
+		t.Errorf("WriteHFE() with %d tracks: error = %v, expected limit", len(disk.Tracks), err)
+	}
+	w, err := NewWriter(filepath.Join(dir, "stream.hfe"), Header{NumberOfSide: 2}, HFEVersion1)
+	if err != nil {
+		t.Fatalf("NewWriter() error: %v", err)
+	}
+	defer w.Close()
+	if err := w.WriteTrack(MaxHFETracks, nil, nil); err == nil {
+		t.Errorf("WriteTrack(%d) accepted track beyond the limit", MaxHFETracks)
+	}
+
+	// Two sides at most
+	_, err = NewWriter(filepath.Join(dir, "sides.hfe"), Header{NumberOfSide: 4}, HFEVersion3)
+	if err == nil || !strings.Contains(err.Error(), "limit 2") {
+		t.Errorf("NewWriter() with 4 sides: error = %v, expected limit", err)
+	}
+}
+
 // Test 9: Edge Cases and Boundary Tests
 
 func TestWrite_EmptyTracks(t *testing.T) {
@@ -1374,6 +1765,114 @@ func TestRead_RejectV2(t *testing.T) {
 	}
 }
 
+// Build single-sided HFE v1 file with two DD tracks of 9 sectors.
+// Side 0 is stored either in the first half of every block, or in whole
+// blocks with track length of one side, as some older tools did.
+func makeSingleSidedV1(t *testing.T, contiguous bool) (string, [][]byte) {
+	header := createTestHeader(2, 1)
+	copy(header.HeaderSignature[:], HFEv1Signature)
+	var file bytes.Buffer
+	if err := binary.Write(&file, binary.LittleEndian, header); err != nil {
+		t.Fatalf("binary.Write() error: %v", err)
+	}
+	file.Write(bytes.Repeat([]byte{0xFF}, BlockSize-file.Len()))
+
+	var tracks [][]byte
+	trackList := bytes.Repeat([]byte{0xFF}, BlockSize)
+	var data []byte
+	for cyl := 0; cyl < 2; cyl++ {
+		sectors := make([][]byte, 9)
+		for s := range sectors {
+			sectors[s] = bytes.Repeat([]byte{byte(cyl*9 + s)}, sectorSize)
+		}
+		side0 := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, cyl, 0, 9, 250)
+		tracks = append(tracks, side0)
+
+		offset := 2 + len(data)/BlockSize
+		trackLen := 2 * len(side0)
+		if contiguous {
+			trackLen = len(side0)
+		}
+		binary.LittleEndian.PutUint16(trackList[cyl*4:], uint16(offset))
+		binary.LittleEndian.PutUint16(trackList[cyl*4+2:], uint16(trackLen))
+		for i := 0; i < len(side0); {
+			n := 256
+			if contiguous {
+				n = BlockSize
+			}
+			chunk := make([]byte, n)
+			for j := range chunk {
+				chunk[j] = 0xFF
+				if i+j < len(side0) {
+					chunk[j] = side0[i+j]
+				}
+			}
+			i += n
+			data = append(data, chunk...)
+			if !contiguous {
+				data = append(data, bytes.Repeat([]byte{0xFF}, 256)...)
+			}
+		}
+		for len(data)%BlockSize != 0 {
+			data = append(data, 0xFF)
+		}
+	}
+	file.Write(trackList)
+	for _, b := range data {
+		file.WriteByte(byteBitsInverter[b])
+	}
+
+	filename := filepath.Join(t.TempDir(), "single.hfe")
+	if err := os.WriteFile(filename, file.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	return filename, tracks
+}
+
+func TestRead_SingleSidedV1Layout(t *testing.T) {
+	defer func() { SingleSidedV1Layout = SingleSidedAuto }()
+	tests := []struct {
+		name       string
+		contiguous bool
+		layout     SingleSidedLayout
+	}{
+		{"interleaved, auto", false, SingleSidedAuto},
+		{"contiguous, auto", true, SingleSidedAuto},
+		{"interleaved, explicit", false, SingleSidedInterleaved},
+		{"contiguous, explicit", true, SingleSidedContiguous},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SingleSidedV1Layout = tc.layout
+			filename, tracks := makeSingleSidedV1(t, tc.contiguous)
+			disk, err := ReadHFE(filename)
+			if err != nil {
+				t.Fatalf("ReadHFE() error: %v", err)
+			}
+			for cyl, want := range tracks {
+				side0 := disk.Tracks[cyl].Side0
+				if len(side0) < len(want) || !bytes.Equal(side0[:len(want)], want) {
+					t.Errorf("track %d: side 0 of %d bytes differs, expected %d bytes", cyl, len(side0), len(want))
+				}
+				if n := goodSectors(side0); n != 9 {
+					t.Errorf("track %d: %d good sectors, expected 9", cyl, n)
+				}
+			}
+		})
+	}
+
+	// Wrong explicit layout loses sectors
+	SingleSidedV1Layout = SingleSidedInterleaved
+	filename, _ := makeSingleSidedV1(t, true)
+	disk, err := ReadHFE(filename)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	if n := goodSectors(disk.Tracks[0].Side0); n == 9 {
+		t.Errorf("contiguous track read as interleaved gives %d good sectors", n)
+	}
+}
+
 func TestWriteV1V3Compatibility(t *testing.T) {
 	// Test that v1 files can be read by the same reader (which supports both)
 	disk := createTestDisk(1, 1, 256)
@@ -1510,3 +2009,140 @@ func TestCountSectorsAmiga(t *testing.T) {
 		t.Errorf("countSectorsAmiga() = %d, expected 11", sectorCount)
 	}
 }
+
+func TestRead_TrackListMoved(t *testing.T) {
+	disk := createTestDisk(4, 2, 1024)
+	filename := filepath.Join(t.TempDir(), "moved.hfe")
+	if err := Write(filename, disk); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+
+	// Move track list to the end of file, with tracks in reverse order
+	trackList := data[BlockSize : 2*BlockSize]
+	moved := bytes.Repeat([]byte{0xFF}, BlockSize)
+	for i := 0; i < 4; i++ {
+		copy(moved[i*4:i*4+4], trackList[(3-i)*4:])
+	}
+	binary.LittleEndian.PutUint16(data[18:20], uint16(len(data)/BlockSize))
+	data = append(data, moved...)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	read, err := ReadHFE(filename)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	for i := range read.Tracks {
+		want := disk.Tracks[3-i]
+		got := read.Tracks[i]
+		if !bytes.Equal(got.Side0[:len(want.Side0)], want.Side0) ||
+			!bytes.Equal(got.Side1[:len(want.Side1)], want.Side1) {
+			t.Errorf("track %d differs from written track %d", i, 3-i)
+		}
+	}
+}
+
+func BenchmarkReadHFE(b *testing.B) {
+	for _, name := range []string{"fat12v1.hfe", "fat12v3.hfe"} {
+		b.Run(name, func(b *testing.B) {
+			filename := findSampleFile(b, name)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ReadHFE(filename); err != nil {
+					b.Fatalf("ReadHFE() error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// Build HFE v1 file with one track of the given length, stored at block 2,
+// with only low 16 bits of the length in the track list.
+func makeLongTrackHFE(trackLen int) []byte {
+	data := make([]byte, 2*BlockSize+trackLen)
+	copy(data, HFEv1Signature)
+	data[9] = 1  // NumberOfTrack
+	data[10] = 2 // NumberOfSide
+	binary.LittleEndian.PutUint16(data[12:], 250)
+	binary.LittleEndian.PutUint16(data[14:], 300)
+	binary.LittleEndian.PutUint16(data[18:], 1) // TrackListOffset
+	binary.LittleEndian.PutUint16(data[BlockSize:], 2)
+	binary.LittleEndian.PutUint16(data[BlockSize+2:], uint16(trackLen))
+	return data
+}
+
+func TestReadHFE_Limits(t *testing.T) {
+	defer func(l ImageLimits) { Limits = l }(Limits)
+	filename := filepath.Join(t.TempDir(), "long.hfe")
+
+	// Long track of 66 kbytes per side is more than 4 revolutions at 250 kbps
+	if err := os.WriteFile(filename, makeLongTrackHFE(0x20200), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadHFE(filename); err == nil || !strings.Contains(err.Error(), "track too long") {
+		t.Errorf("ReadHFE() error = %v, expected track too long", err)
+	}
+
+	// Accepted with raised limit
+	Limits.TrackLenFactor = 8
+	disk, err := ReadHFE(filename)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	if len(disk.Tracks[0].Side0) != 0x20200/2 {
+		t.Errorf("side 0 has %d bytes, expected %d", len(disk.Tracks[0].Side0), 0x20200/2)
+	}
+
+	// Total size of tracks
+	Limits.MaxDiskBytes = 0x10000
+	if _, err := ReadHFE(filename); err == nil || !strings.Contains(err.Error(), "track data too large") {
+		t.Errorf("ReadHFE() error = %v, expected track data too large", err)
+	}
+
+	// Cylinders beyond what HFE files can store
+	data := makeLongTrackHFE(0)
+	data[9] = DefaultMaxTracks + 1
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadHFE(filename); err == nil || !strings.Contains(err.Error(), "too many tracks") {
+		t.Errorf("ReadHFE() error = %v, expected too many tracks", err)
+	}
+
+	// Track list past end of file
+	data = makeLongTrackHFE(0)
+	binary.LittleEndian.PutUint16(data[18:], 1000)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadHFE(filename); err == nil || !strings.Contains(err.Error(), "past end of file") {
+		t.Errorf("ReadHFE() error = %v, expected track list past end of file", err)
+	}
+}
+
+func FuzzReadHFE(f *testing.F) {
+	for _, name := range []string{"fat12v1.hfe", "fat12v3.hfe"} {
+		data, err := os.ReadFile(findSampleFile(f, name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add(makeLongTrackHFE(0x20200))
+
+	filename := filepath.Join(f.TempDir(), "fuzz.hfe")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		disk, err := ReadHFE(filename)
+		if err == nil && len(disk.Tracks) > Limits.MaxTracks {
+			t.Errorf("read %d tracks, limit %d", len(disk.Tracks), Limits.MaxTracks)
+		}
+	})
+}
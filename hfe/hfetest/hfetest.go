@@ -0,0 +1,251 @@
+// Package hfetest provides utilities for testing of floppy image codecs:
+// a deterministic builder of random disks, and a sector-level differ.
+package hfetest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+)
+
+// Geometry of a disk in IBM PC format, with 512-byte sectors
+type Geometry struct {
+	Cylinders       int
+	Sides           int
+	SectorsPerTrack int
+}
+
+func (g Geometry) String() string {
+	return fmt.Sprintf("%dx%dx%d", g.Cylinders, g.Sides, g.SectorsPerTrack)
+}
+
+// Geometries of IBM PC disks, which are recognized by size of IMG files.
+// 5¼" 360K disks are missing: their images are read as 3½" single-sided.
+var Geometries = []Geometry{
+	{40, 1, 8},  // 160K
+	{40, 1, 9},  // 180K
+	{40, 2, 8},  // 320K
+	{80, 1, 9},  // 360K, 3½"
+	{80, 2, 9},  // 720K
+	{80, 2, 10}, // 800K
+	{80, 2, 15}, // 1.2M
+	{80, 2, 18}, // 1.44M
+	{80, 2, 20}, // 1.6M
+	{80, 2, 36}, // 2.88M
+}
+
+// Bytes which are special for track encodings: MFM sync and gap bytes,
+// address marks, and HFE opcodes as they appear in bit-reversed stream
+var specialBytes = []byte{
+	0x00, 0xFF, 0x4E, 0xA1, 0xC2, 0xF5, 0xF6, 0xF7, 0xF8, 0xFB, 0xFC, 0xFE,
+	0xF0, 0xF1, 0xF2, 0xF3, 0xF4, 0x0F, 0x8F, 0x4F, 0xCF, 0x2F,
+}
+
+// RandomDisk builds a disk of IBM PC format with the given geometry,
+// filled with pseudo-random sectors. The same seed gives the same disk.
+// Sectors have random contents, runs of bytes which are special for
+// track encodings, or a mix of both. With deleted set, about one sector
+// of eight gets deleted data address mark.
+func RandomDisk(seed int64, g Geometry, deleted bool) *hfe.Disk {
+	rng := rand.New(rand.NewSource(seed))
+	disk := newDisk(g)
+
+	// Max track length in MFM bits
+	maxHalfBits := int(disk.Header.BitRate) * 1000 * 60 / int(disk.Header.FloppyRPM) * 2
+
+	for cyl := 0; cyl < g.Cylinders; cyl++ {
+		for head := 0; head < g.Sides; head++ {
+			sectors := make([][]byte, g.SectorsPerTrack)
+			marks := make([]bool, g.SectorsPerTrack)
+			for s := range sectors {
+				sectors[s] = randomSector(rng)
+				marks[s] = deleted && rng.Intn(8) == 0
+			}
+			writer := mfm.NewWriter(maxHalfBits)
+			track := writer.EncodeTrackIBMPCDeleted(sectors, marks, cyl, head, g.SectorsPerTrack, disk.Header.BitRate)
+			if head == 0 {
+				disk.Tracks[cyl].Side0 = track
+			} else {
+				disk.Tracks[cyl].Side1 = track
+			}
+		}
+	}
+	return disk
+}
+
+// Empty disk with header for the given geometry, as ReadIMG creates it
+func newDisk(g Geometry) *hfe.Disk {
+	disk := &hfe.Disk{
+		Header: hfe.Header{
+			NumberOfTrack:       uint8(g.Cylinders),
+			NumberOfSide:        uint8(g.Sides),
+			TrackEncoding:       hfe.ENC_ISOIBM_MFM,
+			BitRate:             500,
+			FloppyRPM:           300,
+			FloppyInterfaceMode: hfe.IFM_IBMPC_HD,
+			WriteProtected:      0xFF,
+			WriteAllowed:        0xFF,
+			SingleStep:          0xFF,
+			Track0S0AltEncoding: 0xFF,
+			Track0S0Encoding:    hfe.ENC_ISOIBM_MFM,
+			Track0S1AltEncoding: 0xFF,
+			Track0S1Encoding:    hfe.ENC_ISOIBM_MFM,
+		},
+		Tracks: make([]hfe.TrackData, g.Cylinders),
+	}
+	if g.SectorsPerTrack < 12 {
+		disk.Header.BitRate = 250
+		disk.Header.FloppyInterfaceMode = hfe.IFM_IBMPC_DD
+	} else if g.SectorsPerTrack > 18 {
+		disk.Header.BitRate = 1000
+		disk.Header.FloppyInterfaceMode = hfe.IFM_IBMPC_ED
+	}
+	if g.SectorsPerTrack == 15 {
+		disk.Header.FloppyRPM = 360
+	}
+	return disk
+}
+
+// Contents of one sector, of a randomly chosen kind
+func randomSector(rng *rand.Rand) []byte {
+	data := make([]byte, 512)
+	switch rng.Intn(4) {
+	case 0:
+		// Random bytes
+		rng.Read(data)
+	case 1:
+		// Filled with one special byte
+		b := specialBytes[rng.Intn(len(specialBytes))]
+		for i := range data {
+			data[i] = b
+		}
+	case 2:
+		// Runs of special bytes
+		for i := 0; i < len(data); {
+			b := specialBytes[rng.Intn(len(specialBytes))]
+			for n := 1 + rng.Intn(16); n > 0 && i < len(data); n-- {
+				data[i] = b
+				i++
+			}
+		}
+	default:
+		// Random bytes mixed with special ones
+		rng.Read(data)
+		for i := range data {
+			if rng.Intn(4) == 0 {
+				data[i] = specialBytes[rng.Intn(len(specialBytes))]
+			}
+		}
+	}
+	return data
+}
+
+// SectorKey identifies a sector on the disk
+type SectorKey struct {
+	Cyl    int
+	Head   int
+	Sector int // Sector number from ID field
+}
+
+func (k SectorKey) String() string {
+	return fmt.Sprintf("sector %d of track %d.%d", k.Sector, k.Cyl, k.Head)
+}
+
+// Sector contents and flags, as decoded from a track
+type Sector struct {
+	Data    []byte
+	Deleted bool // Deleted data address mark
+	Bad     bool // Data CRC mismatch
+}
+
+// Sectors decodes all sectors of a disk in IBM PC format.
+// When a sector appears on the track several times,
+// the first good copy is kept.
+func Sectors(disk *hfe.Disk) map[SectorKey]Sector {
+	result := make(map[SectorKey]Sector)
+	numCylinders := min(int(disk.Header.NumberOfTrack), len(disk.Tracks))
+	for cyl := 0; cyl < numCylinders; cyl++ {
+		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+			track := disk.Tracks[cyl].Side0
+			if head == 1 {
+				track = disk.Tracks[cyl].Side1
+			}
+			reader := mfm.NewReader(track)
+			for {
+				s, err := reader.ReadSectorInfoIBMPC(cyl, head)
+				if err != nil {
+					break
+				}
+				key := SectorKey{cyl, head, s.Sector}
+				if old, found := result[key]; found && !old.Bad {
+					continue
+				}
+				result[key] = Sector{Data: s.Data, Deleted: s.Deleted, Bad: s.Bad}
+			}
+		}
+	}
+	return result
+}
+
+// DiffSectors compares two disks in IBM PC format sector by sector.
+// Returns a description of every difference: missing or extra sectors,
+// mismatching contents or flags, in order of cylinder, head and sector.
+// Empty result means both disks have the same contents.
+func DiffSectors(want, got *hfe.Disk) []string {
+	wantSectors := Sectors(want)
+	gotSectors := Sectors(got)
+
+	keys := make([]SectorKey, 0, len(wantSectors))
+	for key := range wantSectors {
+		keys = append(keys, key)
+	}
+	for key := range gotSectors {
+		if _, found := wantSectors[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Cyl != b.Cyl {
+			return a.Cyl < b.Cyl
+		}
+		if a.Head != b.Head {
+			return a.Head < b.Head
+		}
+		return a.Sector < b.Sector
+	})
+
+	var diffs []string
+	for _, key := range keys {
+		w, inWant := wantSectors[key]
+		g, inGot := gotSectors[key]
+		switch {
+		case !inGot:
+			diffs = append(diffs, fmt.Sprintf("%v: missing", key))
+		case !inWant:
+			diffs = append(diffs, fmt.Sprintf("%v: unexpected", key))
+		case !bytes.Equal(w.Data, g.Data):
+			diffs = append(diffs, fmt.Sprintf("%v: contents differ at byte %d", key, firstDiff(w.Data, g.Data)))
+		case w.Deleted != g.Deleted:
+			diffs = append(diffs, fmt.Sprintf("%v: deleted mark %v, expected %v", key, g.Deleted, w.Deleted))
+		case w.Bad != g.Bad:
+			diffs = append(diffs, fmt.Sprintf("%v: bad CRC %v, expected %v", key, g.Bad, w.Bad))
+		}
+	}
+	return diffs
+}
+
+// Offset of the first mismatching byte
+func firstDiff(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,68 @@
+package hfetest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRandomDisk_Deterministic(t *testing.T) {
+	g := Geometry{40, 1, 9}
+	a := RandomDisk(7, g, true)
+	b := RandomDisk(7, g, true)
+	c := RandomDisk(8, g, true)
+	for cyl := range a.Tracks {
+		if !bytes.Equal(a.Tracks[cyl].Side0, b.Tracks[cyl].Side0) {
+			t.Fatalf("track %d differs for the same seed", cyl)
+		}
+	}
+	if len(DiffSectors(a, b)) != 0 {
+		t.Errorf("DiffSectors() found differences for the same seed")
+	}
+	if len(DiffSectors(a, c)) == 0 {
+		t.Errorf("DiffSectors() found no differences for another seed")
+	}
+
+	// Every sector is decoded, with some deleted marks
+	sectors := Sectors(a)
+	if len(sectors) != 40*9 {
+		t.Errorf("decoded %d sectors, expected %d", len(sectors), 40*9)
+	}
+	deleted := 0
+	for key, s := range sectors {
+		if s.Bad {
+			t.Errorf("%v: bad CRC", key)
+		}
+		if s.Deleted {
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		t.Errorf("no deleted sectors")
+	}
+}
+
+func TestDiffSectors(t *testing.T) {
+	g := Geometry{40, 1, 8}
+	want := RandomDisk(1, g, false)
+	got := RandomDisk(1, g, false)
+
+	// Change one sector, and erase one track
+	data := make([]byte, 512)
+	data[100] = 0x55
+	if err := got.WriteSector(3, 0, 2, data); err != nil {
+		t.Fatalf("WriteSector() error: %v", err)
+	}
+	got.Tracks[5].Side0 = nil
+
+	diffs := DiffSectors(want, got)
+	if len(diffs) != 1+8 {
+		t.Fatalf("DiffSectors() = %q, expected 9 differences", diffs)
+	}
+	if !strings.HasPrefix(diffs[0], "sector 2 of track 3.0: contents differ") {
+		t.Errorf("first difference %q", diffs[0])
+	}
+	if diffs[1] != "sector 1 of track 5.0: missing" {
+		t.Errorf("second difference %q", diffs[1])
+	}
+}
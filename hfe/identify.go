@@ -0,0 +1,364 @@
+package hfe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Platform is a computer family which wrote the disk
+type Platform string
+
+const (
+	PlatformUnknown Platform = ""
+	PlatformIBMPC   Platform = "IBM PC"
+	PlatformAmiga   Platform = "Amiga"
+	PlatformAtariST Platform = "Atari ST"
+	PlatformCPM     Platform = "CP/M"
+)
+
+// Confidence tells how reliable the identification is
+type Confidence string
+
+const (
+	ConfidenceLow    Confidence = "low"    // Guessed from geometry alone
+	ConfidenceMedium Confidence = "medium" // File system found, but geometry does not match it
+	ConfidenceHigh   Confidence = "high"   // File system found, and geometry matches
+)
+
+// Geometry is layout of sectors on the disk
+type Geometry struct {
+	Cylinders  int    `json:"cylinders"`   // Cylinders with sectors
+	Heads      int    `json:"heads"`       // Sides with sectors
+	Sectors    int    `json:"sectors"`     // Sectors per track, the largest number found
+	SectorSize int    `json:"sector_size"` // Bytes per sector
+	BitRate    uint16 `json:"bit_rate"`    // Bit rate in kbps
+	Encoding   uint8  `json:"encoding"`    // Track encoding, like ENC_ISOIBM_MFM
+}
+
+// Size returns capacity of the disk in bytes
+func (g Geometry) Size() int {
+	return g.Cylinders * g.Heads * g.Sectors * g.SectorSize
+}
+
+// Identification describes what the disk probably is
+type Identification struct {
+	Platform    Platform   `json:"platform,omitempty"`
+	Filesystem  string     `json:"filesystem,omitempty"` // Like "FAT12" or "OFS", empty when not found
+	Confidence  Confidence `json:"confidence"`
+	Description string     `json:"description"` // Like "DOS FAT12 720K"
+	Geometry
+}
+
+func (id *Identification) String() string {
+	return fmt.Sprintf("%s (confidence %s)", id.Description, id.Confidence)
+}
+
+// Identify finds platform and file system of the disk, by geometry,
+// boot sector and directory contents, and track encoding.
+// Returns error when the disk has no tracks.
+func Identify(disk *Disk) (*Identification, error) {
+	if len(disk.Tracks) == 0 {
+		return nil, errors.New("disk has no tracks")
+	}
+	id := &Identification{Geometry: disk.geometry()}
+	switch id.Encoding {
+	case ENC_Amiga_MFM:
+		id.Platform = PlatformAmiga
+		id.Confidence = ConfidenceMedium
+		if fs := amigaFilesystem(disk.amigaBootBlock()); fs != "" {
+			id.Filesystem = fs
+			id.Confidence = ConfidenceHigh
+		}
+	case ENC_ISOIBM_MFM:
+		boot, _ := disk.ReadSector(0, 0, 1)
+		id.Platform, id.Filesystem = IdentifyFilesystem(boot)
+		switch {
+		case id.Filesystem != "":
+			id.Confidence = ConfidenceMedium
+			if cylinders := bpbCylinders(boot, id.Geometry); cylinders != 0 {
+				id.Cylinders = cylinders
+				id.Confidence = ConfidenceHigh
+			}
+		case disk.hasCPMDirectory():
+			id.Platform, id.Filesystem = PlatformCPM, "CP/M"
+			id.Confidence = ConfidenceMedium
+		default:
+			id.Platform = IdentifyPlatform(id.Geometry)
+			id.Confidence = ConfidenceLow
+		}
+	default:
+		id.Confidence = ConfidenceLow
+	}
+	id.Description = id.describe()
+	return id, nil
+}
+
+// Human-readable description, like "DOS FAT12 720K"
+func (id *Identification) describe() string {
+	var words []string
+	switch {
+	case id.Platform == PlatformUnknown:
+		return "unknown format"
+	case id.Platform == PlatformIBMPC && id.Filesystem == "FAT12":
+		words = append(words, "DOS")
+	case id.Platform != PlatformCPM || id.Filesystem == "":
+		words = append(words, string(id.Platform))
+	}
+	if id.Filesystem != "" {
+		words = append(words, id.Filesystem)
+	}
+	if size := id.Size(); size > 0 {
+		words = append(words, formatSize(size))
+	}
+	if id.Filesystem == "" {
+		words = append(words, "without known file system")
+	}
+	return strings.Join(words, " ")
+}
+
+// Capacity like "720K" or "1.44M"
+func formatSize(bytes int) string {
+	kb := bytes / 1024
+	if kb >= 1000 {
+		return fmt.Sprintf("%gM", float64(kb)/1000)
+	}
+	return fmt.Sprintf("%dK", kb)
+}
+
+// IdentifyFilesystem recognizes file system by the boot sector of
+// IBM PC format disk: FAT12 of IBM PC with x86 jump, or of Atari ST
+// with 68000 branch or without jump. Returns empty file system
+// when the boot sector has no valid BIOS Parameter Block.
+func IdentifyFilesystem(boot []byte) (Platform, string) {
+	if !validBPB(boot) {
+		return PlatformUnknown, ""
+	}
+	switch {
+	case boot[0] == 0xEB || boot[0] == 0xE9:
+		return PlatformIBMPC, "FAT12"
+	default:
+		// TOS writes BRA.S, or nothing in place of the jump
+		return PlatformAtariST, "FAT12"
+	}
+}
+
+// IdentifyPlatform guesses platform by geometry alone
+func IdentifyPlatform(g Geometry) Platform {
+	switch {
+	case g.Encoding == ENC_Amiga_MFM:
+		return PlatformAmiga
+	case g.Encoding != ENC_ISOIBM_MFM || g.SectorSize != 512:
+		return PlatformUnknown
+	case g.BitRate < 375 && (g.Sectors == 10 || g.Sectors == 11) && g.Cylinders >= 80:
+		// Extended formats of Atari ST
+		return PlatformAtariST
+	case g.BitRate < 375 && (g.Sectors == 8 || g.Sectors == 9),
+		g.BitRate >= 375 && (g.Sectors == 15 || g.Sectors == 18 || g.Sectors == 36):
+		return PlatformIBMPC
+	}
+	return PlatformUnknown
+}
+
+// Check BIOS Parameter Block of FAT boot sector
+func validBPB(boot []byte) bool {
+	if len(boot) < 512 {
+		return false
+	}
+	bytesPerSector := binary.LittleEndian.Uint16(boot[11:])
+	sectorsPerCluster := boot[13]
+	reserved := binary.LittleEndian.Uint16(boot[14:])
+	fats := boot[16]
+	rootEntries := binary.LittleEndian.Uint16(boot[17:])
+	totalSectors := binary.LittleEndian.Uint16(boot[19:])
+	media := boot[21]
+	sectorsPerTrack := binary.LittleEndian.Uint16(boot[24:])
+	heads := binary.LittleEndian.Uint16(boot[26:])
+	switch bytesPerSector {
+	case 128, 256, 512, 1024:
+	default:
+		return false
+	}
+	return sectorsPerCluster != 0 && sectorsPerCluster&(sectorsPerCluster-1) == 0 &&
+		reserved >= 1 && (fats == 1 || fats == 2) && rootEntries != 0 && totalSectors != 0 &&
+		(media == 0xF0 || media >= 0xF8) && sectorsPerTrack >= 1 && sectorsPerTrack <= 63 &&
+		(heads == 1 || heads == 2)
+}
+
+// Number of cylinders given by BIOS Parameter Block, when it describes
+// the given geometry. Disks read past the last cylinder of the file
+// system may have a few more cylinders. Returns 0 on mismatch.
+func bpbCylinders(boot []byte, g Geometry) int {
+	sectorsPerTrack := int(binary.LittleEndian.Uint16(boot[24:]))
+	heads := int(binary.LittleEndian.Uint16(boot[26:]))
+	totalSectors := int(binary.LittleEndian.Uint16(boot[19:]))
+	if sectorsPerTrack != g.Sectors || heads != g.Heads || totalSectors%(heads*sectorsPerTrack) != 0 {
+		return 0
+	}
+	cylinders := totalSectors / (heads * sectorsPerTrack)
+	if cylinders > g.Cylinders || cylinders+3 < g.Cylinders {
+		return 0
+	}
+	return cylinders
+}
+
+// Amiga file system of the boot block: "DOS" and flags of the file system
+func amigaFilesystem(boot []byte) string {
+	if len(boot) < 4 || string(boot[:3]) != "DOS" || boot[3] > 7 {
+		return ""
+	}
+	fs := "OFS"
+	if boot[3]&1 != 0 {
+		fs = "FFS"
+	}
+	if boot[3]&4 != 0 {
+		fs += " DirCache"
+	} else if boot[3]&2 != 0 {
+		fs += " International"
+	}
+	return fs
+}
+
+// First sector of the Amiga boot block, or nil when not found
+func (disk *Disk) amigaBootBlock() []byte {
+	reader := mfm.NewReader(disk.Tracks[0].Side0)
+	for {
+		sector, data, err := reader.ReadSectorAmiga(0)
+		if err != nil {
+			return nil
+		}
+		if sector == 0 {
+			return data
+		}
+	}
+}
+
+// CP/M directory entry: user number 0-15, file name and extension
+// in 7-bit ASCII, extent number, and count of 128-byte records.
+// Unused entries are filled with 0xE5.
+func cpmEntry(entry []byte) (used, ok bool) {
+	if entry[0] == 0xE5 {
+		return false, true
+	}
+	if entry[0] > 15 || entry[12] > 31 || entry[15] > 0x80 {
+		return false, false
+	}
+	for _, c := range entry[1:12] {
+		if c &= 0x7F; c < 0x20 || c == 0x7F {
+			return false, false
+		}
+	}
+	return true, true
+}
+
+// Directory of CP/M follows reserved tracks: look for a sector
+// of directory entries at the start of the first tracks
+func (disk *Disk) hasCPMDirectory() bool {
+	for cyl := 0; cyl < min(len(disk.Tracks), 4); cyl++ {
+		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+			decoded := DecodeTrack(disk.Tracks[cyl].side(head), cyl, head)
+			var first *mfm.SectorIBMPC
+			for _, s := range decoded.Sectors {
+				if !s.Bad && (first == nil || s.Sector < first.Sector) {
+					first = s
+				}
+			}
+			if first == nil || len(first.Data) < 128 {
+				continue
+			}
+			files := 0
+			for pos := 0; pos+32 <= len(first.Data); pos += 32 {
+				used, ok := cpmEntry(first.Data[pos : pos+32])
+				if !ok {
+					files = -1
+					break
+				}
+				if used {
+					files++
+				}
+			}
+			if files > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Find geometry of the disk by sectors on its tracks. Encoding is
+// detected on track 0, or taken from the header.
+func (disk *Disk) geometry() Geometry {
+	g := Geometry{BitRate: disk.Header.BitRate, Encoding: DetectEncoding(disk.Tracks[0].Side0, 0, 0)}
+	if g.Encoding == ENC_Unknown {
+		g.Encoding = disk.Header.TrackEncoding
+	}
+	for cyl := range disk.Tracks {
+		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+			track := disk.Tracks[cyl].side(head)
+			n := 0
+			switch g.Encoding {
+			case ENC_ISOIBM_MFM:
+				decoded := DecodeTrack(track, cyl, head)
+				n = decoded.GoodSectors()
+				if n > 0 && g.SectorSize == 0 {
+					g.SectorSize = len(decoded.Sectors[0].Data)
+				}
+			case ENC_Amiga_MFM:
+				n = countSectorsAmiga(track, cyl*2+head)
+				g.SectorSize = 512
+			}
+			if n > 0 {
+				g.Cylinders = cyl + 1
+				g.Heads = max(g.Heads, head+1)
+				g.Sectors = max(g.Sectors, n)
+			}
+		}
+	}
+	return g
+}
+
+// Count distinct Amiga sectors on the track: 11 on DD disk, 22 on HD
+func countSectorsAmiga(track []byte, num int) int {
+	found := make(map[int]bool)
+	reader := mfm.NewReader(track)
+	for {
+		sector, _, err := reader.ReadSectorAmiga(num)
+		if err != nil {
+			return len(found)
+		}
+		if sector >= 0 && sector < 22 {
+			found[sector] = true
+		}
+	}
+}
+
+// Image formats which hold sectors of IBM PC format only
+var ibmFormats = map[ImageFormat]bool{
+	ImageFormatCP2: true,
+	ImageFormatDCF: true,
+	ImageFormatEPL: true,
+	ImageFormatIMD: true,
+	ImageFormatIMG: true,
+	ImageFormatMSA: true,
+	ImageFormatTD0: true,
+}
+
+// Image format may be unable to hold some disks, see FormatWarning
+func formatMayNotFit(format ImageFormat) bool {
+	return ibmFormats[format] || format == ImageFormatADF
+}
+
+// FormatWarning returns warning when the image format cannot hold
+// the identified disk, or empty string
+func (id *Identification) FormatWarning(format ImageFormat) string {
+	switch {
+	case id.Platform == PlatformAmiga && ibmFormats[format]:
+	case id.Encoding == ENC_ISOIBM_MFM && id.Platform != PlatformUnknown && format == ImageFormatADF:
+	default:
+		return ""
+	}
+	return fmt.Sprintf("%s disk does not fit %s format: its sectors will be lost", id.Platform, format)
+}
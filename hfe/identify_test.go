@@ -0,0 +1,216 @@
+package hfe
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Boot sector with BIOS Parameter Block of 720K disk, after the given jump
+func makeBootSector(jump ...byte) []byte {
+	boot := make([]byte, 512)
+	copy(boot, jump)
+	binary.LittleEndian.PutUint16(boot[11:], 512)  // Bytes per sector
+	boot[13] = 2                                   // Sectors per cluster
+	binary.LittleEndian.PutUint16(boot[14:], 1)    // Reserved sectors
+	boot[16] = 2                                   // Number of FATs
+	binary.LittleEndian.PutUint16(boot[17:], 112)  // Root entries
+	binary.LittleEndian.PutUint16(boot[19:], 1440) // Total sectors
+	boot[21] = 0xF9                                // Media descriptor
+	binary.LittleEndian.PutUint16(boot[22:], 3)    // Sectors per FAT
+	binary.LittleEndian.PutUint16(boot[24:], 9)    // Sectors per track
+	binary.LittleEndian.PutUint16(boot[26:], 2)    // Heads
+	boot[510], boot[511] = 0x55, 0xAA
+	return boot
+}
+
+// Disk of IBM PC format at 250 kbps, with the given boot sector,
+// and contents of the first sector on other tracks
+func makeIdentifyDiskIBM(cyls, heads, sectors int, boot []byte, first func(cyl, head int) []byte) *Disk {
+	disk := &Disk{
+		Header: Header{NumberOfTrack: uint8(cyls), NumberOfSide: uint8(heads), BitRate: 250, FloppyRPM: 300, TrackEncoding: ENC_ISOIBM_MFM},
+		Tracks: make([]TrackData, cyls),
+	}
+	for cyl := 0; cyl < cyls; cyl++ {
+		for head := 0; head < heads; head++ {
+			data := make([][]byte, sectors)
+			for s := range data {
+				data[s] = make([]byte, 512)
+			}
+			if cyl == 0 && head == 0 {
+				copy(data[0], boot)
+			} else if first != nil {
+				copy(data[0], first(cyl, head))
+			}
+			track := mfm.NewWriter(250*1000*60/300*2).EncodeTrackIBMPC(data, cyl, head, sectors, 250)
+			if head == 0 {
+				disk.Tracks[cyl].Side0 = track
+			} else {
+				disk.Tracks[cyl].Side1 = track
+			}
+		}
+	}
+	return disk
+}
+
+// Amiga disk of 880K with the given boot block
+func makeIdentifyDiskAmiga(boot []byte) *Disk {
+	disk := &Disk{
+		Header: Header{NumberOfTrack: 80, NumberOfSide: 2, BitRate: 250, FloppyRPM: 300, TrackEncoding: ENC_Amiga_MFM},
+		Tracks: make([]TrackData, 80),
+	}
+	for cyl := 0; cyl < 80; cyl++ {
+		for head := 0; head < 2; head++ {
+			data := make([][]byte, 11)
+			for s := range data {
+				data[s] = make([]byte, 512)
+			}
+			if cyl == 0 && head == 0 {
+				copy(data[0], boot)
+			}
+			track := mfm.NewWriter(250*1000*60/300*2).EncodeTrackAmiga(data, cyl*2+head)
+			if head == 0 {
+				disk.Tracks[cyl].Side0 = track
+			} else {
+				disk.Tracks[cyl].Side1 = track
+			}
+		}
+	}
+	return disk
+}
+
+// Directory of CP/M with one file, on cylinder 2
+func cpmDirectory(cyl, head int) []byte {
+	if cyl != 2 || head != 0 {
+		return nil
+	}
+	dir := make([]byte, 512)
+	for i := range dir {
+		dir[i] = 0xE5
+	}
+	entry := append([]byte{0}, "HELLO   COM"...)
+	entry = append(entry, 0, 0, 0, 8)
+	copy(dir, entry)
+	for i := 16; i < 32; i++ {
+		dir[i] = 0
+	}
+	dir[16] = 1
+	return dir
+}
+
+func TestIdentify(t *testing.T) {
+	tests := []struct {
+		name       string
+		disk       *Disk
+		platform   Platform
+		filesystem string
+		confidence Confidence
+		desc       string
+	}{
+		{"dos", makeIdentifyDiskIBM(80, 2, 9, makeBootSector(0xEB, 0x3C, 0x90), nil),
+			PlatformIBMPC, "FAT12", ConfidenceHigh, "DOS FAT12 720K"},
+		{"dos-extra-cylinders", makeIdentifyDiskIBM(82, 2, 9, makeBootSector(0xE9, 0x00, 0x01), nil),
+			PlatformIBMPC, "FAT12", ConfidenceHigh, "DOS FAT12 720K"},
+		{"dos-wrong-geometry", makeIdentifyDiskIBM(40, 2, 9, makeBootSector(0xEB, 0x3C, 0x90), nil),
+			PlatformIBMPC, "FAT12", ConfidenceMedium, "DOS FAT12 360K"},
+		{"atari", makeIdentifyDiskIBM(80, 2, 9, makeBootSector(0x60, 0x1C), nil),
+			PlatformAtariST, "FAT12", ConfidenceHigh, "Atari ST FAT12 720K"},
+		{"amiga-ofs", makeIdentifyDiskAmiga([]byte("DOS\x00")),
+			PlatformAmiga, "OFS", ConfidenceHigh, "Amiga OFS 880K"},
+		{"amiga-ffs", makeIdentifyDiskAmiga([]byte("DOS\x01")),
+			PlatformAmiga, "FFS", ConfidenceHigh, "Amiga FFS 880K"},
+		{"amiga-nondos", makeIdentifyDiskAmiga([]byte("KICK")),
+			PlatformAmiga, "", ConfidenceMedium, "Amiga 880K without known file system"},
+		{"cpm", makeIdentifyDiskIBM(40, 1, 10, nil, cpmDirectory),
+			PlatformCPM, "CP/M", ConfidenceMedium, "CP/M 200K"},
+		{"pc-no-filesystem", makeIdentifyDiskIBM(80, 2, 9, nil, nil),
+			PlatformIBMPC, "", ConfidenceLow, "IBM PC 720K without known file system"},
+		{"atari-extended", makeIdentifyDiskIBM(80, 2, 10, nil, nil),
+			PlatformAtariST, "", ConfidenceLow, "Atari ST 800K without known file system"},
+		{"blank", &Disk{Header: Header{NumberOfTrack: 2, NumberOfSide: 2}, Tracks: make([]TrackData, 2)},
+			PlatformUnknown, "", ConfidenceLow, "unknown format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := Identify(tt.disk)
+			if err != nil {
+				t.Fatalf("Identify() error: %v", err)
+			}
+			if id.Platform != tt.platform || id.Filesystem != tt.filesystem ||
+				id.Confidence != tt.confidence || id.Description != tt.desc {
+				t.Errorf("identified %q %q %s %q, expected %q %q %s %q",
+					id.Platform, id.Filesystem, id.Confidence, id.Description,
+					tt.platform, tt.filesystem, tt.confidence, tt.desc)
+			}
+		})
+	}
+
+	if _, err := Identify(&Disk{}); err == nil {
+		t.Errorf("Identify() accepted disk without tracks")
+	}
+}
+
+func TestIdentifyFilesystem(t *testing.T) {
+	badMedia := makeBootSector(0xEB, 0x3C, 0x90)
+	badMedia[21] = 0x12
+	tests := []struct {
+		name       string
+		boot       []byte
+		platform   Platform
+		filesystem string
+	}{
+		{"dos", makeBootSector(0xEB, 0x3C, 0x90), PlatformIBMPC, "FAT12"},
+		{"atari", makeBootSector(0x60, 0x1C), PlatformAtariST, "FAT12"},
+		{"bad-media", badMedia, PlatformUnknown, ""},
+		{"zeros", make([]byte, 512), PlatformUnknown, ""},
+		{"short", []byte{0xEB, 0x3C, 0x90}, PlatformUnknown, ""},
+	}
+	for _, tt := range tests {
+		platform, filesystem := IdentifyFilesystem(tt.boot)
+		if platform != tt.platform || filesystem != tt.filesystem {
+			t.Errorf("%s: identified %q %q, expected %q %q", tt.name, platform, filesystem, tt.platform, tt.filesystem)
+		}
+	}
+}
+
+func TestConvert_FormatWarning(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "amiga.adf")
+	if err := WriteADF(src, makeIdentifyDiskAmiga([]byte("DOS\x00"))); err != nil {
+		t.Fatalf("WriteADF() error: %v", err)
+	}
+	report, err := Convert(src, filepath.Join(dir, "amiga.imd"), ConvertOptions{})
+	if err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	if report.Identification == nil || report.Identification.Description != "Amiga OFS 880K" {
+		t.Errorf("identification %+v, expected Amiga OFS 880K", report.Identification)
+	}
+	if !strings.Contains(strings.Join(report.Warnings, "\n"), "Amiga disk does not fit IMD format") {
+		t.Errorf("warnings %q do not mention IMD format", report.Warnings)
+	}
+
+	// HFE holds any disk: it is identified only when asked
+	report, err = Convert(src, filepath.Join(dir, "copy.hfe"), ConvertOptions{})
+	if err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	for _, warning := range report.Warnings {
+		if strings.Contains(warning, "does not fit") {
+			t.Errorf("unexpected warning %q for HFE format", warning)
+		}
+	}
+	if report.Identification != nil {
+		t.Errorf("identified as %+v without being asked", report.Identification)
+	}
+	report, err = Convert(src, filepath.Join(dir, "copy.hfe"), ConvertOptions{Overwrite: true, Identify: true})
+	if err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	if report.Identification == nil || report.Identification.Description != "Amiga OFS 880K" {
+		t.Errorf("identification %+v, expected Amiga OFS 880K", report.Identification)
+	}
+}
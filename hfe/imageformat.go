@@ -11,15 +11,19 @@ type ImageFormat int
 const (
 	// ImageFormatUnknown represents an unknown or unrecognized format
 	ImageFormatUnknown ImageFormat = iota
+	ImageFormat86F                 // 86F format - 86Box flux-accurate image
+	ImageFormatA2R                 // A2R format - Applesauce flux image
 	ImageFormatADF                 // ADF format - Amiga Disk File
 	ImageFormatBKD                 // BKD format - Disk image for BK-0010 or BK-0011M
 	ImageFormatCP2                 // CP2 format - Central Point Software's Copy-II-PC
+	ImageFormatD64                 // D64 format - Commodore 1541 disk image
 	ImageFormatDCF                 // DCF format - Disk Copy Fast utility
 	ImageFormatEPL                 // EPL format - EPLCopy utility
 	ImageFormatHFE                 // HFE format - HxC Floppy Emulator
 	ImageFormatIMD                 // IMD format - Dave Dunfield's ImageDisk utility
-	ImageFormatIMG                 // IMG or IMA format - a raw, sector-by-sector binary copy of the entire disk
+	ImageFormatIMG                 // IMG, IMA or ST format - a raw, sector-by-sector binary copy of the entire disk
 	ImageFormatMFM                 // MFM format - low-level MFM encoded bit stream
+	ImageFormatMSA                 // MSA format - Magic Shadow Archiver image of Atari ST disk
 	ImageFormatPDI                 // PDI format - Upland's PlanetPress
 	ImageFormatPRI                 // PRI format - PCE Raw Image
 	ImageFormatPSI                 // PSI format - PCE Sector Image
@@ -30,12 +34,18 @@ const (
 // String returns the string representation of the ImageFormat
 func (f ImageFormat) String() string {
 	switch f {
+	case ImageFormat86F:
+		return "86F"
+	case ImageFormatA2R:
+		return "A2R"
 	case ImageFormatADF:
 		return "ADF"
 	case ImageFormatBKD:
 		return "BKD"
 	case ImageFormatCP2:
 		return "CP2"
+	case ImageFormatD64:
+		return "D64"
 	case ImageFormatDCF:
 		return "DCF"
 	case ImageFormatEPL:
@@ -48,6 +58,8 @@ func (f ImageFormat) String() string {
 		return "IMG"
 	case ImageFormatMFM:
 		return "MFM"
+	case ImageFormatMSA:
+		return "MSA"
 	case ImageFormatPDI:
 		return "PDI"
 	case ImageFormatPRI:
@@ -67,7 +79,7 @@ func (f ImageFormat) String() string {
 // The extension check is case-insensitive. Returns ImageFormatUnknown if the format
 // cannot be determined.
 func DetectImageFormat(filename string) ImageFormat {
-	ext := filepath.Ext(filename)
+	ext := filepath.Ext(trimGzipSuffix(filename))
 	if ext == "" {
 		return ImageFormatUnknown
 	}
@@ -76,12 +88,18 @@ func DetectImageFormat(filename string) ImageFormat {
 	ext = strings.ToLower(ext[1:])
 
 	switch ext {
+	case "86f":
+		return ImageFormat86F
+	case "a2r":
+		return ImageFormatA2R
 	case "adf":
 		return ImageFormatADF
 	case "bkd":
 		return ImageFormatBKD
 	case "cp2":
 		return ImageFormatCP2
+	case "d64":
+		return ImageFormatD64
 	case "dcf":
 		return ImageFormatDCF
 	case "epl":
@@ -96,6 +114,8 @@ func DetectImageFormat(filename string) ImageFormat {
 		return ImageFormatIMG
 	case "mfm":
 		return ImageFormatMFM
+	case "msa":
+		return ImageFormatMSA
 	case "pdi":
 		return ImageFormatPDI
 	case "pri":
@@ -104,6 +124,8 @@ func DetectImageFormat(filename string) ImageFormat {
 		return ImageFormatPSI
 	case "scp":
 		return ImageFormatSCP
+	case "st":
+		return ImageFormatIMG // Raw image of Atari ST disk
 	case "td0":
 		return ImageFormatTD0
 	default:
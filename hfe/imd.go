@@ -1,6 +1,10 @@
 package hfe
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +16,9 @@ import (
 const (
 	// IMD comment block terminator
 	imdCommentTerminator = 0x1A
+
+	// Fill byte for sectors with unavailable data, as used by format command
+	imdUnavailableFill = 0xF6
 )
 
 // IMDImage represents a complete IMD file
@@ -36,11 +43,33 @@ type IMDTrack struct {
 
 // IMDSector represents a single sector in IMD format
 type IMDSector struct {
-	Flag       byte   // Sector flag byte
-	Data       []byte // Sector data (nil if no data)
-	Compressed bool   // True if sector is compressed
-	Deleted    bool   // True if deleted address mark
-	Bad        bool   // True if bad sector
+	Flag        byte   // Sector flag byte
+	Data        []byte // Sector data (nil if no data)
+	Compressed  bool   // True if sector is compressed
+	Deleted     bool   // True if deleted address mark
+	Bad         bool   // True if bad sector
+	Unavailable bool   // True if sector data could not be read (flag 0)
+}
+
+// IMDSectorAddr identifies a sector of IMD image
+type IMDSectorAddr struct {
+	Cylinder int
+	Head     int
+	Sector   int // Logical sector number, 1-based
+}
+
+// IMDSectorID describes a sector whose ID field has cylinder or head
+// other than the physical track, as given by cylinder and head maps
+type IMDSectorID struct {
+	IMDSectorAddr     // Physical location
+	IDCylinder    int // Cylinder in ID field
+	IDHead        int // Head in ID field
+}
+
+// IMDConversionReport lists problems found when converting IMD image
+type IMDConversionReport struct {
+	Unavailable []IMDSectorAddr // Sectors without data, filled with 0xF6
+	Remapped    []IMDSectorID   // Sectors with non-standard addressing
 }
 
 // imdSectorSize calculates the actual sector size from encoded size
@@ -60,6 +89,75 @@ func modeToRateDensity(mode byte) (rate int, mfm bool, err error) {
 	return rateTable[mode], mode >= 3, nil
 }
 
+// Round bit rate to the nearest data rate supported by IMD.
+// Tracks read from real disks have rates like 249 or 301 kbps.
+func nearestIMDRate(rate int) int {
+	best := 250
+	for _, r := range []int{500, 300} {
+		if abs(rate-r) < abs(rate-best) {
+			best = r
+		}
+	}
+	return best
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Compute IMD mode byte for the given track of the disk.
+// Bit rate may be set per track. Encoding of track 0 may differ
+// from the rest of the disk, like FM track 0 on CP/M disks.
+// Tracks recorded in FM are detected from their data; encodings
+// of cylinders given in the map take precedence.
+func (disk *Disk) imdTrackMode(cyl, head int, encodings map[int]uint8) byte {
+	encoding, ok := encodings[cyl]
+	if !ok {
+		encoding = disk.Header.TrackEncoding
+		if cyl == 0 {
+			if head == 0 && disk.Header.Track0S0AltEncoding == 0 {
+				encoding = disk.Header.Track0S0Encoding
+			} else if head == 1 && disk.Header.Track0S1AltEncoding == 0 {
+				encoding = disk.Header.Track0S1Encoding
+			}
+		}
+		if cyl < len(disk.Tracks) && isFMTrack(disk.Tracks[cyl].side(head)) {
+			encoding = ENC_ISOIBM_FM
+		}
+	}
+	isMFM := encoding != ENC_ISOIBM_FM && encoding != ENC_Emu_FM
+
+	rate := nearestIMDRate(int(disk.TrackBitRate(cyl)))
+	mode, _ := rateDensityToMode(rate, isMFM)
+	return mode
+}
+
+// ID address mark of FM: data 0xFE with clock 0xC7,
+// every FM bitcell taking two bitcells of the track
+const fmAddressMark = 0xAA222AA8
+
+// Report whether the track is recorded in FM: it has FM address marks,
+// and no MFM sync marks.
+func isFMTrack(track []byte) bool {
+	var history uint32
+	fm := false
+	for _, b := range track {
+		for bit := 7; bit >= 0; bit-- {
+			history = history<<1 | uint32(b>>bit&1)
+			switch history {
+			case 0x44894489:
+				return false
+			case fmAddressMark:
+				fm = true
+			}
+		}
+	}
+	return fm
+}
+
 // rateDensityToMode encodes data rate and encoding type to mode byte
 func rateDensityToMode(rate int, mfm bool) (byte, error) {
 	var baseMode int
@@ -93,78 +191,109 @@ func isCompressible(data []byte) bool {
 	return true
 }
 
+// Largest valid sector flag
+const imdMaxFlag = 0x08
+
 // calculateFlag calculates the sector flag byte from status flags
+// According to IMD spec, flag is 1 for normal data, plus
+// 1 for compressed data, 2 for deleted address mark, 4 for bad sector.
 func calculateFlag(compressed, deleted, bad bool) byte {
 	flag := byte(1) // Base: data present
 	if compressed {
-		flag |= 0x01
+		flag += 1
 	}
 	if deleted {
-		flag |= 0x02
+		flag += 2
 	}
 	if bad {
-		flag |= 0x04
+		flag += 4
 	}
 	return flag
 }
 
 // Decode a sector flag byte into status flags
-// According to IMD spec examples:
-// - 0x01 = Normal data, not compressed
+// According to IMD spec:
+// - 0x00 = Sector data unavailable - could not be read
+// - 0x01 = Normal data
 // - 0x02 = Compressed data (all bytes same)
 // - 0x03 = Normal data with deleted address mark
+// - 0x04 = Compressed data with deleted address mark
 // - 0x05 = Normal data, bad sector
-// - 0x06 = Compressed data, bad sector (0x02 | 0x04)
-// - 0x07 = Compressed data, deleted address mark, bad sector
+// - 0x06 = Compressed data, bad sector
+// - 0x07 = Normal data, deleted address mark, bad sector
+// - 0x08 = Compressed data, deleted address mark, bad sector
 func decodeFlag(flag byte) (compressed, deleted, bad bool) {
-	compressed = flag == 0x02 || flag == 0x06 || flag == 0x07 // Compressed data
-	deleted = flag == 0x03 || flag == 0x07                    // Deleted address mark
-	bad = flag == 0x05 || flag == 0x06 || flag == 0x07        // Bad sector
-	return
+	if flag == 0 || flag > imdMaxFlag {
+		return false, false, false
+	}
+	bits := flag - 1
+	return bits&1 != 0, bits&2 != 0, bits&4 != 0
+}
+
+// IMDReadOptions control reading of IMD images
+type IMDReadOptions struct {
+	// Keep tracks read before the end of a truncated file: the image
+	// is returned together with an error which tells where the file
+	// is cut off, and wraps io.ErrUnexpectedEOF
+	Partial bool
 }
 
 // ReadIMDFile reads a file in IMD format and returns an IMDImage structure.
 func ReadIMDFile(filename string) (*IMDImage, error) {
-	file, err := os.Open(filename)
+	return ReadIMDFileOptions(filename, IMDReadOptions{})
+}
+
+// ReadIMDFileOptions reads a file in IMD format with the given options,
+// and returns an IMDImage structure.
+func ReadIMDFileOptions(filename string, opts IMDReadOptions) (*IMDImage, error) {
+	file, err := openImageFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, err
 	}
 	defer file.Close()
+	return readIMDImage(bufio.NewReader(file), opts)
+}
 
+// Read IMD image from the buffered stream
+func readIMDImage(file *bufio.Reader, opts IMDReadOptions) (*IMDImage, error) {
 	// Read comment block (until 0x1A)
-	comment := make([]byte, 0, 1024)
-	for {
-		var b [1]byte
-		n, err := file.Read(b[:])
-		if err != nil {
-			if err == io.EOF {
-				return nil, fmt.Errorf("unexpected EOF in comment block")
-			}
-			return nil, fmt.Errorf("failed to read comment: %w", err)
-		}
-		if n == 0 {
-			return nil, fmt.Errorf("unexpected EOF in comment block")
-		}
-		if b[0] == imdCommentTerminator {
-			break
+	comment, err := file.ReadBytes(imdCommentTerminator)
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("comment block: %w", io.ErrUnexpectedEOF)
 		}
-		comment = append(comment, b[0])
+		return nil, fmt.Errorf("failed to read comment: %w", err)
 	}
+	comment = comment[:len(comment)-1]
 
-	// Read track records
+	// Read track records, within limit of total size
 	var tracks []IMDTrack
+	var truncated error
+	total := int64(0)
 	for {
 		track, err := readIMDTrack(file)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, fmt.Errorf("failed to read track: %w", err)
+			err = fmt.Errorf("failed to read track record %d: %w", len(tracks), err)
+			if opts.Partial && errors.Is(err, io.ErrUnexpectedEOF) {
+				truncated = err
+				break
+			}
+			return nil, err
 		}
 		tracks = append(tracks, track)
+		total += int64(track.Nsec) * int64(imdSectorSize(track.Ssize))
+		if err := Limits.checkDiskBytes(total); err != nil {
+			return nil, err
+		}
 	}
 
 	if len(tracks) == 0 {
+		if truncated != nil {
+			return nil, truncated
+		}
 		return nil, fmt.Errorf("no tracks found in IMD file")
 	}
 
@@ -176,6 +305,9 @@ func ReadIMDFile(filename string) (*IMDImage, error) {
 		}
 	}
 	if validTracks == 0 {
+		if truncated != nil {
+			return nil, truncated
+		}
 		return nil, fmt.Errorf("no tracks with sectors found in IMD file")
 	}
 
@@ -185,7 +317,10 @@ func ReadIMDFile(filename string) (*IMDImage, error) {
 	for _, track := range tracks {
 		if track.Nsec > 0 {
 			rate, _, err := modeToRateDensity(track.Mode)
-			if err == nil && rate > 0 {
+			if err == nil && rate == 300 {
+				// DD disk in a 360 RPM drive: track holds as many bits as at 250 kbps, 300 RPM
+				floppyRPM = 360
+			} else if err == nil && rate > 0 {
 				// Calculate approximate track capacity in bits (sector data only)
 				// Note: Actual MFM bitstream includes sync, address marks, gaps, etc.,
 				// but this gives us a reasonable estimate for RPM calculation
@@ -226,14 +361,24 @@ func ReadIMDFile(filename string) (*IMDImage, error) {
 		Comment:   comment,
 		Tracks:    tracks,
 		FloppyRPM: floppyRPM,
-	}, nil
+	}, truncated
 }
 
 // ConvertIMDToHFE converts an IMDImage structure to HFE Disk structure.
 func ConvertIMDToHFE(img *IMDImage) (*Disk, error) {
+	disk, _, err := ConvertIMDToHFEReport(img)
+	return disk, err
+}
+
+// ConvertIMDToHFEReport converts an IMDImage structure to HFE Disk structure,
+// and reports sectors without data, which are filled with 0xF6.
+// Cylinder and head maps of the image, when present, give the ID fields of sectors;
+// sectors addressed other than by their physical track are reported too.
+func ConvertIMDToHFEReport(img *IMDImage) (*Disk, *IMDConversionReport, error) {
 	if len(img.Tracks) == 0 {
-		return nil, fmt.Errorf("no tracks in IMD image")
+		return nil, nil, fmt.Errorf("no tracks in IMD image")
 	}
+	report := &IMDConversionReport{}
 
 	// Determine disk geometry from tracks
 	// Find maximum cylinder and head values
@@ -250,19 +395,23 @@ func ConvertIMDToHFE(img *IMDImage) (*Disk, error) {
 	}
 
 	// Determine bit rate and encoding from first track with sectors
+	// past track 0, which may differ from the rest of the disk
 	bitRate := uint16(250)
 	encoding := uint8(ENC_ISOIBM_MFM)
 	for _, track := range img.Tracks {
-		if track.Nsec > 0 {
-			rate, mfm, err := modeToRateDensity(track.Mode)
-			if err == nil {
-				bitRate = uint16(rate)
-				if mfm {
-					encoding = uint8(ENC_ISOIBM_MFM)
-				} else {
-					encoding = uint8(ENC_ISOIBM_FM)
-				}
+		if track.Nsec == 0 {
+			continue
+		}
+		rate, mfm, err := modeToRateDensity(track.Mode)
+		if err == nil {
+			bitRate = uint16(rate)
+			if mfm {
+				encoding = uint8(ENC_ISOIBM_MFM)
+			} else {
+				encoding = uint8(ENC_ISOIBM_FM)
 			}
+		}
+		if track.Cylinder > 0 {
 			break
 		}
 	}
@@ -283,15 +432,31 @@ func ConvertIMDToHFE(img *IMDImage) (*Disk, error) {
 			WriteProtected:      0xFF,
 			WriteAllowed:        0xFF,
 			SingleStep:          0xFF,
+			Track0S0AltEncoding: 0xFF,
+			Track0S1AltEncoding: 0xFF,
 		},
 		Tracks: make([]TrackData, numTracks),
 	}
 
-	// Initialize all tracks with empty data
-	for i := range disk.Tracks {
-		disk.Tracks[i] = TrackData{
-			Side0: make([]byte, 0),
-			Side1: make([]byte, 0),
+	// Encoding of track 0 may differ from the rest of the disk
+	for _, track := range img.Tracks {
+		if track.Cylinder != 0 || track.Nsec == 0 {
+			continue
+		}
+		_, mfm, err := modeToRateDensity(track.Mode)
+		if err != nil || mfm == (encoding == ENC_ISOIBM_MFM) {
+			continue
+		}
+		trackEncoding := uint8(ENC_ISOIBM_FM)
+		if mfm {
+			trackEncoding = ENC_ISOIBM_MFM
+		}
+		if track.Head&0x0F == 0 {
+			disk.Header.Track0S0AltEncoding = 0
+			disk.Header.Track0S0Encoding = trackEncoding
+		} else {
+			disk.Header.Track0S1AltEncoding = 0
+			disk.Header.Track0S1Encoding = trackEncoding
 		}
 	}
 
@@ -307,31 +472,33 @@ func ConvertIMDToHFE(img *IMDImage) (*Disk, error) {
 		cylinder := int(track.Cylinder)
 		secSize := imdSectorSize(track.Ssize)
 		if secSize == 0 {
-			return nil, fmt.Errorf("invalid sector size encoding: %d for track %d/%d", track.Ssize, track.Cylinder, headNum)
+			return nil, nil, fmt.Errorf("invalid sector size encoding: %d for track %d/%d", track.Ssize, track.Cylinder, headNum)
 		}
 
 		// Get bit rate and encoding for this track
 		rate, _, err := modeToRateDensity(track.Mode)
 		if err != nil {
-			return nil, fmt.Errorf("invalid mode value: %d for track %d/%d: %w", track.Mode, track.Cylinder, headNum, err)
+			return nil, nil, fmt.Errorf("invalid mode value: %d for track %d/%d: %w", track.Mode, track.Cylinder, headNum, err)
 		}
 		trackBitRate := uint16(rate)
 
 		// Validate cylinder and head are within disk bounds
 		if cylinder >= int(numTracks) {
-			return nil, fmt.Errorf("cylinder %d exceeds disk capacity (%d tracks)", cylinder, numTracks)
+			return nil, nil, fmt.Errorf("cylinder %d exceeds disk capacity (%d tracks)", cylinder, numTracks)
 		}
 		if headNum >= numSides {
-			return nil, fmt.Errorf("head %d exceeds disk capacity (%d sides)", headNum, numSides)
+			return nil, nil, fmt.Errorf("head %d exceeds disk capacity (%d sides)", headNum, numSides)
 		}
 
 		// Map IMD sectors from physical order to sequential logical order
 		// IMD stores sectors in physical order with SectorMap[i] containing logical sector number
 		trackSectors := make([][]byte, track.Nsec)
+		deleted := make([]bool, track.Nsec)
+		addrs := make([]mfm.SectorAddr, track.Nsec)
 		for i := byte(0); i < track.Nsec; i++ {
 			// Get logical sector number from SectorMap (typically 1-based)
 			if int(i) >= len(track.SectorMap) {
-				return nil, fmt.Errorf("sector map index %d out of range for track %d/%d", i, track.Cylinder, headNum)
+				return nil, nil, fmt.Errorf("sector map index %d out of range for track %d/%d", i, track.Cylinder, headNum)
 			}
 			logicalSectorNum := track.SectorMap[i]
 
@@ -340,19 +507,45 @@ func ConvertIMDToHFE(img *IMDImage) (*Disk, error) {
 
 			// Validate array index is in range
 			if arrayIndex < 0 || arrayIndex >= int(track.Nsec) {
-				return nil, fmt.Errorf("invalid logical sector number %d (out of range 1-%d) for track %d/%d", logicalSectorNum, track.Nsec, track.Cylinder, headNum)
+				return nil, nil, fmt.Errorf("invalid logical sector number %d (out of range 1-%d) for track %d/%d", logicalSectorNum, track.Nsec, track.Cylinder, headNum)
 			}
 
 			// Get sector data
 			if int(i) >= len(track.Sectors) {
-				return nil, fmt.Errorf("sector index %d out of range for track %d/%d", i, track.Cylinder, headNum)
+				return nil, nil, fmt.Errorf("sector index %d out of range for track %d/%d", i, track.Cylinder, headNum)
 			}
 			sector := track.Sectors[i]
+			deleted[arrayIndex] = sector.Deleted
 
-			// Handle missing data (flag == 0): fill with zeros
-			if sector.Flag == 0 || sector.Data == nil {
-				// Missing sector - fill with zeros
-				trackSectors[arrayIndex] = make([]byte, secSize)
+			// ID field addressing from optional cylinder and head maps
+			addr := mfm.SectorAddr{Cylinder: cylinder, Head: int(headNum)}
+			if int(i) < len(track.CylMap) {
+				addr.Cylinder = int(track.CylMap[i])
+			}
+			if int(i) < len(track.HeadMap) {
+				addr.Head = int(track.HeadMap[i])
+			}
+			addrs[arrayIndex] = addr
+			if addr.Cylinder != cylinder || addr.Head != int(headNum) {
+				report.Remapped = append(report.Remapped, IMDSectorID{
+					IMDSectorAddr: IMDSectorAddr{
+						Cylinder: cylinder,
+						Head:     int(headNum),
+						Sector:   int(logicalSectorNum),
+					},
+					IDCylinder: addr.Cylinder,
+					IDHead:     addr.Head,
+				})
+			}
+
+			// Sector data unavailable: fill with recognizable pattern
+			if sector.Unavailable || sector.Data == nil {
+				trackSectors[arrayIndex] = bytes.Repeat([]byte{imdUnavailableFill}, secSize)
+				report.Unavailable = append(report.Unavailable, IMDSectorAddr{
+					Cylinder: cylinder,
+					Head:     int(headNum),
+					Sector:   int(logicalSectorNum),
+				})
 			} else {
 				// Use sector data (already expanded if compressed)
 				sectorData := make([]byte, secSize)
@@ -374,7 +567,7 @@ func ConvertIMDToHFE(img *IMDImage) (*Disk, error) {
 
 		// Encode track to MFM
 		writer := mfm.NewWriter(maxHalfBits)
-		mfmData := writer.EncodeTrackIBMPC(trackSectors, cylinder, int(headNum), int(track.Nsec), trackBitRate)
+		mfmData := writer.EncodeTrackIBMPCAddr(trackSectors, deleted, addrs, cylinder, int(headNum), int(track.Nsec), trackBitRate)
 
 		// Store in appropriate side
 		if headNum == 0 {
@@ -382,11 +575,14 @@ func ConvertIMDToHFE(img *IMDImage) (*Disk, error) {
 		} else {
 			disk.Tracks[cylinder].Side1 = mfmData
 		}
+		if trackBitRate != bitRate {
+			disk.Tracks[cylinder].BitRate = trackBitRate
+		}
 	}
 
 	_ = img.Comment // Comment is read but not used in conversion yet
 
-	return disk, nil
+	return disk, report, nil
 }
 
 // ReadIMD reads a file in IMD format and returns a Disk structure.
@@ -396,11 +592,25 @@ func ReadIMD(filename string) (*Disk, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ConvertIMDToHFE(img)
+	disk, report, err := ConvertIMDToHFEReport(img)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(report.Unavailable); n > 0 {
+		fmt.Printf("Warning: %s: %d sectors with unavailable data, filled with 0x%02X\n",
+			filename, n, imdUnavailableFill)
+	}
+	if n := len(report.Remapped); n > 0 {
+		fmt.Printf("Warning: %s: %d sectors with cylinder or head in ID field other than physical track\n",
+			filename, n)
+	}
+	return disk, nil
 }
 
-// readIMDTrack reads a single track record from IMD file
-func readIMDTrack(file *os.File) (IMDTrack, error) {
+// readIMDTrack reads a single track record from IMD file.
+// Returns io.EOF at the end of file, and errors wrapping io.ErrUnexpectedEOF
+// when the record is cut off.
+func readIMDTrack(file io.Reader) (IMDTrack, error) {
 	var track IMDTrack
 
 	// Read track header (5 bytes)
@@ -411,7 +621,7 @@ func readIMDTrack(file *os.File) (IMDTrack, error) {
 			return track, io.EOF
 		}
 		if err == io.ErrUnexpectedEOF {
-			return track, fmt.Errorf("incomplete track header: read %d bytes, expected 5", n)
+			return track, fmt.Errorf("incomplete track header: read %d bytes, expected 5: %w", n, err)
 		}
 		return track, fmt.Errorf("failed to read track header: %w", err)
 	}
@@ -422,85 +632,104 @@ func readIMDTrack(file *os.File) (IMDTrack, error) {
 	track.Nsec = header[3]
 	track.Ssize = header[4]
 
+	if err := readIMDTrackData(file, &track); err != nil {
+		return track, fmt.Errorf("cylinder %d, head %d: %w", track.Cylinder, track.Head&0x0F, err)
+	}
+	return track, nil
+}
+
+// Validate header of the track record, and read the rest of it
+func readIMDTrackData(file io.Reader, track *IMDTrack) error {
 	// Validate header fields
 	if track.Mode > 5 {
-		return track, fmt.Errorf("invalid mode value: %d (must be 0-5)", track.Mode)
+		return fmt.Errorf("invalid mode value: %d (must be 0-5)", track.Mode)
 	}
 	// Head value validation - lower 4 bits contain head number (typically 0-1, but allow up to 15)
 	// Upper bits contain flags (0x40 for Head Map, 0x80 for Cylinder Map)
 	if track.Ssize > 6 {
-		return track, fmt.Errorf("invalid sector size value: %d (must be 0-6)", track.Ssize)
+		return fmt.Errorf("invalid sector size value: %d (must be 0-6)", track.Ssize)
+	}
+	if int(track.Cylinder) >= Limits.MaxTracks {
+		return fmt.Errorf("invalid cylinder: %d (limit %d tracks)", track.Cylinder, Limits.MaxTracks)
+	}
+
+	// Sectors must fit on the track at data rate of the mode, as MFM bitcells
+	rate, _, _ := modeToRateDensity(track.Mode)
+	if err := Limits.checkTrackLen(int(track.Nsec)*imdSectorSize(track.Ssize)*2, uint16(rate), 0); err != nil {
+		return err
 	}
 
 	// Handle null track (no sectors)
 	if track.Nsec == 0 {
-		return track, nil
+		return nil
 	}
 
 	// Read Sector Numbering Map
-	if track.Nsec > 0 {
-		track.SectorMap = make([]byte, track.Nsec)
-		if _, err := io.ReadFull(file, track.SectorMap); err != nil {
-			return track, fmt.Errorf("failed to read sector map: %w", err)
-		}
+	track.SectorMap = make([]byte, track.Nsec)
+	if err := readIMDFull(file, track.SectorMap); err != nil {
+		return fmt.Errorf("failed to read sector map: %w", err)
 	}
 
 	// Read Cylinder Map if present
 	if (track.Head & 0x80) != 0 {
 		track.CylMap = make([]byte, track.Nsec)
-		if _, err := io.ReadFull(file, track.CylMap); err != nil {
-			return track, fmt.Errorf("failed to read cylinder map: %w", err)
+		if err := readIMDFull(file, track.CylMap); err != nil {
+			return fmt.Errorf("failed to read cylinder map: %w", err)
 		}
 	}
 
 	// Read Head Map if present
 	if (track.Head & 0x40) != 0 {
 		track.HeadMap = make([]byte, track.Nsec)
-		if _, err := io.ReadFull(file, track.HeadMap); err != nil {
-			return track, fmt.Errorf("failed to read head map: %w", err)
+		if err := readIMDFull(file, track.HeadMap); err != nil {
+			return fmt.Errorf("failed to read head map: %w", err)
 		}
 	}
 
 	// Read sector data blocks
 	secSize := imdSectorSize(track.Ssize)
 	if secSize == 0 {
-		return track, fmt.Errorf("invalid sector size encoding: %d", track.Ssize)
+		return fmt.Errorf("invalid sector size encoding: %d", track.Ssize)
 	}
 	track.Sectors = make([]IMDSector, track.Nsec)
 	for i := byte(0); i < track.Nsec; i++ {
 		sector, err := readIMDSector(file, secSize)
 		if err != nil {
-			return track, fmt.Errorf("failed to read sector %d (logical sector %d): %w", i, track.SectorMap[i], err)
+			return fmt.Errorf("sector %d (logical sector %d): %w", i, track.SectorMap[i], err)
 		}
 		track.Sectors[i] = sector
 	}
+	return nil
+}
 
-	return track, nil
+// Read exactly len(buf) bytes: end of file is unexpected in any part of a record
+func readIMDFull(file io.Reader, buf []byte) error {
+	n, err := io.ReadFull(file, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("cut off after %d of %d bytes: %w", n, len(buf), io.ErrUnexpectedEOF)
+	}
+	return err
 }
 
 // readIMDSector reads a single sector data block from IMD file
-func readIMDSector(file *os.File, secSize int) (IMDSector, error) {
+func readIMDSector(file io.Reader, secSize int) (IMDSector, error) {
 	var sector IMDSector
 
 	// Read flag byte
 	var flag [1]byte
-	n, err := io.ReadFull(file, flag[:])
-	if err != nil {
-		if err == io.EOF {
-			return sector, fmt.Errorf("unexpected EOF reading sector flag")
-		}
+	if err := readIMDFull(file, flag[:]); err != nil {
 		return sector, fmt.Errorf("failed to read sector flag: %w", err)
 	}
-	if n < 1 {
-		return sector, fmt.Errorf("incomplete sector flag: read %d bytes", n)
-	}
-
 	sector.Flag = flag[0]
 
 	// No data available
 	if sector.Flag == 0 {
+		sector.Unavailable = true
 		return sector, nil
 	}
+	if sector.Flag > imdMaxFlag {
+		return sector, fmt.Errorf("invalid sector flag: 0x%02x", sector.Flag)
+	}
 
 	// Decode flags
 	sector.Compressed, sector.Deleted, sector.Bad = decodeFlag(sector.Flag)
@@ -509,10 +738,7 @@ func readIMDSector(file *os.File, secSize int) (IMDSector, error) {
 	if sector.Compressed {
 		// Compressed: single byte value
 		var value [1]byte
-		if _, err := io.ReadFull(file, value[:]); err != nil {
-			if err == io.EOF {
-				return sector, fmt.Errorf("unexpected EOF reading compressed sector value")
-			}
+		if err := readIMDFull(file, value[:]); err != nil {
 			return sector, fmt.Errorf("failed to read compressed sector value: %w", err)
 		}
 		// Expand to full sector size
@@ -523,10 +749,7 @@ func readIMDSector(file *os.File, secSize int) (IMDSector, error) {
 	} else {
 		// Uncompressed: full sector data
 		sector.Data = make([]byte, secSize)
-		if _, err := io.ReadFull(file, sector.Data); err != nil {
-			if err == io.EOF {
-				return sector, fmt.Errorf("unexpected EOF reading sector data (expected %d bytes)", secSize)
-			}
+		if err := readIMDFull(file, sector.Data); err != nil {
 			return sector, fmt.Errorf("failed to read sector data: %w", err)
 		}
 	}
@@ -534,13 +757,38 @@ func readIMDSector(file *os.File, secSize int) (IMDSector, error) {
 	return sector, nil
 }
 
+// IMDOptions control writing of IMD images
+type IMDOptions struct {
+	// Context to cancel writing, or nil. The file is not created
+	// when writing is cancelled.
+	Context context.Context
+
+	// Called after each track side is written, with number of sides
+	// done and total, and number of good sectors written so far, or nil
+	Progress func(done, total, sectors int)
+
+	// Encoding of given cylinders, like ENC_ISOIBM_FM, overriding
+	// the header and encoding detected from track data, or nil
+	TrackEncoding map[int]uint8
+}
+
 // WriteIMD writes a Disk structure to an IMD format file.
 func WriteIMD(filename string, disk *Disk) error {
-	file, err := os.Create(filename)
+	return WriteIMDOptions(filename, disk, IMDOptions{})
+}
+
+// WriteIMDOptions writes a Disk structure to an IMD format file, with the
+// given options. Tracks are decoded in parallel, and written in order.
+func WriteIMDOptions(filename string, disk *Disk, opts IMDOptions) error {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	file, err := createAtomic(filename)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return err
 	}
-	defer file.Close()
+	defer file.Abort()
 
 	// Write comment block
 	now := time.Now()
@@ -569,86 +817,110 @@ func WriteIMD(filename string, disk *Disk) error {
 		numSides = 1
 	}
 
-	for cyl := 0; cyl < numCylinders; cyl++ {
-		for head := 0; head < numSides; head++ {
-			// Get track data for this cylinder/head
-			var trackData []byte
-			if head == 0 && cyl < len(disk.Tracks) {
-				trackData = disk.Tracks[cyl].Side0
-			} else if head == 1 && cyl < len(disk.Tracks) {
-				trackData = disk.Tracks[cyl].Side1
-			}
-
-			// Determine mode from disk header
-			mode, err := rateDensityToMode(int(disk.Header.BitRate), disk.Header.TrackEncoding == ENC_ISOIBM_MFM)
-			if err != nil {
-				// Default to MFM 500 kbps
-				mode = 3
-			}
-
-			// If track has no data, write null track
-			if len(trackData) == 0 {
-				header := []byte{
-					mode,
-					byte(cyl),
-					byte(head),
-					0, // Nsec = 0 (null track)
-					2, // Ssize = 2 (512 bytes, default)
-				}
-				if _, err := file.Write(header); err != nil {
-					return fmt.Errorf("failed to write track %d/%d header: %w", cyl, head, err)
-				}
-				continue
-			}
+	total := numCylinders * numSides
+	good := 0
+	err = disk.decodeSides(ctx, numCylinders, numSides, func(cyl, head int, decoded *DecodedTrack) error {
+		mode := disk.imdTrackMode(cyl, head, opts.TrackEncoding)
+		n, err := writeIMDSide(file.File, mode, cyl, head, decoded)
+		if err != nil {
+			return err
+		}
+		good += n
+		if opts.Progress != nil {
+			opts.Progress(cyl*numSides+head+1, total, good)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return file.Commit()
+}
 
-			// Extract sectors from MFM bitstream
-			reader := mfm.NewReader(trackData)
-			sectors := make(map[int][]byte)
-			sectorNumbers := make([]int, 0)
+// Write one side of the disk as IMD track with the given mode, from the sectors decoded.
+// Returns number of good sectors written.
+func writeIMDSide(file *os.File, mode byte, cyl, head int, decoded *DecodedTrack) (int, error) {
+	// Extract sectors from MFM bitstream, with addresses from their ID fields
+	sectors := make(map[int]IMDSector)
+	addrs := make(map[int]mfm.SectorAddr)
+	sectorNumbers := make([]int, 0)
+	ssize := byte(2)
 
-			// Read all sectors from track
-			for {
-				sectorNum, sectorData, err := reader.ReadSectorIBMPC(cyl, head)
-				if err != nil {
-					break // End of track or error
-				}
-				if sectorNum < 0 {
-					continue // Invalid sector number
-				}
-				// Store sector (overwrite if duplicate)
-				if _, exists := sectors[sectorNum]; !exists {
-					sectorNumbers = append(sectorNumbers, sectorNum)
-				}
-				sectors[sectorNum] = sectorData
-			}
+	// Read all sectors from track
+	for _, sector := range decoded.Sectors {
+		if sector.Sector < 1 {
+			continue // Invalid sector number
+		}
+		if len(sectorNumbers) == 0 {
+			// IMD track has one sector size for all sectors
+			ssize = byte(sector.Size)
+		} else if sector.Size != int(ssize) {
+			continue
+		}
+		// Of several instances with the same ID,
+		// store the first good one, or the first one when all are bad
+		sectorNum := sector.Sector - 1
+		old, exists := sectors[sectorNum]
+		if !exists {
+			sectorNumbers = append(sectorNumbers, sectorNum)
+		} else if !old.Bad || sector.Bad {
+			continue
+		}
+		sectors[sectorNum] = IMDSector{
+			Data:    sector.Data,
+			Deleted: sector.Deleted,
+			Bad:     sector.Bad,
+		}
+		addrs[sectorNum] = mfm.SectorAddr{Cylinder: sector.Cylinder, Head: sector.Head}
+	}
 
-			// If no sectors found, write null track
-			if len(sectors) == 0 {
-				header := []byte{
-					mode,
-					byte(cyl),
-					byte(head),
-					0, // Nsec = 0 (null track)
-					2, // Ssize = 2 (512 bytes, default)
-				}
-				if _, err := file.Write(header); err != nil {
-					return fmt.Errorf("failed to write track %d/%d header: %w", cyl, head, err)
-				}
-				continue
+	// Sectors missing between found ones could not be read
+	maxSector := 0
+	for _, sectorNum := range sectorNumbers {
+		maxSector = max(maxSector, sectorNum)
+	}
+	if len(sectors) > 0 {
+		for sectorNum := 0; sectorNum < maxSector; sectorNum++ {
+			if _, exists := sectors[sectorNum]; !exists {
+				sectors[sectorNum] = IMDSector{Unavailable: true}
+				addrs[sectorNum] = mfm.SectorAddr{Cylinder: cyl, Head: head}
+				sectorNumbers = append(sectorNumbers, sectorNum)
 			}
+		}
+	}
 
-			// Write track with sectors
-			if err := writeIMDTrack(file, mode, byte(cyl), byte(head), sectors, sectorNumbers); err != nil {
-				return fmt.Errorf("failed to write track %d/%d: %w", cyl, head, err)
-			}
+	// If no sectors found, or track has no data, write null track
+	if len(sectors) == 0 {
+		header := []byte{
+			mode,
+			byte(cyl),
+			byte(head),
+			0, // Nsec = 0 (null track)
+			2, // Ssize = 2 (512 bytes, default)
 		}
+		if _, err := file.Write(header); err != nil {
+			return 0, fmt.Errorf("failed to write track %d/%d header: %w", cyl, head, err)
+		}
+		return 0, nil
 	}
 
-	return nil
+	// Write track with sectors
+	if err := writeIMDTrack(file, mode, byte(cyl), byte(head), ssize, sectors, addrs, sectorNumbers); err != nil {
+		return 0, fmt.Errorf("failed to write track %d/%d: %w", cyl, head, err)
+	}
+	good := 0
+	for _, sector := range sectors {
+		if !sector.Bad && !sector.Unavailable {
+			good++
+		}
+	}
+	return good, nil
 }
 
-// writeIMDTrack writes a complete track record to IMD file
-func writeIMDTrack(file *os.File, mode, cylinder, head byte, sectors map[int][]byte, sectorNumbers []int) error {
+// writeIMDTrack writes a complete track record to IMD file.
+// Cylinder and head maps are written when ID fields of sectors,
+// given by addrs, differ from the physical track.
+func writeIMDTrack(file *os.File, mode, cylinder, head, ssize byte, sectors map[int]IMDSector, addrs map[int]mfm.SectorAddr, sectorNumbers []int) error {
 	if len(sectors) == 0 {
 		return fmt.Errorf("cannot write track with no sectors")
 	}
@@ -657,14 +929,11 @@ func writeIMDTrack(file *os.File, mode, cylinder, head byte, sectors map[int][]b
 	}
 	nsec := byte(len(sectors))
 
-	// Sector size is 512 bytes (encoded as 2)
-	ssize := byte(2)
-
 	// Build sector numbering map
 	sectorMap := make([]byte, nsec)
 	headFlags := head & 0x0F // Physical head number
 
-	// Check if we need cylinder or head maps
+	// Cylinder or head maps are needed when ID fields differ from the track
 	needCylMap := false
 	needHeadMap := false
 	cylMap := make([]byte, nsec)
@@ -685,15 +954,19 @@ func writeIMDTrack(file *os.File, mode, cylinder, head byte, sectors map[int][]b
 		if i >= int(nsec) {
 			break
 		}
-		// IMD sector numbers are typically 1-based in the map
-		// But we'll use the actual sector number from the disk
-		sectorMap[i] = byte(sectorNum)
+		// IMD sector numbers are 1-based in the map
+		sectorMap[i] = byte(sectorNum + 1)
 		cylMap[i] = cylinder
 		headMap[i] = headFlags
+		if addr, ok := addrs[sectorNum]; ok {
+			cylMap[i] = byte(addr.Cylinder)
+			headMap[i] = byte(addr.Head)
+		}
+		needCylMap = needCylMap || cylMap[i] != cylinder
+		needHeadMap = needHeadMap || headMap[i] != headFlags
 	}
 
-	// Set flags if maps are needed (for now, assume uniform)
-	// In practice, these would be set if cylinder/head values vary
+	// Set flags of the maps present in the record
 	if needCylMap {
 		headFlags |= 0x80
 	}
@@ -738,10 +1011,18 @@ func writeIMDTrack(file *os.File, mode, cylinder, head byte, sectors map[int][]b
 		return fmt.Errorf("invalid sector size: %d", ssize)
 	}
 	for _, sectorNum := range sectorNumbers {
-		sectorData, exists := sectors[sectorNum]
+		sector, exists := sectors[sectorNum]
 		if !exists {
 			return fmt.Errorf("sector %d not found in sectors map", sectorNum)
 		}
+		if sector.Unavailable {
+			// Flag only, no data
+			if _, err := file.Write([]byte{0}); err != nil {
+				return fmt.Errorf("failed to write sector %d flag: %w", sectorNum, err)
+			}
+			continue
+		}
+		sectorData := sector.Data
 		if len(sectorData) != secSize && len(sectorData) > 0 {
 			// Sector size mismatch - this is a warning but we'll pad/truncate
 			if len(sectorData) < secSize {
@@ -754,7 +1035,7 @@ func writeIMDTrack(file *os.File, mode, cylinder, head byte, sectors map[int][]b
 				sectorData = sectorData[:secSize]
 			}
 		}
-		if err := writeIMDSector(file, sectorData, secSize); err != nil {
+		if err := writeIMDSector(file, sectorData, secSize, sector.Deleted, sector.Bad); err != nil {
 			return fmt.Errorf("failed to write sector %d: %w", sectorNum, err)
 		}
 	}
@@ -763,14 +1044,14 @@ func writeIMDTrack(file *os.File, mode, cylinder, head byte, sectors map[int][]b
 }
 
 // writeIMDSector writes a single sector data block to IMD file
-func writeIMDSector(file *os.File, data []byte, secSize int) error {
+func writeIMDSector(file *os.File, data []byte, secSize int, deleted, bad bool) error {
 	// Check if sector can be compressed
 	compressed := isCompressible(data)
 	var flag byte
 
 	if compressed {
 		// Compressed sector
-		flag = calculateFlag(true, false, false)
+		flag = calculateFlag(true, deleted, bad)
 		if _, err := file.Write([]byte{flag}); err != nil {
 			return fmt.Errorf("failed to write sector flag: %w", err)
 		}
@@ -780,7 +1061,7 @@ func writeIMDSector(file *os.File, data []byte, secSize int) error {
 		}
 	} else {
 		// Uncompressed sector
-		flag = calculateFlag(false, false, false)
+		flag = calculateFlag(false, deleted, bad)
 		if _, err := file.Write([]byte{flag}); err != nil {
 			return fmt.Errorf("failed to write sector flag: %w", err)
 		}
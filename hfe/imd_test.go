@@ -1,7 +1,13 @@
 package hfe
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -551,3 +557,713 @@ func TestConvertIMDToHFE(t *testing.T) {
 		}
 	}
 }
+
+func TestIMDFlag(t *testing.T) {
+	for flag := byte(1); flag <= 8; flag++ {
+		compressed, deleted, bad := decodeFlag(flag)
+		if calculateFlag(compressed, deleted, bad) != flag {
+			t.Errorf("flag %d: decoded as %v/%v/%v, encoded back as %d",
+				flag, compressed, deleted, bad, calculateFlag(compressed, deleted, bad))
+		}
+	}
+}
+
+// Build IMD file with one track of two 512-byte sectors:
+// sector 1 with the given flag, and normal sector 2.
+func makeIMDFlagFile(t *testing.T, flag byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString("IMD 1.18: test\r\n")
+	buf.WriteByte(imdCommentTerminator)
+	buf.Write([]byte{5, 0, 0, 2, 2}) // 250 kbps MFM, cylinder 0, head 0, 2 sectors, 512 bytes
+	buf.Write([]byte{1, 2})          // Sector map
+	buf.WriteByte(flag)
+	compressed, _, _ := decodeFlag(flag)
+	switch {
+	case flag == 0 || flag > imdMaxFlag:
+	case compressed:
+		buf.WriteByte(0x55)
+	default:
+		buf.Write(bytes.Repeat([]byte{0x55}, 512))
+	}
+	buf.WriteByte(1)
+	buf.Write(bytes.Repeat([]byte{0xAA}, 512))
+
+	filename := filepath.Join(t.TempDir(), "flag.imd")
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	return filename
+}
+
+func TestReadIMDSectorFlags(t *testing.T) {
+	tests := []struct {
+		flag                                  byte
+		unavailable, compressed, deleted, bad bool
+	}{
+		{0x00, true, false, false, false},
+		{0x01, false, false, false, false},
+		{0x02, false, true, false, false},
+		{0x03, false, false, true, false},
+		{0x04, false, true, true, false},
+		{0x05, false, false, false, true},
+		{0x06, false, true, false, true},
+		{0x07, false, false, true, true},
+		{0x08, false, true, true, true},
+	}
+	for _, tc := range tests {
+		img, err := ReadIMDFile(makeIMDFlagFile(t, tc.flag))
+		if err != nil {
+			t.Fatalf("flag %d: ReadIMDFile() error: %v", tc.flag, err)
+		}
+		sector := img.Tracks[0].Sectors[0]
+		if sector.Unavailable != tc.unavailable || sector.Compressed != tc.compressed ||
+			sector.Deleted != tc.deleted || sector.Bad != tc.bad {
+			t.Errorf("flag %d: decoded as %+v", tc.flag, sector)
+		}
+		if tc.unavailable != (sector.Data == nil) {
+			t.Errorf("flag %d: data %d bytes", tc.flag, len(sector.Data))
+		}
+		if !tc.unavailable && !bytes.Equal(sector.Data, bytes.Repeat([]byte{0x55}, 512)) {
+			t.Errorf("flag %d: wrong sector data", tc.flag)
+		}
+		if img.Tracks[0].Sectors[1].Flag != 1 {
+			t.Errorf("flag %d: next sector misaligned", tc.flag)
+		}
+	}
+
+	if _, err := ReadIMDFile(makeIMDFlagFile(t, 0x09)); err == nil {
+		t.Errorf("expected error for flag 9")
+	}
+}
+
+func TestConvertIMDUnavailable(t *testing.T) {
+	img, err := ReadIMDFile(makeIMDFlagFile(t, 0))
+	if err != nil {
+		t.Fatalf("ReadIMDFile() error: %v", err)
+	}
+	disk, report, err := ConvertIMDToHFEReport(img)
+	if err != nil {
+		t.Fatalf("ConvertIMDToHFEReport() error: %v", err)
+	}
+	want := []IMDSectorAddr{{Cylinder: 0, Head: 0, Sector: 1}}
+	if fmt.Sprint(report.Unavailable) != fmt.Sprint(want) {
+		t.Errorf("report %v, expected %v", report.Unavailable, want)
+	}
+
+	// Unavailable sector is filled with 0xF6
+	reader := mfm.NewReader(disk.Tracks[0].Side0)
+	for i := 0; i < 2; i++ {
+		sector, err := reader.ReadSectorInfoIBMPC(0, 0)
+		if err != nil {
+			t.Fatalf("ReadSectorInfoIBMPC() error: %v", err)
+		}
+		fill := byte(0xAA)
+		if sector.Sector == 1 {
+			fill = imdUnavailableFill
+		}
+		if !bytes.Equal(sector.Data, bytes.Repeat([]byte{fill}, 512)) {
+			t.Errorf("sector %d: wrong data % x...", sector.Sector, sector.Data[:4])
+		}
+	}
+}
+
+func TestIMDDeletedRoundTrip(t *testing.T) {
+	// Sector 1 has deleted data, compressed and not
+	for _, flag := range []byte{0x03, 0x04} {
+		img, err := ReadIMDFile(makeIMDFlagFile(t, flag))
+		if err != nil {
+			t.Fatalf("flag %d: ReadIMDFile() error: %v", flag, err)
+		}
+		disk, err := ConvertIMDToHFE(img)
+		if err != nil {
+			t.Fatalf("flag %d: ConvertIMDToHFE() error: %v", flag, err)
+		}
+
+		filename := filepath.Join(t.TempDir(), "deleted.imd")
+		if err := WriteIMD(filename, disk); err != nil {
+			t.Fatalf("flag %d: WriteIMD() error: %v", flag, err)
+		}
+		img, err = ReadIMDFile(filename)
+		if err != nil {
+			t.Fatalf("flag %d: ReadIMDFile() error: %v", flag, err)
+		}
+		track := img.Tracks[0]
+		if track.Nsec != 2 {
+			t.Fatalf("flag %d: track has %d sectors, expected 2", flag, track.Nsec)
+		}
+		for i, sector := range track.Sectors {
+			num := track.SectorMap[i]
+			fill := byte(0xAA)
+			if num == 1 {
+				fill = 0x55
+			}
+			if sector.Deleted != (num == 1) || sector.Bad {
+				t.Errorf("flag %d: sector %d has flag %d", flag, num, sector.Flag)
+			}
+			if !bytes.Equal(sector.Data, bytes.Repeat([]byte{fill}, 512)) {
+				t.Errorf("flag %d: sector %d has wrong data", flag, num)
+			}
+		}
+	}
+}
+
+func TestWriteIMDMissingSector(t *testing.T) {
+	// Sector 2 of 9 is missing on the track
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = bytes.Repeat([]byte{byte(i)}, 512)
+	}
+	full := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+
+	// Take cylinder of sector 2 ID from a track of another cylinder,
+	// but not the CRC: the ID field is damaged.
+	// IDs differ, and contents of sectors are the same.
+	other := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 1, 0, 9, 250)
+	damaged := make([]byte, len(full))
+	copy(damaged, full)
+	id, last := 0, -1000
+	for i := range full {
+		if full[i] == other[i] {
+			continue
+		}
+		if i-last > 100 {
+			id++
+			if id == 2 {
+				damaged[i] = other[i]
+			}
+		}
+		last = i
+	}
+	disk := &Disk{
+		Header: Header{NumberOfTrack: 1, NumberOfSide: 1, BitRate: 250, FloppyRPM: 300, TrackEncoding: ENC_ISOIBM_MFM},
+		Tracks: []TrackData{{Side0: damaged}},
+	}
+
+	filename := filepath.Join(t.TempDir(), "missing.imd")
+	if err := WriteIMD(filename, disk); err != nil {
+		t.Fatalf("WriteIMD() error: %v", err)
+	}
+	img, err := ReadIMDFile(filename)
+	if err != nil {
+		t.Fatalf("ReadIMDFile() error: %v", err)
+	}
+	track := img.Tracks[0]
+	if track.Nsec != 9 {
+		t.Fatalf("track has %d sectors, expected 9", track.Nsec)
+	}
+	for i, sector := range track.Sectors {
+		if sector.Unavailable != (track.SectorMap[i] == 2) {
+			t.Errorf("sector %d: flag %d", track.SectorMap[i], sector.Flag)
+		}
+	}
+}
+
+// Encode IBM PC track with 9 sectors, every sector filled with its number
+func makeIMDTestTrack(cyl, head int, bitRate uint16, first byte) []byte {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		for j := range sectors[i] {
+			sectors[i][j] = byte(i)
+		}
+	}
+	sectors[0][0] = first
+	return mfm.NewWriter(int(bitRate)*1000*60/300*2).EncodeTrackIBMPC(sectors, cyl, head, 9, bitRate)
+}
+
+func TestWriteIMDTrackModes(t *testing.T) {
+	disk := &Disk{
+		Header: Header{
+			NumberOfTrack:       2,
+			NumberOfSide:        1,
+			TrackEncoding:       ENC_ISOIBM_MFM,
+			BitRate:             250,
+			FloppyRPM:           300,
+			Track0S0AltEncoding: 0,
+			Track0S0Encoding:    ENC_ISOIBM_FM,
+			Track0S1AltEncoding: 0xFF,
+		},
+		Tracks: make([]TrackData, 2),
+	}
+	disk.Tracks[0].Side0 = makeIMDTestTrack(0, 0, 250, 0)
+
+	// Track 1 is read at 300 kbps, and has bad CRC in sector 1:
+	// take data from a track with different contents, but keep the CRC
+	good := makeIMDTestTrack(1, 0, 300, 0)
+	other := makeIMDTestTrack(1, 0, 300, 0x80)
+	for i := range good {
+		if good[i] != other[i] {
+			copy(good[i:i+4], other[i:i+4])
+			break
+		}
+	}
+	disk.Tracks[1].Side0 = good
+	disk.Tracks[1].BitRate = 301
+
+	filename := t.TempDir() + "/modes.imd"
+	if err := WriteIMD(filename, disk); err != nil {
+		t.Fatalf("WriteIMD() error: %v", err)
+	}
+	img, err := ReadIMDFile(filename)
+	if err != nil {
+		t.Fatalf("ReadIMDFile() error: %v", err)
+	}
+	if len(img.Tracks) != 2 {
+		t.Fatalf("got %d tracks, expected 2", len(img.Tracks))
+	}
+
+	// FM 250 kbps, then MFM 300 kbps
+	if img.Tracks[0].Mode != 2 || img.Tracks[1].Mode != 4 {
+		t.Errorf("track modes %d and %d, expected 2 and 4", img.Tracks[0].Mode, img.Tracks[1].Mode)
+	}
+
+	for i, sector := range img.Tracks[1].Sectors {
+		expectBad := img.Tracks[1].SectorMap[i] == 1
+		if sector.Bad != expectBad || sector.Deleted {
+			t.Errorf("sector %d: bad=%v deleted=%v", img.Tracks[1].SectorMap[i], sector.Bad, sector.Deleted)
+		}
+	}
+	if len(img.Tracks[0].Sectors) != 9 || !img.Tracks[0].Sectors[1].Compressed {
+		t.Errorf("expected 9 compressed sectors on track 0")
+	}
+
+	// Bit rate of track 1 differs from the rest of the disk
+	result, err := ConvertIMDToHFE(img)
+	if err != nil {
+		t.Fatalf("ConvertIMDToHFE() error: %v", err)
+	}
+	if result.TrackBitRate(0) != 250 || result.TrackBitRate(1) != 300 {
+		t.Errorf("bit rates %d and %d, expected 250 and 300", result.TrackBitRate(0), result.TrackBitRate(1))
+	}
+}
+
+// DD disk read in a 360 RPM drive has 300 kbps data rate,
+// and tracks as long as at 250 kbps and 300 RPM
+func TestConvertIMD300kbps(t *testing.T) {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = bytes.Repeat([]byte{byte(i)}, 512)
+	}
+	const revolutionBits = 300 * 1000 * 60 / 360 * 2
+	disk := &Disk{
+		Header: Header{NumberOfTrack: 1, NumberOfSide: 1, BitRate: 300, FloppyRPM: 360, TrackEncoding: ENC_ISOIBM_MFM},
+		Tracks: []TrackData{{Side0: mfm.NewWriter(revolutionBits).EncodeTrackIBMPC(sectors, 0, 0, 9, 300)}},
+	}
+	filename := filepath.Join(t.TempDir(), "dd360.imd")
+	if err := WriteIMD(filename, disk); err != nil {
+		t.Fatalf("WriteIMD() error: %v", err)
+	}
+
+	img, err := ReadIMDFile(filename)
+	if err != nil {
+		t.Fatalf("ReadIMDFile() error: %v", err)
+	}
+	if img.Tracks[0].Mode != 4 {
+		t.Errorf("track mode %d, expected 4", img.Tracks[0].Mode)
+	}
+	result, err := ConvertIMDToHFE(img)
+	if err != nil {
+		t.Fatalf("ConvertIMDToHFE() error: %v", err)
+	}
+	if result.Header.BitRate != 300 || result.Header.FloppyRPM != 360 {
+		t.Errorf("header has %d kbps, %d RPM, expected 300 kbps, 360 RPM",
+			result.Header.BitRate, result.Header.FloppyRPM)
+	}
+	track := result.Tracks[0].Side0
+	if len(track)*8 > revolutionBits {
+		t.Errorf("track has %d bits, more than %d in one revolution", len(track)*8, revolutionBits)
+	}
+	if n := mfm.NewReader(track).CountSectorsIBMPC(); n != 9 {
+		t.Errorf("decoded %d sectors, expected 9", n)
+	}
+}
+
+// Encoding of every cylinder survives conversion of IMD to HFE and back:
+// FM on the whole disk, or only on track 0 like on CP/M disks
+func TestIMDFMRoundTrip(t *testing.T) {
+	makeImage := func(modes []byte) *IMDImage {
+		img := &IMDImage{FloppyRPM: 300}
+		for cyl, mode := range modes {
+			for head := byte(0); head < 2; head++ {
+				track := IMDTrack{Mode: mode, Cylinder: byte(cyl), Head: head, Nsec: 4, Ssize: 2, SectorMap: []byte{1, 2, 3, 4}}
+				for i := byte(0); i < 4; i++ {
+					fill := byte(cyl)<<4 | head<<2 | i
+					track.Sectors = append(track.Sectors, IMDSector{Flag: 1, Data: bytes.Repeat([]byte{fill}, 512)})
+				}
+				img.Tracks = append(img.Tracks, track)
+			}
+		}
+		return img
+	}
+	tests := []struct {
+		name  string
+		modes []byte // Mode of each cylinder
+	}{
+		{"FM 250 kbps", []byte{2, 2, 2}},
+		{"FM 500 kbps", []byte{0, 0}},
+		{"FM track 0", []byte{2, 5, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disk, err := ConvertIMDToHFE(makeImage(tt.modes))
+			if err != nil {
+				t.Fatalf("ConvertIMDToHFE() error: %v", err)
+			}
+			filename := filepath.Join(t.TempDir(), "fm.imd")
+			if err := WriteIMD(filename, disk); err != nil {
+				t.Fatalf("WriteIMD() error: %v", err)
+			}
+			img, err := ReadIMDFile(filename)
+			if err != nil {
+				t.Fatalf("ReadIMDFile() error: %v", err)
+			}
+			if len(img.Tracks) != 2*len(tt.modes) {
+				t.Fatalf("got %d tracks, expected %d", len(img.Tracks), 2*len(tt.modes))
+			}
+			for _, track := range img.Tracks {
+				want := tt.modes[track.Cylinder]
+				if track.Mode != want || track.Nsec != 4 {
+					t.Errorf("track %d.%d: mode %d with %d sectors, expected mode %d with 4",
+						track.Cylinder, track.Head, track.Mode, track.Nsec, want)
+				}
+			}
+		})
+	}
+}
+
+// Tracks with FM address marks are written as FM,
+// unless encoding of the cylinder is given
+func TestIMDTrackModeFM(t *testing.T) {
+	// FM gap bytes 0xFF, ID address mark, and more gap
+	fmTrack := bytes.Repeat([]byte{0xAA}, 100)
+	fmTrack = append(fmTrack, 0xAA, 0x22, 0x2A, 0xA8)
+	fmTrack = append(fmTrack, bytes.Repeat([]byte{0xAA}, 100)...)
+
+	disk := &Disk{
+		Header: Header{
+			NumberOfTrack:       2,
+			NumberOfSide:        2,
+			TrackEncoding:       ENC_ISOIBM_MFM,
+			BitRate:             250,
+			FloppyRPM:           300,
+			Track0S0AltEncoding: 0xFF,
+			Track0S1AltEncoding: 0xFF,
+		},
+		Tracks: []TrackData{
+			{Side0: fmTrack, Side1: makeIMDTestTrack(0, 1, 250, 0)},
+			{Side0: makeIMDTestTrack(1, 0, 250, 0), Side1: fmTrack},
+		},
+	}
+	tests := []struct {
+		cyl, head int
+		encodings map[int]uint8
+		want      byte
+	}{
+		{0, 0, nil, 2},
+		{0, 1, nil, 5},
+		{1, 0, nil, 5},
+		{1, 1, nil, 2},
+		{0, 0, map[int]uint8{0: ENC_ISOIBM_MFM}, 5},
+		{1, 0, map[int]uint8{1: ENC_ISOIBM_FM}, 2},
+	}
+	for _, tt := range tests {
+		if mode := disk.imdTrackMode(tt.cyl, tt.head, tt.encodings); mode != tt.want {
+			t.Errorf("track %d.%d with encodings %v: mode %d, expected %d", tt.cyl, tt.head, tt.encodings, mode, tt.want)
+		}
+	}
+}
+
+func TestConvertIMDCylHeadMaps(t *testing.T) {
+	// Physical track 1.0 with cylinder offset and swapped head in ID fields;
+	// sector 3 keeps the physical address
+	sectors := make([]IMDSector, 3)
+	for i := range sectors {
+		sectors[i] = IMDSector{Flag: 1, Data: bytes.Repeat([]byte{byte(0x10 + i)}, 512)}
+	}
+	img := &IMDImage{
+		FloppyRPM: 300,
+		Tracks: []IMDTrack{{
+			Mode:      5,
+			Cylinder:  1,
+			Head:      0xC0,
+			Nsec:      3,
+			Ssize:     2,
+			SectorMap: []byte{2, 3, 1},
+			CylMap:    []byte{2, 1, 2},
+			HeadMap:   []byte{1, 0, 1},
+			Sectors:   sectors,
+		}},
+	}
+	disk, report, err := ConvertIMDToHFEReport(img)
+	if err != nil {
+		t.Fatalf("ConvertIMDToHFEReport() error: %v", err)
+	}
+
+	// Sectors 1 and 2 are addressed as 2.1
+	want := []IMDSectorID{
+		{IMDSectorAddr{Cylinder: 1, Head: 0, Sector: 2}, 2, 1},
+		{IMDSectorAddr{Cylinder: 1, Head: 0, Sector: 1}, 2, 1},
+	}
+	if fmt.Sprint(report.Remapped) != fmt.Sprint(want) {
+		t.Errorf("report %v, expected %v", report.Remapped, want)
+	}
+
+	reader := mfm.NewReader(disk.Tracks[1].Side0)
+	reader.Tolerance = mfm.IDIgnoreCylHead
+	found := 0
+	for {
+		sector, err := reader.ReadSectorInfoIBMPC(1, 0)
+		if err != nil {
+			break
+		}
+		found++
+		wantCyl, wantHead, fill := 2, 1, byte(0x10)
+		switch sector.Sector {
+		case 2:
+		case 3:
+			wantCyl, wantHead, fill = 1, 0, 0x11
+		case 1:
+			fill = 0x12
+		}
+		if sector.Cylinder != wantCyl || sector.Head != wantHead {
+			t.Errorf("sector %d: ID %d.%d, expected %d.%d", sector.Sector, sector.Cylinder, sector.Head, wantCyl, wantHead)
+		}
+		if sector.Bad || !bytes.Equal(sector.Data, bytes.Repeat([]byte{fill}, 512)) {
+			t.Errorf("sector %d: wrong data % x...", sector.Sector, sector.Data[:4])
+		}
+	}
+	if found != 3 {
+		t.Errorf("found %d sectors, expected 3", found)
+	}
+}
+
+// IMD image with addressing which differs between tracks and sectors
+// is written back with the same cylinder and head maps, and to IMG
+// by physical position of sectors
+func TestIMDCylHeadMapsRoundTrip(t *testing.T) {
+	makeTrack := func(cyl, head byte, cylMap, headMap []byte) IMDTrack {
+		track := IMDTrack{Mode: 5, Cylinder: cyl, Head: head, Nsec: 3, Ssize: 2, SectorMap: []byte{1, 2, 3}}
+		for i := byte(0); i < 3; i++ {
+			fill := cyl<<4 | head<<2 | i
+			track.Sectors = append(track.Sectors, IMDSector{Flag: 1, Data: bytes.Repeat([]byte{fill}, 512)})
+		}
+		if cylMap != nil {
+			track.Head |= 0x80
+			track.CylMap = cylMap
+		}
+		if headMap != nil {
+			track.Head |= 0x40
+			track.HeadMap = headMap
+		}
+		return track
+	}
+	img := &IMDImage{
+		FloppyRPM: 300,
+		Tracks: []IMDTrack{
+			makeTrack(0, 0, nil, nil),
+			makeTrack(0, 1, nil, []byte{0, 0, 0}),             // Head 0 in IDs of side 1
+			makeTrack(1, 0, []byte{2, 1, 2}, []byte{1, 0, 1}), // Mixed addressing
+			makeTrack(1, 1, nil, nil),
+		},
+	}
+	disk, err := ConvertIMDToHFE(img)
+	if err != nil {
+		t.Fatalf("ConvertIMDToHFE() error: %v", err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "maps.imd")
+	if err := WriteIMD(filename, disk); err != nil {
+		t.Fatalf("WriteIMD() error: %v", err)
+	}
+	result, err := ReadIMDFile(filename)
+	if err != nil {
+		t.Fatalf("ReadIMDFile() error: %v", err)
+	}
+	if len(result.Tracks) != len(img.Tracks) {
+		t.Fatalf("got %d tracks, expected %d", len(result.Tracks), len(img.Tracks))
+	}
+	for i, want := range img.Tracks {
+		got := result.Tracks[i]
+		if got.Cylinder != want.Cylinder || got.Head != want.Head || got.Nsec != want.Nsec {
+			t.Errorf("track %d: %d.%#x with %d sectors, expected %d.%#x with %d",
+				i, got.Cylinder, got.Head, got.Nsec, want.Cylinder, want.Head, want.Nsec)
+			continue
+		}
+		if !bytes.Equal(got.CylMap, want.CylMap) || !bytes.Equal(got.HeadMap, want.HeadMap) {
+			t.Errorf("track %d: maps %v %v, expected %v %v", i, got.CylMap, got.HeadMap, want.CylMap, want.HeadMap)
+		}
+		for j, sector := range got.Sectors {
+			if !bytes.Equal(sector.Data, want.Sectors[got.SectorMap[j]-1].Data) {
+				t.Errorf("track %d, sector %d: wrong data % x...", i, got.SectorMap[j], sector.Data[:4])
+			}
+		}
+	}
+
+	// IMG keeps sectors in place of their physical tracks
+	imgFile := filepath.Join(t.TempDir(), "maps.img")
+	report, err := WriteIMGOptions(imgFile, disk, IMGOptions{SectorsPerTrack: 3, Strict: true})
+	if err != nil {
+		t.Fatalf("WriteIMGOptions() error: %v", err)
+	}
+	if report.Sectors != 12 {
+		t.Errorf("%d sectors written, expected 12", report.Sectors)
+	}
+	data, err := os.ReadFile(imgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, track := range img.Tracks {
+		for j, sector := range track.Sectors {
+			offset := (i*3 + j) * 512
+			if !bytes.Equal(data[offset:offset+512], sector.Data) {
+				t.Errorf("track %d, sector %d: wrong data in IMG", i, j+1)
+			}
+		}
+	}
+}
+
+func TestReadIMDFile_Limits(t *testing.T) {
+	// Track of 255 compressed sectors, 8 kbytes each
+	data := []byte("IMD 1.18: test\r\n\x1a")
+	data = append(data, 5, 0, 0, 255, 6)
+	for i := 0; i < 255; i++ {
+		data = append(data, byte(i+1))
+	}
+	for i := 0; i < 255; i++ {
+		data = append(data, 0x02, 0xE5)
+	}
+	filename := filepath.Join(t.TempDir(), "big.imd")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadIMDFile(filename); err == nil || !strings.Contains(err.Error(), "track too long") {
+		t.Errorf("ReadIMDFile() error = %v, expected track too long", err)
+	}
+}
+
+// Write IMD image of random sectors, 9 per track, and return its contents
+func makeRandomIMD(t testing.TB, cylinders int) []byte {
+	disk := &Disk{
+		Header: Header{NumberOfTrack: uint8(cylinders), NumberOfSide: 2, BitRate: 250, FloppyRPM: 300},
+		Tracks: make([]TrackData, cylinders),
+	}
+	rng := rand.New(rand.NewSource(int64(cylinders)))
+	for cyl := 0; cyl < cylinders; cyl++ {
+		for head := 0; head < 2; head++ {
+			sectors := make([][]byte, 9)
+			for i := range sectors {
+				sectors[i] = make([]byte, 512)
+				rng.Read(sectors[i])
+			}
+			track := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, cyl, head, 9, 250)
+			if head == 0 {
+				disk.Tracks[cyl].Side0 = track
+			} else {
+				disk.Tracks[cyl].Side1 = track
+			}
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "random.imd")
+	if err := WriteIMD(filename, disk); err != nil {
+		t.Fatalf("WriteIMD() error: %v", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReadIMDFile_Truncated(t *testing.T) {
+	data := makeRandomIMD(t, 2)
+	start := bytes.IndexByte(data, imdCommentTerminator) + 1
+	const record = 5 + 9 + 9*(1+512) // Header, sector map and uncompressed sectors
+	if len(data) != start+4*record {
+		t.Fatalf("IMD file of %d bytes, expected %d", len(data), start+4*record)
+	}
+
+	tests := []struct {
+		name   string
+		cut    int    // Length of truncated file
+		tracks int    // Complete tracks before the cut
+		where  string // Context of the error
+	}{
+		{"comment", start - 1, 0, "comment block"},
+		{"track header", start + 2*record + 3, 2, "track record 2: incomplete track header"},
+		{"sector map", start + 2*record + 5 + 4, 2, "track record 2: cylinder 1, head 0: failed to read sector map"},
+		{"sector flag", start + 3*record + 5 + 9, 3, "track record 3: cylinder 1, head 1: sector 0 (logical sector 1): failed to read sector flag"},
+		{"sector data", start + 3*record + 5 + 9 + 4*513 + 100, 3,
+			"track record 3: cylinder 1, head 1: sector 4 (logical sector 5): failed to read sector data: cut off after 99 of 512 bytes"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(dir, "truncated.imd")
+			if err := os.WriteFile(filename, data[:tt.cut], 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := ReadIMDFile(filename)
+			if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), tt.where) {
+				t.Errorf("ReadIMDFile() error = %v, expected %q", err, tt.where)
+			}
+
+			// Partial reading keeps complete tracks, and tells where the file is cut off
+			img, err := ReadIMDFileOptions(filename, IMDReadOptions{Partial: true})
+			if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), tt.where) {
+				t.Errorf("ReadIMDFileOptions() error = %v, expected %q", err, tt.where)
+			}
+			if tt.tracks == 0 {
+				if img != nil {
+					t.Errorf("ReadIMDFileOptions() returned image without tracks")
+				}
+				return
+			}
+			if img == nil || len(img.Tracks) != tt.tracks {
+				t.Fatalf("ReadIMDFileOptions() returned %v, expected %d tracks", img, tt.tracks)
+			}
+			if last := img.Tracks[tt.tracks-1]; len(last.Sectors) != 9 || last.Sectors[8].Data == nil {
+				t.Errorf("last track read is incomplete")
+			}
+		})
+	}
+
+	// File cut at the end of a track record is valid
+	filename := filepath.Join(dir, "short.imd")
+	if err := os.WriteFile(filename, data[:start+2*record], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := ReadIMDFile(filename); err != nil || len(img.Tracks) != 2 {
+		t.Errorf("ReadIMDFile() of two tracks error: %v", err)
+	}
+}
+
+// Parse IMD image of 720 sectors: 40 cylinders, two sides
+func BenchmarkReadIMDFile(b *testing.B) {
+	filename := filepath.Join(b.TempDir(), "disk.imd")
+	if err := os.WriteFile(filename, makeRandomIMD(b, 40), 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadIMDFile(filename); err != nil {
+			b.Fatalf("ReadIMDFile() error: %v", err)
+		}
+	}
+}
+
+func FuzzReadIMD(f *testing.F) {
+	data, err := os.ReadFile(findSampleFile(f, "fat360.imd"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+
+	filename := filepath.Join(f.TempDir(), "fuzz.imd")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		ReadIMD(filename)
+	})
+}
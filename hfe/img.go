@@ -1,35 +1,59 @@
 package hfe
 
 import (
+	"context"
 	"fmt"
 	"github.com/sergev/floppy/mfm"
-	"os"
+	"path/filepath"
+	"strings"
 )
 
 const (
 	sectorSize = 512 // sector size in bytes
 )
 
-// Read a file in IMG or IMA format and return a Disk structure.
+// Tolerance to mismatch between sector ID and physical track,
+// used when extracting sectors for IMG and IMD images.
+var IDTolerance = mfm.IDStrict
+
+// Sector interleave and track-to-track skew of tracks generated
+// from IMG images. Defaults give consecutive sectors on every track.
+var (
+	Interleave = 1
+	TrackSkew  = 0
+)
+
+// Read a file in IMG, IMA or ST format and return a Disk structure.
 func ReadIMG(filename string) (*Disk, error) {
-	file, err := os.Open(filename)
+	file, err := openImageFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, err
 	}
 	defer file.Close()
 
 	// Get file size
-	fileInfo, err := file.Stat()
+	fileSize, err := file.Size()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get file info: %w", err)
+		return nil, err
 	}
-	fileSize := fileInfo.Size()
 
-	// Detect format from file size
-	cylinders, sides, sectorsPerTrack, err := mfm.DetectFormatFromSize(fileSize)
+	// Detect format from file size.
+	// Extension .st means raw image of Atari ST disk.
+	atariST := strings.EqualFold(filepath.Ext(trimGzipSuffix(filename)), ".st")
+	detectFormat := mfm.DetectFormatFromSize
+	if atariST {
+		detectFormat = mfm.DetectAtariSTFormatFromSize
+	}
+	cylinders, sides, sectorsPerTrack, err := detectFormat(fileSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to detect format: %w", err)
 	}
+	if err := Limits.checkTracks(cylinders); err != nil {
+		return nil, err
+	}
+	if err := Limits.checkDiskBytes(fileSize); err != nil {
+		return nil, err
+	}
 
 	// Read all sectors
 	totalSectors := cylinders * sides * sectorsPerTrack
@@ -78,6 +102,13 @@ func ReadIMG(filename string) (*Disk, error) {
 		// 5.25" drive
 		disk.Header.FloppyRPM = 360
 	}
+	if atariST || sectorsPerTrack == 11 || cylinders > 80 {
+		// Geometry used only by Atari ST
+		disk.Header.FloppyInterfaceMode = IFM_AtariST_DD
+		if disk.Header.BitRate >= 500 {
+			disk.Header.FloppyInterfaceMode = IFM_AtariST_HD
+		}
+	}
 
 	// Max track length in MFM bits
 	maxHalfBits := int(disk.Header.BitRate) * 1000 * 60 / int(disk.Header.FloppyRPM) * 2
@@ -97,6 +128,8 @@ func ReadIMG(filename string) (*Disk, error) {
 
 			// Encode track to MFM
 			writer := mfm.NewWriter(maxHalfBits)
+			writer.Interleave = Interleave
+			writer.Skew = TrackSkew
 			mfmData := writer.EncodeTrackIBMPC(trackSectors, cyl, head, sectorsPerTrack, disk.Header.BitRate)
 
 			// Store in appropriate side
@@ -116,75 +149,166 @@ func countSectors(sideData []byte) int {
 	return reader.CountSectorsIBMPC()
 }
 
+// IMGOptions control writing of IMG images
+type IMGOptions struct {
+	// Geometry of the image, or 0 to take it from the disk.
+	// Tracks missing from the disk are filled, which gives
+	// a correctly sized image from a partial capture.
+	Cylinders       int
+	Sides           int
+	SectorsPerTrack int
+
+	// Written in place of sectors which cannot be read
+	Filler byte
+
+	// Fail on the first missing or damaged sector of a track with data,
+	// instead of filling it and adding it to the report.
+	// Tracks without data are filled in any case.
+	Strict bool
+
+	// Context to cancel writing, or nil. The file is not created
+	// when writing is cancelled.
+	Context context.Context
+
+	// Called after each track side is written, with number of sides
+	// done and total, and number of good sectors written so far, or nil
+	Progress func(done, total, sectors int)
+}
+
+// IMGSectorAddr identifies a sector of IMG image
+type IMGSectorAddr struct {
+	Cylinder int
+	Head     int
+	Sector   int  // Logical sector number, 1-based
+	Bad      bool // Sector was found, but with bad checksum
+}
+
+// IMGReport contains results of writing IMG image
+type IMGReport struct {
+	Cylinders       int             // Number of cylinders in the image
+	Sides           int             // Number of sides in the image
+	SectorsPerTrack int             // Number of sectors per track in the image
+	Sectors         int             // Number of good sectors written
+	Missing         []IMGSectorAddr // Sectors filled with Filler, in order of the image
+}
+
 // Write disk contents to an IMG or IMA format file.
+// Fails when any sector is missing or damaged on a track with data.
+// Tracks without data are filled with zeros.
 func WriteIMG(filename string, disk *Disk) error {
+	_, err := WriteIMGOptions(filename, disk, IMGOptions{Strict: true})
+	return err
+}
+
+// Write disk contents to an IMG or IMA format file, with the given options.
+// Tracks are decoded in parallel, and written one by one, each at its place
+// in the image.
+func WriteIMGOptions(filename string, disk *Disk, opts IMGOptions) (*IMGReport, error) {
+	// Figure out disk geometry
+	report := &IMGReport{
+		Cylinders:       opts.Cylinders,
+		Sides:           opts.Sides,
+		SectorsPerTrack: opts.SectorsPerTrack,
+	}
+	if report.Cylinders == 0 {
+		report.Cylinders = int(disk.Header.NumberOfTrack)
+	}
+	if report.Sides == 0 {
+		report.Sides = int(disk.Header.NumberOfSide)
+	}
+	if report.SectorsPerTrack == 0 {
+		report.SectorsPerTrack = disk.firstTrackSectors()
+	}
+	if report.Cylinders < 0 || report.Sides < 1 || report.Sides > 2 || report.SectorsPerTrack < 0 {
+		return nil, fmt.Errorf("invalid geometry: %d cylinders, %d sides, %d sectors per track",
+			report.Cylinders, report.Sides, report.SectorsPerTrack)
+	}
+	if report.SectorsPerTrack == 0 {
+		return nil, fmt.Errorf("no IBM PC sectors found on the disk")
+	}
+
 	// Create output file
-	file, err := os.Create(filename)
+	file, err := createAtomic(filename)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
+	defer file.Abort()
 
-	// Figure out disk geometry
-	numCylinders := int(disk.Header.NumberOfTrack)
-	numHeads := int(disk.Header.NumberOfSide)
-	numSectorsPerTrack := countSectors(disk.Tracks[0].Side0)
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	trackSize := report.SectorsPerTrack * sectorSize
+	buf := make([]byte, trackSize)
+	total := report.Cylinders * report.Sides
+	err = disk.decodeSides(ctx, report.Cylinders, report.Sides, func(cyl, head int, decoded *DecodedTrack) error {
+		if err := disk.imgTrack(buf, cyl, head, decoded, &opts, report); err != nil {
+			return err
+		}
 
-	// Iterate through cylinders and heads
-	for cyl := 0; cyl < numCylinders; cyl++ {
-		for head := 0; head < numHeads; head++ {
+		// Place the track by its position, not by order of writing
+		index := cyl*report.Sides + head
+		if _, err := file.WriteAt(buf, int64(index*trackSize)); err != nil {
+			return fmt.Errorf("failed to write track %d.%d: %w", cyl, head, err)
+		}
+		if opts.Progress != nil {
+			opts.Progress(index+1, total, report.Sectors)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
 
-			// Get appropriate side data
-			var sideData []byte
-			if head == 0 {
-				sideData = disk.Tracks[cyl].Side0
-			} else {
-				sideData = disk.Tracks[cyl].Side1
+// Number of sectors on the first track with any,
+// or 0 when the disk has none.
+func (disk *Disk) firstTrackSectors() int {
+	for cyl := range disk.Tracks {
+		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+			if n := countSectors(disk.Tracks[cyl].side(head)); n > 0 {
+				return n
 			}
+		}
+	}
+	return 0
+}
 
-			if len(sideData) == 0 {
-				return fmt.Errorf("empty track %d.%d", cyl, head)
-			}
+// Place sectors of the decoded track into buf, in sequential order.
+// Of several instances with the same ID, the first good one of the sector size
+// with normal data mark is used.
+// Missing sectors are filled, or give an error in strict mode.
+func (disk *Disk) imgTrack(buf []byte, cyl, head int, decoded *DecodedTrack, opts *IMGOptions, report *IMGReport) error {
+	strict := opts.Strict && disk.checkTrack(cyl, head) == nil && len(disk.Tracks[cyl].side(head)) > 0
 
-			// Create MFM reader for this track
-			reader := mfm.NewReader(sideData)
-
-			// Extract all sectors from track (may appear in any order)
-			sectors := make(map[int][]byte)
-
-			// Read sectors sequentially until we can't find any more
-			for len(sectors) < numSectorsPerTrack {
-				// Try to read a sector
-				sectorNum, sectorData, err := reader.ReadSectorIBMPC(cyl, head)
-				if err != nil {
-					// End of track or error, break
-					break
-				}
-
-				// Validate sector number
-				if sectorNum < 0 || sectorNum >= numSectorsPerTrack {
-					// Invalid sector number, continue searching
-					continue
-				}
-
-				// Store sector (overwrite if duplicate)
-				sectors[sectorNum] = sectorData
+	for s := 0; s < report.SectorsPerTrack; s++ {
+		data := buf[s*sectorSize : (s+1)*sectorSize]
+		sector := decoded.SectorOfSize(s+1, sectorSize)
+		if sector != nil && sector.Bad && strict {
+			fmt.Printf("Warning: bad checksum in sector %d of track %d.%d\n", s+1, cyl, head)
+		}
+		if sector == nil || sector.Bad || sector.Deleted || len(sector.Data) != sectorSize {
+			// Missing sector
+			if strict {
+				return fmt.Errorf("missing sector %d of track %d.%d", s, cyl, head)
 			}
-
-			// Write sectors in sequential order
-			for s := 0; s < numSectorsPerTrack; s++ {
-				sectorData, found := sectors[s]
-				if !found {
-					// Missing sector
-					return fmt.Errorf("missing sector %d of track %d.%d", s, cyl, head)
-				}
-
-				// Write sector data
-				if _, err := file.Write(sectorData); err != nil {
-					return fmt.Errorf("failed to write sector %d of track %d.%d: %w", s, cyl, head, err)
-				}
+			for i := range data {
+				data[i] = opts.Filler
 			}
+			report.Missing = append(report.Missing, IMGSectorAddr{
+				Cylinder: cyl,
+				Head:     head,
+				Sector:   s + 1,
+				Bad:      sector != nil && sector.Bad,
+			})
+			continue
 		}
+		copy(data, sector.Data)
+		report.Sectors++
 	}
 	return nil
 }
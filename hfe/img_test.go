@@ -0,0 +1,269 @@
+package hfe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Regression test: sector images written from sample files must stay
+// byte-identical. Header of IMD file contains the time of writing,
+// so the checksum covers only data after the comment.
+func TestWriteIMG_WriteIMD_Golden(t *testing.T) {
+	tests := []struct {
+		sample string
+		img    string // SHA-256 of IMG output
+		imd    string // SHA-256 of IMD output, after the comment
+	}{
+		{"fat360.imd",
+			"06ed3445dc1e9de2e411d8d2fe1d6b4793f04fbcb857a0bda8a4d17c17208124",
+			"bbefdc9f99810e6d543f0831a43ad55d7da3db96fe1341449135f74eaa7d3830"},
+		{"fat360.hfe.gz",
+			"06ed3445dc1e9de2e411d8d2fe1d6b4793f04fbcb857a0bda8a4d17c17208124",
+			"bbefdc9f99810e6d543f0831a43ad55d7da3db96fe1341449135f74eaa7d3830"},
+		{"fat12v1.hfe",
+			"23e7b2b76d1342ff2e60d472dda540d26b9b3c60511248d7d3d2e407125caccc",
+			"577efce1669633f9062edc5640e4eb9c2efa67696e6f263fc6805a2362f51256"},
+		{"fat12v3.hfe",
+			"23e7b2b76d1342ff2e60d472dda540d26b9b3c60511248d7d3d2e407125caccc",
+			"577efce1669633f9062edc5640e4eb9c2efa67696e6f263fc6805a2362f51256"},
+		{"fat720.img.gz",
+			"484c3fb6d8718041d323f693d00318079f4d66c51e3b9652523f8d23fa308dfc",
+			"96705b204bcd0c6abaee75a6f3431321b9fb53f52bd6f4dfc39292d78bf36f71"},
+		{"fat1.44.img.gz",
+			"bcd678524b1dde47004ee81167d86870fcfbb61c43436eb6e2b1fedae166ba15",
+			"c2382d864132c01b51c7af8d44cace0a0b31dd6f099642776951caa5a3549abf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			disk, _, err := OpenImage(findSampleFile(t, tt.sample))
+			if err != nil {
+				t.Fatalf("OpenImage() error: %v", err)
+			}
+			dir := t.TempDir()
+
+			imgFile := filepath.Join(dir, "disk.img")
+			if err := WriteIMG(imgFile, disk); err != nil {
+				t.Fatalf("WriteIMG() error: %v", err)
+			}
+			if sum := fileChecksum(t, imgFile, false); sum != tt.img {
+				t.Errorf("IMG checksum %s, expected %s", sum, tt.img)
+			}
+
+			imdFile := filepath.Join(dir, "disk.imd")
+			if err := WriteIMD(imdFile, disk); err != nil {
+				t.Fatalf("WriteIMD() error: %v", err)
+			}
+			if sum := fileChecksum(t, imdFile, true); sum != tt.imd {
+				t.Errorf("IMD checksum %s, expected %s", sum, tt.imd)
+			}
+		})
+	}
+}
+
+// Compute SHA-256 of the file, optionally skipping IMD comment
+func fileChecksum(t *testing.T, filename string, skipComment bool) string {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if skipComment {
+		i := bytes.IndexByte(data, 0x1A)
+		if i < 0 {
+			t.Fatalf("no end of comment in %s", filename)
+		}
+		data = data[i:]
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestReadIMG_AtariST(t *testing.T) {
+	testCases := []struct {
+		name      string
+		cylinders int
+		sides     int
+		sectors   int
+	}{
+		{"disk.st", 80, 2, 11},
+		{"disk.st", 80, 1, 10},
+		{"disk.img", 82, 2, 9},
+	}
+	for _, tc := range testCases {
+		dir := t.TempDir()
+		data := make([]byte, tc.cylinders*tc.sides*tc.sectors*sectorSize)
+		for i := range data {
+			data[i] = byte(i / sectorSize)
+		}
+		filename := filepath.Join(dir, tc.name)
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatalf("WriteFile() error: %v", err)
+		}
+
+		disk, err := Read(filename)
+		if err != nil {
+			t.Fatalf("%s: Read() error: %v", tc.name, err)
+		}
+		if int(disk.Header.NumberOfTrack) != tc.cylinders || int(disk.Header.NumberOfSide) != tc.sides {
+			t.Errorf("%s: geometry %d/%d, expected %d/%d", tc.name,
+				disk.Header.NumberOfTrack, disk.Header.NumberOfSide, tc.cylinders, tc.sides)
+		}
+		if disk.Header.FloppyInterfaceMode != IFM_AtariST_DD || disk.Header.BitRate != 250 {
+			t.Errorf("%s: interface mode %d, bit rate %d", tc.name,
+				disk.Header.FloppyInterfaceMode, disk.Header.BitRate)
+		}
+
+		// All sectors are written back unchanged
+		outFile := filepath.Join(dir, "out"+filepath.Ext(tc.name))
+		if err := Write(outFile, disk); err != nil {
+			t.Fatalf("%s: Write() error: %v", tc.name, err)
+		}
+		out, err := os.ReadFile(outFile)
+		if err != nil {
+			t.Fatalf("ReadFile() error: %v", err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: written image differs", tc.name)
+		}
+	}
+}
+
+func FuzzReadIMG(f *testing.F) {
+	f.Add(make([]byte, 160*1024))
+	f.Add(make([]byte, 512))
+
+	filename := filepath.Join(f.TempDir(), "fuzz.img")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		ReadIMG(filename)
+	})
+}
+
+// Encode IBM PC track with 9 sectors, every byte of sector
+// derived from the cylinder, head and sector number
+func makeIMGTestTrack(cyl, head int) [][]byte {
+	sectors := make([][]byte, 9)
+	for s := range sectors {
+		sectors[s] = bytes.Repeat([]byte{byte(cyl*18 + head*9 + s)}, sectorSize)
+	}
+	return sectors
+}
+
+func TestWriteIMGOptions_BadSector(t *testing.T) {
+	disk := &Disk{
+		Header: Header{NumberOfTrack: 2, NumberOfSide: 2, BitRate: 250, FloppyRPM: 300, TrackEncoding: ENC_ISOIBM_MFM},
+		Tracks: make([]TrackData, 2),
+	}
+	var want []byte
+	for cyl := 0; cyl < 2; cyl++ {
+		for head := 0; head < 2; head++ {
+			sectors := makeIMGTestTrack(cyl, head)
+			track := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, cyl, head, 9, 250)
+			if cyl == 1 && head == 0 {
+				// Change one byte of sector 4, keeping the old checksum
+				sectors[3] = bytes.Clone(sectors[3])
+				sectors[3][100] ^= 0xFF
+				other := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, cyl, head, 9, 250)
+				i := 0
+				for track[i] == other[i] {
+					i++
+				}
+				track[i] = other[i]
+				sectors[3] = bytes.Repeat([]byte{0xE5}, sectorSize)
+			}
+			if head == 0 {
+				disk.Tracks[cyl].Side0 = track
+			} else {
+				disk.Tracks[cyl].Side1 = track
+			}
+			want = append(want, bytes.Join(sectors, nil)...)
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "bad.img")
+
+	// Strict mode fails, like WriteIMG
+	if err := WriteIMG(filename, disk); err == nil {
+		t.Fatalf("WriteIMG() succeeded, expected error")
+	}
+	if _, err := WriteIMGOptions(filename, disk, IMGOptions{Strict: true}); err == nil {
+		t.Fatalf("WriteIMGOptions() succeeded in strict mode, expected error")
+	}
+
+	report, err := WriteIMGOptions(filename, disk, IMGOptions{Filler: 0xE5})
+	if err != nil {
+		t.Fatalf("WriteIMGOptions() error: %v", err)
+	}
+	wantMissing := []IMGSectorAddr{{Cylinder: 1, Head: 0, Sector: 4, Bad: true}}
+	if !slices.Equal(report.Missing, wantMissing) {
+		t.Errorf("missing sectors %v, expected %v", report.Missing, wantMissing)
+	}
+	if report.Sectors != 35 {
+		t.Errorf("%d good sectors, expected 35", report.Sectors)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("written image differs")
+	}
+}
+
+func TestWriteIMGOptions_Partial(t *testing.T) {
+	// Only first 10 cylinders of 80 are captured
+	const captured = 10
+	disk := &Disk{
+		Header: Header{NumberOfTrack: captured, NumberOfSide: 2, BitRate: 250, FloppyRPM: 300, TrackEncoding: ENC_ISOIBM_MFM},
+		Tracks: make([]TrackData, captured),
+	}
+	var want []byte
+	for cyl := 0; cyl < captured; cyl++ {
+		for head := 0; head < 2; head++ {
+			sectors := makeIMGTestTrack(cyl, head)
+			track := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, cyl, head, 9, 250)
+			if head == 0 {
+				disk.Tracks[cyl].Side0 = track
+			} else {
+				disk.Tracks[cyl].Side1 = track
+			}
+			want = append(want, bytes.Join(sectors, nil)...)
+		}
+	}
+	want = append(want, make([]byte, (80-captured)*2*9*sectorSize)...)
+
+	filename := filepath.Join(t.TempDir(), "partial.img")
+	report, err := WriteIMGOptions(filename, disk, IMGOptions{Cylinders: 80})
+	if err != nil {
+		t.Fatalf("WriteIMGOptions() error: %v", err)
+	}
+	if report.Cylinders != 80 || report.Sides != 2 || report.SectorsPerTrack != 9 {
+		t.Errorf("geometry %d/%d/%d, expected 80/2/9", report.Cylinders, report.Sides, report.SectorsPerTrack)
+	}
+	if report.Sectors != captured*2*9 || len(report.Missing) != (80-captured)*2*9 {
+		t.Errorf("%d good and %d missing sectors", report.Sectors, len(report.Missing))
+	}
+	if m := report.Missing[0]; m != (IMGSectorAddr{Cylinder: captured, Head: 0, Sector: 1}) {
+		t.Errorf("first missing sector %+v", m)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("written image differs, %d bytes, expected %d", len(data), len(want))
+	}
+
+	// Written image is recognized as 720k disk
+	if _, err := Read(filename); err != nil {
+		t.Errorf("Read() error: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package hfe
+
+import "fmt"
+
+// Default limits of geometry accepted from image files
+const (
+	DefaultMaxTracks      = MaxHFETracks // Cylinders of a disk, as many as WriteHFE can store
+	DefaultTrackLenFactor = 4            // Track length, relative to one revolution at the declared rates
+	DefaultMaxDiskBytes   = 64 << 20     // Track data of the whole image
+	DefaultMaxImageBytes  = 80 << 20     // Compressed image file, decompressed into memory
+	DefaultOpcodeSteps    = 1            // HFE v3 opcodes decoded per byte of track data
+)
+
+// ImageLimits bounds geometry taken from headers of image files.
+// Sizes are checked before memory is allocated for them, so that a corrupted
+// or malicious file fails with an error instead of exhausting memory.
+type ImageLimits struct {
+	MaxTracks      int     // Number of cylinders
+	TrackLenFactor float64 // Track length, relative to one revolution at the declared bit rate and RPM
+	MaxDiskBytes   int64   // Track data of the whole image, in bytes
+	MaxImageBytes  int64   // Compressed image file after decompression, in bytes
+	OpcodeSteps    int     // Iterations of HFE v3 opcode decoding, per byte of track data
+}
+
+// Limits applied when reading image files.
+// Raise them for unusual images which are legitimately larger.
+var Limits = ImageLimits{
+	MaxTracks:      DefaultMaxTracks,
+	TrackLenFactor: DefaultTrackLenFactor,
+	MaxDiskBytes:   DefaultMaxDiskBytes,
+	MaxImageBytes:  DefaultMaxImageBytes,
+	OpcodeSteps:    DefaultOpcodeSteps,
+}
+
+// Longest track accepted at the given bit rate and RPM, in bytes of MFM
+// bitcells of one side. Unknown or slow rotation speed is taken as 300 RPM.
+func (l *ImageLimits) maxTrackBytes(bitRate, rpm uint16) int {
+	rpm = max(rpm, 300)
+	return int(l.TrackLenFactor * float64(RevolutionBits(bitRate, rpm)/8))
+}
+
+// Check number of cylinders of the image
+func (l *ImageLimits) checkTracks(tracks int) error {
+	if tracks > l.MaxTracks {
+		return fmt.Errorf("too many tracks: %d (limit %d)", tracks, l.MaxTracks)
+	}
+	return nil
+}
+
+// Check length of one track, in bytes of one side
+func (l *ImageLimits) checkTrackLen(length int, bitRate, rpm uint16) error {
+	if limit := l.maxTrackBytes(bitRate, rpm); length > limit {
+		return fmt.Errorf("track too long: %d bytes (limit %d at %d kbps)", length, limit, bitRate)
+	}
+	return nil
+}
+
+// Check total size of track data of the image
+func (l *ImageLimits) checkDiskBytes(total int64) error {
+	if total > l.MaxDiskBytes {
+		return fmt.Errorf("track data too large: %d bytes (limit %d)", total, l.MaxDiskBytes)
+	}
+	return nil
+}
+
+// Check size of decompressed image file
+func (l *ImageLimits) checkImageBytes(size int64) error {
+	if size > l.MaxImageBytes {
+		return fmt.Errorf("image file too large: more than %d bytes", l.MaxImageBytes)
+	}
+	return nil
+}
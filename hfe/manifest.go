@@ -0,0 +1,204 @@
+package hfe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Manifest describes provenance of a disk image: how and when it was made.
+// It is saved as JSON file next to the image, see ManifestName.
+type Manifest struct {
+	Tool      string          `json:"tool"`             // Program and its version
+	Created   time.Time       `json:"created"`          // Time of capture or conversion
+	Image     string          `json:"image"`            // Name of image file, without directory
+	Format    string          `json:"format"`           // Format of image file
+	SHA256    string          `json:"sha256"`           // Checksum of image file, in hex
+	Source    string          `json:"source,omitempty"` // Source image, for conversion
+	Device    *ManifestDevice `json:"device,omitempty"` // Adapter used to read the disk
+	Drive     string          `json:"drive,omitempty"`  // Drive name from configuration
+	RPM       float64         `json:"rpm"`              // Rotation speed, as measured when read from a drive
+	BitRate   float64         `json:"bit_rate"`         // Bit rate in kbps, as measured when read from a drive
+	Cylinders int             `json:"cylinders"`
+	Heads     int             `json:"heads"`
+	Tracks    []ManifestTrack `json:"tracks"` // Sector status of every track
+
+	// What the disk probably is, see Identify
+	Identification *Identification `json:"identification,omitempty"`
+}
+
+// ManifestDevice identifies floppy adapter
+type ManifestDevice struct {
+	Adapter      string `json:"adapter"`                 // Type of adapter, like "Greaseweazle"
+	SerialNumber string `json:"serial_number,omitempty"` // Serial number of the device
+	Hardware     string `json:"hardware,omitempty"`      // Hardware model or version
+	Firmware     string `json:"firmware,omitempty"`      // Firmware version
+}
+
+// ManifestTrack contains status of IBM PC sectors on one track
+type ManifestTrack struct {
+	Cylinder int   `json:"cylinder"`
+	Head     int   `json:"head"`
+	Good     int   `json:"good"`              // Number of good sectors
+	Bad      []int `json:"bad,omitempty"`     // Sectors with bad checksum
+	Missing  []int `json:"missing,omitempty"` // Sectors not found
+
+	// Alignment of sectors to the index, when analyzed while reading
+	Layout *mfm.TrackLayout `json:"layout,omitempty"`
+}
+
+// ManifestName returns name of manifest file for the given image.
+func ManifestName(filename string) string {
+	return filename + ".json"
+}
+
+// NewManifest describes the image file, written from the given disk.
+// Rates are nominal values from the header: the caller which read
+// the disk replaces them with measured ones.
+// Device, drive and source are left for the caller to fill.
+func NewManifest(filename string, disk *Disk) (*Manifest, error) {
+	id, _ := Identify(disk)
+	return newManifest(filename, disk, id)
+}
+
+// Describe the image file, with identification of the disk already made
+func newManifest(filename string, disk *Disk, id *Identification) (*Manifest, error) {
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		Tool:      toolVersion(),
+		Created:   time.Now().UTC().Truncate(time.Second),
+		Image:     filepath.Base(filename),
+		Format:    DetectImageFormat(filename).String(),
+		SHA256:    sum,
+		RPM:       float64(disk.Header.FloppyRPM),
+		BitRate:   float64(disk.Header.BitRate),
+		Cylinders: len(disk.Tracks),
+		Heads:     int(disk.Header.NumberOfSide),
+		Tracks:    disk.manifestTracks(),
+
+		Identification: id,
+	}
+	return m, nil
+}
+
+// SetLayout attaches alignment of sectors to the given track.
+// Tracks not present in the manifest are ignored.
+func (m *Manifest) SetLayout(cyl, head int, layout *mfm.TrackLayout) {
+	for i := range m.Tracks {
+		if m.Tracks[i].Cylinder == cyl && m.Tracks[i].Head == head {
+			m.Tracks[i].Layout = layout
+			return
+		}
+	}
+}
+
+// Save writes the manifest next to the image file.
+func (m *Manifest) Save(filename string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	data = append(data, '\n')
+	file, err := createAtomic(ManifestName(filename))
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return file.Commit()
+}
+
+// ReadManifest reads manifest of the given image file.
+func ReadManifest(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(ManifestName(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return m, nil
+}
+
+// Status of sectors on every track. Sectors are numbered from 1
+// up to the largest sector number found on the disk.
+func (disk *Disk) manifestTracks() []ManifestTrack {
+	var tracks []ManifestTrack
+	var found []map[int]bool
+	maxSector := 0
+	for cyl := range disk.Tracks {
+		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+			track := ManifestTrack{Cylinder: cyl, Head: head}
+			status := make(map[int]bool) // Sector number -> good copy found
+			reader := mfm.NewReader(disk.Tracks[cyl].side(head))
+			reader.Tolerance = IDTolerance
+			for {
+				sector, err := reader.ReadSectorInfoIBMPC(cyl, head)
+				if err != nil {
+					break
+				}
+				if sector.Sector < 1 {
+					continue
+				}
+				status[sector.Sector] = status[sector.Sector] || !sector.Bad
+				maxSector = max(maxSector, sector.Sector)
+			}
+			for _, good := range status {
+				if good {
+					track.Good++
+				}
+			}
+			tracks = append(tracks, track)
+			found = append(found, status)
+		}
+	}
+	for i := range tracks {
+		for s := 1; s <= maxSector; s++ {
+			good, present := found[i][s]
+			switch {
+			case !present:
+				tracks[i].Missing = append(tracks[i].Missing, s)
+			case !good:
+				tracks[i].Bad = append(tracks[i].Bad, s)
+			}
+		}
+	}
+	return tracks
+}
+
+// Compute SHA-256 checksum of the file.
+func fileSHA256(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Name and version of the program, from build information.
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "floppy"
+	}
+	return "floppy " + info.Main.Version
+}
@@ -0,0 +1,114 @@
+package hfe
+
+import (
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+func TestManifest_RoundTrip(t *testing.T) {
+	disk := &Disk{
+		Header: Header{
+			NumberOfTrack: 3,
+			NumberOfSide:  1,
+			TrackEncoding: ENC_ISOIBM_MFM,
+			BitRate:       250,
+			FloppyRPM:     300,
+		},
+		Tracks: make([]TrackData, 3),
+	}
+	disk.Tracks[0].Side0 = makeIMDTestTrack(0, 0, 250, 0)
+
+	// Sector 1 of track 1 has bad CRC
+	bad := makeIMDTestTrack(1, 0, 250, 0)
+	other := makeIMDTestTrack(1, 0, 250, 0x80)
+	for i := range bad {
+		if bad[i] != other[i] {
+			copy(bad[i:i+4], other[i:i+4])
+			break
+		}
+	}
+	disk.Tracks[1].Side0 = bad
+
+	// Track 2 is not formatted
+	disk.Tracks[2].Side0 = make([]byte, len(bad))
+
+	filename := filepath.Join(t.TempDir(), "disk.hfe")
+	if err := Write(filename, disk); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	m, err := NewManifest(filename, disk)
+	if err != nil {
+		t.Fatalf("NewManifest() error: %v", err)
+	}
+	m.Device = &ManifestDevice{Adapter: "Greaseweazle", SerialNumber: "GW1234", Firmware: "1.6"}
+	m.Drive = "3.5"
+	m.SetLayout(0, 0, mfm.AnalyzeLayoutIBMPC(disk.Tracks[0].Side0, 250))
+	if err := m.Save(filename); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	got, err := ReadManifest(filename)
+	if err != nil {
+		t.Fatalf("ReadManifest() error: %v", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("manifest changed after round trip:\n got %+v\nwant %+v", got, m)
+	}
+
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		t.Fatalf("fileSHA256() error: %v", err)
+	}
+	if got.SHA256 != sum || len(sum) != 64 {
+		t.Errorf("checksum %q, expected %q", got.SHA256, sum)
+	}
+	if got.Image != "disk.hfe" || got.Format != "HFE" || got.Cylinders != 3 || got.Heads != 1 {
+		t.Errorf("image %q, format %q, geometry %d/%d", got.Image, got.Format, got.Cylinders, got.Heads)
+	}
+
+	// Sector status of every track
+	allSectors := []int{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	if len(got.Tracks) != 3 {
+		t.Fatalf("got %d tracks, expected 3", len(got.Tracks))
+	}
+	if tr := got.Tracks[0]; tr.Good != 9 || tr.Bad != nil || tr.Missing != nil {
+		t.Errorf("track 0: %+v", tr)
+	}
+	if l := got.Tracks[0].Layout; l == nil || l.Sectors != 9 || !l.Nominal || got.Tracks[1].Layout != nil {
+		t.Errorf("track 0 layout %+v, track 1 layout %+v", l, got.Tracks[1].Layout)
+	}
+	if tr := got.Tracks[1]; tr.Good != 8 || !slices.Equal(tr.Bad, []int{1}) || tr.Missing != nil {
+		t.Errorf("track 1: %+v", tr)
+	}
+	if tr := got.Tracks[2]; tr.Cylinder != 2 || tr.Good != 0 || !slices.Equal(tr.Missing, allSectors) {
+		t.Errorf("track 2: %+v", tr)
+	}
+}
+
+func TestConvert_Manifest(t *testing.T) {
+	src := findSampleFile(t, "fat360.imd")
+	dst := filepath.Join(t.TempDir(), "disk.img")
+	if _, err := Convert(src, dst, ConvertOptions{Manifest: true}); err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	m, err := ReadManifest(dst)
+	if err != nil {
+		t.Fatalf("ReadManifest() error: %v", err)
+	}
+	sum, _ := fileSHA256(dst)
+	if m.Source != src || m.Format != "IMG" || m.SHA256 != sum || m.Device != nil {
+		t.Errorf("unexpected manifest: %+v", m)
+	}
+	if len(m.Tracks) != m.Cylinders*m.Heads {
+		t.Errorf("%d tracks for %d cylinders, %d heads", len(m.Tracks), m.Cylinders, m.Heads)
+	}
+	for _, tr := range m.Tracks {
+		if tr.Good != 9 || tr.Bad != nil || tr.Missing != nil {
+			t.Errorf("track %d, side %d: %+v", tr.Cylinder, tr.Head, tr)
+		}
+	}
+}
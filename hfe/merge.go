@@ -0,0 +1,104 @@
+package hfe
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Clone returns a deep copy of the disk.
+// The copy shares no memory with the original, so both can be modified
+// independently, for example from different goroutines.
+func (disk *Disk) Clone() *Disk {
+	clone := *disk
+	clone.Tracks = make([]TrackData, len(disk.Tracks))
+	for i, track := range disk.Tracks {
+		clone.Tracks[i] = track.clone()
+	}
+	return &clone
+}
+
+// Deep copy of track data.
+// Sides are copied separately, even when one slice aliases the other.
+func (track TrackData) clone() TrackData {
+	return TrackData{
+		Side0:          bytes.Clone(track.Side0),
+		Side1:          bytes.Clone(track.Side1),
+		BitRate:        track.BitRate,
+		IndexBitOffset: track.IndexBitOffset,
+		WeakBits:       [2][]byte{bytes.Clone(track.WeakBits[0]), bytes.Clone(track.WeakBits[1])},
+	}
+}
+
+// Return bitstream of the given side, or nil for missing side.
+func (track *TrackData) side(side int) []byte {
+	if side == 0 {
+		return track.Side0
+	}
+	return track.Side1
+}
+
+// Check that cylinder and side are within disk geometry
+func (disk *Disk) checkTrack(cyl, side int) error {
+	if cyl < 0 || cyl >= len(disk.Tracks) {
+		return fmt.Errorf("cylinder %d out of range (0-%d)", cyl, len(disk.Tracks)-1)
+	}
+	if side < 0 || side >= max(int(disk.Header.NumberOfSide), 1) {
+		// Single-sided disk has no side 1
+		return fmt.Errorf("side %d out of range for %d-sided disk", side, disk.Header.NumberOfSide)
+	}
+	return nil
+}
+
+// ReplaceTrack replaces bitstream of one side of a cylinder,
+// starting at the index, without weak bits. Data is copied,
+// so the caller may reuse the buffer.
+func (disk *Disk) ReplaceTrack(cyl, side int, data []byte) error {
+	if err := disk.checkTrack(cyl, side); err != nil {
+		return err
+	}
+	if side == 0 {
+		disk.Tracks[cyl].Side0 = bytes.Clone(data)
+	} else {
+		disk.Tracks[cyl].Side1 = bytes.Clone(data)
+	}
+	disk.Tracks[cyl].IndexBitOffset[side] = 0
+	disk.Tracks[cyl].WeakBits[side] = nil
+	return nil
+}
+
+// Merge builds a new disk from base, with tracks taken from overlay
+// wherever selector returns true. Both disks must have the same geometry
+// and bit rate of the selected tracks. Source disks are not modified,
+// and the result shares no memory with them.
+func Merge(base, overlay *Disk, selector func(cyl, side int) bool) (*Disk, error) {
+	if len(base.Tracks) != len(overlay.Tracks) {
+		return nil, fmt.Errorf("number of tracks differs: %d and %d", len(base.Tracks), len(overlay.Tracks))
+	}
+	if base.Header.NumberOfSide != overlay.Header.NumberOfSide {
+		return nil, fmt.Errorf("number of sides differs: %d and %d", base.Header.NumberOfSide, overlay.Header.NumberOfSide)
+	}
+	if base.Header.TrackEncoding != overlay.Header.TrackEncoding {
+		return nil, fmt.Errorf("track encoding differs: %d and %d", base.Header.TrackEncoding, overlay.Header.TrackEncoding)
+	}
+
+	result := base.Clone()
+	numSides := max(int(base.Header.NumberOfSide), 1)
+	for cyl := range result.Tracks {
+		for side := 0; side < numSides; side++ {
+			if !selector(cyl, side) {
+				continue
+			}
+			if base.TrackBitRate(cyl) != overlay.TrackBitRate(cyl) {
+				return nil, fmt.Errorf("track %d, side %d: bit rate differs: %d and %d kbps",
+					cyl, side, base.TrackBitRate(cyl), overlay.TrackBitRate(cyl))
+			}
+			err := result.ReplaceTrack(cyl, side, overlay.Tracks[cyl].side(side))
+			if err != nil {
+				return nil, err
+			}
+			result.Tracks[cyl].IndexBitOffset[side] = overlay.Tracks[cyl].IndexBitOffset[side]
+			result.Tracks[cyl].WeakBits[side] = bytes.Clone(overlay.Tracks[cyl].WeakBits[side])
+		}
+	}
+	return result, nil
+}
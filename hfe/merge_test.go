@@ -0,0 +1,95 @@
+package hfe
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Create a disk with every track filled by the given byte
+func makeMergeDisk(fill byte, numSides uint8) *Disk {
+	disk := &Disk{
+		Header: Header{NumberOfTrack: 4, NumberOfSide: numSides, BitRate: 250},
+		Tracks: make([]TrackData, 4),
+	}
+	for i := range disk.Tracks {
+		disk.Tracks[i].Side0 = bytes.Repeat([]byte{fill}, 16)
+		if numSides > 1 {
+			disk.Tracks[i].Side1 = bytes.Repeat([]byte{fill + 1}, 16)
+		}
+	}
+	return disk
+}
+
+func TestClone(t *testing.T) {
+	disk := makeMergeDisk(0x10, 2)
+	clone := disk.Clone()
+	clone.Tracks[0].Side0[0] = 0xff
+	clone.Tracks[1].Side1[0] = 0xff
+	clone.Header.BitRate = 500
+	if disk.Tracks[0].Side0[0] != 0x10 || disk.Tracks[1].Side1[0] != 0x11 || disk.Header.BitRate != 250 {
+		t.Errorf("modification of clone affects the original disk")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := makeMergeDisk(0x10, 2)
+	overlay := makeMergeDisk(0x20, 2)
+
+	// Take side 0 of cylinder 2 from overlay
+	merged, err := Merge(base, overlay, func(cyl, side int) bool {
+		return cyl == 2 && side == 0
+	})
+	if err != nil {
+		t.Fatalf("Merge() error: %v", err)
+	}
+	for cyl, track := range merged.Tracks {
+		expected := byte(0x10)
+		if cyl == 2 {
+			expected = 0x20
+		}
+		if track.Side0[0] != expected || track.Side1[0] != 0x11 {
+			t.Errorf("cylinder %d: sides %#x/%#x", cyl, track.Side0[0], track.Side1[0])
+		}
+	}
+
+	// Sources stay intact
+	merged.Tracks[2].Side0[0] = 0xff
+	merged.Tracks[0].Side0[0] = 0xff
+	if overlay.Tracks[2].Side0[0] != 0x20 || base.Tracks[0].Side0[0] != 0x10 {
+		t.Errorf("modification of merged disk affects the sources")
+	}
+}
+
+func TestMergeIncompatible(t *testing.T) {
+	all := func(cyl, side int) bool { return true }
+
+	if _, err := Merge(makeMergeDisk(0x10, 2), makeMergeDisk(0x20, 1), all); err == nil {
+		t.Errorf("expected error for different number of sides")
+	}
+
+	overlay := makeMergeDisk(0x20, 2)
+	overlay.Tracks[3].BitRate = 300
+	if _, err := Merge(makeMergeDisk(0x10, 2), overlay, all); err == nil {
+		t.Errorf("expected error for different bit rate")
+	}
+}
+
+func TestReplaceTrack(t *testing.T) {
+	disk := makeMergeDisk(0x10, 1)
+	data := []byte{1, 2, 3}
+	if err := disk.ReplaceTrack(3, 0, data); err != nil {
+		t.Fatalf("ReplaceTrack() error: %v", err)
+	}
+	data[0] = 0xff
+	if !bytes.Equal(disk.Tracks[3].Side0, []byte{1, 2, 3}) {
+		t.Errorf("track data not copied: % x", disk.Tracks[3].Side0)
+	}
+
+	// Single-sided disk has no side 1
+	if err := disk.ReplaceTrack(0, 1, data); err == nil {
+		t.Errorf("expected error for side 1 of single-sided disk")
+	}
+	if err := disk.ReplaceTrack(4, 0, data); err == nil {
+		t.Errorf("expected error for cylinder out of range")
+	}
+}
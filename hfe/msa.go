@@ -0,0 +1,260 @@
+package hfe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/sergev/floppy/mfm"
+)
+
+const (
+	msaSignature  = 0x0E0F // First word of MSA file
+	msaHeaderSize = 10     // Signature, sectors per track, sides-1, start and end track
+	msaRunMarker  = 0xE5   // Starts a run: marker, byte value, 16-bit count
+	msaMinRun     = 4      // Shorter runs are stored as is
+	msaMaxTrack   = 85     // Last track number accepted by Magic Shadow Archiver
+)
+
+// ReadMSA reads a file in MSA format (Magic Shadow Archiver of Atari ST)
+// and returns a Disk structure. Tracks of the disk are stored either as is,
+// or compressed with run-length encoding.
+// Tracks before the start track of the image are left empty.
+func ReadMSA(filename string) (*Disk, error) {
+	data, err := readImageData(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	if len(data) < msaHeaderSize {
+		return nil, fmt.Errorf("file too small for MSA header: %d bytes", len(data))
+	}
+	if binary.BigEndian.Uint16(data[0:2]) != msaSignature {
+		return nil, fmt.Errorf("invalid MSA signature: 0x%04x", binary.BigEndian.Uint16(data[0:2]))
+	}
+	sectorsPerTrack := int(binary.BigEndian.Uint16(data[2:4]))
+	sides := int(binary.BigEndian.Uint16(data[4:6])) + 1
+	startTrack := int(binary.BigEndian.Uint16(data[6:8]))
+	endTrack := int(binary.BigEndian.Uint16(data[8:10]))
+	if sectorsPerTrack < 1 || sectorsPerTrack > 36 {
+		return nil, fmt.Errorf("invalid number of sectors per track: %d", sectorsPerTrack)
+	}
+	if sides > 2 {
+		return nil, fmt.Errorf("invalid number of sides: %d", sides)
+	}
+	if startTrack > endTrack || endTrack > msaMaxTrack {
+		return nil, fmt.Errorf("invalid track range: %d-%d", startTrack, endTrack)
+	}
+	cylinders := endTrack + 1
+
+	disk := &Disk{
+		Header: Header{
+			NumberOfTrack:       uint8(cylinders),
+			NumberOfSide:        uint8(sides),
+			TrackEncoding:       ENC_ISOIBM_MFM,
+			BitRate:             250, // 250 kbps for DD floppy
+			FloppyRPM:           300, // 300 RPM
+			FloppyInterfaceMode: IFM_AtariST_DD,
+			WriteProtected:      0xFF,
+			WriteAllowed:        0xFF,
+			SingleStep:          0xFF,
+			Track0S0AltEncoding: 0xFF,
+			Track0S0Encoding:    ENC_ISOIBM_MFM,
+			Track0S1AltEncoding: 0xFF,
+			Track0S1Encoding:    ENC_ISOIBM_MFM,
+		},
+		Tracks: make([]TrackData, cylinders),
+	}
+	if sectorsPerTrack > 11 {
+		// High density
+		disk.Header.BitRate = 500
+		disk.Header.FloppyInterfaceMode = IFM_AtariST_HD
+	}
+
+	// Max track length in MFM bits
+	maxHalfBits := int(disk.Header.BitRate) * 1000 * 60 / int(disk.Header.FloppyRPM) * 2
+
+	trackSize := sectorsPerTrack * sectorSize
+	pos := msaHeaderSize
+	for cyl := startTrack; cyl <= endTrack; cyl++ {
+		for head := 0; head < sides; head++ {
+			if pos+2 > len(data) {
+				return nil, fmt.Errorf("unexpected end of file at track %d.%d", cyl, head)
+			}
+			length := int(binary.BigEndian.Uint16(data[pos : pos+2]))
+			pos += 2
+			if pos+length > len(data) {
+				return nil, fmt.Errorf("track %d.%d: record of %d bytes exceeds file size", cyl, head, length)
+			}
+			record := data[pos : pos+length]
+			pos += length
+
+			trackData := record
+			if length != trackSize {
+				trackData, err = msaDecompress(record, trackSize)
+				if err != nil {
+					return nil, fmt.Errorf("track %d.%d: %w", cyl, head, err)
+				}
+			}
+
+			// Split track into sectors
+			trackSectors := make([][]byte, sectorsPerTrack)
+			for s := 0; s < sectorsPerTrack; s++ {
+				trackSectors[s] = trackData[s*sectorSize : (s+1)*sectorSize]
+			}
+
+			// Encode track to MFM
+			writer := mfm.NewWriter(maxHalfBits)
+			writer.Interleave = Interleave
+			writer.Skew = TrackSkew
+			mfmData := writer.EncodeTrackIBMPC(trackSectors, cyl, head, sectorsPerTrack, disk.Header.BitRate)
+
+			// Store in appropriate side
+			if head == 0 {
+				disk.Tracks[cyl].Side0 = mfmData
+			} else {
+				disk.Tracks[cyl].Side1 = mfmData
+			}
+		}
+	}
+	return disk, nil
+}
+
+// Expand run-length encoded track record to size bytes.
+func msaDecompress(record []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for i := 0; i < len(record); {
+		if record[i] != msaRunMarker {
+			out = append(out, record[i])
+			i++
+			continue
+		}
+		if i+4 > len(record) {
+			return nil, fmt.Errorf("truncated run at offset %d", i)
+		}
+		value := record[i+1]
+		count := int(binary.BigEndian.Uint16(record[i+2 : i+4]))
+		if len(out)+count > size {
+			return nil, fmt.Errorf("run at offset %d exceeds track size", i)
+		}
+		for j := 0; j < count; j++ {
+			out = append(out, value)
+		}
+		i += 4
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("decompressed to %d bytes, expected %d", len(out), size)
+	}
+	return out, nil
+}
+
+// Compress track data with run-length encoding.
+// Returns data as is when compression gives no gain.
+func msaCompress(data []byte) []byte {
+	var out []byte
+	for i := 0; i < len(data); {
+		run := 1
+		for i+run < len(data) && data[i+run] == data[i] && run < 0xFFFF {
+			run++
+		}
+		if run >= msaMinRun || data[i] == msaRunMarker {
+			// Marker byte itself can only be stored as a run
+			out = append(out, msaRunMarker, data[i], byte(run>>8), byte(run))
+			i += run
+			continue
+		}
+		out = append(out, data[i:i+run]...)
+		i += run
+	}
+	if len(out) >= len(data) {
+		return data
+	}
+	return out
+}
+
+// WriteMSA writes a Disk structure to a file in MSA format.
+// Empty tracks at the start of the disk are not stored,
+// and other empty tracks are filled with zeros.
+func WriteMSA(filename string, disk *Disk) error {
+	// Figure out disk geometry
+	numCylinders := int(disk.Header.NumberOfTrack)
+	numHeads := int(disk.Header.NumberOfSide)
+	startTrack := 0
+	for startTrack < numCylinders && len(disk.Tracks[startTrack].Side0) == 0 {
+		startTrack++
+	}
+	if startTrack == numCylinders {
+		return fmt.Errorf("disk has no data")
+	}
+	if numCylinders-1 > msaMaxTrack {
+		return fmt.Errorf("too many cylinders for MSA: %d", numCylinders)
+	}
+	if numHeads < 1 || numHeads > 2 {
+		return fmt.Errorf("invalid number of heads: %d", numHeads)
+	}
+	numSectorsPerTrack := countSectors(disk.Tracks[startTrack].Side0)
+	if numSectorsPerTrack == 0 {
+		return fmt.Errorf("no sectors found on track %d.0", startTrack)
+	}
+
+	// Create output file
+	file, err := createAtomic(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	header := make([]byte, msaHeaderSize)
+	binary.BigEndian.PutUint16(header[0:2], msaSignature)
+	binary.BigEndian.PutUint16(header[2:4], uint16(numSectorsPerTrack))
+	binary.BigEndian.PutUint16(header[4:6], uint16(numHeads-1))
+	binary.BigEndian.PutUint16(header[6:8], uint16(startTrack))
+	binary.BigEndian.PutUint16(header[8:10], uint16(numCylinders-1))
+	if _, err := file.Write(header); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	for cyl := startTrack; cyl < numCylinders; cyl++ {
+		for head := 0; head < numHeads; head++ {
+			sideData := disk.Tracks[cyl].side(head)
+
+			// Extract all sectors from track (may appear in any order)
+			reader := mfm.NewReader(sideData)
+			reader.Tolerance = IDTolerance
+			sectors := make(map[int][]byte)
+			for len(sectors) < numSectorsPerTrack && len(sideData) > 0 {
+				sectorNum, sectorData, err := reader.ReadSectorIBMPC(cyl, head)
+				if err != nil {
+					// End of track or error
+					break
+				}
+				if sectorNum < 0 || sectorNum >= numSectorsPerTrack {
+					continue
+				}
+				sectors[sectorNum] = sectorData
+			}
+
+			// Collect sectors in sequential order
+			trackData := make([]byte, 0, numSectorsPerTrack*sectorSize)
+			for s := 0; s < numSectorsPerTrack; s++ {
+				sectorData, found := sectors[s]
+				if !found {
+					if len(sideData) > 0 {
+						return fmt.Errorf("missing sector %d of track %d.%d", s, cyl, head)
+					}
+					// No data captured: fill with zeros
+					sectorData = make([]byte, sectorSize)
+				}
+				trackData = append(trackData, sectorData...)
+			}
+
+			record := msaCompress(trackData)
+			var length [2]byte
+			binary.BigEndian.PutUint16(length[:], uint16(len(record)))
+			if _, err := file.Write(length[:]); err != nil {
+				return fmt.Errorf("failed to write track %d.%d: %w", cyl, head, err)
+			}
+			if _, err := file.Write(record); err != nil {
+				return fmt.Errorf("failed to write track %d.%d: %w", cyl, head, err)
+			}
+		}
+	}
+	return file.Commit()
+}
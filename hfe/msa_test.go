@@ -0,0 +1,152 @@
+package hfe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Build MSA image with one uncompressed track of random data,
+// followed by compressed tracks of mostly zeros.
+func makeTestMSA(sectorsPerTrack, sides, startTrack, endTrack int) (msa []byte, tracks [][]byte) {
+	trackSize := sectorsPerTrack * sectorSize
+	msa = binary.BigEndian.AppendUint16(msa, msaSignature)
+	msa = binary.BigEndian.AppendUint16(msa, uint16(sectorsPerTrack))
+	msa = binary.BigEndian.AppendUint16(msa, uint16(sides-1))
+	msa = binary.BigEndian.AppendUint16(msa, uint16(startTrack))
+	msa = binary.BigEndian.AppendUint16(msa, uint16(endTrack))
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < (endTrack-startTrack+1)*sides; i++ {
+		data := make([]byte, trackSize)
+		if i == 0 {
+			rng.Read(data)
+			msa = binary.BigEndian.AppendUint16(msa, uint16(trackSize))
+			msa = append(msa, data...)
+		} else {
+			// Run of 100 zeros, single marker byte, run of 99 zeros,
+			// short literal, then zeros till the end of track
+			data[100] = msaRunMarker
+			copy(data[200:], []byte{byte(i), 2, 3})
+			record := []byte{
+				msaRunMarker, 0, 0, 100,
+				msaRunMarker, msaRunMarker, 0, 1,
+				msaRunMarker, 0, 0, 99,
+				byte(i), 2, 3,
+				msaRunMarker, 0, byte((trackSize - 203) >> 8), byte(trackSize - 203),
+			}
+			msa = binary.BigEndian.AppendUint16(msa, uint16(len(record)))
+			msa = append(msa, record...)
+		}
+		tracks = append(tracks, data)
+	}
+	return msa, tracks
+}
+
+func TestReadWriteMSA(t *testing.T) {
+	testCases := []struct {
+		name       string
+		sectors    int
+		sides      int
+		startTrack int
+		endTrack   int
+		bitRate    uint16
+		mode       uint8
+	}{
+		{"single sided", 9, 1, 0, 1, 250, IFM_AtariST_DD},
+		{"11 sectors", 11, 2, 0, 2, 250, IFM_AtariST_DD},
+		{"high density", 18, 2, 0, 1, 500, IFM_AtariST_HD},
+		{"partial", 9, 2, 3, 4, 250, IFM_AtariST_DD},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			msa, tracks := makeTestMSA(tc.sectors, tc.sides, tc.startTrack, tc.endTrack)
+			msaFile := filepath.Join(dir, "disk.msa")
+			if err := os.WriteFile(msaFile, msa, 0644); err != nil {
+				t.Fatalf("WriteFile() error: %v", err)
+			}
+
+			disk, err := Read(msaFile)
+			if err != nil {
+				t.Fatalf("Read() error: %v", err)
+			}
+			if int(disk.Header.NumberOfTrack) != tc.endTrack+1 || int(disk.Header.NumberOfSide) != tc.sides {
+				t.Errorf("geometry %d/%d, expected %d/%d",
+					disk.Header.NumberOfTrack, disk.Header.NumberOfSide, tc.endTrack+1, tc.sides)
+			}
+			if disk.Header.FloppyInterfaceMode != tc.mode || disk.Header.BitRate != tc.bitRate {
+				t.Errorf("interface mode %d, bit rate %d, expected %d, %d",
+					disk.Header.FloppyInterfaceMode, disk.Header.BitRate, tc.mode, tc.bitRate)
+			}
+			if tc.startTrack > 0 && len(disk.Tracks[0].Side0) != 0 {
+				t.Errorf("track 0 before start of image is not empty")
+			}
+
+			// Round trip through HFE
+			hfeFile := filepath.Join(dir, "disk.hfe")
+			if err := Write(hfeFile, disk); err != nil {
+				t.Fatalf("Write() HFE error: %v", err)
+			}
+			disk, err = Read(hfeFile)
+			if err != nil {
+				t.Fatalf("Read() HFE error: %v", err)
+			}
+			for i, want := range tracks {
+				cyl := tc.startTrack + i/tc.sides
+				head := i % tc.sides
+				var got []byte
+				for s := 1; s <= tc.sectors; s++ {
+					data, err := disk.ReadSector(cyl, head, s)
+					if err != nil {
+						t.Fatalf("ReadSector(%d, %d, %d) error: %v", cyl, head, s, err)
+					}
+					got = append(got, data...)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("track %d.%d differs", cyl, head)
+				}
+			}
+
+			// Written image is identical to the original
+			outFile := filepath.Join(dir, "out.msa")
+			if err := Write(outFile, disk); err != nil {
+				t.Fatalf("Write() MSA error: %v", err)
+			}
+			out, err := os.ReadFile(outFile)
+			if err != nil {
+				t.Fatalf("ReadFile() error: %v", err)
+			}
+			if !bytes.Equal(out, msa) {
+				t.Errorf("written MSA image differs from original")
+			}
+		})
+	}
+}
+
+func TestReadMSA_Invalid(t *testing.T) {
+	valid, _ := makeTestMSA(9, 1, 0, 1)
+	badRun := bytes.Clone(valid)
+	badRun[len(badRun)-1]++ // Last run is too long
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"short header", valid[:6]},
+		{"bad signature", append([]byte{0x12, 0x34}, valid[2:]...)},
+		{"truncated", valid[:len(valid)-10]},
+		{"bad run", badRun},
+	}
+	for _, tc := range testCases {
+		filename := filepath.Join(t.TempDir(), "disk.msa")
+		if err := os.WriteFile(filename, tc.data, 0644); err != nil {
+			t.Fatalf("WriteFile() error: %v", err)
+		}
+		if _, err := ReadMSA(filename); err == nil {
+			t.Errorf("%s: ReadMSA() succeeded, expected error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package hfe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// OpenImage reads a disk image file of any supported format and returns
+// a Disk structure together with the detected format.
+// The format is recognized by signature when possible (HFE, IMD, 86F),
+// then by file extension, and finally by size of a raw sector image.
+// Files with .gz suffix are decompressed transparently.
+func OpenImage(filename string) (*Disk, ImageFormat, error) {
+	disk, format, err := openImage(filename)
+	if err != nil {
+		return nil, format, err
+	}
+	warnHeader(filename, disk)
+	return disk, format, nil
+}
+
+// Read a disk image file of any supported format, without warnings.
+func openImage(filename string) (*Disk, ImageFormat, error) {
+	format, err := sniffImageFormat(filename)
+	if err != nil {
+		return nil, ImageFormatUnknown, err
+	}
+	if format == ImageFormatUnknown {
+		return nil, ImageFormatUnknown, fmt.Errorf("unknown or unsupported image format for file: %s", filename)
+	}
+
+	disk, err := readFormat(filename, format)
+	if err != nil {
+		return nil, format, err
+	}
+	return disk, format, nil
+}
+
+// Detect image format from the first bytes of the file,
+// falling back to the extension of the name and to the file size.
+// Compressed file is detected by its contents.
+func sniffImageFormat(filename string) (ImageFormat, error) {
+	file, err := openImageFile(filename)
+	if err != nil {
+		return ImageFormatUnknown, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 8)
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return ImageFormatUnknown, fmt.Errorf("failed to read file: %w", err)
+	}
+	magic = magic[:n]
+	switch {
+	case bytes.Equal(magic, []byte(HFEv1Signature)), bytes.Equal(magic, []byte(HFEv3Signature)):
+		return ImageFormatHFE, nil
+	case bytes.HasPrefix(magic, []byte("IMD ")):
+		return ImageFormatIMD, nil
+	case bytes.HasPrefix(magic, []byte(d86fSignature)):
+		return ImageFormat86F, nil
+	}
+
+	if format := DetectImageFormat(trimGzipSuffix(filename)); format != ImageFormatUnknown {
+		return format, nil
+	}
+
+	// Raw sector image of a known size
+	size, err := file.Size()
+	if err != nil {
+		return ImageFormatUnknown, err
+	}
+	if _, _, _, err := mfm.DetectFormatFromSize(size); err == nil {
+		return ImageFormatIMG, nil
+	}
+	return ImageFormatUnknown, nil
+}
@@ -0,0 +1,67 @@
+package hfe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenImage(t *testing.T) {
+	tests := []struct {
+		filename string
+		format   ImageFormat
+	}{
+		{"fat12v1.hfe", ImageFormatHFE},
+		{"fat360.hfe.gz", ImageFormatHFE},
+		{"fat360.imd", ImageFormatIMD},
+		{"fat360.img.gz", ImageFormatIMG},
+	}
+	for _, tc := range tests {
+		sampleFile := findSampleFile(t, tc.filename)
+		disk, format, err := OpenImage(sampleFile)
+		if err != nil {
+			t.Fatalf("OpenImage(%s) error: %v", tc.filename, err)
+		}
+		if format != tc.format {
+			t.Errorf("OpenImage(%s) format = %v, expected %v", tc.filename, format, tc.format)
+		}
+		if len(disk.Tracks) == 0 {
+			t.Errorf("OpenImage(%s) returned no tracks", tc.filename)
+		}
+	}
+}
+
+func TestOpenImage_Sniff(t *testing.T) {
+	dir := t.TempDir()
+
+	// HFE contents under a misleading name
+	data, err := os.ReadFile(findSampleFile(t, "fat12v3.hfe"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	hfeFile := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(hfeFile, data, 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	if _, format, err := OpenImage(hfeFile); err != nil || format != ImageFormatHFE {
+		t.Errorf("OpenImage() = %v, %v, expected HFE", format, err)
+	}
+
+	// Raw 360k image without extension
+	rawFile := filepath.Join(dir, "disk")
+	if err := os.WriteFile(rawFile, make([]byte, 360*1024), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	if _, format, err := OpenImage(rawFile); err != nil || format != ImageFormatIMG {
+		t.Errorf("OpenImage() = %v, %v, expected IMG", format, err)
+	}
+
+	// Unknown contents
+	junkFile := filepath.Join(dir, "junk")
+	if err := os.WriteFile(junkFile, []byte("junk"), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	if _, _, err := OpenImage(junkFile); err == nil {
+		t.Errorf("OpenImage() expected error for unknown format")
+	}
+}
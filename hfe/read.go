@@ -1,26 +1,67 @@
 package hfe
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"strings"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// SingleSidedLayout describes placement of side 0 in track blocks
+// of single-sided HFE v1 files.
+type SingleSidedLayout int
+
+const (
+	SingleSidedAuto        SingleSidedLayout = iota // Choose the layout which gives more good sectors
+	SingleSidedInterleaved                          // First half of every block, as both sides are stored
+	SingleSidedContiguous                           // Whole blocks, with track length of one side, as written by older HxC tools
 )
 
+// Layout of single-sided HFE v1 files, for files which are not detected properly
+var SingleSidedV1Layout = SingleSidedAuto
+
 // Read a disk image file and return a Disk structure.
 // The format is automatically detected from the file extension.
+// Problems found in the header are reported as warnings.
 func Read(filename string) (*Disk, error) {
-	format := DetectImageFormat(filename)
+	disk, err := readFormat(filename, DetectImageFormat(filename))
+	if err != nil {
+		return nil, err
+	}
+	warnHeader(filename, disk)
+	return disk, nil
+}
+
+// Report problems found in the header as warnings.
+func warnHeader(filename string, disk *Disk) {
+	if err := disk.Header.Validate(); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("Warning: %s: %s\n", filename, line)
+		}
+	}
+}
+
+// Read a disk image file in the given format.
+func readFormat(filename string, format ImageFormat) (*Disk, error) {
 	switch format {
 	case ImageFormatHFE:
 		return ReadHFE(filename)
+	case ImageFormat86F:
+		return Read86F(filename)
+	case ImageFormatA2R:
+		return ReadA2R(filename)
 	case ImageFormatADF:
 		return ReadADF(filename)
 	case ImageFormatBKD:
 		return ReadBKD(filename)
 	case ImageFormatCP2:
 		return ReadCP2(filename)
+	case ImageFormatD64:
+		return ReadD64(filename)
 	case ImageFormatDCF:
 		return ReadDCF(filename)
 	case ImageFormatEPL:
@@ -31,6 +72,8 @@ func Read(filename string) (*Disk, error) {
 		return ReadIMG(filename)
 	case ImageFormatMFM:
 		return ReadMFM(filename)
+	case ImageFormatMSA:
+		return ReadMSA(filename)
 	case ImageFormatPDI:
 		return ReadPDI(filename)
 	case ImageFormatPRI:
@@ -53,18 +96,25 @@ func Read(filename string) (*Disk, error) {
 //
 // v2 format is not supported and will return an error
 func ReadHFE(filename string) (*Disk, error) {
-	file, err := os.Open(filename)
+	file, err := openImageFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, err
 	}
 	defer file.Close()
 
 	disk := &Disk{}
 
-	// Read header
-	if err := binary.Read(file, binary.LittleEndian, &disk.Header); err != nil {
+	// Header and track list usually fit in first two blocks
+	prefix := make([]byte, 2*BlockSize)
+	n, err := io.ReadFull(file, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF {
 		return nil, fmt.Errorf("failed to read header: %w", err)
 	}
+	prefix = prefix[:n]
+	if n < headerSize {
+		return nil, fmt.Errorf("failed to read header: %w", io.ErrUnexpectedEOF)
+	}
+	disk.Header = parseHeader(prefix)
 
 	// Validate signature - support v1 (HXCPICFE) and v3 (HXCHFEV3)
 	sig := string(disk.Header.HeaderSignature[:])
@@ -102,19 +152,26 @@ func ReadHFE(filename string) (*Disk, error) {
 	if disk.Header.NumberOfSide == 0 {
 		return nil, errors.New("invalid number of sides")
 	}
+	if err := Limits.checkTracks(int(disk.Header.NumberOfTrack)); err != nil {
+		return nil, err
+	}
 
-	// Read track offset list
-	trackListOffset := int64(disk.Header.TrackListOffset) * BlockSize
-	if _, err := file.Seek(trackListOffset, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to track list: %w", err)
+	fileSize, err := file.Size()
+	if err != nil {
+		return nil, err
 	}
 
-	trackHeaders := make([]TrackHeader, disk.Header.NumberOfTrack)
-	for i := range trackHeaders {
-		if err := binary.Read(file, binary.LittleEndian, &trackHeaders[i]); err != nil {
-			return nil, fmt.Errorf("failed to read track header %d: %w", i, err)
-		}
+	// Read track offset list
+	trackListOffset := int(disk.Header.TrackListOffset) * BlockSize
+	trackList := make([]byte, int(disk.Header.NumberOfTrack)*trackHeaderSize)
+	if trackListOffset+len(trackList) <= len(prefix) {
+		copy(trackList, prefix[trackListOffset:])
+	} else if int64(trackListOffset+len(trackList)) > fileSize {
+		return nil, fmt.Errorf("track list at offset %d is past end of file", trackListOffset)
+	} else if _, err := file.ReadAt(trackList, int64(trackListOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read track list: %w", err)
 	}
+	trackHeaders := parseTrackList(trackList)
 
 	// Initialize tracks
 	disk.Tracks = make([]TrackData, disk.Header.NumberOfTrack)
@@ -122,9 +179,25 @@ func ReadHFE(filename string) (*Disk, error) {
 	// Determine if we need to process opcodes (only for v3)
 	shouldProcessOpcodes := isV3
 
-	// Read each track
+	// Read each track, within limits of track length and total size
+	reader := newTrackReader(file, int64(n))
+	total := int64(0)
 	for i := range trackHeaders {
-		trackData, err := readTrack(file, &trackHeaders[i], disk.Header.NumberOfSide, shouldProcessOpcodes)
+		trackLen := fullTrackLen(trackHeaders, i, fileSize)
+		if int64(trackHeaders[i].Offset)*BlockSize+int64(trackLen) > fileSize {
+			return nil, fmt.Errorf("track %d is past end of file", i)
+		}
+		if trackLen > maxTrackLen {
+			// Length of long track is not stored in the file: check it against rates
+			if err := Limits.checkTrackLen(trackLen/2, disk.Header.BitRate, disk.Header.FloppyRPM); err != nil {
+				return nil, fmt.Errorf("track %d: %w", i, err)
+			}
+		}
+		total += int64(trackLen)
+		if err := Limits.checkDiskBytes(total); err != nil {
+			return nil, err
+		}
+		trackData, err := readTrack(reader, &trackHeaders[i], trackLen, disk.Header.NumberOfSide, shouldProcessOpcodes)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read track %d: %w", i, err)
 		}
@@ -154,54 +227,188 @@ func ReadHFE(filename string) (*Disk, error) {
 	return disk, nil
 }
 
-// readTrack reads a single track from the file
-// shouldProcessOpcodes indicates whether to process HFEv3 opcodes (true for v3, false for v1)
-func readTrack(file *os.File, th *TrackHeader, numSides uint8, shouldProcessOpcodes bool) (*TrackData, error) {
-	// Calculate track length (rounded up to 512-byte boundary)
+// Size of header fields in the first block of HFE file
+const headerSize = 26
+
+// Size of one entry of the track list
+const trackHeaderSize = 4
+
+// Decode header fields from the start of HFE file.
+// Layout matches the one written by Writer.
+func parseHeader(buf []byte) Header {
+	var header Header
+	copy(header.HeaderSignature[:], buf[0:8])
+	header.FormatRevision = buf[8]
+	header.NumberOfTrack = buf[9]
+	header.NumberOfSide = buf[10]
+	header.TrackEncoding = buf[11]
+	header.BitRate = binary.LittleEndian.Uint16(buf[12:14])
+	header.FloppyRPM = binary.LittleEndian.Uint16(buf[14:16])
+	header.FloppyInterfaceMode = buf[16]
+	header.WriteProtected = buf[17]
+	header.TrackListOffset = binary.LittleEndian.Uint16(buf[18:20])
+	header.WriteAllowed = buf[20]
+	header.SingleStep = buf[21]
+	header.Track0S0AltEncoding = buf[22]
+	header.Track0S0Encoding = buf[23]
+	header.Track0S1AltEncoding = buf[24]
+	header.Track0S1Encoding = buf[25]
+	return header
+}
+
+// Decode entries of the track list
+func parseTrackList(buf []byte) []TrackHeader {
+	trackHeaders := make([]TrackHeader, len(buf)/trackHeaderSize)
+	for i := range trackHeaders {
+		entry := buf[i*trackHeaderSize:]
+		trackHeaders[i].Offset = binary.LittleEndian.Uint16(entry[0:2])
+		trackHeaders[i].TrackLen = binary.LittleEndian.Uint16(entry[2:4])
+	}
+	return trackHeaders
+}
+
+// trackReader reads track data through a buffer.
+// Tracks are normally stored one after another, so seek
+// is needed only when the next track is somewhere else.
+type trackReader struct {
+	file  imageReader
+	buf   *bufio.Reader
+	pos   int64  // Current position in file
+	track []byte // Raw data of last track, reused for every track
+}
+
+func newTrackReader(file imageReader, pos int64) *trackReader {
+	return &trackReader{
+		file: file,
+		buf:  bufio.NewReaderSize(file, 8*BlockSize),
+		pos:  pos,
+	}
+}
+
+// Read length bytes of the file at given offset.
+// Returned data is valid until the next call.
+func (r *trackReader) read(offset int64, length int) ([]byte, error) {
+	if offset != r.pos {
+		if _, err := r.file.Seek(offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek to track data: %w", err)
+		}
+		r.buf.Reset(r.file)
+		r.pos = offset
+	}
+	if cap(r.track) < length {
+		r.track = make([]byte, length)
+	}
+	data := r.track[:length]
+	n, err := io.ReadFull(r.buf, data)
+	r.pos += int64(n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read track data: %w", err)
+	}
+	return data, nil
+}
+
+// Calculate length of the track, rounded up to 512-byte boundary.
+// Track list stores only low 16 bits of length. For tracks longer
+// than 64 kbytes, full length is recovered from the space
+// up to the next track, or up to the end of file.
+// This is non-standard: only files written by Writer have such tracks.
+func fullTrackLen(trackHeaders []TrackHeader, i int, fileSize int64) int {
+	th := trackHeaders[i]
 	trackLen := int(th.TrackLen)
 	if trackLen&0x1FF != 0 {
 		trackLen = (trackLen & ^0x1FF) + 0x200
 	}
 
-	// Seek to track data
-	trackOffset := int64(th.Offset) * BlockSize
-	if _, err := file.Seek(trackOffset, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to track data: %w", err)
+	start := int64(th.Offset) * BlockSize
+	end := fileSize
+	for _, next := range trackHeaders {
+		pos := int64(next.Offset) * BlockSize
+		if pos > start && pos < end {
+			end = pos
+		}
+	}
+	space := end - start
+	if th.TrackLen != 0 && space > 0xFFFF && space%BlockSize == 0 && uint16(space-int64(th.TrackLen)) < BlockSize {
+		return int(space)
+	}
+	return trackLen
+}
+
+// Calculate length of track data, from the length rounded up
+// to 512-byte boundary and low 16 bits of the exact length.
+// The rest of the last block is padding.
+func trackDataLen(th *TrackHeader, trackLen int) int {
+	pad := int(uint16(trackLen) - th.TrackLen)
+	if th.TrackLen == 0 || pad >= BlockSize {
+		return trackLen
 	}
+	return trackLen - pad
+}
+
+// Return nil for side with no data, or with only padding written
+// for a side without data: all ones, which is not valid MFM.
+func uncaptured(bits []byte) []byte {
+	for _, b := range bits {
+		if b != 0xFF {
+			return bits
+		}
+	}
+	return nil
+}
+
+// readTrack reads a single track of given length from the file
+// shouldProcessOpcodes indicates whether to process HFEv3 opcodes (true for v3, false for v1)
+func readTrack(reader *trackReader, th *TrackHeader, trackLen int, numSides uint8, shouldProcessOpcodes bool) (*TrackData, error) {
 
 	// Read track data
-	trackBuf := make([]byte, trackLen)
-	if _, err := io.ReadFull(file, trackBuf); err != nil {
-		return nil, fmt.Errorf("failed to read track data: %w", err)
+	trackBuf, err := reader.read(int64(th.Offset)*BlockSize, trackLen)
+	if err != nil {
+		return nil, err
 	}
 
 	// Demux sides: side 0 is bytes 0-255, side 1 is bytes 256-511 of each 512-byte block
 	// Apply byteBitsInverter during demuxing (convert from LSB-first to MSB-first)
 	side0Data := make([]byte, trackLen/2)
-	side1Data := make([]byte, trackLen/2)
+	var side1Data []byte
+	if numSides > 1 {
+		side1Data = make([]byte, trackLen/2)
+	}
+	for j := 0; j+BlockSize <= trackLen; j += BlockSize {
+		block := trackBuf[j : j+BlockSize]
+		invertBits(side0Data[j/2:j/2+256], block[:256])
+		if side1Data != nil {
+			invertBits(side1Data[j/2:j/2+256], block[256:])
+		}
+	}
 
-	for j := 0; j < trackLen; j += BlockSize {
-		for k := 0; k < 256; k++ {
-			side0Data[j/2+k] = byteBitsInverter[trackBuf[j+k]]
-			if numSides > 1 {
-				side1Data[j/2+k] = byteBitsInverter[trackBuf[j+256+k]]
-			}
+	// Drop padding of the last block: both sides have half of the data length
+	dataLen := trackDataLen(th, trackLen)
+	side0Data = side0Data[:dataLen/2]
+	if side1Data != nil {
+		side1Data = side1Data[:dataLen/2]
+	}
+
+	// Older tools store single side in whole blocks
+	if numSides == 1 && !shouldProcessOpcodes {
+		if whole := contiguousSide0(trackBuf[:dataLen], side0Data); whole != nil {
+			side0Data = whole
 		}
 	}
 
 	// Process opcodes for each side (only for v3 format)
 	var side0Bits, side1Bits []byte
-	var err error
+	var weak [2][]byte
+	var bitRate uint16
 
 	if shouldProcessOpcodes {
 		// v3 format: process opcodes
-		side0Bits, err = processOpcodes(side0Data)
+		side0Bits, weak[0], bitRate, err = decodeOpcodes(side0Data)
 		if err != nil {
 			return nil, fmt.Errorf("failed to process opcodes for side 0: %w", err)
 		}
 
 		if numSides > 1 {
-			side1Bits, err = processOpcodes(side1Data)
+			side1Bits, weak[1], _, err = decodeOpcodes(side1Data)
 			if err != nil {
 				return nil, fmt.Errorf("failed to process opcodes for side 1: %w", err)
 			}
@@ -214,31 +421,84 @@ func readTrack(file *os.File, th *TrackHeader, numSides uint8, shouldProcessOpco
 		}
 	}
 
+	// Padding of a side without data means the side was not captured
+	side0Bits = uncaptured(side0Bits)
+	side1Bits = uncaptured(side1Bits)
+	if side0Bits == nil {
+		weak[0] = nil
+	}
+	if side1Bits == nil {
+		weak[1] = nil
+	}
+
 	return &TrackData{
-		Side0: side0Bits,
-		Side1: side1Bits,
+		Side0:    side0Bits,
+		Side1:    side1Bits,
+		BitRate:  bitRate,
+		WeakBits: weak,
 	}, nil
 }
 
+// Returns side 0 of a single-sided v1 track stored in whole blocks,
+// or nil when the track is interleaved as usual.
+func contiguousSide0(trackBuf, side0Data []byte) []byte {
+	if SingleSidedV1Layout == SingleSidedInterleaved {
+		return nil
+	}
+	whole := make([]byte, len(trackBuf))
+	invertBits(whole, trackBuf)
+	if SingleSidedV1Layout == SingleSidedContiguous || goodSectors(whole) > goodSectors(side0Data) {
+		return whole
+	}
+	return nil
+}
+
+// Count IBM PC sectors with correct data checksum, regardless of sector ID
+func goodSectors(bits []byte) int {
+	reader := mfm.NewReader(bits)
+	reader.Tolerance = mfm.IDIgnoreCylHead
+	count := 0
+	for {
+		sector, err := reader.ReadSectorInfoIBMPC(0, 0)
+		if err != nil {
+			return count
+		}
+		if !sector.Bad {
+			count++
+		}
+	}
+}
+
 // processOpcodes processes HFEv3 opcodes and extracts the MFM bitstream
 func processOpcodes(data []byte) ([]byte, error) {
+	result, _, _, err := decodeOpcodes(data)
+	return result, err
+}
+
+// decodeOpcodes processes HFEv3 opcodes and extracts the MFM bitstream.
+// Also returns weak mask of bytes given by RAND opcodes, or nil when none,
+// and bit rate in kbps from the first SETBITRATE opcode, or 0 when none.
+func decodeOpcodes(data []byte) ([]byte, []byte, uint16, error) {
 	// Allocate enough space for output (may be smaller than input due to opcodes)
 	newData := make([]byte, len(data))
-	// Initialize to zeros
-	for i := range newData {
-		newData[i] = 0
-	}
+	var newWeak []byte
 
 	bitrate := byte(0)
 	bitrates := make([]byte, len(data)+1)
+	trackBitRate := uint16(0)
 
 	inBit := 0
 	outBit := 0
 	indexBit := 0
 
-	for inBit/8 < len(data) {
+	// Every step consumes at least one byte, so the loop is bounded by input size
+	maxSteps := len(data) * Limits.OpcodeSteps
+	for step := 0; inBit/8 < len(data); step++ {
+		if step >= maxSteps {
+			return nil, nil, 0, fmt.Errorf("opcode processing: more than %d steps for %d bytes", maxSteps, len(data))
+		}
 		if inBit&7 != 0 {
-			return nil, errors.New("opcode processing: input not byte-aligned")
+			return nil, nil, 0, errors.New("opcode processing: input not byte-aligned")
 		}
 
 		bitrates[outBit/8] = bitrate
@@ -258,19 +518,22 @@ func processOpcodes(data []byte) ([]byte, error) {
 			case SETBITRATE_OPCODE & 0x0F:
 				// SETBITRATE: change bitrate
 				if inBit/8+1 >= len(data) {
-					return nil, errors.New("SETBITRATE opcode: insufficient data")
+					return nil, nil, 0, errors.New("SETBITRATE opcode: insufficient data")
 				}
 				bitrate = data[inBit/8+1]
+				if trackBitRate == 0 && bitrate != 0 {
+					trackBitRate = opcodeToBitRate(bitrate)
+				}
 				inBit += 16
 
 			case SKIPBITS_OPCODE & 0x0F:
 				// SKIPBITS: skip 0-8 bits in next byte, then copy remaining
 				if inBit/8+1 >= len(data) {
-					return nil, errors.New("SKIPBITS opcode: insufficient data")
+					return nil, nil, 0, errors.New("SKIPBITS opcode: insufficient data")
 				}
 				skip := data[inBit/8+1]
 				if skip > 8 {
-					return nil, fmt.Errorf("SKIPBITS opcode: skip value %d > 8", skip)
+					return nil, nil, 0, fmt.Errorf("SKIPBITS opcode: skip value %d > 8", skip)
 				}
 				// Skip the opcode byte and skip value byte, then skip bits
 				inBit += 16 + int(skip)
@@ -280,26 +543,20 @@ func processOpcodes(data []byte) ([]byte, error) {
 				outBit += 8 - int(skip)
 
 			case RAND_OPCODE & 0x0F:
-				// RAND: random/weak byte - write zeros (or could use random data)
-				// For now, write zeros to maintain track length
+				// RAND: random/weak byte - write zeros, and mark them weak
 				inBit += 8
-				// Write 8 zero bits
+				if newWeak == nil {
+					newWeak = make([]byte, len(data))
+				}
+				setWeakBits(newWeak, outBit, 8)
 				outBit += 8
 
 			default:
-				return nil, fmt.Errorf("unknown opcode: 0x%02X", opc)
+				return nil, nil, 0, fmt.Errorf("unknown opcode: 0x%02X", opc)
 			}
 		} else {
 			// Regular data byte - copy 8 bits
-			// Check if this byte was escaped (XORed with 0x90 during encoding)
-			// Bytes in 0x60-0x6F range might be escaped opcodes (0xF0-0xFF XOR 0x90)
-			dataByte := data[inBit/8]
-			// XOR-back if in the escaped range (0x60-0x6F)
-			// This recovers bytes that were in 0xF0-0xFF range (except 0xF4)
-			if dataByte >= 0x60 && dataByte <= 0x6F {
-				dataByte ^= 0x90
-			}
-			bitCopy(newData, outBit, []byte{dataByte}, 0, 8)
+			bitCopy(newData, outBit, data, inBit, 8)
 			inBit += 8
 			outBit += 8
 		}
@@ -310,15 +567,24 @@ func processOpcodes(data []byte) ([]byte, error) {
 
 	// Rotate track so index pulse is at bit 0
 	// If no index was found, indexBit will be 0 (start of track)
+	result := rotateBitsAt(newData, lenBits, indexBit)
+	var weak []byte
+	if newWeak != nil {
+		weak = rotateBitsAt(newWeak, lenBits, indexBit)
+	}
+	return result, weak, trackBitRate, nil
+}
+
+// Copy lenBits bits of data, rotated to start at the given bit position
+func rotateBitsAt(data []byte, lenBits, indexBit int) []byte {
 	result := make([]byte, (lenBits+7)/8)
 	if indexBit < lenBits {
 		// Copy from index to end, then from start to index
-		bitCopy(result, 0, newData, indexBit, lenBits-indexBit)
-		bitCopy(result, lenBits-indexBit, newData, 0, indexBit)
+		bitCopy(result, 0, data, indexBit, lenBits-indexBit)
+		bitCopy(result, lenBits-indexBit, data, 0, indexBit)
 	} else {
 		// No index found, just copy data as-is
-		copy(result, newData[:lenBits/8])
+		copy(result, data[:lenBits/8])
 	}
-
-	return result, nil
+	return result
 }
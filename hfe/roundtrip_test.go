@@ -0,0 +1,348 @@
+package hfe_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/sergev/floppy/flux"
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/hfe/hfetest"
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Report sector-level differences between two disks
+func checkSectors(t *testing.T, stage string, want, got *hfe.Disk) {
+	t.Helper()
+	diffs := hfetest.DiffSectors(want, got)
+	for i, diff := range diffs {
+		if i == 10 {
+			t.Errorf("%s: ... %d more differences", stage, len(diffs)-i)
+			break
+		}
+		t.Errorf("%s: %s", stage, diff)
+	}
+}
+
+// Read file contents, skipping IMD comment when requested
+func readData(t *testing.T, filename string, skipComment bool) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if skipComment {
+		data = data[bytes.IndexByte(data, 0x1A)+1:]
+	}
+	return data
+}
+
+// Geometries for round trip tests: all of them, or a few
+// typical ones in short mode. ED is covered by TestRoundTrip_ED.
+func testGeometries() []hfetest.Geometry {
+	if !testing.Short() {
+		return hfetest.Geometries
+	}
+	return []hfetest.Geometry{
+		{Cylinders: 40, Sides: 1, SectorsPerTrack: 8},
+		{Cylinders: 80, Sides: 2, SectorsPerTrack: 9},
+		{Cylinders: 80, Sides: 2, SectorsPerTrack: 18},
+	}
+}
+
+// IMG -> Disk -> HFE v1/v3 -> Disk -> IMG must keep every sector.
+func TestRoundTrip_IMG(t *testing.T) {
+	for i, g := range testGeometries() {
+		t.Run(g.String(), func(t *testing.T) {
+			disk := hfetest.RandomDisk(int64(i+1), g, false)
+			dir := t.TempDir()
+
+			imgFile := filepath.Join(dir, "disk.img")
+			if err := hfe.WriteIMG(imgFile, disk); err != nil {
+				t.Fatalf("WriteIMG() error: %v", err)
+			}
+			imgDisk, err := hfe.ReadIMG(imgFile)
+			if err != nil {
+				t.Fatalf("ReadIMG() error: %v", err)
+			}
+			checkSectors(t, "IMG", disk, imgDisk)
+
+			for _, version := range []hfe.HFEVersion{hfe.HFEVersion1, hfe.HFEVersion3} {
+				hfeFile := filepath.Join(dir, "disk.hfe")
+				if err := hfe.WriteHFE(hfeFile, imgDisk, version); err != nil {
+					t.Fatalf("WriteHFE(v%d) error: %v", version, err)
+				}
+				hfeDisk, err := hfe.Read(hfeFile)
+				if err != nil {
+					t.Fatalf("Read(v%d) error: %v", version, err)
+				}
+				checkSectors(t, "HFE", disk, hfeDisk)
+
+				outFile := filepath.Join(dir, "out.img")
+				if err := hfe.WriteIMG(outFile, hfeDisk); err != nil {
+					t.Fatalf("WriteIMG() error: %v", err)
+				}
+				if !bytes.Equal(readData(t, outFile, false), readData(t, imgFile, false)) {
+					t.Errorf("IMG after HFE v%d differs from original", version)
+				}
+			}
+		})
+	}
+}
+
+// IMD -> Disk -> IMD must keep every sector, including deleted marks.
+// IMD has no mode for 1 Mbps, so ED disks are not tested.
+func TestRoundTrip_IMD(t *testing.T) {
+	for i, g := range testGeometries() {
+		if g.SectorsPerTrack > 20 {
+			continue
+		}
+		t.Run(g.String(), func(t *testing.T) {
+			disk := hfetest.RandomDisk(int64(100+i), g, true)
+			dir := t.TempDir()
+
+			imdFile := filepath.Join(dir, "disk.imd")
+			if err := hfe.WriteIMD(imdFile, disk); err != nil {
+				t.Fatalf("WriteIMD() error: %v", err)
+			}
+			imdDisk, err := hfe.ReadIMD(imdFile)
+			if err != nil {
+				t.Fatalf("ReadIMD() error: %v", err)
+			}
+			checkSectors(t, "IMD", disk, imdDisk)
+
+			outFile := filepath.Join(dir, "out.imd")
+			if err := hfe.WriteIMD(outFile, imdDisk); err != nil {
+				t.Fatalf("WriteIMD() error: %v", err)
+			}
+			if !bytes.Equal(readData(t, outFile, true), readData(t, imdFile, true)) {
+				t.Errorf("IMD after round trip differs from original")
+			}
+		})
+	}
+}
+
+// 2.88M IMG -> Disk -> HFE v3 -> flux -> PLL -> Disk -> IMG must keep
+// every sector. Flux has 500 nsec bitcells with jitter, and the bit rate
+// is detected from flux, as when reading a real ED disk.
+func TestRoundTrip_ED(t *testing.T) {
+	g := hfetest.Geometry{Cylinders: 80, Sides: 2, SectorsPerTrack: 36}
+	disk := hfetest.RandomDisk(288, g, false)
+	dir := t.TempDir()
+
+	imgFile := filepath.Join(dir, "disk.img")
+	if err := hfe.WriteIMG(imgFile, disk); err != nil {
+		t.Fatalf("WriteIMG() error: %v", err)
+	}
+	if size := len(readData(t, imgFile, false)); size != 2949120 {
+		t.Fatalf("IMG file of %d bytes, expected 2.88M", size)
+	}
+	imgDisk, err := hfe.ReadIMG(imgFile)
+	if err != nil {
+		t.Fatalf("ReadIMG() error: %v", err)
+	}
+	if imgDisk.Header.BitRate != 1000 || imgDisk.Header.FloppyInterfaceMode != hfe.IFM_IBMPC_ED {
+		t.Fatalf("IMG read as %d kbps, interface mode %d", imgDisk.Header.BitRate, imgDisk.Header.FloppyInterfaceMode)
+	}
+
+	hfeFile := filepath.Join(dir, "disk.hfe")
+	if err := hfe.WriteHFE(hfeFile, imgDisk, hfe.HFEVersion3); err != nil {
+		t.Fatalf("WriteHFE() error: %v", err)
+	}
+	hfeDisk, err := hfe.Read(hfeFile)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	checkSectors(t, "HFE", disk, hfeDisk)
+
+	// Pass every track through flux and PLL, or every eighth
+	// cylinder in short mode
+	step := 1
+	if testing.Short() {
+		step = 8
+	}
+	rng := rand.New(rand.NewSource(1))
+	for cyl := 0; cyl < len(hfeDisk.Tracks); cyl += step {
+		for head := 0; head < g.Sides; head++ {
+			side := &hfeDisk.Tracks[cyl].Side0
+			if head == 1 {
+				side = &hfeDisk.Tracks[cyl].Side1
+			}
+			transitions, err := mfm.GenerateFluxTransitions(*side, hfeDisk.Header.BitRate)
+			if err != nil {
+				t.Fatalf("GenerateFluxTransitions() error: %v", err)
+			}
+			track := &flux.FluxTrack{IndexPulses: []uint64{0, 200000000}}
+			for _, tr := range transitions {
+				track.Transitions = append(track.Transitions, tr+uint64(rng.Intn(100)))
+			}
+			bitRate := track.EstimateBitRateKbps()
+			if bitRate != 1000 {
+				t.Fatalf("track %d.%d: detected %d kbps", cyl, head, bitRate)
+			}
+			*side, err = track.DecodeMFM(bitRate, pll.Config{})
+			if err != nil {
+				t.Fatalf("DecodeMFM() error: %v", err)
+			}
+		}
+	}
+	checkSectors(t, "flux", disk, hfeDisk)
+
+	outFile := filepath.Join(dir, "out.img")
+	if err := hfe.WriteIMG(outFile, hfeDisk); err != nil {
+		t.Fatalf("WriteIMG() error: %v", err)
+	}
+	if !bytes.Equal(readData(t, outFile, false), readData(t, imgFile, false)) {
+		t.Errorf("IMG after flux differs from original")
+	}
+}
+
+// A track without data must survive every writer and reader: track-level
+// formats give it back empty, sector images give it back filled with zeros.
+// Neighbouring tracks must keep their sectors.
+func TestEmptyTrack_Matrix(t *testing.T) {
+	const empty = 5
+	g := hfetest.Geometry{Cylinders: 80, Sides: 2, SectorsPerTrack: 9}
+	disk := hfetest.RandomDisk(5, g, false)
+	disk.Tracks[empty] = hfe.TrackData{}
+
+	formats := []struct {
+		name    string
+		write   func(string, *hfe.Disk) error
+		read    func(string) (*hfe.Disk, error)
+		sectors bool // Sector image: empty track is filled with zeros
+	}{
+		{"hfe1", func(f string, d *hfe.Disk) error { return hfe.WriteHFE(f, d, hfe.HFEVersion1) }, hfe.ReadHFE, false},
+		{"hfe3", func(f string, d *hfe.Disk) error { return hfe.WriteHFE(f, d, hfe.HFEVersion3) }, hfe.ReadHFE, false},
+		{"imd", hfe.WriteIMD, hfe.ReadIMD, false},
+		{"86f", hfe.Write86F, hfe.Read86F, false},
+		{"img", hfe.WriteIMG, hfe.ReadIMG, true},
+		{"msa", hfe.WriteMSA, hfe.ReadMSA, true},
+	}
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "disk."+f.name)
+			if err := f.write(filename, disk); err != nil {
+				t.Fatalf("write error: %v", err)
+			}
+			got, err := f.read(filename)
+			if err != nil {
+				t.Fatalf("read error: %v", err)
+			}
+			if len(got.Tracks) <= empty {
+				t.Fatalf("read %d tracks", len(got.Tracks))
+			}
+
+			track := &got.Tracks[empty]
+			if !f.sectors {
+				if !track.Empty() {
+					t.Errorf("track %d: %d+%d bytes, expected empty", empty, len(track.Side0), len(track.Side1))
+				}
+			} else {
+				for key, s := range hfetest.Sectors(got) {
+					if key.Cyl == empty && !bytes.Equal(s.Data, make([]byte, len(s.Data))) {
+						t.Errorf("%s not filled with zeros", key)
+					}
+				}
+				*track = hfe.TrackData{}
+			}
+			checkSectors(t, f.name, disk, got)
+		})
+	}
+}
+
+// Sector images are written in the same order by any number of workers,
+// with progress for each side, and leave no file when cancelled.
+func TestWriteIMG_WriteIMD_Progress(t *testing.T) {
+	g := hfetest.Geometry{Cylinders: 20, Sides: 2, SectorsPerTrack: 9}
+	disk := hfetest.RandomDisk(11, g, false)
+	dir := t.TempDir()
+
+	write := map[string]func(filename string, ctx context.Context, progress func(done, total, sectors int)) error{
+		"img": func(filename string, ctx context.Context, progress func(done, total, sectors int)) error {
+			_, err := hfe.WriteIMGOptions(filename, disk, hfe.IMGOptions{Strict: true, Context: ctx, Progress: progress})
+			return err
+		},
+		"imd": func(filename string, ctx context.Context, progress func(done, total, sectors int)) error {
+			return hfe.WriteIMDOptions(filename, disk, hfe.IMDOptions{Context: ctx, Progress: progress})
+		},
+	}
+	for ext, fn := range write {
+		// Progress is reported for every side in order
+		parallel := filepath.Join(dir, "parallel."+ext)
+		calls := 0
+		err := fn(parallel, nil, func(done, total, sectors int) {
+			calls++
+			if done != calls || total != 40 || sectors != calls*9 {
+				t.Errorf("%s: progress %d/%d with %d sectors at call %d", ext, done, total, sectors, calls)
+			}
+		})
+		if err != nil {
+			t.Fatalf("%s: write error: %v", ext, err)
+		}
+		if calls != 40 {
+			t.Errorf("%s: progress called %d times", ext, calls)
+		}
+
+		// Output does not depend on number of workers
+		serial := filepath.Join(dir, "serial."+ext)
+		procs := runtime.GOMAXPROCS(1)
+		err = fn(serial, nil, nil)
+		runtime.GOMAXPROCS(procs)
+		if err != nil {
+			t.Fatalf("%s: write error: %v", ext, err)
+		}
+		if !bytes.Equal(readData(t, parallel, ext == "imd"), readData(t, serial, ext == "imd")) {
+			t.Errorf("%s: parallel and serial outputs differ", ext)
+		}
+
+		// Cancelled writing stops promptly, and leaves no file
+		cancelled := filepath.Join(dir, "cancelled."+ext)
+		ctx, cancel := context.WithCancel(context.Background())
+		calls = 0
+		err = fn(cancelled, ctx, func(done, total, sectors int) {
+			calls++
+			if done == 10 {
+				cancel()
+			}
+		})
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: cancelled write returned %v", ext, err)
+		}
+		if calls != 10 {
+			t.Errorf("%s: progress called %d times after cancel at 10", ext, calls)
+		}
+		if _, err := os.Stat(cancelled); !os.IsNotExist(err) {
+			t.Errorf("%s: cancelled write left the file", ext)
+		}
+	}
+}
+
+// Speedup of parallel sector extraction: compare workers=1 with all CPUs
+func BenchmarkWriteIMG(b *testing.B) {
+	g := hfetest.Geometry{Cylinders: 80, Sides: 2, SectorsPerTrack: 18}
+	disk := hfetest.RandomDisk(12, g, false)
+	filename := filepath.Join(b.TempDir(), "disk.img")
+	counts := []int{1}
+	if n := runtime.NumCPU(); n > 1 {
+		counts = append(counts, n)
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(workers))
+			for i := 0; i < b.N; i++ {
+				if err := hfe.WriteIMG(filename, disk); err != nil {
+					b.Fatalf("WriteIMG() error: %v", err)
+				}
+			}
+		})
+	}
+}
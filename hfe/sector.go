@@ -0,0 +1,276 @@
+package hfe
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// DecodedTrack contains sectors found on a track of IBM PC format
+type DecodedTrack struct {
+	// Every sector in order of appearance on the track, including
+	// instances with the same ID. Position of sector contents in the
+	// bitstream is given by DataBitPos, and data CRC status by Bad.
+	Sectors []*mfm.SectorIBMPC
+}
+
+// DecodeTrack finds all sectors of IBM PC format on the track.
+// Cylinder and head in ID fields are checked according to IDTolerance.
+func DecodeTrack(track []byte, cyl, head int) *DecodedTrack {
+	result := &DecodedTrack{}
+	if len(track) == 0 {
+		return result
+	}
+	reader := mfm.NewReader(track)
+	reader.Tolerance = IDTolerance
+	for {
+		s, err := reader.ReadSectorInfoIBMPC(cyl, head)
+		if err != nil {
+			break
+		}
+		result.Sectors = append(result.Sectors, s)
+	}
+	return result
+}
+
+// Find all sectors of the track for a sector image. Cylinder and head
+// in ID fields are taken as recorded on the track, so that sectors
+// addressed other than by their physical track, like remapped sectors
+// of IMD images, are kept. Of several instances of a sector number,
+// only ones matching the physical track according to IDTolerance are
+// used, when there are such.
+func decodeTrackIDs(track []byte, cyl, head int) *DecodedTrack {
+	result := &DecodedTrack{}
+	if len(track) == 0 {
+		return result
+	}
+	reader := mfm.NewReader(track)
+	reader.Tolerance = mfm.IDIgnoreCylHead
+	matched := make(map[int]bool)
+	for {
+		s, err := reader.ReadSectorInfoIBMPC(cyl, head)
+		if err != nil {
+			break
+		}
+		result.Sectors = append(result.Sectors, s)
+		if IDTolerance.Matches(s.Cylinder, s.Head, cyl, head) {
+			matched[s.Sector] = true
+		}
+	}
+
+	// Drop foreign instances of sectors found with the physical address
+	sectors := result.Sectors[:0]
+	for _, s := range result.Sectors {
+		if !matched[s.Sector] || IDTolerance.Matches(s.Cylinder, s.Head, cyl, head) {
+			sectors = append(sectors, s)
+		}
+	}
+	result.Sectors = sectors
+	return result
+}
+
+// Decode sides of the first cyls cylinders in parallel, and pass them
+// to fn in order of cylinders and heads, see decodeTrackIDs.
+// Sides missing from the disk are decoded as empty. Stops at the first error of fn, or when ctx is done.
+func (disk *Disk) decodeSides(ctx context.Context, cyls, sides int, fn func(cyl, head int, decoded *DecodedTrack) error) error {
+	n := cyls * sides
+	if n <= 0 {
+		return nil
+	}
+	workers := min(runtime.GOMAXPROCS(0), n)
+	results := make([]*DecodedTrack, n)
+	ready := make([]chan struct{}, n)
+	for i := range ready {
+		ready[i] = make(chan struct{})
+	}
+
+	// Workers run ahead of fn by a few sides at most
+	ctx, cancel := context.WithCancel(ctx)
+	slots := make(chan struct{}, 2*workers)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	go func() {
+		defer close(next)
+		for i := 0; i < n; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				cyl, head := i/sides, i%sides
+				var data []byte
+				if disk.checkTrack(cyl, head) == nil {
+					data = disk.Tracks[cyl].side(head)
+				}
+				results[i] = decodeTrackIDs(data, cyl, head)
+				close(ready[i])
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-ready[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := fn(i/sides, i%sides, results[i]); err != nil {
+			return err
+		}
+		results[i] = nil
+		<-slots
+	}
+	return nil
+}
+
+// Instances returns all sectors with the given number, in order of appearance
+func (t *DecodedTrack) Instances(sector int) []*mfm.SectorIBMPC {
+	var result []*mfm.SectorIBMPC
+	for _, s := range t.Sectors {
+		if s.Sector == sector {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// Sector returns the instance of the sector with the given number to use:
+// the first one with good CRC, or the first one when all are bad.
+// Returns nil when the sector is not found.
+func (t *DecodedTrack) Sector(sector int) *mfm.SectorIBMPC {
+	var bad *mfm.SectorIBMPC
+	for _, s := range t.Sectors {
+		if s.Sector != sector {
+			continue
+		}
+		if !s.Bad {
+			return s
+		}
+		if bad == nil {
+			bad = s
+		}
+	}
+	return bad
+}
+
+// SectorOfSize returns the instance of the sector with the given number
+// for an image of sectors of the given size: the first good one of that size
+// with normal data mark. Other instances are used like Sector does, when
+// there is no such one. Returns nil when the sector is not found.
+func (t *DecodedTrack) SectorOfSize(sector, size int) *mfm.SectorIBMPC {
+	for _, s := range t.Sectors {
+		if s.Sector == sector && !s.Bad && !s.Deleted && len(s.Data) == size {
+			return s
+		}
+	}
+	return t.Sector(sector)
+}
+
+// Duplicates returns numbers of sectors found more than once, in ascending order
+func (t *DecodedTrack) Duplicates() []int {
+	count := make(map[int]int)
+	var result []int
+	for _, s := range t.Sectors {
+		count[s.Sector]++
+		if count[s.Sector] == 2 {
+			result = append(result, s.Sector)
+		}
+	}
+	slices.Sort(result)
+	return result
+}
+
+// GoodSectors returns number of distinct sectors with good CRC
+func (t *DecodedTrack) GoodSectors() int {
+	found := make(map[int]bool)
+	for _, s := range t.Sectors {
+		if !s.Bad {
+			found[s.Sector] = true
+		}
+	}
+	return len(found)
+}
+
+// Describe duplicate instances of the sector, and which one is used
+func (t *DecodedTrack) duplicateMessage(cyl, head, sector int) string {
+	instances := t.Instances(sector)
+	used, bad := 0, 0
+	for i, s := range instances {
+		if s.Bad {
+			bad++
+		}
+		if s == t.Sector(sector) {
+			used = i
+		}
+	}
+	return fmt.Sprintf("track %d, side %d: sector %d found %d times, %d with bad CRC, using copy %d",
+		cyl, head, sector, len(instances), bad, used+1)
+}
+
+// Find sector with the given number on the track of IBM PC format.
+// Returns bitstream of the track and the sector.
+func (disk *Disk) findSector(cyl, head, sector int) ([]byte, *mfm.SectorIBMPC, error) {
+	if err := disk.checkTrack(cyl, head); err != nil {
+		return nil, nil, err
+	}
+	track := disk.Tracks[cyl].side(head)
+	if len(track) == 0 {
+		return nil, nil, fmt.Errorf("track %d, side %d is empty", cyl, head)
+	}
+	if s := DecodeTrack(track, cyl, head).Sector(sector); s != nil {
+		return track, s, nil
+	}
+	return nil, nil, fmt.Errorf("sector %d not found on track %d, side %d", sector, cyl, head)
+}
+
+// ReadSector returns contents of the sector with the given number,
+// as recorded in its ID field (usually 1-based), from the track of IBM PC format.
+func (disk *Disk) ReadSector(cyl, head, sector int) ([]byte, error) {
+	_, s, err := disk.findSector(cyl, head, sector)
+	if err != nil {
+		return nil, err
+	}
+	if s.Bad {
+		return s.Data, fmt.Errorf("bad checksum in sector %d of track %d.%d", sector, cyl, head)
+	}
+	return s.Data, nil
+}
+
+// WriteSector replaces contents of the sector with the given number
+// on the track of IBM PC format, and updates its CRC. The rest of the track,
+// including gaps and other sectors, stays unchanged.
+// Data size must match the size of the sector.
+func (disk *Disk) WriteSector(cyl, head, sector int, data []byte) error {
+	track, s, err := disk.findSector(cyl, head, sector)
+	if err != nil {
+		return err
+	}
+	err = mfm.PatchSectorIBMPC(track, s, data)
+	if err != nil {
+		return fmt.Errorf("track %d, side %d: %w", cyl, head, err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package hfe
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+func TestWriteSector(t *testing.T) {
+	disk, err := Read(findSampleFile(t, "fat12v1.hfe"))
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	orig := bytes.Clone(disk.Tracks[0].Side0)
+
+	boot, err := disk.ReadSector(0, 0, 1)
+	if err != nil {
+		t.Fatalf("ReadSector() error: %v", err)
+	}
+	if len(boot) != 512 || boot[510] != 0x55 || boot[511] != 0xAA {
+		t.Fatalf("ReadSector() returned no boot sector")
+	}
+
+	// Flip one byte of the boot sector
+	patched := bytes.Clone(boot)
+	patched[3] ^= 0xFF
+	if err := disk.WriteSector(0, 0, 1, patched); err != nil {
+		t.Fatalf("WriteSector() error: %v", err)
+	}
+	data, err := disk.ReadSector(0, 0, 1)
+	if err != nil {
+		t.Fatalf("ReadSector() after write error: %v", err)
+	}
+	if !bytes.Equal(data, patched) {
+		t.Errorf("ReadSector() returned old data")
+	}
+
+	// Only data, CRC and one clock bit after it may differ
+	reader := mfm.NewReader(orig)
+	sector, err := reader.ReadSectorInfoIBMPC(0, 0)
+	if err != nil || sector.Sector != 1 {
+		t.Fatalf("cannot find sector 1: %v", err)
+	}
+	first, last := sector.DataBitPos, sector.DataBitPos+(512+2)*16
+	track := disk.Tracks[0].Side0
+	for i := 0; i < len(orig)*8; i++ {
+		if i >= first && i <= last {
+			continue
+		}
+		if (orig[i/8]^track[i/8])&(0x80>>(i%8)) != 0 {
+			t.Fatalf("bit %d changed outside of sector data", i)
+		}
+	}
+
+	// Other sectors are intact
+	for s := 2; s <= 9; s++ {
+		if _, err := disk.ReadSector(0, 0, s); err != nil {
+			t.Errorf("ReadSector(%d) error: %v", s, err)
+		}
+	}
+}
+
+func TestWriteSector_Errors(t *testing.T) {
+	disk, err := Read(findSampleFile(t, "fat12v1.hfe"))
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if err := disk.WriteSector(0, 0, 1, make([]byte, 256)); err == nil {
+		t.Errorf("expected error for wrong data size")
+	}
+	if err := disk.WriteSector(0, 0, 99, make([]byte, 512)); err == nil {
+		t.Errorf("expected error for missing sector")
+	}
+	if _, err := disk.ReadSector(200, 0, 1); err == nil {
+		t.Errorf("expected error for missing cylinder")
+	}
+}
+
+// Build a track of 9 sectors, every sector filled with its index,
+// preceded by another copy of sector 3 filled with 0xEE, with good
+// or bad data CRC
+func makeDuplicateTrack(t *testing.T, badCopy bool) []byte {
+	sectors := [][]byte{make([]byte, 512), make([]byte, 512), bytes.Repeat([]byte{0xee}, 512)}
+	extra := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 3, 250)
+	found := DecodeTrack(extra, 0, 0)
+	second, third := found.Sector(2), found.Sector(3)
+	if second == nil || third == nil {
+		t.Fatalf("sectors of extra track not found")
+	}
+	if badCopy {
+		// Flip the first data bit of sector 3
+		pos := third.DataBitPos + 1
+		extra[pos/8] ^= 0x80 >> (pos % 8)
+	}
+
+	// Cut the extra track after sector 2
+	start := (second.DataBitPos + (512+2)*16 + 7) / 8
+	return append(extra[start:], makeIMDTestTrack(0, 0, 250, 0)...)
+}
+
+func TestDecodeTrack_Duplicates(t *testing.T) {
+	decoded := DecodeTrack(makeDuplicateTrack(t, true), 0, 0)
+	if len(decoded.Sectors) != 10 || decoded.GoodSectors() != 9 {
+		t.Fatalf("found %d sectors, %d good", len(decoded.Sectors), decoded.GoodSectors())
+	}
+	instances := decoded.Instances(3)
+	if len(instances) != 2 || !instances[0].Bad || instances[1].Bad ||
+		instances[0].DataBitPos >= instances[1].DataBitPos {
+		t.Fatalf("instances of sector 3: %d", len(instances))
+	}
+	if s := decoded.Sector(3); s != instances[1] || s.Data[0] != 2 {
+		t.Errorf("bad copy of sector 3 selected")
+	}
+	if dups := decoded.Duplicates(); len(dups) != 1 || dups[0] != 3 {
+		t.Errorf("duplicates %v, expected [3]", dups)
+	}
+
+	// Both copies good: the first one is used
+	decoded = DecodeTrack(makeDuplicateTrack(t, false), 0, 0)
+	if s := decoded.Sector(3); s == nil || s.Data[0] != 0xee {
+		t.Errorf("second good copy of sector 3 selected")
+	}
+}
+
+func TestDecodedTrack_SectorOfSize(t *testing.T) {
+	deleted := &mfm.SectorIBMPC{Sector: 3, Size: 2, Data: make([]byte, 512), Deleted: true}
+	small := &mfm.SectorIBMPC{Sector: 3, Size: 1, Data: make([]byte, 256)}
+	bad := &mfm.SectorIBMPC{Sector: 3, Size: 2, Data: make([]byte, 512), Bad: true}
+	good := &mfm.SectorIBMPC{Sector: 3, Size: 2, Data: make([]byte, 512)}
+	decoded := &DecodedTrack{Sectors: []*mfm.SectorIBMPC{deleted, small, bad, good}}
+
+	if s := decoded.Sector(3); s != deleted {
+		t.Errorf("Sector() returned %+v, expected the first good copy", s)
+	}
+	if s := decoded.SectorOfSize(3, 512); s != good {
+		t.Errorf("SectorOfSize() returned %+v, expected good copy of 512 bytes", s)
+	}
+
+	// Without such a copy, the choice of Sector is used
+	decoded.Sectors = decoded.Sectors[:3]
+	if s := decoded.SectorOfSize(3, 512); s != deleted {
+		t.Errorf("SectorOfSize() returned %+v, expected the first good copy", s)
+	}
+	if s := decoded.SectorOfSize(4, 512); s != nil {
+		t.Errorf("SectorOfSize() returned %+v for missing sector", s)
+	}
+}
+
+func TestConvert_Duplicates(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk.hfe")
+	disk := &Disk{
+		Header: Header{NumberOfTrack: 1, NumberOfSide: 1, BitRate: 250, FloppyRPM: 300},
+		Tracks: []TrackData{{Side0: makeDuplicateTrack(t, true)}},
+	}
+	if err := WriteHFE(src, disk, HFEVersion1); err != nil {
+		t.Fatalf("WriteHFE() error: %v", err)
+	}
+
+	for _, name := range []string{"disk.img", "disk.imd"} {
+		dst := filepath.Join(dir, name)
+		report, err := Convert(src, dst, ConvertOptions{})
+		if err != nil {
+			t.Fatalf("Convert() to %s error: %v", name, err)
+		}
+		want := "track 0, side 0: sector 3 found 2 times, 1 with bad CRC, using copy 2"
+		if !slices.Contains(report.Warnings, want) {
+			t.Errorf("%s: warnings %q, expected %q", name, report.Warnings, want)
+		}
+
+		// Single track of 9 sectors is not a known IMG geometry: take sector 3 from the file
+		var data []byte
+		if name == "disk.img" {
+			image, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = image[2*512 : 3*512]
+		} else {
+			result, err := Read(dst)
+			if err != nil {
+				t.Fatalf("Read(%s) error: %v", name, err)
+			}
+			data, err = result.ReadSector(0, 0, 3)
+			if err != nil {
+				t.Fatalf("%s: ReadSector() error: %v", name, err)
+			}
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte{2}, 512)) {
+			t.Errorf("%s: bad copy of sector 3 converted", name)
+		}
+
+		_, err = Convert(src, dst, ConvertOptions{Overwrite: true, StrictDuplicates: true})
+		if err == nil || !strings.Contains(err.Error(), "sector 3 found 2 times") {
+			t.Errorf("%s: strict conversion error %v", name, err)
+		}
+	}
+}
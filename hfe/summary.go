@@ -0,0 +1,139 @@
+package hfe
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Names of track encodings
+var encodingNames = map[uint8]string{
+	ENC_ISOIBM_MFM: "ISO/IBM MFM",
+	ENC_Amiga_MFM:  "Amiga MFM",
+	ENC_ISOIBM_FM:  "ISO/IBM FM",
+	ENC_Emu_FM:     "EMU FM",
+	ENC_C64_GCR:    "Commodore GCR",
+	ENC_Unknown:    "Unknown",
+}
+
+// Names of floppy interface modes
+var interfaceModeNames = map[uint8]string{
+	IFM_IBMPC_DD:          "IBM PC DD",
+	IFM_IBMPC_HD:          "IBM PC HD",
+	IFM_AtariST_DD:        "Atari ST DD",
+	IFM_AtariST_HD:        "Atari ST HD",
+	IFM_Amiga_DD:          "Amiga DD",
+	IFM_Amiga_HD:          "Amiga HD",
+	IFM_CPC_DD:            "Amstrad CPC DD",
+	IFM_GenericShugart_DD: "Generic Shugart DD",
+	IFM_IBMPC_ED:          "IBM PC ED",
+	IFM_MSX2_DD:           "MSX2 DD",
+	IFM_C64_DD:            "Commodore 64 DD",
+	IFM_EmuShugart_DD:     "EMU Shugart DD",
+	IFM_S950_DD:           "Akai S950 DD",
+	IFM_S950_HD:           "Akai S950 HD",
+	IFM_DISABLE:           "Disabled",
+	0xFF:                  "Unspecified", // Found in images created by other tools
+}
+
+// EncodingName returns human-readable name of the track encoding
+func (h *Header) EncodingName() string {
+	if name, ok := encodingNames[h.TrackEncoding]; ok {
+		return name
+	}
+	return fmt.Sprintf("Encoding 0x%02x", h.TrackEncoding)
+}
+
+// InterfaceModeName returns human-readable name of the floppy interface mode
+func (h *Header) InterfaceModeName() string {
+	if name, ok := interfaceModeNames[h.FloppyInterfaceMode]; ok {
+		return name
+	}
+	return fmt.Sprintf("Interface 0x%02x", h.FloppyInterfaceMode)
+}
+
+// Validate checks that header fields are within sane ranges.
+// All problems found are returned together.
+func (h *Header) Validate() error {
+	var problems []error
+	if h.NumberOfTrack == 0 {
+		problems = append(problems, fmt.Errorf("no tracks"))
+	}
+	if h.NumberOfSide < 1 || h.NumberOfSide > 2 {
+		problems = append(problems, fmt.Errorf("invalid number of sides: %d", h.NumberOfSide))
+	}
+	if h.BitRate == 0 || h.BitRate > 1000 {
+		problems = append(problems, fmt.Errorf("invalid bit rate: %d kbps", h.BitRate))
+	}
+	if _, ok := encodingNames[h.TrackEncoding]; !ok {
+		problems = append(problems, fmt.Errorf("unknown track encoding: 0x%02x", h.TrackEncoding))
+	}
+	if _, ok := interfaceModeNames[h.FloppyInterfaceMode]; !ok {
+		problems = append(problems, fmt.Errorf("unknown interface mode: 0x%02x", h.FloppyInterfaceMode))
+	}
+	return errors.Join(problems...)
+}
+
+// Summary returns a multi-line description of the disk
+func (disk *Disk) Summary() string {
+	h := &disk.Header
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Tracks: %d\n", h.NumberOfTrack)
+	fmt.Fprintf(&sb, "Sides: %d\n", h.NumberOfSide)
+	fmt.Fprintf(&sb, "Encoding: %s\n", h.EncodingName())
+	fmt.Fprintf(&sb, "Interface: %s\n", h.InterfaceModeName())
+	fmt.Fprintf(&sb, "Bit Rate: %d kbps\n", h.BitRate)
+	fmt.Fprintf(&sb, "RPM: %d\n", h.FloppyRPM)
+
+	// Track lengths, with runs of identical tracks grouped together
+	for first := 0; first < len(disk.Tracks); {
+		last := first
+		for last+1 < len(disk.Tracks) && disk.sameTrackLength(first, last+1) {
+			last++
+		}
+		track := &disk.Tracks[first]
+		if first == last {
+			fmt.Fprintf(&sb, "Track %d:", first)
+		} else {
+			fmt.Fprintf(&sb, "Tracks %d-%d:", first, last)
+		}
+		fmt.Fprintf(&sb, " %d bytes", len(track.Side0))
+		if h.NumberOfSide > 1 {
+			fmt.Fprintf(&sb, " + %d bytes", len(track.Side1))
+		}
+		if track.BitRate != 0 {
+			fmt.Fprintf(&sb, " at %d kbps", track.BitRate)
+		}
+		sb.WriteString("\n")
+		first = last + 1
+	}
+
+	if capacity := disk.estimateCapacity(); capacity > 0 {
+		fmt.Fprintf(&sb, "Capacity: %d bytes (%d kbytes)\n", capacity, capacity/1024)
+	}
+	return sb.String()
+}
+
+// Check whether two tracks have the same length and bit rate
+func (disk *Disk) sameTrackLength(a, b int) bool {
+	ta, tb := &disk.Tracks[a], &disk.Tracks[b]
+	return len(ta.Side0) == len(tb.Side0) &&
+		len(ta.Side1) == len(tb.Side1) &&
+		ta.BitRate == tb.BitRate
+}
+
+// Estimate formatted capacity in bytes by counting sectors on track 0.
+// Returns 0 when no known sectors are found.
+func (disk *Disk) estimateCapacity() int {
+	if len(disk.Tracks) == 0 {
+		return 0
+	}
+	track0 := disk.Tracks[0].Side0
+	sectors := mfm.NewReader(track0).CountSectorsIBMPC()
+	if sectors == 0 {
+		sectors = mfm.NewReader(track0).CountSectorsAmiga(0)
+	}
+	return sectors * sectorSize * int(disk.Header.NumberOfTrack) * max(int(disk.Header.NumberOfSide), 1)
+}
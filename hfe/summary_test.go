@@ -0,0 +1,96 @@
+package hfe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodingName(t *testing.T) {
+	tests := []struct {
+		encoding uint8
+		expected string
+	}{
+		{ENC_ISOIBM_MFM, "ISO/IBM MFM"},
+		{ENC_Amiga_MFM, "Amiga MFM"},
+		{ENC_ISOIBM_FM, "ISO/IBM FM"},
+		{ENC_C64_GCR, "Commodore GCR"},
+		{0x42, "Encoding 0x42"},
+	}
+	for _, tt := range tests {
+		h := Header{TrackEncoding: tt.encoding}
+		if got := h.EncodingName(); got != tt.expected {
+			t.Errorf("EncodingName(0x%02x) = %q, expected %q", tt.encoding, got, tt.expected)
+		}
+	}
+}
+
+func TestInterfaceModeName(t *testing.T) {
+	tests := []struct {
+		mode     uint8
+		expected string
+	}{
+		{IFM_IBMPC_DD, "IBM PC DD"},
+		{IFM_Amiga_HD, "Amiga HD"},
+		{IFM_C64_DD, "Commodore 64 DD"},
+		{IFM_DISABLE, "Disabled"},
+		{0x42, "Interface 0x42"},
+	}
+	for _, tt := range tests {
+		h := Header{FloppyInterfaceMode: tt.mode}
+		if got := h.InterfaceModeName(); got != tt.expected {
+			t.Errorf("InterfaceModeName(0x%02x) = %q, expected %q", tt.mode, got, tt.expected)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Header{NumberOfTrack: 80, NumberOfSide: 2, BitRate: 250, FloppyInterfaceMode: IFM_IBMPC_DD}
+	tests := []struct {
+		name    string
+		modify  func(h *Header)
+		problem string
+	}{
+		{"valid", func(h *Header) {}, ""},
+		{"single side", func(h *Header) { h.NumberOfSide = 1 }, ""},
+		{"no tracks", func(h *Header) { h.NumberOfTrack = 0 }, "no tracks"},
+		{"no sides", func(h *Header) { h.NumberOfSide = 0 }, "invalid number of sides"},
+		{"seven sides", func(h *Header) { h.NumberOfSide = 7 }, "invalid number of sides"},
+		{"zero bit rate", func(h *Header) { h.BitRate = 0 }, "invalid bit rate"},
+		{"high bit rate", func(h *Header) { h.BitRate = 1001 }, "invalid bit rate"},
+		{"bad encoding", func(h *Header) { h.TrackEncoding = 0x42 }, "unknown track encoding"},
+		{"bad interface", func(h *Header) { h.FloppyInterfaceMode = 0x42 }, "unknown interface mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := valid
+			tt.modify(&h)
+			err := h.Validate()
+			if tt.problem == "" {
+				if err != nil {
+					t.Errorf("Validate() error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Errorf("Validate() = %v, expected %q", err, tt.problem)
+			}
+		})
+	}
+
+	// Several problems are reported together
+	h := Header{NumberOfSide: 7}
+	if err := h.Validate(); err == nil || len(strings.Split(err.Error(), "\n")) != 3 {
+		t.Errorf("Validate() = %v, expected three problems", err)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	disk, err := ReadHFE("../images/fat12v1.hfe")
+	if err != nil {
+		t.Skipf("sample image not available: %v", err)
+	}
+	summary := disk.Summary()
+	for _, expected := range []string{"Sides: 2", "Track 0: 24904 bytes + 24904 bytes", "Capacity: 36864 bytes"} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("summary does not contain %q:\n%s", expected, summary)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package hfe
+
+import (
+	"fmt"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Number of data bytes from index to the first sector header on IBM PC track:
+// gap4a (80), sync (12), index marker (4), gap1 (50), sync (12)
+const indexToSectorBytes = 80 + 12 + 4 + 50 + 12
+
+// RevolutionBits returns number of MFM bitcells in one revolution
+// for given bit rate (kbps) and rotation speed (RPM).
+func RevolutionBits(bitRate uint16, rpm uint16) int {
+	return int(bitRate) * 1000 * 60 / int(rpm) * 2
+}
+
+// RotateTrackToSector rotates MFM bitstream of the track so that it starts
+// in gap4a before the header of the given sector (1-based, as in the header).
+// Returns error when the sector is not found.
+func RotateTrackToSector(track []byte, sectorNum int) ([]byte, error) {
+	start, err := SectorStart(track, sectorNum)
+	if err != nil {
+		return nil, err
+	}
+	return RotateTrack(track, start), nil
+}
+
+// SectorStart returns bit position in gap4a before the header of the given
+// sector (1-based, as in the header), where RotateTrackToSector starts the track.
+// Returns error when the sector is not found.
+func SectorStart(track []byte, sectorNum int) (int, error) {
+	if len(track) == 0 {
+		return 0, fmt.Errorf("empty track")
+	}
+	bitLen := len(track) * 8
+
+	// Header may wrap around the end of the track: scan a bit further
+	extra := min(len(track), 64)
+	scan := make([]byte, 0, len(track)+extra)
+	scan = append(scan, track...)
+	scan = append(scan, track[:extra]...)
+
+	pos, err := mfm.NewReader(scan).FindSectorIBMPC(sectorNum)
+	if err != nil {
+		return 0, fmt.Errorf("sector %d not found", sectorNum)
+	}
+
+	// Sector header starts after the sync bytes: move back to gap4a
+	start := (pos - indexToSectorBytes*16) % bitLen
+	if start < 0 {
+		start += bitLen
+	}
+	return start, nil
+}
+
+// RotateTrack rotates MFM bitstream to start at the given bit position.
+// Data is returned as is when the position is 0.
+func RotateTrack(track []byte, start int) []byte {
+	if start == 0 {
+		return track
+	}
+	bitLen := len(track) * 8
+	result := make([]byte, len(track))
+	n := bitCopy(result, 0, track, start, bitLen-start)
+	bitCopy(result, n, track, 0, start)
+	return result
+}
+
+// TrimTrackToRevolution cuts or pads MFM bitstream of the track
+// to exactly bitLen bitcells. Padding is filled with gap bytes 4E.
+func TrimTrackToRevolution(track []byte, bitLen int) []byte {
+	result := make([]byte, (bitLen+7)/8)
+	n := bitCopy(result, 0, track, 0, min(bitLen, len(track)*8))
+
+	// Pad with MFM encoding of 4E
+	gap := []byte{0x92, 0x54}
+	for n < bitLen {
+		n = bitCopy(result, n, gap, 0, min(16, bitLen-n))
+	}
+	return result
+}
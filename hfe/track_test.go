@@ -0,0 +1,145 @@
+package hfe
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Rotate bitstream left by the given number of bits.
+func rotateBits(track []byte, shift int) []byte {
+	bitLen := len(track) * 8
+	result := make([]byte, len(track))
+	n := bitCopy(result, 0, track, shift, bitLen-shift)
+	bitCopy(result, n, track, 0, shift)
+	return result
+}
+
+func makeTestTrack144() []byte {
+	sectors := make([][]byte, 18)
+	for i := range sectors {
+		sectors[i] = bytes.Repeat([]byte{byte(i)}, 512)
+	}
+	return mfm.NewWriter(RevolutionBits(500, 300)).EncodeTrackIBMPC(sectors, 0, 0, 18, 500)
+}
+
+func TestRotateTrackToSector(t *testing.T) {
+	track := makeTestTrack144()
+
+	// Find position of sector 1 header in the original track
+	origPos, err := mfm.NewReader(track).FindSectorIBMPC(1)
+	if err != nil {
+		t.Fatalf("FindSectorIBMPC() error: %v", err)
+	}
+
+	// Shift by odd amounts, including one which splits the sector 1 header
+	for _, shift := range []int{12345, 100001, origPos + 8} {
+		shifted := rotateBits(track, shift)
+
+		rotated, err := RotateTrackToSector(shifted, 1)
+		if err != nil {
+			t.Fatalf("shift %d: RotateTrackToSector() error: %v", shift, err)
+		}
+		if len(rotated) != len(track) {
+			t.Errorf("shift %d: length %d, expected %d", shift, len(rotated), len(track))
+		}
+
+		pos, err := mfm.NewReader(rotated).FindSectorIBMPC(1)
+		if err != nil {
+			t.Fatalf("shift %d: sector 1 not found after rotation: %v", shift, err)
+		}
+		if pos/8 > 400 {
+			t.Errorf("shift %d: sector 1 header at byte %d, expected within first 400 bytes", shift, pos/8)
+		}
+		if pos != indexToSectorBytes*16 {
+			t.Errorf("shift %d: sector 1 header at bit %d, expected %d", shift, pos, indexToSectorBytes*16)
+		}
+		if n := mfm.NewReader(rotated).CountSectorsIBMPC(); n != 18 {
+			t.Errorf("shift %d: found %d sectors, expected 18", shift, n)
+		}
+	}
+
+	// Unformatted track
+	if _, err := RotateTrackToSector(make([]byte, 1000), 1); err == nil {
+		t.Errorf("RotateTrackToSector() on empty track: expected error")
+	}
+}
+
+func TestTrimTrackToRevolution(t *testing.T) {
+	track := makeTestTrack144()
+	bitLen := len(track) * 8
+
+	// Cut
+	cut := TrimTrackToRevolution(track, bitLen-1003)
+	if len(cut) != (bitLen-1003+7)/8 {
+		t.Errorf("cut length %d, expected %d", len(cut), (bitLen-1003+7)/8)
+	}
+	if !bytes.Equal(cut[:100], track[:100]) {
+		t.Errorf("cut track does not start with original data")
+	}
+	if cut[len(cut)-1]&0x07 != 0 {
+		t.Errorf("bits beyond the end of track are not cleared: %02x", cut[len(cut)-1])
+	}
+
+	// Pad with gap bytes
+	padded := TrimTrackToRevolution(track, bitLen+160)
+	if len(padded) != len(track)+20 {
+		t.Fatalf("padded length %d, expected %d", len(padded), len(track)+20)
+	}
+	if !bytes.Equal(padded[:len(track)], track) {
+		t.Errorf("padded track does not start with original data")
+	}
+	for i := len(track); i < len(padded); i += 2 {
+		if padded[i] != 0x92 || padded[i+1] != 0x54 {
+			t.Fatalf("padding at byte %d is %02x %02x, expected 92 54", i, padded[i], padded[i+1])
+		}
+	}
+}
+
+func TestEncodeOpcodes_SetIndex(t *testing.T) {
+	encoded := encodeOpcodes([]byte{0x12, 0x34}, nil, 0, 0)
+	if !bytes.Equal(encoded, []byte{SETINDEX_OPCODE, 0x12, 0x34}) {
+		t.Errorf("encodeOpcodes() = % x, expected SETINDEX at position 0", encoded)
+	}
+	decoded, err := processOpcodes(encoded)
+	if err != nil {
+		t.Fatalf("processOpcodes() error: %v", err)
+	}
+	if !bytes.HasPrefix(decoded, []byte{0x12, 0x34}) {
+		t.Errorf("processOpcodes() = % x, expected 12 34", decoded)
+	}
+}
+
+func TestEncodeOpcodes_IndexBitOffset(t *testing.T) {
+	track := makeTestTrack144()
+	for _, index := range []int{1, 7, 8, 12345, len(track) * 4, len(track)*8 - 1} {
+		encoded := encodeOpcodes(track, nil, 500, index)
+		if encoded[0] != SETBITRATE_OPCODE || bytes.Count(encoded, []byte{SETINDEX_OPCODE}) == 0 {
+			t.Fatalf("index %d: encodeOpcodes() = % x..., expected SETBITRATE first and SETINDEX", index, encoded[:8])
+		}
+		decoded, err := processOpcodes(encoded)
+		if err != nil {
+			t.Fatalf("index %d: processOpcodes() error: %v", index, err)
+		}
+		if !bytes.Equal(decoded, rotateBits(track, index)) {
+			t.Errorf("index %d: track not rotated to index exactly", index)
+		}
+	}
+}
+
+func TestEncodeOpcodes_SetBitRate(t *testing.T) {
+	for _, kbps := range []uint16{125, 133, 143, 154, 250, 500} {
+		encoded := encodeOpcodes([]byte{0x12, 0x34}, nil, kbps, 0)
+		if len(encoded) != 5 || encoded[0] != SETINDEX_OPCODE || encoded[1] != SETBITRATE_OPCODE {
+			t.Fatalf("encodeOpcodes() = % x, expected SETINDEX and SETBITRATE", encoded)
+		}
+		decoded, _, bitRate, err := decodeOpcodes(encoded)
+		if err != nil {
+			t.Fatalf("decodeOpcodes() error: %v", err)
+		}
+		if bitRate != kbps || !bytes.Equal(decoded, []byte{0x12, 0x34}) {
+			t.Errorf("decodeOpcodes() = % x, %d kbps, expected 12 34, %d kbps", decoded, bitRate, kbps)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package hfe
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/sergev/floppy/mfm"
+)
+
+// Standard numbers of cylinders, to which Trim can force the disk
+var StandardTrackCounts = []int{40, 80, 82, 83}
+
+// TrimOptions control trimming of the disk
+type TrimOptions struct {
+	// Number of cylinders of the result, one of StandardTrackCounts:
+	// tracks past it are removed, and missing tracks are added empty.
+	// 0 keeps the number of cylinders left after trimming.
+	Tracks int
+}
+
+// Validate checks the options given by user
+func (o *TrimOptions) Validate() error {
+	if o.Tracks != 0 && !slices.Contains(StandardTrackCounts, o.Tracks) {
+		return fmt.Errorf("invalid number of tracks: %d (must be 40, 80, 82 or 83)", o.Tracks)
+	}
+	return nil
+}
+
+// TrimReason tells why a track was removed by Trim
+type TrimReason int
+
+const (
+	TrimEmpty     TrimReason = iota // No sectors found
+	TrimDuplicate                   // Same sectors as on the previous cylinder
+	TrimForced                      // Past the number of cylinders given by options
+)
+
+func (r TrimReason) String() string {
+	switch r {
+	case TrimEmpty:
+		return "empty"
+	case TrimDuplicate:
+		return "duplicate of previous cylinder"
+	case TrimForced:
+		return "beyond requested number of tracks"
+	default:
+		return fmt.Sprintf("reason %d", int(r))
+	}
+}
+
+// TrimmedTrack is a cylinder removed by Trim
+type TrimmedTrack struct {
+	Cylinder int
+	Reason   TrimReason
+}
+
+// TrimReport contains results of trimming
+type TrimReport struct {
+	Before  int            // Number of cylinders before trimming
+	After   int            // Number of cylinders after trimming
+	Removed []TrimmedTrack // Removed cylinders, in ascending order
+	Added   int            // Empty cylinders added to reach the requested number
+}
+
+// Changed reports whether any cylinder was removed or added
+func (r *TrimReport) Changed() bool {
+	return len(r.Removed) > 0 || r.Added > 0
+}
+
+// Messages describes every change made to the disk
+func (r *TrimReport) Messages() []string {
+	var msgs []string
+	for _, t := range r.Removed {
+		msgs = append(msgs, fmt.Sprintf("track %d removed: %s", t.Cylinder, t.Reason))
+	}
+	if r.Added > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d empty tracks added", r.Added))
+	}
+	if r.Before != r.After {
+		msgs = append(msgs, fmt.Sprintf("number of tracks changed from %d to %d", r.Before, r.After))
+	}
+	return msgs
+}
+
+// Trim removes trailing cylinders, which adapters capture past the end
+// of the disk: tracks without IBM PC sectors, and tracks with the same
+// sectors as the previous cylinder, as read when the drive cannot step
+// further. Cylinder 0 is always kept. Disks without IBM PC sectors
+// are not trimmed by contents. With opts.Tracks, number of cylinders
+// is then forced to the given value. Number of tracks in the header
+// is updated to match.
+func (disk *Disk) Trim(opts TrimOptions) *TrimReport {
+	report := &TrimReport{Before: len(disk.Tracks)}
+	numCyls := len(disk.Tracks)
+
+	if disk.hasIBMPCSectors() {
+		// Walk back from the last cylinder
+		last := disk.cylinderSectors(numCyls - 1)
+		for numCyls > 1 {
+			prev := disk.cylinderSectors(numCyls - 2)
+			reason := TrimEmpty
+			if !last.empty() {
+				if !last.equal(prev) {
+					break
+				}
+				reason = TrimDuplicate
+			}
+			report.Removed = append(report.Removed, TrimmedTrack{numCyls - 1, reason})
+			last = prev
+			numCyls--
+		}
+	}
+
+	if opts.Tracks > 0 && numCyls > opts.Tracks {
+		for cyl := numCyls - 1; cyl >= opts.Tracks; cyl-- {
+			report.Removed = append(report.Removed, TrimmedTrack{cyl, TrimForced})
+		}
+		numCyls = opts.Tracks
+	}
+	slices.SortFunc(report.Removed, func(a, b TrimmedTrack) int {
+		return cmp.Compare(a.Cylinder, b.Cylinder)
+	})
+
+	disk.Tracks = disk.Tracks[:numCyls]
+	if opts.Tracks > numCyls {
+		report.Added = opts.Tracks - numCyls
+		disk.Tracks = append(disk.Tracks, make([]TrackData, report.Added)...)
+	}
+	disk.Header.NumberOfTrack = uint8(len(disk.Tracks))
+	report.After = len(disk.Tracks)
+	return report
+}
+
+// Good sectors of both sides of a cylinder, sorted by ID fields.
+// Nil when the cylinder has no sectors.
+type trimSectors []*mfm.SectorIBMPC
+
+// Decode sectors of a cylinder, regardless of cylinder and head in ID fields
+func (disk *Disk) cylinderSectors(cyl int) trimSectors {
+	var result trimSectors
+	for head := 0; head < max(int(disk.Header.NumberOfSide), 1); head++ {
+		track := disk.Tracks[cyl].side(head)
+		if len(track) == 0 {
+			continue
+		}
+		reader := mfm.NewReader(track)
+		reader.Tolerance = mfm.IDIgnoreCylHead
+		for {
+			s, err := reader.ReadSectorInfoIBMPC(cyl, head)
+			if err != nil {
+				break
+			}
+			if !s.Bad {
+				result = append(result, s)
+			}
+		}
+	}
+	slices.SortFunc(result, func(a, b *mfm.SectorIBMPC) int {
+		return cmp.Or(cmp.Compare(a.Cylinder, b.Cylinder),
+			cmp.Compare(a.Head, b.Head), cmp.Compare(a.Sector, b.Sector))
+	})
+	return result
+}
+
+func (s trimSectors) empty() bool {
+	return len(s) == 0
+}
+
+// Check whether both cylinders have the same sectors, including
+// cylinder numbers in ID fields. Different physical cylinders of a disk
+// differ at least in ID fields, even when sector contents are the same.
+func (s trimSectors) equal(other trimSectors) bool {
+	return slices.EqualFunc(s, other, func(a, b *mfm.SectorIBMPC) bool {
+		return a.Cylinder == b.Cylinder && a.Head == b.Head && a.Sector == b.Sector &&
+			a.Deleted == b.Deleted && bytes.Equal(a.Data, b.Data)
+	})
+}
+
+// Check whether any track of the disk has IBM PC sectors
+func (disk *Disk) hasIBMPCSectors() bool {
+	for cyl := range disk.Tracks {
+		if !disk.cylinderSectors(cyl).empty() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package hfe
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// Create a double-sided disk of 250 kbps with the given number of formatted
+// cylinders, followed by copies of the last cylinder, as read by a drive
+// which cannot step further
+func makeTrimDisk(formatted, duplicates int) *Disk {
+	numCyls := formatted + duplicates
+	disk := &Disk{
+		Header: Header{NumberOfTrack: uint8(numCyls), NumberOfSide: 2, BitRate: 250, FloppyRPM: 300},
+		Tracks: make([]TrackData, numCyls),
+	}
+	for cyl := 0; cyl < formatted; cyl++ {
+		disk.Tracks[cyl].Side0 = makeIMDTestTrack(cyl, 0, 250, byte(cyl))
+		disk.Tracks[cyl].Side1 = makeIMDTestTrack(cyl, 1, 250, byte(cyl))
+	}
+	for cyl := formatted; cyl < numCyls; cyl++ {
+		disk.Tracks[cyl] = disk.Tracks[formatted-1].clone()
+	}
+	return disk
+}
+
+func TestTrim_Duplicates(t *testing.T) {
+	disk := makeTrimDisk(80, 2)
+	report := disk.Trim(TrimOptions{})
+	if len(disk.Tracks) != 80 || disk.Header.NumberOfTrack != 80 {
+		t.Fatalf("trimmed to %d tracks, header %d, expected 80", len(disk.Tracks), disk.Header.NumberOfTrack)
+	}
+	if report.Before != 82 || report.After != 80 || report.Added != 0 || !report.Changed() {
+		t.Errorf("report %+v", report)
+	}
+	want := []TrimmedTrack{{80, TrimDuplicate}, {81, TrimDuplicate}}
+	if len(report.Removed) != len(want) || report.Removed[0] != want[0] || report.Removed[1] != want[1] {
+		t.Errorf("removed %v, expected %v", report.Removed, want)
+	}
+	if len(report.Messages()) != 3 {
+		t.Errorf("messages %q", report.Messages())
+	}
+}
+
+func TestTrim_Empty(t *testing.T) {
+	disk := makeTrimDisk(80, 0)
+	disk.Tracks = append(disk.Tracks, TrackData{}, TrackData{
+		Side0: bytes.Repeat([]byte{0xaa}, 12500),
+		Side1: bytes.Repeat([]byte{0x44}, 12500),
+	})
+	disk.Header.NumberOfTrack = 82
+	report := disk.Trim(TrimOptions{})
+	if len(disk.Tracks) != 80 || report.Removed[0].Reason != TrimEmpty || report.Removed[1].Reason != TrimEmpty {
+		t.Errorf("trimmed to %d tracks, removed %v", len(disk.Tracks), report.Removed)
+	}
+}
+
+func TestTrim_KeepsFormatted(t *testing.T) {
+	// Every cylinder of a blank disk has the same contents,
+	// and differs from the previous one only in ID fields
+	disk := makeTrimDisk(82, 0)
+	for cyl := range disk.Tracks {
+		disk.Tracks[cyl].Side0 = makeIMDTestTrack(cyl, 0, 250, 0xf6)
+		disk.Tracks[cyl].Side1 = makeIMDTestTrack(cyl, 1, 250, 0xf6)
+	}
+	report := disk.Trim(TrimOptions{})
+	if len(disk.Tracks) != 82 || report.Changed() || len(report.Removed) != 0 {
+		t.Errorf("trimmed to %d tracks, removed %v", len(disk.Tracks), report.Removed)
+	}
+
+	// Disk without IBM PC sectors is not trimmed by contents
+	disk = makeMergeDisk(0x10, 2)
+	if report := disk.Trim(TrimOptions{}); len(disk.Tracks) != 4 || report.Changed() {
+		t.Errorf("non-IBM disk trimmed to %d tracks", len(disk.Tracks))
+	}
+}
+
+func TestTrim_Forced(t *testing.T) {
+	disk := makeTrimDisk(80, 2)
+	report := disk.Trim(TrimOptions{Tracks: 82})
+	if len(disk.Tracks) != 82 || disk.Header.NumberOfTrack != 82 || report.Added != 2 || !report.Changed() {
+		t.Errorf("forced to %d tracks, report %+v", len(disk.Tracks), report)
+	}
+	if len(disk.Tracks[80].Side0) != 0 || len(disk.Tracks[81].Side1) != 0 {
+		t.Errorf("added tracks are not empty")
+	}
+
+	disk = makeTrimDisk(80, 2)
+	report = disk.Trim(TrimOptions{Tracks: 40})
+	if len(disk.Tracks) != 40 || len(report.Removed) != 42 {
+		t.Fatalf("forced to %d tracks, removed %d", len(disk.Tracks), len(report.Removed))
+	}
+	if report.Removed[0] != (TrimmedTrack{40, TrimForced}) || report.Removed[41] != (TrimmedTrack{81, TrimDuplicate}) {
+		t.Errorf("removed %v", report.Removed)
+	}
+
+	opts := TrimOptions{Tracks: 81}
+	if err := opts.Validate(); err == nil {
+		t.Errorf("expected error for 81 tracks")
+	}
+}
+
+func TestConvert_Trim(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk.hfe")
+	if err := WriteHFE(src, makeTrimDisk(80, 2), HFEVersion1); err != nil {
+		t.Fatalf("WriteHFE() error: %v", err)
+	}
+
+	dst := filepath.Join(dir, "trimmed.hfe")
+	report, err := Convert(src, dst, ConvertOptions{Trim: &TrimOptions{}})
+	if err != nil {
+		t.Fatalf("Convert() error: %v", err)
+	}
+	if report.Trim == nil || report.Trim.After != 80 {
+		t.Errorf("trim report %+v", report.Trim)
+	}
+	disk, err := ReadHFE(dst)
+	if err != nil {
+		t.Fatalf("ReadHFE() error: %v", err)
+	}
+	if len(disk.Tracks) != 80 || disk.Header.NumberOfTrack != 80 {
+		t.Errorf("converted disk has %d tracks, header %d", len(disk.Tracks), disk.Header.NumberOfTrack)
+	}
+
+	_, err = Convert(src, dst, ConvertOptions{Overwrite: true, Trim: &TrimOptions{Tracks: 90}})
+	if err == nil {
+		t.Errorf("expected error for 90 tracks")
+	}
+}
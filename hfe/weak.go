@@ -0,0 +1,88 @@
+package hfe
+
+import "fmt"
+
+// WeakRegion is a run of weak bitcells on one side of a track:
+// flux there reads differently on every revolution, like on copy
+// protected disks
+type WeakRegion struct {
+	Start int // Bit position of the first weak bitcell
+	End   int // Bit position past the last weak bitcell
+}
+
+// String describes the region by offsets of data bytes,
+// two bitcells per data bit
+func (r WeakRegion) String() string {
+	return fmt.Sprintf("bytes %d-%d", r.Start/16, (r.End-1)/16)
+}
+
+// WeakRegions returns runs of set bits of the weak mask, in order
+func WeakRegions(mask []byte) []WeakRegion {
+	var regions []WeakRegion
+	start := -1
+	for pos := 0; pos <= len(mask)*8; pos++ {
+		weak := pos < len(mask)*8 && mask[pos/8]&(0x80>>(pos%8)) != 0
+		switch {
+		case weak && start < 0:
+			start = pos
+		case !weak && start >= 0:
+			regions = append(regions, WeakRegion{start, pos})
+			start = -1
+		}
+	}
+	return regions
+}
+
+// NewWeakMask returns weak mask of n bytes with bitcells of the regions set.
+// Parts of regions past the end are dropped. Returns nil without regions.
+func NewWeakMask(n int, regions []WeakRegion) []byte {
+	var mask []byte
+	for _, r := range regions {
+		start, end := max(r.Start, 0), min(r.End, n*8)
+		if start >= end {
+			continue
+		}
+		if mask == nil {
+			mask = make([]byte, n)
+		}
+		setWeakBits(mask, start, end-start)
+	}
+	return mask
+}
+
+// Any of n bitcells from the given position is weak
+func weakAt(mask []byte, pos, n int) bool {
+	for i := max(pos, 0); i < pos+n && i < len(mask)*8; i++ {
+		if mask[i/8]&(0x80>>(i%8)) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Mark n bitcells from the given position as weak
+func setWeakBits(mask []byte, pos, n int) {
+	for i := max(pos, 0); i < pos+n && i < len(mask)*8; i++ {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+}
+
+// HasWeakBits reports whether any side of the track has weak bitcells
+func (track *TrackData) HasWeakBits() bool {
+	for _, mask := range track.WeakBits {
+		if weakAt(mask, 0, len(mask)*8) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tracks with weak bits can only be stored in HFE v3
+func (disk *Disk) hasWeakBits() bool {
+	for i := range disk.Tracks {
+		if disk.Tracks[i].HasWeakBits() {
+			return true
+		}
+	}
+	return false
+}
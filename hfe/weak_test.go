@@ -0,0 +1,62 @@
+package hfe
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWeakRegions(t *testing.T) {
+	mask := NewWeakMask(4, []WeakRegion{{3, 10}, {20, 40}, {-5, 0}})
+	expected := []WeakRegion{{3, 10}, {20, 32}}
+	if regions := WeakRegions(mask); !reflect.DeepEqual(regions, expected) {
+		t.Errorf("WeakRegions() = %v, expected %v", regions, expected)
+	}
+	if mask := NewWeakMask(4, []WeakRegion{{40, 50}}); mask != nil {
+		t.Errorf("NewWeakMask() of region past the end = %x, expected nil", mask)
+	}
+	if regions := WeakRegions(make([]byte, 4)); regions != nil {
+		t.Errorf("WeakRegions() of empty mask = %v", regions)
+	}
+	if s := (WeakRegion{16, 48}).String(); s != "bytes 1-2" {
+		t.Errorf("String() = %q, expected \"bytes 1-2\"", s)
+	}
+}
+
+func TestWeakBits_RoundTrip(t *testing.T) {
+	disk := createTestDisk(2, 2, 6250)
+	disk.Tracks[1].WeakBits[0] = NewWeakMask(6250, []WeakRegion{{800, 1600}})
+	disk.Tracks[1].IndexBitOffset[0] = 400
+
+	// Weak bits select HFE v3, where RAND opcodes keep them
+	filename := filepath.Join(t.TempDir(), "weak.hfe")
+	if err := Write(filename, disk); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	read, err := Read(filename)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if sig := string(read.Header.HeaderSignature[:]); sig != HFEv3Signature {
+		t.Errorf("written as %q, expected HFE v3", sig)
+	}
+	expected := []WeakRegion{{400, 1200}}
+	if regions := WeakRegions(read.Tracks[1].WeakBits[0]); !reflect.DeepEqual(regions, expected) {
+		t.Errorf("weak regions read %v, expected %v rotated to index", regions, expected)
+	}
+	for pos := 400; pos < 1200; pos++ {
+		if read.Tracks[1].Side0[pos/8] != 0 {
+			t.Fatalf("weak byte %d read as %02x, expected zero", pos/8, read.Tracks[1].Side0[pos/8])
+		}
+	}
+	if read.Tracks[0].HasWeakBits() || read.Tracks[1].WeakBits[1] != nil {
+		t.Errorf("weak bits read on tracks without them")
+	}
+
+	// HFE v1 has no place for weak bits
+	testWriteReadDisk(t, disk, HFEVersion1, func(t *testing.T, original, read *Disk) {
+		if read.hasWeakBits() {
+			t.Errorf("weak bits read from HFE v1")
+		}
+	})
+}
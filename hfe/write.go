@@ -6,18 +6,56 @@ import (
 	"os"
 )
 
+// For single-sided HFE images, the side 1 half of every track block
+// is filled with padding: 0xFF in v1, NOP opcodes in v3.
+// Set to true to store a copy of side 0 there instead, as older
+// versions did, for emulators which expect it.
+var DuplicateSingleSide = false
+
+// Track list of HFE file stores track length in 16 bits, which limits
+// a track (both sides interleaved) to 64 kbytes. When TrimLongTracks is set,
+// longer tracks are trimmed to one revolution, computed from bit rate and RPM.
+// A track which still does not fit (like ED track at 1000 kbps) is stored
+// whole, with only low 16 bits of length in the track list: Read recovers
+// the full length from position of the next track. This is an extension
+// of the format, not understood by other tools: see docs/HFE_File_Format.md.
+var TrimLongTracks = true
+
+// Maximum track length which fits into the track list
+const maxTrackLen = 0xFFFF
+
+// Geometry which HFE file can hold
+const (
+	MaxHFETracks = BlockSize / 4 // Entries of the single track list block
+	MaxHFESides  = 2
+)
+
 // Write a Disk structure to a file, according to it's format.
 func Write(filename string, disk *Disk) error {
-	format := DetectImageFormat(filename)
+	return writeFormat(filename, disk, DetectImageFormat(filename))
+}
+
+// Write a Disk structure to a file in the given format.
+func writeFormat(filename string, disk *Disk, format ImageFormat) error {
 	switch format {
 	case ImageFormatHFE:
+		// Per-track bit rates and weak bits can only be stored in v3 format
+		if disk.hasTrackBitRates() || disk.hasWeakBits() {
+			return WriteHFE(filename, disk, HFEVersion3)
+		}
 		return WriteHFE(filename, disk, HFEVersion1)
+	case ImageFormat86F:
+		return Write86F(filename, disk)
+	case ImageFormatA2R:
+		return WriteA2R(filename, disk)
 	case ImageFormatADF:
 		return WriteADF(filename, disk)
 	case ImageFormatBKD:
 		return WriteBKD(filename, disk)
 	case ImageFormatCP2:
 		return WriteCP2(filename, disk)
+	case ImageFormatD64:
+		return WriteD64(filename, disk)
 	case ImageFormatDCF:
 		return WriteDCF(filename, disk)
 	case ImageFormatEPL:
@@ -28,6 +66,8 @@ func Write(filename string, disk *Disk) error {
 		return WriteIMG(filename, disk)
 	case ImageFormatMFM:
 		return WriteMFM(filename, disk)
+	case ImageFormatMSA:
+		return WriteMSA(filename, disk)
 	case ImageFormatPDI:
 		return WritePDI(filename, disk)
 	case ImageFormatPRI:
@@ -46,22 +86,236 @@ func Write(filename string, disk *Disk) error {
 // Write a Disk structure to an HFE file.
 // version specifies the HFE format version (1, 2, or 3)
 func WriteHFE(filename string, disk *Disk, version HFEVersion) error {
+	if len(disk.Tracks) > MaxHFETracks {
+		return fmt.Errorf("%d tracks do not fit into HFE file (limit %d)", len(disk.Tracks), MaxHFETracks)
+	}
+	w, err := NewWriter(filename, disk.Header, version)
+	if err != nil {
+		return err
+	}
+
+	for i, track := range disk.Tracks {
+		err = w.WriteTrackData(i, track)
+		if err != nil {
+			w.abort()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Writer writes an HFE file incrementally, one track at a time.
+// Track data is written as soon as it is available, and the header
+// and track list are updated on Close, so that an interrupted
+// sequence of writes still produces a valid file with the tracks
+// written so far. The file appears under its name only after Close.
+type Writer struct {
+	Header Header // Header to be written on Close; may be updated between tracks
+
+	file         *atomicFile
+	version      HFEVersion
+	trackHeaders []TrackHeader
+	trackPos     uint16 // Next free position in 512-byte blocks
+	longTracks   bool   // Warning about long tracks was printed
+}
+
+// Create a new HFE file and prepare it for writing tracks.
+// version specifies the HFE format version (1 or 3)
+func NewWriter(filename string, header Header, version HFEVersion) (*Writer, error) {
 	// Validate version
 	if version != HFEVersion1 && version != HFEVersion3 {
-		return fmt.Errorf("invalid HFE version: %d (must be 1 or 3)", version)
+		return nil, fmt.Errorf("invalid HFE version: %d (must be 1 or 3)", version)
+	}
+	if header.NumberOfSide > MaxHFESides {
+		return nil, fmt.Errorf("%d sides do not fit into HFE file (limit %d)", header.NumberOfSide, MaxHFESides)
+	}
+
+	file, err := createAtomic(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		Header:   header,
+		file:     file,
+		version:  version,
+		trackPos: 2, // Start after header and track list blocks
+	}
+
+	// Reserve space for header and track list
+	err = w.writeHeaderAndTrackList()
+	if err != nil {
+		file.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Return true when some tracks have bit rate different from the header
+func (disk *Disk) hasTrackBitRates() bool {
+	for _, track := range disk.Tracks {
+		if track.BitRate != 0 && track.BitRate != disk.Header.BitRate {
+			return true
+		}
+	}
+	return false
+}
+
+// Write data of next track to the file.
+// Tracks must be written in ascending order; skipped tracks are stored as empty.
+func (w *Writer) WriteTrack(i int, side0, side1 []byte) error {
+	return w.WriteTrackData(i, TrackData{Side0: side0, Side1: side1})
+}
+
+// Write next track to the file, including its bit rate.
+// Bit rate of the track is stored only in v3 format.
+func (w *Writer) WriteTrackData(i int, track TrackData) error {
+	if w.file == nil {
+		return fmt.Errorf("writer is closed")
+	}
+	if i < len(w.trackHeaders) {
+		return fmt.Errorf("track %d already written", i)
+	}
+	if i >= MaxHFETracks {
+		return fmt.Errorf("track %d does not fit into HFE file (limit %d tracks)", i, MaxHFETracks)
+	}
+	for len(w.trackHeaders) < i {
+		// Store skipped track as empty
+		err := w.writeTrack(TrackData{})
+		if err != nil {
+			return fmt.Errorf("failed to write track %d: %w", len(w.trackHeaders), err)
+		}
+	}
+	err := w.writeTrack(track)
+	if err != nil {
+		return fmt.Errorf("failed to write track %d: %w", i, err)
+	}
+	return nil
+}
+
+// Encode and write one track at the current position.
+func (w *Writer) writeTrack(track TrackData) error {
+	if w.version != HFEVersion3 {
+		// No way to mark the index: start the track there
+		track = track.FromIndex()
+	}
+	side0, side1, trackLen := w.encodeTrack(track)
+	if trackLen > maxTrackLen && TrimLongTracks {
+		if trimmed, ok := w.trimTrack(track); ok {
+			side0, side1, trackLen = w.encodeTrack(trimmed)
+		}
 	}
 
-	file, err := os.Create(filename)
+	// Track occupies whole blocks, the rest of the last block is padding
+	blocks := (trackLen + BlockSize - 1) / BlockSize
+	if int(w.trackPos)+blocks > 0xFFFF {
+		return fmt.Errorf("track %d does not fit into HFE file", len(w.trackHeaders))
+	}
+	if trackLen > maxTrackLen {
+		if uint16(trackLen) == 0 {
+			// Zero length is reserved for empty tracks
+			trackLen += BlockSize
+			blocks++
+		}
+		if !w.longTracks {
+			fmt.Printf("Warning: track %d is %d bytes long, more than 64 kbytes allowed by HFE format\n",
+				len(w.trackHeaders), trackLen)
+			fmt.Printf("Warning: long tracks are stored as non-standard extension, other tools read them truncated\n")
+			w.longTracks = true
+		}
+	}
+
+	th := TrackHeader{
+		Offset:   w.trackPos,
+		TrackLen: uint16(trackLen), // Low 16 bits for long tracks
+	}
+
+	// Write track data using appropriate function based on version
+	var err error
+	if w.version == HFEVersion3 {
+		// v3: use opcode-encoded track writer
+		err = writeEncodedTrack(w.file.File, blocks*BlockSize, side0, side1)
+	} else {
+		// v1: use raw track writer (no opcodes)
+		err = writeRawTrack(w.file.File, blocks*BlockSize, side0, side1)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return err
+	}
+
+	w.trackHeaders = append(w.trackHeaders, th)
+	w.trackPos += uint16(blocks)
+	return nil
+}
+
+// Prepare track data based on version.
+// Returns data of both sides, and track length in the file.
+func (w *Writer) encodeTrack(track TrackData) ([]byte, []byte, int) {
+	numSides := w.Header.NumberOfSide
+	side0, side1 := track.Side0, track.Side1
+	if w.version == HFEVersion3 {
+		// For v3: encode tracks with opcodes
+		side0 = encodeOpcodes(side0, track.WeakBits[0], track.BitRate, track.indexBit(0))
+		if numSides > 1 {
+			side1 = encodeOpcodes(side1, track.WeakBits[1], track.BitRate, track.indexBit(1))
+		}
+	}
+	if numSides <= 1 {
+		// Side 1 area is padding, unless duplication was requested
+		side1 = nil
+		if DuplicateSingleSide {
+			side1 = side0
+		}
+	}
+
+	// Calculate maximum length (max of both sides)
+	maxLen := len(side0)
+	if len(side1) > maxLen {
+		maxLen = len(side1)
+	}
+
+	// Track length is for both sides: bytelen = maxLen * 2.
+	// It is stored exactly, the file rounds it up to 512-byte boundary.
+	// Track without data is stored as one block of padding,
+	// as zero length is not valid in HFE.
+	trackLen := maxLen * 2
+	if trackLen == 0 {
+		trackLen = BlockSize
+	}
+	return side0, side1, trackLen
+}
+
+// Trim both sides of the track to one revolution.
+// Returns false when the track is not longer than a revolution.
+func (w *Writer) trimTrack(track TrackData) (TrackData, bool) {
+	bitRate := track.BitRate
+	if bitRate == 0 {
+		bitRate = w.Header.BitRate
+	}
+	rpm := w.Header.FloppyRPM
+	if rpm == 0 {
+		rpm = 300
 	}
-	defer file.Close()
 
-	// Prepare header
-	header := disk.Header
+	// Number of bytes per revolution: two MFM half-bits per data bit
+	revLen := int(bitRate) * 1000 * 2 * 60 / int(rpm) / 8
+	if revLen == 0 || (len(track.Side0) <= revLen && len(track.Side1) <= revLen) {
+		return track, false
+	}
+	fmt.Printf("Warning: track %d is too long for HFE format, trimmed to one revolution\n",
+		len(w.trackHeaders))
+	track.Side0 = track.Side0[:min(len(track.Side0), revLen)]
+	track.Side1 = track.Side1[:min(len(track.Side1), revLen)]
+	return track, true
+}
+
+// Write header and track list blocks at the beginning of the file.
+// Number of tracks in the header is set to the number of tracks written.
+func (w *Writer) writeHeaderAndTrackList() error {
+	header := w.Header
 
 	// Set header signature and format revision based on version
-	switch version {
+	switch w.version {
 	case HFEVersion1:
 		copy(header.HeaderSignature[:], HFEv1Signature)
 		header.FormatRevision = 0
@@ -70,8 +324,9 @@ func WriteHFE(filename string, disk *Disk, version HFEVersion) error {
 		header.FormatRevision = 0
 	}
 	header.TrackListOffset = 1
+	header.NumberOfTrack = uint8(len(w.trackHeaders))
 
-	// Write header (512 bytes, padded with 0xFF)
+	// Header block (512 bytes, padded with 0xFF)
 	headerBuf := make([]byte, BlockSize)
 	for i := range headerBuf {
 		headerBuf[i] = 0xFF
@@ -98,133 +353,135 @@ func WriteHFE(filename string, disk *Disk, version HFEVersion) error {
 
 	copy(headerBuf, headerData)
 
-	if _, err := file.Write(headerBuf); err != nil {
+	if _, err := w.file.WriteAt(headerBuf, 0); err != nil {
 		return fmt.Errorf("failed to write header: %w", err)
 	}
 
-	// Calculate track offsets and write track list
+	// Track list block (up to 128 tracks)
 	trackListBuf := make([]byte, BlockSize)
 	for i := range trackListBuf {
 		trackListBuf[i] = 0xFF
 	}
-
-	trackPos := uint16(header.TrackListOffset + 1) // Start after track list block
-
-	// Prepare track data based on version
-	type trackData struct {
-		side0 []byte
-		side1 []byte
+	for i, th := range w.trackHeaders {
+		offset := i * 4
+		binary.LittleEndian.PutUint16(trackListBuf[offset:offset+2], th.Offset)
+		binary.LittleEndian.PutUint16(trackListBuf[offset+2:offset+4], th.TrackLen)
 	}
-	tracks := make([]trackData, len(disk.Tracks))
-	bitrateKbps := disk.Header.BitRate
 
-	if version == HFEVersion3 {
-		// For v3: encode tracks with opcodes
-		for i, track := range disk.Tracks {
-			tracks[i].side0 = encodeOpcodes(track.Side0, bitrateKbps)
-			if disk.Header.NumberOfSide > 1 {
-				tracks[i].side1 = encodeOpcodes(track.Side1, bitrateKbps)
-			} else {
-				tracks[i].side1 = tracks[i].side0
-			}
-		}
-	} else {
-		// For v1: use raw track data (no opcode encoding)
-		for i, track := range disk.Tracks {
-			tracks[i].side0 = track.Side0
-			if disk.Header.NumberOfSide > 1 {
-				tracks[i].side1 = track.Side1
-			} else {
-				tracks[i].side1 = tracks[i].side0
-			}
-		}
+	if _, err := w.file.WriteAt(trackListBuf, BlockSize); err != nil {
+		return fmt.Errorf("failed to write track list: %w", err)
 	}
 
-	// Calculate track offsets using track lengths
-	trackHeaders := make([]TrackHeader, len(disk.Tracks))
-	for i := range tracks {
-		// Calculate maximum length (max of both sides)
-		maxLen := len(tracks[i].side0)
-		if len(tracks[i].side1) > maxLen {
-			maxLen = len(tracks[i].side1)
-		}
-
-		// Track length is for both sides: bytelen = maxLen * 2
-		bytelen := maxLen * 2
-
-		// Round up to 512-byte boundary
-		trackLen := bytelen
-		if trackLen%BlockSize != 0 {
-			trackLen = ((trackLen / BlockSize) + 1) * BlockSize
-		}
+	// Position for track data
+	if _, err := w.file.Seek(int64(w.trackPos)*BlockSize, 0); err != nil {
+		return fmt.Errorf("failed to seek to track data: %w", err)
+	}
+	return nil
+}
 
-		trackHeaders[i].Offset = trackPos
-		trackHeaders[i].TrackLen = uint16(trackLen)
+// Number of tracks written so far.
+func (w *Writer) TrackCount() int {
+	return len(w.trackHeaders)
+}
 
-		// Calculate next track position (in 512-byte blocks)
-		trackPos += uint16(trackLen / BlockSize)
+// Update header and track list, close the file and move it into place.
+func (w *Writer) Close() error {
+	if w.file == nil {
+		return nil
 	}
-
-	// Write track list
-	for i, th := range trackHeaders {
-		offset := i * 4
-		if offset+4 > len(trackListBuf) {
-			// Need to extend track list buffer
-			// For now, assume we fit in one block (up to 128 tracks)
-			if i >= 128 {
-				return fmt.Errorf("too many tracks for single track list block")
-			}
-		}
-		binary.LittleEndian.PutUint16(trackListBuf[offset:offset+2], th.Offset)
-		binary.LittleEndian.PutUint16(trackListBuf[offset+2:offset+4], th.TrackLen)
+	err := w.writeHeaderAndTrackList()
+	file := w.file
+	w.file = nil
+	if err != nil {
+		file.Abort()
+		return err
 	}
+	return file.Commit()
+}
 
-	if _, err := file.Write(trackListBuf); err != nil {
-		return fmt.Errorf("failed to write track list: %w", err)
+// Close and remove the file, without updating it.
+func (w *Writer) abort() {
+	if w.file != nil {
+		w.file.Abort()
+		w.file = nil
 	}
+}
 
-	// Write track data using appropriate function based on version
-	for i := range tracks {
-		var err error
-		if version == HFEVersion3 {
-			// v3: use opcode-encoded track writer
-			err = writeEncodedTrack(file, &trackHeaders[i], tracks[i].side0, tracks[i].side1, disk.Header.NumberOfSide)
-		} else {
-			// v1: use raw track writer (no opcodes)
-			err = writeRawTrack(file, &trackHeaders[i], tracks[i].side0, tracks[i].side1, disk.Header.NumberOfSide)
-		}
-		if err != nil {
-			return fmt.Errorf("failed to write track %d: %w", i, err)
-		}
+// Encode raw MFM bitstream data with HFEv3 opcodes.
+// Nonzero bitrateKbps is stored with SETBITRATE opcode at the start of the track.
+// SETINDEX opcode marks the index pulse at the given bit position.
+// Every byte with weak bitcells, as marked by the weak mask, is stored
+// with RAND opcode, which the emulator plays as random flux.
+//
+// Bytes in opcode range (0xF0-0xFF) cannot be stored as is. Instead, the first
+// 7 bits of such byte are emitted with SKIPBITS opcode (skip 1), and encoding
+// continues from the 8th bit, so the rest of the stream is shifted by one bit.
+// Trailing bits which do not fill a whole byte are emitted with SKIPBITS too,
+// as are the bits before index which do not fill a whole byte.
+// This way every bit pattern is reproduced exactly by decodeOpcodes,
+// except for weak bytes which read back as zeros.
+func encodeOpcodes(data, weak []byte, bitrateKbps uint16, indexBit int) []byte {
+	// Allocate output buffer (worst case: every byte is split)
+	result := make([]byte, 0, len(data)*3/2+9)
+
+	numBits := len(data) * 8
+	if indexBit <= 0 || indexBit >= numBits {
+		// Mark index position at the start of the track
+		indexBit = 0
+		result = append(result, SETINDEX_OPCODE)
 	}
-
-	return nil
+	if bitrateKbps != 0 {
+		result = append(result, SETBITRATE_OPCODE, bitRateToOpcode(bitrateKbps))
+	}
+	if indexBit > 0 {
+		result = encodeBits(result, data, weak, 0, indexBit)
+		result = append(result, SETINDEX_OPCODE)
+	}
+	return encodeBits(result, data, weak, indexBit, numBits)
 }
 
-// Encode raw MFM bitstream data with HFEv3 opcodes
-func encodeOpcodes(data []byte, bitrateKbps uint16) []byte {
-	// Allocate output buffer (worst case: all bytes need escaping)
-	result := make([]byte, 0, len(data))
-
-	// Process each data byte
-	for _, b := range data {
-		// Escape bytes in opcode range (0xF0-0xFF) except RAND_OPCODE (0xF4)
-		// by XORing with 0x90 (per adjustrand function in legacy code)
-		if (b&OPCODE_MASK) == OPCODE_MASK && b != RAND_OPCODE {
-			// Escape by XORing with 0x90
-			result = append(result, b^0x90)
-		} else {
-			// Write byte as-is
+// Append bits of data from pos up to end, encoded with opcodes
+func encodeBits(result, data, weak []byte, pos, end int) []byte {
+	for end-pos >= 8 {
+		if weakAt(weak, pos, 8) {
+			// Random flux in place of the byte
+			result = append(result, RAND_OPCODE)
+			pos += 8
+			continue
+		}
+		b := getByteAt(data, pos)
+		if (b & OPCODE_MASK) != OPCODE_MASK {
+			// Regular data byte
 			result = append(result, b)
+			pos += 8
+			continue
 		}
+		// Opcode-like byte: emit 7 bits only
+		result = append(result, SKIPBITS_OPCODE, 1, b>>1)
+		pos += 7
+	}
+	if tail := end - pos; tail > 0 {
+		// Remaining bits, right-aligned
+		b := getByteAt(data, pos) >> (8 - tail)
+		result = append(result, SKIPBITS_OPCODE, byte(8-tail), b)
 	}
-
 	return result
 }
 
-// writeEncodedTrack writes pre-encoded track data to the file
-func writeEncodedTrack(file *os.File, th *TrackHeader, encodedSide0, encodedSide1 []byte, numSides uint8) error {
-	trackLen := int(th.TrackLen)
+// Get 8 bits of the stream starting at the given bit position,
+// padded with zeros past the end of data.
+func getByteAt(data []byte, pos int) byte {
+	i, shift := pos/8, pos%8
+	b := data[i] << shift
+	if shift != 0 && i+1 < len(data) {
+		b |= data[i+1] >> (8 - shift)
+	}
+	return b
+}
+
+// writeEncodedTrack writes pre-encoded track data to the file,
+// padded with NOP opcodes to trackLen bytes of whole blocks
+func writeEncodedTrack(file *os.File, trackLen int, encodedSide0, encodedSide1 []byte) error {
 
 	// Allocate buffers for each side (padded to trackLen/2)
 	side0Buf := make([]byte, trackLen/2)
@@ -236,69 +493,42 @@ func writeEncodedTrack(file *os.File, th *TrackHeader, encodedSide0, encodedSide
 		side0Buf[i] = NOP_OPCODE
 	}
 
-	if numSides > 1 {
-		copy(side1Buf, encodedSide1)
-		for i := len(encodedSide1); i < len(side1Buf); i++ {
-			side1Buf[i] = NOP_OPCODE
-		}
-	} else {
-		copy(side1Buf, side0Buf)
+	copy(side1Buf, encodedSide1)
+	for i := len(encodedSide1); i < len(side1Buf); i++ {
+		side1Buf[i] = NOP_OPCODE
 	}
 
-	// Interleave side0 and side1 data into track buffer
-	// Side 0: bytes 0-255 of each 512-byte block
-	// Side 1: bytes 256-511 of each 512-byte block
-	trackBuf := make([]byte, trackLen)
-	for k := 0; k < trackLen/BlockSize; k++ {
-		for j := 0; j < 256; j++ {
-			// Head 0
-			trackBuf[k*BlockSize+j] = byteBitsInverter[side0Buf[k*256+j]]
-			// Head 1
-			trackBuf[k*BlockSize+j+256] = byteBitsInverter[side1Buf[k*256+j]]
-		}
-	}
-
-	// Write to file
-	if _, err := file.Write(trackBuf); err != nil {
-		return fmt.Errorf("failed to write track data: %w", err)
-	}
-
-	return nil
+	return writeSides(file, side0Buf, side1Buf)
 }
 
-// writeRawTrack writes raw track data to the file (for v1 format, no opcodes)
-func writeRawTrack(file *os.File, th *TrackHeader, side0, side1 []byte, numSides uint8) error {
-	trackLen := int(th.TrackLen)
+// writeRawTrack writes raw track data to the file (for v1 format, no opcodes),
+// padded to trackLen bytes of whole blocks. Both sides are read back
+// with length of the longer one: v1 has no way to store it per side.
+func writeRawTrack(file *os.File, trackLen int, side0, side1 []byte) error {
 
 	// Allocate buffers for each side (padded to trackLen/2)
 	side0Buf := make([]byte, trackLen/2)
 	side1Buf := make([]byte, trackLen/2)
 
-	// Copy raw data and pad with 0xFF (not NOP opcodes)
-	copy(side0Buf, side0)
-	for i := len(side0); i < len(side0Buf); i++ {
-		side0Buf[i] = 0xFF
-	}
+	// Copy raw data and pad the last block by wrapping around the track
+	wrapTrack(side0Buf, side0)
+	wrapTrack(side1Buf, side1)
 
-	if numSides > 1 {
-		copy(side1Buf, side1)
-		for i := len(side1); i < len(side1Buf); i++ {
-			side1Buf[i] = 0xFF
-		}
-	} else {
-		copy(side1Buf, side0Buf)
-	}
+	return writeSides(file, side0Buf, side1Buf)
+}
 
-	// Interleave side0 and side1 data into track buffer
-	// Side 0: bytes 0-255 of each 512-byte block
-	// Side 1: bytes 256-511 of each 512-byte block
-	trackBuf := make([]byte, trackLen)
-	for k := 0; k < trackLen/BlockSize; k++ {
+// Interleave sides of equal length, padded to whole blocks,
+// and write them to the file.
+// Side 0: bytes 0-255 of each 512-byte block
+// Side 1: bytes 256-511 of each 512-byte block
+func writeSides(file *os.File, side0, side1 []byte) error {
+	trackBuf := make([]byte, len(side0)*2)
+	for k := 0; k < len(trackBuf)/BlockSize; k++ {
 		for j := 0; j < 256; j++ {
 			// Head 0
-			trackBuf[k*BlockSize+j] = byteBitsInverter[side0Buf[k*256+j]]
+			trackBuf[k*BlockSize+j] = byteBitsInverter[side0[k*256+j]]
 			// Head 1
-			trackBuf[k*BlockSize+j+256] = byteBitsInverter[side1Buf[k*256+j]]
+			trackBuf[k*BlockSize+j+256] = byteBitsInverter[side1[k*256+j]]
 		}
 	}
 
@@ -306,10 +536,25 @@ func writeRawTrack(file *os.File, th *TrackHeader, side0, side1 []byte, numSides
 	if _, err := file.Write(trackBuf); err != nil {
 		return fmt.Errorf("failed to write track data: %w", err)
 	}
-
 	return nil
 }
 
+// Fill the buffer with track data, repeated from its beginning when the
+// buffer is longer: HxC firmware plays the track buffer in a loop, so the
+// padding looks like the start of the next revolution. Without track data
+// the buffer is filled with 0xFF.
+func wrapTrack(buf, data []byte) {
+	if len(data) == 0 {
+		for i := range buf {
+			buf[i] = 0xFF
+		}
+		return
+	}
+	for i := 0; i < len(buf); i += len(data) {
+		copy(buf[i:], data)
+	}
+}
+
 // writeBits writes bits from a bitstream to a buffer at a specific offset
 // The bits are written in MSB-first order (will be reversed later)
 // This follows the pattern from hfe.c write_bits function
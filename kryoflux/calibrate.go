@@ -0,0 +1,46 @@
+package kryoflux
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sergev/floppy/config"
+)
+
+// Calibrate verifies the track 0 sensor,
+// and times a full-stroke seek to the last track and back.
+func (c *Client) Calibrate() error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	maxCyl := config.Cyls - 1
+	err := c.configure(c.drive, 0, 0, maxCyl)
+	if err != nil {
+		return fmt.Errorf("failed to configure device: %w", err)
+	}
+	err = c.startMotor()
+	if err != nil {
+		return err
+	}
+
+	// The firmware recalibrates on track 0 request, and fails when TRK0 is not detected
+	err = c.seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek to track 0: %w", err)
+	}
+
+	// Long seek to the last track and back
+	start := time.Now()
+	_, err = c.controlIn(RequestTrack, uint16(maxCyl), false)
+	if err != nil {
+		return fmt.Errorf("failed to seek to track %d: %w", maxCyl, err)
+	}
+	_, err = c.controlIn(RequestTrack, 0, false)
+	if err != nil {
+		return fmt.Errorf("failed to return to track 0: %w", err)
+	}
+	fmt.Printf("Seek Time: %d msec for %d tracks and back\n", time.Since(start).Milliseconds(), maxCyl)
+	return nil
+}
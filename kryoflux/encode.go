@@ -0,0 +1,127 @@
+package kryoflux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// EncodeStream builds a KryoFlux stream file from flux data.
+// Times of flux transitions and index pulses are given in nanoseconds
+// from the start of the stream, in ascending order. They are quantized
+// to the given sample clock, in Hz; index clock is 1/8 of it, as in
+// the device. Result can be saved as a .raw file: it starts with
+// a KFInfo block, carries an Index block for every index pulse,
+// and ends with StreamEnd block and end of stream marker.
+func EncodeStream(transitions []uint64, indexPulses []uint64, sampleClock float64) []byte {
+	e := &streamEncoder{
+		sampleClock: sampleClock,
+		indexClock:  sampleClock / 8,
+		stream:      make([]byte, 0, len(transitions)*11/10+1024),
+	}
+	e.appendOOB(0x04, []byte(fmt.Sprintf("sck=%s, ick=%s\x00",
+		formatClock(e.sampleClock), formatClock(e.indexClock))))
+
+	next := 0 // Next index pulse
+	for _, t := range transitions {
+		ticks := e.ticks(t)
+		for next < len(indexPulses) && e.ticks(indexPulses[next]) < ticks {
+			e.appendIndex(e.ticks(indexPulses[next]))
+			next++
+		}
+		e.appendFlux(ticks)
+	}
+
+	// Index pulses after the last flux transition
+	for ; next < len(indexPulses); next++ {
+		e.appendIndex(e.ticks(indexPulses[next]))
+	}
+
+	// StreamEnd block: Stream Position, Result Code
+	var end [8]byte
+	binary.LittleEndian.PutUint32(end[0:4], e.position)
+	binary.LittleEndian.PutUint32(end[4:8], StreamResultOK)
+	e.appendOOB(0x03, end[:])
+
+	// End of stream marker
+	return append(e.stream, 0x0d, 0x0d, 0x0d, 0x0d)
+}
+
+// State of stream encoding
+type streamEncoder struct {
+	sampleClock float64 // Sample clock in Hz
+	indexClock  float64 // Index clock in Hz
+	stream      []byte  // Stream data
+	position    uint32  // Stream position: bytes of flux data, without OOB blocks
+	cellStart   uint64  // Time of the last flux transition, in sample ticks
+	overflows   uint64  // Ovl16 blocks emitted since the last flux transition
+}
+
+// Convert time in nanoseconds to sample ticks
+func (e *streamEncoder) ticks(ns uint64) uint64 {
+	return uint64(math.Round(float64(ns) * e.sampleClock / 1e9))
+}
+
+// Append flux data block
+func (e *streamEncoder) appendFluxData(data ...byte) {
+	e.stream = append(e.stream, data...)
+	e.position += uint32(len(data))
+}
+
+// Append OOB block with the given type and data
+func (e *streamEncoder) appendOOB(oobType byte, data []byte) {
+	var header [4]byte
+	header[0] = 0x0d
+	header[1] = oobType
+	binary.LittleEndian.PutUint16(header[2:4], uint16(len(data)))
+	e.stream = append(e.stream, header[:]...)
+	e.stream = append(e.stream, data...)
+}
+
+// Append Ovl16 blocks, until the given number is emitted for the current flux cell
+func (e *streamEncoder) appendOverflows(count uint64) {
+	for ; e.overflows < count; e.overflows++ {
+		e.appendFluxData(0x0b)
+	}
+}
+
+// Append flux transition at the given time, in ticks
+func (e *streamEncoder) appendFlux(ticks uint64) {
+	value := ticks - e.cellStart
+	e.appendOverflows(value >> 16)
+	value &= 0xffff
+	switch {
+	case value >= 0x0e && value <= 0xff:
+		// Flux1
+		e.appendFluxData(byte(value))
+	case value <= 0x7ff:
+		// Flux2
+		e.appendFluxData(byte(value>>8), byte(value))
+	default:
+		// Flux3
+		e.appendFluxData(0x0c, byte(value>>8), byte(value))
+	}
+	e.cellStart = ticks
+	e.overflows = 0
+}
+
+// Append Index block for index pulse at the given time, in ticks.
+// Like the device, it refers to the flux cell in progress: stream position
+// of its next block, and sample counter since the start of the cell,
+// which wraps around at 16 bits, when Ovl16 block is emitted.
+func (e *streamEncoder) appendIndex(ticks uint64) {
+	elapsed := ticks - e.cellStart
+	e.appendOverflows(elapsed >> 16)
+
+	// Index block: Stream Position, Sample Counter, Index Counter
+	var block [12]byte
+	binary.LittleEndian.PutUint32(block[0:4], e.position)
+	binary.LittleEndian.PutUint32(block[4:8], uint32(elapsed&0xffff))
+	binary.LittleEndian.PutUint32(block[8:12], uint32(math.Round(float64(ticks)*e.indexClock/e.sampleClock)))
+	e.appendOOB(0x02, block[:])
+}
+
+// Format clock frequency the way the device reports it in KFInfo block
+func formatClock(hz float64) string {
+	return fmt.Sprintf("%.7f", hz)
+}
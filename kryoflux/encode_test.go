@@ -0,0 +1,191 @@
+package kryoflux
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Duration of one tick of sample and index clocks, in nanoseconds
+const (
+	testTickNs      = 1e9 / DefaultSampleClock
+	testIndexTickNs = 1e9 / DefaultIndexClock
+)
+
+// Check that times are equal within the given tolerance
+func checkTimes(t *testing.T, what string, want, got []uint64, tolerance float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d values, expected %d", what, len(got), len(want))
+	}
+	for i := range want {
+		diff := float64(got[i]) - float64(want[i])
+		if diff < -tolerance || diff > tolerance {
+			t.Fatalf("%s #%d: got %d ns, expected %d ns", what, i, got[i], want[i])
+		}
+	}
+}
+
+func TestEncodeStream_RoundTrip(t *testing.T) {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = bytes.Repeat([]byte{byte(i)}, 512)
+	}
+	bits := mfm.NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+	revolution, err := mfm.GenerateFluxTransitions(bits, 250)
+	if err != nil {
+		t.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+
+	// Two revolutions with jitter, stream started 5 msec before index
+	const start, period = 5000000, 200000000
+	rng := rand.New(rand.NewSource(1))
+	var transitions []uint64
+	for rev := uint64(0); rev < 2; rev++ {
+		for _, tr := range revolution {
+			transitions = append(transitions, start+rev*period+tr+uint64(rng.Intn(200)))
+		}
+	}
+	indexPulses := []uint64{start, start + period, start + 2*period}
+	stream := EncodeStream(transitions, indexPulses, DefaultSampleClock)
+
+	c := &Client{}
+	track, stats, err := c.decodeKryoFluxStream(stream)
+	if err != nil {
+		t.Fatalf("decodeKryoFluxStream failed: %v", err)
+	}
+	if len(stats.Desyncs) != 0 || stats.LostBytes != 0 {
+		t.Errorf("stream stats %+v, expected no desyncs", stats)
+	}
+
+	// Flux transitions of both revolutions, relative to index
+	var want []uint64
+	for _, tr := range transitions {
+		if tr >= start {
+			want = append(want, tr-start)
+		}
+	}
+	checkTimes(t, "transition", want, track.Transitions, testTickNs)
+	checkTimes(t, "index", []uint64{0, period, 2 * period}, track.IndexPulses, testIndexTickNs)
+
+	bitcells, err := track.DecodeMFM(250, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(bitcells).CountSectorsIBMPC(); n != 9 {
+		t.Errorf("decoded %d sectors, expected 9", n)
+	}
+}
+
+func TestEncodeStream_Blocks(t *testing.T) {
+	// Flux intervals in ticks, at limits of every block type
+	intervals := []uint64{0x0e, 0xff, 0x0d, 0x100, 0x7ff, 0x800, 0xffff, 0x10000, 0x2abcd, 0x20}
+	var ticks []uint64
+	var transitions []uint64
+	total := uint64(0)
+	for _, v := range intervals {
+		total += v
+		ticks = append(ticks, total)
+		transitions = append(transitions, uint64(float64(total)*testTickNs+0.5))
+	}
+
+	// Index pulse in the middle of the longest cell, past its first overflow,
+	// and another one after the last transition
+	index0 := ticks[7] + 0x18000
+	index1 := ticks[9] + 0x100
+	indexPulses := []uint64{uint64(float64(index0)*testTickNs + 0.5), uint64(float64(index1)*testTickNs + 0.5)}
+	stream := EncodeStream(transitions, indexPulses, DefaultSampleClock)
+
+	s, err := parseStream(stream)
+	if err != nil {
+		t.Fatalf("parseStream() error: %v", err)
+	}
+	fluxData := []byte{
+		0x0e,       // Flux1
+		0xff,       // Flux1
+		0x00, 0x0d, // Flux2
+		0x01, 0x00, // Flux2
+		0x07, 0xff, // Flux2
+		0x0c, 0x08, 0x00, // Flux3
+		0x0c, 0xff, 0xff, // Flux3
+		0x0b, 0x00, 0x00, // Ovl16, Flux2
+		0x0b, 0x0b, 0x0c, 0xab, 0xcd, // Ovl16, Ovl16, Flux3
+		0x20, // Flux1
+	}
+	if !bytes.Equal(s.flux, fluxData) {
+		t.Errorf("flux data %x, expected %x", s.flux, fluxData)
+	}
+	if len(s.index) != 2 || s.index[0].streamPosition != 18 || s.index[0].sampleCounter != 0x8000 ||
+		s.index[1].streamPosition != uint32(len(fluxData)) || s.index[1].sampleCounter != 0x100 {
+		t.Errorf("index blocks %+v", s.index)
+	}
+	if s.stats.Length != uint32(len(fluxData)) || len(s.stats.Desyncs) != 0 {
+		t.Errorf("stream stats %+v", s.stats)
+	}
+
+	// All flux transitions of the stream
+	c := &Client{}
+	decoded, err := c.decodeFlux(s.flux, 0, uint32(len(s.flux)))
+	if err != nil {
+		t.Fatalf("decodeFlux() error: %v", err)
+	}
+	checkTimes(t, "transition", transitions, decoded, testTickNs)
+
+	// Transitions after index pulse in the middle of flux cell
+	track, _, err := c.decodeKryoFluxStream(stream)
+	if err != nil {
+		t.Fatalf("decodeKryoFluxStream failed: %v", err)
+	}
+	checkTimes(t, "transition", []uint64{
+		transitions[8] - indexPulses[0],
+		transitions[9] - indexPulses[0],
+	}, track.Transitions, testTickNs)
+	checkTimes(t, "index", []uint64{0, indexPulses[1] - indexPulses[0]}, track.IndexPulses, testIndexTickNs)
+}
+
+func TestDecodeStream_Revolutions(t *testing.T) {
+	// Three revolutions with different flux intervals and durations
+	intervals := []uint64{2000, 3000, 4000}
+	const perRevolution = 1000
+	start := uint64(1000000)
+	var transitions []uint64
+	indexPulses := []uint64{start}
+	pos := start
+	for _, interval := range intervals {
+		for i := 0; i < perRevolution; i++ {
+			transitions = append(transitions, pos+interval/2+uint64(i)*interval)
+		}
+		pos += perRevolution * interval
+		indexPulses = append(indexPulses, pos)
+	}
+	stream := EncodeStream(transitions, indexPulses, DefaultSampleClock)
+
+	c := &Client{}
+	track, _, err := c.decodeKryoFluxStream(stream)
+	if err != nil {
+		t.Fatalf("decodeKryoFluxStream failed: %v", err)
+	}
+	revs := track.Revolutions()
+	if len(revs) != 3 {
+		t.Fatalf("decoded %d revolutions, expected 3", len(revs))
+	}
+	for r, rev := range revs {
+		if len(rev.Transitions) != perRevolution {
+			t.Errorf("revolution %d: %d transitions, expected %d", r, len(rev.Transitions), perRevolution)
+		}
+		want := perRevolution * intervals[r]
+		if diff := float64(rev.Duration()) - float64(want); diff < -testIndexTickNs || diff > testIndexTickNs {
+			t.Errorf("revolution %d: duration %d ns, expected %d ns", r, rev.Duration(), want)
+		}
+		first := float64(rev.Transitions[0]) - float64(intervals[r]/2)
+		if first < -testIndexTickNs || first > testIndexTickNs {
+			t.Errorf("revolution %d: first transition at %d ns", r, rev.Transitions[0])
+		}
+	}
+	if len(track.Transitions) != 3*perRevolution {
+		t.Errorf("%d transitions in total, expected %d", len(track.Transitions), 3*perRevolution)
+	}
+}
@@ -0,0 +1,222 @@
+package kryoflux
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sergev/floppy/adapter"
+)
+
+// ErrConfigMismatch is reported when the device echoes back
+// configuration other than requested
+var ErrConfigMismatch = errors.New("configuration mismatch")
+
+// REQUEST_INFO indexes beyond 1 and 2, which describe configuration of the device
+const (
+	firstConfigInfo = 3
+	lastConfigInfo  = 6
+)
+
+// Firmware known to echo configuration in REQUEST_INFO. Older firmware
+// gives these indexes other meaning, so mismatches are only traced.
+const strictConfigVersion = 3.0
+
+// DeviceInfo contains KryoFlux device information from REQUEST_INFO
+type DeviceInfo struct {
+	Name             string        // Device name, like "KryoFlux DiskSystem"
+	FirmwareVersion  string        // Firmware version, like "3.00s"
+	BuildDate        string        // Firmware build date and time
+	HardwareID       int           // Hardware ID
+	HardwareRevision int           // Hardware revision
+	SampleClock      float64       // Sample clock in Hz
+	IndexClock       float64       // Index clock in Hz
+	Config           *DeviceConfig // Configuration echoed by the device, nil when not reported
+}
+
+// DeviceConfig is configuration of the device, as reported by
+// REQUEST_INFO indexes beyond 2. Fields not reported are -1.
+type DeviceConfig struct {
+	Device   int // Drive unit
+	Density  int // Density line
+	MinTrack int // First track the head may step to
+	MaxTrack int // Last track the head may step to
+}
+
+func (config *DeviceConfig) String() string {
+	return fmt.Sprintf("device %d, density %d, tracks %d-%d",
+		config.Device, config.Density, config.MinTrack, config.MaxTrack)
+}
+
+// Parse info string and merge its fields into the device info.
+// Info string is a comma-separated list of key=value pairs, like:
+//
+//	name=KryoFlux DiskSystem, version=3.00s, date=Mar 27 2018, time=18:25:55,
+//	hwid=1, hwrv=1, hs=1, sck=24027428.5714285, ick=3003428.5714285625
+//
+// Unknown keys and malformed values are ignored.
+func (info *DeviceInfo) parse(s string) {
+	var date, clock string
+	for _, field := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "name":
+			info.Name = value
+		case "version":
+			info.FirmwareVersion = value
+		case "date":
+			date = value
+		case "time":
+			clock = value
+		case "hwid":
+			if n, err := strconv.Atoi(value); err == nil {
+				info.HardwareID = n
+			}
+		case "hwrv":
+			if n, err := strconv.Atoi(value); err == nil {
+				info.HardwareRevision = n
+			}
+		case "sck":
+			if f, err := strconv.ParseFloat(value, 64); err == nil && f > 0 {
+				info.SampleClock = f
+			}
+		case "ick":
+			if f, err := strconv.ParseFloat(value, 64); err == nil && f > 0 {
+				info.IndexClock = f
+			}
+		}
+	}
+	if date != "" || clock != "" {
+		info.BuildDate = strings.TrimSpace(date + " " + clock)
+	}
+}
+
+// Numeric firmware version, like 3.0 for "3.00s", or 0 when unknown
+func (info *DeviceInfo) firmwareVersion() float64 {
+	s := info.FirmwareVersion
+	end := 0
+	for end < len(s) && (s[end] >= '0' && s[end] <= '9' || s[end] == '.') {
+		end++
+	}
+	version, _ := strconv.ParseFloat(s[:end], 64)
+	return version
+}
+
+// Parse configuration info string and merge its fields into the config,
+// which is allocated when the first field is found. Info string is like:
+//
+//	info=3, dev=0, dens=0, mint=0, maxt=83
+//
+// Long key names "device", "density", "mintrack" and "maxtrack" are
+// accepted as well. Unknown keys and malformed values are ignored.
+func parseConfig(s string, config *DeviceConfig) *DeviceConfig {
+	for _, field := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			continue
+		}
+		if config == nil && configKey(key, &DeviceConfig{}) != nil {
+			config = &DeviceConfig{-1, -1, -1, -1}
+		}
+		if dest := configKey(key, config); dest != nil {
+			*dest = n
+		}
+	}
+	return config
+}
+
+// Field of configuration named by the key, or nil
+func configKey(key string, config *DeviceConfig) *int {
+	if config == nil {
+		return nil
+	}
+	switch key {
+	case "dev", "device":
+		return &config.Device
+	case "dens", "density":
+		return &config.Density
+	case "mint", "mintrack":
+		return &config.MinTrack
+	case "maxt", "maxtrack":
+		return &config.MaxTrack
+	}
+	return nil
+}
+
+// Read configuration back from REQUEST_INFO indexes beyond 2, and compare
+// it with the settings. Indexes which firmware does not implement are not
+// asked again. Mismatch is an error on firmware known to echo configuration.
+func (c *Client) checkConfig(s deviceSettings) error {
+	var config *DeviceConfig
+	for index := uint16(firstConfigInfo); index <= lastConfigInfo; index++ {
+		if c.configInfoEnd != 0 && index >= c.configInfoEnd {
+			break
+		}
+		data, err := c.controlIn(RequestInfo, index, true)
+		if errors.Is(err, adapter.ErrDeviceGone) {
+			return err
+		}
+		if err != nil || len(data) == 0 {
+			// Not implemented by firmware
+			c.configInfoEnd = index
+			break
+		}
+		config = parseConfig(string(data), config)
+	}
+	c.deviceInfo.Config = config
+	if config == nil {
+		return nil
+	}
+	adapter.Tracef(traceName, "device reports %v", config)
+
+	for _, field := range []struct {
+		name      string
+		got, want int
+	}{
+		{"device", config.Device, s.device},
+		{"density", config.Density, s.density},
+		{"min track", config.MinTrack, s.minCyl},
+		{"max track", config.MaxTrack, s.maxCyl},
+	} {
+		if field.got < 0 || field.got == field.want {
+			continue
+		}
+		if c.deviceInfo.firmwareVersion() < strictConfigVersion {
+			adapter.Tracef(traceName, "%s %d differs from %d, ignored on firmware %q",
+				field.name, field.got, field.want, c.deviceInfo.FirmwareVersion)
+			continue
+		}
+		return fmt.Errorf("%w: device reports %s %d, expected %d", ErrConfigMismatch, field.name, field.got, field.want)
+	}
+	return nil
+}
+
+// GetDeviceInfo returns device information obtained during reset
+func (c *Client) GetDeviceInfo() DeviceInfo {
+	return c.deviceInfo
+}
+
+// Sample clock in Hz, as reported by the device
+func (c *Client) sampleClock() float64 {
+	if c.deviceInfo.SampleClock > 0 {
+		return c.deviceInfo.SampleClock
+	}
+	return DefaultSampleClock
+}
+
+// Index clock in Hz, as reported by the device
+func (c *Client) indexClock() float64 {
+	if c.deviceInfo.IndexClock > 0 {
+		return c.deviceInfo.IndexClock
+	}
+	return DefaultIndexClock
+}
@@ -2,6 +2,7 @@ package kryoflux
 
 import (
 	_ "embed"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -9,6 +10,8 @@ import (
 	"time"
 
 	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/hfe"
 
 	"github.com/google/gousb"
 	"go.bug.st/serial/enumerator"
@@ -39,6 +42,8 @@ const (
 	RequestStatus   = 0x80
 	RequestInfo     = 0x81
 
+	MaxTrack = 83 // Last cylinder the firmware steps to
+
 	FWLoadAddress    = 0x00202000
 	FWWriteChunkSize = 16384
 	FWReadChunkSize  = 6400
@@ -46,15 +51,18 @@ const (
 	ControlTimeout = 5 * time.Second // Timeout for USB control transfers (matches legacy C code)
 
 	// Stream reading constants
-	ReadBufferSize = 6400
-	StreamOnValue  = 0x601
+	ReadBufferSize   = 6400
+	StreamBufferSize = 400 * 1024 // Typical stream length for a few revolutions
+	StreamOnValue    = 0x601
+
+	// Result codes in StreamEnd block
+	StreamResultOK        = 0
+	StreamResultBuffering = 1 // Host did not read data fast enough
+	StreamResultNoIndex   = 2 // No index signal detected
 
 	// Default clocks in Hz
 	DefaultSampleClock = 24027428.57142857
 	DefaultIndexClock  = 3003428.5714285625
-
-	// Enable for debug
-	DebugFlag = false
 )
 
 // Timing information about each index.
@@ -77,22 +85,44 @@ type IndexTiming struct {
 	// by the index clock (ick)
 }
 
-// DecodedStreamData contains decoded flux transitions and index information
-type DecodedStreamData struct {
-	FluxTransitions []uint64      // Flux transition times in nanoseconds (relative to first index)
-	IndexPulses     []IndexTiming // Information about index pulse timing
+// controlTransferer performs USB control transfers (implemented by gousb.Device)
+type controlTransferer interface {
+	Control(rType, request uint8, val, idx uint16, data []byte) (int, error)
+}
+
+// bulkReader reads from the bulk IN endpoint (implemented by gousb.InEndpoint)
+type bulkReader interface {
+	Read(buf []byte) (int, error)
+}
+
+// bulkWriter writes to the bulk OUT endpoint (implemented by gousb.OutEndpoint)
+type bulkWriter interface {
+	Write(buf []byte) (int, error)
 }
 
 // Client wraps a USB connection to a KryoFlux device
 type Client struct {
-	ctx         *gousb.Context
-	dev         *gousb.Device
-	intf        *gousb.Interface
-	done        func()
-	bulkOut     *gousb.OutEndpoint
-	bulkIn      *gousb.InEndpoint
-	deviceInfo1 string // From REQUEST_INFO index 1
-	deviceInfo2 string // From REQUEST_INFO index 2
+	ctx           *gousb.Context
+	dev           *gousb.Device
+	intf          *gousb.Interface
+	done          func()
+	ctrl          controlTransferer
+	bulkOut       bulkWriter
+	bulkIn        bulkReader
+	deviceInfo    DeviceInfo              // From REQUEST_INFO index 1 and 2, and configuration
+	configInfoEnd uint16                  // First REQUEST_INFO index not implemented by firmware, or 0
+	drive         int                     // Drive unit: 0 or 1, see SetDrive
+	settings      deviceSettings          // Last configuration, restored after reconnect
+	streamBuf     []byte                  // Scratch buffer for stream capture, reused between tracks
+	open          func() (*Client, error) // Open the device again after it is lost
+	busy          adapter.Busy            // One operation at a time
+	motor         adapter.Motor           // Left running between operations, see startMotor
+}
+
+// Parameters of configure request. The firmware calls limits
+// of head movement tracks, but they are cylinder numbers.
+type deviceSettings struct {
+	device, density, minCyl, maxCyl int
 }
 
 func init() {
@@ -102,6 +132,72 @@ func init() {
 // NewClient creates a new KryoFlux client using USB communication
 // The portDetails parameter is ignored as KryoFlux uses USB directly
 func NewClient(portDetails *enumerator.PortDetails) (adapter.FloppyAdapter, error) {
+	client, err := connect("")
+	if err != nil {
+		return nil, err
+	}
+
+	// Reset device and get info
+	err = client.reset()
+	if err != nil {
+		// Don't fail completely if reset fails - device might still work
+		// client.Close()
+		return nil, fmt.Errorf("failed to reset device: %w", err)
+	}
+	err = client.SetDrive(config.Unit)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.keepMotor()
+
+	// After disconnect, look for the same device
+	serialNumber, _ := client.dev.SerialNumber()
+	client.open = func() (*Client, error) {
+		return connect(serialNumber)
+	}
+	return client, nil
+}
+
+// Open KryoFlux device with the given serial number, or any device
+// when serialNumber is empty, and upload firmware when needed.
+func connect(serialNumber string) (*Client, error) {
+	client, err := openClient(serialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if firmware is present
+	fwPresent, err := client.checkFirmwarePresent()
+	if err != nil {
+		fwPresent = false
+	}
+
+	if !fwPresent {
+		adapter.Progressf("Uploading KryoFlux firmware...\n")
+
+		// Upload firmware
+		err = client.uploadFirmware()
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to upload firmware: %w", err)
+		}
+
+		// Close interface and device explicitly
+		client.Close()
+
+		// Wait for device re-enumeration and reopen it
+		client, err = reopenClient(serialNumber)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// Find KryoFlux device, claim the interface and open bulk endpoints.
+// With non-empty serialNumber, only the device with this serial number is used.
+func openClient(serialNumber string) (*Client, error) {
 	ctx := gousb.NewContext()
 
 	// Open device by VID/PID using OpenDevices
@@ -110,25 +206,38 @@ func NewClient(portDetails *enumerator.PortDetails) (adapter.FloppyAdapter, erro
 		return uint16(desc.Vendor) == VendorID && uint16(desc.Product) == ProductID
 	})
 	if err != nil {
+		for _, d := range devs {
+			d.Close()
+		}
 		ctx.Close()
 		return nil, fmt.Errorf("failed to enumerate USB devices: %w", err)
 	}
-	if len(devs) == 0 {
+
+	// Use the first matching device, and close others
+	var dev *gousb.Device
+	for _, d := range devs {
+		if dev == nil && serialNumber != "" {
+			if sn, _ := d.SerialNumber(); sn != serialNumber {
+				d.Close()
+				continue
+			}
+		}
+		if dev == nil {
+			dev = d
+		} else {
+			d.Close()
+		}
+	}
+	if dev == nil {
 		ctx.Close()
 		return nil, fmt.Errorf("KryoFlux device not found (VID=0x%04X PID=0x%04X)", VendorID, ProductID)
 	}
 
-	// Use the first matching device
-	dev := devs[0]
-	// Close any additional devices if multiple were found
-	for i := 1; i < len(devs); i++ {
-		devs[i].Close()
-	}
-
 	// Get config 1 and claim interface 1 (as per C code: KRYOFLUX_INTERFACE = 1)
 	cfg, err := dev.Config(1)
 	if err != nil {
 		dev.Close()
+		ctx.Close()
 		return nil, fmt.Errorf("failed to get config 1: %w", err)
 	}
 
@@ -136,6 +245,7 @@ func NewClient(portDetails *enumerator.PortDetails) (adapter.FloppyAdapter, erro
 	if err != nil {
 		cfg.Close()
 		dev.Close()
+		ctx.Close()
 		return nil, fmt.Errorf("failed to claim interface %d: %w", Interface, err)
 	}
 
@@ -150,6 +260,7 @@ func NewClient(portDetails *enumerator.PortDetails) (adapter.FloppyAdapter, erro
 	if err != nil {
 		done()
 		dev.Close()
+		ctx.Close()
 		return nil, fmt.Errorf("failed to open bulk out endpoint: %w", err)
 	}
 
@@ -157,149 +268,78 @@ func NewClient(portDetails *enumerator.PortDetails) (adapter.FloppyAdapter, erro
 	if err != nil {
 		done()
 		dev.Close()
+		ctx.Close()
 		return nil, fmt.Errorf("failed to open bulk in endpoint: %w", err)
 	}
 
-	client := &Client{
+	return &Client{
 		ctx:     ctx,
 		dev:     dev,
 		intf:    intf,
 		done:    done,
+		ctrl:    dev,
 		bulkOut: bulkOut,
 		bulkIn:  bulkIn,
-	}
-
-	// Check if firmware is present
-	fwPresent, err := client.checkFirmwarePresent()
-	if err != nil {
-		fwPresent = false
-	}
-
-	if !fwPresent {
-		fmt.Printf("Uploading KryoFlux firmware...\n")
-
-		// Upload firmware
-		err = client.uploadFirmware()
-		if err != nil {
-			client.Close()
-			return nil, fmt.Errorf("failed to upload firmware: %w", err)
-		}
-
-		// Close interface and device explicitly
-		done()
-		dev.Close()
-		ctx.Close()
-
-		// Wait for device re-enumeration
-		time.Sleep(1 * time.Second)
-
-		// Reopen device
-		ctx2 := gousb.NewContext()
-		devs2, err := ctx2.OpenDevices(func(desc *gousb.DeviceDesc) bool {
-			return uint16(desc.Vendor) == VendorID && uint16(desc.Product) == ProductID
-		})
-		if err != nil {
-			ctx2.Close()
-			return nil, fmt.Errorf("failed to reopen device after firmware upload: %w", err)
-		}
-		if len(devs2) == 0 {
-			ctx2.Close()
-			return nil, fmt.Errorf("device not found after firmware upload")
-		}
-
-		dev2 := devs2[0]
-		// Close any additional devices if multiple were found
-		for i := 1; i < len(devs2); i++ {
-			devs2[i].Close()
-		}
-
-		// Get config 1 and claim interface 1
-		cfg2, err := dev2.Config(1)
-		if err != nil {
-			dev2.Close()
-			ctx2.Close()
-			return nil, fmt.Errorf("failed to get config 1 after firmware upload: %w", err)
-		}
-
-		// Claim interface 1
-		// Retry in case device isn't fully ready after re-enumeration
-		var intf2 *gousb.Interface
-		const maxInterfaceRetries = 25
-		const interfaceRetryDelay = 200 * time.Millisecond
-		for retry := 0; retry < maxInterfaceRetries; retry++ {
-			intf2, err = cfg2.Interface(Interface, 0)
-			if err == nil {
-				break
-			}
-			if retry < maxInterfaceRetries-1 {
-				time.Sleep(interfaceRetryDelay)
-			}
-		}
-		if err != nil {
-			cfg2.Close()
-			dev2.Close()
-			ctx2.Close()
-			return nil, fmt.Errorf("failed to claim interface %d after firmware upload (tried %d times): %w", Interface, maxInterfaceRetries, err)
-		}
-
-		done2 := func() {
-			intf2.Close()
-			cfg2.Close()
-		}
-
-		bulkOut2, err := intf2.OutEndpoint(EndpointBulkOut)
-		if err != nil {
-			done2()
-			dev2.Close()
-			ctx2.Close()
-			return nil, fmt.Errorf("failed to open bulk out endpoint after firmware upload: %w", err)
-		}
+	}, nil
+}
 
-		bulkIn2, err := intf2.InEndpoint(EndpointBulkIn)
+// Reopen the device after firmware upload.
+// Device re-enumeration may take a while, especially on slow USB stacks,
+// so retry with growing pauses until the firmware responds.
+func reopenClient(serialNumber string) (*Client, error) {
+	var client *Client
+	err := adapter.Reopen(func() error {
+		c, err := openClient(serialNumber)
 		if err != nil {
-			done2()
-			dev2.Close()
-			ctx2.Close()
-			return nil, fmt.Errorf("failed to open bulk in endpoint after firmware upload: %w", err)
-		}
-
-		client = &Client{
-			ctx:     ctx2,
-			dev:     dev2,
-			intf:    intf2,
-			done:    done2,
-			bulkOut: bulkOut2,
-			bulkIn:  bulkIn2,
+			return err
 		}
 
 		// Verify firmware is now present
-		fwPresent, err = client.checkFirmwarePresent()
-		if err != nil {
-			client.Close()
-			return nil, fmt.Errorf("failed to verify firmware after upload: %w", err)
-		}
+		fwPresent, _ := c.checkFirmwarePresent()
 		if !fwPresent {
-			client.Close()
-			return nil, fmt.Errorf("firmware not present after upload")
+			c.Close()
+			return fmt.Errorf("firmware not present after upload")
 		}
+		client = c
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("after firmware upload: %w", err)
 	}
+	return client, nil
+}
 
-	// Reset device and get info
-	err = client.reset()
-	if err != nil {
-		// Don't fail completely if reset fails - device might still work
-		// client.Close()
-		return nil, fmt.Errorf("failed to reset device: %w", err)
+// usbError maps USB errors with a generic meaning to adapter errors
+func usbError(err error) error {
+	if errors.Is(err, gousb.ErrorNoDevice) {
+		return fmt.Errorf("%w: %v", adapter.ErrDeviceGone, err)
 	}
+	return err
+}
 
-	return client, nil
+// streamResultError converts a StreamEnd result code to an error
+func streamResultError(code uint32) error {
+	switch code {
+	case StreamResultOK:
+		return nil
+	case StreamResultBuffering:
+		return fmt.Errorf("stream buffering problem: %w", adapter.ErrOverflow)
+	case StreamResultNoIndex:
+		return fmt.Errorf("stream failed: %w", adapter.ErrNoIndex)
+	}
+	return fmt.Errorf("stream failed with result code %d", code)
 }
 
 // controlIn performs a control transfer IN request
 func (c *Client) controlIn(request byte, index uint16, silent bool) ([]byte, error) {
 	buf := make([]byte, 512)
-	length, err := c.dev.Control(ControlRequestType, request, 0, index, buf)
+	name := requestName(request, index)
+	start := time.Now()
+	trace(adapter.TraceToDevice, name, adapter.USBSetupPacket(ControlRequestType, request, 0, index, len(buf)), start, nil)
+	length, err := c.ctrl.Control(ControlRequestType, request, 0, index, buf)
+	trace(adapter.TraceFromDevice, name, buf[:max(0, min(length, len(buf)))], start, err)
 	if err != nil {
+		err = usbError(err)
 		if !silent {
 			return nil, fmt.Errorf("control transfer failed: %w", err)
 		}
@@ -386,7 +426,9 @@ func (c *Client) tryCheckStatus() (bool, error) {
 // sendBootloaderString sends a string to the bootloader via bulk out
 func (c *Client) sendBootloaderString(s string) error {
 	data := []byte(s)
+	start := time.Now()
 	_, err := c.bulkOut.Write(data)
+	trace(adapter.TraceToDevice, "bootloader "+s, data, start, err)
 	return err
 }
 
@@ -395,7 +437,9 @@ func (c *Client) recvBootloaderString(size int) (string, error) {
 	buf := make([]byte, size)
 	tot := 0
 	for tot < size {
+		start := time.Now()
 		length, err := c.bulkIn.Read(buf[tot:])
+		trace(adapter.TraceFromDevice, "bootloader reply", buf[tot:tot+max(0, length)], start, err)
 		if err != nil {
 			return "", err
 		}
@@ -449,7 +493,9 @@ func (c *Client) uploadFirmware() error {
 		if int(offs)+chunkSize > int(fwSize) {
 			chunkSize = int(fwSize - offs)
 		}
+		start := time.Now()
 		_, err := c.bulkOut.Write(fwData[int(offs) : int(offs)+chunkSize])
+		trace(adapter.TraceToDevice, "firmware data", fwData[int(offs):int(offs)+chunkSize], start, err)
 		if err != nil {
 			return fmt.Errorf("failed to write firmware chunk at offset %d: %w", offs, err)
 		}
@@ -470,7 +516,9 @@ func (c *Client) uploadFirmware() error {
 			chunkSize = int(fwSize - offs)
 		}
 
+		start := time.Now()
 		length, err := c.bulkIn.Read(verifyBuf[:chunkSize])
+		trace(adapter.TraceFromDevice, "firmware verify", verifyBuf[:max(0, min(length, chunkSize))], start, err)
 		if err != nil {
 			return fmt.Errorf("failed to read firmware chunk for verification at offset %d: %w", offs, err)
 		}
@@ -513,14 +561,16 @@ func (c *Client) reset() error {
 	if err != nil {
 		return fmt.Errorf("info request 1 failed: %w", err)
 	}
-	c.deviceInfo1 = strings.TrimSpace(string(info1))
+	c.deviceInfo = DeviceInfo{}
+	c.configInfoEnd = 0
+	c.deviceInfo.parse(string(info1))
 
 	// Get INFO 2
 	info2, err := c.controlIn(RequestInfo, 2, false)
 	if err != nil {
 		return fmt.Errorf("info request 2 failed: %w", err)
 	}
-	c.deviceInfo2 = strings.TrimSpace(string(info2))
+	c.deviceInfo.parse(string(info2))
 
 	return nil
 }
@@ -543,45 +593,70 @@ func (c *Client) getStatus() (string, error) {
 	return strings.TrimSpace(string(data)), nil
 }
 
+// Describe returns identification of the adapter for image manifest
+func (c *Client) Describe() hfe.ManifestDevice {
+	info := c.deviceInfo
+	return hfe.ManifestDevice{
+		Adapter:  "KryoFlux",
+		Hardware: fmt.Sprintf("ID %d, Revision %d", info.HardwareID, info.HardwareRevision),
+		Firmware: info.FirmwareVersion,
+	}
+}
+
 // PrintStatus prints KryoFlux status information to stdout
 func (c *Client) PrintStatus() {
-	fmt.Printf("KryoFlux Adapter Info:\n")
-	fmt.Printf("%s\n", c.deviceInfo1)
-	fmt.Printf("%s\n", c.deviceInfo2)
+	if err := c.busy.Begin(); err != nil {
+		fmt.Printf("Status unavailable: %v\n", err)
+		return
+	}
+	defer c.busy.End()
+
+	info := c.deviceInfo
+	fmt.Printf("KryoFlux Firmware Version: %s\n", info.FirmwareVersion)
+	if info.Name != "" {
+		fmt.Printf("Device Name: %s\n", info.Name)
+	}
+	if info.BuildDate != "" {
+		fmt.Printf("Build Date: %s\n", info.BuildDate)
+	}
+	fmt.Printf("Hardware: ID %d, Revision %d\n", info.HardwareID, info.HardwareRevision)
+	fmt.Printf("Sample Clock: %.4f MHz\n", c.sampleClock()*1e-6)
+	fmt.Printf("Index Clock: %.4f MHz\n", c.indexClock()*1e-6)
+	fmt.Printf("Drive Unit: %d\n", c.drive)
 
-	// Check whether drive 0 is connected.
+	// Check whether the drive is connected.
 	// Configure device and try to position head at track 0, side 0.
-	configureErr := c.configure(0, 0, 0, 0)
-	motorErr := c.motorOn(0, 0)
-	driveIsConnected := (configureErr == nil) && (motorErr == nil)
+	configureErr := c.configure(c.drive, 0, 0, 0)
+	motorErr := c.startMotor()
+	seekErr := c.seek(0, 0)
+	driveIsConnected := (configureErr == nil) && (motorErr == nil) && (seekErr == nil)
 
 	if !driveIsConnected {
 		fmt.Printf("Floppy Drive: Not detected\n")
-		// Clean up if we partially succeeded (configure worked but motorOn failed)
-		if configureErr == nil {
-			c.motorOff()
-		}
+		// Clean up if we partially succeeded (motor turned on but seek failed)
+		c.motor.Off()
 	} else {
 		fmt.Printf("Floppy Drive: Connected\n")
-		// Ensure motor is turned off when done
-		defer c.motorOff()
+		if config := c.deviceInfo.Config; config != nil {
+			fmt.Printf("Configuration: %v\n", config)
+		}
 
 		// Capture stream data to check for disk insertion and calculate RPM
-		streamData, err := c.captureStream()
+		streamData, err := c.captureStream(StreamRevolutions)
 		if err != nil {
 			fmt.Printf("Floppy Disk: Not inserted\n")
 			return
 		}
 
 		// Decode stream to extract index pulses
-		decoded, err := c.decodeKryoFluxStream(streamData)
+		decoded, _, err := c.decodeKryoFluxStream(streamData)
 		if err != nil {
 			fmt.Printf("Floppy Disk: Not inserted\n")
 			return
 		}
 
 		// Check if at least 2 index pulses are present (indicates disk is inserted)
-		if len(decoded.IndexPulses) < 2 {
+		if decoded.RPM() == 0 {
 			fmt.Printf("Floppy Disk: Not inserted\n")
 			return
 		}
@@ -589,15 +664,32 @@ func (c *Client) PrintStatus() {
 		fmt.Printf("Floppy Disk: Inserted\n")
 
 		// Calculate RPM from decoded stream data
-		rpm, _ := c.calculateRPMAndBitRate(decoded)
-		if rpm > 0 {
-			fmt.Printf("Rotation Speed: %d RPM\n", rpm)
-		}
+		fmt.Printf("Rotation Speed: %d RPM\n", decoded.NominalRPM())
+	}
+}
+
+// SetDrive sets drive unit for subsequent operations: 0 or 1.
+// Motor of the previous unit is turned off.
+func (c *Client) SetDrive(unit int) error {
+	if unit < 0 || unit > 1 {
+		return fmt.Errorf("invalid drive unit: %d (must be 0 or 1)", unit)
+	}
+	if unit != c.drive {
+		c.motor.Off()
 	}
+	c.drive = unit
+	return nil
 }
 
-// configure configures the device with the specified parameters
-func (c *Client) configure(device, density, minTrack, maxTrack int) error {
+// configure configures the device with the specified parameters:
+// the head moves only between minCyl and maxCyl, inclusive
+func (c *Client) configure(device, density, minCyl, maxCyl int) error {
+	if maxCyl > MaxTrack {
+		return fmt.Errorf("cylinder %d is beyond KryoFlux limit of %d: %w", maxCyl, MaxTrack, adapter.ErrBadCylinder)
+	}
+	if minCyl < 0 || minCyl > maxCyl {
+		return fmt.Errorf("invalid range of cylinders: %d-%d: %w", minCyl, maxCyl, adapter.ErrBadCylinder)
+	}
 	_, err := c.controlIn(RequestDevice, uint16(device), false)
 	if err != nil {
 		return fmt.Errorf("failed to set device: %w", err)
@@ -608,32 +700,81 @@ func (c *Client) configure(device, density, minTrack, maxTrack int) error {
 		return fmt.Errorf("failed to set density: %w", err)
 	}
 
-	_, err = c.controlIn(RequestMinTrack, uint16(minTrack), false)
+	_, err = c.controlIn(RequestMinTrack, uint16(minCyl), false)
 	if err != nil {
 		return fmt.Errorf("failed to set min track: %w", err)
 	}
 
-	_, err = c.controlIn(RequestMaxTrack, uint16(maxTrack), false)
+	_, err = c.controlIn(RequestMaxTrack, uint16(maxCyl), false)
 	if err != nil {
 		return fmt.Errorf("failed to set max track: %w", err)
 	}
 
-	return nil
+	c.settings = deviceSettings{device, density, minCyl, maxCyl}
+	return c.checkConfig(c.settings)
+}
+
+// Reconnect to the device after it dropped off the bus, and restore
+// its configuration. Firmware is uploaded again when the device was
+// powered off. Motor and head position are set by the next track read.
+func (c *Client) resume() error {
+	if c.open == nil {
+		return fmt.Errorf("device cannot be reopened")
+	}
+	c.Close()
+	err := adapter.Reopen(func() error {
+		client, err := c.open()
+		if err != nil {
+			return err
+		}
+		err = client.reset()
+		if err != nil {
+			client.Close()
+			return err
+		}
+		c.ctx, c.dev, c.intf, c.done = client.ctx, client.dev, client.intf, client.done
+		c.ctrl, c.bulkOut, c.bulkIn = client.ctrl, client.bulkOut, client.bulkIn
+		c.deviceInfo = client.deviceInfo
+		c.configInfoEnd = client.configInfoEnd
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.motor.SetRunning(false)
+	s := c.settings
+	return c.configure(s.device, s.density, s.minCyl, s.maxCyl)
+}
+
+// Leave the motor running between operations, until idle time expires.
+// KryoFlux has no separate request to deselect the drive.
+func (c *Client) keepMotor() {
+	c.motor.Stop = c.motorOff
+	c.busy.Motor = &c.motor
 }
 
-// motorOn turns on the motor and positions the head at the specified side and track
-func (c *Client) motorOn(side, track int) error {
+// startMotor turns on the motor, unless it is left running by the previous operation
+func (c *Client) startMotor() error {
+	if c.motor.Running() {
+		return nil
+	}
 	_, err := c.controlIn(RequestMotor, 1, false)
 	if err != nil {
 		return fmt.Errorf("failed to turn motor on: %w", err)
 	}
-	_, err = c.controlIn(RequestSide, uint16(side), false)
+	c.motor.SetRunning(true)
+	return nil
+}
+
+// seek positions the head at the specified cylinder and side
+func (c *Client) seek(cyl, head int) error {
+	_, err := c.controlIn(RequestSide, uint16(head), false)
 	if err != nil {
 		return fmt.Errorf("failed to set side: %w", err)
 	}
-	_, err = c.controlIn(RequestTrack, uint16(track), false)
+	_, err = c.controlIn(RequestTrack, uint16(cyl), false)
 	if err != nil {
-		return fmt.Errorf("failed to set track: %w", err)
+		return fmt.Errorf("failed to set cylinder: %w", err)
 	}
 	return nil
 }
@@ -647,6 +788,15 @@ func (c *Client) motorOff() error {
 	return nil
 }
 
+// StopMotor turns off the motor left running after the last operation
+func (c *Client) StopMotor() error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+	return c.motor.Off()
+}
+
 // streamOn starts the stream
 func (c *Client) streamOn() error {
 	_, err := c.controlIn(RequestStream, StreamOnValue, false)
@@ -687,14 +837,64 @@ func (c *Client) writePreamble(file *os.File) error {
 	return nil
 }
 
-// Format formats the floppy disk
+// DiskPresent reports whether a disk is inserted, by looking for index pulses
+// on track 0. KryoFlux does not report the disk change line.
+func (c *Client) DiskPresent() (bool, error) {
+	if err := c.busy.Begin(); err != nil {
+		return false, err
+	}
+	defer c.busy.End()
+
+	err := c.configure(c.drive, 0, 0, 0)
+	if err != nil {
+		return false, err
+	}
+	err = c.startMotor()
+	if err != nil {
+		return false, err
+	}
+	err = c.seek(0, 0)
+	if err != nil {
+		return false, err
+	}
+
+	streamData, err := c.captureStream(StreamRevolutions)
+	if errors.Is(err, adapter.ErrNoIndex) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	decoded, _, err := c.decodeKryoFluxStream(streamData)
+	if err != nil {
+		return false, err
+	}
+	return decoded.RPM() != 0, nil
+}
+
+// IsWriteProtected is not supported: KryoFlux cannot write disks
+func (c *Client) IsWriteProtected() (bool, error) {
+	return false, adapter.ErrNotSupported
+}
+
+// Format is not supported: KryoFlux cannot write disks
 func (c *Client) Format() error {
-	return fmt.Errorf("Format is not supported for KryoFlux adapter")
+	return fmt.Errorf("format %w", adapter.ErrNotSupported)
 }
 
-// Erase erases the floppy disk
-func (c *Client) Erase(numberOfTracks int) error {
-	return fmt.Errorf("Erase is not supported for KryoFlux adapter")
+// Erase is not supported: KryoFlux cannot write disks
+func (c *Client) Erase(numberOfCylinders int) error {
+	return fmt.Errorf("erase %w", adapter.ErrNotSupported)
+}
+
+// Capabilities reports what the adapter can do. Revolutions
+// of a stream are limited only by MaxStreamSize.
+func (c *Client) Capabilities() adapter.Capability {
+	return adapter.Capability{
+		CanRead:               true,
+		SupportsDensitySelect: true,
+		MaxCylinders:          MaxTrack + 1,
+	}
 }
 
 // Close closes the USB connection
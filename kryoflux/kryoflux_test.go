@@ -0,0 +1,893 @@
+package kryoflux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gousb"
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+)
+
+// controlRequest records a control transfer issued by the host.
+type controlRequest struct {
+	request uint8
+	index   uint16
+}
+
+// fakeDevice emulates KryoFlux control and bulk endpoints with canned responses.
+type fakeDevice struct {
+	requests []controlRequest
+	reply    func(request uint8, index uint16) string // Control response text
+	chunks   [][]byte                                 // Bulk IN data, one chunk per read
+	out      bytes.Buffer                             // Bulk OUT data
+	ctrlErr  error                                    // Error returned by control transfers
+	readErr  error                                    // Error returned by bulk reads after all chunks
+}
+
+func (d *fakeDevice) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	d.requests = append(d.requests, controlRequest{request, idx})
+	if d.ctrlErr != nil {
+		return 0, d.ctrlErr
+	}
+	response := fmt.Sprintf("request=%d", idx&0xff)
+	if d.reply != nil {
+		response = d.reply(request, idx)
+	}
+	return copy(data, response), nil
+}
+
+func (d *fakeDevice) Read(buf []byte) (int, error) {
+	if len(d.chunks) == 0 {
+		if d.readErr != nil {
+			return 0, d.readErr
+		}
+		return 0, io.EOF
+	}
+	n := copy(buf, d.chunks[0])
+	d.chunks = d.chunks[1:]
+	return n, nil
+}
+
+func (d *fakeDevice) Write(buf []byte) (int, error) {
+	return d.out.Write(buf)
+}
+
+// Create a client wired to the fake device.
+func newFakeClient(d *fakeDevice) *Client {
+	c := &Client{
+		ctrl:    d,
+		bulkIn:  d,
+		bulkOut: d,
+	}
+	c.keepMotor()
+	return c
+}
+
+func TestControlIn(t *testing.T) {
+	tests := []struct {
+		name    string
+		index   uint16
+		reply   string
+		wantErr bool
+	}{
+		{"matching index", 3, "track=3", false},
+		{"index with trailing data", 1, "info=1, name=KryoFlux DiskSystem", false},
+		{"mismatching index", 2, "track=5", true},
+		{"no value", 0, "hello", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &fakeDevice{reply: func(uint8, uint16) string { return tc.reply }}
+			c := newFakeClient(d)
+
+			data, err := c.controlIn(RequestTrack, tc.index, false)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("controlIn() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && string(data) != tc.reply {
+				t.Errorf("controlIn() = %q, expected %q", data, tc.reply)
+			}
+			if len(d.requests) != 1 || d.requests[0] != (controlRequest{RequestTrack, tc.index}) {
+				t.Errorf("unexpected requests %v", d.requests)
+			}
+		})
+	}
+}
+
+func TestControlInDeviceGone(t *testing.T) {
+	d := &fakeDevice{ctrlErr: gousb.ErrorNoDevice}
+	c := newFakeClient(d)
+
+	_, err := c.controlIn(RequestStatus, 0, false)
+	if !errors.Is(err, adapter.ErrDeviceGone) {
+		t.Errorf("controlIn() error = %v, expected ErrDeviceGone", err)
+	}
+}
+
+func TestCaptureStream(t *testing.T) {
+	stream := makeTestStreamHD(t)
+
+	// Deliver the stream in USB-sized chunks
+	d := &fakeDevice{}
+	for offset := 0; offset < len(stream); offset += ReadBufferSize {
+		end := offset + ReadBufferSize
+		if end > len(stream) {
+			end = len(stream)
+		}
+		d.chunks = append(d.chunks, stream[offset:end])
+	}
+	c := newFakeClient(d)
+
+	data, err := c.captureStream(StreamRevolutions)
+	if err != nil {
+		t.Fatalf("captureStream() error: %v", err)
+	}
+	if !bytes.Equal(data, stream) {
+		t.Fatalf("captured %d bytes, expected %d", len(data), len(stream))
+	}
+
+	// Stream must be started and then stopped
+	want := []controlRequest{{RequestStream, StreamOnValue}, {RequestStream, 0}}
+	if len(d.requests) != len(want) || d.requests[0] != want[0] || d.requests[1] != want[1] {
+		t.Errorf("requests %v, expected %v", d.requests, want)
+	}
+
+	decoded, _, err := c.decodeKryoFluxStream(data)
+	if err != nil {
+		t.Fatalf("decodeKryoFluxStream() error: %v", err)
+	}
+	if len(decoded.IndexPulses) != 2 || len(decoded.Transitions) == 0 {
+		t.Errorf("decoded %d index pulses, %d transitions", len(decoded.IndexPulses), len(decoded.Transitions))
+	}
+}
+
+// endlessDevice emulates a drive which streams until the host stops it:
+// flux of 2 usec, and index pulse every revolution of 200 msec.
+type endlessDevice struct {
+	fakeDevice
+	revBytes  uint32 // Flux bytes per revolution, 0 = no index
+	position  uint32 // Stream position of next flux byte
+	indexes   int    // Index blocks sent
+	ended     bool   // End of stream sent
+	sentBytes int
+}
+
+func (d *endlessDevice) Read(buf []byte) (int, error) {
+	if d.ended {
+		return 0, io.EOF
+	}
+	var chunk []byte
+	if len(d.requests) > 0 && d.requests[len(d.requests)-1] == (controlRequest{RequestStream, 0}) {
+		// Stopped by host: terminate the stream
+		chunk = appendStreamEnd(chunk, d.position, StreamResultOK)
+		chunk = append(chunk, 0x0d, 0x0d, 0x0d, 0x0d)
+		d.ended = true
+	} else {
+		for len(chunk)+16 < len(buf) {
+			if d.revBytes > 0 && d.position%d.revBytes == 0 {
+				ticks := uint32(float64(d.indexes) * 0.2 * DefaultIndexClock)
+				chunk = appendIndexBlock(chunk, d.position, ticks)
+				d.indexes++
+			}
+			chunk = append(chunk, 48) // 2 usec at sample clock
+			d.position++
+		}
+	}
+	d.sentBytes += len(chunk)
+	return copy(buf, chunk), nil
+}
+
+func TestCaptureStream_Revolutions(t *testing.T) {
+	d := &endlessDevice{revBytes: 100000}
+	c := &Client{ctrl: d, bulkIn: d}
+
+	data, err := c.captureStream(2)
+	if err != nil {
+		t.Fatalf("captureStream() error: %v", err)
+	}
+
+	// Stream is stopped right after the third index pulse
+	if d.indexes != 3 || d.sentBytes > 2*100000+2*ReadBufferSize {
+		t.Errorf("device sent %d index pulses, %d bytes", d.indexes, d.sentBytes)
+	}
+	want := []controlRequest{{RequestStream, StreamOnValue}, {RequestStream, 0}}
+	if fmt.Sprint(d.requests) != fmt.Sprint(want) {
+		t.Errorf("requests %v, expected %v", d.requests, want)
+	}
+
+	decoded, _, err := c.decodeKryoFluxStream(data)
+	if err != nil {
+		t.Fatalf("decodeKryoFluxStream() error: %v", err)
+	}
+	if revs := decoded.Revolutions(); len(revs) != 2 {
+		t.Errorf("decoded %d revolutions, expected 2", len(revs))
+	}
+	if rpm := decoded.NominalRPM(); rpm != 300 {
+		t.Errorf("decoded %d RPM, expected 300", rpm)
+	}
+}
+
+// stopFailDevice streams like endlessDevice, and drops off the bus
+// when the host stops the stream
+type stopFailDevice struct {
+	endlessDevice
+}
+
+func (d *stopFailDevice) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if request == RequestStream && idx == 0 {
+		d.requests = append(d.requests, controlRequest{request, idx})
+		return 0, gousb.ErrorNoDevice
+	}
+	return d.endlessDevice.Control(rType, request, val, idx, data)
+}
+
+func TestCaptureStream_StopError(t *testing.T) {
+	d := &stopFailDevice{endlessDevice{revBytes: 100000}}
+	c := &Client{ctrl: d, bulkIn: d}
+
+	_, err := c.captureStream(2)
+	if !errors.Is(err, adapter.ErrDeviceGone) || !strings.Contains(err.Error(), "failed to stop stream") {
+		t.Fatalf("captureStream() error = %v, expected failure to stop stream", err)
+	}
+	want := []controlRequest{{RequestStream, StreamOnValue}, {RequestStream, 0}}
+	if fmt.Sprint(d.requests) != fmt.Sprint(want) {
+		t.Errorf("requests %v, expected %v", d.requests, want)
+	}
+}
+
+func TestCaptureStream_SizeLimit(t *testing.T) {
+	defer func(size int) { MaxStreamSize = size }(MaxStreamSize)
+	MaxStreamSize = 500000
+
+	// Bad index sensor: the stream never ends by itself
+	d := &endlessDevice{}
+	c := &Client{ctrl: d, bulkIn: d}
+
+	_, err := c.captureStream(2)
+	if err == nil || !strings.Contains(err.Error(), "exceeds 500000 bytes") {
+		t.Fatalf("captureStream() error = %v, expected size limit", err)
+	}
+	if d.sentBytes > MaxStreamSize+ReadBufferSize {
+		t.Errorf("device sent %d bytes", d.sentBytes)
+	}
+	want := []controlRequest{{RequestStream, StreamOnValue}, {RequestStream, 0}}
+	if fmt.Sprint(d.requests) != fmt.Sprint(want) {
+		t.Errorf("requests %v, expected stream stopped", d.requests)
+	}
+}
+
+func TestStreamScanner(t *testing.T) {
+	stream := makeTestStreamHD(t)
+
+	// Blocks split between USB transfers are scanned when complete
+	var s streamScanner
+	for i := 1; i <= len(stream); i++ {
+		s.scan(stream[:i])
+		if s.eof && i < len(stream) {
+			t.Fatalf("end of stream found at %d of %d bytes", i, len(stream))
+		}
+	}
+	if !s.eof || s.indexes != 2 {
+		t.Errorf("eof %v, %d index pulses, expected 2", s.eof, s.indexes)
+	}
+}
+
+func TestMeasureRPM(t *testing.T) {
+	stream := makeTestStreamHD(t)
+
+	// Every test stream contains one revolution, so two streams are captured
+	d := &fakeDevice{}
+	for i := 0; i < 2; i++ {
+		for offset := 0; offset < len(stream); offset += ReadBufferSize {
+			d.chunks = append(d.chunks, stream[offset:min(offset+ReadBufferSize, len(stream))])
+		}
+	}
+	c := newFakeClient(d)
+
+	mean, stddev, err := c.MeasureRPM(2)
+	if err != nil {
+		t.Fatalf("MeasureRPM() error: %v", err)
+	}
+	if mean < 295 || mean > 305 || stddev > 0.01 {
+		t.Errorf("MeasureRPM() = %.3f, %.3f, expected about 300, 0", mean, stddev)
+	}
+	if len(d.chunks) != 0 {
+		t.Errorf("%d stream chunks left unread", len(d.chunks))
+	}
+
+	// Motor is left running for the next operation, until stopped
+	if !c.motor.Running() {
+		t.Errorf("motor stopped after operation")
+	}
+	if err := c.StopMotor(); err != nil {
+		t.Fatalf("StopMotor() error: %v", err)
+	}
+	last := d.requests[len(d.requests)-1]
+	if last != (controlRequest{RequestMotor, 0}) {
+		t.Errorf("last request %v, expected motor off", last)
+	}
+}
+
+func TestDriveUnit(t *testing.T) {
+	stream := makeTestStreamHD(t)
+	d := &fakeDevice{}
+	for i := 0; i < 2; i++ {
+		for offset := 0; offset < len(stream); offset += ReadBufferSize {
+			d.chunks = append(d.chunks, stream[offset:min(offset+ReadBufferSize, len(stream))])
+		}
+	}
+	c := newFakeClient(d)
+	if err := c.SetDrive(2); err == nil {
+		t.Errorf("SetDrive(2) accepted invalid unit")
+	}
+	if err := c.SetDrive(1); err != nil {
+		t.Fatalf("SetDrive(1) error: %v", err)
+	}
+	if _, _, err := c.MeasureRPM(1); err != nil {
+		t.Fatalf("MeasureRPM() error: %v", err)
+	}
+	if len(d.requests) == 0 || d.requests[0] != (controlRequest{RequestDevice, 1}) {
+		t.Errorf("requests %v, expected device 1 first", d.requests)
+	}
+}
+
+func TestDeviceInfoParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		info1 string
+		info2 string
+		want  DeviceInfo
+	}{
+		{
+			name:  "firmware 3.00",
+			info1: "info=1, name=KryoFlux DiskSystem, version=3.00s, date=Mar 27 2018, time=18:25:55",
+			info2: "info=2, hwid=1, hwrv=1, hs=1, sck=24027428.5714285, ick=3003428.5714285625",
+			want: DeviceInfo{
+				Name:             "KryoFlux DiskSystem",
+				FirmwareVersion:  "3.00s",
+				BuildDate:        "Mar 27 2018 18:25:55",
+				HardwareID:       1,
+				HardwareRevision: 1,
+				SampleClock:      24027428.5714285,
+				IndexClock:       3003428.5714285625,
+			},
+		},
+		{
+			name:  "all in one string",
+			info1: "info=1, name=KryoFlux DiskSystem, version=2.20s, date=Jan  6 2014, time=17:29:13, hwid=1, hwrv=1, sck=24027428.5714285, ick=3003428.5714285625",
+			want: DeviceInfo{
+				Name:             "KryoFlux DiskSystem",
+				FirmwareVersion:  "2.20s",
+				BuildDate:        "Jan  6 2014 17:29:13",
+				HardwareID:       1,
+				HardwareRevision: 1,
+				SampleClock:      24027428.5714285,
+				IndexClock:       3003428.5714285625,
+			},
+		},
+		{
+			name:  "old firmware without clocks",
+			info1: "info=1, name=KryoFlux DiskSystem, version=2.00",
+			info2: "info=2, hwid=1, hwrv=x, foo=bar, garbage",
+			want: DeviceInfo{
+				Name:            "KryoFlux DiskSystem",
+				FirmwareVersion: "2.00",
+				HardwareID:      1,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &fakeDevice{reply: func(request uint8, index uint16) string {
+				switch {
+				case request == RequestInfo && index == 1:
+					return tc.info1
+				case request == RequestInfo && index == 2:
+					return tc.info2
+				}
+				return ""
+			}}
+			c := newFakeClient(d)
+			if err := c.reset(); err != nil {
+				t.Fatalf("reset() error: %v", err)
+			}
+			if got := c.GetDeviceInfo(); got != tc.want {
+				t.Errorf("GetDeviceInfo() = %+v, expected %+v", got, tc.want)
+			}
+		})
+	}
+
+	// Missing clocks fall back to defaults
+	c := &Client{}
+	if c.sampleClock() != DefaultSampleClock || c.indexClock() != DefaultIndexClock {
+		t.Errorf("default clocks %f, %f", c.sampleClock(), c.indexClock())
+	}
+}
+
+// Fake device which echoes configuration in REQUEST_INFO index 3,
+// with density shifted by the given amount.
+func configDevice(version string, densityShift int) *fakeDevice {
+	var dev, dens, mint, maxt uint16
+	return &fakeDevice{reply: func(request uint8, index uint16) string {
+		switch request {
+		case RequestDevice:
+			dev = index
+		case RequestDensity:
+			dens = index
+		case RequestMinTrack:
+			mint = index
+		case RequestMaxTrack:
+			maxt = index
+		case RequestInfo:
+			switch index {
+			case 1:
+				return "info=1, name=KryoFlux DiskSystem, version=" + version
+			case 3:
+				return fmt.Sprintf("info=3, dev=%d, dens=%d, mint=%d, maxt=%d", dev, int(dens)+densityShift, mint, maxt)
+			case 4:
+				return fmt.Sprintf("info=%d", index)
+			}
+			return "" // Not implemented
+		}
+		return fmt.Sprintf("request=%d", index&0xff)
+	}}
+}
+
+func TestConfigCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  string
+		shift    int
+		wantErr  bool
+		wantNote string
+	}{
+		{"confirming", "3.00s", 0, false, "device reports device 1, density 0, tracks 2-40"},
+		{"mismatching", "3.00s", 1, true, "device reports device 1, density 1, tracks 2-40"},
+		{"mismatching old firmware", "2.20s", 1, false, "density 1 differs from 0, ignored on firmware \"2.20s\""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var notes []string
+			adapter.SetTraceFunc(func(event adapter.TraceEvent) {
+				if event.Direction == adapter.TraceNote {
+					notes = append(notes, event.Command)
+				}
+			})
+			defer adapter.SetTraceFunc(nil)
+
+			d := configDevice(tc.version, tc.shift)
+			c := newFakeClient(d)
+			if err := c.reset(); err != nil {
+				t.Fatalf("reset() error: %v", err)
+			}
+			err := c.configure(1, 0, 2, 40)
+			if tc.wantErr != errors.Is(err, ErrConfigMismatch) {
+				t.Fatalf("configure() error: %v", err)
+			}
+			want := DeviceConfig{Device: 1, Density: tc.shift, MinTrack: 2, MaxTrack: 40}
+			if got := c.GetDeviceInfo().Config; got == nil || *got != want {
+				t.Errorf("Config = %v, expected %v", got, &want)
+			}
+			if !slices.Contains(notes, tc.wantNote) {
+				t.Errorf("trace notes %q, expected %q", notes, tc.wantNote)
+			}
+
+			// Index 5 is not implemented, and not asked again
+			c.configure(1, 0, 2, 40)
+			if n := countRequests(d, controlRequest{RequestInfo, 5}); n != 1 {
+				t.Errorf("info index 5 asked %d times", n)
+			}
+			if n := countRequests(d, controlRequest{RequestInfo, 6}); n != 0 {
+				t.Errorf("info index 6 asked %d times", n)
+			}
+		})
+	}
+
+	// Firmware without configuration info
+	c := newFakeClient(&fakeDevice{})
+	if err := c.configure(0, 0, 0, 83); err != nil {
+		t.Fatalf("configure() error: %v", err)
+	}
+	if config := c.GetDeviceInfo().Config; config != nil {
+		t.Errorf("Config = %v, expected nil", config)
+	}
+}
+
+// Append an OOB StreamEnd block to the stream.
+func appendStreamEnd(stream []byte, streamPosition, resultCode uint32) []byte {
+	block := make([]byte, 12)
+	block[0] = 0x0d
+	block[1] = 0x03
+	binary.LittleEndian.PutUint16(block[2:4], 8)
+	binary.LittleEndian.PutUint32(block[4:8], streamPosition)
+	binary.LittleEndian.PutUint32(block[8:12], resultCode)
+	return append(stream, block...)
+}
+
+func TestStreamResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    uint32
+		wantErr error
+	}{
+		{"ok", StreamResultOK, nil},
+		{"buffering", StreamResultBuffering, adapter.ErrOverflow},
+		{"no index", StreamResultNoIndex, adapter.ErrNoIndex},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stream := makeTestStreamHD(t)
+			end := len(stream) - 16
+			position := binary.LittleEndian.Uint32(stream[end+4:])
+			stream = appendStreamEnd(stream[:end], position, tc.code)
+			stream = append(stream, 0x0d, 0x0d, 0x0d, 0x0d)
+			c := newFakeClient(&fakeDevice{})
+
+			_, _, err := c.decodeKryoFluxStream(stream)
+			if tc.wantErr == nil && err != nil {
+				t.Errorf("decodeKryoFluxStream() error: %v", err)
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("decodeKryoFluxStream() error = %v, expected %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadTrackError(t *testing.T) {
+	defer func(heads int) { config.Heads = heads }(config.Heads)
+	config.Heads = 1
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts.FailFast = true
+
+	// Device aborts the stream because there is no disk
+	var stream []byte
+	stream = appendStreamEnd(stream, 0, StreamResultNoIndex)
+	stream = append(stream, 0x0d, 0x0d, 0x0d, 0x0d)
+	c := newFakeClient(&fakeDevice{chunks: [][]byte{stream}})
+
+	_, err := c.Read(1, nil)
+	var trackErr *adapter.TrackError
+	if !errors.As(err, &trackErr) {
+		t.Fatalf("Read() error = %v, expected TrackError", err)
+	}
+	if trackErr.Cyl != 0 || trackErr.Head != 0 {
+		t.Errorf("TrackError at %d.%d, expected 0.0", trackErr.Cyl, trackErr.Head)
+	}
+	if !errors.Is(err, adapter.ErrNoIndex) || !adapter.IsRetryable(err) {
+		t.Errorf("Read() error = %v, expected retryable ErrNoIndex", err)
+	}
+}
+
+func TestReadFailedTrack(t *testing.T) {
+	defer func(heads int) { config.Heads = heads }(config.Heads)
+	config.Heads = 2
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+
+	// Side 0 of cylinder 2 is good, side 1 has no index in both reads
+	var noIndex []byte
+	noIndex = appendStreamEnd(noIndex, 0, StreamResultNoIndex)
+	noIndex = append(noIndex, 0x0d, 0x0d, 0x0d, 0x0d)
+	newDevice := func() *fakeDevice {
+		stream := makeTestStreamHD(t)
+		d := &fakeDevice{}
+		for offset := 0; offset < len(stream); offset += ReadBufferSize {
+			d.chunks = append(d.chunks, stream[offset:min(offset+ReadBufferSize, len(stream))])
+		}
+		d.chunks = append(d.chunks, noIndex, noIndex)
+		return d
+	}
+
+	// Side 1 is left empty, and reading succeeds
+	adapter.ReadOpts = adapter.ReadOptions{StartTrack: 2, EndTrack: 2, Sides: "both", Retries: 1, MaxFailedTracks: 1}
+	d := newDevice()
+	disk, err := newFakeClient(d).Read(80, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if len(disk.Tracks[2].Side0) == 0 || len(disk.Tracks[2].Side1) != 0 {
+		t.Errorf("side 0 %d bytes, side 1 %d bytes", len(disk.Tracks[2].Side0), len(disk.Tracks[2].Side1))
+	}
+	if len(d.chunks) != 0 {
+		t.Errorf("%d streams not read, expected one retry", len(d.chunks))
+	}
+
+	// Too many failed tracks: the disk is returned with error
+	adapter.ReadOpts.MaxFailedTracks = 0
+	disk, err = newFakeClient(newDevice()).Read(80, nil)
+	var trackErr *adapter.TrackError
+	if !errors.As(err, &trackErr) || trackErr.Cyl != 2 || trackErr.Head != 1 {
+		t.Fatalf("Read() error = %v, expected failure of track 2.1", err)
+	}
+	if disk == nil || len(disk.Tracks[2].Side0) == 0 {
+		t.Errorf("Read() lost track 2.0")
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	defer func(heads int) { config.Heads = heads }(config.Heads)
+	config.Heads = 2
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts = adapter.ReadOptions{StartTrack: 2, EndTrack: 2, Sides: "0"}
+
+	// Only side 0 of cylinder 2 is read
+	stream := makeTestStreamHD(t)
+	d := &fakeDevice{}
+	for offset := 0; offset < len(stream); offset += ReadBufferSize {
+		d.chunks = append(d.chunks, stream[offset:min(offset+ReadBufferSize, len(stream))])
+	}
+	c := newFakeClient(d)
+	disk, err := c.Read(80, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if disk.Header.NumberOfSide != 1 {
+		t.Errorf("NumberOfSide = %d, expected 1", disk.Header.NumberOfSide)
+	}
+	for cyl, track := range disk.Tracks {
+		if len(track.Side1) != 0 || (len(track.Side0) != 0) != (cyl == 2) {
+			t.Errorf("cylinder %d: side 0 %d bytes, side 1 %d bytes", cyl, len(track.Side0), len(track.Side1))
+		}
+	}
+
+	// Firmware must not seek beyond the range
+	for _, req := range []controlRequest{{RequestMinTrack, 2}, {RequestMaxTrack, 2}} {
+		found := false
+		for _, r := range d.requests {
+			found = found || r == req
+		}
+		if !found {
+			t.Errorf("request %v not sent", req)
+		}
+	}
+}
+
+// Read of 82 cylinders seeks every cylinder 0-81 once for each side,
+// and limits the firmware to the same range
+func TestReadAllCylinders(t *testing.T) {
+	defer func(heads int) { config.Heads = heads }(config.Heads)
+	config.Heads = 2
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts = adapter.ReadOptions{EndTrack: -1}
+
+	stream := makeTestStreamHD(t)
+	d := &fakeDevice{}
+	for i := 0; i < 82*2; i++ {
+		for offset := 0; offset < len(stream); offset += ReadBufferSize {
+			d.chunks = append(d.chunks, stream[offset:min(offset+ReadBufferSize, len(stream))])
+		}
+	}
+	c := newFakeClient(d)
+	disk, err := c.Read(82, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if len(disk.Tracks) != 82 || len(disk.Tracks[81].Side1) == 0 {
+		t.Errorf("read %d cylinders, expected 82", len(disk.Tracks))
+	}
+
+	var seeks, expected []controlRequest
+	for _, r := range d.requests {
+		switch r.request {
+		case RequestSide, RequestTrack, RequestMinTrack, RequestMaxTrack:
+			seeks = append(seeks, r)
+		}
+	}
+	expected = append(expected, controlRequest{RequestMinTrack, 0}, controlRequest{RequestMaxTrack, 81})
+	for cyl := uint16(0); cyl < 82; cyl++ {
+		for head := uint16(0); head < 2; head++ {
+			expected = append(expected, controlRequest{RequestSide, head}, controlRequest{RequestTrack, cyl})
+		}
+	}
+	if !slices.Equal(seeks, expected) {
+		t.Errorf("seek requests %v, expected cylinders 0-81", seeks)
+	}
+}
+
+func TestReadReconnect(t *testing.T) {
+	defer func(heads int) { config.Heads = heads }(config.Heads)
+	config.Heads = 1
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts = adapter.ReadOptions{EndTrack: -1, Sides: "0", MaxReconnects: 1}
+	defer func(delay time.Duration) { adapter.ReconnectDelay = delay }(adapter.ReconnectDelay)
+	adapter.ReconnectDelay = time.Millisecond
+
+	// Device drops off the bus after the first track,
+	// and the second track is read after reconnect
+	newDevice := func() *fakeDevice {
+		stream := makeTestStreamHD(t)
+		d := &fakeDevice{}
+		for offset := 0; offset < len(stream); offset += ReadBufferSize {
+			d.chunks = append(d.chunks, stream[offset:min(offset+ReadBufferSize, len(stream))])
+		}
+		return d
+	}
+	lost := newDevice()
+	lost.readErr = gousb.ErrorNoDevice
+	found := newDevice()
+	c := newFakeClient(lost)
+	opened := 0
+	c.open = func() (*Client, error) {
+		opened++
+		return newFakeClient(found), nil
+	}
+
+	disk, err := c.Read(2, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if opened != 1 {
+		t.Errorf("device opened %d times, expected once", opened)
+	}
+	for cyl, track := range disk.Tracks {
+		if len(track.Side0) == 0 {
+			t.Errorf("cylinder %d is empty", cyl)
+		}
+	}
+
+	// Configuration is restored on the new device
+	expected := []controlRequest{
+		{RequestReset, 0}, {RequestInfo, 1}, {RequestInfo, 2},
+		{RequestDevice, 0}, {RequestDensity, 0}, {RequestMinTrack, 0}, {RequestMaxTrack, 1},
+	}
+	if len(found.requests) < len(expected) {
+		t.Fatalf("requests to new device %v, expected %v first", found.requests, expected)
+	}
+	for i, req := range expected {
+		if found.requests[i] != req {
+			t.Errorf("request %d to new device %v, expected %v", i, found.requests[i], req)
+		}
+	}
+}
+
+// Count control requests with the given code and index
+func countRequests(d *fakeDevice, req controlRequest) int {
+	n := 0
+	for _, r := range d.requests {
+		if r == req {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMotorIdle(t *testing.T) {
+	defer func(heads, idle int) { config.Heads, config.MotorIdle = heads, idle }(config.Heads, config.MotorIdle)
+	config.Heads, config.MotorIdle = 1, 60000
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts = adapter.ReadOptions{EndTrack: -1, Sides: "0"}
+
+	// Three tracks, each with own stream
+	stream := makeTestStreamHD(t)
+	d := &fakeDevice{}
+	for i := 0; i < 3; i++ {
+		for offset := 0; offset < len(stream); offset += ReadBufferSize {
+			d.chunks = append(d.chunks, stream[offset:min(offset+ReadBufferSize, len(stream))])
+		}
+	}
+	c := newFakeClient(d)
+	if _, err := c.Read(3, nil); err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+
+	// Motor is turned on once, and head is moved for every track
+	if n := countRequests(d, controlRequest{RequestMotor, 1}); n != 1 {
+		t.Errorf("motor turned on %d times, expected once", n)
+	}
+	if n := countRequests(d, controlRequest{RequestMotor, 0}); n != 0 {
+		t.Errorf("motor turned off %d times during read", n)
+	}
+	for cyl := uint16(0); cyl < 3; cyl++ {
+		if countRequests(d, controlRequest{RequestTrack, cyl}) != 1 {
+			t.Errorf("track %d requested %d times, expected once", cyl, countRequests(d, controlRequest{RequestTrack, cyl}))
+		}
+	}
+
+	// Motor is stopped after idle time. Every poll restarts
+	// the timer: poll less often than it expires.
+	config.MotorIdle = 20
+	deadline := time.Now().Add(time.Second)
+	for {
+		time.Sleep(50 * time.Millisecond)
+		if err := c.busy.Begin(); err == nil {
+			stopped := countRequests(d, controlRequest{RequestMotor, 0}) > 0
+			c.busy.End()
+			if stopped {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("motor was not stopped when idle")
+		}
+	}
+
+	// Next operation turns the motor on again
+	for offset := 0; offset < len(stream); offset += ReadBufferSize {
+		d.chunks = append(d.chunks, stream[offset:min(offset+ReadBufferSize, len(stream))])
+	}
+	if _, _, err := c.MeasureRPM(1); err != nil {
+		t.Fatalf("MeasureRPM() error: %v", err)
+	}
+	if n := countRequests(d, controlRequest{RequestMotor, 1}); n != 2 {
+		t.Errorf("motor turned on %d times, expected twice", n)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var events []adapter.TraceEvent
+	adapter.SetTraceFunc(func(event adapter.TraceEvent) { events = append(events, event) })
+	defer adapter.SetTraceFunc(nil)
+
+	d := &fakeDevice{chunks: [][]byte{[]byte("KryoFlux bootloader\n\r")}}
+	c := newFakeClient(d)
+
+	_, err := c.controlIn(RequestTrack, 40, false)
+	if err != nil {
+		t.Fatalf("controlIn() error = %v", err)
+	}
+	err = c.sendBootloaderString("N#")
+	if err != nil {
+		t.Fatalf("sendBootloaderString() error = %v", err)
+	}
+	_, err = c.recvBootloaderString(512)
+	if err != nil {
+		t.Fatalf("recvBootloaderString() error = %v", err)
+	}
+
+	want := []struct {
+		dir     adapter.TraceDirection
+		command string
+		data    string
+	}{
+		{adapter.TraceToDevice, "TRACK 40", string(adapter.USBSetupPacket(ControlRequestType, RequestTrack, 0, 40, 512))},
+		{adapter.TraceFromDevice, "TRACK 40", "request=40"},
+		{adapter.TraceToDevice, "bootloader N#", "N#"},
+		{adapter.TraceFromDevice, "bootloader reply", "KryoFlux bootloader\n\r"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, expected %d: %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Adapter != "kryoflux" || e.Direction != w.dir || e.Command != w.command || string(e.Data) != w.data {
+			t.Errorf("event %d: %s %s %q %q, expected %s %q %q",
+				i, e.Adapter, e.Direction, e.Command, e.Data, w.dir, w.command, w.data)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	var _ adapter.FloppyAdapter = (*Client)(nil)
+
+	d := &fakeDevice{}
+	c := newFakeClient(d)
+	caps := c.Capabilities()
+	if !caps.CanRead || caps.CanWrite || caps.CanWriteFlux || caps.CanErase || caps.CanFormat ||
+		caps.MaxCylinders != MaxTrack+1 {
+		t.Errorf("Capabilities() = %+v", caps)
+	}
+	for name, err := range map[string]error{
+		"Write":          c.Write(nil, 1),
+		"WriteTrackFlux": c.WriteTrackFlux(0, 0, []uint64{2000}, true),
+		"Erase":          c.Erase(1),
+		"Format":         c.Format(),
+	} {
+		if !errors.Is(err, adapter.ErrNotSupported) {
+			t.Errorf("%s() error = %v, expected not supported", name, err)
+		}
+	}
+	if len(d.requests) != 0 {
+		t.Errorf("requests %v, expected none", d.requests)
+	}
+}
@@ -1,90 +1,44 @@
 package kryoflux
 
 import (
-	"encoding/binary"
 	"fmt"
 	"time"
 
+	"github.com/sergev/floppy/adapter"
 	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/flux"
 	"github.com/sergev/floppy/hfe"
-	"github.com/sergev/floppy/mfm"
 )
 
-// Find EOF marker in the KryoFlux stream data according to the format specification
-// Returns false if validation should continue, true if stream is complete or invalid
-func (c *Client) findEndOfStream(data []byte) bool {
+// Capture a stream from the device and returns the raw stream data.
+// The stream is stopped after the given number of revolutions,
+// that is one more index pulse, and then received up to its end.
+// Failure to stop the stream is an error: the device may still be streaming.
+func (c *Client) captureStream(revolutions int) (data []byte, err error) {
 
-	// Process the data
-	offset := 0
-	for {
-		if offset >= len(data) {
-			// No EOF found - stream is incomplete
-			return false
-		}
-		val := data[offset]
-
-		switch {
-		case val <= 0x07:
-			// Value: 2-byte sequence
-			offset += 2
-		case val == 0x08:
-			// Nop1: 1 byte
-			offset += 1
-		case val == 0x09:
-			// Nop2: 2 bytes
-			offset += 2
-		case val == 0x0a:
-			// Nop3: 3 bytes
-			offset += 3
-		case val == 0x0b:
-			// Overflow16: 1-byte
-			offset++
-		case val == 0x0c:
-			// Value16: 3-byte sequence
-			offset += 3
-		case val == 0x0d:
-			// OOB marker: 4-byte header + data
-			if offset+4 > len(data) {
-				fmt.Printf("Lost OOB header!\n")
-				return true
-			}
-
-			oobType := data[offset+1]
-			if oobType == 0x0d {
-				// End of stream marker
-				return true
-			}
-
-			oobSize := int(data[offset+2]) | (int(data[offset+3]) << 8)
-			if offset+4+oobSize > len(data) {
-				fmt.Printf("Lost OOB data!\n")
-				return true
-			}
-
-			// OOB markers are metadata - skip over them
-			offset += oobSize + 4
-		case val >= 0xe:
-			// Sample: 1-byte
-			offset++
-		}
+	// Reuse the stream buffer between tracks
+	if c.streamBuf == nil {
+		c.streamBuf = make([]byte, 0, StreamBufferSize)
 	}
-}
-
-// Capture a stream from the device and returns the raw stream data
-func (c *Client) captureStream() ([]byte, error) {
-
-	var streamData []byte
+	streamData := c.streamBuf[:0]
+	defer func() {
+		c.streamBuf = streamData[:0]
+	}()
 
 	// Start stream
-	err := c.streamOn()
+	err = c.streamOn()
 	if err != nil {
-		return nil, fmt.Errorf("failed to start stream: %w", err)
+		return nil, err
 	}
 	streamStarted := true
 	defer func() {
-		// Stop stream if we started it
+		// Stop stream if we started it, and report failure unless
+		// there is an error already
 		if streamStarted {
-			c.controlIn(RequestStream, 0, true)
+			stopErr := c.streamOff()
+			if stopErr != nil && err == nil {
+				data, err = nil, stopErr
+			}
 		}
 	}()
 
@@ -95,9 +49,20 @@ func (c *Client) captureStream() ([]byte, error) {
 	startTime := time.Now()
 	lastDataTime := time.Now()
 	dataReceived := false
+	var scanner streamScanner
 
 	// Process incoming data synchronously
 	for {
+		// Without index pulses the device does not end the stream:
+		// stop it after fixed time, and receive the rest of data
+		if adapter.ReadOpts.Indexless && streamStarted && time.Since(startTime) > adapter.ReadOpts.CaptureTime {
+			streamStarted = false
+			err = c.streamOff()
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Check for overall timeout
 		if time.Since(startTime) > maxTotalTime {
 			// If we have some data, return it anyway - might be a partial stream
@@ -122,9 +87,11 @@ func (c *Client) captureStream() ([]byte, error) {
 		}
 
 		// Read data synchronously
+		start := time.Now()
 		length, err := c.bulkIn.Read(buf)
+		trace(adapter.TraceFromDevice, "stream data", buf[:max(0, min(length, len(buf)))], start, err)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read stream data: %w", err)
+			return nil, fmt.Errorf("failed to read stream data: %w", usbError(err))
 		}
 
 		if length == 0 {
@@ -136,162 +103,45 @@ func (c *Client) captureStream() ([]byte, error) {
 		dataReceived = true
 		lastDataTime = time.Now()
 
-		// Copy data
-		data := make([]byte, length)
-		copy(data, buf[:length])
-
 		// Append the data
-		streamData = append(streamData, data...)
+		streamData = append(streamData, buf[:length]...)
+		if len(streamData) > MaxStreamSize {
+			return nil, fmt.Errorf("stream exceeds %d bytes after %d index pulses", MaxStreamSize, scanner.indexes)
+		}
 
 		// Stop processing if EOF found
-		if c.findEndOfStream(data) {
+		scanner.scan(streamData)
+		if scanner.eof {
 			break
 		}
-	}
-
-	return streamData, nil
-}
-
-// Decode OOB Index blocks from the byte stream
-// Returns array of IndexTiming records
-// Typical sequence of OOB blocks is:
-//
-//	KFInfo: infoData='name=KryoFlux DiskSystem, version=3.00s, date=Mar 27 2018, time=18:25:55,
-//	                  hwid=1, hwrv=1, hs=1, sck=24027428.5714285, ick=3003428.5714285625'
-//	Index: streamPosition=21154, sampleCounter=66, indexCounter=109798707
-//	Index: streamPosition=96737, sampleCounter=66, indexCounter=110398148
-//	Index: streamPosition=172321, sampleCounter=66, indexCounter=110997615
-//	Index: streamPosition=247904, sampleCounter=66, indexCounter=111597074
-//	Index: streamPosition=323485, sampleCounter=60, indexCounter=112196534
-//	Index: streamPosition=399070, sampleCounter=66, indexCounter=112795973
-//	StreamEnd: streamPosition=399071, resultCode=0
-//	StreamInfo: streamPosition=399071, transferTime=0
-func (c *Client) decodePulses(data []byte) []IndexTiming {
-
-	var indexPulses []IndexTiming
-
-	// Process the data
-	offset := 0
-	for {
-		if offset >= len(data) {
-			// No EOF found - stream is incomplete
-			return indexPulses
-		}
-		val := data[offset]
-
-		switch {
-		case val <= 0x07:
-			// Value: 2-byte sequence
-			offset += 2
-		case val == 0x08:
-			// Nop1: 1 byte
-			offset += 1
-		case val == 0x09:
-			// Nop2: 2 bytes
-			offset += 2
-		case val == 0x0a:
-			// Nop3: 3 bytes
-			offset += 3
-		case val == 0x0b:
-			// Overflow16: 1-byte
-			offset++
-		case val == 0x0c:
-			// Value16: 3-byte sequence
-			offset += 3
-		case val == 0x0d:
-			// OOB marker: 4-byte header + data
-			if offset+4 > len(data) {
-				// Lost OOB header
-				return indexPulses
-			}
-
-			oobType := data[offset+1]
-			if oobType == 0x0d {
-				// End of stream marker
-				return indexPulses
-			}
-
-			oobSize := int(data[offset+2]) | (int(data[offset+3]) << 8)
-			if offset+4+oobSize > len(data) {
-				// Lost OOB data
-				return indexPulses
-			}
 
-			// Handle Index block (type 0x02)
-			if oobType == 0x02 && oobSize >= 12 {
-				//
-				// Index block: Stream Position (4 bytes), Sample Counter (4 bytes),
-				//              Index Counter (4 bytes)
-				// Example:
-				//      Index: streamPosition=21154, sampleCounter=66, indexCounter=109798707
-				//      Index: streamPosition=96737, sampleCounter=66, indexCounter=110398148
-				//
-				streamPosition := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
-				sampleCounter := binary.LittleEndian.Uint32(data[offset+8 : offset+12])
-				indexCounter := binary.LittleEndian.Uint32(data[offset+12 : offset+16])
-				if DebugFlag {
-					fmt.Printf("--- Index: streamPosition=%d, sampleCounter=%d, indexCounter=%d\n",
-						streamPosition, sampleCounter, indexCounter)
-				}
-				indexPulses = append(indexPulses, IndexTiming{
-					streamPosition: streamPosition,
-					sampleCounter:  sampleCounter,
-					indexCounter:   indexCounter,
-				})
-			}
-
-			// Handle StreamEnd block (type 0x03) - indicates stream has ended
-			if oobType == 0x03 && oobSize >= 8 {
-				// StreamEnd block: Stream Position (4 bytes), Result Code (4 bytes)
-				streamPosition := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
-				resultCode := binary.LittleEndian.Uint32(data[offset+8 : offset+12])
-				if DebugFlag {
-					fmt.Printf("--- StreamEnd: streamPosition=%d, resultCode=%d\n",
-						streamPosition, resultCode)
-				}
-			}
-
-			// Handle StreamInfo block (type 0x01) - provides information on the progress
-			if oobType == 0x03 && oobSize >= 8 {
-				// StreamEnd block: Stream Position (4 bytes), Transfer Time (4 bytes)
-				streamPosition := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
-				transferTime := binary.LittleEndian.Uint32(data[offset+8 : offset+12])
-				if DebugFlag {
-					fmt.Printf("--- StreamInfo: streamPosition=%d, transferTime=%d\n",
-						streamPosition, transferTime)
-				}
-			}
-
-			// Handle KFInfo block (type 0x04) to extract sample clock
-			if oobType == 0x04 && oobSize > 0 {
-				infoData := string(data[offset+4 : offset+4+int(oobSize)])
-				if DebugFlag {
-					fmt.Printf("--- KFInfo: infoData='%s'\n", infoData)
-				}
+		// Enough revolutions: stop the stream, and receive the rest of data
+		if streamStarted && revolutions > 0 && scanner.indexes > revolutions {
+			streamStarted = false
+			err = c.streamOff()
+			if err != nil {
+				return nil, err
 			}
-
-			offset += oobSize + 4
-		case val >= 0xe:
-			// Sample: 1-byte
-			offset++
 		}
 	}
+
+	return streamData, nil
 }
 
 // Extract flux transitions.
 func (c *Client) decodeFlux(data []byte, streamStart uint32, streamEnd uint32) ([]uint64, error) {
+	if streamStart > streamEnd || streamEnd > uint32(len(data)) {
+		return nil, fmt.Errorf("invalid range of flux data %d-%d of %d bytes", streamStart, streamEnd, len(data))
+	}
 
 	ticksAccumulated := uint64(0)
-	tickPeriodNs := 1e9 / DefaultSampleClock // Nanoseconds per tick
+	tickPeriodNs := 1e9 / c.sampleClock() // Nanoseconds per tick
 
 	// Collect all flux transitions with their absolute times in ticks
 	// Filter transitions to only include those between first and second index
-	var fluxTransitions []uint64
+	fluxTransitions := make([]uint64, 0, streamEnd-streamStart)
 
-	if DebugFlag {
-		fmt.Printf("--- decodeFlux() streamStart=%d, streamEnd=%d\n", streamStart, streamEnd)
-		fmt.Printf("--- len(data) = %d\n", len(data))
-	}
+	adapter.Tracef(traceName, "decodeFlux() streamStart=%d, streamEnd=%d, len(data)=%d", streamStart, streamEnd, len(data))
 	i := streamStart
 	for i < streamEnd {
 		val := data[i]
@@ -353,156 +203,126 @@ func (c *Client) decodeFlux(data []byte, streamStart uint32, streamEnd uint32) (
 			i++
 		}
 	}
-	if DebugFlag {
-		fmt.Printf("--- len(fluxTransitions) = %d\n", len(fluxTransitions))
-	}
+	adapter.Tracef(traceName, "len(fluxTransitions) = %d", len(fluxTransitions))
 	return fluxTransitions, nil
 }
 
-// Decode KryoFlux stream data to extract flux transitions and index pulses.
-func (c *Client) decodeKryoFluxStream(data []byte) (*DecodedStreamData, error) {
-
-	// Decode index pulses
-	indexPulses := c.decodePulses(data)
-	if len(indexPulses) < 2 {
-		return nil, fmt.Errorf("no index pulses detected")
-	}
+// Decode KryoFlux stream data to extract flux transitions of the first revolution
+// and times of all index pulses, in nanoseconds relative to the first index pulse.
+// Returns statistics of stream validation. Typical sequence of OOB blocks is:
+//
+//	KFInfo: infoData='name=KryoFlux DiskSystem, version=3.00s, date=Mar 27 2018, time=18:25:55,
+//	                  hwid=1, hwrv=1, hs=1, sck=24027428.5714285, ick=3003428.5714285625'
+//	Index: streamPosition=21154, sampleCounter=66, indexCounter=109798707
+//	Index: streamPosition=96737, sampleCounter=66, indexCounter=110398148
+//	Index: streamPosition=172321, sampleCounter=66, indexCounter=110997615
+//	Index: streamPosition=247904, sampleCounter=66, indexCounter=111597074
+//	Index: streamPosition=323485, sampleCounter=60, indexCounter=112196534
+//	Index: streamPosition=399070, sampleCounter=66, indexCounter=112795973
+//	StreamEnd: streamPosition=399071, resultCode=0
+//	StreamInfo: streamPosition=399071, transferTime=0
+func (c *Client) decodeKryoFluxStream(data []byte) (*flux.FluxTrack, *StreamStats, error) {
 
-	// Decode transitions between two indices
-	fluxTransitions, err := c.decodeFlux(data, indexPulses[0].streamPosition,
-		indexPulses[1].streamPosition)
+	// Split stream into flux data and OOB blocks
+	stream, err := parseStream(data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	result := &DecodedStreamData{
-		FluxTransitions: fluxTransitions,
-		IndexPulses:     indexPulses,
+	stats := &stream.stats
+	if stats.LostFraction() > MaxStreamLoss {
+		return nil, stats, fmt.Errorf("lost %d of %d stream bytes in %d regions: %w",
+			stats.LostBytes, stats.Length, len(stats.Desyncs), adapter.ErrOverflow)
 	}
-	return result, nil
-}
-
-// calculateRPMAndBitRate calculates RPM and bit rate from decoded stream data
-func (c *Client) calculateRPMAndBitRate(decoded *DecodedStreamData) (uint16, uint16) {
-	if len(decoded.IndexPulses) < 2 {
-		return 300, 250 // Default RPM and bit rate
+	if adapter.ReadOpts.Indexless {
+		track, err := c.decodeIndexless(stream)
+		return track, stats, err
 	}
-	if DebugFlag {
-		fmt.Printf("--- len(decoded.IndexPulses) = %d\n", len(decoded.IndexPulses))
+	indexPulses := stream.index
+	if len(indexPulses) < 2 {
+		return nil, stats, fmt.Errorf("not enough index pulses: %w", adapter.ErrNoIndex)
 	}
 
-	// Calculate RPM from index pulse intervals
-	// IndexPulses contains absolute times, so subtract to get interval
-	trackIndexTicks := float64(decoded.IndexPulses[1].indexCounter - decoded.IndexPulses[0].indexCounter)
-	trackDurationNs := uint64(trackIndexTicks / DefaultIndexClock * 1e9)
-	if DebugFlag {
-		fmt.Printf("--- track duration = %d nsec\n", trackDurationNs)
+	// Decode transitions of all revolutions, from the first index to the end
+	fluxTransitions, err := c.decodeFlux(stream.flux, indexPulses[0].streamPosition, uint32(len(stream.flux)))
+	if err != nil {
+		return nil, stats, err
 	}
 
-	rpm := 60e9 / float64(trackDurationNs)
-	if DebugFlag {
-		fmt.Printf("--- rpm = %.2f\n", rpm)
+	// Index pulse came in the middle of the first flux cell:
+	// count time from the pulse, not from the start of the cell
+	if ticks := indexPulses[0].sampleCounter; ticks > 0 {
+		offset := uint64(float64(ticks) * 1e9 / c.sampleClock())
+		for i := range fluxTransitions {
+			fluxTransitions[i] -= min(offset, fluxTransitions[i])
+		}
 	}
-
-	// Round to either 300 or 360 RPM
-	var roundedRPM uint16
-	if rpm < 330 {
-		roundedRPM = 300
-	} else {
-		roundedRPM = 360
+	track := &flux.FluxTrack{
+		Transitions:   fluxTransitions,
+		SampleClockHz: c.sampleClock(),
 	}
-
-	// Calculate bit rate from transition count and track duration
-	transitionCount := uint64(len(decoded.FluxTransitions))
-	bitsPerMsec := transitionCount * 1e6 / trackDurationNs
-
-	// Round to standard floppy drive bitrates: 250, 500, or 1000 kbps
-	var roundedBitRate uint16
-	if bitsPerMsec < 375 {
-		roundedBitRate = 250
-	} else if bitsPerMsec < 750 {
-		roundedBitRate = 500
-	} else {
-		roundedBitRate = 1000
+	for _, pulse := range indexPulses {
+		// Index counter is measured with index clock, and wraps around at 32 bits
+		ticks := pulse.indexCounter - indexPulses[0].indexCounter
+		track.IndexPulses = append(track.IndexPulses, uint64(float64(ticks)/c.indexClock()*1e9))
 	}
-
-	return roundedRPM, roundedBitRate
+	adapter.Tracef(traceName, "track duration = %d nsec", track.IndexPulses[1])
+	return track, stats, nil
 }
 
-// Recover raw MFM bitcells from KryoFlux decoded stream data using PLL,
-// and returns MFM bitcells as bytes (bitcells packed MSB-first, not decoded data bits)
-func (c *Client) decodeFluxToMFM(decoded *DecodedStreamData, bitRateKhz uint16) ([]byte, error) {
-	if len(decoded.FluxTransitions) == 0 {
-		return nil, fmt.Errorf("no flux transitions found")
+// Decode all flux transitions of the stream captured without index pulses,
+// and place index pulses at the revolution period found in flux data.
+func (c *Client) decodeIndexless(stream *kfStream) (*flux.FluxTrack, error) {
+	fluxTransitions, err := c.decodeFlux(stream.flux, 0, uint32(len(stream.flux)))
+	if err != nil {
+		return nil, err
 	}
-
-	// Create and initialize PLL decoder with transitions
-	decoder := mfm.NewDecoder(decoded.FluxTransitions, bitRateKhz)
-
-	// Ignore first half-bit (as done in reference implementation)
-	_ = decoder.NextBit()
-
-	// Generate MFM bitcells using PLL algorithm
-	var bitcells []bool
-	for {
-		// Check if transitions are exhausted or nearly exhausted BEFORE generating more bits
-		if decoder.IsDone() {
-			// Transitions exhausted - stop immediately
-			break
-		}
-
-		first := decoder.NextBit()
-		second := decoder.NextBit()
-
-		bitcells = append(bitcells, first)
-		bitcells = append(bitcells, second)
+	track := &flux.FluxTrack{
+		Transitions:   fluxTransitions,
+		SampleClockHz: c.sampleClock(),
 	}
-	if DebugFlag {
-		fmt.Printf("--- len(bitcells) = %d\n", len(bitcells))
+	err = track.SynthesizeIndex()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, adapter.ErrNoIndex)
 	}
+	adapter.Tracef(traceName, "estimated track duration = %d nsec", track.IndexPulses[1])
+	return track, nil
+}
 
-	if len(bitcells) == 0 {
-		return nil, fmt.Errorf("no bitcells generated")
+// ReadTrack reads one track into memory, and decodes it with
+// rates measured on the track itself, unless forced by ReadOpts
+func (c *Client) ReadTrack(cyl, head int) (*adapter.TrackCapture, error) {
+	if err := c.busy.Begin(); err != nil {
+		return nil, err
 	}
+	defer c.busy.End()
 
-	// Pack bitcells as bytes (MSB-first)
-	var mfmBytes []byte
-	currentByte := byte(0)
-	bitCount := 0
-
-	for _, bit := range bitcells {
-		if bit {
-			currentByte |= 1 << (7 - bitCount)
-		}
-		bitCount++
-
-		// When we have 8 bits, save the byte and start a new one
-		if bitCount == 8 {
-			mfmBytes = append(mfmBytes, currentByte)
-			currentByte = 0
-			bitCount = 0
-		}
+	err := adapter.CheckTrack(cyl, head)
+	if err != nil {
+		return nil, err
 	}
 
-	// Add any remaining partial byte
-	if bitCount > 0 {
-		mfmBytes = append(mfmBytes, currentByte)
-	}
-	if DebugFlag {
-		fmt.Printf("--- len(mfmBytes) = %d\n", len(mfmBytes))
+	// Configure device, and limit head movement to the track
+	err = c.configure(c.drive, 0, cyl, cyl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure device: %w", err)
 	}
+	return c.readTrack(&diskReader{single: true}, cyl, head)
+}
 
-	if len(mfmBytes) == 0 {
-		return nil, fmt.Errorf("no MFM bytes generated")
+// Read reads the entire floppy disk and returns it as a disk object.
+// When w is not nil, every track is also saved to it as soon as it is read.
+func (c *Client) Read(numberOfCylinders int, w *hfe.Writer) (*hfe.Disk, error) {
+	if err := c.busy.Begin(); err != nil {
+		return nil, err
 	}
+	defer c.busy.End()
 
-	return mfmBytes, nil
-}
-
-// Read reads the entire floppy disk and returns it as a disk object
-func (c *Client) Read(numberOfTracks int) (*hfe.Disk, error) {
+	// Range of cylinders and heads to read
+	firstCyl, lastCyl := adapter.ReadOpts.Cylinders(numberOfCylinders)
+	firstHead, lastHead := adapter.ReadOpts.Heads(config.Heads)
 
-	// Configure device with default values (device=0, density=0, minTrack=0, maxTrack=N-1)
-	err := c.configure(0, 0, 0, numberOfTracks-1)
+	// Configure device (device=0, density=0), and limit head movement to the range
+	err := c.configure(c.drive, 0, firstCyl, lastCyl)
 	if err != nil {
 		return nil, fmt.Errorf("failed to configure device: %w", err)
 	}
@@ -510,8 +330,8 @@ func (c *Client) Read(numberOfTracks int) (*hfe.Disk, error) {
 	// Initialize disk structure
 	disk := &hfe.Disk{
 		Header: hfe.Header{
-			NumberOfTrack:       uint8(numberOfTracks),
-			NumberOfSide:        uint8(config.Heads),
+			NumberOfTrack:       uint8(numberOfCylinders),
+			NumberOfSide:        uint8(adapter.ReadOpts.NumberOfSides(config.Heads)),
 			TrackEncoding:       hfe.ENC_ISOIBM_MFM,
 			BitRate:             500,              // Will be calculated from flux data
 			FloppyRPM:           300,              // Will be calculated from flux data
@@ -524,77 +344,254 @@ func (c *Client) Read(numberOfTracks int) (*hfe.Disk, error) {
 			Track0S1AltEncoding: 0xFF, // Use default encoding
 			Track0S1Encoding:    hfe.ENC_ISOIBM_MFM,
 		},
-		Tracks: make([]hfe.TrackData, numberOfTracks),
+		Tracks: make([]hfe.TrackData, numberOfCylinders),
 	}
 
 	// Assume uknown bitrate
 	disk.Header.BitRate = 0
 
+	r := &diskReader{}
+	failures := &adapter.TrackFailures{Reconnect: c.resume}
+
 	// Iterate through cylinders and sides
-	for cyl := 0; cyl < numberOfTracks; cyl++ {
-		for side := 0; side < config.Heads; side++ {
+	for cyl := firstCyl; cyl <= lastCyl; cyl++ {
+		for head := firstHead; head <= lastHead; head++ {
 			// Print progress message
-			if cyl != 0 || side != 0 {
-				fmt.Printf("\rReading track %d, side %d...", cyl, side)
+			if cyl != firstCyl || head != firstHead {
+				fmt.Printf("\rReading track %d, side %d...", cyl, head)
 			}
 
-			// Turn on motor and position head
-			err = c.motorOn(side, cyl)
+			err = failures.Read(cyl, head, func() error {
+				capture, err := c.readTrack(r, cyl, head)
+				if err != nil {
+					return err
+				}
+				capture.Store(disk)
+				disk.Header.FloppyRPM, disk.Header.BitRate = r.rates.Disk()
+				r.encoding.Update(disk, capture)
+				return nil
+			})
 			if err != nil {
-				fmt.Printf(" ERROR\n")
-				c.motorOff()
-				return nil, fmt.Errorf("failed to position head at track %d, side %d: %v", cyl, side, err)
+				return nil, err
 			}
+		}
 
-			// Capture stream data to memory
-			streamData, err := c.captureStream()
+		// Save completed track to the output file
+		if w != nil {
+			w.Header = disk.Header
+			err = w.WriteTrackData(cyl, disk.Tracks[cyl])
 			if err != nil {
 				fmt.Printf(" ERROR\n")
-				c.motorOff()
-				return nil, fmt.Errorf("failed to capture stream from track %d, side %d: %v", cyl, side, err)
+				return nil, fmt.Errorf("failed to save track %d: %w", cyl, err)
 			}
+		}
+	}
+	fmt.Printf("\nRead complete.\n")
+	if r.damagedTracks > 0 {
+		fmt.Printf("Stream data lost on %d tracks.\n", r.damagedTracks)
+	}
+	if report := r.rates.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.recovery.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.recovery.LockReport(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.locks.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.verifier.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.encoding.Report(disk); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.weak.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := failures.Report(); report != "" {
+		fmt.Println(report)
+	}
 
-			// Decode stream data to extract flux transitions
-			decoded, err := c.decodeKryoFluxStream(streamData)
-			if err != nil {
-				fmt.Printf(" ERROR\n")
-				c.motorOff()
-				return nil, fmt.Errorf("failed to decode stream from track %d, side %d: %v", cyl, side, err)
-			}
+	return disk, failures.Err()
+}
 
-			// Calculate RPM and BitRate from first track
-			if disk.Header.BitRate == 0 {
-				calculatedRPM, calculatedBitRate := c.calculateRPMAndBitRate(decoded)
-				fmt.Printf("Rotation Speed: %d RPM\n", calculatedRPM)
-				fmt.Printf("Bit Rate: %d kbps\n", calculatedBitRate)
+// State of reading the disk, shared between tracks
+type diskReader struct {
+	single          bool   // Reading a single track: rates are measured on it quietly
+	bitRate         uint16 // Bit rate of the track being read, 0 until the first track
+	rpm             uint16 // Rotation speed of the track being read
+	rates           adapter.RateEstimator
+	recovery        flux.SpeedRecovery
+	verifier        adapter.Verifier
+	locks           adapter.LockLog
+	encoding        adapter.EncodingDetector
+	weak            adapter.WeakDetector
+	damagedTracks   int  // Tracks with stream data lost in transfer
+	noIndexReported bool // Warning about missing index signal is printed
+}
 
-				disk.Header.FloppyRPM = calculatedRPM
-				disk.Header.BitRate = calculatedBitRate
-			}
+// Read one track, and decode it as the given cylinder and head of the disk.
+// Bit rate and RPM of the disk are measured on the first tracks decoded.
+func (c *Client) readTrack(r *diskReader, cyl, head int) (*adapter.TrackCapture, error) {
+	// Motor stays on for the whole disk, unless the device was reconnected
+	err := c.startMotor()
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+	}
+	err = c.seek(cyl, head)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to position head: %w", err)}
+	}
+
+	// Capture stream data to memory
+	streamData, err := c.captureStream(adapter.ReadOpts.TrackRevolutions(StreamRevolutions))
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to capture stream: %w", err)}
+	}
+
+	// Decode stream data to extract flux transitions
+	decoded, stats, err := c.decodeKryoFluxStream(streamData)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to decode stream: %w", err)}
+	}
+	err = adapter.CheckIndex(decoded)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+	}
+	if stats.NoIndex && !r.noIndexReported {
+		fmt.Printf("\nWarning: no index signal detected, revolutions are found from flux data\n")
+		r.noIndexReported = true
+	}
+	if len(stats.Desyncs) > 0 {
+		fmt.Printf("\nWarning: track %d, side %d: %d stream bytes lost in %d regions\n",
+			cyl, head, stats.LostBytes, len(stats.Desyncs))
+		r.damagedTracks++
+	}
+
+	// Calculate RPM and BitRate of the track, unless given by user
+	if r.single {
+		r.rpm, r.bitRate = adapter.ReadOpts.TrackRates(decoded)
+	} else {
+		r.rpm, r.bitRate = r.rates.Rates(decoded)
+	}
+
+	// Pass flux transitions of the first revolution for analysis
+	if adapter.AnalysisEnabled() {
+		if revs := decoded.Revolutions(); len(revs) > 0 {
+			adapter.ReportFlux(cyl, head, revs[0].Transitions)
+		}
+	}
+
+	// Decode flux data to MFM bitstream
+	mfmBitstream, adjust, err := r.recovery.DecodeMFM(decoded, r.bitRate)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to decode flux data to MFM: %w", err)}
+	}
+	if !r.single {
+		if adapter.ReadOpts.Indexless && len(r.rates.Measurements) == 0 {
+			fmt.Printf("Estimated Rotation Speed: %.1f RPM\n", decoded.RPM())
+		}
+		r.rates.Add(cyl, head, decoded)
+	}
+	if adjust != 0 {
+		fmt.Printf("\nWarning: track %d, side %d: decoded at %+.1f%% bit rate\n", cyl, head, adjust*100)
+	}
+	if r.recovery.Weak {
+		fmt.Printf("\nWarning: track %d, side %d: weak PLL lock, phase error %.1f%% RMS at %.0f ns period\n",
+			cyl, head, r.recovery.Lock.LockQuality*100, r.recovery.Lock.PeriodNs)
+	}
+
+	// Flux of the first capture is kept, even when verified with new captures
+	capture := &adapter.TrackCapture{
+		Cyl:     cyl,
+		Head:    head,
+		BitRate: r.bitRate,
+		RPM:     r.rpm,
+		Flux:    decoded,
+		Lock:    r.recovery.Lock,
+	}
 
-			// Decode flux data to MFM bitstream
-			mfmBitstream, err := c.decodeFluxToMFM(decoded, disk.Header.BitRate)
+	// Verify the track with other revolutions of the capture, then with new captures
+	if adapter.ReadOpts.Verify {
+		rev := 0
+		mfmBitstream, err = r.verifier.Track(cyl, head, mfmBitstream, func() ([]byte, error) {
+			rev++
+			if rev < len(decoded.Revolutions()) {
+				return r.recovery.DecodeRevolutionMFM(decoded, rev, r.bitRate, adjust)
+			}
+			streamData, err := c.captureStream(adapter.ReadOpts.TrackRevolutions(StreamRevolutions))
 			if err != nil {
-				fmt.Printf(" ERROR\n")
-				c.motorOff()
-				return nil, fmt.Errorf("failed to decode flux data to MFM from track %d, side %d: %v", cyl, side, err)
+				return nil, err
 			}
-
-			// Store MFM bitstream in appropriate side
-			if side == 0 {
-				disk.Tracks[cyl].Side0 = mfmBitstream
-			} else {
-				disk.Tracks[cyl].Side1 = mfmBitstream
+			decoded, _, err = c.decodeKryoFluxStream(streamData)
+			if err != nil {
+				return nil, err
 			}
+			rev = 0
+			return r.recovery.DecodeRevolutionMFM(decoded, 0, r.bitRate, adjust)
+		})
+		if err != nil {
+			return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
 		}
 	}
-	fmt.Printf("\nRead complete.\n")
 
-	// Turn off motor
-	err = c.motorOff()
+	// Pass alignment of sectors to the index for analysis
+	adapter.ReportLayout(cyl, head, mfmBitstream, r.bitRate)
+	capture.MFM, capture.Index = adapter.RevolutionMFM(mfmBitstream, r.bitRate, r.rpm)
+	r.weak.Detect(capture)
+	r.locks.Add(capture)
+	return capture, nil
+}
+
+// MeasureRPM measures rotation speed over the given number of revolutions.
+// Returns mean speed and its standard deviation, in RPM.
+func (c *Client) MeasureRPM(revolutions int) (float64, float64, error) {
+	if err := c.busy.Begin(); err != nil {
+		return 0, 0, err
+	}
+	defer c.busy.End()
+
+	if revolutions < 1 {
+		return 0, 0, fmt.Errorf("invalid number of revolutions: %d", revolutions)
+	}
+
+	// Use track 0, side 0 of the selected drive
+	err := c.configure(c.drive, 0, 0, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to configure device: %w", err)
+	}
+	err = c.startMotor()
 	if err != nil {
-		return nil, fmt.Errorf("failed to turn off motor: %w", err)
+		return 0, 0, err
+	}
+	err = c.seek(0, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to position head: %w", err)
 	}
 
-	return disk, nil
+	// Each stream contains several revolutions: capture until we have enough
+	var periods []float64
+	for len(periods) < revolutions {
+		streamData, err := c.captureStream(revolutions)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to capture stream: %w", err)
+		}
+		stream, err := parseStream(streamData)
+		if err != nil {
+			return 0, 0, err
+		}
+		indexPulses := stream.index
+		if len(indexPulses) < 2 {
+			return 0, 0, fmt.Errorf("not enough index pulses: %w", adapter.ErrNoIndex)
+		}
+		for i := 1; i < len(indexPulses) && len(periods) < revolutions; i++ {
+			// Index counter is measured with index clock, and wraps around at 32 bits
+			ticks := indexPulses[i].indexCounter - indexPulses[i-1].indexCounter
+			periods = append(periods, float64(ticks)/c.indexClock()*1e9)
+		}
+	}
+	return adapter.RPMStats(periods)
 }
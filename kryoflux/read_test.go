@@ -0,0 +1,224 @@
+package kryoflux
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Append an OOB Index block to the stream.
+func appendIndexBlock(stream []byte, streamPosition, indexCounter uint32) []byte {
+	block := make([]byte, 16)
+	block[0] = 0x0d
+	block[1] = 0x02
+	binary.LittleEndian.PutUint16(block[2:4], 12)
+	binary.LittleEndian.PutUint32(block[4:8], streamPosition)
+	binary.LittleEndian.PutUint32(block[12:16], indexCounter)
+	return append(stream, block...)
+}
+
+// Build a KryoFlux stream for one HD track, enclosed between two index pulses.
+func makeTestStreamHD(tb testing.TB) []byte {
+	sectors := make([][]byte, 18)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		for j := range sectors[i] {
+			sectors[i][j] = byte(i + j)
+		}
+	}
+	writer := mfm.NewWriter(200000)
+	track := writer.EncodeTrackIBMPC(sectors, 0, 0, 18, 500)
+	transitions, err := mfm.GenerateFluxTransitions(track, 500)
+	if err != nil {
+		tb.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+
+	var stream []byte
+	stream = appendIndexBlock(stream, 0, 0)
+	lastTicks := uint64(0)
+	for _, t := range transitions {
+		ticks := uint64(float64(t) * DefaultSampleClock / 1e9)
+		delta := ticks - lastTicks
+		lastTicks = ticks
+		switch {
+		case delta >= 0x0e && delta <= 0xff:
+			stream = append(stream, byte(delta))
+		case delta <= 0x7ff:
+			stream = append(stream, byte(delta>>8), byte(delta))
+		default:
+			stream = append(stream, 0x0c, byte(delta>>8), byte(delta))
+		}
+	}
+	duration := float64(lastTicks) * DefaultIndexClock / DefaultSampleClock
+	stream = appendIndexBlock(stream, uint32(len(stream)-16), uint32(duration))
+	stream = appendStreamEnd(stream, uint32(len(stream)-32), StreamResultOK)
+	stream = append(stream, 0x0d, 0x0d, 0x0d, 0x0d)
+	return stream
+}
+
+func TestDecodeFluxToMFM(t *testing.T) {
+	c := &Client{}
+	stream := makeTestStreamHD(t)
+
+	decoded, _, err := c.decodeKryoFluxStream(stream)
+	if err != nil {
+		t.Fatalf("decodeKryoFluxStream failed: %v", err)
+	}
+	if rpm, rate := decoded.NominalRPM(), decoded.EstimateBitRateKbps(); rpm != 300 || rate != 500 {
+		t.Errorf("estimated %d RPM, %d kbps, expected 300 RPM, 500 kbps", rpm, rate)
+	}
+
+	bitcells, err := decoded.DecodeMFM(500, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(bitcells).CountSectorsIBMPC(); n != 18 {
+		t.Errorf("decoded %d sectors, expected 18", n)
+	}
+}
+
+func TestReadTrack(t *testing.T) {
+	defer func(cyls, heads int) { config.Cyls, config.Heads = cyls, heads }(config.Cyls, config.Heads)
+	config.Cyls, config.Heads = 80, 2
+
+	stream := makeTestStreamHD(t)
+	d := &fakeDevice{}
+	for i := 0; i < 2; i++ {
+		for offset := 0; offset < len(stream); offset += ReadBufferSize {
+			d.chunks = append(d.chunks, stream[offset:min(offset+ReadBufferSize, len(stream))])
+		}
+	}
+	c := newFakeClient(d)
+	for i := 0; i < 2; i++ {
+		capture, err := c.ReadTrack(5, 1)
+		if err != nil {
+			t.Fatalf("ReadTrack() error: %v", err)
+		}
+		if capture.Cyl != 5 || capture.Head != 1 || capture.BitRate != 500 || capture.RPM != 300 {
+			t.Errorf("capture of cylinder %d, head %d at %d kbps, %d RPM",
+				capture.Cyl, capture.Head, capture.BitRate, capture.RPM)
+		}
+		if n := mfm.NewReader(capture.MFM).CountSectorsIBMPC(); n != 18 {
+			t.Errorf("decoded %d sectors, expected 18", n)
+		}
+		if capture.Flux == nil || len(capture.Flux.IndexPulses) != 2 {
+			t.Errorf("flux of the capture is missing")
+		}
+	}
+	if len(d.chunks) != 0 {
+		t.Errorf("%d chunks of stream not read", len(d.chunks))
+	}
+
+	// Firmware is limited to the track, and seeks only there
+	for _, r := range d.requests {
+		switch r.request {
+		case RequestMinTrack, RequestMaxTrack, RequestTrack:
+			if r.index != 5 {
+				t.Errorf("request %v, expected cylinder 5", r)
+			}
+		case RequestSide:
+			if r.index != 1 {
+				t.Errorf("request %v, expected side 1", r)
+			}
+		}
+	}
+	if n := countRequests(d, controlRequest{RequestTrack, 5}); n != 2 {
+		t.Errorf("%d seeks to cylinder 5, expected 2", n)
+	}
+
+	// No such track
+	if _, err := c.ReadTrack(80, 0); err == nil {
+		t.Errorf("ReadTrack() accepted cylinder 80")
+	}
+	if _, err := c.ReadTrack(0, 2); err == nil {
+		t.Errorf("ReadTrack() accepted head 2")
+	}
+}
+
+func BenchmarkDecodeFluxToMFM(b *testing.B) {
+	c := &Client{}
+	stream := makeTestStreamHD(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decoded, _, err := c.decodeKryoFluxStream(stream)
+		if err != nil {
+			b.Fatalf("decodeKryoFluxStream failed: %v", err)
+		}
+		_, err = decoded.DecodeMFM(500, pll.Config{})
+		if err != nil {
+			b.Fatalf("DecodeMFM failed: %v", err)
+		}
+	}
+}
+
+func TestDecodeIndexless(t *testing.T) {
+	defer func() { adapter.ReadOpts.Indexless = false }()
+
+	// 1.25 revolutions of HD track without index blocks,
+	// ended by the device with "no index" result
+	sectors := make([][]byte, 18)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		for j := range sectors[i] {
+			sectors[i][j] = byte(i * j)
+		}
+	}
+	track := mfm.NewWriter(200000).EncodeTrackIBMPC(sectors, 0, 0, 18, 500)
+	transitions, err := mfm.GenerateFluxTransitions(track, 500)
+	if err != nil {
+		t.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+	const period = 200000000
+	var stream []byte
+	lastTicks := uint64(0)
+	for rev := uint64(0); rev < 2; rev++ {
+		for _, tr := range transitions {
+			pos := rev*period + tr
+			if pos > period*5/4 {
+				break
+			}
+			ticks := uint64(float64(pos) * DefaultSampleClock / 1e9)
+			delta := ticks - lastTicks
+			lastTicks = ticks
+			if delta >= 0x0e && delta <= 0xff {
+				stream = append(stream, byte(delta))
+			} else {
+				stream = append(stream, byte(delta>>8), byte(delta))
+			}
+		}
+	}
+	stream = appendStreamEnd(stream, uint32(len(stream)), StreamResultNoIndex)
+	stream = append(stream, 0x0d, 0x0d, 0x0d, 0x0d)
+	c := &Client{}
+
+	// Fails without index-less mode
+	if _, _, err := c.decodeKryoFluxStream(stream); !errors.Is(err, adapter.ErrNoIndex) {
+		t.Fatalf("decodeKryoFluxStream() error = %v, expected ErrNoIndex", err)
+	}
+
+	adapter.ReadOpts.Indexless = true
+	decoded, stats, err := c.decodeKryoFluxStream(stream)
+	if err != nil {
+		t.Fatalf("decodeKryoFluxStream failed: %v", err)
+	}
+	if !stats.NoIndex {
+		t.Errorf("missing index was not reported")
+	}
+	if rpm := decoded.RPM(); rpm < 299.9 || rpm > 300.1 {
+		t.Errorf("estimated %.2f RPM, expected 300", rpm)
+	}
+	bitcells, err := decoded.DecodeMFM(500, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(bitcells).CountSectorsIBMPC(); n != 18 {
+		t.Errorf("decoded %d sectors, expected 18", n)
+	}
+}
@@ -0,0 +1,285 @@
+package kryoflux
+
+import (
+	"encoding/binary"
+
+	"github.com/sergev/floppy/adapter"
+)
+
+// Maximum fraction of the stream which may be lost in USB transfer.
+// A track with more bytes lost is treated as failed.
+var MaxStreamLoss = 0.01
+
+// Number of revolutions captured per track. The stream is stopped
+// when one more index pulse is seen.
+var StreamRevolutions = 2
+
+// Maximum size of stream data captured for one track, in bytes.
+// Protects against endless stream from a drive with bad index sensor.
+var MaxStreamSize = 4 * 1024 * 1024
+
+// Desync describes a place where stream position reported by the device
+// in StreamInfo or StreamEnd block did not match the number of bytes received
+type Desync struct {
+	Offset   int    // Offset of OOB block in received data
+	Expected uint32 // Stream position counted by host
+	Actual   uint32 // Stream position reported by device
+}
+
+// StreamStats contains results of stream validation for one track
+type StreamStats struct {
+	Length    uint32   // Stream length in bytes, without OOB blocks
+	LostBytes uint32   // Bytes lost or damaged in transfer
+	Desyncs   []Desync // Regions where bytes were lost
+	NoIndex   bool     // Device reported no index signal, in index-less mode
+}
+
+// LostFraction returns part of the stream lost in transfer
+func (s *StreamStats) LostFraction() float64 {
+	if s.Length == 0 {
+		return 0
+	}
+	return float64(s.LostBytes) / float64(s.Length)
+}
+
+// Stream data split into flux data and OOB blocks
+type kfStream struct {
+	flux     []byte        // Flux data without OOB blocks, indexed by stream position
+	index    []IndexTiming // Index blocks
+	stats    StreamStats
+	verified uint32 // Last stream position confirmed by the device
+}
+
+// Size of flux data block with the given first byte
+func fluxBlockSize(val byte) int {
+	switch {
+	case val <= 0x07:
+		return 2 // Flux2
+	case val == 0x09:
+		return 2 // Nop2
+	case val == 0x0a, val == 0x0c:
+		return 3 // Nop3, Flux3
+	default:
+		return 1 // Nop1, Ovl16, Flux1
+	}
+}
+
+// Scanner of stream data as it arrives from the device:
+// counts index blocks and finds end of stream.
+type streamScanner struct {
+	offset  int  // Start of the first block not scanned yet
+	indexes int  // Number of index blocks seen
+	eof     bool // End of stream marker seen
+}
+
+// Scan complete blocks of data received since the last call.
+// Incomplete block at the end is scanned when the rest of it arrives.
+func (s *streamScanner) scan(data []byte) {
+	for s.offset < len(data) && !s.eof {
+		val := data[s.offset]
+		if val != 0x0d {
+			s.offset += fluxBlockSize(val)
+			continue
+		}
+
+		// OOB marker: 4-byte header + data
+		if s.offset+4 > len(data) {
+			return
+		}
+		oobType := data[s.offset+1]
+		if oobType == 0x0d {
+			// End of stream marker
+			s.eof = true
+			return
+		}
+		oobSize := int(binary.LittleEndian.Uint16(data[s.offset+2 : s.offset+4]))
+		if s.offset+4+oobSize > len(data) {
+			return
+		}
+		if oobType == 0x02 {
+			s.indexes++
+		}
+		s.offset += 4 + oobSize
+	}
+}
+
+// Parse stream data: separate flux data from OOB blocks, and check
+// stream positions reported by the device. When bytes were lost
+// in transfer, the gap is filled with Nop1 blocks, so that flux data
+// stays aligned with stream positions, and parsing continues.
+// Returns error when the stream was terminated by the device
+// with a non-zero result code. In index-less mode, missing index
+// signal is not an error.
+func parseStream(data []byte) (*kfStream, error) {
+	s := &kfStream{
+		flux: make([]byte, 0, len(data)),
+	}
+	offset := 0
+	for offset < len(data) {
+		val := data[offset]
+		if val != 0x0d {
+			end := min(offset+fluxBlockSize(val), len(data))
+			s.flux = append(s.flux, data[offset:end]...)
+			offset = end
+			continue
+		}
+
+		// OOB marker: 4-byte header + data
+		if offset+4 > len(data) {
+			// Lost OOB header
+			break
+		}
+		oobType := data[offset+1]
+		if oobType == 0x0d {
+			// End of stream marker
+			break
+		}
+		oobSize := int(binary.LittleEndian.Uint16(data[offset+2 : offset+4]))
+		if !s.validBlock(data, offset) {
+			// Bytes lost in the middle of a flux block made us
+			// take flux data for OOB header: find the next good block
+			next := s.resync(data, offset+1)
+			adapter.Tracef(traceName, "bad OOB block at offset %d, resync at %d", offset, next)
+			if next < 0 {
+				break
+			}
+			offset = next
+			continue
+		}
+		block := data[offset+4 : offset+4+oobSize]
+
+		switch oobType {
+		case 0x01:
+			// StreamInfo block: Stream Position (4 bytes), Transfer Time (4 bytes)
+			streamPosition := binary.LittleEndian.Uint32(block[0:4])
+			transferTime := binary.LittleEndian.Uint32(block[4:8])
+			adapter.Tracef(traceName, "StreamInfo: streamPosition=%d, transferTime=%d", streamPosition, transferTime)
+			s.checkPosition(offset, streamPosition)
+
+		case 0x02:
+			//
+			// Index block: Stream Position (4 bytes), Sample Counter (4 bytes),
+			//              Index Counter (4 bytes)
+			// Example:
+			//      Index: streamPosition=21154, sampleCounter=66, indexCounter=109798707
+			//      Index: streamPosition=96737, sampleCounter=66, indexCounter=110398148
+			//
+			streamPosition := binary.LittleEndian.Uint32(block[0:4])
+			sampleCounter := binary.LittleEndian.Uint32(block[4:8])
+			indexCounter := binary.LittleEndian.Uint32(block[8:12])
+			adapter.Tracef(traceName, "Index: streamPosition=%d, sampleCounter=%d, indexCounter=%d", streamPosition, sampleCounter, indexCounter)
+			s.index = append(s.index, IndexTiming{
+				streamPosition: streamPosition,
+				sampleCounter:  sampleCounter,
+				indexCounter:   indexCounter,
+			})
+
+		case 0x03:
+			// StreamEnd block: Stream Position (4 bytes), Result Code (4 bytes)
+			streamPosition := binary.LittleEndian.Uint32(block[0:4])
+			resultCode := binary.LittleEndian.Uint32(block[4:8])
+			adapter.Tracef(traceName, "StreamEnd: streamPosition=%d, resultCode=%d", streamPosition, resultCode)
+			if resultCode == StreamResultNoIndex && adapter.ReadOpts.Indexless {
+				// Expected for drive without index sensor
+				s.stats.NoIndex = true
+			} else if err := streamResultError(resultCode); err != nil {
+				return s, err
+			}
+			s.checkPosition(offset, streamPosition)
+			s.stats.Length = streamPosition
+
+		case 0x04:
+			// KFInfo block: text with device information
+			adapter.Tracef(traceName, "KFInfo: infoData='%s'", string(block))
+		}
+		offset += 4 + oobSize
+	}
+
+	// Index pulses past the end of flux data come from corrupt
+	// or truncated stream: there is no flux to time them by
+	for i, pulse := range s.index {
+		if pulse.streamPosition > uint32(len(s.flux)) {
+			adapter.Tracef(traceName, "index at stream position %d beyond %d bytes of flux", pulse.streamPosition, len(s.flux))
+			s.index = s.index[:i]
+			break
+		}
+	}
+
+	if s.stats.Length < uint32(len(s.flux)) {
+		// No StreamEnd block
+		s.stats.Length = uint32(len(s.flux))
+	}
+	return s, nil
+}
+
+// Check OOB block at the given offset: known type, size fits
+// into the data, and stream position is plausible.
+func (s *kfStream) validBlock(data []byte, offset int) bool {
+	oobType := data[offset+1]
+	oobSize := int(binary.LittleEndian.Uint16(data[offset+2 : offset+4]))
+	if offset+4+oobSize > len(data) {
+		return false
+	}
+	switch oobType {
+	case 0x01, 0x03:
+		if oobSize != 8 {
+			return false
+		}
+		streamPosition := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
+		return s.plausible(streamPosition, len(data))
+	case 0x02:
+		return oobSize == 12
+	case 0x04:
+		return true
+	}
+	return false
+}
+
+// Stream position is plausible when it does not go back before
+// the last verified position, and the gap is not larger than all data.
+func (s *kfStream) plausible(streamPosition uint32, dataLen int) bool {
+	return streamPosition >= s.verified && streamPosition-s.verified <= uint32(dataLen)
+}
+
+// Scan forward for the next StreamInfo or StreamEnd block
+// with plausible stream position. Returns its offset, or -1.
+func (s *kfStream) resync(data []byte, offset int) int {
+	for ; offset+12 <= len(data); offset++ {
+		if data[offset] != 0x0d || (data[offset+1] != 0x01 && data[offset+1] != 0x03) {
+			continue
+		}
+		if s.validBlock(data, offset) {
+			return offset
+		}
+	}
+	return -1
+}
+
+// Compare stream position reported by the device with the number of bytes received.
+// On mismatch, record the desync and realign flux data to the reported position.
+func (s *kfStream) checkPosition(offset int, streamPosition uint32) {
+	counted := uint32(len(s.flux))
+	s.verified = streamPosition
+	if streamPosition == counted {
+		return
+	}
+	adapter.Tracef(traceName, "bad stream position %d != %d at offset %d", counted, streamPosition, offset)
+	s.stats.Desyncs = append(s.stats.Desyncs, Desync{
+		Offset:   offset,
+		Expected: counted,
+		Actual:   streamPosition,
+	})
+	if streamPosition > counted {
+		// Bytes lost: fill the gap with Nop1 blocks.
+		// Timing of flux transitions after the gap is shifted
+		// by duration of the lost region.
+		s.stats.LostBytes += streamPosition - counted
+		for len(s.flux) < int(streamPosition) {
+			s.flux = append(s.flux, 0x08)
+		}
+	} else {
+		// Garbage received: drop it
+		s.stats.LostBytes += counted - streamPosition
+		s.flux = s.flux[:streamPosition]
+	}
+}
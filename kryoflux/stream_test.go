@@ -0,0 +1,140 @@
+package kryoflux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Append an OOB StreamInfo block to the stream.
+func appendStreamInfo(stream []byte, streamPosition uint32) []byte {
+	block := make([]byte, 12)
+	block[0] = 0x0d
+	block[1] = 0x01
+	binary.LittleEndian.PutUint16(block[2:4], 8)
+	binary.LittleEndian.PutUint32(block[4:8], streamPosition)
+	return append(stream, block...)
+}
+
+// Rebuild the test stream with StreamInfo blocks after every 1000 bytes
+// of flux data, and with flux blocks in range [gapStart, gapEnd) lost.
+func makeStreamWithGap(tb testing.TB, gapStart, gapEnd uint32) []byte {
+	orig := makeTestStreamHD(tb)
+	fluxLen := binary.LittleEndian.Uint32(orig[len(orig)-32+4:])
+	fluxData := orig[16 : 16+fluxLen]
+
+	var stream []byte
+	stream = append(stream, orig[:16]...)
+	lastInfo := uint32(0)
+	for pos := uint32(0); pos < fluxLen; {
+		size := uint32(fluxBlockSize(fluxData[pos]))
+		if pos < gapStart || pos >= gapEnd {
+			stream = append(stream, fluxData[pos:pos+size]...)
+		}
+		pos += size
+		if pos-lastInfo >= 1000 {
+			stream = appendStreamInfo(stream, pos)
+			lastInfo = pos
+		}
+	}
+	return append(stream, orig[16+fluxLen:]...)
+}
+
+func TestParseStream(t *testing.T) {
+	s, err := parseStream(makeStreamWithGap(t, 0, 0))
+	if err != nil {
+		t.Fatalf("parseStream() error: %v", err)
+	}
+	if len(s.stats.Desyncs) != 0 || s.stats.LostBytes != 0 {
+		t.Errorf("parseStream() stats = %+v, expected no desyncs", s.stats)
+	}
+	if len(s.index) != 2 || s.stats.Length != uint32(len(s.flux)) {
+		t.Errorf("parseStream() found %d indices, length %d of %d", len(s.index), s.stats.Length, len(s.flux))
+	}
+}
+
+func TestStreamRecovery(t *testing.T) {
+	c := &Client{}
+
+	// A few bytes lost in the middle of the track
+	stream := makeStreamWithGap(t, 20500, 20506)
+	decoded, stats, err := c.decodeKryoFluxStream(stream)
+	if err != nil {
+		t.Fatalf("decodeKryoFluxStream() error: %v", err)
+	}
+	if len(stats.Desyncs) != 1 || stats.LostBytes < 6 || stats.LostBytes > 8 {
+		t.Errorf("stats = %+v, expected one region of 6 bytes", *stats)
+	}
+	bitcells, err := decoded.DecodeMFM(500, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(bitcells).CountSectorsIBMPC(); n < 17 {
+		t.Errorf("decoded %d sectors, expected at least 17", n)
+	}
+
+	// Too much data lost
+	stream = makeStreamWithGap(t, 20000, 30000)
+	_, stats, err = c.decodeKryoFluxStream(stream)
+	if !errors.Is(err, adapter.ErrOverflow) || !adapter.IsRetryable(err) {
+		t.Errorf("decodeKryoFluxStream() error = %v, expected ErrOverflow", err)
+	}
+	if stats == nil || stats.LostBytes < 10000 {
+		t.Errorf("stats = %+v, expected 10000 bytes lost", stats)
+	}
+}
+
+func TestStreamResync(t *testing.T) {
+	// Corrupted OOB header: parser skips to the next good StreamInfo block
+	stream := makeStreamWithGap(t, 0, 0)
+	info := 16
+	for stream[info] != 0x0d || stream[info+1] != 0x01 {
+		info += fluxBlockSize(stream[info])
+	}
+	stream[info+1] = 0x07
+
+	s, err := parseStream(stream)
+	if err != nil {
+		t.Fatalf("parseStream() error: %v", err)
+	}
+	if len(s.stats.Desyncs) != 1 || len(s.index) != 2 {
+		t.Errorf("parseStream() stats = %+v, %d indices", s.stats, len(s.index))
+	}
+}
+
+// Append an OOB Index block to the stream.
+func appendIndex(stream []byte, streamPosition uint32) []byte {
+	block := make([]byte, 16)
+	block[0] = 0x0d
+	block[1] = 0x02
+	binary.LittleEndian.PutUint16(block[2:4], 12)
+	binary.LittleEndian.PutUint32(block[4:8], streamPosition)
+	return append(stream, block...)
+}
+
+func TestStreamIndexBeyondEnd(t *testing.T) {
+	// Truncated stream: second index refers to flux which never came
+	stream := appendIndex(bytes.Repeat([]byte{0x40}, 20), 0)
+	stream = appendIndex(stream, 5000)
+
+	s, err := parseStream(stream)
+	if err != nil {
+		t.Fatalf("parseStream() error: %v", err)
+	}
+	if len(s.index) != 1 {
+		t.Errorf("parseStream() kept %d indices, expected 1", len(s.index))
+	}
+
+	c := &Client{}
+	if _, _, err := c.decodeKryoFluxStream(stream); !errors.Is(err, adapter.ErrNoIndex) {
+		t.Errorf("decodeKryoFluxStream() error = %v, expected no index", err)
+	}
+	if _, err := c.decodeFlux(s.flux, 5000, uint32(len(s.flux))); err == nil {
+		t.Errorf("decodeFlux() from position past the end succeeded")
+	}
+}
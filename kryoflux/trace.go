@@ -0,0 +1,40 @@
+package kryoflux
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+)
+
+// Adapter name in trace events
+const traceName = "kryoflux"
+
+// Names of control requests in trace events
+var requestNames = map[byte]string{
+	RequestReset:    "RESET",
+	RequestDevice:   "DEVICE",
+	RequestMotor:    "MOTOR",
+	RequestDensity:  "DENSITY",
+	RequestSide:     "SIDE",
+	RequestTrack:    "TRACK",
+	RequestStream:   "STREAM",
+	RequestMinTrack: "MIN_TRACK",
+	RequestMaxTrack: "MAX_TRACK",
+	RequestStatus:   "STATUS",
+	RequestInfo:     "INFO",
+}
+
+// Name of control request with its index, like "TRACK 40"
+func requestName(request byte, index uint16) string {
+	name, ok := requestNames[request]
+	if !ok {
+		name = fmt.Sprintf("REQUEST_0x%02x", request)
+	}
+	return fmt.Sprintf("%s %d", name, index)
+}
+
+// Report bytes transferred since start
+func trace(dir adapter.TraceDirection, command string, data []byte, start time.Time, err error) {
+	adapter.Trace(traceName, dir, command, data, start, err)
+}
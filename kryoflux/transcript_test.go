@@ -0,0 +1,70 @@
+package kryoflux
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/hfe"
+)
+
+// Transport which serves as control and bulk endpoints
+type usbTransport interface {
+	controlTransferer
+	bulkReader
+	bulkWriter
+}
+
+// Read side 0 of the first cylinder through the given transport
+func readFirstTrack(t *testing.T, d usbTransport) []byte {
+	t.Helper()
+	defer func(heads int) { config.Heads = heads }(config.Heads)
+	config.Heads = 2
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts = adapter.ReadOptions{Sides: "0"}
+
+	c := &Client{ctrl: d, bulkIn: d, bulkOut: d}
+	c.keepMotor()
+	disk, err := c.Read(1, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if err := c.StopMotor(); err != nil {
+		t.Fatalf("StopMotor() error: %v", err)
+	}
+	return disk.Tracks[0].Side0
+}
+
+func TestTranscriptRead(t *testing.T) {
+	filename := filepath.Join("testdata", "read-track.fdxt")
+	records, err := adapter.LoadTranscript(filename)
+	if err != nil {
+		t.Fatalf("LoadTranscript() error: %v", err)
+	}
+	replay := adapter.NewReplay(records)
+	track := readFirstTrack(t, replay)
+	if err := replay.Done(); err != nil {
+		t.Errorf("replay: %v", err)
+	}
+	checkTestSectors(t, track)
+}
+
+// Check that all sectors of the test track are decoded with their contents
+func checkTestSectors(t *testing.T, track []byte) {
+	t.Helper()
+	decoded := hfe.DecodeTrack(track, 0, 0)
+	for i := 0; i < 18; i++ {
+		sector := decoded.Sector(i + 1)
+		if sector == nil {
+			t.Errorf("sector %d not decoded", i+1)
+			continue
+		}
+		for j, b := range sector.Data {
+			if b != byte(i+j) {
+				t.Errorf("sector %d: byte %d is %#02x, expected %#02x", i+1, j, b, byte(i+j))
+				break
+			}
+		}
+	}
+}
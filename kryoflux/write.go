@@ -3,10 +3,17 @@ package kryoflux
 import (
 	"fmt"
 
+	"github.com/sergev/floppy/adapter"
 	"github.com/sergev/floppy/hfe"
 )
 
-// Write writes data from the disk object to the floppy disk
-func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
-	return fmt.Errorf("Write is not supported for KryoFlux adapter")
+// Write is not supported: KryoFlux cannot write disks yet
+func (c *Client) Write(disk *hfe.Disk, numberOfCylinders int) error {
+	return fmt.Errorf("write %w", adapter.ErrNotSupported)
+}
+
+// WriteTrackFlux is not supported: KryoFlux cannot write disks yet.
+// Capabilities reports it with CanWriteFlux false.
+func (c *Client) WriteTrackFlux(cyl, head int, transitions []uint64, cueToIndex bool) error {
+	return fmt.Errorf("write %w", adapter.ErrNotSupported)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	_ "github.com/sergev/floppy/greaseweazle"
 	_ "github.com/sergev/floppy/kryoflux"
+	_ "github.com/sergev/floppy/sim"
 	_ "github.com/sergev/floppy/supercardpro"
 	"github.com/sergev/floppy/adapter"
 )
@@ -2,19 +2,14 @@ package mfm
 
 import (
 	"fmt"
-)
-
-// PLL and MFM constants
-// SCP PLL algorithm constants (from legacy/mfmdisk/scp.c)
-const (
-	CLOCK_MAX_ADJ  = 10 // +/- 10% adjustment range (90%-110% of CLOCK_CENTRE)
-	PERIOD_ADJ_PCT = 5  // Period adjustment percentage
-	PHASE_ADJ_PCT  = 60 // Phase adjustment percentage
+	"math"
 
-	// Enable for debug
-	DebugFlag = false
+	"github.com/sergev/floppy/pll"
 )
 
+// Enable for debug
+const DebugFlag = false
+
 // Decoder decodes flux transitions into bits using an SCP-style Phase-Locked Loop.
 // Based on pll_t from legacy/mfmdisk/scp.c
 // It combines PLL state with flux iteration functionality.
@@ -26,6 +21,12 @@ type Decoder struct {
 	Time         float64 // Total time elapsed in nanoseconds
 	ClockedZeros int     // Count of consecutive clocked zeros
 
+	// Gains of the PLL, see pll.Config (from legacy/mfmdisk/scp.c)
+	config pll.Config
+
+	// Lock statistics: phase error of every transition, relative to period
+	phaseErrSq float64 // Sum of squared phase errors
+	phaseCount int     // Number of transitions
 	// Flux iterator fields
 	transitions []uint64 // Absolute transition times in nanoseconds
 	index       int      // Current index into transitions
@@ -35,13 +36,26 @@ type Decoder struct {
 // NewDecoder creates a new PLL decoder with the given transitions and bit rate.
 // It initializes both the PLL state and flux iterator.
 func NewDecoder(transitions []uint64, bitRateKhz uint16) *Decoder {
+	return NewDecoderPeriod(transitions, 1e6/float64(bitRateKhz)/2)
+}
+
+// NewDecoderPeriod creates a new PLL decoder with the given bitcell period
+// in nanoseconds, for bit rates which are not a whole number of kbps.
+func NewDecoderPeriod(transitions []uint64, periodNs float64) *Decoder {
+	return NewDecoderConfig(transitions, periodNs, pll.Config{})
+}
+
+// NewDecoderConfig creates a new PLL decoder with the given bitcell period
+// in nanoseconds, and gains of the PLL from the config.
+func NewDecoderConfig(transitions []uint64, periodNs float64, config pll.Config) *Decoder {
 	return &Decoder{
 		// Initialize PLL state
-		PeriodIdeal:  1e6 / float64(bitRateKhz) / 2,
-		Period:       1e6 / float64(bitRateKhz) / 2,
+		PeriodIdeal:  periodNs,
+		Period:       periodNs,
 		Flux:         0,
 		Time:         0,
 		ClockedZeros: 0,
+		config:       config.WithDefaults(),
 
 		// Initialize flux iterator
 		transitions: transitions,
@@ -50,6 +64,30 @@ func NewDecoder(transitions []uint64, bitRateKhz uint16) *Decoder {
 	}
 }
 
+// Reset puts the PLL back to its ideal period, like at the start of a track.
+// It is done after a dropout, when enabled by pll.Config. Position in the flux stream
+// and time of the current bitcell are kept, so that bitcells stay in place.
+// Lock statistics cover the whole stream, and are not cleared.
+func (pll *Decoder) Reset() {
+	pll.Period = pll.PeriodIdeal
+}
+
+// PeriodNs returns the bitcell period the PLL is locked to, in nanoseconds
+func (pll *Decoder) PeriodNs() float64 {
+	return pll.Period
+}
+
+// LockQuality returns RMS phase error of transitions decoded so far,
+// as a fraction of the bitcell period: near 0 for a clean lock,
+// and about 0.29 for transitions at random phase. Returns 0 before
+// the first transition.
+func (pll *Decoder) LockQuality() float64 {
+	if pll.phaseCount == 0 {
+		return 0
+	}
+	return math.Sqrt(pll.phaseErrSq / float64(pll.phaseCount))
+}
+
 // NextFlux returns the next flux interval in nanoseconds (time until next transition).
 // Returns 0 if no more transitions are available.
 func (pll *Decoder) NextFlux() uint64 {
@@ -104,23 +142,31 @@ func (pll *Decoder) NextBit() bool {
 	// Check if we have a clocked zero (flux >= period/2 after subtraction)
 	if pll.Flux >= pll.Period/2 {
 		pll.ClockedZeros++
+		if pll.ClockedZeros == pll.config.DropoutCells {
+			pll.Reset()
+		}
 		if DebugFlag {
 			fmt.Printf("---     return 0, clockedZeros = %d\n", pll.ClockedZeros)
 		}
 		return false // 0
 	}
 
-	// Transition detected - adjust PLL parameters
+	// Transition detected - count its phase error
+	phaseErr := pll.Flux / pll.Period
+	pll.phaseErrSq += phaseErr * phaseErr
+	pll.phaseCount++
+
+	// Adjust PLL parameters
 	// PLL: Adjust clock period according to phase mismatch
 	if pll.ClockedZeros <= 3 {
 		// In sync: adjust base clock by a fraction of phase mismatch
-		pll.Period += pll.Flux * PERIOD_ADJ_PCT / 100
+		pll.Period += pll.Flux * float64(pll.config.PeriodAdjust) / 100
 		if DebugFlag {
 			fmt.Printf("---     in sync: adjust period = %.0f\n", pll.Period)
 		}
 	} else {
 		// Out of sync: adjust base clock towards centre
-		pll.Period += (pll.PeriodIdeal - pll.Period) * PERIOD_ADJ_PCT / 100
+		pll.Period += (pll.PeriodIdeal - pll.Period) * float64(pll.config.PeriodAdjust) / 100
 		if DebugFlag {
 			fmt.Printf("---     out of sync: normalize period = %.0f\n", pll.Period)
 		}
@@ -128,7 +174,7 @@ func (pll *Decoder) NextBit() bool {
 
 	// Clamp the period adjustment range
 	// the minimum allowed clock period
-	pMin := (pll.PeriodIdeal * (100 - CLOCK_MAX_ADJ)) / 100
+	pMin := (pll.PeriodIdeal * float64(100-pll.config.MaxAdjust)) / 100
 	if pll.Period < pMin {
 		pll.Period = pMin
 		if DebugFlag {
@@ -137,7 +183,7 @@ func (pll *Decoder) NextBit() bool {
 	}
 
 	// the maximum allowed clock period
-	pMax := (pll.PeriodIdeal * (100 + CLOCK_MAX_ADJ)) / 100
+	pMax := (pll.PeriodIdeal * float64(100+pll.config.MaxAdjust)) / 100
 	if pll.Period > pMax {
 		pll.Period = pMax
 		if DebugFlag {
@@ -146,8 +192,8 @@ func (pll *Decoder) NextBit() bool {
 	}
 
 	// PLL: Adjust clock phase according to mismatch
-	// PHASE_ADJ_PCT=100% -> timing window snaps to observed flux
-	newFlux := pll.Flux * (100 - PHASE_ADJ_PCT) / 100
+	// PhaseAdjust=100% -> timing window snaps to observed flux
+	newFlux := pll.Flux * float64(100-pll.config.PhaseAdjust) / 100
 	pll.Time += pll.Flux - newFlux
 	pll.Flux = newFlux
 	if DebugFlag {
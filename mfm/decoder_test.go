@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math/rand"
 	"testing"
+
+	"github.com/sergev/floppy/pll"
 )
 
 // Helper function: decodeAllBits decodes a fixed number of bits from the decoder.
@@ -381,3 +383,101 @@ func TestDecoder_EndOfStream(t *testing.T) {
 		})
 	}
 }
+
+// Flux of a standard 9-sector track at 250 kbps, sped up by the given
+// fraction, with Gaussian noise of jitterNs added to every transition
+func jitteredTrack(t *testing.T, speedError, jitterNs float64) []uint64 {
+	t.Helper()
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		for j := range sectors[i] {
+			sectors[i][j] = byte(i + j)
+		}
+	}
+	bits := NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+	transitions, err := GenerateFluxTransitions(bits, 250)
+	if err != nil {
+		t.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i, tr := range transitions {
+		transitions[i] = uint64(float64(tr)/(1+speedError) + rng.NormFloat64()*jitterNs)
+	}
+	return transitions
+}
+
+// Decode all transitions into MFM bitcells. When the PLL sees
+// no transitions for pll.DropoutCells bitcells, onDropout is called.
+func decodeTrack(decoder *Decoder, onDropout func()) []byte {
+	var cells []bool
+	for !decoder.IsDone() {
+		cells = append(cells, decoder.NextBit())
+		if decoder.ClockedZeros == pll.DropoutCells && onDropout != nil {
+			onDropout()
+		}
+	}
+	return bitsToBytes(cells)
+}
+
+func TestDecoder_LockQuality(t *testing.T) {
+	last := -1.0
+	for _, jitterNs := range []float64{0, 50, 150, 300} {
+		decoder := NewDecoder(jitteredTrack(t, 0, jitterNs), 250)
+		if q := decoder.LockQuality(); q != 0 {
+			t.Errorf("jitter %v: lock quality %v before decoding", jitterNs, q)
+		}
+		decodeTrack(decoder, nil)
+		q := decoder.LockQuality()
+		if q <= last {
+			t.Errorf("jitter %v: lock quality %.3f, expected above %.3f", jitterNs, q, last)
+		}
+		if jitterNs == 0 && q > 0.01 {
+			t.Errorf("no jitter: lock quality %.3f, expected near zero", q)
+		}
+		last = q
+	}
+}
+
+func TestDecoder_ResetAfterDropout(t *testing.T) {
+	// Drive is 3% fast; no flux for 1 msec in the middle of the track
+	transitions := jitteredTrack(t, 0.03, 50)
+	start := uint64(80_000_000)
+	kept := transitions[:0]
+	for _, tr := range transitions {
+		if tr < start || tr >= start+1_000_000 {
+			kept = append(kept, tr)
+		}
+	}
+
+	decoder := NewDecoderConfig(kept, 2000, pll.Config{DropoutCells: pll.DropoutCells})
+	resets := 0
+	bits := decodeTrack(decoder, func() {
+		resets++
+		if decoder.PeriodNs() != decoder.PeriodIdeal {
+			t.Errorf("period %.1f ns after reset, expected %.1f", decoder.PeriodNs(), decoder.PeriodIdeal)
+		}
+	})
+	if resets != 1 {
+		t.Errorf("%d resets, expected one at the dropout", resets)
+	}
+
+	// PLL locks again to the fast drive, and all sectors but the lost one are good
+	if p := decoder.PeriodNs(); p < 1900 || p > 1970 {
+		t.Errorf("period %.1f ns at the end, expected about %.1f", p, 2000/1.03)
+	}
+	reader := NewReader(bits)
+	good := 0
+	for {
+		sector, err := reader.ReadSectorInfoIBMPC(0, 0)
+		if err != nil {
+			break
+		}
+		if !sector.Bad {
+			good++
+		}
+	}
+	if good != 8 {
+		t.Errorf("%d good sectors, expected 8", good)
+	}
+}
@@ -1,6 +1,7 @@
 package mfm
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -47,3 +48,49 @@ func TestMfmToFluxTransitions(t *testing.T) {
 		t.Errorf("Expected transitions array: %v", expectedTransitions)
 	}
 }
+
+// Verify write precompensation on a known bitcell pattern, at 500 kbps
+func TestFluxIntervals_Precomp(t *testing.T) {
+	//  MFM: 1 0 1 0 0 1 0 0 0 1 0 1
+	mfmBits := []byte{0xa4, 0x50}
+	table := PrecompTable{{FirstCyl: 40, LastCyl: -1, ShiftNs: 125}}
+
+	// No precompensation on outer cylinders
+	intervals, err := FluxIntervals(mfmBits, CellPeriodNs(500), table, 39)
+	if err != nil {
+		t.Fatalf("FluxIntervals() error: %v", err)
+	}
+	expected := []uint64{1000, 2000, 3000, 4000, 2000}
+	if fmt.Sprint(intervals) != fmt.Sprint(expected) {
+		t.Errorf("cylinder 39: intervals %v, expected %v", intervals, expected)
+	}
+
+	// Transitions 2 and 5 (pattern 10100) are early, transitions 1 and 4 (pattern 00101) are late,
+	// transition 3 has no close neighbors and stays in place.
+	intervals, err = FluxIntervals(mfmBits, CellPeriodNs(500), table, 40)
+	if err != nil {
+		t.Fatalf("FluxIntervals() error: %v", err)
+	}
+	expected = []uint64{1125, 1750, 3125, 4125, 1750}
+	if fmt.Sprint(intervals) != fmt.Sprint(expected) {
+		t.Errorf("cylinder 40: intervals %v, expected %v", intervals, expected)
+	}
+
+	// Close transitions are written closer than nominal, so that
+	// peak shift on read back moves them apart to their nominal places
+	for _, i := range []int{1, 4} {
+		if intervals[i] >= 2000 {
+			t.Errorf("interval %d between close transitions is %d ns, expected less than 2000", i, intervals[i])
+		}
+	}
+
+	transitions := IntervalsToTransitions(intervals)
+	if transitions[2] != 6000 || transitions[4] != 11875 {
+		t.Errorf("transitions %v", transitions)
+	}
+
+	// Shift must be less than bitcell
+	if _, err := FluxIntervals(mfmBits, 100, table, 40); err == nil {
+		t.Errorf("expected error for excessive precompensation")
+	}
+}
@@ -0,0 +1,210 @@
+package mfm
+
+// TrackLayout describes placement of IBM PC sectors on a track relative
+// to the index pulse. It tells a track written by a controller, with its
+// write splices and the gaps it was formatted with, from a track generated
+// by an emulator or converted from a sector image.
+//
+// Positions and sizes are in bytes of MFM data, 16 bitcells each.
+// Gaps count filler bytes up to the 12 sync bytes of the next address mark,
+// like gap parameters of the format command.
+type TrackLayout struct {
+	Sectors int   `json:"sectors"`           // Number of sector IDs found
+	FirstID int   `json:"first_id"`          // From index to address mark of the first sector ID
+	Gap4a   int   `json:"gap4a"`             // Before the index address mark, -1 when it does not precede the first sector
+	Gap1    int   `json:"gap1"`              // Before the first sector ID: after index mark, or from index
+	Gap3    []int `json:"gap3"`              // After every sector but the last, in physical order
+	Gap4b   int   `json:"gap4b"`             // After the last sector up to the end of track data
+	Splices []int `json:"splices,omitempty"` // Write splices: where gap bytes break off, from index
+	Nominal bool  `json:"nominal"`           // Spacing of sectors matches the standard format
+}
+
+// Address mark with its field, found on the track
+type layoutField struct {
+	tag   int // Tag after the mark: 0xFC index, 0xFE ID, 0xFB/0xF8 data
+	start int // Bit position of the first sync byte
+	mark  int // Bit position of the address mark
+	end   int // Bit position past the field and its CRC
+	size  int // Size code of sector ID, -1 for other fields
+}
+
+// Minimal run of abnormal gap bytes, which is a write splice
+// rather than a flipped bit
+const spliceRun = 2
+
+// Deviation of gap2 and gap3 from the standard format,
+// in bytes, still counted as nominal
+const layoutTolerance = 4
+
+// AnalyzeLayoutIBMPC finds sectors and gaps on the track.
+// MFM bitcells must start at the index pulse, like decoded flux
+// of one revolution. Bit rate in kbps selects the standard gaps.
+// Returns nil when no sector ID is found.
+func AnalyzeLayoutIBMPC(bits []byte, bitRate uint16) *TrackLayout {
+	fields := scanLayoutFields(bits)
+
+	// Gap between every two fields, and after the last one.
+	// Index mark found past the first sector is a part of gap3.
+	layout := &TrackLayout{Gap4a: -1}
+	pos, sectorEnd := 0, 0
+	var gap2 []int
+	for i, f := range fields {
+		gap := (f.start - pos) / 16
+		if i == 0 {
+			// Flux before the first field is not aligned to anything
+			if s := findSplice(bits, f.start, gap, -1); s >= 0 {
+				layout.Splices = append(layout.Splices, s/16)
+			}
+		} else if s := findSplice(bits, pos, gap, +1); s >= 0 {
+			layout.Splices = append(layout.Splices, s/16)
+		}
+
+		switch f.tag {
+		case 0xfc:
+			if layout.Sectors == 0 {
+				layout.Gap4a = gap
+			}
+		case 0xfe:
+			if layout.Sectors == 0 {
+				layout.FirstID = f.mark / 16
+				layout.Gap1 = gap
+			} else {
+				layout.Gap3 = append(layout.Gap3, (f.start-sectorEnd)/16)
+			}
+			layout.Sectors++
+			sectorEnd = f.end
+		default:
+			gap2 = append(gap2, gap)
+			sectorEnd = f.end
+		}
+		pos = f.end
+	}
+	if layout.Sectors == 0 {
+		return nil
+	}
+	layout.Gap4b = (len(bits)*8 - pos) / 16
+	if s := findSplice(bits, pos, layout.Gap4b, +1); s >= 0 {
+		layout.Splices = append(layout.Splices, s/16)
+	}
+
+	// Every sector must have data after the standard gap2,
+	// and be followed by the standard gap3
+	headerGap, sectorGap := computeGapsIBMPC(bitRate, layout.Sectors)
+	layout.Nominal = len(gap2) == layout.Sectors
+	for _, gap := range gap2 {
+		layout.Nominal = layout.Nominal && abs(gap-headerGap) <= layoutTolerance
+	}
+	for _, gap := range layout.Gap3 {
+		layout.Nominal = layout.Nominal && abs(gap-sectorGap) <= layoutTolerance
+	}
+	return layout
+}
+
+// Find address marks of the track with their fields, in order.
+// Sync bytes before every mark are counted back from the mark.
+func scanLayoutFields(bits []byte) []layoutField {
+	var fields []layoutField
+	r := NewReader(bits)
+	for {
+		tag, err := r.scanIBMPC()
+		if err != nil {
+			return fields
+		}
+		mark := r.bitPos - 4*16
+		f := layoutField{tag: tag, start: mark, mark: mark, end: r.bitPos, size: -1}
+		for f.start >= 16 && gapByte(bits, f.start-16) == 0x00 {
+			f.start -= 16
+		}
+
+		switch tag {
+		case 0xfe:
+			// Sector ID with valid CRC
+			var id [6]byte
+			for i := range id {
+				id[i], err = r.readByte()
+				if err != nil {
+					return fields
+				}
+			}
+			sum := crc16CCITT(0xb230, id[:4])
+			if sum != uint16(id[4])<<8|uint16(id[5]) || id[3] > 7 {
+				continue
+			}
+			f.end = r.bitPos
+			f.size = int(id[3])
+		case 0xfb, 0xf8:
+			// Data of the preceding sector ID
+			n := len(fields)
+			if n == 0 || fields[n-1].tag != 0xfe {
+				continue
+			}
+			f.end += ((128 << fields[n-1].size) + 2) * 16
+			if f.end > len(bits)*8 {
+				return fields
+			}
+			r.bitPos = f.end
+		case 0xfc:
+		default:
+			continue
+		}
+		fields = append(fields, f)
+	}
+}
+
+// Find write splice in a gap of n bytes, walking by whole bytes
+// from the aligned position either forward (dir = +1) or backward
+// (dir = -1). Returns bit position of the splice, or -1 when gap bytes
+// are all valid.
+func findSplice(bits []byte, aligned, n, dir int) int {
+	run := 0
+	for i := 0; i < n; i++ {
+		pos := aligned + i*16
+		if dir < 0 {
+			pos = aligned - (i+1)*16
+		}
+		if gapByte(bits, pos) >= 0 {
+			run = 0
+			continue
+		}
+		run++
+		if run == spliceRun {
+			// Splice is where the run starts, walking from the aligned position
+			first := i - spliceRun + 1
+			if dir < 0 {
+				return aligned - first*16
+			}
+			return aligned + first*16
+		}
+	}
+	return -1
+}
+
+// Decode gap byte at the bit position: filler 0x4E or sync 0x00.
+// Returns -1 for any other value, or when clock bits violate MFM encoding.
+func gapByte(bits []byte, pos int) int {
+	value := 0
+	prev := pos > 0 && cellAt(bits, pos-1)
+	for i := 0; i < 8; i++ {
+		clock := cellAt(bits, pos+2*i)
+		data := cellAt(bits, pos+2*i+1)
+		if clock != (!prev && !data) && (i > 0 || pos > 0) {
+			return -1
+		}
+		value <<= 1
+		if data {
+			value |= 1
+		}
+		prev = data
+	}
+	if value != 0x4e && value != 0x00 {
+		return -1
+	}
+	return value
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,105 @@
+package mfm
+
+import (
+	"slices"
+	"testing"
+)
+
+// Standard 720K track: 9 sectors at 250 kbps
+func layoutTestTrack() []byte {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+	}
+	return NewWriter(100000).EncodeTrackIBMPC(sectors, 0, 0, 9, 250)
+}
+
+// Bytes of MFM data from index to the end of data of the given number of sectors:
+// gap4a, index mark, gap1, then sectors with gap3 after each one
+const (
+	layoutIndexBytes  = 80 + 16 + 50
+	layoutSectorBytes = 16 + 6 + 22 + 16 + 512 + 2 + 80
+)
+
+func sectorsEnd(n int) int {
+	return layoutIndexBytes + n*layoutSectorBytes - 80
+}
+
+func TestAnalyzeLayoutIBMPC(t *testing.T) {
+	bits := layoutTestTrack()
+	layout := AnalyzeLayoutIBMPC(bits, 250)
+	if layout == nil {
+		t.Fatalf("no layout found")
+	}
+	if layout.Sectors != 9 || layout.FirstID != layoutIndexBytes+12 ||
+		layout.Gap4a != 80 || layout.Gap1 != 50 {
+		t.Errorf("layout %+v", layout)
+	}
+	if want := slices.Repeat([]int{80}, 8); !slices.Equal(layout.Gap3, want) {
+		t.Errorf("gap3 %v, expected %v", layout.Gap3, want)
+	}
+	if want := len(bits)/2 - sectorsEnd(9); layout.Gap4b != want {
+		t.Errorf("gap4b %d, expected %d", layout.Gap4b, want)
+	}
+	if !layout.Nominal || len(layout.Splices) != 0 {
+		t.Errorf("nominal %v, splices %v", layout.Nominal, layout.Splices)
+	}
+}
+
+func TestAnalyzeLayoutIBMPC_Rotated(t *testing.T) {
+	// Index is 40 bytes into gap3 after the fourth sector
+	bits := layoutTestTrack()
+	cut := 2 * (sectorsEnd(4) + 40)
+	rotated := append(slices.Clone(bits[cut:]), bits[:cut]...)
+
+	layout := AnalyzeLayoutIBMPC(rotated, 250)
+	if layout == nil {
+		t.Fatalf("no layout found")
+	}
+	if layout.Sectors != 9 || layout.FirstID != 40+12 ||
+		layout.Gap4a != -1 || layout.Gap1 != 40 || layout.Gap4b != 40 {
+		t.Errorf("layout %+v", layout)
+	}
+
+	// Gap3 after the last sector goes through the index mark
+	wrap := len(bits)/2 - sectorsEnd(9) + layoutIndexBytes
+	want := []int{80, 80, 80, 80, wrap, 80, 80, 80}
+	if !slices.Equal(layout.Gap3, want) {
+		t.Errorf("gap3 %v, expected %v", layout.Gap3, want)
+	}
+	if layout.Nominal || len(layout.Splices) != 0 {
+		t.Errorf("nominal %v, splices %v", layout.Nominal, layout.Splices)
+	}
+}
+
+func TestAnalyzeLayoutIBMPC_Splice(t *testing.T) {
+	// Extra bitcell in gap3 after the second sector, like a sector
+	// rewritten by a drive which is slightly out of phase
+	bits := layoutTestTrack()
+	splice := sectorsEnd(2) + 10
+	cells := make([]int, len(bits)*8)
+	for i := range cells {
+		cells[i] = bitAt(bits, i)
+	}
+	cells = slices.Insert(cells[:len(cells)-1], splice*16, 1)
+	for i, c := range cells {
+		setBitAt(bits, i, c)
+	}
+
+	layout := AnalyzeLayoutIBMPC(bits, 250)
+	if layout == nil {
+		t.Fatalf("no layout found")
+	}
+	if layout.Sectors != 9 || !slices.Equal(layout.Splices, []int{splice}) {
+		t.Errorf("sectors %d, splices %v, expected splice at %d", layout.Sectors, layout.Splices, splice)
+	}
+	if layout.Gap3[1] != 80 || !layout.Nominal {
+		t.Errorf("gap3 %v, nominal %v", layout.Gap3, layout.Nominal)
+	}
+}
+
+func TestAnalyzeLayoutIBMPC_Unformatted(t *testing.T) {
+	if layout := AnalyzeLayoutIBMPC(slices.Repeat([]byte{0xaa}, 1000), 250); layout != nil {
+		t.Errorf("layout %+v on unformatted track", layout)
+	}
+}
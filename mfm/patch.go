@@ -0,0 +1,61 @@
+package mfm
+
+import "fmt"
+
+// Get MFM bit at position i (MSB-first)
+func bitAt(data []byte, i int) int {
+	return int(data[i/8]>>(7-i%8)) & 1
+}
+
+// Set MFM bit at position i (MSB-first)
+func setBitAt(data []byte, i int, value int) {
+	mask := byte(0x80) >> (i % 8)
+	if value != 0 {
+		data[i/8] |= mask
+	} else {
+		data[i/8] &^= mask
+	}
+}
+
+// PatchSectorIBMPC replaces contents of the sector in the MFM bitstream,
+// and updates its data CRC. The sector must be found by ReadSectorInfoIBMPC
+// in the same bitstream. Gaps, address marks and other sectors stay intact,
+// except the clock bit right after the CRC, which depends on its last bit.
+func PatchSectorIBMPC(track []byte, sector *SectorIBMPC, data []byte) error {
+	size := 128 << sector.Size
+	if len(data) != size {
+		return fmt.Errorf("sector %d has %d bytes, got %d", sector.Sector, size, len(data))
+	}
+	bitCount := (size + 2) * 16
+	start := sector.DataBitPos
+	if start < 1 || start+bitCount > len(track)*8 {
+		return fmt.Errorf("sector %d is out of track bounds", sector.Sector)
+	}
+
+	// Encode data and CRC, continuing from the last bit of the address mark
+	tag := byte(0xfb)
+	if sector.Deleted {
+		tag = 0xf8
+	}
+	sum := crc16CCITTByte(0xcdb4, tag)
+	sum = crc16CCITT(sum, data)
+	w := NewWriter(bitCount)
+	w.lastDataBit = bitAt(track, start-1)
+	for _, b := range data {
+		w.writeByte(b)
+	}
+	w.writeByte(byte(sum >> 8))
+	w.writeByte(byte(sum))
+
+	encoded := w.getData()
+	for i := 0; i < bitCount; i++ {
+		setBitAt(track, start+i, bitAt(encoded, i))
+	}
+
+	// Clock bit of the next data bit: set only between two zeros
+	next := start + bitCount
+	if next+1 < len(track)*8 && bitAt(track, next+1) == 0 {
+		setBitAt(track, next, w.lastDataBit^1)
+	}
+	return nil
+}
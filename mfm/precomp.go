@@ -0,0 +1,90 @@
+package mfm
+
+import (
+	"fmt"
+)
+
+// PrecompRange enables write precompensation on a range of cylinders
+type PrecompRange struct {
+	FirstCyl int    // First cylinder
+	LastCyl  int    // Last cylinder, -1 = up to the end of disk
+	ShiftNs  uint64 // Amount of shift in nanoseconds
+}
+
+// PrecompTable lists cylinder ranges with write precompensation.
+// Cylinders not covered by any range are written without precompensation.
+type PrecompTable []PrecompRange
+
+// Shift returns amount of precompensation for the cylinder, in nanoseconds
+func (table PrecompTable) Shift(cyl int) uint64 {
+	for _, r := range table {
+		if cyl >= r.FirstCyl && (r.LastCyl < 0 || cyl <= r.LastCyl) {
+			return r.ShiftNs
+		}
+	}
+	return 0
+}
+
+// CellPeriodNs returns duration of one MFM bitcell in nanoseconds
+func CellPeriodNs(bitRateKhz uint16) uint64 {
+	return uint64(1e6 / (2 * float64(bitRateKhz)))
+}
+
+// Get bitcell at position i (MSB-first), or 0 outside of the stream
+func cellAt(mfmBits []byte, i int) bool {
+	if i < 0 || i >= len(mfmBits)*8 {
+		return false
+	}
+	return mfmBits[i/8]&(0x80>>(i%8)) != 0
+}
+
+// FluxIntervals converts MFM bitcells to intervals between flux transitions,
+// in nanoseconds, with write precompensation for the given cylinder.
+// A transition with a close neighbor on one side only is shifted toward it,
+// to counter the peak shift on read back, which pushes close transitions
+// apart: in bitcell pattern 10100 the middle transition is written early,
+// and in pattern 00101 it is written late.
+func FluxIntervals(mfmBits []byte, cellNs uint64, table PrecompTable, cyl int) ([]uint64, error) {
+	if len(mfmBits) == 0 {
+		return nil, fmt.Errorf("empty MFM data")
+	}
+	shift := table.Shift(cyl)
+	if shift >= cellNs {
+		return nil, fmt.Errorf("precompensation %d nsec is too large for bitcell %d nsec", shift, cellNs)
+	}
+
+	var intervals []uint64
+	last := uint64(0)
+	bitCount := len(mfmBits) * 8
+	for i := 0; i < bitCount; i++ {
+		if !cellAt(mfmBits, i) {
+			continue
+		}
+
+		// Transition at the end of the bitcell
+		t := uint64(i+1) * cellNs
+		if shift > 0 {
+			before, after := cellAt(mfmBits, i-2), cellAt(mfmBits, i+2)
+			if before && !after {
+				t -= shift
+			} else if after && !before {
+				t += shift
+			}
+		}
+		intervals = append(intervals, t-last)
+		last = t
+	}
+	return intervals, nil
+}
+
+// IntervalsToTransitions converts intervals between flux transitions
+// to transition times relative to track start
+func IntervalsToTransitions(intervals []uint64) []uint64 {
+	transitions := make([]uint64, len(intervals))
+	t := uint64(0)
+	for i, interval := range intervals {
+		t += interval
+		transitions[i] = t
+	}
+	return transitions
+}
@@ -8,11 +8,36 @@ const (
 	sectorSize = 512 // sector size in bytes
 )
 
+// IDTolerance selects which fields of sector ID must match the physical track.
+// Some disks lie in the ID field: single-sided formats write head 0 on both sides,
+// 40-track disks read in an 80-track drive have halved cylinder numbers.
+type IDTolerance int
+
+const (
+	IDStrict        IDTolerance = iota // Cylinder and head must match
+	IDIgnoreHead                       // Head is not checked
+	IDIgnoreCylHead                    // Neither cylinder nor head is checked
+)
+
+// Sector of IBM PC format, with values from its ID field
+type SectorIBMPC struct {
+	Cylinder int    // Cylinder number from ID field
+	Head     int    // Head number from ID field
+	Sector   int    // Sector number from ID field (1-based)
+	Size     int    // Size code from ID field: 128 << Size bytes
+	Data     []byte // Sector contents
+	Deleted  bool   // Deleted data address mark
+	Bad      bool   // Data CRC mismatch
+
+	DataBitPos int // Position of sector contents in the bitstream, in MFM bits
+}
+
 // Read bits from an MFM bitstream (MSB-first byte order)
 // In MFM encoding: each data bit is encoded as 2 bits.
 type Reader struct {
-	data   []byte // MFM bitstream data (two bits per each data bit)
-	bitPos int    // Current bit position in raw bitstream (0-based)
+	data      []byte      // MFM bitstream data (two bits per each data bit)
+	bitPos    int         // Current bit position in raw bitstream (0-based)
+	Tolerance IDTolerance // How to match sector ID against physical track
 }
 
 // Create a new MFM bitstream reader
@@ -111,13 +136,50 @@ func (r *Reader) scanIBMPC() (int, error) {
 // Read a sector from IBM PC format
 // Return: sector number (0-based), 512-byte data, error
 func (r *Reader) ReadSectorIBMPC(cylinder, head int) (int, []byte, error) {
-	data := make([]byte, sectorSize)
+	for {
+		sector, err := r.ReadSectorInfoIBMPC(cylinder, head)
+		if err != nil {
+			return -1, nil, err
+		}
+		if len(sector.Data) != sectorSize || sector.Deleted {
+			// Wrong size or deleted data, continue searching
+			continue
+		}
+		if sector.Bad {
+			fmt.Printf("Warning: bad checksum in sector %d of track %d.%d\n", sector.Sector, cylinder, head)
+			continue
+		}
+		return sector.Sector - 1, sector.Data, nil
+	}
+}
 
+// Check whether sector ID matches the physical track, according to tolerance mode
+func (r *Reader) idMatches(readCylinder, readHead byte, cylinder, head int) bool {
+	return r.Tolerance.Matches(int(readCylinder), int(readHead), cylinder, head)
+}
+
+// Matches reports whether cylinder and head from sector ID
+// match the physical track, according to tolerance mode
+func (t IDTolerance) Matches(idCylinder, idHead, cylinder, head int) bool {
+	switch t {
+	case IDIgnoreCylHead:
+		return true
+	case IDIgnoreHead:
+		return idCylinder == cylinder
+	default:
+		return idCylinder == cylinder && idHead == head
+	}
+}
+
+// Read next sector of any size from IBM PC format.
+// Return sector with values from its ID field, or error at end of track.
+// Sectors with deleted data mark or bad data CRC are returned with flags set.
+func (r *Reader) ReadSectorInfoIBMPC(cylinder, head int) (*SectorIBMPC, error) {
 	for {
 		// Scan for sector header marker (tag 0xFE)
 		tag, err := r.scanIBMPC()
 		if err != nil {
-			return -1, nil, err
+			return nil, err
 		}
 		if tag != 0xfe {
 			// Not a sector header, continue scanning
@@ -162,38 +224,37 @@ func (r *Reader) ReadSectorIBMPC(cylinder, head int) (int, []byte, error) {
 		}
 
 		// Verify cylinder and head match
-		readTrack := int(readCylinder)*2 + int(readHead)
-		expectedTrack := cylinder*2 + head
-		if readTrack != expectedTrack {
+		if !r.idMatches(readCylinder, readHead, cylinder, head) {
 			// Wrong track, continue searching
 			continue
 		}
 
-		// Verify size (should be 2 for 512-byte sectors)
-		if size != 2 {
-			// Wrong size, continue searching
+		// Size codes above 7 are not valid
+		if size > 7 {
 			continue
 		}
+		data := make([]byte, 128<<size)
 
 		// Scan for data marker (tag 0xFB)
 		tag, err = r.scanIBMPC()
 		if err != nil {
-			return -1, nil, err
+			return nil, err
 		}
 		if tag == 0xfe {
 			// Found another header marker instead of data marker, restart
 			continue
 		}
-		if tag != 0xfb {
+		if tag != 0xfb && tag != 0xf8 {
 			// Invalid tag, continue searching
 			continue
 		}
 
 		// Read sector data
-		for i := 0; i < sectorSize; i++ {
+		dataBitPos := r.bitPos
+		for i := range data {
 			b, err := r.readByte()
 			if err != nil {
-				return -1, nil, err
+				return nil, err
 			}
 			data[i] = b
 		}
@@ -201,25 +262,29 @@ func (r *Reader) ReadSectorIBMPC(cylinder, head int) (int, []byte, error) {
 		// Read data CRC
 		dataSumHigh, err := r.readByte()
 		if err != nil {
-			return -1, nil, err
+			return nil, err
 		}
 		dataSumLow, err := r.readByte()
 		if err != nil {
-			return -1, nil, err
+			return nil, err
 		}
 		dataSum := uint16(dataSumHigh)<<8 | uint16(dataSumLow)
 
-		// Verify data CRC (log warning but use data anyway)
-		myDataSum := crc16CCITTByte(0xcdb4, 0xfb)
+		// Verify data CRC
+		myDataSum := crc16CCITTByte(0xcdb4, byte(tag))
 		myDataSum = crc16CCITT(myDataSum, data)
-		if myDataSum != dataSum {
-			// CRC mismatch, but use the data anyway
-			fmt.Printf("Warning: bad checksum in sector %d of track %d.%d\n", sector, cylinder, head)
-			continue
-		}
 
-		// Return sector number (0-based) and data
-		return int(sector) - 1, data, nil
+		return &SectorIBMPC{
+			Cylinder: int(readCylinder),
+			Head:     int(readHead),
+			Sector:   int(sector),
+			Size:     int(size),
+			Data:     data,
+			Deleted:  tag == 0xf8,
+			Bad:      myDataSum != dataSum,
+
+			DataBitPos: dataBitPos,
+		}, nil
 	}
 }
 
@@ -295,6 +360,57 @@ func (r *Reader) CountSectorsIBMPC() int {
 	return len(sectors)
 }
 
+// Find header of the sector with given number, as recorded in the header (1-based).
+// Return bit position of the first A1 byte of the header marker, or error.
+func (r *Reader) FindSectorIBMPC(sectorNum int) (int, error) {
+	pos, _, err := r.findHeaderIBMPC(func(sector int) bool { return sector == sectorNum })
+	return pos, err
+}
+
+// Find the next sector header with valid CRC, whatever its sector number.
+// Return bit position of the first A1 byte of the header marker,
+// and sector number of the header, or error.
+func (r *Reader) FindHeaderIBMPC() (int, int, error) {
+	return r.findHeaderIBMPC(func(int) bool { return true })
+}
+
+// Find the next sector header with valid CRC, whose sector number matches
+func (r *Reader) findHeaderIBMPC(match func(sector int) bool) (int, int, error) {
+	for {
+		// Scan for sector header marker (tag 0xFE)
+		tag, err := r.scanIBMPC()
+		if err != nil {
+			return -1, 0, err
+		}
+		if tag != 0xfe {
+			// Not a sector header, continue scanning
+			continue
+		}
+
+		// Marker is three A1 bytes followed by tag, 16 bits each
+		markerPos := r.bitPos - 4*16
+
+		// Read sector header
+		var header [6]byte
+		for i := range header {
+			header[i], err = r.readByte()
+			if err != nil {
+				return -1, 0, err
+			}
+		}
+
+		// Verify header CRC
+		myHeaderSum := crc16CCITT(0xb230, header[:4])
+		if myHeaderSum != uint16(header[4])<<8|uint16(header[5]) {
+			// CRC mismatch, continue searching
+			continue
+		}
+		if match(int(header[2])) {
+			return markerPos, int(header[2]), nil
+		}
+	}
+}
+
 // Detect floppy format from file size
 // Return: cylinders, sides, sectorsPerTrack
 func DetectFormatFromSize(fileSize int64) (cylinders, sides, sectorsPerTrack int, err error) {
@@ -332,6 +448,16 @@ func DetectFormatFromSize(fileSize int64) (cylinders, sides, sectorsPerTrack int
 		// 5¼" XT DD single side
 		{40, 1, 8}, // 160K
 		{40, 1, 9}, // 180K
+		// Atari ST, 11 sectors
+		{80, 2, 11}, // 880K
+		{80, 1, 11}, // 440K
+		// Atari ST, 82 cylinders
+		{82, 2, 9},  // 738K
+		{82, 2, 10}, // 820K
+		{82, 2, 11}, // 902K
+		{82, 1, 9},  // 369K
+		{82, 1, 10}, // 410K
+		{82, 1, 11}, // 451K
 	}
 
 	for _, format := range commonFormats {
@@ -362,6 +488,30 @@ func DetectFormatFromSize(fileSize int64) (cylinders, sides, sectorsPerTrack int
 	return 0, 0, 0, fmt.Errorf("unknown floppy image format %d sectors", totalSectors)
 }
 
+// Detect Atari ST floppy format from file size.
+// Atari ST disks have 80 or 82 cylinders, one or two sides,
+// and 9 to 11 sectors per track, or 18 sectors on HD disks.
+// Sizes which match no Atari ST format are detected as IBM PC ones.
+// Return: cylinders, sides, sectorsPerTrack
+func DetectAtariSTFormatFromSize(fileSize int64) (cylinders, sides, sectorsPerTrack int, err error) {
+	if fileSize%sectorSize == 0 {
+		totalSectors := int(fileSize / sectorSize)
+		if totalSectors == 80*2*18 {
+			return 80, 2, 18, nil
+		}
+		for _, cylinders := range []int{80, 82} {
+			for sides := 1; sides <= 2; sides++ {
+				for sectorsPerTrack := 9; sectorsPerTrack <= 11; sectorsPerTrack++ {
+					if totalSectors == cylinders*sides*sectorsPerTrack {
+						return cylinders, sides, sectorsPerTrack, nil
+					}
+				}
+			}
+		}
+	}
+	return DetectFormatFromSize(fileSize)
+}
+
 // unshuffle reconstructs a 32-bit word from odd and even bit streams.
 // The first argument contains the odd bits, the second - the even bits.
 func unshuffle(odd, even uint16) uint32 {
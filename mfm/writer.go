@@ -8,6 +8,10 @@ type Writer struct {
 	bitPos      int    // Current bit position (0-based)
 	lastDataBit int    // Last data bit for encoding of next zero
 	maxHalfBits int    // Maximum number of half-bits allowed for this track
+
+	// Layout of IBM PC tracks; zero values give consecutive sectors
+	Interleave int // Physical distance between logical sectors: 1 for 1:1, 2 for 2:1, etc.
+	Skew       int // Shift of first sector from one cylinder to the next, in sectors
 }
 
 // Create a new MFM writer.
@@ -132,15 +136,17 @@ func (w *Writer) getData() []byte {
 	return w.buffer
 }
 
-// Encode a track in IBM format
+// Encode a track in IBM format, with sectors laid out by Interleave and Skew
 // sectors: array of sector data (512 bytes each), indexed by sector number
 // cylinder: cylinder number (0-based)
 // head: head number (0 or 1)
 // sectorsPerTrack: number of sectors per track
 // bitRate: bit rate in kbps
 // skipIndexMark: if true, skip the index marker (used for BKD format)
+// deleted: sectors with deleted data address mark, or nil
+// addrs: cylinder and head to record in ID field of each sector, or nil
 //
-func (w *Writer) encodeTrackIBMInternal(sectors [][]byte, cylinder, head, sectorsPerTrack int, bitRate uint16, skipIndexMark bool) []byte {
+func (w *Writer) encodeTrackIBMInternal(sectors [][]byte, cylinder, head, sectorsPerTrack int, bitRate uint16, skipIndexMark bool, deleted []bool, addrs []SectorAddr) []byte {
 
 	const startGap = 80 // gap4a: empty bytes before index marker
 	const indexGap = 50 // gap1: empty bytes before first sector
@@ -148,28 +154,38 @@ func (w *Writer) encodeTrackIBMInternal(sectors [][]byte, cylinder, head, sector
 	// Compute gap2 and gap3 based on bit rate and sectorsPerTrack.
 	headerGap, sectorGap := computeGapsIBMPC(bitRate, sectorsPerTrack)
 
-	// Index (before first sector) - optionally skip the index marker
-	if !skipIndexMark {
+	// Index (before first sector) - optionally skip the index marker.
+	// Tracks of 11 sectors at double density, like on Atari ST,
+	// have no room for index gaps.
+	noIndexGap := isTightTrack(bitRate, sectorsPerTrack)
+	if !skipIndexMark && !noIndexGap {
 		w.writeGap(startGap, 0x4E)
 		w.writeIndexMarker()
 	}
-	w.writeGap(indexGap, 0x4E)
+	if !noIndexGap {
+		w.writeGap(indexGap, 0x4E)
+	}
 
-	// Write each sector
-	for s := 0; s < sectorsPerTrack; s++ {
+	// Write each sector, in physical order
+	order := sectorOrder(sectorsPerTrack, w.Interleave, w.Skew, cylinder)
+	for _, s := range order {
 
 		// Sector marker
 		w.writeMarker(0xFE)
 
 		// Sector identifier: cylinder, head, sector, size
-		w.writeByte(byte(cylinder))
-		w.writeByte(byte(head))
+		idCylinder, idHead := cylinder, head
+		if s < len(addrs) {
+			idCylinder, idHead = addrs[s].Cylinder, addrs[s].Head
+		}
+		w.writeByte(byte(idCylinder))
+		w.writeByte(byte(idHead))
 		w.writeByte(byte(s + 1)) // Sector number (1-based)
 		w.writeByte(2)           // Size code (2 = 512 bytes)
 
 		// Calculate header CRC
-		sum := crc16CCITTByte(0xb230, byte(cylinder))
-		sum = crc16CCITTByte(sum, byte(head))
+		sum := crc16CCITTByte(0xb230, byte(idCylinder))
+		sum = crc16CCITTByte(sum, byte(idHead))
 		sum = crc16CCITTByte(sum, byte(s+1))
 		sum = crc16CCITTByte(sum, 2)
 
@@ -180,8 +196,12 @@ func (w *Writer) encodeTrackIBMInternal(sectors [][]byte, cylinder, head, sector
 		// Gap between sector mark and data
 		w.writeGap(headerGap, 0x4E)
 
-		// Data marker
-		w.writeMarker(0xFB)
+		// Data marker: normal or deleted data
+		tag := byte(0xFB)
+		if s < len(deleted) && deleted[s] {
+			tag = 0xF8
+		}
+		w.writeMarker(tag)
 
 		// Sector data must be present
 		sectorData := sectors[s]
@@ -190,7 +210,7 @@ func (w *Writer) encodeTrackIBMInternal(sectors [][]byte, cylinder, head, sector
 		}
 
 		// Calculate data CRC
-		sum = crc16CCITTByte(0xcdb4, 0xFB)
+		sum = crc16CCITTByte(0xcdb4, tag)
 		sum = crc16CCITT(sum, sectorData)
 
 		// Write data CRC
@@ -209,6 +229,36 @@ func (w *Writer) encodeTrackIBMInternal(sectors [][]byte, cylinder, head, sector
 	return w.getData()
 }
 
+// Compute physical order of sectors on a track: logical sector number
+// at each physical position. Every next sector is placed interleave
+// positions after the previous one, or at the nearest free position
+// past it. The layout is rotated by skew positions per cylinder,
+// so that sector 1 follows the head after a step.
+func sectorOrder(sectorsPerTrack, interleave, skew, cylinder int) []int {
+	order := make([]int, sectorsPerTrack)
+	if sectorsPerTrack == 0 {
+		return order
+	}
+	if interleave < 1 {
+		interleave = 1
+	}
+	if skew < 0 {
+		skew = 0
+	}
+	shift := cylinder * skew % sectorsPerTrack
+	used := make([]bool, sectorsPerTrack)
+	pos := 0
+	for s := 0; s < sectorsPerTrack; s++ {
+		for used[pos] {
+			pos = (pos + 1) % sectorsPerTrack
+		}
+		used[pos] = true
+		order[(pos+shift)%sectorsPerTrack] = s
+		pos = (pos + interleave) % sectorsPerTrack
+	}
+	return order
+}
+
 // Track layout for IBM PC floppies
 // ┌─────┬──────┬────┬···┬──────┬──────┬────┬──────┬────┬────┬···┬─────┐
 // │gap4a│Index │gap1│   │Sector│Sector│gap2│Data  │Data│gap3│   │gap4b│
@@ -216,7 +266,29 @@ func (w *Writer) encodeTrackIBMInternal(sectors [][]byte, cylinder, head, sector
 // └─────┴──────┴────┴···┴──────┴──────┴────┴──────┴────┴────┴···┴─────┘
 //                     └───────────────repeat──────────────────┘
 func (w *Writer) EncodeTrackIBMPC(sectors [][]byte, cylinder, head, sectorsPerTrack int, bitRate uint16) []byte {
-	return w.encodeTrackIBMInternal(sectors, cylinder, head, sectorsPerTrack, bitRate, false)
+	return w.encodeTrackIBMInternal(sectors, cylinder, head, sectorsPerTrack, bitRate, false, nil, nil)
+}
+
+// Encode a track in IBM PC format, where some sectors have deleted data
+// address mark (0xF8) instead of normal one (0xFB).
+// deleted is indexed by sector number, like sectors.
+func (w *Writer) EncodeTrackIBMPCDeleted(sectors [][]byte, deleted []bool, cylinder, head, sectorsPerTrack int, bitRate uint16) []byte {
+	return w.encodeTrackIBMInternal(sectors, cylinder, head, sectorsPerTrack, bitRate, false, deleted, nil)
+}
+
+// Cylinder and head recorded in the ID field of a sector.
+// They may differ from the physical track, for example on disks
+// formatted with a cylinder offset or swapped heads.
+type SectorAddr struct {
+	Cylinder int
+	Head     int
+}
+
+// Encode a track in IBM PC format, where every sector may have its own
+// cylinder and head in the ID field. Both deleted and addrs are indexed
+// by sector number, like sectors; nil means the physical track values.
+func (w *Writer) EncodeTrackIBMPCAddr(sectors [][]byte, deleted []bool, addrs []SectorAddr, cylinder, head, sectorsPerTrack int, bitRate uint16) []byte {
+	return w.encodeTrackIBMInternal(sectors, cylinder, head, sectorsPerTrack, bitRate, false, deleted, addrs)
 }
 
 // Track layout for BK-0010 and BK-0011M floppies
@@ -226,7 +298,7 @@ func (w *Writer) EncodeTrackIBMPC(sectors [][]byte, cylinder, head, sectorsPerTr
 // └────┴···┴──────┴──────┴────┴──────┴────┴────┴···┴─────┘
 //        └───────────────repeat──────────────────┘
 func (w *Writer) EncodeTrackBK(sectors [][]byte, cylinder, head, sectorsPerTrack int, bitRate uint16) []byte {
-	return w.encodeTrackIBMInternal(sectors, cylinder, head, sectorsPerTrack, bitRate, true)
+	return w.encodeTrackIBMInternal(sectors, cylinder, head, sectorsPerTrack, bitRate, true, nil, nil)
 }
 
 // Compute gap2 and gap3 based on bit rate and number of sectors per track.
@@ -245,6 +317,7 @@ func (w *Writer) EncodeTrackBK(sectors [][]byte, cylinder, head, sectorsPerTrack
 //             3½"SS   360K    9          1      80      22    80
 //             3½"     720K    9          2      80      22    80
 //             3½"     800K    10         2      80      22    34
+//             3½"ST   880K    11         2      80      10    6
 // ----------------------------------------------------------------
 // 300 kbps    5¼"AT   360K    9          2      40      22    80
 // ----------------------------------------------------------------
@@ -284,10 +357,22 @@ func computeGapsIBMPC(bitRate uint16, sectorsPerTrack int) (int, int) {
 			// From my experience, 34 works well.
 			sectorGap = 34
 		}
+		if isTightTrack(bitRate, sectorsPerTrack) {
+			// Minimal gaps. Together with 12 sync bytes, gap2 still
+			// spans 22 bytes, which controller skips before writing data
+			headerGap = 10
+			sectorGap = 6
+		}
 	}
 	return headerGap, sectorGap
 }
 
+// Check whether the track is too short for index gaps:
+// 11 sectors at double density fit only without them.
+func isTightTrack(bitRate uint16, sectorsPerTrack int) bool {
+	return bitRate <= 300 && sectorsPerTrack > 10
+}
+
 // shuffle splits a 32-bit word into odd and even bit streams.
 func shuffle(word uint32) (odd, even uint16) {
 	for i := 0; i < 16; i++ {
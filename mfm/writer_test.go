@@ -1,6 +1,7 @@
 package mfm
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -206,3 +207,221 @@ func TestEncodeTrackIBMPC_CountSectors(t *testing.T) {
 		})
 	}
 }
+
+func TestReadSectorIBMPC_IDTolerance(t *testing.T) {
+	// Single-sided format: ID field of every sector has head 0
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		sectors[i][0] = byte(i)
+	}
+	track := NewWriter(200000).EncodeTrackIBMPC(sectors, 3, 0, 9, 250)
+
+	testCases := []struct {
+		name      string
+		tolerance IDTolerance
+		cylinder  int
+		expected  int
+	}{
+		{"strict", IDStrict, 3, 0},
+		{"ignore head", IDIgnoreHead, 3, 9},
+		{"ignore head, wrong cylinder", IDIgnoreHead, 6, 0},
+		{"ignore cylinder and head", IDIgnoreCylHead, 6, 9},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Read the track as head 1
+			reader := NewReader(track)
+			reader.Tolerance = tc.tolerance
+			count := 0
+			for {
+				sector, err := reader.ReadSectorInfoIBMPC(tc.cylinder, 1)
+				if err != nil {
+					break
+				}
+				if sector.Cylinder != 3 || sector.Head != 0 || sector.Size != 2 {
+					t.Errorf("sector %d: ID field %d/%d size %d, expected 3/0 size 2",
+						sector.Sector, sector.Cylinder, sector.Head, sector.Size)
+				}
+				if sector.Data[0] != byte(sector.Sector-1) {
+					t.Errorf("sector %d: wrong data %#x", sector.Sector, sector.Data[0])
+				}
+				count++
+			}
+			if count != tc.expected {
+				t.Errorf("found %d sectors, expected %d", count, tc.expected)
+			}
+		})
+	}
+}
+
+func TestEncodeTrackIBMPC_Interleave(t *testing.T) {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		sectors[i][0] = byte(i)
+	}
+
+	testCases := []struct {
+		name       string
+		interleave int
+		skew       int
+		cylinder   int
+		expected   []int
+	}{
+		{"default", 0, 0, 0, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{"2:1", 2, 0, 0, []int{1, 6, 2, 7, 3, 8, 4, 9, 5}},
+		{"3:1", 3, 0, 0, []int{1, 4, 7, 2, 5, 8, 3, 6, 9}},
+		{"skew on cylinder 0", 1, 2, 0, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{"skew on cylinder 2", 1, 2, 2, []int{6, 7, 8, 9, 1, 2, 3, 4, 5}},
+		{"2:1 with skew", 2, 1, 1, []int{5, 1, 6, 2, 7, 3, 8, 4, 9}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			writer := NewWriter(200000)
+			writer.Interleave = tc.interleave
+			writer.Skew = tc.skew
+			track := writer.EncodeTrackIBMPC(sectors, tc.cylinder, 0, 9, 250)
+
+			// Sector IDs in physical order, each with its own data
+			reader := NewReader(track)
+			var ids []int
+			for {
+				sector, err := reader.ReadSectorInfoIBMPC(tc.cylinder, 0)
+				if err != nil {
+					break
+				}
+				if sector.Data[0] != byte(sector.Sector-1) {
+					t.Errorf("sector %d: wrong data %#x", sector.Sector, sector.Data[0])
+				}
+				ids = append(ids, sector.Sector)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tc.expected) {
+				t.Errorf("physical order %v, expected %v", ids, tc.expected)
+			}
+		})
+	}
+}
+
+func TestEncodeTrackIBMPC_ElevenSectors(t *testing.T) {
+	sectors := make([][]byte, 11)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		for j := range sectors[i] {
+			sectors[i][j] = byte(i*7 + j)
+		}
+	}
+
+	// One revolution at 250 kbps and 300 RPM: 6250 bytes
+	const maxHalfBits = 250000 * 60 / 300 * 2
+	writer := NewWriter(maxHalfBits)
+	track := writer.EncodeTrackIBMPC(sectors, 5, 1, 11, 250)
+	if len(track)*8 > maxHalfBits {
+		t.Fatalf("track of %d bytes is longer than one revolution", len(track))
+	}
+
+	// Every sector decodes with valid CRC, even the last one
+	reader := NewReader(track)
+	found := 0
+	for {
+		sector, err := reader.ReadSectorInfoIBMPC(5, 1)
+		if err != nil {
+			break
+		}
+		if sector.Bad {
+			t.Errorf("sector %d: bad CRC", sector.Sector)
+		}
+		if sector.Sector != found+1 || sector.Data[0] != byte(found*7) {
+			t.Errorf("sector %d: unexpected, data %#x", sector.Sector, sector.Data[0])
+		}
+		found++
+	}
+	if found != 11 {
+		t.Errorf("found %d sectors, expected 11", found)
+	}
+}
+
+func TestDetectAtariSTFormatFromSize(t *testing.T) {
+	testCases := []struct {
+		size      int64
+		atariST   bool
+		cylinders int
+		sides     int
+		sectors   int
+	}{
+		{80 * 2 * 11 * 512, false, 80, 2, 11},
+		{82 * 2 * 10 * 512, false, 82, 2, 10},
+		{80 * 1 * 10 * 512, false, 40, 2, 10},
+		{80 * 1 * 10 * 512, true, 80, 1, 10},
+		{80 * 2 * 9 * 512, true, 80, 2, 9},
+		{80 * 2 * 18 * 512, true, 80, 2, 18},
+		{40 * 1 * 8 * 512, true, 40, 1, 8},
+	}
+	for _, tc := range testCases {
+		detect := DetectFormatFromSize
+		if tc.atariST {
+			detect = DetectAtariSTFormatFromSize
+		}
+		cylinders, sides, sectors, err := detect(tc.size)
+		if err != nil {
+			t.Errorf("size %d: error %v", tc.size, err)
+			continue
+		}
+		if cylinders != tc.cylinders || sides != tc.sides || sectors != tc.sectors {
+			t.Errorf("size %d, Atari ST %v: %d/%d/%d, expected %d/%d/%d", tc.size, tc.atariST,
+				cylinders, sides, sectors, tc.cylinders, tc.sides, tc.sectors)
+		}
+	}
+}
+
+func TestEncodeTrackIBMPC_ExtendedDensity(t *testing.T) {
+	for _, sectorsPerTrack := range []int{36, 39} {
+		sectors := make([][]byte, sectorsPerTrack)
+		for i := range sectors {
+			sectors[i] = make([]byte, 512)
+			for j := range sectors[i] {
+				sectors[i][j] = byte(i*3 + j)
+			}
+		}
+
+		// One revolution at 1000 kbps and 300 RPM: 25000 bytes
+		const maxHalfBits = 1000000 * 60 / 300 * 2
+		writer := NewWriter(maxHalfBits)
+		track := writer.EncodeTrackIBMPC(sectors, 79, 1, sectorsPerTrack, 1000)
+		if len(track)*8 != maxHalfBits {
+			t.Errorf("%d sectors: track of %d bytes, expected one revolution", sectorsPerTrack, len(track))
+		}
+
+		// Gaps leave room for track fill after the last sector
+		gap2, gap3 := computeGapsIBMPC(1000, sectorsPerTrack)
+		used := 80 + 16 + 50 + sectorsPerTrack*(16+6+gap2+16+514+gap3)
+		if used >= maxHalfBits/16 {
+			t.Errorf("%d sectors: %d bytes do not fit into track", sectorsPerTrack, used)
+		}
+
+		// Every sector decodes with valid CRC, even the last one
+		reader := NewReader(track)
+		found := 0
+		for {
+			sector, err := reader.ReadSectorInfoIBMPC(79, 1)
+			if err != nil {
+				break
+			}
+			if sector.Bad || sector.Sector != found+1 || sector.Data[0] != byte(found*3) {
+				t.Errorf("%d sectors: sector %d is bad or unexpected", sectorsPerTrack, sector.Sector)
+			}
+			found++
+		}
+		if found != sectorsPerTrack {
+			t.Errorf("found %d sectors, expected %d", found, sectorsPerTrack)
+		}
+	}
+
+	// 2.88M image is recognized by size
+	cylinders, sides, sectors, err := DetectFormatFromSize(80 * 2 * 36 * 512)
+	if err != nil || cylinders != 80 || sides != 2 || sectors != 36 {
+		t.Errorf("DetectFormatFromSize(2.88M) = %d/%d/%d, %v", cylinders, sides, sectors, err)
+	}
+}
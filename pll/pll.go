@@ -0,0 +1,42 @@
+// Package pll configures the phase-locked loop, which recovers
+// MFM bitcells from times of flux transitions.
+package pll
+
+// Defaults of the PLL, as in SuperCard Pro software
+const (
+	DefaultPeriodAdjust = 5  // Percent of phase error applied to the period
+	DefaultPhaseAdjust  = 60 // Percent of phase error applied to the phase
+	DefaultMaxAdjust    = 10 // Percent the period may drift from the ideal one
+)
+
+// DropoutCells is a suggested value of Config.DropoutCells:
+// valid MFM has at most three clocked zeros in a row
+const DropoutCells = 32
+
+// Config tunes the PLL. Zero value of every field selects its default,
+// so Config{} decodes like the PLL always did.
+type Config struct {
+	PeriodAdjust int // Percent of phase error applied to the period, 0 = DefaultPeriodAdjust
+	PhaseAdjust  int // Percent of phase error applied to the phase, 0 = DefaultPhaseAdjust
+	MaxAdjust    int // Percent the period may drift from the ideal one, 0 = DefaultMaxAdjust
+
+	// Clocked zeros without a transition, after which the period is reset
+	// to the ideal one, to lock again after a dropout; 0 = never reset.
+	// The PLL keeps the period during a dropout anyway, so this only
+	// matters when flux around the dropout pulls it off.
+	DropoutCells int
+}
+
+// WithDefaults returns the config with zero fields set to defaults
+func (c Config) WithDefaults() Config {
+	if c.PeriodAdjust == 0 {
+		c.PeriodAdjust = DefaultPeriodAdjust
+	}
+	if c.PhaseAdjust == 0 {
+		c.PhaseAdjust = DefaultPhaseAdjust
+	}
+	if c.MaxAdjust == 0 {
+		c.MaxAdjust = DefaultMaxAdjust
+	}
+	return c
+}
@@ -0,0 +1,116 @@
+package sim
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sergev/floppy/config"
+)
+
+// Dropout is a region of a track where no flux transitions are read,
+// like a scratch or a worn spot of the disk surface
+type Dropout struct {
+	Cyl    int           // Cylinder of the track
+	Head   int           // Side of the track
+	Start  time.Duration // Start of the region, from the index pulse
+	Length time.Duration // Length of the region
+}
+
+// WeakRegion is a region of a track where flux reads differently
+// on every revolution, like weak bits of copy protected disks
+type WeakRegion struct {
+	Cyl    int           // Cylinder of the track
+	Head   int           // Side of the track
+	Start  time.Duration // Start of the region, from the index pulse
+	Length time.Duration // Length of the region
+}
+
+// BadSector makes data of a sector fail its CRC check when read
+type BadSector struct {
+	Cyl    int // Cylinder of the track
+	Head   int // Side of the track
+	Sector int // Sector number from ID field (1-based)
+	Reads  int // Number of first reads of the track where the sector is bad, 0 = every read
+}
+
+// FailedRead makes first reads of a track fail, like a buffer overflow
+// of the adapter
+type FailedRead struct {
+	Cyl   int // Cylinder of the track
+	Head  int // Side of the track
+	Reads int // Number of first reads of the track which fail
+}
+
+// Most revolutions read per track, as by SuperCard Pro
+const maxRevolutions = 5
+
+// Options controls imperfections and timing of the simulated drive.
+// Faults are deterministic, so that retry and verification logic
+// can be tested: the same options always give the same reads.
+type Options struct {
+	Revolutions uint    // Revolutions to read per track: 1-5
+	JitterNs    float64 // Standard deviation of flux transition noise, in nanoseconds
+	SpeedError  float64 // Drive spins faster by this fraction, like 0.02 for 2%; negative for slower
+
+	Dropouts    []Dropout    // Regions without flux
+	WeakRegions []WeakRegion // Regions of random flux, besides weak bits of the disk image
+	BadSectors  []BadSector  // Sectors with bad data CRC
+	FailedReads []FailedRead // Tracks which cannot be read at first
+
+	NoDisk         bool // Drive is empty
+	WriteProtected bool // Disk is write protected
+
+	// Delays of drive mechanics, zero for none.
+	// Overridden by the drive profile, when set there.
+	StepDelay   time.Duration // Move head by one cylinder
+	SettleDelay time.Duration // Head settle time after seek
+	SpinUpDelay time.Duration // Motor spin-up time
+}
+
+// Default options: perfect disk, two revolutions, timing of a typical drive
+var DefaultOptions = Options{
+	Revolutions: 2,
+	StepDelay:   3 * time.Millisecond,
+	SettleDelay: 15 * time.Millisecond,
+	SpinUpDelay: 500 * time.Millisecond,
+}
+
+// SetOptions validates and sets options for subsequent operations
+func (c *Client) SetOptions(opts Options) error {
+	if opts.Revolutions < 1 || opts.Revolutions > maxRevolutions {
+		return fmt.Errorf("invalid number of revolutions: %d (must be 1-%d)", opts.Revolutions, maxRevolutions)
+	}
+	if opts.JitterNs < 0 {
+		return fmt.Errorf("invalid jitter: %g ns", opts.JitterNs)
+	}
+	if opts.SpeedError <= -0.5 || opts.SpeedError >= 0.5 {
+		return fmt.Errorf("invalid speed error: %g (must be within -0.5..0.5)", opts.SpeedError)
+	}
+	if opts.StepDelay < 0 || opts.SettleDelay < 0 || opts.SpinUpDelay < 0 {
+		return fmt.Errorf("invalid negative delay")
+	}
+	c.options = opts
+	return nil
+}
+
+// Delays of drive mechanics: from the drive profile, when set there
+func (c *Client) stepDelay() time.Duration {
+	if config.StepDelay != 0 {
+		return time.Duration(config.StepDelay) * time.Microsecond
+	}
+	return c.options.StepDelay
+}
+
+func (c *Client) settleDelay() time.Duration {
+	if config.Settle != 0 {
+		return time.Duration(config.Settle) * time.Millisecond
+	}
+	return c.options.SettleDelay
+}
+
+func (c *Client) spinUpDelay() time.Duration {
+	if config.MotorDelay != 0 {
+		return time.Duration(config.MotorDelay) * time.Millisecond
+	}
+	return c.options.SpinUpDelay
+}
@@ -0,0 +1,421 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/flux"
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+)
+
+// Sample clock of the simulator: flux times are exact nanoseconds
+const simSampleClockHz = 1e9
+
+// Read reads the entire floppy disk and returns it as a disk object.
+// When w is not nil, every track is also saved to it as soon as it is read.
+func (c *Client) Read(numberOfCylinders int, w *hfe.Writer) (*hfe.Disk, error) {
+	if err := c.busy.Begin(); err != nil {
+		return nil, err
+	}
+	defer c.busy.End()
+
+	// Range of cylinders and heads to read
+	firstCyl, lastCyl := adapter.ReadOpts.Cylinders(numberOfCylinders)
+	firstHead, lastHead := adapter.ReadOpts.Heads(config.Heads)
+
+	// Initialize disk structure
+	disk := &hfe.Disk{
+		Header: hfe.Header{
+			NumberOfTrack:       uint8(numberOfCylinders),
+			NumberOfSide:        uint8(adapter.ReadOpts.NumberOfSides(config.Heads)),
+			TrackEncoding:       hfe.ENC_ISOIBM_MFM,
+			BitRate:             0,                // Will be calculated from flux data
+			FloppyRPM:           300,              // Will be calculated from flux data
+			FloppyInterfaceMode: hfe.IFM_IBMPC_DD, // Default to double density
+			WriteProtected:      0xFF,             // Not write protected
+			WriteAllowed:        0xFF,             // Write allowed
+			SingleStep:          0xFF,             // Single step mode
+			Track0S0AltEncoding: 0xFF,             // Use default encoding
+			Track0S0Encoding:    hfe.ENC_ISOIBM_MFM,
+			Track0S1AltEncoding: 0xFF, // Use default encoding
+			Track0S1Encoding:    hfe.ENC_ISOIBM_MFM,
+		},
+		Tracks: make([]hfe.TrackData, numberOfCylinders),
+	}
+
+	r := &trackReader{}
+	failures := &adapter.TrackFailures{}
+	for cyl := firstCyl; cyl <= lastCyl; cyl++ {
+		for head := firstHead; head <= lastHead; head++ {
+			// Print progress message
+			if cyl != firstCyl || head != firstHead {
+				fmt.Printf("\rReading track %d, side %d...", cyl, head)
+			}
+
+			err := failures.Read(cyl, head, func() error {
+				capture, err := c.readTrack(r, cyl, head)
+				if err != nil {
+					return err
+				}
+				capture.Store(disk)
+				disk.Header.FloppyRPM, disk.Header.BitRate = r.rates.Disk()
+				r.encoding.Update(disk, capture)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Save completed track to the output file
+		if w != nil {
+			w.Header = disk.Header
+			err := w.WriteTrackData(cyl, disk.Tracks[cyl])
+			if err != nil {
+				return nil, fmt.Errorf("failed to save track %d: %w", cyl, err)
+			}
+		}
+	}
+	fmt.Printf("\nRead complete.\n")
+	if report := r.rates.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.recovery.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.recovery.LockReport(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.locks.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.verifier.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.encoding.Report(disk); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.weak.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := failures.Report(); report != "" {
+		fmt.Println(report)
+	}
+
+	return disk, failures.Err()
+}
+
+// ReadTrack reads one track into memory, and decodes it with
+// rates measured on the track itself, unless forced by ReadOpts
+func (c *Client) ReadTrack(cyl, head int) (*adapter.TrackCapture, error) {
+	if err := c.busy.Begin(); err != nil {
+		return nil, err
+	}
+	defer c.busy.End()
+
+	err := adapter.CheckTrack(cyl, head)
+	if err != nil {
+		return nil, err
+	}
+	return c.readTrack(&trackReader{single: true}, cyl, head)
+}
+
+// State of reading tracks, shared between tracks of one disk
+type trackReader struct {
+	single   bool   // Reading a single track: rates are measured on it quietly
+	bitRate  uint16 // Bit rate of the track being read, 0 until the first track
+	rpm      uint16 // Rotation speed of the track being read
+	rates    adapter.RateEstimator
+	recovery flux.SpeedRecovery
+	verifier adapter.Verifier
+	locks    adapter.LockLog
+	encoding adapter.EncodingDetector
+	weak     adapter.WeakDetector
+}
+
+// Read one track and decode it, like hardware adapters do.
+// Bit rate and RPM of the disk are measured on the first tracks decoded.
+func (c *Client) readTrack(r *trackReader, cyl, head int) (*adapter.TrackCapture, error) {
+	c.startMotor()
+	err := c.seek(cyl, head)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to seek: %w", err)}
+	}
+
+	decoded, err := c.capture()
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to read flux data: %w", err)}
+	}
+	err = adapter.CheckIndex(decoded)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+	}
+
+	// Calculate RPM and BitRate of the track, unless given by user
+	if r.single {
+		r.rpm, r.bitRate = adapter.ReadOpts.TrackRates(decoded)
+	} else {
+		r.rpm, r.bitRate = r.rates.Rates(decoded)
+	}
+
+	// Pass flux transitions of the first revolution for analysis
+	if adapter.AnalysisEnabled() {
+		if revs := decoded.Revolutions(); len(revs) > 0 {
+			adapter.ReportFlux(cyl, head, revs[0].Transitions)
+		}
+	}
+
+	// Decode flux data to MFM bitstream
+	mfmBitstream, adjust, err := r.recovery.DecodeMFM(decoded, r.bitRate)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to decode flux data to MFM: %w", err)}
+	}
+	if !r.single {
+		r.rates.Add(cyl, head, decoded)
+	}
+	if adjust != 0 {
+		fmt.Printf("\nWarning: track %d, side %d: decoded at %+.1f%% bit rate\n", cyl, head, adjust*100)
+	}
+	if r.recovery.Weak {
+		fmt.Printf("\nWarning: track %d, side %d: weak PLL lock, phase error %.1f%% RMS at %.0f ns period\n",
+			cyl, head, r.recovery.Lock.LockQuality*100, r.recovery.Lock.PeriodNs)
+	}
+
+	// Flux of the first capture is kept, even when verified with new captures
+	capture := &adapter.TrackCapture{
+		Cyl:     cyl,
+		Head:    head,
+		BitRate: r.bitRate,
+		RPM:     r.rpm,
+		Flux:    decoded,
+		Lock:    r.recovery.Lock,
+	}
+
+	// Verify the track with other revolutions of the capture, then with new captures
+	if adapter.ReadOpts.Verify {
+		rev := 0
+		mfmBitstream, err = r.verifier.Track(cyl, head, mfmBitstream, func() ([]byte, error) {
+			rev++
+			if rev < len(decoded.Revolutions()) {
+				return r.recovery.DecodeRevolutionMFM(decoded, rev, r.bitRate, adjust)
+			}
+			decoded, err = c.capture()
+			if err != nil {
+				return nil, err
+			}
+			rev = 0
+			return r.recovery.DecodeRevolutionMFM(decoded, 0, r.bitRate, adjust)
+		})
+		if err != nil {
+			return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+		}
+	}
+
+	// Pass alignment of sectors to the index for analysis
+	adapter.ReportLayout(cyl, head, mfmBitstream, r.bitRate)
+	capture.MFM, capture.Index = adapter.RevolutionMFM(mfmBitstream, r.bitRate, r.rpm)
+	r.weak.Detect(capture)
+	r.locks.Add(capture)
+	return capture, nil
+}
+
+// Synthesize flux of the track under the head, for all revolutions,
+// with imperfections requested by options
+func (c *Client) capture() (*flux.FluxTrack, error) {
+	if c.options.NoDisk {
+		return nil, fmt.Errorf("no flux data: %w", adapter.ErrNoIndex)
+	}
+	track := [2]int{c.cyl, c.head}
+	c.reads[track]++
+	read := c.reads[track]
+	for _, f := range c.options.FailedReads {
+		if f.Cyl == c.cyl && f.Head == c.head && read <= f.Reads {
+			return nil, fmt.Errorf("simulated read failure %d of %d: %w", read, f.Reads, adapter.ErrOverflow)
+		}
+	}
+
+	// Flux of one revolution, starting at the index pulse.
+	// Revolutions differ by jitter and weak bits.
+	bitRate := c.trackBitRate(c.cyl)
+	bits := c.trackBits(c.cyl, c.head, read)
+	weak := c.weakMask(c.cyl, c.head, len(bits), bitRate)
+	revolution := c.synthesize(bits, bitRate, 1)
+
+	periodNs := c.revolutionNs()
+	revs := adapter.ReadOpts.TrackRevolutions(int(c.options.Revolutions))
+	result := &flux.FluxTrack{
+		Transitions:   make([]uint64, 0, len(revolution)*revs),
+		IndexPulses:   []uint64{0},
+		SampleClockHz: simSampleClockHz,
+	}
+	for rev := 0; rev < revs; rev++ {
+		seed := int64(((c.cyl*2+c.head)*1000+read)*maxRevolutions + rev)
+		if weak != nil {
+			revolution = c.synthesize(randomizeWeak(bits, weak, seed), bitRate, seed)
+		} else if rev > 0 && c.options.JitterNs > 0 {
+			revolution = c.synthesize(bits, bitRate, seed)
+		}
+		start := uint64(rev) * periodNs
+		for _, t := range revolution {
+			result.Transitions = append(result.Transitions, start+t)
+		}
+		result.IndexPulses = append(result.IndexPulses, start+periodNs)
+	}
+	return result, nil
+}
+
+// Flux transitions of one revolution with the given MFM bitcells,
+// starting at the index pulse, with jitter from the given seed
+func (c *Client) synthesize(bits []byte, bitRate uint16, seed int64) []uint64 {
+	intervals := flux.SynthesizeFluxSeed(bits, bitRate, c.options.JitterNs, c.options.SpeedError, seed)
+	revolution := c.fillRevolution(mfm.IntervalsToTransitions(intervals), bitRate)
+	return c.dropout(revolution)
+}
+
+// MFM bitcells of the track as recorded on the disk, with bad sectors
+// injected for the given read. Missing track reads as unformatted.
+func (c *Client) trackBits(cyl, head, read int) []byte {
+	var bits []byte
+	if cyl < len(c.disk.Tracks) && head < max(int(c.disk.Header.NumberOfSide), 1) {
+		if head == 0 {
+			bits = c.disk.Tracks[cyl].Side0
+		} else {
+			bits = c.disk.Tracks[cyl].Side1
+		}
+	}
+	if len(bits) == 0 {
+		// Clock bits only: no sectors are found
+		n := hfe.RevolutionBits(c.trackBitRate(cyl), c.nominalRPM()) / 8
+		return bytes.Repeat([]byte{0xaa}, n)
+	}
+
+	bits = bytes.Clone(bits)
+	for _, bad := range c.options.BadSectors {
+		if bad.Cyl == cyl && bad.Head == head && (bad.Reads == 0 || read <= bad.Reads) {
+			corruptSector(bits, cyl, head, bad.Sector)
+		}
+	}
+	return bits
+}
+
+// Weak mask of the track under the head: weak bits of the disk image,
+// and weak regions of options. Returns nil when the track has none.
+func (c *Client) weakMask(cyl, head, n int, bitRate uint16) []byte {
+	var regions []hfe.WeakRegion
+	if cyl < len(c.disk.Tracks) && head < 2 {
+		mask := c.disk.Tracks[cyl].WeakBits[head]
+		if len(mask) == n {
+			regions = hfe.WeakRegions(mask)
+		}
+	}
+	cellNs := float64(mfm.CellPeriodNs(bitRate)) / (1 + c.options.SpeedError)
+	for _, w := range c.options.WeakRegions {
+		if w.Cyl == cyl && w.Head == head {
+			start := int(float64(w.Start.Nanoseconds()) / cellNs)
+			end := int(float64((w.Start + w.Length).Nanoseconds()) / cellNs)
+			regions = append(regions, hfe.WeakRegion{Start: start, End: end})
+		}
+	}
+	return hfe.NewWeakMask(n, regions)
+}
+
+// Copy of MFM bitcells with weak ones replaced by random data bits
+// of valid MFM, from random source with the given seed
+func randomizeWeak(bits, weak []byte, seed int64) []byte {
+	rng := rand.New(rand.NewSource(seed))
+	bits = bytes.Clone(bits)
+	for _, r := range hfe.WeakRegions(weak) {
+		for pos := r.Start; pos+1 < r.End; pos += 2 {
+			data := rng.Intn(2) == 1
+			setCell(bits, pos+1, data)
+			setCell(bits, pos, !cell(bits, pos-1) && !data)
+		}
+	}
+	return bits
+}
+
+// Cut transitions of one revolution to its duration, or fill the rest
+// of the revolution past the end of track data with clock bits
+func (c *Client) fillRevolution(transitions []uint64, bitRate uint16) []uint64 {
+	periodNs := c.revolutionNs()
+	for len(transitions) > 0 && transitions[len(transitions)-1] >= periodNs {
+		transitions = transitions[:len(transitions)-1]
+	}
+	stepNs := uint64(float64(2*mfm.CellPeriodNs(bitRate)) / (1 + c.options.SpeedError))
+	t := uint64(0)
+	if len(transitions) > 0 {
+		t = transitions[len(transitions)-1]
+	}
+	for t+stepNs < periodNs {
+		t += stepNs
+		transitions = append(transitions, t)
+	}
+	return transitions
+}
+
+// Remove transitions inside dropout regions of the track under the head
+func (c *Client) dropout(transitions []uint64) []uint64 {
+	for _, d := range c.options.Dropouts {
+		if d.Cyl != c.cyl || d.Head != c.head {
+			continue
+		}
+		start := uint64(d.Start.Nanoseconds())
+		end := start + uint64(d.Length.Nanoseconds())
+		kept := transitions[:0]
+		for _, t := range transitions {
+			if t < start || t >= end {
+				kept = append(kept, t)
+			}
+		}
+		transitions = kept
+	}
+	return transitions
+}
+
+// Invert the first data bit of every instance of the given sector,
+// so that its data CRC does not match. Clock bits around it are
+// recomputed, to keep the MFM encoding valid.
+func corruptSector(bits []byte, cyl, head, sector int) {
+	reader := mfm.NewReader(bits)
+	reader.Tolerance = mfm.IDIgnoreCylHead
+	for {
+		s, err := reader.ReadSectorInfoIBMPC(cyl, head)
+		if err != nil {
+			return
+		}
+		if s.Sector != sector {
+			continue
+		}
+
+		// Data bit is the second cell of every pair
+		pos := s.DataBitPos + 1
+		setCell(bits, pos, !cell(bits, pos))
+		for _, clock := range []int{pos - 1, pos + 1} {
+			setCell(bits, clock, !cell(bits, clock-1) && !cell(bits, clock+1))
+		}
+	}
+}
+
+// Value of MFM cell at the given bit position, MSB-first
+func cell(bits []byte, pos int) bool {
+	if pos < 0 || pos >= len(bits)*8 {
+		return false
+	}
+	return bits[pos/8]&(0x80>>(pos%8)) != 0
+}
+
+// Set value of MFM cell at the given bit position, MSB-first
+func setCell(bits []byte, pos int, value bool) {
+	if pos < 0 || pos >= len(bits)*8 {
+		return
+	}
+	if value {
+		bits[pos/8] |= 0x80 >> (pos % 8)
+	} else {
+		bits[pos/8] &^= 0x80 >> (pos % 8)
+	}
+}
@@ -0,0 +1,248 @@
+// Package sim implements a simulated floppy adapter, which reads and writes
+// a disk image in memory instead of a real diskette. Flux of every track is
+// synthesized from the image, and decoded the same way as flux captured by
+// hardware adapters. It allows to develop and test without a device at hand.
+package sim
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/hfe"
+)
+
+// Client is a simulated drive with a disk image inserted
+type Client struct {
+	disk     *hfe.Disk     // Contents of the simulated disk
+	filename string        // Image file the disk was loaded from, if any
+	options  Options       // Imperfections and timing of the drive
+	busy     adapter.Busy  // One operation at a time
+	motor    adapter.Motor // Left running between operations, see startMotor
+
+	cyl   int            // Current position of the head
+	head  int            // Selected side
+	reads map[[2]int]int // Number of reads of every track, by cylinder and side
+}
+
+func init() {
+	adapter.RegisterSimulator(NewClient)
+}
+
+// NewClient creates a simulated adapter with the disk from the given image file.
+// Any format supported by hfe.Read is accepted.
+func NewClient(filename string) (adapter.FloppyAdapter, error) {
+	disk, err := hfe.Read(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image %s: %w", filename, err)
+	}
+	client := New(disk)
+	client.filename = filename
+	return client, nil
+}
+
+// New creates a simulated adapter with the given disk inserted.
+// The disk is modified by writes to the adapter.
+func New(disk *hfe.Disk) *Client {
+	c := &Client{
+		disk:    disk,
+		options: DefaultOptions,
+		reads:   make(map[[2]int]int),
+	}
+	c.busy.Motor = &c.motor
+	return c
+}
+
+// Image returns contents of the simulated disk
+func (c *Client) Image() *hfe.Disk {
+	return c.disk
+}
+
+// Turn on the motor, unless it is left running by the previous operation
+func (c *Client) startMotor() {
+	if c.motor.Running() {
+		return
+	}
+	sleep(c.spinUpDelay())
+	c.motor.SetRunning(true)
+}
+
+// StopMotor turns off the motor left running after the last operation
+func (c *Client) StopMotor() error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+	return c.motor.Off()
+}
+
+// Move the head to the given cylinder, and select the side
+func (c *Client) seek(cyl, head int) error {
+	if cyl < 0 || cyl > 255 {
+		return fmt.Errorf("invalid cylinder %d", cyl)
+	}
+	if head < 0 || head > 1 {
+		return fmt.Errorf("invalid head %d", head)
+	}
+	if cyl != c.cyl {
+		steps := cyl - c.cyl
+		if steps < 0 {
+			steps = -steps
+		}
+		sleep(time.Duration(steps)*c.stepDelay() + c.settleDelay())
+		c.cyl = cyl
+	}
+	c.head = head
+	return nil
+}
+
+// Wait for the drive mechanics, unless the delay is zeroed
+func sleep(d time.Duration) {
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Rotation speed of the disk in the image, RPM
+func (c *Client) nominalRPM() uint16 {
+	switch {
+	case c.disk.Header.FloppyRPM != 0:
+		return c.disk.Header.FloppyRPM
+	case config.RPM != 0:
+		return uint16(config.RPM)
+	}
+	return 300
+}
+
+// Duration of one revolution of the simulated drive, in nanoseconds
+func (c *Client) revolutionNs() uint64 {
+	return uint64(60e9 / float64(c.nominalRPM()) / (1 + c.options.SpeedError))
+}
+
+// Bit rate of the track in kbps, 250 when unknown
+func (c *Client) trackBitRate(cyl int) uint16 {
+	if bitRate := c.disk.TrackBitRate(cyl); bitRate != 0 {
+		return bitRate
+	}
+	return 250
+}
+
+// Format is not supported: disks are formatted by writing an image
+func (c *Client) Format() error {
+	return fmt.Errorf("format %w", adapter.ErrNotSupported)
+}
+
+// Capabilities reports what the simulated adapter can do
+func (c *Client) Capabilities() adapter.Capability {
+	return adapter.Capability{
+		CanRead:            true,
+		CanWrite:           true,
+		CanWriteFlux:       true,
+		CanErase:           true,
+		MaxRevolutions:     maxRevolutions,
+		SensesDiskChange:   true,
+		SensesWriteProtect: true,
+		MaxCylinders:       config.MaxCyls,
+	}
+}
+
+// Calibrate verifies the track 0 sensor,
+// and times a full-stroke seek to the last track and back.
+func (c *Client) Calibrate() error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	c.startMotor()
+	err := c.seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek to track 0: %w", err)
+	}
+
+	// Long seek to the last track and back
+	maxCyl := config.Cyls - 1
+	start := time.Now()
+	err = c.seek(maxCyl, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek to track %d: %w", maxCyl, err)
+	}
+	err = c.seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to return to track 0: %w", err)
+	}
+	fmt.Printf("Seek Time: %d msec for %d tracks and back\n", time.Since(start).Milliseconds(), maxCyl)
+	return nil
+}
+
+// MeasureRPM measures rotation speed over the given number of revolutions.
+// Returns mean speed and its standard deviation, in RPM.
+func (c *Client) MeasureRPM(revolutions int) (float64, float64, error) {
+	if err := c.busy.Begin(); err != nil {
+		return 0, 0, err
+	}
+	defer c.busy.End()
+
+	if revolutions < 1 {
+		return 0, 0, fmt.Errorf("invalid number of revolutions: %d", revolutions)
+	}
+	if c.options.NoDisk {
+		return 0, 0, adapter.ErrNoIndex
+	}
+	c.startMotor()
+	periods := make([]float64, revolutions)
+	for i := range periods {
+		periods[i] = float64(c.revolutionNs())
+	}
+	return adapter.RPMStats(periods)
+}
+
+// DiskPresent reports whether a disk is inserted
+func (c *Client) DiskPresent() (bool, error) {
+	return !c.options.NoDisk, nil
+}
+
+// IsWriteProtected reports whether the disk is write protected
+func (c *Client) IsWriteProtected() (bool, error) {
+	return c.options.WriteProtected, nil
+}
+
+// Before writing: fail when no disk is inserted, or it is write protected
+func (c *Client) checkWritable() error {
+	return adapter.CheckWritable(c.DiskPresent, c.IsWriteProtected)
+}
+
+// Describe returns identification of the adapter for image manifest
+func (c *Client) Describe() hfe.ManifestDevice {
+	return hfe.ManifestDevice{
+		Adapter: "Simulator",
+	}
+}
+
+// PrintStatus prints status of the simulated drive to stdout
+func (c *Client) PrintStatus() {
+	if err := c.busy.Begin(); err != nil {
+		fmt.Printf("Status unavailable: %v\n", err)
+		return
+	}
+	defer c.busy.End()
+
+	fmt.Printf("Simulated Adapter\n")
+	if c.filename != "" {
+		fmt.Printf("Image File: %s\n", filepath.Base(c.filename))
+	}
+	if c.options.NoDisk {
+		fmt.Printf("Floppy Disk: Not inserted\n")
+		return
+	}
+	fmt.Printf("Floppy Disk: Inserted\n")
+	fmt.Printf("Tracks: %d, Sides: %d\n", len(c.disk.Tracks), c.disk.Header.NumberOfSide)
+	fmt.Printf("Rotation Speed: %d RPM\n", c.nominalRPM())
+	if c.options.WriteProtected {
+		fmt.Printf("Write Protected: Yes\n")
+	} else {
+		fmt.Printf("Write Protected: No\n")
+	}
+}
@@ -0,0 +1,428 @@
+package sim
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+)
+
+// Sample image: 40 cylinders, 2 sides, 9 sectors per track
+const sampleImage = "../images/fat360.imd"
+
+// Create simulator with the sample disk, and no delays
+func newTestClient(t *testing.T, opts Options) (*Client, *hfe.Disk) {
+	t.Helper()
+	cyls, heads := config.Cyls, config.Heads
+	t.Cleanup(func() { config.Cyls, config.Heads = cyls, heads })
+	config.Cyls, config.Heads = 40, 2
+
+	disk, err := hfe.Read(sampleImage)
+	if err != nil {
+		t.Fatalf("hfe.Read() error: %v", err)
+	}
+	c := New(disk.Clone())
+	if err := c.SetOptions(opts); err != nil {
+		t.Fatalf("SetOptions() error: %v", err)
+	}
+	t.Cleanup(func() { c.StopMotor() })
+	return c, disk
+}
+
+// Check that sectors of the disk match the sample
+func checkSectors(t *testing.T, want, got *hfe.Disk) {
+	t.Helper()
+	wantPrint, err := hfe.Fingerprint(want)
+	if err != nil {
+		t.Fatalf("Fingerprint() error: %v", err)
+	}
+	gotPrint, err := hfe.Fingerprint(got)
+	if err != nil {
+		t.Fatalf("Fingerprint() error: %v", err)
+	}
+	if gotPrint.SHA256 != wantPrint.SHA256 {
+		t.Errorf("sectors differ: %q", gotPrint.Diff(wantPrint))
+	}
+}
+
+// Decode sector of the captured track
+func readSector(t *testing.T, capture *adapter.TrackCapture, num int) *mfm.SectorIBMPC {
+	t.Helper()
+	reader := mfm.NewReader(capture.MFM)
+	for {
+		sector, err := reader.ReadSectorInfoIBMPC(capture.Cyl, capture.Head)
+		if err != nil {
+			t.Fatalf("sector %d not found", num)
+		}
+		if sector.Sector == num {
+			return sector
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"perfect", Options{Revolutions: 1}},
+		{"fast", Options{Revolutions: 2, JitterNs: 80, SpeedError: 0.015}},
+		{"slow", Options{Revolutions: 2, JitterNs: 80, SpeedError: -0.015}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, want := newTestClient(t, tc.opts)
+			disk, err := c.Read(40, nil)
+			if err != nil {
+				t.Fatalf("Read() error: %v", err)
+			}
+			if disk.Header.BitRate != 250 || disk.Header.FloppyRPM != 300 {
+				t.Errorf("bit rate %d, RPM %d", disk.Header.BitRate, disk.Header.FloppyRPM)
+			}
+			checkSectors(t, want, disk)
+		})
+	}
+}
+
+// Read of 82 cylinders reads every track 0-81 once, on both sides
+func TestRead_AllCylinders(t *testing.T) {
+	c, _ := newTestClient(t, Options{Revolutions: 1})
+	for cyl := 40; cyl < 82; cyl++ {
+		c.disk.Tracks = append(c.disk.Tracks, c.disk.Tracks[cyl-40])
+	}
+	c.disk.Header.NumberOfTrack = 82
+
+	disk, err := c.Read(82, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if len(disk.Tracks) != 82 || len(disk.Tracks[81].Side1) == 0 {
+		t.Errorf("read %d cylinders, expected 82", len(disk.Tracks))
+	}
+	for cyl := 0; cyl < 82; cyl++ {
+		for head := 0; head < 2; head++ {
+			if n := c.reads[[2]int{cyl, head}]; n != 1 {
+				t.Errorf("cylinder %d, side %d read %d times, expected once", cyl, head, n)
+			}
+		}
+	}
+	if len(c.reads) != 82*2 {
+		t.Errorf("read %d tracks, expected %d", len(c.reads), 82*2)
+	}
+}
+
+func TestReadTrack_BadSector(t *testing.T) {
+	c, _ := newTestClient(t, Options{
+		Revolutions: 1,
+		BadSectors:  []BadSector{{Cyl: 3, Head: 1, Sector: 5}},
+	})
+	for read := 0; read < 2; read++ {
+		capture, err := c.ReadTrack(3, 1)
+		if err != nil {
+			t.Fatalf("ReadTrack() error: %v", err)
+		}
+		if !readSector(t, capture, 5).Bad {
+			t.Errorf("read %d: sector 5 is good, expected bad CRC", read)
+		}
+		if readSector(t, capture, 4).Bad {
+			t.Errorf("read %d: sector 4 is bad", read)
+		}
+	}
+}
+
+func TestRead_VerifyRecovers(t *testing.T) {
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts.Verify = true
+
+	// Sector is bad in the first capture: both revolutions of it
+	c, _ := newTestClient(t, Options{
+		Revolutions: 2,
+		BadSectors:  []BadSector{{Cyl: 0, Head: 0, Sector: 2, Reads: 1}},
+	})
+	capture, err := c.ReadTrack(0, 0)
+	if err != nil {
+		t.Fatalf("ReadTrack() error: %v", err)
+	}
+	if readSector(t, capture, 2).Bad {
+		t.Errorf("sector 2 is bad after verification")
+	}
+	if c.reads[[2]int{0, 0}] != 2 {
+		t.Errorf("track captured %d times, expected 2", c.reads[[2]int{0, 0}])
+	}
+}
+
+func TestRead_FailedReads(t *testing.T) {
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts.Retries = 2
+	adapter.ReadOpts.EndTrack = 1
+
+	// Track 1.0 is read on the last retry, track 1.1 is given up
+	c, _ := newTestClient(t, Options{
+		Revolutions: 1,
+		FailedReads: []FailedRead{{Cyl: 1, Head: 0, Reads: 2}, {Cyl: 1, Head: 1, Reads: 3}},
+	})
+	disk, err := c.Read(40, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if n := mfm.NewReader(disk.Tracks[1].Side0).CountSectorsIBMPC(); n != 9 {
+		t.Errorf("track 1, side 0: %d sectors read, expected 9", n)
+	}
+	if len(disk.Tracks[1].Side1) != 0 {
+		t.Errorf("track 1, side 1 is read, expected failure")
+	}
+	if c.reads[[2]int{1, 1}] != 3 {
+		t.Errorf("track 1, side 1 read %d times, expected 3", c.reads[[2]int{1, 1}])
+	}
+}
+
+func TestRead_Dropout(t *testing.T) {
+	// No flux for 20 msec: two sectors or so are lost
+	c, _ := newTestClient(t, Options{
+		Revolutions: 1,
+		Dropouts:    []Dropout{{Cyl: 2, Head: 0, Start: 60 * time.Millisecond, Length: 20 * time.Millisecond}},
+	})
+	capture, err := c.ReadTrack(2, 0)
+	if err != nil {
+		t.Fatalf("ReadTrack() error: %v", err)
+	}
+	if n := mfm.NewReader(capture.MFM).CountSectorsIBMPC(); n >= 9 || n < 5 {
+		t.Errorf("%d sectors found, expected some lost", n)
+	}
+}
+
+func TestRead_WeakBits(t *testing.T) {
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts.StartTrack, adapter.ReadOpts.EndTrack, adapter.ReadOpts.Sides = 2, 3, "0"
+
+	// 4 msec of random flux on every revolution: 2000 bitcells at 250 kbps
+	c, want := newTestClient(t, Options{
+		Revolutions: 3,
+		JitterNs:    40,
+		WeakRegions: []WeakRegion{{Cyl: 3, Head: 0, Start: 50 * time.Millisecond, Length: 4 * time.Millisecond}},
+	})
+	filename := filepath.Join(t.TempDir(), "weak.hfe")
+	w, err := hfe.NewWriter(filename, want.Header, hfe.HFEVersion3)
+	if err != nil {
+		t.Fatalf("NewWriter() error: %v", err)
+	}
+	disk, err := c.Read(40, w)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	if disk.Tracks[2].HasWeakBits() {
+		t.Errorf("weak bits found on track 2: %v", hfe.WeakRegions(disk.Tracks[2].WeakBits[0]))
+	}
+
+	// Detected region is the injected one, in bit positions from sector 1
+	track := &disk.Tracks[3]
+	start := (25000 + track.IndexBitOffset[0]) % (len(track.Side0) * 8)
+	regions := hfe.WeakRegions(track.WeakBits[0])
+	if len(regions) != 1 || regions[0].Start < start || regions[0].Start > start+32 ||
+		regions[0].End > start+2000 || regions[0].End < start+2000-32 {
+		t.Fatalf("weak regions %v, expected one at %d-%d", regions, start, start+2000)
+	}
+
+	// Weak bits are kept in HFE v3 image
+	read, err := hfe.Read(filename)
+	if err != nil {
+		t.Fatalf("hfe.Read() error: %v", err)
+	}
+	if !read.Tracks[3].HasWeakBits() || read.Tracks[2].HasWeakBits() {
+		t.Errorf("weak bits of image: track 2 %v, track 3 %v, expected only track 3",
+			hfe.WeakRegions(read.Tracks[2].WeakBits[0]), hfe.WeakRegions(read.Tracks[3].WeakBits[0]))
+	}
+}
+
+func TestRead_NoWeakBits(t *testing.T) {
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts.EndTrack = 19
+
+	// Independent jitter on every revolution of an ordinary disk
+	c, _ := newTestClient(t, Options{Revolutions: 3, JitterNs: 150})
+	disk, err := c.Read(40, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	for cyl := 0; cyl < 20; cyl++ {
+		if disk.Tracks[cyl].HasWeakBits() {
+			t.Errorf("weak bits found on cylinder %d: %v, %v", cyl,
+				hfe.WeakRegions(disk.Tracks[cyl].WeakBits[0]), hfe.WeakRegions(disk.Tracks[cyl].WeakBits[1]))
+		}
+	}
+
+	// Image keeps every sector read
+	filename := filepath.Join(t.TempDir(), "jitter.hfe")
+	if err := hfe.Write(filename, disk); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	read, err := hfe.Read(filename)
+	if err != nil {
+		t.Fatalf("hfe.Read() error: %v", err)
+	}
+	for cyl := 0; cyl < 20; cyl++ {
+		for head := 0; head < 2; head++ {
+			got, kept := disk.Tracks[cyl].Side0, read.Tracks[cyl].Side0
+			if head == 1 {
+				got, kept = disk.Tracks[cyl].Side1, read.Tracks[cyl].Side1
+			}
+			n := hfe.DecodeTrack(got, cyl, head).GoodSectors()
+			if k := hfe.DecodeTrack(kept, cyl, head).GoodSectors(); k != n {
+				t.Errorf("cylinder %d, side %d: %d good sectors in image, %d read", cyl, head, k, n)
+			}
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	c, want := newTestClient(t, Options{Revolutions: 1})
+
+	// Erased disk is written back from the sample
+	if err := c.Erase(40); err != nil {
+		t.Fatalf("Erase() error: %v", err)
+	}
+	capture, err := c.ReadTrack(0, 0)
+	if err != nil {
+		t.Fatalf("ReadTrack() error: %v", err)
+	}
+	if n := mfm.NewReader(capture.MFM).CountSectorsIBMPC(); n != 0 {
+		t.Errorf("%d sectors found on erased track", n)
+	}
+	if err := c.Write(want, 40); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	checkSectors(t, want, c.Image())
+
+	disk, err := c.Read(40, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	checkSectors(t, want, disk)
+}
+
+func TestWrite_Protected(t *testing.T) {
+	c, want := newTestClient(t, Options{Revolutions: 1, WriteProtected: true})
+	if err := c.Write(want, 40); !errors.Is(err, adapter.ErrWriteProtected) {
+		t.Errorf("Write() error %v, expected write protected", err)
+	}
+	if err := c.Erase(40); !errors.Is(err, adapter.ErrWriteProtected) {
+		t.Errorf("Erase() error %v, expected write protected", err)
+	}
+
+	c.options.WriteProtected, c.options.NoDisk = false, true
+	if err := c.Write(want, 40); !errors.Is(err, adapter.ErrNoDisk) {
+		t.Errorf("Write() error %v, expected no disk", err)
+	}
+}
+
+func TestWrite_ReadOnlyImage(t *testing.T) {
+	c, want := newTestClient(t, Options{Revolutions: 1})
+	if err := c.Erase(40); err != nil {
+		t.Fatalf("Erase() error: %v", err)
+	}
+
+	// Image marked as write protected is refused, and the disk is left as is
+	master := want.Clone()
+	master.SetWriteProtect(true)
+	if err := c.Write(master, 40); !errors.Is(err, adapter.ErrImageReadOnly) {
+		t.Fatalf("Write() error %v, expected read-only image", err)
+	}
+	if len(c.Image().Tracks[0].Side0) != 0 {
+		t.Errorf("track 0 written from read-only image")
+	}
+
+	defer func(force bool) { adapter.WriteOpts.Force = force }(adapter.WriteOpts.Force)
+	adapter.WriteOpts.Force = true
+	if err := c.Write(master, 40); err != nil {
+		t.Fatalf("Write() with Force error: %v", err)
+	}
+	checkSectors(t, want, c.Image())
+}
+
+func TestWriteTrackFlux(t *testing.T) {
+	c, want := newTestClient(t, Options{Revolutions: 1})
+	config.RPM = 300
+	defer func() { config.RPM = 0 }()
+
+	// Flux of track 5.1 is written to track 6.0
+	intervals, err := mfm.FluxIntervals(want.Tracks[5].Side1, mfm.CellPeriodNs(250), nil, 5)
+	if err != nil {
+		t.Fatalf("FluxIntervals() error: %v", err)
+	}
+	if err := c.WriteTrackFlux(6, 0, intervals, true); err != nil {
+		t.Fatalf("WriteTrackFlux() error: %v", err)
+	}
+	capture, err := c.ReadTrack(6, 0)
+	if err != nil {
+		t.Fatalf("ReadTrack() error: %v", err)
+	}
+	sector := readSector(t, &adapter.TrackCapture{Cyl: 5, Head: 1, MFM: capture.MFM}, 1)
+	if sector.Bad || sector.Cylinder != 5 || sector.Head != 1 {
+		t.Errorf("sector %+v", sector)
+	}
+}
+
+func TestSeekAndMotor(t *testing.T) {
+	c, _ := newTestClient(t, Options{
+		Revolutions: 1,
+		StepDelay:   time.Millisecond,
+		SpinUpDelay: 10 * time.Millisecond,
+	})
+
+	start := time.Now()
+	if err := c.Calibrate(); err != nil {
+		t.Fatalf("Calibrate() error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 88*time.Millisecond {
+		t.Errorf("calibration took %v, expected spin-up and 78 steps", elapsed)
+	}
+	if !c.motor.Running() || c.cyl != 0 {
+		t.Errorf("motor running %v, cylinder %d", c.motor.Running(), c.cyl)
+	}
+
+	mean, stddev, err := c.MeasureRPM(3)
+	if err != nil || mean < 299.9 || mean > 300.1 || stddev != 0 {
+		t.Errorf("MeasureRPM() = %v, %v, %v", mean, stddev, err)
+	}
+	if err := c.StopMotor(); err != nil || c.motor.Running() {
+		t.Errorf("StopMotor() error %v, running %v", err, c.motor.Running())
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	c := New(&hfe.Disk{})
+	for _, opts := range []Options{
+		{Revolutions: 0},
+		{Revolutions: 6},
+		{Revolutions: 1, JitterNs: -1},
+		{Revolutions: 1, SpeedError: 0.5},
+		{Revolutions: 1, StepDelay: -time.Millisecond},
+	} {
+		if err := c.SetOptions(opts); err == nil {
+			t.Errorf("SetOptions(%+v) accepted", opts)
+		}
+	}
+	if err := c.SetOptions(DefaultOptions); err != nil {
+		t.Errorf("SetOptions(DefaultOptions) error: %v", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	var _ adapter.FloppyAdapter = (*Client)(nil)
+
+	c, _ := newTestClient(t, DefaultOptions)
+	caps := c.Capabilities()
+	if !caps.CanRead || !caps.CanWrite || !caps.CanErase || caps.CanFormat || caps.MaxRevolutions != 5 {
+		t.Errorf("Capabilities() = %+v", caps)
+	}
+	if err := c.Format(); !errors.Is(err, adapter.ErrNotSupported) {
+		t.Errorf("Format() error = %v, expected not supported", err)
+	}
+}
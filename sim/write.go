@@ -0,0 +1,176 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/flux"
+	"github.com/sergev/floppy/hfe"
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Shortest flux interval accepted for raw flux writes, nsec
+const minWriteFluxNs = 400
+
+// Write writes data from the disk object to the floppy disk
+func (c *Client) Write(disk *hfe.Disk, numberOfCylinders int) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	err := adapter.WriteOpts.CheckImage(disk)
+	if err != nil {
+		return err
+	}
+	c.startMotor()
+	err = c.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	for cyl := 0; cyl < numberOfCylinders; cyl++ {
+		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
+			fmt.Printf("\r  Writing track %d, side %d...", cyl, head)
+			err = c.seek(cyl, head)
+			if err != nil {
+				return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to seek: %w", err)}
+			}
+
+			var mfmBits []byte
+			if cyl < len(disk.Tracks) {
+				track := disk.Tracks[cyl].FromIndex()
+				if head == 0 {
+					mfmBits = track.Side0
+				} else {
+					mfmBits = track.Side1
+				}
+			}
+			c.store(cyl, head, mfmBits, disk.TrackBitRate(cyl), disk.Header.FloppyRPM)
+
+			if disk.MustVerify() {
+				fmt.Printf("\rVerifying track %d, side %d...", cyl, head)
+				decoded, err := c.capture()
+				if err != nil {
+					return &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+				}
+				bitsResult, err := decoded.DecodeMFM(disk.TrackBitRate(cyl), pll.Config{})
+				if err != nil {
+					return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to decode flux data to MFM: %w", err)}
+				}
+				err = disk.VerifyTrack(cyl, head, bitsResult)
+				if err != nil {
+					return &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+				}
+			}
+		}
+	}
+	fmt.Printf("\nWrite complete.\n")
+
+	return nil
+}
+
+// Write raw flux to one track.
+// Transitions are intervals between flux reversals, in nanoseconds.
+// Flux is recorded as MFM bitcells at bit rate of the disk,
+// and always starts at the index pulse.
+func (c *Client) WriteTrackFlux(cyl, head int, transitions []uint64, cueToIndex bool) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	err := adapter.CheckFluxIntervals(transitions, minWriteFluxNs)
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+	}
+
+	c.startMotor()
+	err = c.checkWritable()
+	if err != nil {
+		return err
+	}
+	err = c.seek(cyl, head)
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to seek: %w", err)}
+	}
+
+	times := mfm.IntervalsToTransitions(transitions)
+	track := &flux.FluxTrack{
+		Transitions:   times,
+		IndexPulses:   []uint64{0, times[len(times)-1]},
+		SampleClockHz: simSampleClockHz,
+	}
+	bitRate := c.trackBitRate(cyl)
+	mfmBits, err := track.DecodeMFM(bitRate, pll.Config{})
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to decode flux data to MFM: %w", err)}
+	}
+	c.store(cyl, head, mfmBits, bitRate, c.nominalRPM())
+	return nil
+}
+
+// Erase erases the floppy disk
+func (c *Client) Erase(numberOfCylinders int) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	c.startMotor()
+	err := c.checkWritable()
+	if err != nil {
+		return err
+	}
+	for cyl := 0; cyl < numberOfCylinders; cyl++ {
+		for head := 0; head < config.Heads; head++ {
+			fmt.Printf("\rErasing cylinder %d, side %d...", cyl, head)
+			err = c.seek(cyl, head)
+			if err != nil {
+				return fmt.Errorf("failed to seek to cylinder %d: %w", cyl, err)
+			}
+			c.store(cyl, head, nil, 0, 0)
+		}
+	}
+	fmt.Printf("\nErase complete.\n")
+
+	return nil
+}
+
+// Record bitcells of a track on the simulated disk, which grows
+// to include it. Bit rate and RPM are taken for the disk when unknown;
+// otherwise a different bit rate is kept for the track.
+func (c *Client) store(cyl, head int, mfmBits []byte, bitRate, rpm uint16) {
+	disk := c.disk
+	for len(disk.Tracks) <= cyl {
+		disk.Tracks = append(disk.Tracks, hfe.TrackData{})
+	}
+	if len(disk.Tracks) > int(disk.Header.NumberOfTrack) {
+		disk.Header.NumberOfTrack = uint8(len(disk.Tracks))
+	}
+	if head >= int(disk.Header.NumberOfSide) {
+		disk.Header.NumberOfSide = uint8(head + 1)
+	}
+	if disk.Header.BitRate == 0 {
+		disk.Header.BitRate = bitRate
+	}
+	if disk.Header.FloppyRPM == 0 {
+		disk.Header.FloppyRPM = rpm
+	}
+
+	track := &disk.Tracks[cyl]
+	if bitRate != 0 {
+		track.BitRate = 0
+		if bitRate != disk.Header.BitRate {
+			track.BitRate = bitRate
+		}
+	}
+	if head == 0 {
+		track.Side0 = bytes.Clone(mfmBits)
+	} else {
+		track.Side1 = bytes.Clone(mfmBits)
+	}
+}
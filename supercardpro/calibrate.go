@@ -0,0 +1,42 @@
+package supercardpro
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sergev/floppy/config"
+)
+
+// Calibrate verifies the track 0 sensor,
+// and times a full-stroke seek to the last track and back.
+func (c *Client) Calibrate() error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	err := c.selectDrive(c.options.Drive)
+	if err != nil {
+		return fmt.Errorf("failed to select drive: %w", err)
+	}
+
+	// SEEK0 fails when TRK0 is not detected
+	err = c.seekTrack(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek to track 0: %w", err)
+	}
+
+	// Long seek to the last track and back
+	maxCyl := config.Cyls - 1
+	start := time.Now()
+	err = c.seekTrack(maxCyl, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek to track %d: %w", maxCyl, err)
+	}
+	err = c.seekTrack(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to return to track 0: %w", err)
+	}
+	fmt.Printf("Seek Time: %d msec for %d tracks and back\n", time.Since(start).Milliseconds(), maxCyl)
+	return nil
+}
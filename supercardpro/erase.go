@@ -1,7 +1,6 @@
 package supercardpro
 
 import (
-	"encoding/binary"
 	"fmt"
 
 	"github.com/sergev/floppy/config"
@@ -9,8 +8,8 @@ import (
 
 // Generate minimal flux data for one revolution
 // Assume 300 RPM (250 kbps) drive speed
-// Return flux data as uint16 samples (big-endian) suitable for erase operation
-func (c *Client) generateEraseFlux() []byte {
+// Return flux cells suitable for erase operation
+func (c *Client) generateEraseFlux() []uint16 {
 	// For 300 RPM: 1 revolution = 0.2 seconds = 200,000,000 nanoseconds
 	// IndexTime in 25ns units = 200,000,000 / 25 = 8,000,000
 	const indexTime = uint32(8000000) // 300 RPM in 25ns units
@@ -24,55 +23,58 @@ func (c *Client) generateEraseFlux() []byte {
 
 	// Generate flux data: simple pattern of intervals
 	// For erase, we just need enough data - the exact pattern doesn't matter
-	fluxData := make([]byte, int(nrSamples)*2)
-	for i := uint32(0); i < nrSamples; i++ {
-		// Write interval as big-endian uint16
-		binary.BigEndian.PutUint16(fluxData[i*2:(i+1)*2], intervalSize)
+	fluxData := make([]uint16, nrSamples)
+	for i := range fluxData {
+		fluxData[i] = intervalSize
 	}
 
 	return fluxData
 }
 
 // Erase erases the floppy disk
-func (c *Client) Erase(numberOfTracks int) error {
-	// Select drive 0 and turn on motor
-	err := c.selectDrive(0)
+func (c *Client) Erase(numberOfCylinders int) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	// Select the drive and turn on motor
+	err := c.selectDrive(c.options.Drive)
 	if err != nil {
 		return fmt.Errorf("failed to select drive: %w", err)
 	}
-	defer c.deselectDrive(0)
+	err = c.checkWritable()
+	if err != nil {
+		return err
+	}
 
 	// Generate minimal flux data for one revolution (assumes 300 RPM / 250 kbps)
 	flux := c.generateEraseFlux()
-	nrSamples := uint32(len(flux) / 2)
 
 	// Load flux data into RAM once (same data used for all tracks)
-	err = c.loadRAM(flux)
+	err = c.uploadFlux(flux)
 	if err != nil {
 		return fmt.Errorf("failed to load flux data: %w", err)
 	}
 
-	// Erase all tracks
-	maxTrack := uint(numberOfTracks * config.Heads)
+	// Erase all cylinders and heads
+	for cyl := 0; cyl < numberOfCylinders; cyl++ {
+		for head := 0; head < config.Heads; head++ {
+			// Print progress
+			fmt.Printf("\rErasing cylinder %d, side %d...", cyl, head)
 
-	for track := uint(0); track < maxTrack; track++ {
-		cyl := track >> 1
-		side := track & 1
-
-		// Print progress
-		fmt.Printf("\rErasing cylinder %d, side %d...", cyl, side)
-
-		// Seek to track
-		err = c.seekTrack(track)
-		if err != nil {
-			return fmt.Errorf("failed to seek to track %d: %w", track, err)
-		}
+			// Seek to track
+			err = c.seekTrack(cyl, head)
+			if err != nil {
+				return fmt.Errorf("failed to seek to cylinder %d, side %d: %w", cyl, head, err)
+			}
 
-		// Write with wipe flag to erase the track (1 revolution for faster erase)
-		// Note: Flux data is already loaded in RAM from the initial loadRAM call
-		err = c.writeFlux(nrSamples, 1)
-		if err != nil {
-			return fmt.Errorf("failed to erase track %d: %w", track, err)
+			// Write with wipe flag to erase the track
+			// Note: Flux data is already loaded in RAM from the initial uploadFlux call
+			err = c.writeRAM(uint32(len(flux)), true)
+			if err != nil {
+				return fmt.Errorf("failed to erase cylinder %d, side %d: %w", cyl, head, err)
+			}
 		}
 	}
 	fmt.Printf("\nErase complete.\n")
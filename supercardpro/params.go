@@ -0,0 +1,100 @@
+package supercardpro
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sergev/floppy/config"
+)
+
+// Size of SETPARAMS data on the wire: five uint16 values
+const driveParamsSize = 10
+
+// DriveParams contains drive timing parameters (SCPCMD_SETPARAMS)
+type DriveParams struct {
+	SelectDelayUS   uint16 // Delay after drive select, usec
+	StepDelayUS     uint16 // Delay between head steps, usec
+	MotorDelayMS    uint16 // Motor spin-up time, msec
+	SeekSettleMS    uint16 // Head settle time after seek to track 0, msec
+	MotorOffDelayMS uint16 // Automatic motor off delay, msec
+}
+
+// Power-on defaults of the device
+var DefaultDriveParams = DriveParams{
+	SelectDelayUS:   1000,
+	StepDelayUS:     5000,
+	MotorDelayMS:    1000,
+	SeekSettleMS:    15,
+	MotorOffDelayMS: 10000,
+}
+
+// Encode drive parameters as big-endian structure
+func (p DriveParams) marshal() []byte {
+	buf := make([]byte, driveParamsSize)
+	binary.BigEndian.PutUint16(buf[0:2], p.SelectDelayUS)
+	binary.BigEndian.PutUint16(buf[2:4], p.StepDelayUS)
+	binary.BigEndian.PutUint16(buf[4:6], p.MotorDelayMS)
+	binary.BigEndian.PutUint16(buf[6:8], p.SeekSettleMS)
+	binary.BigEndian.PutUint16(buf[8:10], p.MotorOffDelayMS)
+	return buf
+}
+
+// SetParams sets drive timing parameters
+func (c *Client) SetParams(params DriveParams) error {
+	err := c.scpSend(SCPCMD_SETPARAMS, params.marshal(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to set parameters: %w", err)
+	}
+	return nil
+}
+
+// Apply user-supplied drive parameters from the drive profile, if any
+func (c *Client) applyDriveProfile() error {
+	if config.StepDelay == 0 && config.Settle == 0 && config.MotorDelay == 0 {
+		return nil
+	}
+
+	params := DefaultDriveParams
+	if config.StepDelay != 0 {
+		params.StepDelayUS = uint16(config.StepDelay)
+	}
+	if config.Settle != 0 {
+		params.SeekSettleMS = uint16(config.Settle)
+	}
+	if config.MotorDelay != 0 {
+		params.MotorDelayMS = uint16(config.MotorDelay)
+	}
+	return c.SetParams(params)
+}
+
+// Most revolutions the device captures per track
+const maxRevolutions = 5
+
+// Options selects drive and number of revolutions.
+// Range of cylinders to read is given by adapter.ReadOpts.
+type Options struct {
+	Drive       uint // Drive number: 0 or 1
+	Revolutions uint // Revolutions to read per track: 1-5
+}
+
+// Default options: drive 0, two revolutions
+var DefaultOptions = Options{
+	Drive:       0,
+	Revolutions: 2,
+}
+
+// SetOptions validates and sets options for subsequent operations
+func (c *Client) SetOptions(opts Options) error {
+	if opts.Drive > 1 {
+		return fmt.Errorf("invalid drive number: %d (must be 0 or 1)", opts.Drive)
+	}
+	if opts.Revolutions < 1 || opts.Revolutions > maxRevolutions {
+		return fmt.Errorf("invalid number of revolutions: %d (must be 1-%d)", opts.Revolutions, maxRevolutions)
+	}
+	if opts.Drive != c.options.Drive {
+		// Motor of the previous drive is turned off
+		c.motor.Off()
+	}
+	c.options = opts
+	return nil
+}
@@ -3,62 +3,19 @@ package supercardpro
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
 
+	"github.com/sergev/floppy/adapter"
 	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/flux"
 	"github.com/sergev/floppy/hfe"
-	"github.com/sergev/floppy/mfm"
 )
 
-// calculateRPMAndBitRate calculates RPM and bit rate from SuperCard Pro flux data
-// Returns the calculated RPM: 300 or 360
-// Returns the calculated bit rate: 250, 500 or 1000 kbps
-func (c *Client) calculateRPMAndBitRate(fluxData *FluxData) (uint16, uint16) {
-	if fluxData.Info[0].IndexTime == 0 {
-		return 300, 250 // Default RPM and bit rate
-	}
-
-	// IndexTime is the duration of one revolution in units of 25ns
-	// Convert to nanoseconds: IndexTime * 25
-	trackDurationNs := uint64(fluxData.Info[0].IndexTime) * 25
-
-	// Calculate RPM: 60 seconds per minute / period in seconds
-	// RPM = 60 / (trackDurationNs / 1e9) = 60 * 1e9 / trackDurationNs
-	rpm := 60e9 / float64(trackDurationNs)
-
-	// Round to either 300 or 360 RPM (standard floppy drive speeds)
-	// Use 330 RPM as the threshold (midpoint between 300 and 360)
-	var roundedRPM uint16
-	if rpm < 330 {
-		roundedRPM = 300
-	} else {
-		roundedRPM = 360
-	}
-
-	// Calculate bit rate from transition count and track duration
-	// Use NrBitcells from flux info as the transition count for the first revolution
-	transitionCount := uint64(fluxData.Info[0].NrBitcells)
+// Sample clock of SuperCard Pro: flux intervals are counted in 25 nsec units
+const scpSampleClockHz = 40e6
 
-	// Calculate bits per millisecond
-	bitsPerMsec := transitionCount * 1e6 / trackDurationNs
-
-	// Round to standard floppy drive bitrates: 250, 500, or 1000 kbps
-	// Use thresholds: < 375 -> 250, < 750 -> 500, >= 750 -> 1000
-	var roundedBitRate uint16
-	if bitsPerMsec < 375 {
-		roundedBitRate = 250
-	} else if bitsPerMsec < 750 {
-		roundedBitRate = 500
-	} else {
-		roundedBitRate = 1000
-	}
-
-	return roundedRPM, roundedBitRate
-}
-
-// decodeFluxToMFM recovers raw MFM bitcells from SuperCard Pro flux data using PLL,
-// and returns MFM bitcells as bytes (bitcells packed MSB-first, not decoded data bits)
-func (c *Client) decodeFluxToMFM(fluxData *FluxData, bitRateKhz uint16) ([]byte, error) {
+// fluxTrack decodes SuperCard Pro flux data of all revolutions into transition
+// and index pulse times in nanoseconds, relative to the first index pulse.
+func fluxTrack(fluxData *FluxData) (*flux.FluxTrack, error) {
 	if len(fluxData.Data) == 0 {
 		return nil, fmt.Errorf("empty flux data")
 	}
@@ -67,104 +24,50 @@ func (c *Client) decodeFluxToMFM(fluxData *FluxData, bitRateKhz uint16) ([]byte,
 		return nil, fmt.Errorf("invalid flux info")
 	}
 
-	// Step 1: Decode SuperCard Pro flux data to get transition times
-	// IndexTime is in units of 25ns, convert to nanoseconds
-	indexTime0Ns := uint64(fluxData.Info[0].IndexTime) * 25
+	track := &flux.FluxTrack{
+		Transitions:   make([]uint64, 0, len(fluxData.Data)/2),
+		IndexPulses:   []uint64{0},
+		SampleClockHz: scpSampleClockHz,
+	}
 
-	var transitions []uint64 // Times in nanoseconds relative to index pulse
-	fluxIntervalNs := uint64(0)
+	// IndexTime is the duration of every revolution in units of 25ns
+	indexNs := uint64(0)
+	for _, info := range fluxData.Info {
+		if info.IndexTime == 0 {
+			break
+		}
+		indexNs += uint64(info.IndexTime) * 25
+		track.IndexPulses = append(track.IndexPulses, indexNs)
+	}
 
 	// Parse 16-bit big-endian flux intervals from the data
-	dataOffset := 0
-	maxOffset := len(fluxData.Data) - 2 // Need at least 2 bytes for a 16-bit value
-
-	for dataOffset < maxOffset {
-		val := binary.BigEndian.Uint16(fluxData.Data[dataOffset : dataOffset+2])
-		dataOffset += 2
-
+	timeNs := uint64(0)
+	for offset := 0; offset+2 <= len(fluxData.Data); offset += 2 {
+		val := binary.BigEndian.Uint16(fluxData.Data[offset : offset+2])
 		if val == 0 {
 			// Overflow: add 0x10000 and continue
-			fluxIntervalNs += 0x10000 * 25
+			timeNs += 0x10000 * 25
 			continue
 		}
 
 		// Add this interval (in 25ns units, convert to nanoseconds)
-		fluxIntervalNs += uint64(val) * 25
-
-		// Only process transitions from the first revolution
-		// Stop when we've exceeded one revolution
-		if fluxIntervalNs > indexTime0Ns {
-			break
-		}
-
-		// Store transition time relative to index pulse
-		transitions = append(transitions, fluxIntervalNs)
+		timeNs += uint64(val) * 25
+		track.Transitions = append(track.Transitions, timeNs)
 	}
 
-	if len(transitions) == 0 {
+	if len(track.Transitions) == 0 {
 		return nil, fmt.Errorf("no flux transitions found")
 	}
+	return track, nil
+}
 
-	// Step 2: Apply PLL to recover clock and generate bitcell boundaries
-	// Create and initialize PLL decoder with transitions
-	decoder := mfm.NewDecoder(transitions, bitRateKhz)
-
-	// Ignore first half-bit (as done in reference implementation)
-	_ = decoder.NextBit()
-
-	// Generate MFM bitcells using PLL algorithm
-	var bitcells []bool
-	for {
-		first := decoder.NextBit()
-		second := decoder.NextBit()
-
-		bitcells = append(bitcells, first)
-		bitcells = append(bitcells, second)
-
-		if decoder.IsDone() {
-			// No more transitions available
-			break
-		}
-	}
-
-	if len(bitcells) == 0 {
-		return nil, fmt.Errorf("no bitcells generated")
-	}
-
-	// Step 3: Pack bitcells as bytes (MSB-first)
-	// Each bitcell becomes one bit in the output
-	var mfmBytes []byte
-	currentByte := byte(0)
-	bitCount := 0
-
-	for _, bit := range bitcells {
-		if bit {
-			currentByte |= 1 << (7 - bitCount)
-		}
-		bitCount++
-
-		// When we have 8 bits, save the byte and start a new one
-		if bitCount == 8 {
-			mfmBytes = append(mfmBytes, currentByte)
-			currentByte = 0
-			bitCount = 0
-		}
-	}
-
-	// Add any remaining partial byte
-	if bitCount > 0 {
-		mfmBytes = append(mfmBytes, currentByte)
-	}
-
-	if len(mfmBytes) == 0 {
-		return nil, fmt.Errorf("no MFM bytes generated")
+// readFluxInfo reads flux for the specified number of revolutions (up to 5)
+// into device RAM, and returns the flux info without the flux data
+func (c *Client) readFluxInfo(nrRevs uint) (*FluxData, error) {
+	if nrRevs < 1 || nrRevs > 5 {
+		return nil, fmt.Errorf("invalid number of revolutions: %d", nrRevs)
 	}
 
-	return mfmBytes, nil
-}
-
-// readFlux reads flux data for the specified number of revolutions
-func (c *Client) readFlux(nrRevs uint) (*FluxData, error) {
 	// Prepare READFLUX command data: [nr_revs, 1] (1 = ignore index)
 	info := []byte{byte(nrRevs), 0}
 	err := c.scpSend(SCPCMD_READFLUX, info, nil)
@@ -180,7 +83,7 @@ func (c *Client) readFlux(nrRevs uint) (*FluxData, error) {
 
 	// Read 40 bytes (5 revolutions × 8 bytes: 4 bytes index_time + 4 bytes nr_bitcells)
 	infoData := make([]byte, 40)
-	_, err = io.ReadFull(c.port, infoData)
+	err = c.receive("GETFLUXINFO data", infoData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read flux info: %w", err)
 	}
@@ -193,21 +96,40 @@ func (c *Client) readFlux(nrRevs uint) (*FluxData, error) {
 		fluxData.Info[i].NrBitcells = binary.BigEndian.Uint32(infoData[offset+4 : offset+8])
 		//fmt.Printf("--- %d: IndexTime = %d, NrBitcells = %d\n", i, fluxData.Info[i].IndexTime, fluxData.Info[i].NrBitcells)
 	}
+	return fluxData, nil
+}
 
-	// Dirty hack to copy all bitcells of one rotation
-	ignoreBitcells := fluxData.Info[0].NrBitcells * 95 / 100
-	NrBitcells := fluxData.Info[1].NrBitcells
+// readFlux reads flux data for the specified number of revolutions.
+// Only the flux samples of the revolutions read are transferred from device RAM,
+// starting at the first index pulse. The flux data is valid until the next call.
+func (c *Client) readFlux(nrRevs uint) (*FluxData, error) {
+	fluxData, err := c.readFluxInfo(nrRevs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every bitcell is stored in RAM as one 16-bit sample
+	length := uint32(0)
+	for i := uint(0); i < nrRevs; i++ {
+		length += fluxData.Info[i].NrBitcells * 2
+	}
+	if length == 0 {
+		return nil, fmt.Errorf("no flux data: %w", adapter.ErrNoIndex)
+	}
+	if length > scpRAMSize {
+		return nil, fmt.Errorf("flux data too long: %d bytes", length)
+	}
 
 	// Prepare RAM transfer command: 2 uint32_t values in big-endian
-	// Offset: 0, Length: up to 512*1024
 	ramCmd := make([]byte, 8)
-	binary.BigEndian.PutUint32(ramCmd[0:4], ignoreBitcells*2) // offset
-	binary.BigEndian.PutUint32(ramCmd[4:8], NrBitcells*2)     // length
-
-	// Allocate buffer for flux data
-	fluxData.Data = make([]byte, NrBitcells*2)
+	binary.BigEndian.PutUint32(ramCmd[0:4], 0)      // offset
+	binary.BigEndian.PutUint32(ramCmd[4:8], length) // length
 
-	// Send SENDRAM_USB command - this will read 512KB into fluxData.Data
+	// Send SENDRAM_USB command, and read the flux data
+	if uint32(cap(c.fluxBuf)) < length {
+		c.fluxBuf = make([]byte, length)
+	}
+	fluxData.Data = c.fluxBuf[:length]
 	err = c.scpSend(SCPCMD_SENDRAM_USB, ramCmd, fluxData.Data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read flux data: %w", err)
@@ -216,20 +138,67 @@ func (c *Client) readFlux(nrRevs uint) (*FluxData, error) {
 	return fluxData, nil
 }
 
-// Read reads the entire floppy disk and returns it as a disk object
-func (c *Client) Read(numberOfTracks int) (*hfe.Disk, error) {
-	// Select drive 0
-	err := c.selectDrive(0)
+// ReadTrack reads one track into memory, and decodes it with
+// rates measured on the track itself, unless forced by ReadOpts
+func (c *Client) ReadTrack(cyl, head int) (*adapter.TrackCapture, error) {
+	if err := c.busy.Begin(); err != nil {
+		return nil, err
+	}
+	defer c.busy.End()
+
+	err := adapter.CheckTrack(cyl, head)
+	if err != nil {
+		return nil, err
+	}
+	err = c.prepareRead()
+	if err != nil {
+		return nil, err
+	}
+	return c.readTrack(&trackReader{single: true}, cyl, head)
+}
+
+// Revolutions to read per track: as requested by the read command,
+// or by client options
+func (c *Client) revolutions() uint {
+	return uint(adapter.ReadOpts.TrackRevolutions(int(c.options.Revolutions)))
+}
+
+// Select the drive, turn on motor and set drive parameters
+func (c *Client) prepareRead() error {
+	err := c.selectDrive(c.options.Drive)
+	if err != nil {
+		return fmt.Errorf("failed to select drive: %w", err)
+	}
+	err = c.applyDriveProfile()
+	if err != nil {
+		return fmt.Errorf("failed to set drive parameters: %w", err)
+	}
+	return nil
+}
+
+// Read reads the entire floppy disk and returns it as a disk object.
+// When w is not nil, every track is also saved to it as soon as it is read.
+func (c *Client) Read(numberOfCylinders int, w *hfe.Writer) (*hfe.Disk, error) {
+	if err := c.busy.Begin(); err != nil {
+		return nil, err
+	}
+	defer c.busy.End()
+
+	// Select drive and turn on motor
+	err := c.prepareRead()
 	if err != nil {
-		return nil, fmt.Errorf("failed to select drive: %w", err)
+		return nil, err
 	}
-	defer c.deselectDrive(0)
+
+	// Range of cylinders and heads to read
+	firstCyl, lastCyl := adapter.ReadOpts.Cylinders(numberOfCylinders)
+	firstHead, lastHead := adapter.ReadOpts.Heads(config.Heads)
 
 	// Initialize disk structure
 	disk := &hfe.Disk{
 		Header: hfe.Header{
-			NumberOfTrack:       uint8(numberOfTracks),
-			NumberOfSide:        uint8(config.Heads),
+			NumberOfTrack:       uint8(numberOfCylinders),
+			NumberOfSide:        uint8(adapter.ReadOpts.NumberOfSides(config.Heads)),
 			TrackEncoding:       hfe.ENC_ISOIBM_MFM,
 			BitRate:             500,              // Will be calculated from flux data
 			FloppyRPM:           300,              // Will be calculated from flux data
@@ -242,55 +211,180 @@ func (c *Client) Read(numberOfTracks int) (*hfe.Disk, error) {
 			Track0S1AltEncoding: 0xFF, // Use default encoding
 			Track0S1Encoding:    hfe.ENC_ISOIBM_MFM,
 		},
-		Tracks: make([]hfe.TrackData, numberOfTracks),
+		Tracks: make([]hfe.TrackData, numberOfCylinders),
 	}
 
-	// Iterate through cylinders and sides
-	for track := uint(0); track < uint(numberOfTracks*config.Heads); track++ {
-		cyl := track >> 1
-		head := track & 1
+	// Bit rate is unknown until the first track is read
+	disk.Header.BitRate = 0
 
-		// Print progress message
-		if track != 0 {
-			fmt.Printf("\rReading track %d, side %d...", cyl, head)
+	// Iterate through cylinders and sides
+	r := &trackReader{}
+	failures := &adapter.TrackFailures{Reconnect: c.resume}
+	for cyl := firstCyl; cyl <= lastCyl; cyl++ {
+		for head := firstHead; head <= lastHead; head++ {
+			// Print progress message
+			if cyl != firstCyl || head != firstHead {
+				fmt.Printf("\rReading track %d, side %d...", cyl, head)
+			}
+
+			err = failures.Read(cyl, head, func() error {
+				capture, err := c.readTrack(r, cyl, head)
+				if err != nil {
+					return err
+				}
+				capture.Store(disk)
+				disk.Header.FloppyRPM, disk.Header.BitRate = r.rates.Disk()
+				r.encoding.Update(disk, capture)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		// Seek to track
-		err = c.seekTrack(track)
-		if err != nil {
-			return nil, fmt.Errorf("failed to seek to track %d: %w", track, err)
+		// Save completed track to the output file
+		if w != nil {
+			w.Header = disk.Header
+			err = w.WriteTrackData(cyl, disk.Tracks[cyl])
+			if err != nil {
+				return nil, fmt.Errorf("failed to save track %d: %w", cyl, err)
+			}
 		}
+	}
+	fmt.Printf("\nRead complete.\n")
+	if report := r.rates.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.recovery.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.recovery.LockReport(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.locks.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.verifier.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.encoding.Report(disk); report != "" {
+		fmt.Println(report)
+	}
+	if report := r.weak.Report(); report != "" {
+		fmt.Println(report)
+	}
+	if report := failures.Report(); report != "" {
+		fmt.Println(report)
+	}
 
-		// Read flux data (1 full revolution)
-		fluxData, err := c.readFlux(1)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read flux data from track %d: %w", track, err)
-		}
+	return disk, failures.Err()
+}
 
-		// Calculate RPM and BitRate from first track (track 0, cylinder 0, head 0)
-		if track == 0 {
-			calculatedRPM, calculatedBitRate := c.calculateRPMAndBitRate(fluxData)
-			fmt.Printf("Rotation Speed: %d RPM\n", calculatedRPM)
-			fmt.Printf("Bit Rate: %d kbps\n", calculatedBitRate)
+// State of reading tracks, shared between tracks of one disk
+type trackReader struct {
+	single   bool   // Reading a single track: rates are measured on it quietly
+	bitRate  uint16 // Bit rate of the track being read, 0 until the first track
+	rpm      uint16 // Rotation speed of the track being read
+	rates    adapter.RateEstimator
+	recovery flux.SpeedRecovery
+	verifier adapter.Verifier
+	locks    adapter.LockLog
+	encoding adapter.EncodingDetector
+	weak     adapter.WeakDetector
+}
 
-			disk.Header.FloppyRPM = calculatedRPM
-			disk.Header.BitRate = calculatedBitRate
-		}
+// Read one track and decode it.
+// Bit rate and RPM of the disk are measured on the first tracks decoded.
+func (c *Client) readTrack(r *trackReader, cyl, head int) (*adapter.TrackCapture, error) {
+	// Seek to track
+	err := c.seekTrack(cyl, head)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to seek: %w", err)}
+	}
 
-		// Decode flux data to MFM bitstream
-		mfmBitstream, err := c.decodeFluxToMFM(fluxData, disk.Header.BitRate)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode flux data to MFM from track %d: %w", track, err)
+	// Read flux data of all requested revolutions
+	fluxData, err := c.readFlux(c.revolutions())
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to read flux data: %w", err)}
+	}
+
+	decoded, err := fluxTrack(fluxData)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to decode flux data: %w", err)}
+	}
+	err = adapter.CheckIndex(decoded)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+	}
+
+	// Calculate RPM and BitRate of the track, unless given by user
+	if r.single {
+		r.rpm, r.bitRate = adapter.ReadOpts.TrackRates(decoded)
+	} else {
+		r.rpm, r.bitRate = r.rates.Rates(decoded)
+	}
+
+	// Pass flux transitions of the first revolution for analysis
+	if adapter.AnalysisEnabled() {
+		if revs := decoded.Revolutions(); len(revs) > 0 {
+			adapter.ReportFlux(cyl, head, revs[0].Transitions)
 		}
+	}
 
-		// Store MFM bitstream in appropriate side
-		if head == 0 {
-			disk.Tracks[cyl].Side0 = mfmBitstream
-		} else {
-			disk.Tracks[cyl].Side1 = mfmBitstream
+	// Decode flux data to MFM bitstream
+	mfmBitstream, adjust, err := r.recovery.DecodeMFM(decoded, r.bitRate)
+	if err != nil {
+		return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to decode flux data to MFM: %w", err)}
+	}
+	if !r.single {
+		r.rates.Add(cyl, head, decoded)
+	}
+	if adjust != 0 {
+		fmt.Printf("\nWarning: track %d, side %d: decoded at %+.1f%% bit rate\n", cyl, head, adjust*100)
+	}
+	if r.recovery.Weak {
+		fmt.Printf("\nWarning: track %d, side %d: weak PLL lock, phase error %.1f%% RMS at %.0f ns period\n",
+			cyl, head, r.recovery.Lock.LockQuality*100, r.recovery.Lock.PeriodNs)
+	}
+
+	// Flux of the first capture is kept, even when verified with new captures
+	capture := &adapter.TrackCapture{
+		Cyl:     cyl,
+		Head:    head,
+		BitRate: r.bitRate,
+		RPM:     r.rpm,
+		Flux:    decoded,
+		Lock:    r.recovery.Lock,
+	}
+
+	// Verify the track with other revolutions of the capture, then with new captures
+	if adapter.ReadOpts.Verify {
+		rev := 0
+		mfmBitstream, err = r.verifier.Track(cyl, head, mfmBitstream, func() ([]byte, error) {
+			rev++
+			if rev < len(decoded.Revolutions()) {
+				return r.recovery.DecodeRevolutionMFM(decoded, rev, r.bitRate, adjust)
+			}
+			fluxData, err := c.readFlux(c.revolutions())
+			if err != nil {
+				return nil, err
+			}
+			decoded, err = fluxTrack(fluxData)
+			if err != nil {
+				return nil, err
+			}
+			rev = 0
+			return r.recovery.DecodeRevolutionMFM(decoded, 0, r.bitRate, adjust)
+		})
+		if err != nil {
+			return nil, &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
 		}
 	}
-	fmt.Printf("\nRead complete.\n")
 
-	return disk, nil
+	// Pass alignment of sectors to the index for analysis
+	adapter.ReportLayout(cyl, head, mfmBitstream, r.bitRate)
+	capture.MFM, capture.Index = adapter.RevolutionMFM(mfmBitstream, r.bitRate, r.rpm)
+	r.weak.Detect(capture)
+	r.locks.Add(capture)
+	return capture, nil
 }
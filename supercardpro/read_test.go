@@ -0,0 +1,294 @@
+package supercardpro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
+)
+
+// Build SuperCard Pro flux data for one HD track.
+func makeTestFluxHD(tb testing.TB) *FluxData {
+	sectors := make([][]byte, 18)
+	for i := range sectors {
+		sectors[i] = make([]byte, 512)
+		for j := range sectors[i] {
+			sectors[i][j] = byte(i + j)
+		}
+	}
+	writer := mfm.NewWriter(200000)
+	track := writer.EncodeTrackIBMPC(sectors, 0, 0, 18, 500)
+	transitions, err := mfm.GenerateFluxTransitions(track, 500)
+	if err != nil {
+		tb.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+
+	fluxData := &FluxData{
+		Data: fluxBytes(encodeFluxToSCP(transitions)),
+	}
+	fluxData.Info[0].IndexTime = uint32(transitions[len(transitions)-1]/25) + 1
+	fluxData.Info[0].NrBitcells = uint32(len(transitions))
+	return fluxData
+}
+
+func TestFluxTrack(t *testing.T) {
+	fluxData := makeTestFluxHD(t)
+
+	track, err := fluxTrack(fluxData)
+	if err != nil {
+		t.Fatalf("fluxTrack failed: %v", err)
+	}
+	if len(track.IndexPulses) != 2 || len(track.Transitions) != int(fluxData.Info[0].NrBitcells) {
+		t.Errorf("decoded %d index pulses, %d transitions", len(track.IndexPulses), len(track.Transitions))
+	}
+	if rpm, rate := track.NominalRPM(), track.EstimateBitRateKbps(); rpm != 300 || rate != 500 {
+		t.Errorf("estimated %d RPM, %d kbps, expected 300 RPM, 500 kbps", rpm, rate)
+	}
+
+	bitcells, err := track.DecodeMFM(500, pll.Config{})
+	if err != nil {
+		t.Fatalf("DecodeMFM failed: %v", err)
+	}
+	if n := mfm.NewReader(bitcells).CountSectorsIBMPC(); n != 18 {
+		t.Errorf("decoded %d sectors, expected 18", n)
+	}
+}
+
+func BenchmarkDecodeFluxToMFM(b *testing.B) {
+	fluxData := makeTestFluxHD(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		track, err := fluxTrack(fluxData)
+		if err != nil {
+			b.Fatalf("fluxTrack failed: %v", err)
+		}
+		_, err = track.DecodeMFM(500, pll.Config{})
+		if err != nil {
+			b.Fatalf("DecodeMFM failed: %v", err)
+		}
+	}
+}
+
+// Queue replies for seek and reading of one track with the given flux data.
+// Seek is SCPCMD_SEEK0 for cylinder 0, or SCPCMD_STEPTO otherwise.
+func writeFluxReplies(port *fakePort, seek byte, fluxData *FluxData) {
+	port.rx.Write([]byte{seek, SCP_STATUS_OK, SCPCMD_SIDE, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_READFLUX, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_GETFLUXINFO, SCP_STATUS_OK})
+	info := make([]byte, 40)
+	binary.BigEndian.PutUint32(info[0:], fluxData.Info[0].IndexTime)
+	binary.BigEndian.PutUint32(info[4:], uint32(len(fluxData.Data)/2))
+	port.rx.Write(info)
+	port.rx.Write(fluxData.Data)
+	port.rx.Write([]byte{SCPCMD_SENDRAM_USB, SCP_STATUS_OK})
+}
+
+func TestReadTrack(t *testing.T) {
+	fluxData := makeTestFluxHD(t)
+	port := &fakePort{}
+	port.rx.Write([]byte{SCPCMD_SELA, SCP_STATUS_OK, SCPCMD_MTRAON, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_SETPARAMS, SCP_STATUS_OK})
+	writeFluxReplies(port, SCPCMD_STEPTO, fluxData)
+
+	// Second read: motor is still running
+	port.rx.Write([]byte{SCPCMD_SETPARAMS, SCP_STATUS_OK})
+	writeFluxReplies(port, SCPCMD_STEPTO, fluxData)
+
+	oldCyls, oldHeads := config.Cyls, config.Heads
+	config.Cyls, config.Heads, config.Settle = 80, 2, 1
+	defer func() { config.Cyls, config.Heads, config.Settle = oldCyls, oldHeads, 0 }()
+
+	c := &Client{port: port, options: DefaultOptions}
+	c.options.Revolutions = 1
+	var buf *byte
+	for i := 0; i < 2; i++ {
+		capture, err := c.ReadTrack(5, 1)
+		if err != nil {
+			t.Fatalf("ReadTrack() error: %v", err)
+		}
+		if capture.Cyl != 5 || capture.Head != 1 || capture.BitRate != 500 || capture.RPM != 300 {
+			t.Errorf("capture of cylinder %d, head %d at %d kbps, %d RPM",
+				capture.Cyl, capture.Head, capture.BitRate, capture.RPM)
+		}
+		if n := mfm.NewReader(capture.MFM).CountSectorsIBMPC(); n != 18 {
+			t.Errorf("decoded %d sectors, expected 18", n)
+		}
+		if capture.Flux == nil || len(capture.Flux.IndexPulses) != 2 {
+			t.Errorf("flux of the capture is missing")
+		}
+
+		// Flux buffer is reused by the next read
+		if i == 0 {
+			buf = &c.fluxBuf[0]
+		} else if buf != &c.fluxBuf[0] {
+			t.Errorf("flux buffer reallocated")
+		}
+	}
+	if port.rx.Len() != 0 {
+		t.Errorf("%d bytes of replies not consumed", port.rx.Len())
+	}
+	if !bytes.HasPrefix(port.tx.Bytes(), makePacket(SCPCMD_SELA)) {
+		t.Errorf("drive A is not selected")
+	}
+
+	// No such track
+	if _, err := c.ReadTrack(80, 0); err == nil {
+		t.Errorf("ReadTrack() accepted cylinder 80")
+	}
+}
+
+// DD disk in a 360 RPM drive is read at 300 kbps
+func TestRead_360RPM(t *testing.T) {
+	sectors := make([][]byte, 9)
+	for i := range sectors {
+		sectors[i] = bytes.Repeat([]byte{byte(i)}, 512)
+	}
+	writer := mfm.NewWriter(300 * 1000 * 60 / 360 * 2)
+	transitions, err := mfm.GenerateFluxTransitions(writer.EncodeTrackIBMPC(sectors, 0, 0, 9, 300), 300)
+	if err != nil {
+		t.Fatalf("GenerateFluxTransitions failed: %v", err)
+	}
+	fluxData := &FluxData{Data: fluxBytes(encodeFluxToSCP(transitions))}
+	fluxData.Info[0].IndexTime = 166666667 / 25
+
+	port := &fakePort{}
+	port.rx.Write([]byte{SCPCMD_SELA, SCP_STATUS_OK, SCPCMD_MTRAON, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_SETPARAMS, SCP_STATUS_OK})
+	writeFluxReplies(port, SCPCMD_SEEK0, fluxData)
+
+	oldHeads := config.Heads
+	config.Heads, config.Settle = 2, 1
+	defer func() { config.Heads, config.Settle = oldHeads, 0 }()
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts = adapter.ReadOptions{Sides: "0", Revolutions: 1}
+
+	// One revolution requested by the read command
+	c := &Client{port: port, options: DefaultOptions}
+	disk, err := c.Read(1, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if disk.Header.BitRate != 300 || disk.Header.FloppyRPM != 360 {
+		t.Errorf("header has %d kbps, %d RPM, expected 300 kbps, 360 RPM",
+			disk.Header.BitRate, disk.Header.FloppyRPM)
+	}
+	if n := mfm.NewReader(disk.Tracks[0].Side0).CountSectorsIBMPC(); n != 9 {
+		t.Errorf("decoded %d sectors, expected 9", n)
+	}
+	if !bytes.Contains(port.tx.Bytes(), makePacket(SCPCMD_READFLUX, 1, 0)) {
+		t.Errorf("flux is not read for one revolution")
+	}
+	if port.rx.Len() != 0 {
+		t.Errorf("%d bytes of replies not consumed", port.rx.Len())
+	}
+}
+
+func TestFluxTrack_Revolutions(t *testing.T) {
+	// Three revolutions with different flux intervals, in units of 25 ns.
+	// Transitions are half an interval away from every index pulse.
+	intervals := []int{80, 120, 160}
+	const perRevolution = 1000
+	fluxData := &FluxData{}
+	prevHalf := 0
+	for r, interval := range intervals {
+		fluxData.Data = binary.BigEndian.AppendUint16(fluxData.Data, uint16(prevHalf+interval/2))
+		for i := 1; i < perRevolution; i++ {
+			fluxData.Data = binary.BigEndian.AppendUint16(fluxData.Data, uint16(interval))
+		}
+		fluxData.Info[r].IndexTime = uint32(perRevolution * interval)
+		fluxData.Info[r].NrBitcells = perRevolution
+		prevHalf = interval / 2
+	}
+
+	track, err := fluxTrack(fluxData)
+	if err != nil {
+		t.Fatalf("fluxTrack failed: %v", err)
+	}
+	revs := track.Revolutions()
+	if len(revs) != 3 {
+		t.Fatalf("decoded %d revolutions, expected 3", len(revs))
+	}
+	for r, rev := range revs {
+		if len(rev.Transitions) != perRevolution {
+			t.Errorf("revolution %d: %d transitions, expected %d", r, len(rev.Transitions), perRevolution)
+		}
+		if want := uint64(perRevolution * intervals[r] * 25); rev.Duration() != want {
+			t.Errorf("revolution %d: duration %d ns, expected %d ns", r, rev.Duration(), want)
+		}
+		if want := uint64(intervals[r] / 2 * 25); rev.Transitions[0] != want {
+			t.Errorf("revolution %d: first transition at %d ns, expected %d ns", r, rev.Transitions[0], want)
+		}
+	}
+}
+
+// drivePort answers every command like a drive with the same HD track
+// on every cylinder, and records cylinders and heads selected
+type drivePort struct {
+	fakePort
+	flux   *FluxData // Track read by READFLUX
+	tracks [][2]int  // Cylinder and head of every side selection
+	cyl    int       // Current position of the head
+}
+
+func (p *drivePort) Write(buf []byte) (int, error) {
+	p.tx.Write(buf)
+	switch buf[0] {
+	case SCPCMD_SEEK0:
+		p.cyl = 0
+	case SCPCMD_STEPTO:
+		p.cyl = int(buf[2])
+	case SCPCMD_SIDE:
+		p.tracks = append(p.tracks, [2]int{p.cyl, int(buf[2])})
+	case SCPCMD_GETFLUXINFO:
+		p.rx.Write([]byte{buf[0], SCP_STATUS_OK})
+		info := make([]byte, 40)
+		binary.BigEndian.PutUint32(info[0:], p.flux.Info[0].IndexTime)
+		binary.BigEndian.PutUint32(info[4:], uint32(len(p.flux.Data)/2))
+		p.rx.Write(info)
+		return len(buf), nil
+	case SCPCMD_SENDRAM_USB:
+		p.rx.Write(p.flux.Data)
+	}
+	p.rx.Write([]byte{buf[0], SCP_STATUS_OK})
+	return len(buf), nil
+}
+
+// Read of 82 cylinders steps to every cylinder once, and reads
+// each of its sides, on drives with one and two heads
+func TestRead_AllCylinders(t *testing.T) {
+	oldCyls, oldHeads := config.Cyls, config.Heads
+	config.Cyls, config.Settle = 82, 1
+	defer func() { config.Cyls, config.Heads, config.Settle = oldCyls, oldHeads, 0 }()
+	fluxData := makeTestFluxHD(t)
+
+	for heads := 1; heads <= 2; heads++ {
+		config.Heads = heads
+		port := &drivePort{flux: fluxData}
+		c := &Client{port: port, options: DefaultOptions}
+		c.options.Revolutions = 1
+		disk, err := c.Read(82, nil)
+		if err != nil {
+			t.Fatalf("%d heads: Read() error: %v", heads, err)
+		}
+		if len(disk.Tracks) != 82 || len(disk.Tracks[81].Side0) == 0 {
+			t.Errorf("%d heads: read %d cylinders, expected 82", heads, len(disk.Tracks))
+		}
+
+		var expected [][2]int
+		for cyl := 0; cyl < 82; cyl++ {
+			for head := 0; head < heads; head++ {
+				expected = append(expected, [2]int{cyl, head})
+			}
+		}
+		if !reflect.DeepEqual(port.tracks, expected) {
+			t.Errorf("%d heads: read tracks %v, expected cylinders 0-81", heads, port.tracks)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package supercardpro
 
 import (
+	"errors"
 	"fmt"
-	"io"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/hfe"
 )
 
 // SCPInfo contains hardware and firmware version information
@@ -25,7 +28,7 @@ func (c *Client) getSCPInfo() (SCPInfo, error) {
 
 	// Read 2 bytes: [hardware_version][firmware_version]
 	response := make([]byte, 2)
-	_, err = io.ReadFull(c.port, response)
+	err = c.receive("SCPINFO data", response)
 	if err != nil {
 		return info, fmt.Errorf("failed to read version info: %w", err)
 	}
@@ -39,32 +42,114 @@ func (c *Client) getSCPInfo() (SCPInfo, error) {
 	return info, nil
 }
 
-// PrintStatus prints SuperCard Pro status information to stdout
-func (c *Client) PrintStatus() {
+// MeasureRPM measures rotation speed over the given number of revolutions.
+// Returns mean speed and its standard deviation, in RPM.
+func (c *Client) MeasureRPM(revolutions int) (float64, float64, error) {
+	if err := c.busy.Begin(); err != nil {
+		return 0, 0, err
+	}
+	defer c.busy.End()
 
-	// Fetch and display hardware and firmware versions
-	info, err := c.getSCPInfo()
+	if revolutions < 1 {
+		return 0, 0, fmt.Errorf("invalid number of revolutions: %d", revolutions)
+	}
+
+	// Use track 0 of the selected drive
+	err := c.selectDrive(c.options.Drive)
 	if err != nil {
-		// Failed to fetch version information
-		fmt.Printf("SuperCard Pro Firmware Version: Unknown\n")
-	} else {
-		fmt.Printf("SuperCard Pro Hardware Version: %d.%d\n", info.HardwareMajor, info.HardwareMinor)
-		fmt.Printf("Firmware Version: %d.%d\n", info.FirmwareMajor, info.FirmwareMinor)
+		return 0, 0, fmt.Errorf("failed to select drive: %w", err)
+	}
+	err = c.seekTrack(0, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to seek: %w", err)
+	}
+
+	// The device reports at most 5 revolutions per read
+	var periods []float64
+	for len(periods) < revolutions {
+		nrRevs := min(revolutions-len(periods), 5)
+		fluxData, err := c.readFluxInfo(uint(nrRevs))
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := 0; i < nrRevs; i++ {
+			// IndexTime is the duration of one revolution in units of 25ns
+			periods = append(periods, float64(fluxData.Info[i].IndexTime)*25)
+		}
+	}
+	return adapter.RPMStats(periods)
+}
+
+// DiskPresent reports whether a disk is inserted, by looking for index pulses.
+// The head is not moved.
+func (c *Client) DiskPresent() (bool, error) {
+	if err := c.busy.Begin(); err != nil {
+		return false, err
+	}
+	defer c.busy.End()
+
+	err := c.selectDrive(c.options.Drive)
+	if err != nil {
+		return false, fmt.Errorf("failed to select drive: %w", err)
+	}
+	return c.diskPresent()
+}
+
+// IsWriteProtected is not supported: write protection is reported
+// only when a write is attempted.
+func (c *Client) IsWriteProtected() (bool, error) {
+	return false, adapter.ErrNotSupported
+}
+
+// Check for index pulses on the selected drive
+func (c *Client) diskPresent() (bool, error) {
+	_, err := c.readFluxInfo(1)
+	if errors.Is(err, adapter.ErrNoIndex) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Before writing: fail when no disk is inserted.
+// The drive must be selected.
+func (c *Client) checkWritable() error {
+	return adapter.CheckWritable(c.diskPresent, c.IsWriteProtected)
+}
+
+// Describe returns identification of the adapter for image manifest
+func (c *Client) Describe() hfe.ManifestDevice {
+	return hfe.ManifestDevice{
+		Adapter:      "SuperCard Pro",
+		SerialNumber: c.serialNumber,
+		Hardware:     fmt.Sprintf("%d.%d", c.info.HardwareMajor, c.info.HardwareMinor),
+		Firmware:     fmt.Sprintf("%d.%d", c.info.FirmwareMajor, c.info.FirmwareMinor),
 	}
+}
+
+// PrintStatus prints SuperCard Pro status information to stdout
+func (c *Client) PrintStatus() {
+	if err := c.busy.Begin(); err != nil {
+		fmt.Printf("Status unavailable: %v\n", err)
+		return
+	}
+	defer c.busy.End()
+
+	// Display hardware and firmware versions, obtained on initialization
+	fmt.Printf("SuperCard Pro Hardware Version: %d.%d\n", c.info.HardwareMajor, c.info.HardwareMinor)
+	fmt.Printf("Firmware Version: %d.%d\n", c.info.FirmwareMajor, c.info.FirmwareMinor)
 	fmt.Printf("Serial Number: %s\n", c.serialNumber)
+	fmt.Printf("Drive Unit: %d\n", c.options.Drive)
 
-	// Check whether drive 0 is connected.
-	// Try to select drive 0 and seek to track 0.
-	selectErr := c.selectDrive(0)
-	seekErr := c.seekTrack(0)
+	// Check whether the drive is connected.
+	// Try to select the drive and seek to track 0.
+	selectErr := c.selectDrive(c.options.Drive)
+	seekErr := c.seekTrack(0, 0)
 	driveIsConnected := (selectErr == nil) && (seekErr == nil)
 
 	if !driveIsConnected {
 		fmt.Printf("Floppy Drive: Not detected\n")
 		// Clean up if we partially succeeded (drive was selected but seek failed)
-		if selectErr == nil {
-			c.deselectDrive(0)
-		}
+		c.motor.Off()
 	} else {
 		fmt.Printf("Floppy Drive: Connected\n")
 		// Measure and display RPM
@@ -73,14 +158,11 @@ func (c *Client) PrintStatus() {
 		fluxData, err := c.readFlux(2)
 		if err == nil {
 			fmt.Printf("Floppy Disk: Inserted\n")
-			rpm, _ := c.calculateRPMAndBitRate(fluxData)
-			if rpm > 0 {
-				fmt.Printf("Rotation Speed: %d RPM\n", rpm)
+			if decoded, err := fluxTrack(fluxData); err == nil {
+				fmt.Printf("Rotation Speed: %d RPM\n", decoded.NominalRPM())
 			}
 		} else {
 			fmt.Printf("Floppy Disk: Not inserted\n")
 		}
-		// Clean up: deselect drive and turn off motor
-		c.deselectDrive(0)
 	}
 }
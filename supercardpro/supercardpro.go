@@ -2,11 +2,14 @@ package supercardpro
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"github.com/sergev/floppy/adapter"
 	"io"
 	"time"
 
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+
 	"go.bug.st/serial"
 	"go.bug.st/serial/enumerator"
 )
@@ -18,6 +21,12 @@ const (
 
 const baudRate = 115200
 
+// Time to wait for response to the initial SCPINFO command
+const handshakeTimeout = 500 * time.Millisecond
+
+// Size of flux data RAM of the device, in bytes
+const scpRAMSize = 512 * 1024
+
 // SCP command codes
 const (
 	SCPCMD_SELA        = 0x80 // select drive A
@@ -40,9 +49,38 @@ const (
 	SCPCMD_SCPINFO     = 0xd0 // get SCP info
 )
 
+// Flags of SCPCMD_WRITEFLUX
+const (
+	SCP_FLAG_INDEX       = 0x01 // wait for index pulse before writing
+	SCP_FLAG_BITCELLSIZE = 0x02 // 8-bit bitcells in RAM, instead of 16-bit
+	SCP_FLAG_WIPE        = 0x04 // wipe track before writing
+)
+
+// Flux data is uploaded to device RAM in parts of this size, in bytes
+const loadRAMChunk = 64 * 1024
+
 // SCP status codes
 const (
-	SCP_STATUS_OK = 0x4f // command successful
+	SCP_STATUS_BAD_COMMAND     = 0x01 // bad command
+	SCP_STATUS_COMMAND_ERR     = 0x02 // command error
+	SCP_STATUS_CHECKSUM        = 0x03 // packet checksum failed
+	SCP_STATUS_TIMEOUT         = 0x04 // USB timeout
+	SCP_STATUS_NO_TRK0         = 0x05 // track 0 not found
+	SCP_STATUS_NO_DRIVE_SEL    = 0x06 // no drive selected
+	SCP_STATUS_NO_MOTOR_SEL    = 0x07 // motor not enabled
+	SCP_STATUS_NOT_READY       = 0x08 // drive not ready
+	SCP_STATUS_NO_INDEX        = 0x09 // no index pulse detected
+	SCP_STATUS_ZERO_REVS       = 0x0a // zero revolutions chosen
+	SCP_STATUS_READ_TOO_LONG   = 0x0b // read data was more than RAM would hold
+	SCP_STATUS_BAD_LENGTH      = 0x0c // invalid length
+	SCP_STATUS_BAD_DATA        = 0x0d // bit cell time is invalid
+	SCP_STATUS_BOUNDARY_ODD    = 0x0e // location boundary is odd
+	SCP_STATUS_WP_ENABLED      = 0x0f // disk is write protected
+	SCP_STATUS_BAD_RAM         = 0x10 // RAM test failed
+	SCP_STATUS_NO_DISK         = 0x11 // no disk in drive
+	SCP_STATUS_BAD_BAUD        = 0x12 // bad baud rate selected
+	SCP_STATUS_BAD_CMD_ON_PORT = 0x13 // bad command for selected output port
+	SCP_STATUS_OK              = 0x4f // command successful
 )
 
 // FluxInfo contains information about a single revolution of flux data
@@ -57,10 +95,24 @@ type FluxData struct {
 	Data []byte      // Flux data (512KB raw bytes from device)
 }
 
+// Port is the serial transport used to talk to the device.
+// It is implemented by serial.Port, and can be replaced by a fake in tests.
+type Port interface {
+	io.ReadWriteCloser
+	SetMode(mode *serial.Mode) error
+	SetReadTimeout(t time.Duration) error
+}
+
 // Client wraps a serial port connection to a SuperCard Pro device
 type Client struct {
-	port         serial.Port
+	port         Port
 	serialNumber string
+	info         SCPInfo              // Hardware and firmware versions
+	options      Options              // Drive, revolutions and cylinders to use
+	openPort     func() (Port, error) // Reopen the port after the device is lost
+	busy         adapter.Busy         // One operation at a time
+	motor        adapter.Motor        // Left running between operations, see selectDrive
+	fluxBuf      []byte               // Flux data of the last readFlux, reused between tracks
 }
 
 func init() {
@@ -72,22 +124,115 @@ func init() {
 func NewClient(portDetails *enumerator.PortDetails) (adapter.FloppyAdapter, error) {
 	// Open the serial port
 	mode := &serial.Mode{
-		BaudRate: 38400,
+		BaudRate: baudRate,
 	}
 	port, err := serial.Open(portDetails.Name, mode)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open serial port %s: %w", portDetails.Name, err)
 	}
 
+	client, err := newClient(port, portDetails.SerialNumber)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	client.openPort = func() (Port, error) {
+		// Port name may change when the device is enumerated again
+		return serial.Open(adapter.FindSerialPort(portDetails.SerialNumber, portDetails.Name), mode)
+	}
+	return client, nil
+}
+
+// newClient initializes the device connected via the given port.
+// The port is not closed on failure.
+func newClient(port Port, serialNumber string) (*Client, error) {
 	client := &Client{
 		port:         port,
-		serialNumber: portDetails.SerialNumber,
+		serialNumber: serialNumber,
+		options:      DefaultOptions,
 	}
+	client.keepMotor()
+	opts := DefaultOptions
+	opts.Drive = uint(config.Unit)
+	if err := client.SetOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := client.handshake(); err != nil {
+		return nil, fmt.Errorf("SuperCard Pro does not respond: %w", err)
+	}
+	return client, nil
+}
 
-	// TODO: Add SuperCard Pro specific initialization when protocol is known
-	// For now, we just open the port and store the connection
+// Flush the link and check that the device is alive:
+// discard pending bytes and request hardware and firmware versions.
+// One retry is made when the device does not answer properly.
+func (c *Client) handshake() error {
+	port := c.port
+	defer func() { c.port = port }()
+	c.port = timeoutPort{port}
 
-	return client, nil
+	err := port.SetReadTimeout(handshakeTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to set read timeout: %w", err)
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		c.drain()
+		c.info, err = c.getSCPInfo()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = port.SetReadTimeout(serial.NoTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to set read timeout: %w", err)
+	}
+	return nil
+}
+
+// Discard bytes left in the link from a previous session
+func (c *Client) drain() {
+	buf := make([]byte, 256)
+	for {
+		n, err := c.port.Read(buf)
+		if n == 0 || err != nil {
+			return
+		}
+	}
+}
+
+// Port which reports an empty read as timeout,
+// instead of returning zero bytes without error.
+type timeoutPort struct {
+	Port
+}
+
+func (p timeoutPort) Read(buf []byte) (int, error) {
+	n, err := p.Port.Read(buf)
+	if n == 0 && err == nil {
+		return 0, errors.New("timeout")
+	}
+	return n, err
+}
+
+// statusError converts an SCP status byte to an error.
+// Statuses with a generic meaning wrap the corresponding adapter error.
+func statusError(status byte) error {
+	switch status {
+	case SCP_STATUS_OK:
+		return nil
+	case SCP_STATUS_NO_TRK0:
+		return adapter.ErrNoTrack0
+	case SCP_STATUS_NO_INDEX, SCP_STATUS_NO_DISK:
+		return adapter.ErrNoIndex
+	case SCP_STATUS_READ_TOO_LONG:
+		return adapter.ErrOverflow
+	case SCP_STATUS_WP_ENABLED:
+		return adapter.ErrWriteProtected
+	}
+	return fmt.Errorf("status 0x%02x", status)
 }
 
 // scpSend sends a command to the SuperCard Pro device using the SCP protocol
@@ -118,16 +263,17 @@ func (c *Client) scpSend(cmd byte, data []byte, readData []byte) error {
 	packet[2+dataLen] = checksum
 
 	// Write packet to serial port
-	_, err := c.port.Write(packet)
+	name := commandName(cmd)
+	err := c.send(name, packet)
 	if err != nil {
-		return fmt.Errorf("failed to write command packet: %w", err)
+		return fmt.Errorf("failed to write command packet: %w", adapter.SerialError(err))
 	}
 
 	// Special handling for SENDRAM_USB: read 512KB before reading response
 	if cmd == SCPCMD_SENDRAM_USB && readData != nil {
-		_, err = io.ReadFull(c.port, readData)
+		err = c.receive("RAM data", readData)
 		if err != nil {
-			return fmt.Errorf("failed to read RAM data: %w", err)
+			return fmt.Errorf("failed to read RAM data: %w", adapter.SerialError(err))
 		}
 	}
 
@@ -138,9 +284,9 @@ func (c *Client) scpSend(cmd byte, data []byte, readData []byte) error {
 
 	// Read response: [cmd_echo][status]
 	response := make([]byte, 2)
-	_, err = io.ReadFull(c.port, response)
+	err = c.receive(name+" response", response)
 	if err != nil {
-		return fmt.Errorf("failed to read command response: %w", err)
+		return fmt.Errorf("failed to read command response: %w", adapter.SerialError(err))
 	}
 
 	// Validate echo matches sent command
@@ -150,14 +296,33 @@ func (c *Client) scpSend(cmd byte, data []byte, readData []byte) error {
 
 	// Check status
 	if response[1] != SCP_STATUS_OK {
-		return fmt.Errorf("command failed with status 0x%02x", response[1])
+		return fmt.Errorf("command 0x%02x failed: %w", cmd, statusError(response[1]))
 	}
 
 	return nil
 }
 
-// selectDrive selects a drive and turns on its motor
+// Longest time the motor is left running between operations.
+// The device turns the motor off by itself after MotorOffDelayMS.
+const MotorIdleLimit = 9 * time.Second
+
+// Leave the drive selected with motor running between operations,
+// until idle time expires
+func (c *Client) keepMotor() {
+	c.motor.Stop = func() error {
+		return c.deselectDrive(c.options.Drive)
+	}
+	c.motor.MaxIdle = MotorIdleLimit
+	c.busy.Motor = &c.motor
+}
+
+// selectDrive selects a drive and turns on its motor,
+// unless it is left running by the previous operation
 func (c *Client) selectDrive(drive uint) error {
+	if c.motor.Running() {
+		return nil
+	}
+
 	// Select drive (SELA for drive 0, SELB for drive 1)
 	var cmd byte = SCPCMD_SELA
 	if drive == 1 {
@@ -177,7 +342,7 @@ func (c *Client) selectDrive(drive uint) error {
 	if err != nil {
 		return fmt.Errorf("failed to turn on motor for drive %d: %w", drive, err)
 	}
-
+	c.motor.SetRunning(true)
 	return nil
 }
 
@@ -206,11 +371,14 @@ func (c *Client) deselectDrive(drive uint) error {
 	return nil
 }
 
-// seekTrack seeks to the specified track
-func (c *Client) seekTrack(track uint) error {
-	// Calculate cylinder and side
-	cyl := track >> 1
-	side := track & 1
+// seekTrack moves the head to the given cylinder, and selects the side
+func (c *Client) seekTrack(cyl, head int) error {
+	if cyl < 0 || cyl >= config.MaxCyls {
+		return fmt.Errorf("invalid cylinder %d (must be 0-%d): %w", cyl, config.MaxCyls-1, adapter.ErrBadCylinder)
+	}
+	if head < 0 || head > 1 {
+		return fmt.Errorf("invalid head %d (must be 0 or 1)", head)
+	}
 
 	// Seek to cylinder
 	if cyl == 0 {
@@ -219,46 +387,43 @@ func (c *Client) seekTrack(track uint) error {
 			return fmt.Errorf("failed to seek to track 0: %w", err)
 		}
 	} else {
-		cylByte := byte(cyl)
-		err := c.scpSend(SCPCMD_STEPTO, []byte{cylByte}, nil)
+		err := c.scpSend(SCPCMD_STEPTO, []byte{byte(cyl)}, nil)
 		if err != nil {
 			return fmt.Errorf("failed to step to cylinder %d: %w", cyl, err)
 		}
 	}
 
 	// Select side
-	sideByte := byte(side)
-	err := c.scpSend(SCPCMD_SIDE, []byte{sideByte}, nil)
+	err := c.scpSend(SCPCMD_SIDE, []byte{byte(head)}, nil)
 	if err != nil {
-		return fmt.Errorf("failed to select side %d: %w", side, err)
+		return fmt.Errorf("failed to select side %d: %w", head, err)
 	}
 
 	// Apply seek settle delay (20ms default, simplified - no step_delay_ms subtraction)
-	time.Sleep(20 * time.Millisecond)
+	settle := 20 * time.Millisecond
+	if config.Settle != 0 {
+		settle = time.Duration(config.Settle) * time.Millisecond
+	}
+	time.Sleep(settle)
 
 	return nil
 }
 
-// loadRAM loads flux data into device RAM buffer
-// fluxData should be uint16 samples (big-endian), total length = nrSamples * 2 bytes
-func (c *Client) loadRAM(fluxData []byte) error {
-	if len(fluxData)%2 != 0 {
-		return fmt.Errorf("flux data length must be even (uint16 samples)")
+// loadRAM loads flux data into device RAM buffer at the given offset.
+// Data are uint16 samples (big-endian), so length and offset must be even.
+func (c *Client) loadRAM(offset uint32, fluxData []byte) error {
+	if len(fluxData)%2 != 0 || offset%2 != 0 {
+		return fmt.Errorf("flux data length and offset must be even (uint16 samples)")
 	}
 
-	// Build LOADRAM_USB command header: [offset(be32), length(be32)]
-	// The command packet contains only the 8-byte header [cmd, len=8, offset, length, checksum]
-	// Then we write the actual data separately
-	ramCmdHeader := make([]byte, 8)
-	binary.BigEndian.PutUint32(ramCmdHeader[0:4], 0)                     // offset = 0
-	binary.BigEndian.PutUint32(ramCmdHeader[4:8], uint32(len(fluxData))) // length
-
-	// Build command packet manually: [cmd][len][data...][checksum]
-	// We need to send the command packet, then the data, then read the response
+	// Build LOADRAM_USB command packet: [cmd][len=8][offset(be32), length(be32)][checksum]
+	ramCmd := make([]byte, 8)
+	binary.BigEndian.PutUint32(ramCmd[0:4], offset)
+	binary.BigEndian.PutUint32(ramCmd[4:8], uint32(len(fluxData)))
 	packet := make([]byte, 3+8)
 	packet[0] = SCPCMD_LOADRAM_USB
 	packet[1] = 8 // length of header data
-	copy(packet[2:10], ramCmdHeader)
+	copy(packet[2:10], ramCmd)
 
 	// Calculate checksum: 0x4a + sum of cmd, len, and data bytes
 	checksum := byte(0x4a)
@@ -268,22 +433,22 @@ func (c *Client) loadRAM(fluxData []byte) error {
 	packet[10] = checksum
 
 	// Write command packet to serial port
-	_, err := c.port.Write(packet)
+	err := c.send("LOADRAM_USB", packet)
 	if err != nil {
-		return fmt.Errorf("failed to write LOADRAM_USB command packet: %w", err)
+		return fmt.Errorf("failed to write LOADRAM_USB command packet: %w", adapter.SerialError(err))
 	}
 
 	// Write the actual flux data (device expects this immediately after command packet)
-	_, err = c.port.Write(fluxData)
+	err = c.send("RAM data", fluxData)
 	if err != nil {
-		return fmt.Errorf("failed to write flux data: %w", err)
+		return fmt.Errorf("failed to write flux data: %w", adapter.SerialError(err))
 	}
 
 	// Read the response (cmd_echo, status) that comes after the data
 	response := make([]byte, 2)
-	_, err = io.ReadFull(c.port, response)
+	err = c.receive("LOADRAM_USB response", response)
 	if err != nil {
-		return fmt.Errorf("failed to read command response: %w", err)
+		return fmt.Errorf("failed to read command response: %w", adapter.SerialError(err))
 	}
 
 	// Validate echo matches sent command
@@ -293,30 +458,110 @@ func (c *Client) loadRAM(fluxData []byte) error {
 
 	// Check status
 	if response[1] != SCP_STATUS_OK {
-		return fmt.Errorf("LOADRAM_USB command failed with status 0x%02x", response[1])
+		return fmt.Errorf("LOADRAM_USB command failed: %w", statusError(response[1]))
 	}
 
 	return nil
 }
 
-// Write flux data with wipe track flag enabled
-// nrSamples is the number of uint16 flux samples
-// nrRevs is the number of revolutions to write (1 for erase, typically 2-5 for normal writes)
-func (c *Client) writeFlux(nrSamples uint32, nrRevs uint8) error {
-	// Build WRITEFLUX command: [nr_samples(be32), nr_revs]
-	// nr_revs: number of revolutions to write (1 = faster erase, 5 = multiple revolutions)
+// uploadFlux loads flux cells into device RAM, in parts of loadRAMChunk bytes.
+// Cells which do not fit into RAM give ErrOverflow, and nothing is sent.
+func (c *Client) uploadFlux(fluxCells []uint16) error {
+	if len(fluxCells) == 0 {
+		return fmt.Errorf("no flux data to write")
+	}
+	if len(fluxCells)*2 > scpRAMSize {
+		return fmt.Errorf("flux data of %d bytes exceeds %d KB of device RAM: %w",
+			len(fluxCells)*2, scpRAMSize/1024, adapter.ErrOverflow)
+	}
+	data := fluxBytes(fluxCells)
+	for offset := 0; offset < len(data); offset += loadRAMChunk {
+		err := c.loadRAM(uint32(offset), data[offset:min(offset+loadRAMChunk, len(data))])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRAM writes the first nrCells flux cells of device RAM to the track,
+// wiping it first. With cueIndex, writing starts at the index pulse.
+// Flux data is written once: it must cover the whole revolution.
+func (c *Client) writeRAM(nrCells uint32, cueIndex bool) error {
+	// Build WRITEFLUX command: [nr_bitcells(be32), flags]
 	writeCmd := make([]byte, 5)
-	binary.BigEndian.PutUint32(writeCmd[0:4], nrSamples) // number of flux samples
-	writeCmd[4] = nrRevs                                 // number of revolutions
+	binary.BigEndian.PutUint32(writeCmd[0:4], nrCells)
+	writeCmd[4] = SCP_FLAG_WIPE
+	if cueIndex {
+		writeCmd[4] |= SCP_FLAG_INDEX
+	}
 
 	err := c.scpSend(SCPCMD_WRITEFLUX, writeCmd, nil)
 	if err != nil {
-		return fmt.Errorf("failed to write flux with wipe: %w", err)
+		return fmt.Errorf("failed to write flux: %w", err)
+	}
+	return nil
+}
+
+// writeFlux loads flux cells of 25ns units into device RAM, and writes
+// them to the track at current position
+func (c *Client) writeFlux(fluxCells []uint16, cueIndex bool) error {
+	err := c.uploadFlux(fluxCells)
+	if err != nil {
+		return err
 	}
+	return c.writeRAM(uint32(len(fluxCells)), cueIndex)
+}
 
+// Reconnect to the device after it dropped off the bus, and restore
+// state of the read session: selected drive with motor on, and drive
+// parameters. The head is moved to track 0, as its position is unknown.
+func (c *Client) resume() error {
+	if c.openPort == nil {
+		return fmt.Errorf("port cannot be reopened")
+	}
+	c.port.Close()
+	err := adapter.Reopen(func() error {
+		port, err := c.openPort()
+		if err != nil {
+			return err
+		}
+		c.port = port
+		err = c.handshake()
+		if err != nil {
+			port.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.motor.SetRunning(false)
+	err = c.selectDrive(c.options.Drive)
+	if err != nil {
+		return fmt.Errorf("failed to select drive: %w", err)
+	}
+	err = c.applyDriveProfile()
+	if err != nil {
+		return fmt.Errorf("failed to set drive parameters: %w", err)
+	}
+	err = c.scpSend(SCPCMD_SEEK0, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to seek to track 0: %w", err)
+	}
 	return nil
 }
 
+// StopMotor turns off the motor left running after the last operation,
+// and deselects the drive
+func (c *Client) StopMotor() error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+	return c.motor.Off()
+}
+
 // Close closes the serial port connection
 func (c *Client) Close() error {
 	if c.port != nil {
@@ -325,7 +570,19 @@ func (c *Client) Close() error {
 	return nil
 }
 
-// Format formats the floppy disk
+// Format is not supported: disks are formatted by writing an image
 func (c *Client) Format() error {
-	return fmt.Errorf("Format() not yet implemented for SuperCard Pro adapter")
+	return fmt.Errorf("format %w", adapter.ErrNotSupported)
+}
+
+// Capabilities reports what the adapter can do
+func (c *Client) Capabilities() adapter.Capability {
+	return adapter.Capability{
+		CanRead:        true,
+		CanWrite:       true,
+		CanWriteFlux:   true,
+		CanErase:       true,
+		MaxRevolutions: maxRevolutions,
+		MaxCylinders:   config.MaxCyls,
+	}
 }
@@ -0,0 +1,514 @@
+package supercardpro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+	"go.bug.st/serial"
+)
+
+// fakePort is an in-memory serial port replaying canned device responses.
+type fakePort struct {
+	rx    bytes.Buffer // Data to be returned by the device
+	tx    bytes.Buffer // Data sent by the host
+	modes []int        // Baud rates set by the host
+}
+
+func (p *fakePort) Read(buf []byte) (int, error) {
+	if p.rx.Len() == 0 {
+		return 0, io.EOF
+	}
+	return p.rx.Read(buf)
+}
+
+func (p *fakePort) Write(buf []byte) (int, error) {
+	return p.tx.Write(buf)
+}
+
+func (p *fakePort) Close() error {
+	return nil
+}
+
+func (p *fakePort) SetMode(mode *serial.Mode) error {
+	p.modes = append(p.modes, mode.BaudRate)
+	return nil
+}
+
+func (p *fakePort) SetReadTimeout(t time.Duration) error {
+	return nil
+}
+
+// Build command packet as expected from the host.
+func makePacket(cmd byte, data ...byte) []byte {
+	packet := append([]byte{cmd, byte(len(data))}, data...)
+	checksum := byte(0x4a)
+	for _, b := range packet {
+		checksum += b
+	}
+	return append(packet, checksum)
+}
+
+func TestScpSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     byte
+		data    []byte
+		rx      []byte
+		wantErr bool
+	}{
+		{"select A", SCPCMD_SELA, nil, []byte{SCPCMD_SELA, SCP_STATUS_OK}, false},
+		{"step to", SCPCMD_STEPTO, []byte{40}, []byte{SCPCMD_STEPTO, SCP_STATUS_OK}, false},
+		{"bad status", SCPCMD_SEEK0, nil, []byte{SCPCMD_SEEK0, 0x03}, true},
+		{"echo mismatch", SCPCMD_SIDE, []byte{1}, []byte{SCPCMD_SELA, SCP_STATUS_OK}, true},
+		{"no response", SCPCMD_MTRAON, nil, nil, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			port := &fakePort{}
+			port.rx.Write(tc.rx)
+			c := &Client{port: port}
+
+			err := c.scpSend(tc.cmd, tc.data, nil)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("scpSend() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			want := makePacket(tc.cmd, tc.data...)
+			if !bytes.Equal(port.tx.Bytes(), want) {
+				t.Errorf("sent % x, expected % x", port.tx.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		status byte
+		want   error
+	}{
+		{SCP_STATUS_NO_TRK0, adapter.ErrNoTrack0},
+		{SCP_STATUS_NO_INDEX, adapter.ErrNoIndex},
+		{SCP_STATUS_NO_DISK, adapter.ErrNoIndex},
+		{SCP_STATUS_READ_TOO_LONG, adapter.ErrOverflow},
+		{SCP_STATUS_WP_ENABLED, adapter.ErrWriteProtected},
+	}
+	for _, tc := range tests {
+		port := &fakePort{}
+		port.rx.Write([]byte{SCPCMD_SEEK0, tc.status})
+		c := &Client{port: port}
+
+		err := c.scpSend(SCPCMD_SEEK0, nil, nil)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("status 0x%02x: error = %v, expected %v", tc.status, err, tc.want)
+		}
+	}
+
+	err := statusError(SCP_STATUS_CHECKSUM)
+	if err == nil || adapter.IsRetryable(err) {
+		t.Errorf("statusError(SCP_STATUS_CHECKSUM) = %v, expected fatal error", err)
+	}
+}
+
+func TestGetSCPInfo(t *testing.T) {
+	port := &fakePort{}
+	port.rx.Write([]byte{SCPCMD_SCPINFO, SCP_STATUS_OK, 0x14, 0x25})
+	c := &Client{port: port}
+
+	info, err := c.getSCPInfo()
+	if err != nil {
+		t.Fatalf("getSCPInfo() error: %v", err)
+	}
+	if info != (SCPInfo{HardwareMajor: 1, HardwareMinor: 4, FirmwareMajor: 2, FirmwareMinor: 5}) {
+		t.Errorf("getSCPInfo() = %+v", info)
+	}
+	if want := makePacket(SCPCMD_SCPINFO); !bytes.Equal(port.tx.Bytes(), want) {
+		t.Errorf("sent % x, expected % x", port.tx.Bytes(), want)
+	}
+}
+
+// replyPort answers only after a command is sent, like a real device.
+type replyPort struct {
+	fakePort
+	replies [][]byte // Response to each write
+}
+
+func (p *replyPort) Write(buf []byte) (int, error) {
+	if len(p.replies) > 0 {
+		p.rx.Write(p.replies[0])
+		p.replies = p.replies[1:]
+	}
+	return p.fakePort.Write(buf)
+}
+
+func TestNewClient(t *testing.T) {
+	info := []byte{SCPCMD_SCPINFO, SCP_STATUS_OK, 0x14, 0x25}
+	tests := []struct {
+		name    string
+		stale   []byte
+		replies [][]byte
+		sent    int
+		wantErr bool
+	}{
+		{"clean link", nil, [][]byte{info}, 1, false},
+		{"stale bytes", []byte{0x4f, 0x00, 0x12}, [][]byte{info}, 1, false},
+		{"retry", nil, [][]byte{{SCPCMD_SELA, SCP_STATUS_OK}, info}, 2, false},
+		{"no device", nil, nil, 2, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			port := &replyPort{replies: tc.replies}
+			port.rx.Write(tc.stale)
+
+			c, err := newClient(port, "SN1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("newClient() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			want := bytes.Repeat(makePacket(SCPCMD_SCPINFO), tc.sent)
+			if !bytes.Equal(port.tx.Bytes(), want) {
+				t.Errorf("sent % x, expected % x", port.tx.Bytes(), want)
+			}
+			if err != nil {
+				return
+			}
+			if c.info != (SCPInfo{HardwareMajor: 1, HardwareMinor: 4, FirmwareMajor: 2, FirmwareMinor: 5}) {
+				t.Errorf("info = %+v", c.info)
+			}
+			if _, ok := c.port.(*replyPort); !ok {
+				t.Errorf("port was not restored")
+			}
+		})
+	}
+}
+
+func TestReadFlux(t *testing.T) {
+	const nrBitcells = 100
+	port := &fakePort{}
+
+	// READFLUX and GETFLUXINFO responses
+	port.rx.Write([]byte{SCPCMD_READFLUX, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_GETFLUXINFO, SCP_STATUS_OK})
+	info := make([]byte, 40)
+	for i := 0; i < 2; i++ {
+		binary.BigEndian.PutUint32(info[i*8:], 8000000)
+		binary.BigEndian.PutUint32(info[i*8+4:], nrBitcells)
+	}
+	port.rx.Write(info)
+
+	// SENDRAM data of both revolutions followed by response
+	flux := make([]byte, 2*nrBitcells*2)
+	for i := 0; i < 2*nrBitcells; i++ {
+		binary.BigEndian.PutUint16(flux[i*2:], uint16(80+i))
+	}
+	port.rx.Write(flux)
+	port.rx.Write([]byte{SCPCMD_SENDRAM_USB, SCP_STATUS_OK})
+
+	c := &Client{port: port}
+	fluxData, err := c.readFlux(2)
+	if err != nil {
+		t.Fatalf("readFlux() error: %v", err)
+	}
+	if fluxData.Info[0].IndexTime != 8000000 || fluxData.Info[1].NrBitcells != nrBitcells {
+		t.Errorf("unexpected flux info %+v", fluxData.Info)
+	}
+	if !bytes.Equal(fluxData.Data, flux) {
+		t.Errorf("flux data mismatch")
+	}
+
+	// Verify command sequence
+	var want []byte
+	want = append(want, makePacket(SCPCMD_READFLUX, 2, 0)...)
+	want = append(want, makePacket(SCPCMD_GETFLUXINFO)...)
+	ram := make([]byte, 8)
+	binary.BigEndian.PutUint32(ram[0:4], 0)
+	binary.BigEndian.PutUint32(ram[4:8], 2*nrBitcells*2)
+	want = append(want, makePacket(SCPCMD_SENDRAM_USB, ram...)...)
+	if !bytes.Equal(port.tx.Bytes(), want) {
+		t.Errorf("sent % x, expected % x", port.tx.Bytes(), want)
+	}
+}
+
+func TestMeasureRPM(t *testing.T) {
+	port := &fakePort{}
+	port.rx.Write([]byte{SCPCMD_SELA, SCP_STATUS_OK, SCPCMD_MTRAON, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_SEEK0, SCP_STATUS_OK, SCPCMD_SIDE, SCP_STATUS_OK})
+
+	// Seven revolutions of 200 msec are read as 5 + 2
+	for _, nrRevs := range []int{5, 2} {
+		port.rx.Write([]byte{SCPCMD_READFLUX, SCP_STATUS_OK})
+		port.rx.Write([]byte{SCPCMD_GETFLUXINFO, SCP_STATUS_OK})
+		info := make([]byte, 40)
+		for i := 0; i < nrRevs; i++ {
+			binary.BigEndian.PutUint32(info[i*8:], 8000000)
+		}
+		port.rx.Write(info)
+	}
+
+	c := &Client{port: port}
+	mean, stddev, err := c.MeasureRPM(7)
+	if err != nil {
+		t.Fatalf("MeasureRPM() error: %v", err)
+	}
+	if mean != 300 || stddev != 0 {
+		t.Errorf("MeasureRPM() = %.3f, %.3f, expected 300, 0", mean, stddev)
+	}
+	if port.rx.Len() != 0 {
+		t.Errorf("%d response bytes left unread", port.rx.Len())
+	}
+}
+
+func TestSetParams(t *testing.T) {
+	port := &fakePort{}
+	port.rx.Write([]byte{SCPCMD_SETPARAMS, SCP_STATUS_OK})
+
+	c := &Client{port: port}
+	if err := c.SetParams(DefaultDriveParams); err != nil {
+		t.Fatalf("SetParams() error: %v", err)
+	}
+	want := makePacket(SCPCMD_SETPARAMS, 0x03, 0xe8, 0x13, 0x88, 0x03, 0xe8, 0x00, 0x0f, 0x27, 0x10)
+	if !bytes.Equal(port.tx.Bytes(), want) {
+		t.Errorf("sent % x, expected % x", port.tx.Bytes(), want)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	c := &Client{options: DefaultOptions}
+	for _, opts := range []Options{
+		{Drive: 2, Revolutions: 2},
+		{Drive: 0, Revolutions: 0},
+		{Drive: 0, Revolutions: 6},
+	} {
+		if err := c.SetOptions(opts); err == nil {
+			t.Errorf("SetOptions(%+v) accepted invalid options", opts)
+		}
+	}
+	opts := Options{Drive: 1, Revolutions: 5}
+	if err := c.SetOptions(opts); err != nil || c.options != opts {
+		t.Errorf("SetOptions(%+v) error: %v", opts, err)
+	}
+}
+
+// Queue replies for seek and reading of one track with a single revolution.
+func writeTrackReplies(port *fakePort, nrBitcells int) {
+	port.rx.Write([]byte{SCPCMD_STEPTO, SCP_STATUS_OK, SCPCMD_SIDE, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_READFLUX, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_GETFLUXINFO, SCP_STATUS_OK})
+	info := make([]byte, 40)
+	binary.BigEndian.PutUint32(info[0:], 8000000)
+	binary.BigEndian.PutUint32(info[4:], uint32(nrBitcells))
+	port.rx.Write(info)
+	flux := make([]byte, nrBitcells*2)
+	for i := 0; i < nrBitcells; i++ {
+		binary.BigEndian.PutUint16(flux[i*2:], 80)
+	}
+	port.rx.Write(flux)
+	port.rx.Write([]byte{SCPCMD_SENDRAM_USB, SCP_STATUS_OK})
+}
+
+func TestReadRange(t *testing.T) {
+	const nrBitcells = 100
+	port := &fakePort{}
+	port.rx.Write([]byte{SCPCMD_SELB, SCP_STATUS_OK, SCPCMD_MTRBON, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_SETPARAMS, SCP_STATUS_OK})
+
+	// Cylinder 1 only, a single revolution per side
+	for head := 0; head < 2; head++ {
+		writeTrackReplies(port, nrBitcells)
+	}
+	port.rx.Write([]byte{SCPCMD_MTRBOFF, SCP_STATUS_OK, SCPCMD_DSELB, SCP_STATUS_OK})
+
+	oldHeads := config.Heads
+	config.Heads, config.Settle = 2, 1
+	defer func() { config.Heads, config.Settle = oldHeads, 0 }()
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts.StartTrack, adapter.ReadOpts.EndTrack = 1, 1
+	c := &Client{port: port}
+	c.keepMotor()
+	if err := c.SetOptions(Options{Drive: 1, Revolutions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := c.Read(80, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if len(disk.Tracks[0].Side0) != 0 || len(disk.Tracks[1].Side0) == 0 || len(disk.Tracks[1].Side1) == 0 {
+		t.Errorf("expected only cylinder 1 to be read")
+	}
+	if err := c.StopMotor(); err != nil {
+		t.Fatalf("StopMotor() error: %v", err)
+	}
+	if port.rx.Len() != 0 {
+		t.Errorf("%d bytes of replies not consumed", port.rx.Len())
+	}
+
+	// Drive B is selected, and deselected when the motor is stopped
+	sent := port.tx.Bytes()
+	selectB := append(makePacket(SCPCMD_SELB), makePacket(SCPCMD_MTRBON)...)
+	deselectB := append(makePacket(SCPCMD_MTRBOFF), makePacket(SCPCMD_DSELB)...)
+	if !bytes.HasPrefix(sent, selectB) || !bytes.HasSuffix(sent, deselectB) {
+		t.Errorf("sent % x, expected select and deselect of drive B", sent)
+	}
+}
+
+func TestNewClient_DriveUnit(t *testing.T) {
+	defer func() { config.Unit = 0 }()
+	info := []byte{SCPCMD_SCPINFO, SCP_STATUS_OK, 0x14, 0x25}
+
+	config.Unit = 1
+	c, err := newClient(&replyPort{replies: [][]byte{info}}, "SN1")
+	if err != nil {
+		t.Fatalf("newClient() error: %v", err)
+	}
+	if c.options.Drive != 1 {
+		t.Errorf("drive %d, expected 1", c.options.Drive)
+	}
+
+	config.Unit = 2
+	if _, err := newClient(&replyPort{replies: [][]byte{info}}, "SN1"); err == nil {
+		t.Errorf("newClient() accepted drive unit 2")
+	}
+}
+
+func TestReadSides(t *testing.T) {
+	port := &fakePort{}
+	port.rx.Write([]byte{SCPCMD_SELA, SCP_STATUS_OK, SCPCMD_MTRAON, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_SETPARAMS, SCP_STATUS_OK})
+
+	// Side 1 of cylinders 2 and 3
+	for cyl := 2; cyl <= 3; cyl++ {
+		writeTrackReplies(port, 100)
+	}
+
+	oldHeads := config.Heads
+	config.Heads, config.Settle = 2, 1
+	defer func() { config.Heads, config.Settle = oldHeads, 0 }()
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts = adapter.ReadOptions{StartTrack: 2, EndTrack: 3, Sides: "1"}
+
+	c := &Client{port: port, options: DefaultOptions}
+	disk, err := c.Read(4, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	for cyl, track := range disk.Tracks {
+		if len(track.Side0) != 0 || (len(track.Side1) != 0) != (cyl >= 2) {
+			t.Errorf("cylinder %d: side 0 %d bytes, side 1 %d bytes", cyl, len(track.Side0), len(track.Side1))
+		}
+	}
+	if port.rx.Len() != 0 {
+		t.Errorf("%d bytes of replies not consumed", port.rx.Len())
+	}
+}
+
+func TestReadReconnect(t *testing.T) {
+	// Device drops off the bus while seeking to the second track
+	lost := &fakePort{}
+	lost.rx.Write([]byte{SCPCMD_SELA, SCP_STATUS_OK, SCPCMD_MTRAON, SCP_STATUS_OK})
+	lost.rx.Write([]byte{SCPCMD_SETPARAMS, SCP_STATUS_OK})
+	writeTrackReplies(lost, 100)
+	lost.rx.Write([]byte{SCPCMD_STEPTO, SCP_STATUS_OK})
+
+	// New port answers handshake, then restores the session and reads the track
+	session := &fakePort{}
+	session.rx.Write([]byte{SCPCMD_SELA, SCP_STATUS_OK, SCPCMD_MTRAON, SCP_STATUS_OK})
+	session.rx.Write([]byte{SCPCMD_SETPARAMS, SCP_STATUS_OK})
+	session.rx.Write([]byte{SCPCMD_SEEK0, SCP_STATUS_OK})
+	writeTrackReplies(session, 100)
+	info := []byte{SCPCMD_SCPINFO, SCP_STATUS_OK, 0x14, 0x25}
+	found := &replyPort{replies: [][]byte{info, session.rx.Bytes()}}
+
+	oldHeads := config.Heads
+	config.Heads, config.Settle = 2, 1
+	defer func() { config.Heads, config.Settle = oldHeads, 0 }()
+	defer func(opts adapter.ReadOptions) { adapter.ReadOpts = opts }(adapter.ReadOpts)
+	adapter.ReadOpts = adapter.ReadOptions{StartTrack: 2, EndTrack: 3, Sides: "1", MaxReconnects: 1}
+	defer func(delay time.Duration) { adapter.ReconnectDelay = delay }(adapter.ReconnectDelay)
+	adapter.ReconnectDelay = time.Millisecond
+
+	c := &Client{port: lost, options: DefaultOptions}
+	c.openPort = func() (Port, error) { return found, nil }
+	disk, err := c.Read(4, nil)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	for cyl := 2; cyl <= 3; cyl++ {
+		if len(disk.Tracks[cyl].Side1) == 0 {
+			t.Errorf("cylinder %d, side 1 is empty", cyl)
+		}
+	}
+	if c.port != found || found.rx.Len() != 0 {
+		t.Errorf("%d bytes of replies not consumed after reconnect", found.rx.Len())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var events []adapter.TraceEvent
+	adapter.SetTraceFunc(func(event adapter.TraceEvent) { events = append(events, event) })
+	defer adapter.SetTraceFunc(nil)
+
+	port := &fakePort{}
+	port.rx.Write([]byte{SCPCMD_STEPTO, SCP_STATUS_OK})
+	port.rx.Write([]byte{SCPCMD_SCPINFO, SCP_STATUS_OK, 0x10, 0x15})
+	c := &Client{port: port}
+
+	err := c.scpSend(SCPCMD_STEPTO, []byte{40}, nil)
+	if err != nil {
+		t.Fatalf("scpSend() error = %v", err)
+	}
+	_, err = c.getSCPInfo()
+	if err != nil {
+		t.Fatalf("getSCPInfo() error = %v", err)
+	}
+
+	want := []struct {
+		dir     adapter.TraceDirection
+		command string
+		data    []byte
+	}{
+		{adapter.TraceToDevice, "STEPTO", makePacket(SCPCMD_STEPTO, 40)},
+		{adapter.TraceFromDevice, "STEPTO response", []byte{SCPCMD_STEPTO, SCP_STATUS_OK}},
+		{adapter.TraceToDevice, "SCPINFO", makePacket(SCPCMD_SCPINFO)},
+		{adapter.TraceFromDevice, "SCPINFO response", []byte{SCPCMD_SCPINFO, SCP_STATUS_OK}},
+		{adapter.TraceFromDevice, "SCPINFO data", []byte{0x10, 0x15}},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, expected %d: %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Adapter != "supercardpro" || e.Direction != w.dir || e.Command != w.command || !bytes.Equal(e.Data, w.data) {
+			t.Errorf("event %d: %s %s %q % x, expected %s %q % x",
+				i, e.Adapter, e.Direction, e.Command, e.Data, w.dir, w.command, w.data)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	var _ adapter.FloppyAdapter = (*Client)(nil)
+
+	c := &Client{port: &fakePort{}, options: DefaultOptions}
+	caps := c.Capabilities()
+	if !caps.CanRead || !caps.CanWrite || !caps.CanErase || caps.CanFormat || caps.MaxRevolutions != 5 ||
+		caps.SensesDiskChange || caps.SensesWriteProtect {
+		t.Errorf("Capabilities() = %+v", caps)
+	}
+	if err := c.Format(); !errors.Is(err, adapter.ErrNotSupported) {
+		t.Errorf("Format() error = %v, expected not supported", err)
+	}
+
+	// Revolutions beyond the reported limit are refused
+	opts := DefaultOptions
+	opts.Revolutions = uint(caps.MaxRevolutions)
+	if err := c.SetOptions(opts); err != nil {
+		t.Errorf("SetOptions() with %d revolutions: %v", opts.Revolutions, err)
+	}
+	opts.Revolutions++
+	if err := c.SetOptions(opts); err == nil {
+		t.Errorf("SetOptions() accepted %d revolutions", opts.Revolutions)
+	}
+}
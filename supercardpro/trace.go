@@ -0,0 +1,58 @@
+package supercardpro
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sergev/floppy/adapter"
+)
+
+// Adapter name in trace events
+const traceName = "supercardpro"
+
+// Names of commands in trace events
+var commandNames = map[byte]string{
+	SCPCMD_SELA:        "SELA",
+	SCPCMD_SELB:        "SELB",
+	SCPCMD_DSELA:       "DSELA",
+	SCPCMD_DSELB:       "DSELB",
+	SCPCMD_MTRAON:      "MTRAON",
+	SCPCMD_MTRBON:      "MTRBON",
+	SCPCMD_MTRAOFF:     "MTRAOFF",
+	SCPCMD_MTRBOFF:     "MTRBOFF",
+	SCPCMD_SEEK0:       "SEEK0",
+	SCPCMD_STEPTO:      "STEPTO",
+	SCPCMD_SIDE:        "SIDE",
+	SCPCMD_SETPARAMS:   "SETPARAMS",
+	SCPCMD_READFLUX:    "READFLUX",
+	SCPCMD_GETFLUXINFO: "GETFLUXINFO",
+	SCPCMD_WRITEFLUX:   "WRITEFLUX",
+	SCPCMD_SENDRAM_USB: "SENDRAM_USB",
+	SCPCMD_LOADRAM_USB: "LOADRAM_USB",
+	SCPCMD_SCPINFO:     "SCPINFO",
+}
+
+// Name of command code, like "SCPINFO"
+func commandName(code byte) string {
+	if name, ok := commandNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("CMD_0x%02x", code)
+}
+
+// Write bytes to the device, and trace them
+func (c *Client) send(command string, data []byte) error {
+	start := time.Now()
+	_, err := c.port.Write(data)
+	adapter.Trace(traceName, adapter.TraceToDevice, command, data, start, err)
+	return err
+}
+
+// Read a reply of known size from the device, and trace it
+func (c *Client) receive(command string, buf []byte) error {
+	start := time.Now()
+	n, err := io.ReadFull(c.port, buf)
+	adapter.Trace(traceName, adapter.TraceFromDevice, command, buf[:n], start, err)
+	return err
+}
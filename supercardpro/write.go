@@ -2,17 +2,22 @@ package supercardpro
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 
-	"github.com/sergev/floppy/config"
+	"github.com/sergev/floppy/adapter"
 	"github.com/sergev/floppy/hfe"
 	"github.com/sergev/floppy/mfm"
+	"github.com/sergev/floppy/pll"
 )
 
-// Encode flux transition times into SuperCard Pro flux format.
+// Shortest flux interval accepted for raw flux writes, nsec
+const minWriteFluxNs = 400
+
+// Encode flux transition times into SuperCard Pro flux cells.
 // Transitions are relative times in nanoseconds, converted to intervals in 25ns units.
-func encodeFluxToSCP(transitions []uint64) []byte {
-	var result []byte
+func encodeFluxToSCP(transitions []uint64) []uint16 {
+	var result []uint16
 
 	// Convert transitions to intervals
 	lastTime := uint64(0)
@@ -26,7 +31,7 @@ func encodeFluxToSCP(transitions []uint64) []byte {
 		// Handle overflow: if interval >= 0x10000, emit 0x0000 and subtract 0x10000
 		for interval25ns >= 0x10000 {
 			// Emit overflow marker (0x0000)
-			result = append(result, 0x00, 0x00)
+			result = append(result, 0)
 			interval25ns -= 0x10000
 		}
 
@@ -34,11 +39,7 @@ func encodeFluxToSCP(transitions []uint64) []byte {
 		if interval25ns == 0 {
 			interval25ns = 1
 		}
-
-		// Emit interval as big-endian uint16
-		intervalBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(intervalBytes, uint16(interval25ns))
-		result = append(result, intervalBytes...)
+		result = append(result, uint16(interval25ns))
 
 		lastTime = transitionTime
 	}
@@ -46,67 +47,86 @@ func encodeFluxToSCP(transitions []uint64) []byte {
 	return result
 }
 
+// Flux cells as stored in device RAM: big-endian uint16 samples
+func fluxBytes(fluxCells []uint16) []byte {
+	data := make([]byte, len(fluxCells)*2)
+	for i, cell := range fluxCells {
+		binary.BigEndian.PutUint16(data[i*2:], cell)
+	}
+	return data
+}
+
 // Write writes data from the disk object to the floppy disk
-func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
-	// Select drive 0 and turn on motor
-	err := c.selectDrive(0)
+func (c *Client) Write(disk *hfe.Disk, numberOfCylinders int) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	err := adapter.WriteOpts.CheckImage(disk)
+	if err != nil {
+		return err
+	}
+
+	// Select the drive and turn on motor
+	err = c.selectDrive(c.options.Drive)
 	if err != nil {
 		return fmt.Errorf("failed to select drive: %w", err)
 	}
-	defer c.deselectDrive(0) // Deselect drive and turn off motor when done
+	err = c.checkWritable()
+	if err != nil {
+		return err
+	}
 
 	// Iterate through cylinders and heads
-	for cyl := 0; cyl < numberOfTracks; cyl++ {
+	for cyl := 0; cyl < numberOfCylinders; cyl++ {
 		for head := 0; head < int(disk.Header.NumberOfSide); head++ {
-			// Calculate track number
-			track := uint(cyl*config.Heads + head)
-
 			// Seek to track
-			err = c.seekTrack(track)
+			err = c.seekTrack(cyl, head)
 			if err != nil {
-				return fmt.Errorf("failed to seek to track %d: %w", track, err)
+				return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to seek: %w", err)}
 			}
 
-			// Get MFM bitcells from track data
-			var mfmBits []byte
-			if head == 0 {
-				mfmBits = disk.Tracks[cyl].Side0
-			} else {
-				mfmBits = disk.Tracks[cyl].Side1
+			// Get MFM bitcells from track data, starting at the index
+			trackData := disk.Tracks[cyl].FromIndex()
+			mfmBits := trackData.Side0
+			if head == 1 {
+				mfmBits = trackData.Side1
 			}
 
 			// Convert MFM bitcells to flux transitions
-			transitions, err := mfm.GenerateFluxTransitions(mfmBits, disk.Header.BitRate)
+			// with write precompensation of inner tracks
+			bitRate := disk.TrackBitRate(cyl)
+			intervals, err := mfm.FluxIntervals(mfmBits, mfm.CellPeriodNs(bitRate), adapter.WriteOpts.PrecompTable(bitRate), cyl)
 			if err != nil {
-				return fmt.Errorf("failed to convert MFM to flux transitions for cylinder %d, head %d: %w", cyl, head, err)
+				return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to convert MFM to flux transitions: %w", err)}
 			}
+			transitions := mfm.IntervalsToTransitions(intervals)
 
 			// Extend transitions to cover full rotation
-			transitions = mfm.CoverFullRotation(transitions, disk.Header.BitRate, disk.Header.FloppyRPM)
+			transitions = mfm.CoverFullRotation(transitions, bitRate, disk.Header.FloppyRPM)
 
 			// Encode flux transitions to SuperCard Pro format
-			fluxData := encodeFluxToSCP(transitions)
-			nrSamples := uint32(len(fluxData) / 2)
+			fluxCells := encodeFluxToSCP(transitions)
 
 			// Retry several times
+			var lastErr error
 			for retry := 0; ; retry++ {
 				if retry >= 5 {
-					return fmt.Errorf("failed to write track %d, side %d", cyl, head)
+					return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("too many retries: %w", lastErr)}
 				}
 				fmt.Printf("\r  Writing track %d, side %d...", cyl, head)
 
-				// Load flux data into RAM
-				err = c.loadRAM(fluxData)
-				if err != nil {
-					// Failed to load flux data
-					fmt.Printf("Error %s\n", err.Error())
-					continue
-				}
-
-				// Write flux (2-5 revolutions for normal writes, use 2 as default)
-				err = c.writeFlux(nrSamples, 2)
+				// Load flux data into RAM, and write it from the index
+				err = c.writeFlux(fluxCells, true)
 				if err != nil {
+					// Write protection is not going to go away,
+					// and the track is not going to fit into RAM
+					if errors.Is(err, adapter.ErrWriteProtected) || errors.Is(err, adapter.ErrOverflow) {
+						return &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+					}
 					// Failed to write flux data
+					lastErr = err
 					fmt.Printf("Error %s\n", err.Error())
 					continue
 				}
@@ -118,14 +138,23 @@ func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
 					fluxResult, err := c.readFlux(2)
 					if err != nil {
 						// Failed to read flux data
+						lastErr = err
 						fmt.Printf("Error %s\n", err.Error())
 						continue
 					}
 
 					// Decode flux data to MFM bitstream
-					bitsResult, err := c.decodeFluxToMFM(fluxResult, disk.Header.BitRate)
+					decoded, err := fluxTrack(fluxResult)
+					if err != nil {
+						// Failed to decode flux data
+						lastErr = err
+						fmt.Printf("Error %s\n", err.Error())
+						continue
+					}
+					bitsResult, err := decoded.DecodeMFM(disk.TrackBitRate(cyl), pll.Config{})
 					if err != nil {
 						// Failed to decode flux data to MFM
+						lastErr = err
 						fmt.Printf("Error %s\n", err.Error())
 						continue
 					}
@@ -134,6 +163,7 @@ func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
 					err = disk.VerifyTrack(cyl, head, bitsResult)
 					if err != nil {
 						// Data mismatch
+						lastErr = err
 						fmt.Printf("Error %s\n", err.Error())
 						continue
 					}
@@ -148,3 +178,46 @@ func (c *Client) Write(disk *hfe.Disk, numberOfTracks int) error {
 
 	return nil
 }
+
+// Write raw flux to one track.
+// Transitions are intervals between flux reversals, in nanoseconds.
+// Writing starts at the index pulse when cueToIndex is set,
+// or right away otherwise.
+func (c *Client) WriteTrackFlux(cyl, head int, transitions []uint64, cueToIndex bool) error {
+	if err := c.busy.Begin(); err != nil {
+		return err
+	}
+	defer c.busy.End()
+
+	err := adapter.CheckFluxIntervals(transitions, minWriteFluxNs)
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+	}
+
+	// Encode intervals to SuperCard Pro format
+	fluxCells := encodeFluxToSCP(mfm.IntervalsToTransitions(transitions))
+	if len(fluxCells)*2 > scpRAMSize {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("flux data of %d bytes exceeds %d KB of device RAM: %w",
+			len(fluxCells)*2, scpRAMSize/1024, adapter.ErrOverflow)}
+	}
+
+	// Select the drive and turn on motor
+	err = c.selectDrive(c.options.Drive)
+	if err != nil {
+		return fmt.Errorf("failed to select drive: %w", err)
+	}
+	err = c.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	err = c.seekTrack(cyl, head)
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: fmt.Errorf("failed to seek: %w", err)}
+	}
+	err = c.writeFlux(fluxCells, cueToIndex)
+	if err != nil {
+		return &adapter.TrackError{Cyl: cyl, Head: head, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package supercardpro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/sergev/floppy/adapter"
+	"github.com/sergev/floppy/config"
+)
+
+func TestEncodeFluxToSCP(t *testing.T) {
+	// 2 usec = 80 units of 25 ns, 4 usec = 160 units,
+	// 2 msec = 80000 units = overflow + 14464
+	transitions := []uint64{2000, 6000, 2006000}
+	expected := []byte{0x00, 0x50, 0x00, 0xA0, 0x00, 0x00, 0x38, 0x80}
+	if got := fluxBytes(encodeFluxToSCP(transitions)); !bytes.Equal(got, expected) {
+		t.Errorf("flux % x, expected % x", got, expected)
+	}
+}
+
+func TestWriteFlux(t *testing.T) {
+	// Flux cells of one chunk and three more
+	cells := make([]uint16, loadRAMChunk/2+3)
+	for i := range cells {
+		cells[i] = uint16(80 + i%3*40)
+	}
+	data := fluxBytes(cells)
+
+	port := &fakePort{}
+	port.rx.Write([]byte{SCPCMD_LOADRAM_USB, SCP_STATUS_OK, SCPCMD_LOADRAM_USB, SCP_STATUS_OK, SCPCMD_WRITEFLUX, SCP_STATUS_OK})
+	c := &Client{port: port}
+	if err := c.writeFlux(cells, true); err != nil {
+		t.Fatalf("writeFlux() error: %v", err)
+	}
+
+	// RAM is loaded in two parts, then written from the index with wipe
+	var want []byte
+	want = append(want, makePacket(SCPCMD_LOADRAM_USB, 0, 0, 0, 0, 0, 1, 0, 0)...)
+	want = append(want, data[:loadRAMChunk]...)
+	want = append(want, makePacket(SCPCMD_LOADRAM_USB, 0, 1, 0, 0, 0, 0, 0, 6)...)
+	want = append(want, data[loadRAMChunk:]...)
+	want = append(want, makePacket(SCPCMD_WRITEFLUX, 0, 0, 0x80, 0x03, SCP_FLAG_INDEX|SCP_FLAG_WIPE)...)
+	if got := port.tx.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("sent %d bytes, expected %d:\nstart % x\n  end % x\nexpected end % x",
+			len(got), len(want), got[:min(len(got), 16)], got[max(0, len(got)-16):], want[len(want)-16:])
+	}
+}
+
+func TestWriteFlux_Errors(t *testing.T) {
+	// Track which does not fit into RAM is rejected, and nothing is sent
+	port := &fakePort{}
+	c := &Client{port: port}
+	err := c.writeFlux(make([]uint16, scpRAMSize/2+1), true)
+	if !errors.Is(err, adapter.ErrOverflow) {
+		t.Errorf("writeFlux() error = %v, expected ErrOverflow", err)
+	}
+	if port.tx.Len() != 0 {
+		t.Errorf("sent %d bytes, expected nothing", port.tx.Len())
+	}
+
+	// Write protection is reported by status of WRITEFLUX
+	port.rx.Write([]byte{SCPCMD_LOADRAM_USB, SCP_STATUS_OK, SCPCMD_WRITEFLUX, SCP_STATUS_WP_ENABLED})
+	err = c.writeFlux([]uint16{80, 120, 160}, false)
+	if !errors.Is(err, adapter.ErrWriteProtected) {
+		t.Errorf("writeFlux() error = %v, expected ErrWriteProtected", err)
+	}
+	want := makePacket(SCPCMD_WRITEFLUX, 0, 0, 0, 3, SCP_FLAG_WIPE)
+	if got := port.tx.Bytes(); !bytes.HasSuffix(got, want) {
+		t.Errorf("sent % x, expected WRITEFLUX % x", got[max(0, len(got)-len(want)):], want)
+	}
+
+	// Bad checksum of LOADRAM_USB is reported by the device
+	port = &fakePort{}
+	port.rx.Write([]byte{SCPCMD_LOADRAM_USB, SCP_STATUS_CHECKSUM})
+	c = &Client{port: port}
+	if err := c.writeFlux([]uint16{80}, true); err == nil {
+		t.Errorf("writeFlux() accepted checksum error")
+	}
+}
+
+func TestWriteTrackFlux_Invalid(t *testing.T) {
+	defer func(rpm int) { config.RPM = rpm }(config.RPM)
+	config.RPM = 360
+
+	// Nothing may be sent to the device
+	port := &fakePort{}
+	c := &Client{port: port}
+	for _, transitions := range [][]uint64{
+		{2000, 300, 4000}, // too short
+		{100e6, 75e6},     // longer than one revolution
+	} {
+		err := c.WriteTrackFlux(1, 0, transitions, true)
+		var trackErr *adapter.TrackError
+		if !errors.As(err, &trackErr) || trackErr.Cyl != 1 {
+			t.Errorf("%v: error = %v, expected TrackError", transitions, err)
+		}
+	}
+	if port.tx.Len() != 0 {
+		t.Errorf("sent % x, expected nothing", port.tx.Bytes())
+	}
+}
+
+func TestWriteTrackFlux(t *testing.T) {
+	for _, cue := range []bool{true, false} {
+		port := &fakePort{}
+		port.rx.Write([]byte{SCPCMD_SELA, SCP_STATUS_OK, SCPCMD_MTRAON, SCP_STATUS_OK})
+
+		// Disk is present: flux of one revolution with index
+		port.rx.Write([]byte{SCPCMD_READFLUX, SCP_STATUS_OK, SCPCMD_GETFLUXINFO, SCP_STATUS_OK})
+		info := make([]byte, 40)
+		binary.BigEndian.PutUint32(info[0:], 8000000)
+		binary.BigEndian.PutUint32(info[4:], 50000)
+		port.rx.Write(info)
+
+		port.rx.Write([]byte{SCPCMD_STEPTO, SCP_STATUS_OK, SCPCMD_SIDE, SCP_STATUS_OK})
+		port.rx.Write([]byte{SCPCMD_LOADRAM_USB, SCP_STATUS_OK, SCPCMD_WRITEFLUX, SCP_STATUS_OK})
+		c := &Client{port: port}
+		if err := c.WriteTrackFlux(5, 1, []uint64{2000, 4000, 20000}, cue); err != nil {
+			t.Fatalf("cue %v: WriteTrackFlux() error: %v", cue, err)
+		}
+
+		// Writing starts at the index pulse only when cued
+		flags := byte(SCP_FLAG_WIPE)
+		if cue {
+			flags |= SCP_FLAG_INDEX
+		}
+		want := makePacket(SCPCMD_WRITEFLUX, 0, 0, 0, 3, flags)
+		if got := port.tx.Bytes(); !bytes.HasSuffix(got, want) {
+			t.Errorf("cue %v: sent % x, expected WRITEFLUX % x", cue, got[max(0, len(got)-len(want)):], want)
+		}
+	}
+}